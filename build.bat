@@ -9,7 +9,9 @@ call set_gopath.bat
 
 if not exist "%cd%\bin" mkdir "%cd%\bin"
 
-for %%i in (bsondump, mongostat, mongofiles, mongoexport, mongoimport, mongorestore, mongodump, mongotop) do (
+REM mongoreplay links against wpcap: the Npcap SDK (or the WinPcap developer's
+REM pack) must be extracted to C:\WpdPack, and Npcap installed to run it.
+for %%i in (bsondump, mongostat, mongofiles, mongoexport, mongoimport, mongorestore, mongodump, mongotop, mongoreplay) do (
 	echo Building %%i
 
 	go build -o "%cd%\bin\%%i.exe" "%cd%\%%i\main\%%i.go"
@@ -0,0 +1,255 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"crypto/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// fanOutOps sends every op received from in to each of the n returned
+// channels, giving all but the first a copy of the op so that they can be
+// played independently. Sending blocks until every channel has received the
+// op, so that none gets ahead of the others.
+func fanOutOps(ctx context.Context, in <-chan *RecordedOp, n int) []<-chan *RecordedOp {
+	outs := make([]chan *RecordedOp, n)
+	results := make([]<-chan *RecordedOp, n)
+	for i := range outs {
+		outs[i] = make(chan *RecordedOp)
+		results[i] = outs[i]
+	}
+	go func() {
+		defer func() {
+			for _, out := range outs {
+				close(out)
+			}
+		}()
+		for {
+			var op *RecordedOp
+			select {
+			case <-ctx.Done():
+				return
+			case next, ok := <-in:
+				if !ok {
+					return
+				}
+				op = next
+			}
+			// the copies are made before the op is sent, as it is changed
+			// while it is played
+			sent := []*RecordedOp{op}
+			for range outs[1:] {
+				sent = append(sent, copyRecordedOp(op))
+			}
+			for i, out := range outs {
+				select {
+				case <-ctx.Done():
+					return
+				case out <- sent[i]:
+				}
+			}
+		}
+	}()
+	return results
+}
+
+// amplifiedStatRecorder shares the StatRecorder of an amplified playback
+// between the StatCollectors of its copies. Closing the recorder of the
+// first copy waits for the other copies to finish playing, then closes the
+// shared recorder; closing those of the other copies does nothing.
+type amplifiedStatRecorder struct {
+	lock     *sync.Mutex
+	recorder StatRecorder
+	copies   *sync.WaitGroup
+}
+
+func (rec amplifiedStatRecorder) RecordStat(stat *OpStat) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	rec.recorder.RecordStat(stat)
+}
+
+func (rec amplifiedStatRecorder) Flush() error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if flusher, ok := rec.recorder.(StatFlusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func (rec amplifiedStatRecorder) RecordConnectionSummaries(summaries []*ConnectionSummary) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if summaryRecorder, ok := rec.recorder.(ConnectionSummaryRecorder); ok {
+		summaryRecorder.RecordConnectionSummaries(summaries)
+	}
+}
+
+func (rec amplifiedStatRecorder) Close() error {
+	if rec.copies == nil {
+		return nil
+	}
+	rec.copies.Wait()
+	return rec.recorder.Close()
+}
+
+// amplifyStatCollector returns the StatCollectors of the n copies of an
+// amplified playback, the first of which is statColl, all recording to the
+// StatRecorder of statColl. copies must be marked done as each of the other
+// copies finishes playing.
+func amplifyStatCollector(statColl *StatCollector, n int, copies *sync.WaitGroup) []*StatCollector {
+	collectors := []*StatCollector{statColl}
+	if statColl.noop {
+		for len(collectors) < n {
+			collectors = append(collectors, &StatCollector{noop: true})
+		}
+		return collectors
+	}
+	lock := &sync.Mutex{}
+	shared := statColl.StatRecorder
+	statColl.StatRecorder = amplifiedStatRecorder{lock: lock, recorder: shared, copies: copies}
+	for len(collectors) < n {
+		collectors = append(collectors, &StatCollector{
+			StatGenerator:  &ComparativeStatGenerator{},
+			StatRecorder:   amplifiedStatRecorder{lock: lock, recorder: shared},
+			statStreamSize: statColl.statStreamSize,
+			flushInterval:  statColl.flushInterval,
+		})
+	}
+	return collectors
+}
+
+// absorb adds the ops played, errors and latencies of a copy of an amplified
+// playback to those of the context, once the copy has finished playing.
+func (context *ExecutionContext) absorb(other *ExecutionContext) {
+	context.errors.merge(&other.errors)
+	context.connections.merge(&other.connections)
+	if context.cursorLeaks != nil && other.cursorLeaks != nil {
+		context.cursorLeaks.merge(other.cursorLeaks)
+	}
+	other.latencies.Lock()
+	context.latencies.Lock()
+	context.latencies.histogram.Merge(&other.latencies.histogram)
+	context.latencies.Unlock()
+	other.latencies.Unlock()
+	atomic.AddInt64(&context.blockedOps, other.BlockedOps())
+	atomic.AddInt64(&context.dryRunOps, other.DryRunOps())
+	atomic.AddInt64(&context.filteredOps, other.FilteredOps())
+	atomic.AddInt64(&context.retriedOps, other.RetriedOps())
+	atomic.AddInt64(&context.abandonedOps, other.AbandonedOps())
+	atomic.AddInt64(&context.skippedGetMores, other.SkippedGetMores())
+	atomic.AddInt64(&context.reissuedQueries, other.ReissuedQueries())
+	atomic.AddInt64(&context.brokenConnectionOps, other.BrokenConnectionOps())
+	atomic.AddInt64(&context.translatedOps, other.TranslatedOps())
+	atomic.AddInt64(&context.droppedGetLastErrors, other.DroppedGetLastErrors())
+	atomic.AddInt64(&context.downconvertedOps, other.DownconvertedOps())
+	atomic.AddInt64(&context.unacknowledgedWrites, other.UnacknowledgedWrites())
+	atomic.AddInt64(&context.exhaustBatches, other.ExhaustBatches())
+	atomic.AddInt64(&context.truncatedWaits, other.TruncatedWaits())
+	atomic.AddInt64(&context.budgetSpentGetMores, other.BudgetSpentGetMores())
+	atomic.AddInt64(&context.remappedResumeTokens, other.RemappedResumeTokens())
+	atomic.AddInt64(&context.restartedChangeStreams, other.RestartedChangeStreams())
+}
+
+// sessionRemapper implements the PreOpHook interface, replacing the id of
+// the logical session of every command with one of its own, so that the
+// copies of a connection don't share sessions and transactions with the
+// original. Each recorded session is replaced with the same new session
+// throughout the playback.
+type sessionRemapper struct {
+	sync.Mutex
+	ids map[string][]byte
+}
+
+func newSessionRemapper() *sessionRemapper {
+	return &sessionRemapper{ids: map[string][]byte{}}
+}
+
+func (remapper *sessionRemapper) BeforeOp(op *RecordedOp, parsedOp Op) error {
+	switch castOp := parsedOp.(type) {
+	case *QueryOp:
+		if !strings.HasSuffix(castOp.Collection, "$cmd") {
+			return nil
+		}
+		query, err := bsonToD(castOp.Query)
+		if err != nil {
+			return err
+		}
+		if lsid, ok := remapper.remap(query); ok {
+			castOp.Query = setDocField(query, "lsid", lsid)
+		}
+	case *CommandOp:
+		args, err := bsonToD(castOp.CommandArgs)
+		if err != nil {
+			return err
+		}
+		if lsid, ok := remapper.remap(args); ok {
+			castOp.CommandArgs = setDocField(args, "lsid", lsid)
+		}
+	case *MsgOp:
+		body, _, err := fetchPayload0Data(castOp.Sections)
+		if err != nil {
+			return err
+		}
+		doc, err := bsonToD(body)
+		if err != nil {
+			return err
+		}
+		if lsid, ok := remapper.remap(doc); ok {
+			return setMsgOpField(castOp, "lsid", lsid)
+		}
+	}
+	return nil
+}
+
+// remap returns the lsid replacing that of the command, if it has one.
+func (remapper *sessionRemapper) remap(command bson.D) (bson.D, bool) {
+	value, ok := FindValueByKey("lsid", &command)
+	if !ok {
+		return nil, false
+	}
+	lsid, err := bsonToD(value)
+	if err != nil {
+		return nil, false
+	}
+	id, ok := FindValueByKey("id", &lsid)
+	if !ok {
+		return nil, false
+	}
+	binary, ok := id.(bson.Binary)
+	if !ok {
+		return nil, false
+	}
+	remapper.Lock()
+	newID, ok := remapper.ids[string(binary.Data)]
+	if !ok {
+		newID = newSessionID()
+		remapper.ids[string(binary.Data)] = newID
+	}
+	remapper.Unlock()
+	remapped := make(bson.D, len(lsid))
+	copy(remapped, lsid)
+	return setDocField(remapped, "id", bson.Binary{Kind: binary.Kind, Data: newID}), true
+}
+
+// newSessionID returns a random version 4 UUID, as drivers use for the ids
+// of logical sessions.
+func newSessionID() []byte {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return id
+}
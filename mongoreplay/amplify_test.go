@@ -0,0 +1,166 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	gocontext "context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestFanOutOps(t *testing.T) {
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	defer cancel()
+	in := make(chan *RecordedOp)
+	outs := fanOutOps(ctx, in, 3)
+
+	go func() {
+		for i := int64(1); i <= 3; i++ {
+			in <- &RecordedOp{RawOp: RawOp{Body: []byte{byte(i)}}, Order: i}
+		}
+		close(in)
+	}()
+	for i := int64(1); i <= 3; i++ {
+		seen := map[*RecordedOp]bool{}
+		for j, out := range outs {
+			op := <-out
+			if op.Order != i {
+				t.Fatalf("expected op %v on channel %v, saw %v", i, j, op.Order)
+			}
+			seen[op] = true
+		}
+		if len(seen) != len(outs) {
+			t.Errorf("expected op %v to be copied for each channel", i)
+		}
+	}
+	for j, out := range outs {
+		if _, ok := <-out; ok {
+			t.Errorf("expected channel %v to be closed", j)
+		}
+	}
+}
+
+func TestAmplifyStatCollector(t *testing.T) {
+	recorder := &BufferedStatRecorder{}
+	statColl := &StatCollector{StatGenerator: &ComparativeStatGenerator{}, StatRecorder: recorder, statStreamSize: 1}
+	var copies sync.WaitGroup
+	collectors := amplifyStatCollector(statColl, 3, &copies)
+	if len(collectors) != 3 || collectors[0] != statColl {
+		t.Fatalf("expected 3 collectors, the first being the original")
+	}
+
+	copies.Add(2)
+	op := &RecordedOp{RawOp: RawOp{Header: MsgHeader{OpCode: OpCodeMessage}}, Seen: &PreciseTime{time.Now()}}
+	parsed := &MsgOp{CommandName: "find"}
+	for _, collector := range collectors[1:] {
+		go func(collector *StatCollector) {
+			defer copies.Done()
+			collector.Collect(op, parsed, nil, "")
+			collector.Close()
+		}(collector)
+	}
+	statColl.Collect(op, parsed, nil, "")
+	// closing the first collector waits for the copies before the shared
+	// recorder is closed
+	statColl.Close()
+	if len(recorder.Buffer) != 3 {
+		t.Errorf("expected the stats of the 3 copies to be recorded, saw %v", len(recorder.Buffer))
+	}
+
+	noop := amplifyStatCollector(&StatCollector{noop: true}, 2, &copies)
+	if !noop[1].noop {
+		t.Errorf("expected the copies of a collector recording nothing to record nothing")
+	}
+}
+
+func TestAbsorb(t *testing.T) {
+	context := NewExecutionContext(&StatCollector{noop: true}, nil, &ExecutionOptions{})
+	other := NewExecutionContext(&StatCollector{noop: true}, nil, &ExecutionOptions{})
+	context.errors.observe(nil, nil)
+	other.errors.observe(nil, nil)
+	other.errors.observe(fmt.Errorf("error executing op: EOF"), nil)
+	other.latencies.histogram.Record(1000)
+	other.blockedOps = 2
+
+	context.absorb(other)
+	if context.errors.opsPlayed != 3 || context.ErrorRate() != 1.0/3 {
+		t.Errorf("expected the ops and errors of the copy to be counted, saw %v ops and error rate %v",
+			context.errors.opsPlayed, context.ErrorRate())
+	}
+	if context.latencies.histogram.Count() != 1 {
+		t.Errorf("expected the latencies of the copy to be counted")
+	}
+	if context.BlockedOps() != 2 {
+		t.Errorf("expected the blocked ops of the copy to be counted, saw %v", context.BlockedOps())
+	}
+}
+
+func TestSessionRemapper(t *testing.T) {
+	lsid := func(id byte) bson.D {
+		return bson.D{{"id", bson.Binary{Kind: 4, Data: []byte{id, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}}}}
+	}
+	msgOp := func(session bson.D) *MsgOp {
+		raw, err := dToRaw(bson.D{{"find", "c"}, {"lsid", session}, {"$db", "test"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &MsgOp{CommandName: "find", MsgOp: mgo.MsgOp{Sections: []mgo.MsgSection{{PayloadType: mgo.MsgPayload0, Data: raw}}}}
+	}
+	sessionOf := func(op *MsgOp) string {
+		body, _, err := fetchPayload0Data(op.Sections)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := bsonToD(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := FindValueByKey("lsid", &doc)
+		session, err := bsonToD(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := FindValueByKey("id", &session)
+		binary := id.(bson.Binary)
+		if binary.Kind != 4 {
+			t.Errorf("expected the session id to remain a UUID, saw subtype %v", binary.Kind)
+		}
+		return string(binary.Data)
+	}
+
+	remapper := newSessionRemapper()
+	remapped := map[byte]string{}
+	for _, id := range []byte{1, 2, 1} {
+		op := msgOp(lsid(id))
+		if err := remapper.BeforeOp(&RecordedOp{}, op); err != nil {
+			t.Fatal(err)
+		}
+		session := sessionOf(op)
+		if session == string(lsid(id)[0].Value.(bson.Binary).Data) {
+			t.Errorf("expected session %v to be remapped", id)
+		}
+		if previous, ok := remapped[id]; ok && previous != session {
+			t.Errorf("expected session %v to be remapped to the same session throughout", id)
+		}
+		remapped[id] = session
+	}
+	if remapped[1] == remapped[2] {
+		t.Errorf("expected different sessions to be remapped to different sessions")
+	}
+	other := msgOp(lsid(1))
+	if err := newSessionRemapper().BeforeOp(&RecordedOp{}, other); err != nil {
+		t.Fatal(err)
+	}
+	if sessionOf(other) == remapped[1] {
+		t.Errorf("expected each copy to remap sessions to sessions of its own")
+	}
+}
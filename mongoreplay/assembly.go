@@ -137,8 +137,9 @@ func (c *pageCache) next(ts time.Time) (p *page) {
 	p, c.free = c.free[i], c.free[:i]
 	p.prev = nil
 	p.next = nil
-	p.Seen = ts
-	p.Bytes = p.buf[:0]
+	// the Skip, Start and End of the last use of the page must not be passed
+	// on with its new bytes
+	p.Reassembly = tcpassembly.Reassembly{Bytes: p.buf[:0], Seen: ts}
 	c.used++
 	return p
 }
@@ -225,6 +226,9 @@ func (a *Assembler) FlushOlderThan(t time.Time) (flushed, closed int) {
 			conn.mu.Unlock()
 			continue
 		}
+		if len(conn.spooled) > 0 && conn.spooled[0].seen.Before(t) {
+			a.unspoolOrDrop(conn)
+		}
 		for conn.first != nil && conn.first.Seen.Before(t) {
 			a.skipFlush(conn)
 			flushed = true
@@ -233,7 +237,7 @@ func (a *Assembler) FlushOlderThan(t time.Time) (flushed, closed int) {
 				break
 			}
 		}
-		if !conn.closed && conn.first == nil && conn.lastSeen.Before(t) {
+		if !conn.closed && conn.first == nil && len(conn.spooled) == 0 && conn.lastSeen.Before(t) {
 			flushed = true
 			a.closeConnection(conn)
 			closes++
@@ -262,6 +266,13 @@ func (a *Assembler) FlushAll() (closed int) {
 	return
 }
 
+// restartedBy returns whether a TCP packet starts a new connection with the
+// key of conn, which is the case of a SYN that isn't a retransmission of the
+// SYN conn started with.
+func (conn *connection) restartedBy(t *layers.TCP) bool {
+	return t.SYN && conn.nextSeq != invalidSequence && conn.synSeq != Sequence(t.Seq)
+}
+
 type key [2]gopacket.Flow
 
 func (k *key) String() string {
@@ -352,10 +363,14 @@ type connection struct {
 	pages             int
 	first, last       *page
 	nextSeq           Sequence
+	synSeq            Sequence
 	created, lastSeen time.Time
 	stream            tcpassembly.Stream
 	closed            bool
 	mu                sync.Mutex
+	// spooled are the pages of the connection spilled to the spool, ordered
+	// by sequence.
+	spooled []spooledPage
 }
 
 func (conn *connection) reset(k key, s tcpassembly.Stream, ts time.Time) {
@@ -363,9 +378,11 @@ func (conn *connection) reset(k key, s tcpassembly.Stream, ts time.Time) {
 	conn.pages = 0
 	conn.first, conn.last = nil, nil
 	conn.nextSeq = invalidSequence
+	conn.synSeq = invalidSequence
 	conn.created = ts
 	conn.stream = s
 	conn.closed = false
+	conn.spooled = conn.spooled[:0]
 }
 
 // AssemblerOptions controls the behavior of each assembler.  Modify the
@@ -381,6 +398,12 @@ type AssemblerOptions struct {
 	// particular connection, the smallest sequence number will be flushed,
 	// along with any contiguous data.  If <= 0, this is ignored.
 	MaxBufferedPagesPerConnection int
+	// SpoolDir is the directory of the temporary file to which the pages of a
+	// connection are spilled when one of the limits above is reached, rather
+	// than flushing it.  The connection keeps waiting for the packets it is
+	// missing, until it is flushed by FlushOlderThan or FlushAll.  If empty,
+	// pages are never spilled.
+	SpoolDir string
 }
 
 // Assembler handles reassembling TCP streams.  It is not safe for
@@ -447,6 +470,14 @@ type Assembler struct {
 	ret      []tcpassembly.Reassembly
 	pc       *pageCache
 	connPool *StreamPool
+
+	// bufferOverflows counts the times the buffered pages limits of the
+	// AssemblerOptions forced a connection to give up waiting for packets,
+	// and spooledPages the pages spilled to the spool instead.
+	bufferOverflows int64
+	spooledPages    int64
+	spool           *spool
+	spoolFailed     bool
 }
 
 func (p *StreamPool) newConnection(k key, s tcpassembly.Stream, ts time.Time) (c *connection) {
@@ -507,8 +538,21 @@ func (a *Assembler) Assemble(netFlow gopacket.Flow, t *layers.TCP) {
 //    zero or one calls to Reassembled on a single stream
 //    zero or one calls to ReassemblyComplete on the same stream
 func (a *Assembler) AssembleWithTimestamp(netFlow gopacket.Flow, t *layers.TCP, timestamp time.Time) {
+	a.assemble(netFlow, t, len(t.Payload), timestamp)
+}
+
+// AssembleTruncated reassembles a TCP packet whose payload was truncated by
+// the capture, length being that of the payload that was sent. The bytes
+// missing from the payload are passed on to the stream as skipped, rather
+// than waited for. The missing bytes of a truncated packet received out of
+// order are only skipped when the stream is flushed.
+func (a *Assembler) AssembleTruncated(netFlow gopacket.Flow, t *layers.TCP, length int, timestamp time.Time) {
+	a.assemble(netFlow, t, length, timestamp)
+}
+
+func (a *Assembler) assemble(netFlow gopacket.Flow, t *layers.TCP, length int, timestamp time.Time) {
 	// Ignore empty TCP packets
-	if !t.SYN && !t.FIN && !t.RST && len(t.LayerPayload()) == 0 {
+	if !t.SYN && !t.FIN && !t.RST && length == 0 {
 		return
 	}
 
@@ -521,7 +565,7 @@ func (a *Assembler) AssembleWithTimestamp(netFlow gopacket.Flow, t *layers.TCP,
 	// loop 0-1 times for the VAST majority of cases.
 	for {
 		conn = a.connPool.getConnection(
-			key, !t.SYN && len(t.LayerPayload()) == 0, timestamp)
+			key, !t.SYN && length == 0, timestamp)
 		if conn == nil {
 			if *debugLog {
 				log.Printf("%v got empty packet on otherwise empty connection", key)
@@ -530,7 +574,19 @@ func (a *Assembler) AssembleWithTimestamp(netFlow gopacket.Flow, t *layers.TCP,
 		}
 		conn.mu.Lock()
 		if !conn.closed {
-			break
+			if !conn.restartedBy(t) {
+				break
+			}
+			// the ports of a connection that wasn't seen closing are reused by
+			// a new one, so the data of the old one is flushed before starting
+			// the new one from its SYN
+			if *debugLog {
+				log.Printf("%v restarted by a SYN with sequence %v", key, t.Seq)
+			}
+			for !conn.closed {
+				a.skipFlush(conn)
+			}
+			a.ret = a.ret[:0]
 		}
 		conn.mu.Unlock()
 	}
@@ -542,6 +598,7 @@ func (a *Assembler) AssembleWithTimestamp(netFlow gopacket.Flow, t *layers.TCP,
 	if conn.nextSeq == invalidSequence {
 		// Handling the first packet we've seen on the stream.
 		skip := 0
+		end := seq.Add(length)
 		if !t.SYN {
 			// don't add 1 since we're just going to assume the sequence number
 			// without the SYN packet.
@@ -552,6 +609,8 @@ func (a *Assembler) AssembleWithTimestamp(netFlow gopacket.Flow, t *layers.TCP,
 		} else {
 			// for SYN packets, also increment the sequence number by 1
 			conn.nextSeq = seq.Add(len(bytes) + 1)
+			conn.synSeq = seq
+			end = end.Add(1)
 		}
 		a.ret = append(a.ret, tcpassembly.Reassembly{
 			Bytes: bytes,
@@ -559,6 +618,7 @@ func (a *Assembler) AssembleWithTimestamp(netFlow gopacket.Flow, t *layers.TCP,
 			Start: t.SYN,
 			Seen:  timestamp,
 		})
+		a.skipTruncated(conn, end, timestamp)
 		a.insertIntoConn(t, conn, timestamp)
 	} else if diff := conn.nextSeq.Difference(seq); diff > 0 {
 		a.insertIntoConn(t, conn, timestamp)
@@ -570,6 +630,7 @@ func (a *Assembler) AssembleWithTimestamp(netFlow gopacket.Flow, t *layers.TCP,
 			End:   t.RST || t.FIN,
 			Seen:  timestamp,
 		})
+		a.skipTruncated(conn, seq.Add(length), timestamp)
 	}
 	if len(a.ret) > 0 {
 		a.sendToConnection(conn)
@@ -577,6 +638,23 @@ func (a *Assembler) AssembleWithTimestamp(netFlow gopacket.Flow, t *layers.TCP,
 	conn.mu.Unlock()
 }
 
+// skipTruncated skips the bytes of a truncated packet missing from the last
+// reassembly, which end at end, passing on whether the stream ends with them.
+func (a *Assembler) skipTruncated(conn *connection, end Sequence, timestamp time.Time) {
+	missing := conn.nextSeq.Difference(end)
+	if missing <= 0 {
+		return
+	}
+	last := len(a.ret) - 1
+	a.ret = append(a.ret, tcpassembly.Reassembly{
+		Skip: missing,
+		End:  a.ret[last].End,
+		Seen: timestamp,
+	})
+	a.ret[last].End = false
+	conn.nextSeq = end
+}
+
 func byteSpan(expected, received Sequence, bytes []byte) (toSend []byte, next Sequence) {
 	if expected == invalidSequence {
 		return bytes, received.Add(len(bytes))
@@ -603,10 +681,16 @@ func (a *Assembler) sendToConnection(conn *connection) {
 	}
 }
 
-// addContiguous adds contiguous byte-sets to a connection.
+// addContiguous adds contiguous byte-sets to a connection, reading its
+// spooled pages back once they are reached.
 func (a *Assembler) addContiguous(conn *connection) {
-	for conn.first != nil && conn.nextSeq.Difference(conn.first.seq) <= 0 {
-		a.addNextFromConn(conn)
+	for {
+		for conn.first != nil && conn.nextSeq.Difference(conn.first.seq) <= 0 {
+			a.addNextFromConn(conn)
+		}
+		if !a.unspoolReached(conn) {
+			return
+		}
 	}
 }
 
@@ -617,6 +701,9 @@ func (a *Assembler) skipFlush(conn *connection) {
 	if *debugLog {
 		log.Printf("%v skipFlush %v", conn.key, conn.nextSeq)
 	}
+	if len(conn.spooled) > 0 {
+		a.unspoolOrDrop(conn)
+	}
 	if conn.first == nil {
 		a.closeConnection(conn)
 		return
@@ -644,6 +731,10 @@ func (a *Assembler) closeConnection(conn *connection) {
 	for p := conn.first; p != nil; p = p.next {
 		a.pc.replace(p)
 	}
+	if len(conn.spooled) > 0 {
+		a.spool.release(len(conn.spooled))
+		conn.spooled = conn.spooled[:0]
+	}
 }
 
 // traverseConn traverses our doubly-linked list of pages for the correct
@@ -693,7 +784,19 @@ func (a *Assembler) insertIntoConn(t *layers.TCP, conn *connection, ts time.Time
 		if *debugLog {
 			log.Printf("%v hit max buffer size: %+v, %v, %v", conn.key, a.AssemblerOptions, conn.pages, a.pc.used)
 		}
-		a.addNextFromConn(conn)
+		if a.SpoolDir != "" && !a.spoolFailed {
+			err := a.spill(conn)
+			if err == nil {
+				return
+			}
+			userInfoLogger.Logvf(Always, "%v; giving up on the packets connections wait for "+
+				"once the buffered pages limits are reached", err)
+			a.spoolFailed = true
+		}
+		a.bufferOverflows++
+		if conn.first != nil {
+			a.addNextFromConn(conn)
+		}
 	}
 }
 
@@ -0,0 +1,335 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// testStream records the bytes reassembled for it, and whether bytes were
+// skipped.
+type testStream struct {
+	data     []byte
+	skipped  bool
+	complete bool
+}
+
+func (stream *testStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
+	for _, reassembly := range reassemblies {
+		if reassembly.Skip > 0 {
+			stream.skipped = true
+		}
+		stream.data = append(stream.data, reassembly.Bytes...)
+	}
+}
+
+func (stream *testStream) ReassemblyComplete() {
+	stream.complete = true
+}
+
+type testStreamFactory struct {
+	streams []*testStream
+}
+
+func (factory *testStreamFactory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
+	stream := &testStream{}
+	factory.streams = append(factory.streams, stream)
+	return stream
+}
+
+// segment is a TCP segment of a single direction of a test connection.
+type segment struct {
+	seq  uint32
+	data string
+	syn  bool
+	fin  bool
+}
+
+func (s segment) tcp() *layers.TCP {
+	tcp := &layers.TCP{SrcPort: 50000, DstPort: 27017, Seq: s.seq, SYN: s.syn, FIN: s.fin, ACK: !s.syn}
+	tcp.Payload = []byte(s.data)
+	return tcp
+}
+
+func TestAssemblerReordering(t *testing.T) {
+	type testCase struct {
+		name     string
+		segments []segment
+		expected string
+	}
+	cases := []testCase{
+		{
+			name:     "in order",
+			segments: []segment{{seq: 99, syn: true}, {seq: 100, data: "abcd"}, {seq: 104, data: "efgh"}},
+			expected: "abcdefgh",
+		},
+		{
+			name: "reordered",
+			segments: []segment{{seq: 99, syn: true}, {seq: 108, data: "ijkl"}, {seq: 104, data: "efgh"},
+				{seq: 100, data: "abcd"}},
+			expected: "abcdefghijkl",
+		},
+		{
+			name: "retransmissions",
+			segments: []segment{{seq: 99, syn: true}, {seq: 100, data: "abcd"}, {seq: 100, data: "abcd"},
+				{seq: 104, data: "efgh"}, {seq: 99, syn: true}, {seq: 104, data: "efgh"}},
+			expected: "abcdefgh",
+		},
+		{
+			name: "overlapping segments",
+			segments: []segment{{seq: 99, syn: true}, {seq: 100, data: "abcd"}, {seq: 102, data: "cdef"},
+				{seq: 110, data: "klm"}, {seq: 107, data: "hijkl"}, {seq: 105, data: "fgh"}},
+			expected: "abcdefghijklm",
+		},
+		{
+			name: "wrapped sequence numbers",
+			segments: []segment{{seq: uint32Max - 1, syn: true}, {seq: 3, data: "efgh"},
+				{seq: uint32Max, data: "abcd"}},
+			expected: "abcdefgh",
+		},
+	}
+	netFlow := gopacket.NewFlow(layers.EndpointIPv4, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4())
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		factory := &testStreamFactory{}
+		assembler := NewAssembler(NewStreamPool(factory))
+		for _, s := range c.segments {
+			assembler.AssembleWithTimestamp(netFlow, s.tcp(), time.Now())
+		}
+		assembler.FlushAll()
+		if len(factory.streams) != 1 {
+			t.Fatalf("expected 1 stream, got %v", len(factory.streams))
+		}
+		stream := factory.streams[0]
+		if string(stream.data) != c.expected || stream.skipped || !stream.complete {
+			t.Errorf("expected %q to be reassembled, got %q (skipped: %v, complete: %v)",
+				c.expected, stream.data, stream.skipped, stream.complete)
+		}
+	}
+}
+
+func TestAssemblerReusedPages(t *testing.T) {
+	factory := &testStreamFactory{}
+	assembler := NewAssembler(NewStreamPool(factory))
+	netFlow := gopacket.NewFlow(layers.EndpointIPv4, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4())
+
+	t.Log("Flushing a stream past a missing segment")
+	for _, s := range []segment{{seq: 99, syn: true}, {seq: 100, data: "abcd"}, {seq: 108, data: "ijkl"}} {
+		assembler.AssembleWithTimestamp(netFlow, s.tcp(), time.Now())
+	}
+	assembler.FlushAll()
+	if !factory.streams[0].skipped {
+		t.Errorf("expected the missing segment to be skipped")
+	}
+
+	t.Log("Reordering the segments of the next stream")
+	for _, s := range []segment{{seq: 199, syn: true}, {seq: 204, data: "efgh"}, {seq: 200, data: "abcd"}} {
+		assembler.AssembleWithTimestamp(netFlow, s.tcp(), time.Now())
+	}
+	assembler.FlushAll()
+	if stream := factory.streams[1]; stream.skipped || string(stream.data) != "abcdefgh" {
+		t.Errorf("expected the reordered segments to be reassembled without skipping, got %q (skipped: %v)",
+			stream.data, stream.skipped)
+	}
+}
+
+func TestAssemblerReusedPorts(t *testing.T) {
+	factory := &testStreamFactory{}
+	assembler := NewAssembler(NewStreamPool(factory))
+	netFlow := gopacket.NewFlow(layers.EndpointIPv4, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4())
+	for _, s := range []segment{
+		{seq: 99, syn: true}, {seq: 100, data: "abcd"},
+		{seq: 5000, syn: true}, {seq: 5001, data: "efgh"},
+	} {
+		assembler.AssembleWithTimestamp(netFlow, s.tcp(), time.Now())
+	}
+	assembler.FlushAll()
+	if len(factory.streams) != 2 {
+		t.Fatalf("expected a new stream to be started by the SYN, got %v streams", len(factory.streams))
+	}
+	for i, expected := range []string{"abcd", "efgh"} {
+		if stream := factory.streams[i]; string(stream.data) != expected || !stream.complete {
+			t.Errorf("expected stream %v to be %q, got %q (complete: %v)", i, expected, stream.data, stream.complete)
+		}
+	}
+}
+
+func TestReorderedOps(t *testing.T) {
+	src, dst := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	message := pingQuery(t, 1)
+	pkts := []gopacket.Packet{synPacket(t, src, dst, 50000, 27017, 999)}
+	for _, s := range []struct{ start, end int }{{30, len(message)}, {10, 40}, {0, 20}, {10, 40}} {
+		pkts = append(pkts, tcpPacket(t, src, dst, 50000, 27017, uint32(1000+s.start), message[s.start:s.end]))
+	}
+	ops := assembleOps(t, "", pkts)
+	if len(ops) != 1 {
+		t.Fatalf("expected 1 op, got %v", len(ops))
+	}
+	if op := ops[0]; !bytes.Equal(op.Body, message) {
+		t.Errorf("expected the op to be reassembled from its segments, got %v", op.Body)
+	}
+}
+
+func TestReusedPortsOps(t *testing.T) {
+	client, server := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	query, reply := pingQuery(t, 1), pingReply(t, 2, 1)
+	var pkts []gopacket.Packet
+	for _, isn := range []uint32{1000, 50000} {
+		pkts = append(pkts,
+			synPacket(t, client, server, 50000, 27017, isn),
+			synPacket(t, server, client, 27017, 50000, isn+10000),
+			tcpPacket(t, client, server, 50000, 27017, isn+1, query),
+			tcpPacket(t, server, client, 27017, 50000, isn+10001, reply),
+		)
+	}
+	ops := assembleOps(t, "", pkts)
+	if len(ops) != 4 {
+		t.Fatalf("expected 4 ops, got %v", len(ops))
+	}
+	connections := map[int64]int{}
+	for _, op := range ops {
+		connections[op.SeenConnectionNum]++
+	}
+	if len(connections) != 2 {
+		t.Errorf("expected the queries and replies of two connections, got %v", connections)
+	}
+	for connection, count := range connections {
+		if count != 2 {
+			t.Errorf("expected a query and its reply on connection %v, got %v ops", connection, count)
+		}
+	}
+}
+
+func TestAssembleTruncated(t *testing.T) {
+	factory := &testStreamFactory{}
+	assembler := NewAssembler(NewStreamPool(factory))
+	netFlow := gopacket.NewFlow(layers.EndpointIPv4, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4())
+	assembler.AssembleWithTimestamp(netFlow, segment{seq: 99, syn: true}.tcp(), time.Now())
+	assembler.AssembleWithTimestamp(netFlow, segment{seq: 100, data: "abcd"}.tcp(), time.Now())
+	assembler.AssembleTruncated(netFlow, segment{seq: 104, data: "ef"}.tcp(), 4, time.Now())
+	assembler.AssembleWithTimestamp(netFlow, segment{seq: 108, data: "ijkl"}.tcp(), time.Now())
+	stream := factory.streams[0]
+	if string(stream.data) != "abcdefijkl" || !stream.skipped {
+		t.Errorf("expected the missing bytes to be skipped without waiting for them, got %q (skipped: %v)",
+			stream.data, stream.skipped)
+	}
+}
+
+func TestTruncatedOps(t *testing.T) {
+	src, dst := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	pkts := []gopacket.Packet{synPacket(t, src, dst, 50000, 27017, 999)}
+	seq := uint32(1000)
+	for i := int32(1); i <= 3; i++ {
+		message := pingQuery(t, i)
+		pkt := tcpPacket(t, src, dst, 50000, 27017, seq, message)
+		if i == 2 {
+			t.Log("Truncating the packet of the second query")
+			pkt = gopacket.NewPacket(pkt.Data()[:len(pkt.Data())-20], layers.LayerTypeIPv4, gopacket.Default)
+			pkt.Metadata().Timestamp = time.Now()
+			if tcp := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP); sentPayloadLength(pkt, tcp) != len(message) {
+				t.Errorf("expected the sent payload to be %v bytes, got %v", len(message), sentPayloadLength(pkt, tcp))
+			}
+		}
+		pkts = append(pkts, pkt)
+		seq += uint32(len(message))
+	}
+	opStream := NewMongoOpStream(1)
+	ops := assembleOpStream(t, opStream, pkts)
+	if len(ops) != 2 || ops[0].Header.RequestID != 1 || ops[1].Header.RequestID != 3 {
+		t.Errorf("expected the first and third queries to be recorded, got %v", ops)
+	}
+	if opStream.truncatedOps != 1 {
+		t.Errorf("expected 1 truncated op, got %v", opStream.truncatedOps)
+	}
+}
+
+func TestAssemblerBufferOverflows(t *testing.T) {
+	factory := &testStreamFactory{}
+	assembler := NewAssembler(NewStreamPool(factory))
+	assembler.MaxBufferedPagesPerConnection = 2
+	netFlow := gopacket.NewFlow(layers.EndpointIPv4, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4())
+	for _, s := range []segment{{seq: 99, syn: true}, {seq: 100, data: "abcd"}, {seq: 108, data: "ijkl"},
+		{seq: 112, data: "mnop"}} {
+		assembler.AssembleWithTimestamp(netFlow, s.tcp(), time.Now())
+	}
+	if assembler.bufferOverflows != 1 {
+		t.Errorf("expected 1 buffer overflow, got %v", assembler.bufferOverflows)
+	}
+	if stream := factory.streams[0]; string(stream.data) != "abcdijklmnop" || !stream.skipped {
+		t.Errorf("expected the missing segment to be given up on, got %q (skipped: %v)", stream.data, stream.skipped)
+	}
+}
+
+func TestAssemblerSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	netFlow := gopacket.NewFlow(layers.EndpointIPv4, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4())
+
+	type testCase struct {
+		name     string
+		segments []segment
+		expected string
+		skipped  bool
+	}
+	cases := []testCase{
+		{
+			name: "missing segment received after spilling",
+			segments: []segment{{seq: 99, syn: true}, {seq: 100, data: "abcd"}, {seq: 108, data: "ijkl"},
+				{seq: 112, data: "mnop"}, {seq: 120, data: "uvwx"}, {seq: 104, data: "efgh"},
+				{seq: 116, data: "qrst"}},
+			expected: "abcdefghijklmnopqrstuvwx",
+		},
+		{
+			name: "spilled segments flushed",
+			segments: []segment{{seq: 99, syn: true}, {seq: 100, data: "abcd"}, {seq: 108, data: "ijkl"},
+				{seq: 112, data: "mnop"}},
+			expected: "abcdijklmnop",
+			skipped:  true,
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		factory := &testStreamFactory{}
+		assembler := NewAssembler(NewStreamPool(factory))
+		assembler.MaxBufferedPagesPerConnection = 2
+		assembler.SpoolDir = dir
+		for _, s := range c.segments {
+			assembler.AssembleWithTimestamp(netFlow, s.tcp(), time.Now())
+		}
+		if assembler.spooledPages == 0 || assembler.bufferOverflows != 0 {
+			t.Errorf("expected pages to be spooled rather than given up on, got %v spooled and %v overflows",
+				assembler.spooledPages, assembler.bufferOverflows)
+		}
+		assembler.FlushAll()
+		stream := factory.streams[0]
+		if string(stream.data) != c.expected || stream.skipped != c.skipped || !stream.complete {
+			t.Errorf("expected %q to be reassembled (skipped: %v), got %q (skipped: %v, complete: %v)",
+				c.expected, c.skipped, stream.data, stream.skipped, stream.complete)
+		}
+		if assembler.spool.pages != 0 || assembler.spool.size != 0 {
+			t.Errorf("expected the spool to be emptied, got %v pages of %v bytes", assembler.spool.pages, assembler.spool.size)
+		}
+		if err := assembler.RemoveSpool(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 0 {
+		t.Errorf("expected the spool files to be removed, got %v (%v)", files, err)
+	}
+}
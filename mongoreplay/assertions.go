@@ -0,0 +1,251 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Assertion is a condition on the results of a playback, such as
+// "p95<50ms", checked once playback finishes.
+type Assertion struct {
+	// Setting is the assertion as given to --assert.
+	Setting string
+	// Metric is a latency percentile such as "p95", "max", "errorRate" or
+	// "ops".
+	Metric string
+	// Operator is one of <, <=, > and >=.
+	Operator string
+	// Threshold is a latency in microseconds, a rate between 0 and 1, or a
+	// number of ops, depending on the metric.
+	Threshold float64
+
+	percentile float64
+}
+
+// AssertionResult is the outcome of checking an Assertion.
+type AssertionResult struct {
+	Assertion string  `json:"assertion"`
+	Metric    string  `json:"metric"`
+	Unit      string  `json:"unit"`
+	Observed  float64 `json:"observed"`
+	Threshold float64 `json:"threshold"`
+	Passed    bool    `json:"passed"`
+	Message   string  `json:"message,omitempty"`
+}
+
+// Verdict holds the results of the assertions checked at the end of a
+// playback. It is written as JSON so that the playback can be used as a
+// regression test by other tools.
+type Verdict struct {
+	Passed     bool              `json:"passed"`
+	OpsPlayed  int64             `json:"opsPlayed"`
+	Assertions []AssertionResult `json:"assertions"`
+}
+
+// ParseAssertion parses an assertion of the form <metric><operator><value>.
+// Latency metrics (pNN and max) take durations such as "50ms", errorRate
+// takes a percentage or a fraction, and ops takes a number of ops.
+func ParseAssertion(setting string) (Assertion, error) {
+	assertion := Assertion{Setting: setting}
+	trimmed := strings.Replace(setting, " ", "", -1)
+	i := strings.IndexAny(trimmed, "<>")
+	if i < 1 {
+		return assertion, fmt.Errorf("'%v' is not of the form <metric><operator><value>, e.g. p95<50ms", setting)
+	}
+	assertion.Metric = trimmed[:i]
+	assertion.Operator = trimmed[i : i+1]
+	value := trimmed[i+1:]
+	if strings.HasPrefix(value, "=") {
+		assertion.Operator += "="
+		value = value[1:]
+	}
+
+	switch {
+	case assertion.Metric == "errorRate":
+		rate, err := parseRate(value)
+		if err != nil {
+			return assertion, fmt.Errorf("invalid rate in '%v': %v", setting, err)
+		}
+		assertion.Threshold = rate
+	case assertion.Metric == "ops":
+		ops, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ops < 0 {
+			return assertion, fmt.Errorf("invalid number of ops in '%v'", setting)
+		}
+		assertion.Threshold = float64(ops)
+	case assertion.Metric == "max" || strings.HasPrefix(assertion.Metric, "p"):
+		if assertion.Metric != "max" {
+			percentile, err := strconv.ParseFloat(assertion.Metric[1:], 64)
+			if err != nil || percentile <= 0 || percentile > 100 {
+				return assertion, fmt.Errorf("invalid percentile '%v' in '%v'", assertion.Metric, setting)
+			}
+			assertion.percentile = percentile
+		}
+		latency, err := time.ParseDuration(value)
+		if err != nil || latency < 0 {
+			return assertion, fmt.Errorf("invalid latency in '%v', expected a duration such as 50ms", setting)
+		}
+		assertion.Threshold = float64(latency / time.Microsecond)
+	default:
+		return assertion, fmt.Errorf("unknown metric '%v' in '%v', expected a percentile such as p95, max, errorRate or ops",
+			assertion.Metric, setting)
+	}
+	return assertion, nil
+}
+
+func (assertion Assertion) holds(observed float64) bool {
+	switch assertion.Operator {
+	case "<":
+		return observed < assertion.Threshold
+	case "<=":
+		return observed <= assertion.Threshold
+	case ">":
+		return observed > assertion.Threshold
+	case ">=":
+		return observed >= assertion.Threshold
+	}
+	return false
+}
+
+func (assertion Assertion) isLatency() bool {
+	return assertion.Metric != "errorRate" && assertion.Metric != "ops"
+}
+
+// checkAssertions checks the assertions against the latencies, error rate
+// and number of ops of a playback. Latency assertions fail when no
+// latencies were recorded, so that a playback which received no replies
+// does not pass.
+func checkAssertions(assertions []Assertion, latencies *LatencyHistogram, errorRate float64, opsPlayed int64) *Verdict {
+	verdict := &Verdict{Passed: true, OpsPlayed: opsPlayed, Assertions: []AssertionResult{}}
+	for _, assertion := range assertions {
+		result := AssertionResult{
+			Assertion: assertion.Setting,
+			Metric:    assertion.Metric,
+			Threshold: assertion.Threshold,
+		}
+		var observed float64
+		switch {
+		case assertion.Metric == "errorRate":
+			result.Unit = "ratio"
+			observed = errorRate
+		case assertion.Metric == "ops":
+			result.Unit = "ops"
+			observed = float64(opsPlayed)
+		case assertion.Metric == "max":
+			observed = float64(latencies.Max())
+		default:
+			observed = float64(latencies.Percentile(assertion.percentile))
+		}
+		result.Observed = observed
+		if assertion.isLatency() {
+			// latencies are reported in milliseconds, as in the latency
+			// percentile tables
+			result.Unit = "ms"
+			result.Observed /= 1000
+			result.Threshold /= 1000
+		}
+
+		if assertion.isLatency() && latencies.Count() == 0 {
+			result.Message = "no latencies were recorded"
+		} else {
+			result.Passed = assertion.holds(observed)
+		}
+		if !result.Passed {
+			verdict.Passed = false
+		}
+		verdict.Assertions = append(verdict.Assertions, result)
+	}
+	return verdict
+}
+
+// failures describes the assertions of the verdict which failed.
+func (verdict *Verdict) failures() []string {
+	var failures []string
+	for _, result := range verdict.Assertions {
+		if result.Passed {
+			continue
+		}
+		if result.Message != "" {
+			failures = append(failures, fmt.Sprintf("%v (%v)", result.Assertion, result.Message))
+		} else {
+			failures = append(failures, fmt.Sprintf("%v (observed %v%v)", result.Assertion,
+				strconv.FormatFloat(result.Observed, 'g', 6, 64), unitSuffix(result.Unit)))
+		}
+	}
+	return failures
+}
+
+func unitSuffix(unit string) string {
+	switch unit {
+	case "ms":
+		return "ms"
+	case "ops":
+		return " ops"
+	}
+	return ""
+}
+
+// writeVerdict writes the verdict as JSON to the file at path, or to stdout
+// if path is empty.
+func writeVerdict(verdict *Verdict, path string) error {
+	var out io.WriteCloser = os.Stdout
+	if path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(verdict)
+	if path != "" {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// latencySummary counts the latencies of the ops played which received
+// replies.
+type latencySummary struct {
+	sync.Mutex
+	histogram LatencyHistogram
+}
+
+func (summary *latencySummary) observe(reply Replyable) {
+	if reply == nil {
+		return
+	}
+	latency := reply.getLatencyMicros()
+	if latency <= 0 {
+		return
+	}
+	summary.Lock()
+	summary.histogram.Record(latency)
+	summary.Unlock()
+}
+
+// CheckAssertions checks the assertions against the results of the
+// playback so far.
+func (context *ExecutionContext) CheckAssertions(assertions []Assertion) *Verdict {
+	context.latencies.Lock()
+	defer context.latencies.Unlock()
+	context.errors.Lock()
+	opsPlayed := context.errors.opsPlayed
+	context.errors.Unlock()
+	return checkAssertions(assertions, &context.latencies.histogram, context.ErrorRate(), opsPlayed)
+}
@@ -0,0 +1,160 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseAssertion(t *testing.T) {
+	testCases := []struct {
+		setting   string
+		metric    string
+		operator  string
+		threshold float64
+		valid     bool
+	}{
+		{"p95<50ms", "p95", "<", 50000, true},
+		{"p99.9 <= 1s", "p99.9", "<=", 1000000, true},
+		{"max<250us", "max", "<", 250, true},
+		{"errorRate<0.1%", "errorRate", "<", 0.001, true},
+		{"errorRate<=0.05", "errorRate", "<=", 0.05, true},
+		{"ops>=1000", "ops", ">=", 1000, true},
+		{"p95<50", "", "", 0, false},
+		{"p0<50ms", "", "", 0, false},
+		{"p101<50ms", "", "", 0, false},
+		{"mean<50ms", "", "", 0, false},
+		{"errorRate<2", "", "", 0, false},
+		{"ops>lots", "", "", 0, false},
+		{"<50ms", "", "", 0, false},
+		{"p95", "", "", 0, false},
+	}
+	for _, c := range testCases {
+		t.Logf("running case: %s", c.setting)
+		assertion, err := ParseAssertion(c.setting)
+		if (err == nil) != c.valid {
+			t.Errorf("expected valid to be %v, saw error %v", c.valid, err)
+			continue
+		}
+		if !c.valid {
+			continue
+		}
+		if assertion.Metric != c.metric || assertion.Operator != c.operator || assertion.Threshold != c.threshold {
+			t.Errorf("expected %v %v %v, saw %v %v %v", c.metric, c.operator, c.threshold,
+				assertion.Metric, assertion.Operator, assertion.Threshold)
+		}
+	}
+}
+
+func TestCheckAssertions(t *testing.T) {
+	latencies := &LatencyHistogram{}
+	for i := int64(1); i <= 100; i++ {
+		latencies.Record(i * 1000)
+	}
+	testCases := []struct {
+		name       string
+		assertions []string
+		latencies  *LatencyHistogram
+		errorRate  float64
+		passed     []bool
+	}{
+		{
+			name:       "latencies",
+			assertions: []string{"p50<60ms", "p95<90ms", "max<=100ms", "p99>50ms"},
+			latencies:  latencies,
+			passed:     []bool{true, false, true, true},
+		},
+		{
+			name:       "error rate and ops",
+			assertions: []string{"errorRate<1%", "errorRate<0.5%", "ops>=100", "ops>100"},
+			latencies:  latencies,
+			errorRate:  0.008,
+			passed:     []bool{true, false, true, false},
+		},
+		{
+			name:       "no latencies recorded",
+			assertions: []string{"p95<50ms", "errorRate<1%"},
+			latencies:  &LatencyHistogram{},
+			passed:     []bool{false, true},
+		},
+	}
+	for _, c := range testCases {
+		t.Logf("running case: %s", c.name)
+		var assertions []Assertion
+		for _, setting := range c.assertions {
+			assertion, err := ParseAssertion(setting)
+			if err != nil {
+				t.Fatalf("error parsing %v: %v", setting, err)
+			}
+			assertions = append(assertions, assertion)
+		}
+		verdict := checkAssertions(assertions, c.latencies, c.errorRate, 100)
+		passed := true
+		for i, result := range verdict.Assertions {
+			if result.Passed != c.passed[i] {
+				t.Errorf("expected %v to have passed %v, saw %v (observed %v%v)",
+					result.Assertion, c.passed[i], result.Passed, result.Observed, result.Unit)
+			}
+			passed = passed && c.passed[i]
+		}
+		if verdict.Passed != passed {
+			t.Errorf("expected the verdict to have passed %v, saw %v", passed, verdict.Passed)
+		}
+		if len(verdict.failures()) != len(c.passed)-countTrue(c.passed) {
+			t.Errorf("unexpected failures %v", verdict.failures())
+		}
+	}
+}
+
+func countTrue(values []bool) int {
+	var count int
+	for _, value := range values {
+		if value {
+			count++
+		}
+	}
+	return count
+}
+
+func TestWriteVerdict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-verdict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "verdict.json")
+
+	assertion, err := ParseAssertion("p95<50ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	latencies := &LatencyHistogram{}
+	latencies.Record(20000)
+	if err := writeVerdict(checkAssertions([]Assertion{assertion}, latencies, 0, 1), path); err != nil {
+		t.Fatalf("error writing verdict: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var verdict Verdict
+	if err := json.Unmarshal(data, &verdict); err != nil {
+		t.Fatalf("verdict is not valid json: %v\n%s", err, data)
+	}
+	if !verdict.Passed || verdict.OpsPlayed != 1 || len(verdict.Assertions) != 1 {
+		t.Fatalf("unexpected verdict %s", data)
+	}
+	result := verdict.Assertions[0]
+	if result.Unit != "ms" || result.Observed != 20 || result.Threshold != 50 {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
@@ -35,7 +35,7 @@ func TestCommandsAgainstAuthedDBWhenAuthed(t *testing.T) {
 			t.Error(err)
 		}
 	}()
-	statCollector, _ := newStatCollector(testCollectorOpts, "format", true, true)
+	statCollector, _ := NewStatCollector(testCollectorOpts, "format", true, true)
 	replaySession, err := mgo.Dial(urlAuth)
 	if err != nil {
 		t.Error(err)
@@ -108,7 +108,7 @@ func TestCommandsAgainstAuthedDBWhenNotAuthed(t *testing.T) {
 			t.Error(err)
 		}
 	}()
-	statCollector, _ := newStatCollector(testCollectorOpts, "format", true, true)
+	statCollector, _ := NewStatCollector(testCollectorOpts, "format", true, true)
 	replaySession, err := mgo.Dial(urlNonAuth)
 	if err != nil {
 		t.Error(err)
@@ -0,0 +1,150 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// the speed is changed by at most these factors at a time, so that a
+	// noisy interval doesn't throw the playback off
+	autoSpeedMinFactor = 0.5
+	autoSpeedMaxFactor = 1.5
+
+	// the speed is kept within these bounds
+	autoSpeedMin = 0.01
+	autoSpeedMax = 1000
+)
+
+// autoSpeedTarget is the metric of the target cluster which --autoSpeed
+// holds: either the ops completed per second, or a latency percentile.
+type autoSpeedTarget struct {
+	setting      string
+	opsPerSecond float64
+	percentile   float64
+	// latency is the target of the percentile, in microseconds.
+	latency float64
+}
+
+// parseAutoSpeedTarget parses a target of the form <metric>=<value>, where
+// the metric is opsPerSecond or a latency percentile such as p95, which
+// takes a duration such as 50ms.
+func parseAutoSpeedTarget(setting string) (*autoSpeedTarget, error) {
+	target := &autoSpeedTarget{setting: setting}
+	trimmed := strings.Replace(setting, " ", "", -1)
+	i := strings.Index(trimmed, "=")
+	if i < 1 {
+		return nil, fmt.Errorf("'%v' is not of the form <metric>=<value>, e.g. p95=50ms or opsPerSecond=5000", setting)
+	}
+	metric, value := trimmed[:i], trimmed[i+1:]
+	switch {
+	case metric == "opsPerSecond":
+		ops, err := strconv.ParseFloat(value, 64)
+		if err != nil || ops <= 0 {
+			return nil, fmt.Errorf("invalid number of ops per second in '%v'", setting)
+		}
+		target.opsPerSecond = ops
+	case strings.HasPrefix(metric, "p"):
+		percentile, err := strconv.ParseFloat(metric[1:], 64)
+		if err != nil || percentile <= 0 || percentile > 100 {
+			return nil, fmt.Errorf("invalid percentile '%v' in '%v'", metric, setting)
+		}
+		target.percentile = percentile
+		latency, err := time.ParseDuration(value)
+		if err != nil || latency <= 0 {
+			return nil, fmt.Errorf("invalid latency in '%v', expected a duration such as 50ms", setting)
+		}
+		target.latency = float64(latency / time.Microsecond)
+	default:
+		return nil, fmt.Errorf("unknown metric '%v' in '%v', expected opsPerSecond or a percentile such as p95", metric, setting)
+	}
+	return target, nil
+}
+
+// factor returns the factor the speed is to be multiplied by to approach the
+// target, given the ops completed and the latencies of an interval, and the
+// metric observed over it. A factor of 1 leaves the speed unchanged.
+func (target *autoSpeedTarget) factor(ops int64, interval time.Duration, latencies *LatencyHistogram) (float64, string) {
+	var ratio float64
+	var observed string
+	if target.opsPerSecond > 0 {
+		opsPerSecond := float64(ops) / interval.Seconds()
+		observed = fmt.Sprintf("%.1f ops per second", opsPerSecond)
+		if opsPerSecond == 0 {
+			// nothing was played, which speeding up skips past
+			return autoSpeedMaxFactor, observed
+		}
+		ratio = target.opsPerSecond / opsPerSecond
+	} else {
+		if latencies.Count() == 0 {
+			return 1, "no latencies"
+		}
+		latency := latencies.Percentile(target.percentile)
+		observed = fmt.Sprintf("p%v of %v", target.percentile, time.Duration(latency)*time.Microsecond)
+		if latency <= 0 {
+			return autoSpeedMaxFactor, observed
+		}
+		// the latencies fall as the speed does
+		ratio = target.latency / float64(latency)
+	}
+	switch {
+	case ratio < autoSpeedMinFactor:
+		ratio = autoSpeedMinFactor
+	case ratio > autoSpeedMaxFactor:
+		ratio = autoSpeedMaxFactor
+	}
+	return ratio, observed
+}
+
+// autoSpeed adjusts the speed of the playback every interval to hold the
+// target, until ctx is done or the playback finishes. The ops completed are
+// counted over every context of the playback, and the latencies are those
+// of the ops completed events.
+func (control *playControl) autoSpeed(ctx context.Context, events <-chan Event, target *autoSpeedTarget, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var latencies LatencyHistogram
+	lastOps := control.status().OpsCompleted
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Type == OpCompleted && event.Err == nil && event.Latency > 0 {
+				latencies.Record(int64(event.Latency / time.Microsecond))
+			}
+		case <-ticker.C:
+			status := control.status()
+			if status.State != "playing" {
+				// the interval isn't representative of the speed
+				lastOps, latencies = status.OpsCompleted, LatencyHistogram{}
+				continue
+			}
+			factor, observed := target.factor(status.OpsCompleted-lastOps, interval, &latencies)
+			lastOps, latencies = status.OpsCompleted, LatencyHistogram{}
+			speed := status.Speed * factor
+			switch {
+			case speed < autoSpeedMin:
+				speed = autoSpeedMin
+			case speed > autoSpeedMax:
+				speed = autoSpeedMax
+			}
+			toolDebugLogger.Logvf(Info, "Auto speed observed %v for a target of %v", observed, target.setting)
+			if speed != status.Speed {
+				control.setSpeed(speed)
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseAutoSpeedTarget(t *testing.T) {
+	type testCase struct {
+		name         string
+		setting      string
+		opsPerSecond float64
+		percentile   float64
+		latency      float64
+		err          bool
+	}
+	cases := []testCase{
+		{name: "ops per second", setting: "opsPerSecond=5000", opsPerSecond: 5000},
+		{name: "latency percentile", setting: "p95 = 50ms", percentile: 95, latency: 50000},
+		{name: "invalid percentile", setting: "p101=50ms", err: true},
+		{name: "invalid latency", setting: "p99=fast", err: true},
+		{name: "unknown metric", setting: "errorRate=1%", err: true},
+		{name: "no value", setting: "opsPerSecond", err: true},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		target, err := parseAutoSpeedTarget(c.setting)
+		if (err != nil) != c.err {
+			t.Errorf("expected error %v, got %v", c.err, err)
+			continue
+		}
+		if err == nil && (target.opsPerSecond != c.opsPerSecond || target.percentile != c.percentile || target.latency != c.latency) {
+			t.Errorf("unexpected target %+v", target)
+		}
+	}
+}
+
+func TestAutoSpeedFactor(t *testing.T) {
+	type testCase struct {
+		name      string
+		setting   string
+		ops       int64
+		latencies []int64
+		factor    float64
+	}
+	cases := []testCase{
+		{name: "below the target ops", setting: "opsPerSecond=100", ops: 800, factor: 1.25},
+		{name: "far below the target ops", setting: "opsPerSecond=100", ops: 100, factor: autoSpeedMaxFactor},
+		{name: "no ops", setting: "opsPerSecond=100", factor: autoSpeedMaxFactor},
+		{name: "above the target ops", setting: "opsPerSecond=100", ops: 4000, factor: autoSpeedMinFactor},
+		{name: "above the target latency", setting: "p50=10ms", latencies: []int64{12500, 12500, 12500}, factor: 0.8},
+		{name: "no latencies", setting: "p50=10ms", factor: 1},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		target, err := parseAutoSpeedTarget(c.setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var latencies LatencyHistogram
+		for _, latency := range c.latencies {
+			latencies.Record(latency)
+		}
+		factor, _ := target.factor(c.ops, 10*time.Second, &latencies)
+		// the latencies are bucketed to within 1%
+		if factor < c.factor*0.99 || factor > c.factor*1.01 {
+			t.Errorf("expected factor %v, got %v", c.factor, factor)
+		}
+	}
+}
+
+func TestAutoSpeed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	control := newPlayControl(1, cancel)
+	target, err := parseAutoSpeedTarget("opsPerSecond=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan Event)
+	done := make(chan struct{})
+	go func() {
+		control.autoSpeed(ctx, events, target, 10*time.Millisecond)
+		close(done)
+	}()
+
+	// no ops are played, so the playback is sped up
+	deadline := time.Now().Add(5 * time.Second)
+	for control.status().Speed < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if speed := control.status().Speed; speed < 2 {
+		t.Errorf("expected the playback to be sped up, got speed %v", speed)
+	}
+
+	// the adjustments stop with the playback
+	close(events)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the adjustments to stop once playback finished")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// playbackPoint is a point of a playback, such as a --barrier or the point a
+// command of --failpoints is run at: 'start', before the first op, 'op:<n>',
+// before the op of order n, a duration, before the first op recorded that
+// long after the first op, or an RFC 3339 time, before the first op recorded
+// at or after it.
+type playbackPoint struct {
+	at string
+
+	// exactly one of atStart, order, offset and time is set
+	atStart bool
+	order   *int64
+	offset  *time.Duration
+	time    *time.Time
+}
+
+// parsePlaybackPoint parses a playbackPoint, which may only be 'start' if
+// allowStart is set.
+func parsePlaybackPoint(at string, allowStart bool) (*playbackPoint, error) {
+	point := &playbackPoint{at: at}
+	switch {
+	case at == "start" && allowStart:
+		point.atStart = true
+	case strings.HasPrefix(at, "op:"):
+		order, err := strconv.ParseInt(strings.TrimPrefix(at, "op:"), 10, 64)
+		if err != nil || order < 0 {
+			return nil, fmt.Errorf("invalid op order '%v'", strings.TrimPrefix(at, "op:"))
+		}
+		point.order = &order
+	default:
+		if offset, err := time.ParseDuration(at); err == nil {
+			if offset < 0 {
+				return nil, fmt.Errorf("offset '%v' is negative", at)
+			}
+			point.offset = &offset
+		} else if t, err := time.Parse(time.RFC3339, at); err == nil {
+			point.time = &t
+		} else if allowStart {
+			return nil, fmt.Errorf("'%v' is neither 'start', 'op:<n>', a duration nor an RFC 3339 time", at)
+		} else {
+			return nil, fmt.Errorf("'%v' is neither 'op:<n>', a duration nor an RFC 3339 time", at)
+		}
+	}
+	return point, nil
+}
+
+// due returns whether op is at or past the point, given the time the first
+// op was seen.
+func (point *playbackPoint) due(op *RecordedOp, start time.Time) bool {
+	switch {
+	case point.atStart:
+		return true
+	case point.order != nil:
+		return op.Order >= *point.order
+	case op.Seen == nil:
+		return false
+	case point.offset != nil:
+		return !op.Seen.Time.Before(start.Add(*point.offset))
+	default:
+		return !op.Seen.Time.Before(*point.time)
+	}
+}
+
+// barrierSchedule holds the --barrier points a playback has not reached yet.
+type barrierSchedule struct {
+	pending []*playbackPoint
+	// start is the time the first op played was seen, which the offsets are
+	// relative to.
+	start time.Time
+}
+
+func newBarrierSchedule(barriers []*playbackPoint) *barrierSchedule {
+	return &barrierSchedule{pending: append([]*playbackPoint(nil), barriers...)}
+}
+
+// reached returns the barriers which op reaches, removing them from those
+// pending.
+func (schedule *barrierSchedule) reached(op *RecordedOp) []*playbackPoint {
+	if len(schedule.pending) == 0 {
+		return nil
+	}
+	if schedule.start.IsZero() && op.Seen != nil {
+		schedule.start = op.Seen.Time
+	}
+	var reached, pending []*playbackPoint
+	for _, point := range schedule.pending {
+		if point.due(op, schedule.start) {
+			reached = append(reached, point)
+		} else {
+			pending = append(pending, point)
+		}
+	}
+	schedule.pending = pending
+	return reached
+}
+
+// waitAtBarrier waits until the connections have finished with every op
+// sent to them, or ctx is done, in which case ctx's error is returned.
+func (context *ExecutionContext) waitAtBarrier(ctx context.Context, reached []*playbackPoint, op *RecordedOp) error {
+	var ats []string
+	for _, point := range reached {
+		ats = append(ats, point.at)
+	}
+	userInfoLogger.Logvf(Always, "Reached barrier at %v before op %v; waiting for the ops played before it to complete",
+		strings.Join(ats, ", "), op.Order)
+	start := time.Now()
+	drained := make(chan struct{})
+	go func() {
+		context.pendingOps.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	userInfoLogger.Logvf(Always, "Passed barrier at %v after waiting %v", strings.Join(ats, ", "),
+		time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// scheduleNow returns the time the schedule of the playback has reached.
+func (context *ExecutionContext) scheduleNow() time.Time {
+	if context.clock != nil {
+		return context.clock.now()
+	}
+	return time.Now()
+}
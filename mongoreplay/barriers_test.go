@@ -0,0 +1,149 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParsePlaybackPoint(t *testing.T) {
+	type testCase struct {
+		name       string
+		at         string
+		allowStart bool
+		err        string
+	}
+	cases := []testCase{
+		{name: "op", at: "op:1000"},
+		{name: "offset", at: "90s"},
+		{name: "time", at: "2020-05-20T12:00:00Z"},
+		{name: "start", at: "start", allowStart: true},
+		{name: "start not allowed", at: "start", err: "is neither 'op:<n>'"},
+		{name: "invalid op", at: "op:first", err: "invalid op order"},
+		{name: "negative op", at: "op:-1", err: "invalid op order"},
+		{name: "negative offset", at: "-5s", err: "negative"},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		point, err := parsePlaybackPoint(c.at, c.allowStart)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("expected an error containing %q, got %v", c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else if point.at != c.at {
+			t.Errorf("expected the point to be at %v, got %v", c.at, point.at)
+		}
+	}
+}
+
+func TestBarrierScheduleReached(t *testing.T) {
+	var barriers []*playbackPoint
+	for _, at := range []string{"1m", "op:5", "2020-05-20T12:30:00Z"} {
+		barrier, err := parsePlaybackPoint(at, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		barriers = append(barriers, barrier)
+	}
+	schedule := newBarrierSchedule(barriers)
+	start := time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC)
+	reached := func(order int64, offset time.Duration) string {
+		var ats []string
+		for _, point := range schedule.reached(&RecordedOp{Order: order, Seen: &PreciseTime{start.Add(offset)}}) {
+			ats = append(ats, point.at)
+		}
+		return strings.Join(ats, ", ")
+	}
+	if at := reached(1, 0); at != "" {
+		t.Errorf("expected no barrier at the first op, got %v", at)
+	}
+	if at := reached(2, time.Minute); at != "1m" {
+		t.Errorf("expected the barrier a minute in, got %v", at)
+	}
+	// a barrier is only reached once
+	if at := reached(3, 2*time.Minute); at != "" {
+		t.Errorf("expected no barrier, got %v", at)
+	}
+	if at := reached(6, time.Hour); at != "op:5, 2020-05-20T12:30:00Z" {
+		t.Errorf("expected the last two barriers, got %v", at)
+	}
+}
+
+// barrierTestHook slows down the ops played before the barrier, recording
+// when each op starts and completes.
+type barrierTestHook struct {
+	sync.Mutex
+	started   map[int64]time.Time
+	completed map[int64]time.Time
+}
+
+func (hook *barrierTestHook) BeforeOp(op *RecordedOp, parsedOp Op) error {
+	if op.Order < 3 {
+		time.Sleep(50 * time.Millisecond)
+	}
+	hook.Lock()
+	defer hook.Unlock()
+	hook.started[op.Order] = time.Now()
+	return nil
+}
+
+func (hook *barrierTestHook) AfterOp(op *RecordedOp, parsedOp Op, reply Replyable, err error) {
+	hook.Lock()
+	defer hook.Unlock()
+	hook.completed[op.Order] = time.Now()
+}
+
+func TestPlayWaitsAtBarrier(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	if err := generator.generateMsgOpInsertHelper("barriers", 0, 6); err != nil {
+		t.Fatal(err)
+	}
+	close(generator.opChan)
+	// the ops after the barrier are played on connections of their own, so
+	// that only the barrier holds them back
+	opChan := make(chan *RecordedOp, 6)
+	var order int64
+	for op := range generator.opChan {
+		op.Order = order
+		op.SeenConnectionNum = order
+		opChan <- op
+		order++
+	}
+	close(opChan)
+
+	barrier, err := parsePlaybackPoint("op:3", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statCollector, _ := NewStatCollector(StatOptions{Buffered: true}, "format", true, true)
+	context := NewExecutionContext(statCollector, nil, &ExecutionOptions{fullSpeed: true, dryRun: true,
+		barriers: []*playbackPoint{barrier}})
+	hook := &barrierTestHook{started: map[int64]time.Time{}, completed: map[int64]time.Time{}}
+	context.PreOpHooks = []PreOpHook{hook}
+	context.PostOpHooks = []PostOpHook{hook}
+	if err := Play(context, opChan, 1, 1, 10); err != nil {
+		t.Fatalf("error playing traffic: %v", err)
+	}
+
+	if len(hook.started) != 6 || len(hook.completed) != 6 {
+		t.Fatalf("expected the 6 ops to be played, saw %v", len(hook.completed))
+	}
+	for before := int64(0); before < 3; before++ {
+		for after := int64(3); after < 6; after++ {
+			if hook.started[after].Before(hook.completed[before]) {
+				t.Errorf("op %v started before op %v, played before the barrier, completed", after, before)
+			}
+		}
+	}
+}
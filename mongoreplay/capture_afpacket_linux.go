@@ -0,0 +1,226 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// The ring of each AF_PACKET socket is made of blocks of afpacketBlockSize
+// bytes, which the kernel fills with packets of up to afpacketFrameSize
+// bytes, and has at least afpacketMinBlocks blocks.
+const (
+	afpacketFrameSize = 64 * 1024
+	afpacketBlockSize = 1024 * 1024
+	afpacketMinBlocks = 8
+)
+
+// afpacketSocket is the part of an AF_PACKET socket which afpacketSource
+// reads.
+type afpacketSocket interface {
+	ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	Close()
+}
+
+// afpacketSource is a captureSource reading packets from the memory-mapped
+// TPACKET_V3 rings of AF_PACKET sockets. When there are several sockets,
+// the kernel fans the packets out across them by flow, so that the packets
+// of a connection are all read, in order, by the same goroutine.
+type afpacketSource struct {
+	sockets []afpacketSocket
+	// filter is the BPF filter expression applied to the packets read, as
+	// AF_PACKET sockets capture every packet of the interface.
+	filter  *pcap.BPF
+	packets chan gopacket.Packet
+	once    sync.Once
+	// closed is closed by Close, after which each socket is closed by the
+	// goroutine reading it, as its ring can't be unmapped while it is read.
+	closed    chan struct{}
+	closeOnce sync.Once
+	retryWait time.Duration
+	// readers counts the goroutines reading the sockets, after which
+	// packets is closed
+	readers sync.WaitGroup
+
+	errLock sync.Mutex
+	err     error
+}
+
+// openAFPacket opens cfg.CaptureThreads AF_PACKET sockets on the network
+// interface of cfg, in a fanout group when there is more than one.
+func openAFPacket(cfg OpStreamSettings) (captureSource, error) {
+	threads := cfg.CaptureThreads
+	if threads < 1 {
+		threads = 1
+	}
+	// CaptureBufSize is the size in KiB of the ring of each socket
+	numBlocks := cfg.CaptureBufSize * 1024 / afpacketBlockSize
+	if numBlocks < afpacketMinBlocks {
+		numBlocks = afpacketMinBlocks
+	}
+
+	s := &afpacketSource{
+		packets:   make(chan gopacket.Packet, 1000),
+		closed:    make(chan struct{}),
+		retryWait: captureRetryWait,
+	}
+	if len(cfg.Expression) > 0 {
+		filter, err := compileBPFFilter(cfg.NetworkInterface, cfg.Expression)
+		if err != nil {
+			return nil, err
+		}
+		s.filter = filter
+	}
+	// the fanout group is shared by every process using its id
+	fanoutID := uint16(os.Getpid())
+	for i := 0; i < threads; i++ {
+		socket, err := afpacket.NewTPacket(
+			afpacket.OptInterface(cfg.NetworkInterface),
+			afpacket.OptFrameSize(afpacketFrameSize),
+			afpacket.OptBlockSize(afpacketBlockSize),
+			afpacket.OptNumBlocks(numBlocks),
+			afpacket.TPacketVersion3)
+		if err == nil && threads > 1 {
+			err = socket.SetFanout(afpacket.FanoutHash, fanoutID)
+		}
+		if err != nil {
+			for _, opened := range s.sockets {
+				opened.Close()
+			}
+			if socket != nil {
+				socket.Close()
+			}
+			return nil, fmt.Errorf("error opening AF_PACKET socket on network interface: %v", err)
+		}
+		s.sockets = append(s.sockets, socket)
+	}
+	return s, nil
+}
+
+// compileBPFFilter compiles a BPF filter expression for the link type of a
+// network interface, which requires briefly opening a pcap handle on it.
+func compileBPFFilter(iface, expr string) (*pcap.BPF, error) {
+	handle, err := pcap.OpenLive(iface, 64*1024, false, pcap.BlockForever)
+	if err != nil {
+		return nil, fmt.Errorf("error opening network interface to compile packet filter expression: %v", err)
+	}
+	defer handle.Close()
+	filter, err := handle.NewBPF(expr)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling packet filter expression: %v", err)
+	}
+	return filter, nil
+}
+
+// Packets starts reading every socket in its own goroutine, the first time
+// it is called. The channel is closed once they have all stopped.
+func (s *afpacketSource) Packets() chan gopacket.Packet {
+	s.once.Do(func() {
+		s.readers.Add(len(s.sockets))
+		for _, socket := range s.sockets {
+			go s.read(socket)
+		}
+		go func() {
+			s.readers.Wait()
+			close(s.packets)
+		}()
+	})
+	return s.packets
+}
+
+// read decodes the packets of a socket which match the filter, copying them
+// out of its ring, until the source is closed or the socket can't be read
+// anymore, which ends the capture with an error.
+func (s *afpacketSource) read(socket afpacketSocket) {
+	defer s.readers.Done()
+	defer socket.Close()
+	backoff := captureBackoff{retryWait: s.retryWait}
+	for {
+		data, ci, err := socket.ZeroCopyReadPacketData()
+		select {
+		case <-s.closed:
+			return
+		default:
+		}
+		if err == syscall.EINTR {
+			// poll is interrupted by signals
+			continue
+		}
+		if err != nil {
+			retry, fatal := backoff.failed("AF_PACKET socket", err, s.closed)
+			if fatal != nil {
+				s.fail(fatal)
+			}
+			if !retry {
+				return
+			}
+			continue
+		}
+		backoff.succeeded()
+		if s.filter != nil && !s.filter.Matches(ci, data) {
+			continue
+		}
+		pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		m := pkt.Metadata()
+		m.CaptureInfo = ci
+		m.Truncated = m.Truncated || ci.CaptureLength < ci.Length
+		select {
+		case s.packets <- pkt:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// Close stops the goroutines reading the sockets, each of which closes its
+// socket once its pending read returns, or closes the sockets if they were
+// never read.
+func (s *afpacketSource) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	s.once.Do(func() {
+		for _, socket := range s.sockets {
+			socket.Close()
+		}
+	})
+}
+
+// fail ends the capture with err, stopping the goroutines reading the
+// sockets.
+func (s *afpacketSource) fail(err error) {
+	s.errLock.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.errLock.Unlock()
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+}
+
+// Err returns the error which ended the capture, if any.
+func (s *afpacketSource) Err() error {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	return s.err
+}
+
+// Stats is unavailable, as the AF_PACKET sockets don't report the packets
+// they drop.
+func (s *afpacketSource) Stats() (int64, int64, error) {
+	return 0, 0, fmt.Errorf("the %v capture engine doesn't count dropped packets", captureEngineAFPacket)
+}
@@ -0,0 +1,15 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+// +build !linux
+
+package mongoreplay
+
+import "fmt"
+
+func openAFPacket(cfg OpStreamSettings) (captureSource, error) {
+	return nil, fmt.Errorf("the %v capture engine is only available on Linux", captureEngineAFPacket)
+}
@@ -0,0 +1,240 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// A capture whose reads fail is read again after captureRetryWait, doubled
+// after each failure, until captureMaxReadErrors reads in a row have failed,
+// which ends the capture.
+const (
+	captureRetryWait     = 10 * time.Millisecond
+	captureMaxReadErrors = 10
+)
+
+// The capture engines which --captureEngine selects from to capture packets
+// on a network interface.
+const (
+	captureEnginePcap     = "pcap"
+	captureEngineAFPacket = "afpacket"
+)
+
+// captureSource is where a PacketHandler reads the captured packets from.
+type captureSource interface {
+	// Packets returns the channel of captured packets, which is closed once
+	// every packet of the capture has been read.
+	Packets() chan gopacket.Packet
+	// Stats returns the number of packets dropped by the kernel, as there
+	// was no room left in the capture buffer, and by the network interface.
+	Stats() (dropped, ifDropped int64, err error)
+	// Close stops the capture. Packets captured but not yet read are
+	// discarded.
+	Close()
+	// Err returns the error which ended the capture once Packets is
+	// closed, or nil if every packet was read or the capture was closed.
+	Err() error
+}
+
+// captureBackoff waits between the reads of a capture which fail.
+type captureBackoff struct {
+	// retryWait is the first wait
+	retryWait time.Duration
+	failures  int
+	wait      time.Duration
+}
+
+// failed waits after a read of source failed with err, and returns whether
+// to read again, which it doesn't once closed is closed, or with an error
+// once reads failed captureMaxReadErrors times in a row.
+func (b *captureBackoff) failed(source string, err error, closed <-chan struct{}) (bool, error) {
+	b.failures++
+	if b.failures >= captureMaxReadErrors {
+		return false, fmt.Errorf("error reading %v: %v", source, err)
+	}
+	if b.wait == 0 {
+		b.wait = b.retryWait
+	}
+	toolDebugLogger.Logvf(DebugLow, "Error reading %v, retrying in %v: %v", source, b.wait, err)
+	select {
+	case <-time.After(b.wait):
+	case <-closed:
+		return false, nil
+	}
+	b.wait *= 2
+	return true, nil
+}
+
+// succeeded resets the backoff after a read succeeded.
+func (b *captureBackoff) succeeded() {
+	b.failures, b.wait = 0, 0
+}
+
+// pcapSource is a captureSource reading the packets of a pcap handle, from
+// either a pcap file or a network interface.
+type pcapSource struct {
+	handle    *pcap.Handle
+	source    *gopacket.PacketSource
+	packets   chan gopacket.Packet
+	once      sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+	retryWait time.Duration
+	// err is the error which ended the capture, set before packets is
+	// closed
+	err error
+}
+
+func newPcapSource(handle *pcap.Handle) *pcapSource {
+	return &pcapSource{
+		handle:    handle,
+		source:    gopacket.NewPacketSource(handle, handle.LinkType()),
+		packets:   make(chan gopacket.Packet, 1000),
+		closed:    make(chan struct{}),
+		retryWait: captureRetryWait,
+	}
+}
+
+// Packets starts reading the handle, the first time it is called.
+func (s *pcapSource) Packets() chan gopacket.Packet {
+	s.once.Do(func() {
+		go s.read()
+	})
+	return s.packets
+}
+
+// read reads the packets of the handle until the end of its file or its
+// closing, or until it can't be read anymore, which ends the capture with
+// an error.
+func (s *pcapSource) read() {
+	defer close(s.packets)
+	backoff := captureBackoff{retryWait: s.retryWait}
+	for {
+		packet, err := s.source.NextPacket()
+		switch {
+		case err == io.EOF:
+			return
+		case err != nil:
+			retry, fatal := backoff.failed("pcap handle", err, s.closed)
+			if !retry {
+				s.err = fatal
+				return
+			}
+			continue
+		}
+		backoff.succeeded()
+		s.packets <- packet
+	}
+}
+
+// Err returns the error which ended the capture, once Packets is closed.
+func (s *pcapSource) Err() error {
+	return s.err
+}
+
+func (s *pcapSource) Stats() (int64, int64, error) {
+	stats, err := s.handle.Stats()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(stats.PacketsDropped), int64(stats.PacketsIfDropped), nil
+}
+
+// Close closes the pcap handle once its pending read returns, which for a
+// live capture waits for the next packet, draining the packets left.
+func (s *pcapSource) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	packets := s.Packets()
+	go s.handle.Close()
+	go func() {
+		for range packets {
+		}
+	}()
+}
+
+// openCaptureSource opens the pcap file or the network interface to record
+// from, with the capture engine and BPF filter expression of cfg.
+func openCaptureSource(cfg OpStreamSettings) (captureSource, error) {
+	var handle *pcap.Handle
+	var err error
+	switch {
+	case len(cfg.PcapFile) > 0:
+		handle, err = pcap.OpenOffline(cfg.PcapFile)
+		if err != nil {
+			return nil, fmt.Errorf("error opening pcap file: %v", err)
+		}
+	case len(cfg.NetworkInterface) > 0:
+		switch cfg.CaptureEngine {
+		case "", captureEnginePcap:
+			handle, err = openPcapInterface(cfg)
+			if err != nil {
+				return nil, err
+			}
+		case captureEngineAFPacket:
+			return openAFPacket(cfg)
+		default:
+			return nil, fmt.Errorf("unknown capture engine %q", cfg.CaptureEngine)
+		}
+	default:
+		return nil, fmt.Errorf("must specify either a pcap file or network interface to record from")
+	}
+
+	if len(cfg.Expression) > 0 {
+		err = handle.SetBPFFilter(cfg.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("error setting packet filter expression: %v", err)
+		}
+	}
+	return newPcapSource(handle), nil
+}
+
+// openPcapInterface opens a pcap handle listening to the network interface
+// of cfg.
+func openPcapInterface(cfg OpStreamSettings) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(cfg.NetworkInterface)
+	if err != nil {
+		return nil, fmt.Errorf("error creating a pcap handle: %v", err)
+	}
+	// This is safe; calling `Activate()` steals the underlying ptr.
+	defer inactive.CleanUp()
+
+	err = inactive.SetSnapLen(64 * 1024)
+	if err != nil {
+		return nil, fmt.Errorf("error setting snaplen on pcap handle: %v", err)
+	}
+
+	err = inactive.SetPromisc(false)
+	if err != nil {
+		return nil, fmt.Errorf("error setting promisc on pcap handle: %v", err)
+	}
+
+	err = inactive.SetTimeout(pcap.BlockForever)
+	if err != nil {
+		return nil, fmt.Errorf("error setting timeout on pcap handle: %v", err)
+	}
+
+	// CaptureBufSize is in KiB to match units on `tcpdump -B`.
+	err = inactive.SetBufferSize(cfg.CaptureBufSize * 1024)
+	if err != nil {
+		return nil, fmt.Errorf("error setting buffer size on pcap handle: %v", err)
+	}
+
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, fmt.Errorf("error listening to network interface: %v", err)
+	}
+	return handle, nil
+}
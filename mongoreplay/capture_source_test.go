@@ -0,0 +1,116 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestRecordCaptureEngineParams(t *testing.T) {
+	type testCase struct {
+		name     string
+		settings OpStreamSettings
+		valid    bool
+	}
+	cases := []testCase{
+		{
+			name:     "pcap engine on a pcap file",
+			settings: OpStreamSettings{PcapFile: "file.pcap", CaptureEngine: captureEnginePcap},
+			valid:    true,
+		},
+		{
+			name:     "afpacket engine with fanout",
+			settings: OpStreamSettings{NetworkInterface: "eth0", CaptureEngine: captureEngineAFPacket, CaptureThreads: 4},
+			valid:    true,
+		},
+		{
+			name:     "afpacket engine on a pcap file",
+			settings: OpStreamSettings{PcapFile: "file.pcap", CaptureEngine: captureEngineAFPacket},
+		},
+		{
+			name:     "fanout with the pcap engine",
+			settings: OpStreamSettings{NetworkInterface: "eth0", CaptureEngine: captureEnginePcap, CaptureThreads: 4},
+		},
+		{
+			name:     "unknown engine",
+			settings: OpStreamSettings{NetworkInterface: "eth0", CaptureEngine: "pfring"},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		record := &RecordCommand{OpStreamSettings: c.settings}
+		err := record.ValidateParams(nil)
+		if c.valid && err != nil {
+			t.Errorf("expected the settings to be valid, got %v", err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("expected the settings to be invalid")
+		}
+	}
+}
+
+// failingPacketData is a packet data source whose reads fail failures times
+// before returning its packets, then io.EOF. A negative number of failures
+// fails every read.
+type failingPacketData struct {
+	failures int
+	packets  int
+	reads    int
+}
+
+func (data *failingPacketData) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data.reads++
+	if data.failures != 0 {
+		data.failures--
+		return nil, gopacket.CaptureInfo{}, fmt.Errorf("read error")
+	}
+	if data.packets == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data.packets--
+	return make([]byte, 60), gopacket.CaptureInfo{CaptureLength: 60, Length: 60}, nil
+}
+
+func TestPcapSourceReadErrors(t *testing.T) {
+	type testCase struct {
+		name    string
+		data    *failingPacketData
+		packets int
+		reads   int
+		err     bool
+	}
+	cases := []testCase{
+		{name: "transient errors", data: &failingPacketData{failures: 3, packets: 2}, packets: 2, reads: 6},
+		{name: "persistent error", data: &failingPacketData{failures: -1}, reads: captureMaxReadErrors, err: true},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		s := &pcapSource{
+			source:    gopacket.NewPacketSource(c.data, layers.LinkTypeEthernet),
+			packets:   make(chan gopacket.Packet, 1000),
+			closed:    make(chan struct{}),
+			retryWait: time.Millisecond,
+		}
+		packets := 0
+		for range s.Packets() {
+			packets++
+		}
+		if packets != c.packets || c.data.reads != c.reads {
+			t.Errorf("expected %v packets in %v reads, got %v in %v", c.packets, c.reads, packets, c.data.reads)
+		}
+		if err := s.Err(); (err != nil) != c.err || err != nil && !strings.Contains(err.Error(), "read error") {
+			t.Errorf("expected error %v, got %v", c.err, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// CaptureStats counts what a recording may be missing from the traffic it
+// captured. They are logged periodically while recording, and written at the
+// end of the playback file once the recording finishes.
+type CaptureStats struct {
+	// PacketsCaptured is the number of packets handled by the recording.
+	PacketsCaptured int64
+	// PacketsDropped and PacketsIfDropped are the packets of a live capture
+	// dropped by the kernel, as there was no room left in the capture buffer,
+	// and by the network interface.
+	PacketsDropped   int64
+	PacketsIfDropped int64
+	// BufferOverflows counts the times the limit of --maxBufferedPages or
+	// --maxBufferedMemory was reached, giving up on the packets a connection
+	// was waiting for, and SpooledPages the pages spooled to --spoolDir
+	// instead.
+	BufferOverflows int64
+	SpooledPages    int64
+	// TruncatedOps counts the ops which were not recorded because some of
+	// their bytes were missing, whether they were lost by the capture or
+	// given up by a buffer overflow, and CorruptMessages the places where
+	// corrupt data was skipped.
+	TruncatedOps    int64
+	CorruptMessages int64
+}
+
+// playbackFileTrailer is the document holding the capture stats which ends
+// a playback file. Files recorded before they were written don't have one.
+type playbackFileTrailer struct {
+	CaptureStats CaptureStats `bson:"captureStats"`
+}
+
+// isPlaybackFileTrailer returns whether a raw document of a playback file is
+// its trailer rather than a recorded op, from the name of its first field.
+func isPlaybackFileTrailer(doc []byte) bool {
+	return len(doc) > 5 && bytes.HasPrefix(doc[5:], []byte("captureStats\x00"))
+}
+
+// Lossy returns whether the recording is missing any of the captured traffic.
+func (stats *CaptureStats) Lossy() bool {
+	return stats.PacketsDropped > 0 || stats.PacketsIfDropped > 0 || stats.BufferOverflows > 0 ||
+		stats.TruncatedOps > 0 || stats.CorruptMessages > 0
+}
+
+// add adds the counts of other to those of stats, as for recordings which
+// are merged.
+func (stats *CaptureStats) add(other *CaptureStats) {
+	stats.PacketsCaptured += other.PacketsCaptured
+	stats.PacketsDropped += other.PacketsDropped
+	stats.PacketsIfDropped += other.PacketsIfDropped
+	stats.BufferOverflows += other.BufferOverflows
+	stats.SpooledPages += other.SpooledPages
+	stats.TruncatedOps += other.TruncatedOps
+	stats.CorruptMessages += other.CorruptMessages
+}
+
+// since returns the counts of stats since those of base, as for the
+// segments of a rotated recording.
+func (stats CaptureStats) since(base CaptureStats) CaptureStats {
+	return CaptureStats{
+		PacketsCaptured:  stats.PacketsCaptured - base.PacketsCaptured,
+		PacketsDropped:   stats.PacketsDropped - base.PacketsDropped,
+		PacketsIfDropped: stats.PacketsIfDropped - base.PacketsIfDropped,
+		BufferOverflows:  stats.BufferOverflows - base.BufferOverflows,
+		SpooledPages:     stats.SpooledPages - base.SpooledPages,
+		TruncatedOps:     stats.TruncatedOps - base.TruncatedOps,
+		CorruptMessages:  stats.CorruptMessages - base.CorruptMessages,
+	}
+}
+
+func (stats *CaptureStats) String() string {
+	return fmt.Sprintf("%v packets captured, %v dropped by the kernel, %v dropped by the interface, "+
+		"%v reassembly buffer overflows, %v pages spooled, %v truncated ops, %v corrupt messages",
+		stats.PacketsCaptured, stats.PacketsDropped, stats.PacketsIfDropped,
+		stats.BufferOverflows, stats.SpooledPages, stats.TruncatedOps, stats.CorruptMessages)
+}
+
+// captureStats returns the capture stats of the recording so far. The
+// counts of the capture source are left out, and its error returned, when
+// they are unavailable, as for pcap files.
+func (ctx *packetHandlerContext) captureStats() (CaptureStats, error) {
+	stats := CaptureStats{
+		PacketsCaptured: atomic.LoadInt64(&ctx.packetHandler.packetsCaptured),
+		BufferOverflows: atomic.LoadInt64(&ctx.packetHandler.bufferOverflows),
+		SpooledPages:    atomic.LoadInt64(&ctx.packetHandler.spooledPages),
+		TruncatedOps:    atomic.LoadInt64(&ctx.mongoOpStream.truncatedOps),
+		CorruptMessages: atomic.LoadInt64(&ctx.mongoOpStream.corruptions),
+	}
+	dropped, ifDropped, err := ctx.source.Stats()
+	if err != nil {
+		return stats, err
+	}
+	stats.PacketsDropped = dropped
+	stats.PacketsIfDropped = ifDropped
+	return stats, nil
+}
+
+// logCaptureStats logs the capture stats of the recording every interval
+// until done is closed.
+func (ctx *packetHandlerContext) logCaptureStats(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			stats, _ := ctx.captureStats()
+			userInfoLogger.Logvf(Always, "Capture stats: %v", &stats)
+		case <-done:
+			return
+		}
+	}
+}
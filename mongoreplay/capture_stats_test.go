@@ -0,0 +1,98 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestCaptureStatsTrailer(t *testing.T) {
+	stats := CaptureStats{
+		PacketsCaptured:  1000,
+		PacketsDropped:   3,
+		PacketsIfDropped: 1,
+		BufferOverflows:  2,
+		TruncatedOps:     4,
+		CorruptMessages:  5,
+	}
+	type testCase struct {
+		name      string
+		withStats bool
+	}
+	cases := []testCase{
+		{name: "playback file ending with capture stats", withStats: true},
+		{name: "playback file without capture stats"},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		b := &bytes.Buffer{}
+		playbackWriter, err := playbackFileWriterFromWriteCloser(NopWriteCloser(b), "file", PlaybackFileMetadata{})
+		if err != nil {
+			t.Fatalf("couldn't create playbackfile writer %v", err)
+		}
+		generator := newRecordedOpGenerator()
+		if err := generator.generateInsertHelper("insert", 0, 10); err != nil {
+			t.Fatal(err)
+		}
+		close(generator.opChan)
+		for op := range generator.opChan {
+			if err := bsonToWriter(playbackWriter, op); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c.withStats {
+			if err := playbackWriter.WriteCaptureStats(stats); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		playbackReader, err := playbackFileReaderFromReadSeeker(bytes.NewReader(b.Bytes()), "")
+		if err != nil {
+			t.Fatalf("couldn't create playbackfile reader %v", err)
+		}
+		opChan, errChan := playbackReader.OpChan(1)
+		var numOps int
+		for op := range opChan {
+			if op.Seen == nil {
+				t.Errorf("expected only recorded ops, got %#v", op)
+			}
+			numOps++
+		}
+		if err := <-errChan; err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if numOps != 10 {
+			t.Errorf("expected 10 ops, got %v", numOps)
+		}
+		read := playbackReader.CaptureStats()
+		switch {
+		case !c.withStats && read != nil:
+			t.Errorf("expected no capture stats, got %v", read)
+		case c.withStats && (read == nil || *read != stats):
+			t.Errorf("expected capture stats %v, got %v", &stats, read)
+		}
+	}
+}
+
+func TestCaptureStatsLossy(t *testing.T) {
+	if stats := (CaptureStats{PacketsCaptured: 10}); stats.Lossy() {
+		t.Errorf("expected %v not to be lossy", &stats)
+	}
+	for _, stats := range []CaptureStats{
+		{PacketsDropped: 1},
+		{PacketsIfDropped: 1},
+		{BufferOverflows: 1},
+		{TruncatedOps: 1},
+		{CorruptMessages: 1},
+	} {
+		if !stats.Lossy() {
+			t.Errorf("expected %v to be lossy", &stats)
+		}
+	}
+}
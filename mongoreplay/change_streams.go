@@ -0,0 +1,241 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/10gen/llmgo/bson"
+	"github.com/patrickmn/go-cache"
+)
+
+// the ways the resume options of replayed change streams are played, as set
+// by --changeStreamResume
+const (
+	// changeStreamResumeRemap resumes change streams from the live position
+	// matching the recorded one they resumed from, restarting them from now
+	// if there is none.
+	changeStreamResumeRemap = "remap"
+	// changeStreamResumeNow restarts every change stream from now.
+	changeStreamResumeNow = "now"
+	// changeStreamResumeRecorded plays the resume options as recorded.
+	changeStreamResumeRecorded = "recorded"
+)
+
+// changeStreamStage returns the options of the $changeStream stage opening
+// the pipeline of an aggregate command, if it opens a change stream.
+func changeStreamStage(command bson.D) (bson.D, bool) {
+	if len(command) == 0 || command[0].Name != "aggregate" {
+		return nil, false
+	}
+	value, _ := FindValueByKey("pipeline", &command)
+	pipeline, ok := value.([]interface{})
+	if !ok || len(pipeline) == 0 {
+		return nil, false
+	}
+	stage, err := bsonToD(pipeline[0])
+	if err != nil || len(stage) != 1 || stage[0].Name != "$changeStream" {
+		return nil, false
+	}
+	options, err := bsonToD(stage[0].Value)
+	if err != nil {
+		return nil, false
+	}
+	return options, true
+}
+
+// changeStreamCommand returns the command op runs if it may open a change
+// stream, and a function replacing the command in op.
+func changeStreamCommand(op Op) (bson.D, func(bson.D) error, error) {
+	switch castOp := op.(type) {
+	case *QueryOp:
+		if !strings.HasSuffix(castOp.Collection, ".$cmd") {
+			return nil, nil, nil
+		}
+		query, wrapper, err := unwrapQuery(castOp.Query)
+		if err != nil {
+			return nil, nil, err
+		}
+		return query, func(command bson.D) error {
+			if wrapper != nil {
+				wrapper[0].Value = command
+				castOp.Query = wrapper
+			} else {
+				castOp.Query = command
+			}
+			return nil
+		}, nil
+	case *MsgOp:
+		if castOp.CommandName != "aggregate" {
+			return nil, nil, nil
+		}
+		payload, sectionIx, err := fetchPayload0Data(castOp.Sections)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := bsonToD(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		return body, func(command bson.D) error {
+			raw, err := dToRaw(command)
+			if err != nil {
+				return err
+			}
+			castOp.Sections[sectionIx].Data = raw
+			return nil
+		}, nil
+	}
+	return nil, nil, nil
+}
+
+// isChangeStream returns whether op opens a change stream.
+func isChangeStream(op Op) bool {
+	command, _, err := changeStreamCommand(op)
+	if err != nil {
+		return false
+	}
+	_, ok := changeStreamStage(command)
+	return ok
+}
+
+// rewriteChangeStream rewrites the options of a change stream opened by op
+// which resume it from a recorded position, as set by --changeStreamResume.
+// Recorded resume tokens and operation times mean nothing to the server
+// played against, which would fail the change stream or replay events from
+// an arbitrary point. startAtOperationTime is always removed, and the
+// resume tokens of resumeAfter and startAfter are replaced by the live ones
+// matching them, or removed if there are none.
+func (context *ExecutionContext) rewriteChangeStream(op Op) error {
+	command, replace, err := changeStreamCommand(op)
+	if err != nil || replace == nil {
+		return err
+	}
+	options, ok := changeStreamStage(command)
+	if !ok {
+		return nil
+	}
+	var rewritten bson.D
+	var remapped, restarted bool
+	for _, option := range options {
+		switch option.Name {
+		case "resumeAfter", "startAfter":
+			if context.changeStreamResume == changeStreamResumeRemap {
+				if token, ok := context.changeStreamTokens.Get(resumeTokenKey(option.Value)); ok {
+					remapped = true
+					rewritten = append(rewritten, bson.DocElem{Name: option.Name, Value: token})
+					continue
+				}
+			}
+			restarted = true
+		case "startAtOperationTime":
+			restarted = true
+		default:
+			rewritten = append(rewritten, option)
+		}
+	}
+	switch {
+	case restarted:
+		atomic.AddInt64(&context.restartedChangeStreams, 1)
+	case remapped:
+		atomic.AddInt64(&context.remappedResumeTokens, 1)
+	default:
+		return nil
+	}
+	if rewritten == nil {
+		rewritten = bson.D{}
+	}
+	value, _ := FindValueByKey("pipeline", &command)
+	pipeline := append([]interface{}{bson.D{{Name: "$changeStream", Value: rewritten}}}, value.([]interface{})[1:]...)
+	return replace(setDocField(command, "pipeline", pipeline))
+}
+
+// mapResumeTokens maps the resume tokens of the recorded reply to a change
+// stream's aggregate or getMore to the live position reached by the reply
+// played, so that the change streams later resumed from them resume from
+// it. The postBatchResumeToken of the recorded cursor, and the _id of the
+// last event of its batch, are mapped to the postBatchResumeToken of the
+// live cursor, or the _id of the last event of its batch on servers which
+// don't return one.
+func (context *ExecutionContext) mapResumeTokens(fromFile, fromWire Replyable) {
+	recorded := resumeTokensOf(fromFile)
+	live := resumeTokensOf(fromWire)
+	if len(recorded) == 0 || len(live) == 0 {
+		return
+	}
+	for _, token := range recorded {
+		context.changeStreamTokens.Set(resumeTokenKey(token), live[0], cache.DefaultExpiration)
+	}
+}
+
+// resumeTokensOf returns the resume tokens of the position a reply to a
+// change stream's aggregate or getMore reached: its postBatchResumeToken,
+// if any, followed by the _id of the last event of its batch, if any.
+func resumeTokensOf(reply Replyable) []interface{} {
+	docs, err := replyDocuments(reply)
+	if err != nil || len(docs) == 0 {
+		return nil
+	}
+	doc, err := bsonToD(docs[0])
+	if err != nil {
+		return nil
+	}
+	value, ok := FindValueByKey("cursor", &doc)
+	if !ok {
+		return nil
+	}
+	cursor, err := bsonToD(value)
+	if err != nil {
+		return nil
+	}
+	var tokens []interface{}
+	if token, ok := FindValueByKey("postBatchResumeToken", &cursor); ok {
+		tokens = append(tokens, token)
+	}
+	for _, name := range []string{"firstBatch", "nextBatch"} {
+		batch, _ := FindValueByKey(name, &cursor)
+		events, ok := batch.([]interface{})
+		if !ok || len(events) == 0 {
+			continue
+		}
+		event, err := bsonToD(events[len(events)-1])
+		if err != nil {
+			continue
+		}
+		if id, ok := FindValueByKey("_id", &event); ok {
+			tokens = append(tokens, id)
+		}
+	}
+	return tokens
+}
+
+// resumeTokenKey returns the key of a resume token in the tokens mapped,
+// which is its _data string for the tokens of servers since 4.0.7.
+func resumeTokenKey(token interface{}) string {
+	doc, err := bsonToD(token)
+	if err != nil {
+		return fmt.Sprintf("%v", token)
+	}
+	if data, ok := FindValueByKey("_data", &doc); ok {
+		return fmt.Sprintf("%v", data)
+	}
+	return fmt.Sprintf("%v", doc)
+}
+
+// RemappedResumeTokens returns the number of change streams resumed from
+// the live position matching the recorded one they resumed from.
+func (context *ExecutionContext) RemappedResumeTokens() int64 {
+	return atomic.LoadInt64(&context.remappedResumeTokens)
+}
+
+// RestartedChangeStreams returns the number of change streams resuming from
+// a recorded position which were restarted from now instead.
+func (context *ExecutionContext) RestartedChangeStreams() int64 {
+	return atomic.LoadInt64(&context.restartedChangeStreams)
+}
@@ -0,0 +1,125 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"reflect"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestRewriteChangeStream(t *testing.T) {
+	recordedToken := bson.D{{"_data", "8263A0"}}
+	liveToken := bson.D{{"_data", "8265F1"}}
+	match := bson.D{{"$match", bson.D{{"operationType", "insert"}}}}
+	type testCase struct {
+		name    string
+		policy  string
+		command bson.D
+		// expected is the $changeStream stage played, and remapped and
+		// restarted whether the change stream was counted as either
+		expected            bson.D
+		remapped, restarted bool
+	}
+	stream := func(options bson.D) bson.D {
+		return bson.D{{"aggregate", "c"}, {"pipeline", []interface{}{bson.D{{"$changeStream", options}}, match}}, {"cursor", bson.D{}}}
+	}
+	cases := []testCase{
+		{
+			name:     "resume token remapped",
+			policy:   changeStreamResumeRemap,
+			command:  stream(bson.D{{"fullDocument", "updateLookup"}, {"resumeAfter", recordedToken}}),
+			expected: bson.D{{"fullDocument", "updateLookup"}, {"resumeAfter", liveToken}},
+			remapped: true,
+		},
+		{
+			name:      "unknown token removed",
+			policy:    changeStreamResumeRemap,
+			command:   stream(bson.D{{"startAfter", bson.D{{"_data", "unknown"}}}}),
+			expected:  bson.D{},
+			restarted: true,
+		},
+		{
+			name:      "operation time removed",
+			policy:    changeStreamResumeRemap,
+			command:   stream(bson.D{{"startAtOperationTime", bson.MongoTimestamp(1 << 32)}}),
+			expected:  bson.D{},
+			restarted: true,
+		},
+		{
+			name:      "restarted from now",
+			policy:    changeStreamResumeNow,
+			command:   stream(bson.D{{"resumeAfter", recordedToken}}),
+			expected:  bson.D{},
+			restarted: true,
+		},
+		{
+			name:     "not resuming",
+			policy:   changeStreamResumeRemap,
+			command:  stream(bson.D{{"fullDocument", "updateLookup"}}),
+			expected: bson.D{{"fullDocument", "updateLookup"}},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		context := NewExecutionContext(&StatCollector{}, nil, &ExecutionOptions{changeStreamResume: c.policy})
+		if c.policy == changeStreamResumeRemap {
+			context.mapResumeTokens(
+				msgOpReplyWith(t, bson.D{{"cursor", bson.D{{"id", int64(1)}, {"nextBatch", []interface{}{}}, {"postBatchResumeToken", recordedToken}}}, {"ok", 1}}),
+				msgOpReplyWith(t, bson.D{{"cursor", bson.D{{"id", int64(2)}, {"nextBatch", []interface{}{}}, {"postBatchResumeToken", liveToken}}}, {"ok", 1}}))
+		}
+		op, err := newMsgCommand("test", c.command)
+		if err != nil {
+			t.Fatalf("error building the command: %v", err)
+		}
+		if err := context.rewriteChangeStream(op); err != nil {
+			t.Errorf("error rewriting the change stream: %v", err)
+			continue
+		}
+		command, _, err := changeStreamCommand(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stage, ok := changeStreamStage(command)
+		if !ok {
+			t.Errorf("expected a change stream, got %v", command)
+			continue
+		}
+		if !reflect.DeepEqual(stage, c.expected) {
+			t.Errorf("expected $changeStream %v, got %v", c.expected, stage)
+		}
+		pipeline, _ := FindValueByKey("pipeline", &command)
+		if stages := pipeline.([]interface{}); len(stages) != 2 {
+			t.Errorf("expected the rest of the pipeline to be kept, got %v", stages)
+		}
+		if remapped := context.RemappedResumeTokens() == 1; remapped != c.remapped {
+			t.Errorf("expected remapped %v, got %v", c.remapped, remapped)
+		}
+		if restarted := context.RestartedChangeStreams() == 1; restarted != c.restarted {
+			t.Errorf("expected restarted %v, got %v", c.restarted, restarted)
+		}
+	}
+}
+
+func TestResumeTokensOf(t *testing.T) {
+	token := bson.D{{"_data", "8263A0"}}
+	eventID := bson.D{{"_data", "8263A1"}}
+	reply := msgOpReplyWith(t, bson.D{{"cursor", bson.D{
+		{"id", int64(1)},
+		{"firstBatch", []interface{}{bson.D{{"_id", bson.D{{"_data", "8263A2"}}}}, bson.D{{"_id", eventID}, {"operationType", "insert"}}}},
+		{"postBatchResumeToken", token},
+	}}, {"ok", 1}})
+	expected := []interface{}{token, eventID}
+	if tokens := resumeTokensOf(reply); !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("expected %v, got %v", expected, tokens)
+	}
+	if tokens := resumeTokensOf(&ReplyOp{ReplyOp: mgo.ReplyOp{}}); tokens != nil {
+		t.Errorf("expected no tokens from an empty reply, got %v", tokens)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PlaybackCheckpoint records how far a playback got, so that an interrupted
+// playback can be resumed from roughly where it left off.
+type PlaybackCheckpoint struct {
+	// PlaybackFile is the path of the playback file being played.
+	PlaybackFile string `bson:"playbackFile"`
+
+	// Generation and Order identify the furthest op of the playback file that
+	// had been played when the checkpoint was written.
+	Generation int   `bson:"generation"`
+	Order      int64 `bson:"order"`
+
+	// OpsPlayed is the number of ops played before the checkpoint was written,
+	// including those played before any earlier resume.
+	OpsPlayed int64 `bson:"opsPlayed"`
+
+	// Cursors maps the cursorIDs of the playback file to the live cursorIDs
+	// that were still in use.
+	Cursors []CheckpointCursor `bson:"cursors"`
+
+	// OpenConnections holds the recorded connection numbers which had been
+	// opened and had yet to end. On resume, they stay open until their ops
+	// end them, so that later checkpoints still hold them.
+	OpenConnections []int64 `bson:"openConnections"`
+
+	// Complete is set once all of the playback file has been played.
+	Complete bool `bson:"complete"`
+
+	Written time.Time `bson:"written"`
+}
+
+// CheckpointCursor maps a cursorID from the playback file to its live
+// cursorID.
+type CheckpointCursor struct {
+	Recorded int64 `bson:"recorded"`
+	Live     int64 `bson:"live"`
+}
+
+// liveCursorLister is implemented by the cursorManagers that are able to
+// report the live cursors they know of.
+type liveCursorLister interface {
+	LiveCursors() map[int64]int64
+}
+
+// ReadCheckpointFile reads a PlaybackCheckpoint from the file at path.
+func ReadCheckpointFile(path string) (*PlaybackCheckpoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	checkpoint := &PlaybackCheckpoint{}
+	if err := bsonFromReader(file, checkpoint); err != nil {
+		return nil, fmt.Errorf("error reading checkpoint %v: %v", path, err)
+	}
+	return checkpoint, nil
+}
+
+// played returns whether the op precedes or is the op that was furthest
+// along in the playback when the checkpoint was written.
+func (checkpoint *PlaybackCheckpoint) played(op *RecordedOp) bool {
+	if op.Generation != checkpoint.Generation {
+		return op.Generation < checkpoint.Generation
+	}
+	return op.Order <= checkpoint.Order
+}
+
+// restoreCursors seeds the cursorManager with the live cursors saved in the
+// checkpoint.
+func (checkpoint *PlaybackCheckpoint) restoreCursors(cursors cursorManager) {
+	for _, cursor := range checkpoint.Cursors {
+		cursors.SetCursor(cursor.Recorded, cursor.Live)
+	}
+}
+
+// checkpointer keeps track of the progress of a playback and periodically
+// writes it to a checkpoint file.
+type checkpointer struct {
+	path         string
+	playbackFile string
+
+	mutex           sync.Mutex
+	generation      int
+	order           int64
+	anyPlayed       bool
+	opsPlayed       int64
+	openConnections map[int64]bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newCheckpointer(path, playbackFile string, resumeFrom *PlaybackCheckpoint) *checkpointer {
+	c := &checkpointer{
+		path:            path,
+		playbackFile:    playbackFile,
+		openConnections: map[int64]bool{},
+	}
+	if resumeFrom != nil {
+		c.generation = resumeFrom.Generation
+		c.order = resumeFrom.Order
+		c.anyPlayed = true
+		c.opsPlayed = resumeFrom.OpsPlayed
+		for _, connectionNum := range resumeFrom.OpenConnections {
+			c.openConnections[connectionNum] = true
+		}
+	}
+	return c
+}
+
+// observePlayed records that the op has been handled by its connection. Ops
+// are played concurrently across connections, so the checkpoint holds the
+// furthest op played, and ops still in flight on other connections when
+// playback is interrupted are skipped on resume.
+func (c *checkpointer) observePlayed(op *RecordedOp) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.opsPlayed++
+	if op.EOF {
+		delete(c.openConnections, op.SeenConnectionNum)
+	} else {
+		c.openConnections[op.SeenConnectionNum] = true
+	}
+	if !c.anyPlayed || op.Generation > c.generation ||
+		(op.Generation == c.generation && op.Order > c.order) {
+		c.generation = op.Generation
+		c.order = op.Order
+		c.anyPlayed = true
+	}
+}
+
+// write atomically replaces the checkpoint file with the current progress.
+func (c *checkpointer) write(cursors cursorManager, complete bool) error {
+	c.mutex.Lock()
+	checkpoint := &PlaybackCheckpoint{
+		PlaybackFile: c.playbackFile,
+		Generation:   c.generation,
+		Order:        c.order,
+		OpsPlayed:    c.opsPlayed,
+		Complete:     complete,
+		Written:      time.Now(),
+	}
+	for connectionNum := range c.openConnections {
+		checkpoint.OpenConnections = append(checkpoint.OpenConnections, connectionNum)
+	}
+	c.mutex.Unlock()
+	sort.Slice(checkpoint.OpenConnections, func(i, j int) bool {
+		return checkpoint.OpenConnections[i] < checkpoint.OpenConnections[j]
+	})
+	if lister, ok := cursors.(liveCursorLister); ok {
+		for recorded, live := range lister.LiveCursors() {
+			checkpoint.Cursors = append(checkpoint.Cursors, CheckpointCursor{recorded, live})
+		}
+	}
+
+	tmpPath := c.path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = bsonToWriter(file, checkpoint)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, c.path)
+}
+
+// start writes a checkpoint every interval until finish is called.
+func (c *checkpointer) start(interval time.Duration, cursors cursorManager) {
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				if err := c.write(cursors, false); err != nil {
+					userInfoLogger.Logvf(Always, "Error writing checkpoint: %v", err)
+				} else {
+					toolDebugLogger.Logvf(DebugLow, "Wrote checkpoint to %v", c.path)
+				}
+			}
+		}
+	}()
+}
+
+// finish stops the periodic checkpoints and writes a final one.
+func (c *checkpointer) finish(cursors cursorManager, complete bool) error {
+	if c.stop != nil {
+		close(c.stop)
+		<-c.done
+	}
+	return c.write(cursors, complete)
+}
+
+// skipPlayedOps returns a channel yielding the ops of opChan which had not
+// been played when the context's resumeFrom checkpoint was written. The
+// cursors produced by skipped ops are marked as failed, so that ops using
+// cursors which were not saved in the checkpoint do not wait for them. The
+// channel is closed once opChan is or ctx is done.
+func skipPlayedOps(ctx context.Context, context *ExecutionContext, opChan <-chan *RecordedOp) <-chan *RecordedOp {
+	ch := make(chan *RecordedOp)
+	go func() {
+		defer close(ch)
+		var skipped int64
+		for {
+			var op *RecordedOp
+			select {
+			case nextOp, ok := <-opChan:
+				if !ok {
+					return
+				}
+				op = nextOp
+			case <-ctx.Done():
+				return
+			}
+			if context.resumeFrom.played(op) {
+				context.CursorIDMap.MarkFailed(op)
+				skipped++
+				continue
+			}
+			userInfoLogger.Logvf(Always, "Skipped %v ops played before the checkpoint", skipped)
+			select {
+			case ch <- op:
+			case <-ctx.Done():
+				return
+			}
+			forwardOps(ctx, opChan, ch)
+			return
+		}
+	}()
+	return ch
+}
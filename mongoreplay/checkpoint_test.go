@@ -0,0 +1,84 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint")
+
+	cursors := &preprocessCursorManager{
+		cursorInfos: map[int64]*preprocessCursorInfo{
+			1: {successChan: make(chan struct{}), failChan: make(chan struct{})},
+			2: {successChan: make(chan struct{}), failChan: make(chan struct{})},
+		},
+		opToCursors: map[opKey]int64{},
+	}
+	cursors.SetCursor(1, 1001)
+
+	c := newCheckpointer(path, "playback.bson", nil)
+	c.observePlayed(&RecordedOp{Generation: 0, Order: 5, SeenConnectionNum: 1})
+	c.observePlayed(&RecordedOp{Generation: 0, Order: 3, SeenConnectionNum: 2})
+	c.observePlayed(&RecordedOp{Generation: 0, Order: 7, SeenConnectionNum: 3})
+	c.observePlayed(&RecordedOp{Generation: 0, Order: 6, SeenConnectionNum: 2, EOF: true})
+	if err := c.finish(cursors, false); err != nil {
+		t.Fatalf("error writing checkpoint: %v", err)
+	}
+
+	checkpoint, err := ReadCheckpointFile(path)
+	if err != nil {
+		t.Fatalf("error reading checkpoint: %v", err)
+	}
+	if checkpoint.PlaybackFile != "playback.bson" || checkpoint.Order != 7 || checkpoint.OpsPlayed != 4 {
+		t.Errorf("unexpected checkpoint %#v", checkpoint)
+	}
+	if !reflect.DeepEqual(checkpoint.OpenConnections, []int64{1, 3}) {
+		t.Errorf("expected connections 1 and 3 to be open, saw %v", checkpoint.OpenConnections)
+	}
+	if !reflect.DeepEqual(checkpoint.Cursors, []CheckpointCursor{{1, 1001}}) {
+		t.Errorf("expected only cursor 1 to be saved, saw %v", checkpoint.Cursors)
+	}
+
+	t.Log("Resuming from the checkpoint")
+	resumed := newCheckpointer(path, "playback.bson", checkpoint)
+	resumed.observePlayed(&RecordedOp{Generation: 0, Order: 8, SeenConnectionNum: 1, EOF: true})
+	resumed.observePlayed(&RecordedOp{Generation: 0, Order: 9, SeenConnectionNum: 4})
+	if err := resumed.finish(cursors, false); err != nil {
+		t.Fatalf("error writing checkpoint: %v", err)
+	}
+	resumedCheckpoint, err := ReadCheckpointFile(path)
+	if err != nil {
+		t.Fatalf("error reading checkpoint: %v", err)
+	}
+	if !reflect.DeepEqual(resumedCheckpoint.OpenConnections, []int64{3, 4}) {
+		t.Errorf("expected connections 3 and 4 to be open after resuming, saw %v", resumedCheckpoint.OpenConnections)
+	}
+
+	for _, c := range []struct {
+		op     *RecordedOp
+		played bool
+	}{
+		{&RecordedOp{Generation: 0, Order: 7}, true},
+		{&RecordedOp{Generation: 0, Order: 8}, false},
+		{&RecordedOp{Generation: 1, Order: 0}, false},
+	} {
+		if checkpoint.played(c.op) != c.played {
+			t.Errorf("op %v of generation %v: expected played to be %v", c.op.Order, c.op.Generation, c.played)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NormalizeClocksCommand stores settings for the mongoreplay
+// 'normalize-clocks' subcommand
+type NormalizeClocksCommand struct {
+	GlobalOpts   *Options `no-flag:"true"`
+	PlaybackFile string   `description:"path to the playback file to read from" short:"p" long:"playback-file" required:"yes"`
+	OutFile      string   `description:"path to the playback file to write the corrected ops to" short:"o" long:"outputFile" required:"yes"`
+	Offsets      []string `long:"offset" description:"clock offset added to the times the ops sent by a host were seen, as <host>=<duration> (e.g. '10.0.0.5=-250ms'). May be repeated"`
+	Correlate    bool     `long:"correlate" description:"also shift the ops sent by each client host earlier by just enough that none of the replies to them is seen before them"`
+	Gzip         bool     `long:"gzip" description:"decompress gzipped input and compress the output"`
+
+	EncryptionOptions `group:"encryption options"`
+
+	offsets clockOffsets
+}
+
+// clockOffsets are the offsets added to the times the ops sent by each host
+// were seen.
+type clockOffsets map[string]time.Duration
+
+// ValidateParams validates the settings described in the
+// NormalizeClocksCommand struct.
+func (normalize *NormalizeClocksCommand) ValidateParams(args []string) error {
+	switch {
+	case len(args) > 0:
+		return fmt.Errorf("unknown argument: %s", args[0])
+	case len(normalize.Offsets) == 0 && !normalize.Correlate:
+		return fmt.Errorf("must specify --offset or --correlate")
+	}
+	normalize.offsets = clockOffsets{}
+	for _, setting := range normalize.Offsets {
+		i := strings.LastIndex(setting, "=")
+		if i < 0 {
+			return fmt.Errorf("Invalid setting for --offset: '%v' is not <host>=<duration>", setting)
+		}
+		offset, err := time.ParseDuration(setting[i+1:])
+		if err != nil {
+			return fmt.Errorf("Invalid setting for --offset: %v", err)
+		}
+		normalize.offsets[endpointHost(setting[:i])] = offset
+	}
+	return nil
+}
+
+// Execute runs the program for the 'normalize-clocks' subcommand
+func (normalize *NormalizeClocksCommand) Execute(args []string) error {
+	err := normalize.ValidateParams(args)
+	if err != nil {
+		return err
+	}
+	normalize.GlobalOpts.SetLogging()
+	if err := normalize.setTapeEncryption(); err != nil {
+		return err
+	}
+
+	reader, err := NewPlaybackFileReader(normalize.PlaybackFile, normalize.Gzip)
+	if err != nil {
+		return err
+	}
+	offsets := normalize.offsets
+	if normalize.Correlate {
+		opChan, errChan := reader.OpChan(1)
+		correlated := correlateClockOffsets(opChan, offsets)
+		if err := <-errChan; err != nil && err != io.EOF {
+			return err
+		}
+		for host, offset := range correlated {
+			offsets[host] += offset
+		}
+	}
+	for _, host := range offsets.hosts() {
+		userInfoLogger.Logvf(Always, "Shifting the ops sent by %v by %v", host, offsets[host])
+	}
+
+	writer, err := NewPlaybackFileWriter(normalize.OutFile, reader.metadata.DriverOpsFiltered, normalize.Gzip)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	opChan, errChan := reader.OpChan(1)
+	writeErr := normalizeClocks(opChan, offsets, writer)
+	for range opChan {
+	}
+	if err := <-errChan; err != nil && err != io.EOF {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if stats := reader.CaptureStats(); stats != nil {
+		return writer.WriteCaptureStats(*stats)
+	}
+	return nil
+}
+
+// endpointHost returns the host of an endpoint such as 10.0.0.1:27017, or
+// the endpoint itself if it has no port.
+func endpointHost(endpoint string) string {
+	if host, _, err := net.SplitHostPort(endpoint); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(endpoint, "["), "]")
+}
+
+// of returns the offset of the host which sent op.
+func (offsets clockOffsets) of(op *RecordedOp) time.Duration {
+	return offsets[endpointHost(op.SrcEndpoint)]
+}
+
+// hosts returns the hosts which have an offset, in order.
+func (offsets clockOffsets) hosts() []string {
+	var hosts []string
+	for host, offset := range offsets {
+		if offset != 0 {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// correlateClockOffsets returns the offsets which, added to the given ones,
+// shift the ops sent by each client host earlier by the most any of the
+// replies to them is seen before them, so that no reply is seen before its
+// op. Replies are told from ops by the op they respond to, and matched with
+// it by their connection and that op's request id, whichever of the two is
+// read first.
+func correlateClockOffsets(opChan <-chan *RecordedOp, offsets clockOffsets) clockOffsets {
+	type request struct {
+		host string
+		seen time.Time
+	}
+	requests := map[int64]map[int32]request{}
+	replies := map[int64]map[int32]time.Time{}
+	correlated := clockOffsets{}
+	correlate := func(req request, replySeen time.Time) {
+		if latency := replySeen.Sub(req.seen); latency < correlated[req.host] {
+			correlated[req.host] = latency
+		}
+	}
+	for op := range opChan {
+		connection := op.SeenConnectionNum
+		if op.EOF {
+			delete(requests, connection)
+			delete(replies, connection)
+			continue
+		}
+		seen := op.Seen.Add(offsets.of(op))
+		if op.Header.ResponseTo != 0 {
+			if req, ok := requests[connection][op.Header.ResponseTo]; ok {
+				delete(requests[connection], op.Header.ResponseTo)
+				correlate(req, seen)
+				continue
+			}
+			if replies[connection] == nil {
+				replies[connection] = map[int32]time.Time{}
+			}
+			replies[connection][op.Header.ResponseTo] = seen
+			continue
+		}
+		if !op.RawOp.expectsReply() {
+			continue
+		}
+		req := request{endpointHost(op.SrcEndpoint), seen}
+		if replySeen, ok := replies[connection][op.Header.RequestID]; ok {
+			delete(replies[connection], op.Header.RequestID)
+			correlate(req, replySeen)
+			continue
+		}
+		if requests[connection] == nil {
+			requests[connection] = map[int32]request{}
+		}
+		requests[connection][op.Header.RequestID] = req
+	}
+	return correlated
+}
+
+// normalizeClocks writes the ops of opChan to writer with the offsets of the
+// hosts which sent them added to the times they were seen, reordered by
+// those times. The ops of opChan are expected in the order they were seen,
+// so that each op can only be moved before those seen up to the largest
+// negative offset after it, which bounds the ops held.
+func normalizeClocks(opChan <-chan *RecordedOp, offsets clockOffsets, writer *PlaybackFileWriter) error {
+	var window time.Duration
+	for _, offset := range offsets {
+		if offset < window {
+			window = offset
+		}
+	}
+	pending := &shiftedOps{}
+	for op := range opChan {
+		// no op to come can be seen before the op read less the window
+		horizon := op.Seen.Add(window)
+		op.Seen = &PreciseTime{op.Seen.Add(offsets.of(op))}
+		heap.Push(pending, op)
+		for pending.Len() > 0 && !(*pending)[0].Seen.After(horizon) {
+			if err := writer.WriteRecordedOp(heap.Pop(pending).(*RecordedOp)); err != nil {
+				return fmt.Errorf("error writing op: %v", err)
+			}
+		}
+	}
+	for pending.Len() > 0 {
+		if err := writer.WriteRecordedOp(heap.Pop(pending).(*RecordedOp)); err != nil {
+			return fmt.Errorf("error writing op: %v", err)
+		}
+	}
+	return nil
+}
+
+// shiftedOps orders ops by the times they were seen. Of the ops seen at the
+// same time, which the correlated offsets make of a reply and its op, the
+// requests come before the replies, and otherwise the ops are kept in the
+// order they were read in.
+type shiftedOps []*RecordedOp
+
+func (o shiftedOps) Len() int {
+	return len(o)
+}
+
+func (o shiftedOps) Less(i, j int) bool {
+	if !o[i].Seen.Equal(o[j].Seen.Time) {
+		return o[i].Seen.Before(o[j].Seen.Time)
+	}
+	if replyI, replyJ := o[i].Header.ResponseTo != 0, o[j].Header.ResponseTo != 0; replyI != replyJ {
+		return replyJ
+	}
+	return o[i].Order < o[j].Order
+}
+
+func (o shiftedOps) Swap(i, j int) {
+	o[i], o[j] = o[j], o[i]
+}
+
+func (o *shiftedOps) Push(op interface{}) {
+	*o = append(*o, op.(*RecordedOp))
+}
+
+func (o *shiftedOps) Pop() interface{} {
+	i := len(*o) - 1
+	op := (*o)[i]
+	*o = (*o)[:i]
+	return op
+}
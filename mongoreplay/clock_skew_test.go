@@ -0,0 +1,148 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalizeClocksParams(t *testing.T) {
+	type testCase struct {
+		name      string
+		offsets   []string
+		correlate bool
+		expected  clockOffsets
+		err       bool
+	}
+	cases := []testCase{
+		{
+			name: "no offset or correlation",
+			err:  true,
+		},
+		{
+			name:     "correlation alone",
+			expected: clockOffsets{}, correlate: true,
+		},
+		{
+			name:     "host offsets",
+			offsets:  []string{"10.0.0.5=-250ms", "10.0.0.6:27017=1s", "[::1]=2ms"},
+			expected: clockOffsets{"10.0.0.5": -250 * time.Millisecond, "10.0.0.6": time.Second, "::1": 2 * time.Millisecond},
+		},
+		{
+			name:    "missing duration",
+			offsets: []string{"10.0.0.5"},
+			err:     true,
+		},
+		{
+			name:    "bad duration",
+			offsets: []string{"10.0.0.5=soon"},
+			err:     true,
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		normalize := &NormalizeClocksCommand{Offsets: c.offsets, Correlate: c.correlate}
+		err := normalize.ValidateParams(nil)
+		if (err != nil) != c.err {
+			t.Errorf("expected error %v, got %v", c.err, err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(normalize.offsets, c.expected) {
+			t.Errorf("expected offsets %v, got %v", c.expected, normalize.offsets)
+		}
+	}
+}
+
+// skewedOps returns two requests of a client, each followed by its reply
+// from the server, the second reply seen before its request.
+func skewedOps() []*RecordedOp {
+	op := func(order int64, src, dst string, requestID, responseTo int32, offset time.Duration) *RecordedOp {
+		op := &RecordedOp{
+			SrcEndpoint:       src,
+			DstEndpoint:       dst,
+			SeenConnectionNum: 1,
+			Order:             order,
+			Seen:              &PreciseTime{testTime.Add(offset)},
+		}
+		op.Header.RequestID = requestID
+		op.Header.ResponseTo = responseTo
+		return op
+	}
+	client, server := "10.0.0.1:50000", "10.0.0.2:27017"
+	return []*RecordedOp{
+		op(0, client, server, 1, 0, 0),
+		op(1, server, client, 2, 1, 10*time.Millisecond),
+		op(2, server, client, 4, 3, 95*time.Millisecond),
+		op(3, client, server, 3, 0, 100*time.Millisecond),
+	}
+}
+
+func TestCorrelateClockOffsets(t *testing.T) {
+	ops := skewedOps()
+	opChan := make(chan *RecordedOp, len(ops))
+	for _, op := range ops {
+		opChan <- op
+	}
+	close(opChan)
+	correlated := correlateClockOffsets(opChan, clockOffsets{})
+	expected := clockOffsets{"10.0.0.1": -5 * time.Millisecond}
+	if !reflect.DeepEqual(correlated, expected) {
+		t.Errorf("expected offsets %v, got %v", expected, correlated)
+	}
+}
+
+func TestNormalizeClocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-normalize-clocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "normalized.playback")
+	writer, err := NewPlaybackFileWriter(path, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := skewedOps()
+	opChan := make(chan *RecordedOp, len(ops))
+	for _, op := range ops {
+		opChan <- op
+	}
+	close(opChan)
+	if err := normalizeClocks(opChan, clockOffsets{"10.0.0.1": -5 * time.Millisecond}, writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	reader, err := NewPlaybackFileReader(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readChan, errChan := reader.OpChan(1)
+	var requestIDs []int32
+	var seen []time.Duration
+	for op := range readChan {
+		requestIDs = append(requestIDs, op.Header.RequestID)
+		seen = append(seen, op.Seen.Sub(testTime))
+	}
+	if err := <-errChan; err != io.EOF {
+		t.Fatal(err)
+	}
+	// the second request is now seen with its reply, and before it
+	expectedIDs := []int32{1, 2, 3, 4}
+	expectedSeen := []time.Duration{-5 * time.Millisecond, 10 * time.Millisecond,
+		95 * time.Millisecond, 95 * time.Millisecond}
+	if !reflect.DeepEqual(requestIDs, expectedIDs) || !reflect.DeepEqual(seen, expectedSeen) {
+		t.Errorf("expected ops %v seen at %v, got %v seen at %v", expectedIDs, expectedSeen, requestIDs, seen)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// Command describes a mongoreplay subcommand.
+type Command struct {
+	Name             string
+	Aliases          []string
+	ShortDescription string
+	LongDescription  string
+
+	// New returns the value holding the settings of the subcommand, whose
+	// Execute method is run when the subcommand is selected.
+	New func(globalOpts *Options) flags.Commander
+}
+
+// Commands lists the mongoreplay subcommands, in the order in which they are
+// shown in the help output.
+var Commands = []Command{
+	{
+		Name:             "record",
+		ShortDescription: "Convert network traffic into mongodb queries",
+		LongDescription: "Capture the mongodb traffic of a network interface, or read it from a pcap file, " +
+			"and save the ops found in it to a playback file.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &RecordCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "play",
+		ShortDescription: "Play captured traffic against a mongodb instance",
+		LongDescription: "Replay the ops of a playback file against a mongodb instance, following the timing " +
+			"of the recording, and optionally collect stats about their execution.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &PlayCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "shadow",
+		ShortDescription: "Play live traffic against a shadow mongodb instance",
+		LongDescription: "Capture the mongodb traffic of a network interface, or follow a playback file as it is " +
+			"recorded, and play each op against a shadow instance a fixed lag after it was seen.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &ShadowCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "coordinate",
+		ShortDescription: "Distribute the playback of a playback file to several workers",
+		LongDescription: "Partition the connections of a playback file among 'worker' processes, have them play " +
+			"their segments together with the play options given as arguments, and aggregate the stats they stream " +
+			"into a single report.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &CoordinateCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "worker",
+		ShortDescription: "Play the segments of a distributed playback",
+		LongDescription: "Serve an HTTP endpoint to which 'coordinate' sends segments of a playback file, playing " +
+			"each against a mongodb instance and streaming back the stats of its ops.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &WorkerCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "monitor",
+		Aliases:          []string{"stat"},
+		ShortDescription: "Inspect live or pre-recorded mongodb traffic",
+		LongDescription: "Report on the ops and replies found in network traffic, a pcap file or a playback " +
+			"file, without replaying them.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &MonitorCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "filter",
+		ShortDescription: "Filter playback file",
+		LongDescription: "Write the ops of a playback file within a time range, optionally without the ops " +
+			"issued by drivers, to a new playback file, or split them into several files by connection.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &FilterCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "import",
+		Aliases:          []string{"convert"},
+		ShortDescription: "Synthesize a playback file from records of the ops run by a server",
+		LongDescription: "Write a playback file of the ops recorded by a server other than in its network traffic, " +
+			"for replaying the workload of a server whose traffic can't be captured.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &ImportCommand{
+				Profiler: ImportProfilerCommand{GlobalOpts: globalOpts},
+				Log:      ImportLogCommand{GlobalOpts: globalOpts},
+			}
+		},
+	},
+	{
+		Name:             "normalize-clocks",
+		ShortDescription: "Correct the clock skew between the hosts of a playback file",
+		LongDescription: "Shift the times the ops of a playback file were seen by an offset for each host that " +
+			"sent them, given or estimated from the replies seen before the ops they reply to, and write the " +
+			"ops, reordered by their corrected times, to a new playback file.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &NormalizeClocksCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "split",
+		ShortDescription: "Split playback file by connection, namespace or time",
+		LongDescription: "Write the ops of a playback file to a playback file for each connection, each namespace " +
+			"or each time slice, writing replies with the requests they reply to and the handshakes of each " +
+			"connection to every file its ops are written to, so that each file can be played on its own.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &SplitCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "merge",
+		ShortDescription: "Merge playback files into one",
+		LongDescription: "Interleave the ops of several playback files, such as those recorded on different " +
+			"mongos or application hosts, by the time they were seen, optionally correcting the clock skew " +
+			"between the hosts, and write them to a single playback file.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &MergeCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "diff-replies",
+		ShortDescription: "Compare the reply tapes of two playbacks",
+		LongDescription: "Compare the replies recorded with 'play --replyTape' during two playbacks of the same " +
+			"file, e.g. against different server versions, and print those which differ once the fields that " +
+			"vary between runs are ignored.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &DiffRepliesCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "diff-tapes",
+		Aliases:          []string{"compare"},
+		ShortDescription: "Compare the workloads of two playback files",
+		LongDescription: "Compare the op types and namespaces, the query shapes and the timing of two playback " +
+			"files, e.g. a filtered or anonymized playback file and the one it was made from, and print the " +
+			"op types, namespaces and query shapes whose shares of the ops differ.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &DiffTapesCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "dump",
+		Aliases:          []string{"inspect"},
+		ShortDescription: "Print the ops of a playback file as json",
+		LongDescription: "Print the ops of a playback file matching a json document, such as " +
+			"'{\"op\": \"query\", \"ns\": \"app.users\"}', as indented Extended JSON, highlighted when " +
+			"written to a terminal.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &DumpCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "grep",
+		ShortDescription: "Find the ops of a playback file holding a field and value",
+		LongDescription: "Print a line for each op of a playback file whose document holds the fields and " +
+			"values given as '<field>=<value>' arguments, such as 'accountId=123', at any depth, with the " +
+			"offset of the op in the playback file, to trace the traffic of a customer through a recording.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &GrepCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "connections",
+		ShortDescription: "Report the lifetimes and concurrency of the connections of a playback file",
+		LongDescription: "Reconstruct when each connection of a playback file was opened and closed, and " +
+			"print the most connections open at once, the rate connections were opened at and the op rate " +
+			"of each connection, to size the connection limits of the cluster it is to be played against.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &ConnectionsCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "heatmap",
+		ShortDescription: "Count the ops of a playback file by type and namespace over time",
+		LongDescription: "Count the ops of a playback file by their type and namespace in buckets of time, " +
+			"one minute long by default, and print the counts as csv or json, to plot the shape of the " +
+			"workload over time.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &HeatmapCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "dedup",
+		ShortDescription: "Write a small playback file with the mix of ops of a large one",
+		LongDescription: "Group the ops of a playback file by their shape, the ops which differ only by the " +
+			"values they hold sharing a shape, sample representatives of each shape and write a playback " +
+			"file of a given number of ops playing them in the proportions of the original, for repeated " +
+			"benchmarking with a workload much smaller than the recording.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &DedupCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "compact",
+		ShortDescription: "Strip the documents of the replies of a playback file",
+		LongDescription: "Write a copy of a playback file whose replies keep their headers, cursor ids, " +
+			"errors and numbers of documents, but not the documents returned, which often make up most " +
+			"of a recording. Playback only needs the former to map cursors and follow exhaust streams, " +
+			"so compacted playback files play as the originals do.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &CompactCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "verify",
+		ShortDescription: "Check a playback file against its integrity footer",
+		LongDescription: "Read a playback file whole, checking that each of its ops can be read and that its " +
+			"bytes match the checksums of its integrity footer, and its signature when it was signed, so " +
+			"that truncated, corrupt or tampered playback files are found before they are played. Fails " +
+			"if the playback file doesn't verify.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &VerifyCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "selftest",
+		ShortDescription: "Check that traffic can be recorded and played in this environment",
+		LongDescription: "Record a generated workload sent to a mongodb instance through a proxy on the loopback " +
+			"interface, replay the recording against the same instance and check that every op was recorded " +
+			"and played successfully.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &SelfTestCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "interfaces",
+		ShortDescription: "List the network interfaces which can be recorded from",
+		LongDescription: "List the network interfaces which can be captured on with 'record -i', with their " +
+			"addresses. On Windows, interfaces may be given to -i by their name, such as 'Ethernet', as well " +
+			"as by their Npcap device.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &InterfacesCommand{GlobalOpts: globalOpts}
+		},
+	},
+	{
+		Name:             "completion",
+		ShortDescription: "Generate a shell completion script",
+		LongDescription: "Print a script that enables completion of mongoreplay subcommands and options in " +
+			"bash or zsh, e.g. with 'source <(mongoreplay completion --shell bash)'.",
+		New: func(globalOpts *Options) flags.Commander {
+			return &CompletionCommand{GlobalOpts: globalOpts}
+		},
+	},
+}
+
+// AddCommands registers every subcommand in Commands with the parser.
+func AddCommands(parser *flags.Parser, globalOpts *Options) error {
+	for _, command := range Commands {
+		cmd, err := parser.AddCommand(command.Name, command.ShortDescription,
+			command.LongDescription, command.New(globalOpts))
+		if err != nil {
+			return fmt.Errorf("error adding command %v: %v", command.Name, err)
+		}
+		cmd.Aliases = command.Aliases
+	}
+	return nil
+}
+
+// CompletionCommand stores settings for the mongoreplay 'completion'
+// subcommand
+type CompletionCommand struct {
+	GlobalOpts *Options `no-flag:"true"`
+	Shell      string   `long:"shell" description:"shell to generate the completion script for" choice:"bash" choice:"zsh" default:"bash"`
+}
+
+// completionScript relies on the completion built into go-flags, which lists
+// the completions of the arguments when GO_FLAGS_COMPLETION is set.
+const completionScript = `_%[1]s_completion() {
+    local args=("${COMP_WORDS[@]:1:$COMP_CWORD}")
+    local IFS=$'\n'
+    COMPREPLY=($(GO_FLAGS_COMPLETION=1 ${COMP_WORDS[0]} "${args[@]}"))
+    return 0
+}
+complete -o default -F _%[1]s_completion %[1]s
+`
+
+// Execute runs the program for the 'completion' subcommand
+func (completion *CompletionCommand) Execute(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unknown argument: %s", args[0])
+	}
+	name := filepath.Base(os.Args[0])
+	if completion.Shell == "zsh" {
+		fmt.Fprintln(os.Stdout, "autoload -U +X bashcompinit && bashcompinit")
+	}
+	_, err := fmt.Fprintf(os.Stdout, completionScript, name)
+	return err
+}
@@ -0,0 +1,74 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/jessevdk/go-flags"
+)
+
+func TestCommandCompletion(t *testing.T) {
+	opts := Options{}
+	parser := flags.NewParser(&opts, flags.Default)
+	if err := AddCommands(parser, &opts); err != nil {
+		t.Fatal(err)
+	}
+	var completed []string
+	parser.CompletionHandler = func(items []flags.Completion) {
+		completed = nil
+		for _, item := range items {
+			completed = append(completed, item.Item)
+		}
+	}
+	os.Setenv("GO_FLAGS_COMPLETION", "1")
+	defer os.Unsetenv("GO_FLAGS_COMPLETION")
+
+	testCases := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"pl"}, []string{"play"}},
+		{[]string{"play", "--dry"}, []string{"--dryRun"}},
+		{[]string{"stat", "--pair"}, []string{"--paired"}},
+	}
+	for _, c := range testCases {
+		t.Logf("running case: %v", c.args)
+		if _, err := parser.ParseArgs(c.args); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(completed, c.expected) {
+			t.Errorf("completions not matched. Saw %v -- Expected %v", completed, c.expected)
+		}
+	}
+}
+
+func TestCommandAliases(t *testing.T) {
+	opts := Options{}
+	parser := flags.NewParser(&opts, flags.Default)
+	if err := AddCommands(parser, &opts); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		alias    string
+		expected string
+	}{
+		{"stat", "monitor"},
+		{"inspect", "dump"},
+		{"convert", "import"},
+		{"compare", "diff-tapes"},
+	}
+	for _, c := range testCases {
+		t.Logf("running case: %v", c.alias)
+		cmd := parser.Find(c.alias)
+		if cmd == nil || cmd.Name != c.expected {
+			t.Errorf("expected %v to run %v, got %v", c.alias, c.expected, cmd)
+		}
+	}
+}
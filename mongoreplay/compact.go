@@ -0,0 +1,271 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// CompactCommand stores settings for the mongoreplay 'compact' subcommand
+type CompactCommand struct {
+	GlobalOpts   *Options `no-flag:"true"`
+	PlaybackFile string   `description:"path to the playback file to read from" short:"p" long:"playback-file" required:"yes"`
+	OutFile      string   `short:"o" long:"outputFile" description:"path to the playback file to write the compacted ops to" required:"yes"`
+	Gzip         bool     `long:"gzip" description:"decompress gzipped input and compress the output"`
+
+	EncryptionOptions `group:"encryption options"`
+}
+
+// compactedReplyFields are the top-level fields of reply documents kept by
+// compaction, besides the cursor: the outcome of the op and its errors.
+var compactedReplyFields = map[string]bool{
+	"ok":                 true,
+	"errmsg":             true,
+	"code":               true,
+	"codeName":           true,
+	"errorLabels":        true,
+	"$err":               true,
+	"err":                true,
+	"n":                  true,
+	"nModified":          true,
+	"writeErrors":        true,
+	"writeConcernError":  true,
+	"writeConcernErrors": true,
+}
+
+// ValidateParams validates the settings described in the CompactCommand
+// struct.
+func (compact *CompactCommand) ValidateParams(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unknown argument: %s", args[0])
+	}
+	return nil
+}
+
+// Execute runs the program for the 'compact' subcommand
+func (compact *CompactCommand) Execute(args []string) error {
+	if err := compact.ValidateParams(args); err != nil {
+		return err
+	}
+	compact.GlobalOpts.SetLogging()
+	if err := compact.setTapeEncryption(); err != nil {
+		return err
+	}
+
+	reader, err := NewPlaybackFileReader(compact.PlaybackFile, compact.Gzip)
+	if err != nil {
+		return err
+	}
+	metadata := reader.metadata
+	metadata.PlaybackFileVersion = PlaybackFileVersion
+	metadata.RepliesCompacted = true
+	writer, err := newPlaybackFileWriter(compact.OutFile, metadata, compact.Gzip)
+	if err != nil {
+		return err
+	}
+
+	opChan, errChan := reader.OpChan(1)
+	var replies, before, after int64
+	var compactErr error
+	for op := range opChan {
+		if compactErr != nil {
+			continue
+		}
+		length := int64(op.RawOp.Header.MessageLength)
+		compacted, err := compactReply(op)
+		if err != nil {
+			compactErr = fmt.Errorf("error compacting op %v: %v", op.Order, err)
+			continue
+		}
+		if compacted {
+			replies++
+			before += length
+			after += int64(op.RawOp.Header.MessageLength)
+		}
+		if err := writer.WriteRecordedOp(op); err != nil {
+			compactErr = err
+		}
+	}
+	if err := <-errChan; err != nil && err != io.EOF {
+		writer.Close()
+		return err
+	}
+	if compactErr != nil {
+		writer.Close()
+		return compactErr
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	userInfoLogger.Logvf(Always, "Compacted %v replies from %v to %v bytes", replies, before, after)
+	return nil
+}
+
+// compactReply replaces the raw op of a recorded reply with a compacted one,
+// returning whether the op was a reply. The compacted reply keeps the header
+// of the recorded one, and the cursor id, flags and number of documents
+// which playback relies on to map cursors and follow exhaust streams, but
+// only the fields of its documents in compactedReplyFields: the documents of
+// cursor batches are left empty. Compressed replies are compacted
+// uncompressed.
+func compactReply(op *RecordedOp) (bool, error) {
+	if op.EOF {
+		return false, nil
+	}
+	// the raw op is parsed from a copy, so that the ops other than replies
+	// are written as they were recorded, compressed or not
+	raw := op.RawOp
+	parsedOp, err := raw.Parse()
+	if err != nil {
+		return false, err
+	}
+	var compacted *RawOp
+	switch reply := parsedOp.(type) {
+	case *MsgOpReply:
+		compacted, err = compactMsgOpReply(reply)
+	case *ReplyOp:
+		// the flags, cursor id, starting point and number of documents
+		// follow the header
+		docs := make([]interface{}, len(reply.Docs))
+		for i, doc := range reply.Docs {
+			docs[i] = doc
+		}
+		compacted, err = rawOpWithDocs(raw.Header, raw.Body[MsgHeaderLen:MsgHeaderLen+20], compactReplyDocs(docs)...)
+	case *CommandReplyOp:
+		// the metadata is left empty
+		docs := compactReplyDocs([]interface{}{reply.CommandReply})
+		docs = append(docs, bson.D{})
+		docs = append(docs, compactReplyDocs(reply.OutputDocs)...)
+		compacted, err = rawOpWithDocs(raw.Header, nil, docs...)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	op.RawOp = *compacted
+	return true, nil
+}
+
+// compactMsgOpReply returns an OP_MSG reply holding the compacted document of
+// its payload of type 0, with the flags of the reply except for the
+// checksum, which no longer matches.
+func compactMsgOpReply(reply *MsgOpReply) (*RawOp, error) {
+	doc := bson.D{}
+	if len(reply.Sections) > 0 {
+		raw, _, err := fetchPayload0Data(reply.Sections)
+		if err != nil {
+			return nil, err
+		}
+		if doc, err = bsonToD(raw); err != nil {
+			return nil, err
+		}
+	}
+	compacted, err := newMsgRawOp(reply.Header.RequestID, reply.Header.ResponseTo, compactReplyDoc(doc))
+	if err != nil {
+		return nil, err
+	}
+	SetInt32(compacted.Body, MsgHeaderLen, int32(reply.Flags&^mgo.MsgFlagChecksumPresent))
+	return compacted, nil
+}
+
+// rawOpWithDocs returns a raw op with the given header, with its length
+// updated, followed by the prefix and the documents.
+func rawOpWithDocs(header MsgHeader, prefix []byte, docs ...interface{}) (*RawOp, error) {
+	body := append(make([]byte, MsgHeaderLen), prefix...)
+	for _, doc := range docs {
+		docAsSlice, err := bson.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, docAsSlice...)
+	}
+	header.MessageLength = int32(len(body))
+	copy(body, header.ToWire())
+	return &RawOp{Header: header, Body: body}, nil
+}
+
+// compactReplyDocs returns the compacted form of the documents of a reply.
+func compactReplyDocs(docs []interface{}) []interface{} {
+	compacted := make([]interface{}, len(docs))
+	for i, value := range docs {
+		doc, err := bsonToD(value)
+		if err != nil {
+			doc = bson.D{}
+		}
+		compacted[i] = compactReplyDoc(doc)
+	}
+	return compacted
+}
+
+// compactReplyDoc returns the fields of a reply document in
+// compactedReplyFields, and its cursor with empty documents in its batch.
+func compactReplyDoc(doc bson.D) bson.D {
+	compacted := bson.D{}
+	for _, elem := range doc {
+		if elem.Name == "cursor" {
+			if cursor, err := bsonToD(elem.Value); err == nil {
+				compacted = append(compacted, bson.DocElem{Name: "cursor", Value: compactCursor(cursor)})
+			}
+		} else if compactedReplyFields[elem.Name] {
+			compacted = append(compacted, elem)
+		}
+	}
+	return compacted
+}
+
+// compactCursor returns the id, namespace and resume token of a cursor, and
+// its batch with each document left empty. The last document of a batch of
+// change events keeps its _id, the resume token which the change streams
+// resumed from it are mapped by.
+func compactCursor(cursor bson.D) bson.D {
+	compacted := bson.D{}
+	for _, elem := range cursor {
+		switch elem.Name {
+		case "id", "ns", "postBatchResumeToken":
+			compacted = append(compacted, elem)
+		case "firstBatch", "nextBatch":
+			batch, _ := elem.Value.([]interface{})
+			docs := make([]interface{}, len(batch))
+			for i := range batch {
+				docs[i] = bson.D{}
+			}
+			if len(batch) > 0 {
+				if id, ok := resumeTokenOf(batch[len(batch)-1]); ok {
+					docs[len(batch)-1] = bson.D{{Name: "_id", Value: id}}
+				}
+			}
+			compacted = append(compacted, bson.DocElem{Name: elem.Name, Value: docs})
+		}
+	}
+	return compacted
+}
+
+// resumeTokenOf returns the _id of a change event, which is a resume token
+// document holding _data.
+func resumeTokenOf(event interface{}) (interface{}, bool) {
+	doc, err := bsonToD(event)
+	if err != nil {
+		return nil, false
+	}
+	id, ok := FindValueByKey("_id", &doc)
+	if !ok {
+		return nil, false
+	}
+	token, err := bsonToD(id)
+	if err != nil {
+		return nil, false
+	}
+	if _, ok := FindValueByKey("_data", &token); !ok {
+		return nil, false
+	}
+	return id, true
+}
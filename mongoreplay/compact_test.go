@@ -0,0 +1,187 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// compactedDoc compacts op, returning the payload of type 0 of the OP_MSG
+// reply it became.
+func compactedDoc(t *testing.T, op *RecordedOp) (*MsgOpReply, bson.D) {
+	compacted, err := compactReply(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compacted {
+		t.Fatalf("expected the reply to be compacted")
+	}
+	parsedOp, err := op.RawOp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, ok := parsedOp.(*MsgOpReply)
+	if !ok {
+		t.Fatalf("expected an OP_MSG reply, got %T", parsedOp)
+	}
+	raw, _, err := fetchPayload0Data(reply.Sections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := bsonToD(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply, doc
+}
+
+func TestCompactMsgOpReply(t *testing.T) {
+	batch := []interface{}{
+		bson.D{{"_id", 1}, {"name", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}},
+		bson.D{{"_id", 2}, {"name", "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"}},
+		bson.D{{"_id", 3}, {"name", "cccccccccccccccccccccccccccccccc"}},
+	}
+	raw, err := newMsgRawOp(7, 3, bson.D{
+		{"cursor", bson.D{{"firstBatch", batch}, {"id", int64(42)}, {"ns", "test.c"}}},
+		{"ok", 1},
+		{"$clusterTime", bson.D{{"clusterTime", bson.MongoTimestamp(1)}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetInt32(raw.Body, MsgHeaderLen, int32(mgo.MsgFlagMoreToCome))
+	op := &RecordedOp{RawOp: *raw}
+	reply, doc := compactedDoc(t, op)
+
+	if reply.Header.RequestID != 7 || reply.Header.ResponseTo != 3 || reply.Flags != mgo.MsgFlagMoreToCome {
+		t.Errorf("expected the header and flags to be kept, got %v and %v", reply.Header, reply.Flags)
+	}
+	if op.RawOp.Header.MessageLength >= raw.Header.MessageLength {
+		t.Errorf("expected the reply to shrink from %v bytes, got %v", raw.Header.MessageLength, op.RawOp.Header.MessageLength)
+	}
+	if cursorID, err := reply.getCursorID(); err != nil || cursorID != 42 {
+		t.Errorf("expected cursor 42, got %v, %v", cursorID, err)
+	}
+	if _, ok := FindValueByKey("$clusterTime", &doc); ok {
+		t.Errorf("expected $clusterTime to be stripped from %v", doc)
+	}
+	if ok, _ := FindValueByKey("ok", &doc); ok != 1 {
+		t.Errorf("expected ok to be kept in %v", doc)
+	}
+	docs, err := getCursorDocs(&bson.Raw{Kind: 0x03, Data: op.RawOp.Body[MsgHeaderLen+5:]})
+	if err != nil || len(docs) != 3 {
+		t.Fatalf("expected 3 documents in the batch, got %v, %v", len(docs), err)
+	}
+	for _, d := range docs {
+		if len(d.Data) != 5 {
+			t.Errorf("expected the documents of the batch to be empty, got %v bytes", len(d.Data))
+		}
+	}
+}
+
+func TestCompactReplyDoc(t *testing.T) {
+	token := bson.D{{"_data", "8263"}}
+	type testCase struct {
+		name     string
+		doc      bson.D
+		expected bson.D
+	}
+	cases := []testCase{
+		{name: "write result",
+			doc:      bson.D{{"n", 1}, {"writeErrors", []interface{}{bson.D{{"code", 11000}}}}, {"ok", 1}, {"operationTime", 5}},
+			expected: bson.D{{"n", 1}, {"writeErrors", []interface{}{bson.D{{"code", 11000}}}}, {"ok", 1}}},
+		{name: "error",
+			doc:      bson.D{{"ok", 0}, {"errmsg", "not primary"}, {"code", 10107}, {"codeName", "NotWritablePrimary"}},
+			expected: bson.D{{"ok", 0}, {"errmsg", "not primary"}, {"code", 10107}, {"codeName", "NotWritablePrimary"}}},
+		{name: "query result",
+			doc:      bson.D{{"_id", 1}, {"name", "x"}},
+			expected: bson.D{}},
+		{name: "change events",
+			doc: bson.D{{"cursor", bson.D{{"id", int64(5)}, {"nextBatch", []interface{}{
+				bson.D{{"_id", bson.D{{"_data", "8262"}}}, {"operationType", "insert"}},
+				bson.D{{"_id", token}, {"operationType", "insert"}},
+			}}, {"postBatchResumeToken", token}}}},
+			expected: bson.D{{"cursor", bson.D{{"id", int64(5)}, {"nextBatch", []interface{}{
+				bson.D{}, bson.D{{"_id", token}},
+			}}, {"postBatchResumeToken", token}}}}},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		compacted, err := bson.Marshal(compactReplyDoc(c.doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := bson.Marshal(c.expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(compacted, expected) {
+			t.Errorf("expected %v, got %v", c.expected, compactReplyDoc(c.doc))
+		}
+	}
+}
+
+func TestCompactLegacyReplies(t *testing.T) {
+	// the OP_REPLY keeps its cursor id and number of documents
+	msg := replyMessage(t, 3, bson.D{{"cursor", bson.D{{"id", int64(42)}, {"firstBatch", []interface{}{bson.D{{"a", 1}}}}}}, {"ok", 1}})
+	SetInt32(msg, MsgHeaderLen+4, 42)
+	header := MsgHeader{}
+	header.FromWire(msg)
+	op := &RecordedOp{RawOp: RawOp{Header: header, Body: msg}}
+	if compacted, err := compactReply(op); err != nil || !compacted {
+		t.Fatalf("expected the reply to be compacted, got %v", err)
+	}
+	parsedOp, err := op.RawOp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := parsedOp.(*ReplyOp)
+	if reply.CursorId != 42 || reply.ReplyDocs != 1 || len(reply.Docs) != 1 || reply.Header.ResponseTo != 3 {
+		t.Errorf("expected the header of the reply to be kept, got %+v", reply)
+	}
+	if cursorID, err := reply.getCursorID(); err != nil || cursorID != 42 {
+		t.Errorf("expected cursor 42, got %v, %v", cursorID, err)
+	}
+
+	// compressed replies are compacted uncompressed
+	raw, err := newMsgRawOp(7, 3, bson.D{{"cursor", bson.D{{"id", int64(9)}, {"nextBatch", []interface{}{}}}}, {"ok", 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := compressMessage(raw.Body, compressorSnappy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header = MsgHeader{}
+	header.FromWire(compressed)
+	op = &RecordedOp{RawOp: RawOp{Header: header, Body: compressed}}
+	if reply, _ := compactedDoc(t, op); op.RawOp.Header.OpCode != OpCodeMessage {
+		t.Errorf("expected an uncompressed reply, got %v", op.RawOp.Header.OpCode)
+	} else if cursorID, _ := reply.getCursorID(); cursorID != 9 {
+		t.Errorf("expected cursor 9, got %v", cursorID)
+	}
+
+	// other ops are left as they were recorded
+	find, err := newMsgRawOp(8, 0, bson.D{{"find", "c"}, {"$db", "test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err = compressMessage(find.Body, compressorSnappy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header = MsgHeader{}
+	header.FromWire(compressed)
+	op = &RecordedOp{RawOp: RawOp{Header: header, Body: compressed}}
+	if compacted, err := compactReply(op); err != nil || compacted || !bytes.Equal(op.RawOp.Body, compressed) {
+		t.Errorf("expected the find to be left compressed, got %v, %v", compacted, err)
+	}
+}
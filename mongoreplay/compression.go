@@ -0,0 +1,349 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+	"github.com/golang/snappy"
+)
+
+// the ids of the compressors of OP_COMPRESSED messages
+const (
+	compressorNoop   uint8 = 0
+	compressorSnappy uint8 = 1
+	compressorZlib   uint8 = 2
+)
+
+// compressorIDs are the compressors --networkCompression can negotiate.
+var compressorIDs = map[string]uint8{
+	"snappy": compressorSnappy,
+	"zlib":   compressorZlib,
+}
+
+// compressedHeaderLen is the length of the fields following the header of an
+// OP_COMPRESSED message: the original opcode, the uncompressed size and the
+// compressor id.
+const compressedHeaderLen = 9
+
+// uncompressedCommands are the commands never sent compressed, since they
+// negotiate compression or carry credentials.
+var uncompressedCommands = map[string]bool{
+	"hello":           true,
+	"isMaster":        true,
+	"ismaster":        true,
+	"saslStart":       true,
+	"saslContinue":    true,
+	"getnonce":        true,
+	"authenticate":    true,
+	"createUser":      true,
+	"updateUser":      true,
+	"copydbSaslStart": true,
+	"copydbgetnonce":  true,
+	"copydb":          true,
+}
+
+// parseCompressors parses the comma-separated compressors of
+// --networkCompression, in order of preference.
+func parseCompressors(list string) ([]string, error) {
+	var compressors []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "zstd" {
+			return nil, fmt.Errorf("zstd is not supported by mongoreplay; use snappy or zlib")
+		}
+		if _, ok := compressorIDs[name]; !ok {
+			return nil, fmt.Errorf("unknown compressor '%v'; must be snappy or zlib", name)
+		}
+		compressors = append(compressors, name)
+	}
+	return compressors, nil
+}
+
+// negotiateCompression runs isMaster on a new connection, offering the
+// compressors, and returns the id of the compressor the server chose, if
+// any. The server keeps the compressors negotiated by the first handshake
+// of a connection, so the handshake the driver runs afterwards, which
+// offers none, doesn't undo them.
+func negotiateCompression(conn net.Conn, compressors []string) (uint8, bool, error) {
+	doc, err := bson.Marshal(bson.D{{Name: "isMaster", Value: 1}, {Name: "compression", Value: compressors}})
+	if err != nil {
+		return 0, false, err
+	}
+	// the header is followed by the flag bits, the namespace, and the
+	// numbers of documents to skip and to return
+	msg := make([]byte, MsgHeaderLen+4, MsgHeaderLen+4+11+8+len(doc))
+	msg = append(msg, "admin.$cmd\x00"...)
+	msg = append(msg, make([]byte, 8)...)
+	SetInt32(msg, len(msg)-4, -1)
+	msg = append(msg, doc...)
+	header := MsgHeader{MessageLength: int32(len(msg)), RequestID: 1, OpCode: OpCodeQuery}
+	copy(msg, header.ToWire())
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(msg); err != nil {
+		return 0, false, err
+	}
+	replyHeader, err := ReadHeader(conn)
+	if err != nil {
+		return 0, false, err
+	}
+	reply := &RawOp{Header: *replyHeader, Body: replyHeader.ToWire()}
+	if err := reply.FromReader(conn); err != nil {
+		return 0, false, err
+	}
+	op, err := reply.Parse()
+	if err != nil {
+		return 0, false, err
+	}
+	replyOp, ok := op.(*ReplyOp)
+	if !ok || len(replyOp.Docs) == 0 {
+		return 0, false, fmt.Errorf("unexpected reply to isMaster: %v", op)
+	}
+	result, err := bsonToD(replyOp.Docs[0])
+	if err != nil {
+		return 0, false, err
+	}
+	value, _ := FindValueByKey("compression", &result)
+	negotiated, _ := value.([]interface{})
+	for _, name := range negotiated {
+		if name, ok := name.(string); ok {
+			if id, ok := compressorIDs[name]; ok {
+				return id, true, nil
+			}
+		}
+	}
+	return 0, false, nil
+}
+
+// compressedConn compresses the messages written to a connection, other
+// than those of the uncompressedCommands, and decompresses the
+// OP_COMPRESSED messages read from it, so that the driver, which doesn't
+// support compression, reads and writes uncompressed messages.
+type compressedConn struct {
+	net.Conn
+	compressor uint8
+
+	// written holds the start of a message written in part, and unread
+	// what is left of the last message read.
+	written []byte
+	unread  []byte
+}
+
+// Write compresses the whole messages of b, holding any part of a message
+// until the rest of it is written.
+func (conn *compressedConn) Write(b []byte) (int, error) {
+	pending := append(conn.written, b...)
+	var out []byte
+	for len(pending) >= MsgHeaderLen {
+		length := int(getInt32(pending, 0))
+		if length < MsgHeaderLen {
+			return 0, fmt.Errorf("invalid message length %v", length)
+		}
+		if len(pending) < length {
+			break
+		}
+		msg := pending[:length]
+		if !uncompressedCommands[messageCommandName(msg)] {
+			compressed, err := compressMessage(msg, conn.compressor)
+			if err != nil {
+				return 0, err
+			}
+			msg = compressed
+		}
+		out = append(out, msg...)
+		pending = pending[length:]
+	}
+	conn.written = append(conn.written[:0], pending...)
+	if len(out) > 0 {
+		if _, err := conn.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Read reads the messages of the connection, decompressing them.
+func (conn *compressedConn) Read(b []byte) (int, error) {
+	if len(conn.unread) == 0 {
+		header, err := ReadHeader(conn.Conn)
+		if err != nil {
+			return 0, err
+		}
+		msg := &RawOp{Header: *header, Body: header.ToWire()}
+		if err := msg.FromReader(conn.Conn); err != nil {
+			return 0, err
+		}
+		conn.unread = msg.Body
+		if header.OpCode == OpCodeCompressed {
+			if conn.unread, err = decompressMessage(msg.Body); err != nil {
+				return 0, err
+			}
+		}
+	}
+	n := copy(b, conn.unread)
+	conn.unread = conn.unread[n:]
+	return n, nil
+}
+
+// compressMessage returns the OP_COMPRESSED message holding msg, a whole
+// message, compressed with the compressor.
+func compressMessage(msg []byte, compressor uint8) ([]byte, error) {
+	header := MsgHeader{}
+	header.FromWire(msg)
+	body := msg[MsgHeaderLen:]
+	out := make([]byte, MsgHeaderLen+compressedHeaderLen, MsgHeaderLen+compressedHeaderLen+len(body))
+	switch compressor {
+	case compressorNoop:
+		out = append(out, body...)
+	case compressorSnappy:
+		out = append(out, snappy.Encode(nil, body)...)
+	case compressorZlib:
+		var buf bytes.Buffer
+		writer := zlib.NewWriter(&buf)
+		if _, err := writer.Write(body); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		out = append(out, buf.Bytes()...)
+	default:
+		return nil, fmt.Errorf("unsupported compressor id %v", compressor)
+	}
+	compressed := MsgHeader{
+		MessageLength: int32(len(out)),
+		RequestID:     header.RequestID,
+		ResponseTo:    header.ResponseTo,
+		OpCode:        OpCodeCompressed,
+	}
+	copy(out, compressed.ToWire())
+	SetInt32(out, MsgHeaderLen, int32(header.OpCode))
+	SetInt32(out, MsgHeaderLen+4, int32(len(body)))
+	out[MsgHeaderLen+8] = compressor
+	return out, nil
+}
+
+// decompressMessage returns the message held by msg, a whole OP_COMPRESSED
+// message.
+func decompressMessage(msg []byte) ([]byte, error) {
+	if len(msg) < MsgHeaderLen+compressedHeaderLen {
+		return nil, fmt.Errorf("compressed message too short: %v bytes", len(msg))
+	}
+	header := MsgHeader{}
+	header.FromWire(msg)
+	originalOpCode := getInt32(msg, MsgHeaderLen)
+	size := getInt32(msg, MsgHeaderLen+4)
+	compressor := msg[MsgHeaderLen+8]
+	data := msg[MsgHeaderLen+compressedHeaderLen:]
+
+	var body []byte
+	var err error
+	switch compressor {
+	case compressorNoop:
+		body = data
+	case compressorSnappy:
+		body, err = snappy.Decode(nil, data)
+	case compressorZlib:
+		var reader io.ReadCloser
+		if reader, err = zlib.NewReader(bytes.NewReader(data)); err == nil {
+			body, err = ioutil.ReadAll(reader)
+			reader.Close()
+		}
+	default:
+		err = fmt.Errorf("unsupported compressor id %v", compressor)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(body) != int(size) {
+		return nil, fmt.Errorf("decompressed %v bytes, expected %v", len(body), size)
+	}
+	decompressed := MsgHeader{
+		MessageLength: int32(MsgHeaderLen + len(body)),
+		RequestID:     header.RequestID,
+		ResponseTo:    header.ResponseTo,
+		OpCode:        OpCode(originalOpCode),
+	}
+	return append(decompressed.ToWire(), body...), nil
+}
+
+// messageCommandName returns the name of the command run by msg, a whole
+// OP_QUERY, OP_COMMAND or OP_MSG message, or the empty string if it doesn't
+// run a command.
+func messageCommandName(msg []byte) string {
+	header := MsgHeader{}
+	header.FromWire(msg)
+	body := msg[MsgHeaderLen:]
+	switch header.OpCode {
+	case OpCodeQuery:
+		if len(body) < 4 {
+			return ""
+		}
+		end := bytes.IndexByte(body[4:], 0)
+		if end < 0 || !bytes.HasSuffix(body[4:4+end], []byte(".$cmd")) {
+			return ""
+		}
+		// the namespace is followed by the numbers of documents to skip and
+		// to return
+		if query := 4 + end + 1 + 8; query < len(body) {
+			return firstElementName(body[query:])
+		}
+	case OpCodeCommand:
+		end := bytes.IndexByte(body, 0)
+		if end < 0 {
+			return ""
+		}
+		name := body[end+1:]
+		if end = bytes.IndexByte(name, 0); end < 0 {
+			return ""
+		}
+		return string(name[:end])
+	case OpCodeMessage:
+		if len(body) < 4 {
+			return ""
+		}
+		// the flag bits are followed by the sections, of which the command
+		// is the only one of kind 0
+		for sections := body[4:]; len(sections) > 4; {
+			kind := sections[0]
+			if kind == byte(0) {
+				return firstElementName(sections[1:])
+			}
+			size := int(getInt32(sections, 1))
+			if size < 4 || len(sections) < 1+size {
+				return ""
+			}
+			sections = sections[1+size:]
+		}
+	}
+	return ""
+}
+
+// firstElementName returns the name of the first element of the BSON
+// document at the start of doc.
+func firstElementName(doc []byte) string {
+	// the length of the document is followed by the type of its first
+	// element and its name
+	if len(doc) < 6 {
+		return ""
+	}
+	end := bytes.IndexByte(doc[5:], 0)
+	if end < 0 {
+		return ""
+	}
+	return string(doc[5 : 5+end])
+}
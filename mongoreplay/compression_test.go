@@ -0,0 +1,190 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestCompressMessage(t *testing.T) {
+	find, err := newMsgRawOp(7, 0, bson.D{{"find", "c"}, {"filter", bson.D{{"a", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}}}, {"$db", "test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, compressor := range []uint8{compressorNoop, compressorSnappy, compressorZlib} {
+		t.Logf("running case: compressor %v", compressor)
+		compressed, err := compressMessage(find.Body, compressor)
+		if err != nil {
+			t.Errorf("error compressing: %v", err)
+			continue
+		}
+		header := MsgHeader{}
+		header.FromWire(compressed)
+		if header.OpCode != OpCodeCompressed || header.RequestID != 7 || int(header.MessageLength) != len(compressed) {
+			t.Errorf("unexpected header %v", header)
+		}
+		decompressed, err := decompressMessage(compressed)
+		if err != nil {
+			t.Errorf("error decompressing: %v", err)
+			continue
+		}
+		if !bytes.Equal(decompressed, find.Body) {
+			t.Errorf("expected %v, got %v", find.Body, decompressed)
+		}
+	}
+}
+
+func TestParseCompressors(t *testing.T) {
+	type testCase struct {
+		name     string
+		list     string
+		expected []string
+		invalid  bool
+	}
+	cases := []testCase{
+		{name: "preference", list: "zlib, snappy", expected: []string{"zlib", "snappy"}},
+		{name: "zstd", list: "zstd,snappy", invalid: true},
+		{name: "unknown", list: "lz4", invalid: true},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		compressors, err := parseCompressors(c.list)
+		if c.invalid {
+			if err == nil {
+				t.Errorf("expected an error, got %v", compressors)
+			}
+			continue
+		}
+		if err != nil || len(compressors) != len(c.expected) {
+			t.Errorf("expected %v, got %v (%v)", c.expected, compressors, err)
+			continue
+		}
+		for i := range compressors {
+			if compressors[i] != c.expected[i] {
+				t.Errorf("expected %v, got %v", c.expected, compressors)
+			}
+		}
+	}
+}
+
+// readMessage reads a whole message from conn.
+func readMessage(t *testing.T, conn net.Conn) []byte {
+	header, err := ReadHeader(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &RawOp{Header: *header, Body: header.ToWire()}
+	if err := msg.FromReader(conn); err != nil {
+		t.Fatal(err)
+	}
+	return msg.Body
+}
+
+// replyMessage returns an OP_REPLY to requestID holding doc.
+func replyMessage(t *testing.T, requestID int32, doc bson.D) []byte {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the header is followed by the flag bits, the cursor id, the starting
+	// position and the number of documents returned
+	msg := make([]byte, MsgHeaderLen+20, MsgHeaderLen+20+len(raw))
+	SetInt32(msg, MsgHeaderLen+16, 1)
+	msg = append(msg, raw...)
+	header := MsgHeader{MessageLength: int32(len(msg)), ResponseTo: requestID, OpCode: OpCodeReply}
+	copy(msg, header.ToWire())
+	return msg
+}
+
+func TestCompressedConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	t.Log("Negotiating compression")
+	negotiated := make(chan uint8, 1)
+	go func() {
+		compressor, ok, err := negotiateCompression(client, []string{"zlib", "snappy"})
+		if err != nil || !ok {
+			t.Errorf("expected compression to be negotiated, got %v", err)
+		}
+		negotiated <- compressor
+	}()
+	handshake := readMessage(t, server)
+	if name := messageCommandName(handshake); name != "isMaster" {
+		t.Fatalf("expected isMaster, got %v", name)
+	}
+	server.Write(replyMessage(t, 1, bson.D{{"ismaster", true}, {"compression", []string{"snappy"}}, {"ok", 1}}))
+	compressor := <-negotiated
+	if compressor != compressorSnappy {
+		t.Fatalf("expected snappy to be negotiated, got %v", compressor)
+	}
+	conn := &compressedConn{Conn: client, compressor: compressor}
+
+	t.Log("Writing a handshake and a command, the command split in two")
+	isMaster, err := newMsgRawOp(2, 0, bson.D{{"isMaster", 1}, {"$db", "admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	find, err := newMsgRawOp(3, 0, bson.D{{"find", "c"}, {"$db", "test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := append(append([]byte{}, isMaster.Body...), find.Body...)
+	go func() {
+		half := len(isMaster.Body) + 10
+		if _, err := conn.Write(written[:half]); err != nil {
+			t.Error(err)
+		}
+		if _, err := conn.Write(written[half:]); err != nil {
+			t.Error(err)
+		}
+	}()
+	if msg := readMessage(t, server); !bytes.Equal(msg, isMaster.Body) {
+		t.Errorf("expected the handshake to be sent uncompressed, got %v", msg)
+	}
+	msg := readMessage(t, server)
+	header := MsgHeader{}
+	header.FromWire(msg)
+	if header.OpCode != OpCodeCompressed {
+		t.Errorf("expected the command to be compressed, got %v", header.OpCode)
+	}
+	if decompressed, err := decompressMessage(msg); err != nil || !bytes.Equal(decompressed, find.Body) {
+		t.Errorf("expected the command to decompress to %v, got %v (%v)", find.Body, decompressed, err)
+	}
+
+	t.Log("Reading a compressed reply")
+	reply, err := newMsgRawOp(4, 3, bson.D{{"ok", 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := compressMessage(reply.Body, compressorZlib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Write(compressed)
+	if read := readMessage(t, conn); !bytes.Equal(read, reply.Body) {
+		t.Errorf("expected %v, got %v", reply.Body, read)
+	}
+}
+
+func TestMessageCommandName(t *testing.T) {
+	hello, err := newMsgRawOp(1, 0, bson.D{{"hello", 1}, {"speculativeAuthenticate", bson.D{{"saslStart", 1}}}, {"$db", "admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := messageCommandName(hello.Body); name != "hello" {
+		t.Errorf("expected hello, got %v", name)
+	}
+	if name := messageCommandName(hello.Body[:MsgHeaderLen+2]); name != "" {
+		t.Errorf("expected no command from a truncated message, got %v", name)
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// globalConfigSection is the name go-flags gives the group of the options
+// parsed into Options, which the top-level settings of a configuration file
+// are applied to.
+const globalConfigSection = "Application Options"
+
+// configSetting is a setting of a configuration file: the value of an option
+// of the command of the section it's found in, or of a global option.
+type configSetting struct {
+	section string
+	name    string
+	value   string
+	line    int
+}
+
+// configLine is a line of a configuration file stripped of its comment and
+// indentation.
+type configLine struct {
+	number int
+	indent int
+	text   string
+}
+
+// LoadConfigFile applies the settings of the configuration file named by the
+// --config option of args, if any, to the options of the parser. It must be
+// called before the parser parses args, so that the options set on the
+// command line override those of the file.
+func LoadConfigFile(parser *flags.Parser, args []string) error {
+	configOpts := struct {
+		Config string `long:"config"`
+	}{}
+	configParser := flags.NewParser(&configOpts, flags.IgnoreUnknown)
+	// completions are listed by the parser the settings are applied to
+	configParser.CompletionHandler = func([]flags.Completion) {}
+	if _, err := configParser.ParseArgs(args); err != nil {
+		return err
+	}
+	if configOpts.Config == "" {
+		return nil
+	}
+	file, err := os.Open(configOpts.Config)
+	if err != nil {
+		return fmt.Errorf("error opening config file: %v", err)
+	}
+	defer file.Close()
+	settings, err := readConfig(file)
+	if err != nil {
+		return fmt.Errorf("error reading config file %v: %v", configOpts.Config, err)
+	}
+	if err := applyConfig(parser, settings); err != nil {
+		return fmt.Errorf("error in config file %v: %v", configOpts.Config, err)
+	}
+	return nil
+}
+
+// applyConfig sets the options of the parser named by the settings. The
+// settings are handed to the ini parser of go-flags, one per line, so that
+// they are converted and validated as on the command line.
+func applyConfig(parser *flags.Parser, settings []configSetting) error {
+	bySection := map[string][]configSetting{}
+	var sections []string
+	for _, setting := range settings {
+		if setting.section != globalConfigSection && parser.Find(setting.section) == nil {
+			return fmt.Errorf("line %v: unknown command %q", setting.line, setting.section)
+		}
+		if _, ok := bySection[setting.section]; !ok {
+			sections = append(sections, setting.section)
+		}
+		bySection[setting.section] = append(bySection[setting.section], setting)
+	}
+
+	buf := &bytes.Buffer{}
+	var lines []int
+	for _, section := range sections {
+		fmt.Fprintf(buf, "[%v]\n", section)
+		lines = append(lines, 0)
+		for _, setting := range bySection[section] {
+			fmt.Fprintf(buf, "%v = %v\n", setting.name, strconv.Quote(setting.value))
+			lines = append(lines, setting.line)
+		}
+	}
+	err := flags.NewIniParser(parser).Parse(buf)
+	if iniErr, ok := err.(*flags.IniError); ok && iniErr.LineNumber > 0 && int(iniErr.LineNumber) <= len(lines) {
+		return fmt.Errorf("line %v: %v", lines[iniErr.LineNumber-1], iniErr.Message)
+	}
+	return err
+}
+
+// readConfig reads the settings of a configuration file written in the
+// subset of YAML made of mappings and lists of scalars. Settings at the top
+// level of the file set global options, while those of the mapping named
+// after a command set the options of that command:
+//
+//	verbosity: true
+//	play:
+//	  host: mongodb://localhost:27017
+//	  speed: 2
+//	  assert:
+//	    - p95<50ms
+//	    - errorRate<0.1%
+//
+// Options which may be repeated on the command line take a list, written
+// either as above or inline, like [p95<50ms, errorRate<0.1%].
+func readConfig(in io.Reader) ([]configSetting, error) {
+	var lines []configLine
+	scanner := bufio.NewScanner(in)
+	number := 0
+	for scanner.Scan() {
+		number++
+		raw := scanner.Text()
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %v: tabs can't be used for indentation", number)
+		}
+		text = strings.TrimSpace(stripConfigComment(text))
+		if text == "" || text == "---" || text == "..." {
+			continue
+		}
+		lines = append(lines, configLine{number: number, indent: len(raw) - len(strings.TrimLeft(raw, " ")), text: text})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var settings []configSetting
+	for i := 0; i < len(lines); {
+		if lines[i].indent != 0 {
+			return nil, fmt.Errorf("line %v: unexpected indentation", lines[i].number)
+		}
+		// a key without a value at the top level starts the section of a
+		// command unless a list follows it
+		if name, value, ok := splitConfigKey(lines[i].text); ok && value == "" &&
+			i+1 < len(lines) && lines[i+1].indent > 0 && !isConfigListItem(lines[i+1].text) {
+			sectionSettings, next, err := readConfigMapping(lines, i+1, lines[i+1].indent, name)
+			if err != nil {
+				return nil, err
+			}
+			settings = append(settings, sectionSettings...)
+			i = next
+			continue
+		}
+		sectionSettings, next, err := readConfigMapping(lines, i, 0, globalConfigSection)
+		if err != nil {
+			return nil, err
+		}
+		settings = append(settings, sectionSettings...)
+		i = next
+	}
+	return settings, nil
+}
+
+// readConfigMapping reads the settings of the mapping starting at lines[i]
+// at the given indentation, returning them along with the index of the line
+// following it. The mapping of the top level ends at the first section.
+func readConfigMapping(lines []configLine, i, indent int, section string) ([]configSetting, int, error) {
+	var settings []configSetting
+	for i < len(lines) && lines[i].indent >= indent {
+		line := lines[i]
+		if line.indent > indent {
+			return nil, 0, fmt.Errorf("line %v: unexpected indentation", line.number)
+		}
+		if isConfigListItem(line.text) {
+			return nil, 0, fmt.Errorf("line %v: list item without a key", line.number)
+		}
+		name, value, ok := splitConfigKey(line.text)
+		if !ok {
+			return nil, 0, fmt.Errorf("line %v: expected 'name: value', got %q", line.number, line.text)
+		}
+		i++
+		if value != "" {
+			values, err := parseConfigValue(value)
+			if err != nil {
+				return nil, 0, fmt.Errorf("line %v: %v", line.number, err)
+			}
+			for _, v := range values {
+				settings = append(settings, configSetting{section: section, name: name, value: v, line: line.number})
+			}
+			continue
+		}
+		if i < len(lines) && isConfigListItem(lines[i].text) && lines[i].indent >= indent {
+			itemIndent := lines[i].indent
+			for i < len(lines) && lines[i].indent == itemIndent && isConfigListItem(lines[i].text) {
+				item, err := parseConfigScalar(strings.TrimSpace(lines[i].text[1:]))
+				if err != nil {
+					return nil, 0, fmt.Errorf("line %v: %v", lines[i].number, err)
+				}
+				settings = append(settings, configSetting{section: section, name: name, value: item, line: lines[i].number})
+				i++
+			}
+			continue
+		}
+		if i < len(lines) && lines[i].indent > indent {
+			if section == globalConfigSection {
+				// the key starts the section of a command
+				return settings, i - 1, nil
+			}
+			return nil, 0, fmt.Errorf("line %v: the settings of %q can't be nested", lines[i].number, name)
+		}
+		// an option set without a value, such as a flag
+		settings = append(settings, configSetting{section: section, name: name, line: line.number})
+	}
+	return settings, i, nil
+}
+
+func isConfigListItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitConfigKey splits a 'name: value' line, returning false if it has no
+// key.
+func splitConfigKey(text string) (string, string, bool) {
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			name := strings.TrimSpace(text[:i])
+			if name == "" {
+				return "", "", false
+			}
+			return name, strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// parseConfigValue parses the value of a setting, either a scalar or an
+// inline list of scalars.
+func parseConfigValue(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") {
+		scalar, err := parseConfigScalar(value)
+		return []string{scalar}, err
+	}
+	if !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("unterminated list %q", value)
+	}
+	var values []string
+	var quote byte
+	start := 1
+	inner := value[:len(value)-1]
+	for i := 1; i <= len(inner); i++ {
+		if i < len(inner) && quote != 0 {
+			if inner[i] == quote {
+				quote = 0
+			}
+			continue
+		}
+		if i < len(inner) && (inner[i] == '"' || inner[i] == '\'') {
+			quote = inner[i]
+			continue
+		}
+		if i == len(inner) || inner[i] == ',' {
+			item := strings.TrimSpace(inner[start:i])
+			start = i + 1
+			if item == "" {
+				continue
+			}
+			scalar, err := parseConfigScalar(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, scalar)
+		}
+	}
+	return values, nil
+}
+
+// parseConfigScalar parses a plain, single-quoted or double-quoted scalar.
+func parseConfigScalar(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted string %v", value)
+		}
+		return unquoted, nil
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("invalid quoted string %v", value)
+		}
+		return strings.Replace(value[1:len(value)-1], "''", "'", -1), nil
+	}
+	return value, nil
+}
+
+// stripConfigComment removes the comment ending a line, which starts with a
+// '#' at the start of the line or after whitespace, outside of the quoted
+// scalars of the line.
+func stripConfigComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" [,:", text[i-1]) >= 0):
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
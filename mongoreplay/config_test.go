@@ -0,0 +1,196 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jessevdk/go-flags"
+)
+
+type configTestCommand struct {
+	Host      string   `long:"host" default:"mongodb://localhost:27017"`
+	Speed     float64  `long:"speed" default:"1.0"`
+	FullSpeed bool     `long:"fullSpeed"`
+	Collect   string   `long:"collect" choice:"json" choice:"none" default:"none"`
+	Assert    []string `long:"assert"`
+	Filter    string   `long:"filter"`
+}
+
+func (command *configTestCommand) Execute(args []string) error {
+	return nil
+}
+
+func TestReadConfig(t *testing.T) {
+	config := `# replay of the nightly capture
+verbosity: true
+play:
+  host: "mongodb://replay:27017"   # target
+  speed: 2.5
+  assert:
+    - p95<50ms
+    - 'errorRate<0.1%'
+  readPreference: '{mode: "secondary"}'
+record:
+  assert: [a, "b, c"]
+silent:
+`
+	settings, err := readConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []configSetting{
+		{section: globalConfigSection, name: "verbosity", value: "true", line: 2},
+		{section: "play", name: "host", value: "mongodb://replay:27017", line: 4},
+		{section: "play", name: "speed", value: "2.5", line: 5},
+		{section: "play", name: "assert", value: "p95<50ms", line: 7},
+		{section: "play", name: "assert", value: "errorRate<0.1%", line: 8},
+		{section: "play", name: "readPreference", value: `{mode: "secondary"}`, line: 9},
+		{section: "record", name: "assert", value: "a", line: 11},
+		{section: "record", name: "assert", value: "b, c", line: 11},
+		{section: globalConfigSection, name: "silent", line: 12},
+	}
+	if !reflect.DeepEqual(settings, expected) {
+		t.Errorf("settings not matched. Saw %v -- Expected %v", settings, expected)
+	}
+
+	for _, invalid := range []string{
+		"play:\n  host: a\n    speed: 2\n",
+		"play:\n  dialer:\n    tls: true\n",
+		"- a\n",
+		"play\n",
+		"play:\n\thost: a\n",
+	} {
+		if _, err := readConfig(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected an error reading %q", invalid)
+		}
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mongotape.yaml")
+	config := "silent: true\nplay:\n  host: mongodb://replay:27017\n  speed: 2\n  fullSpeed: true\n" +
+		"  collect: json\n  assert:\n    - p95<50ms\n    - max<1s\n"
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		name     string
+		args     []string
+		expected configTestCommand
+	}
+	cases := []testCase{
+		{
+			name: "file values",
+			args: []string{"play", "--config", path},
+			expected: configTestCommand{Host: "mongodb://replay:27017", Speed: 2, FullSpeed: true, Collect: "json",
+				Assert: []string{"p95<50ms", "max<1s"}},
+		},
+		{
+			name: "command line overrides",
+			args: []string{"--config=" + path, "play", "--speed", "4", "--assert", "ops>=10"},
+			expected: configTestCommand{Host: "mongodb://replay:27017", Speed: 4, FullSpeed: true, Collect: "json",
+				Assert: []string{"ops>=10"}},
+		},
+		{
+			name:     "no config",
+			args:     []string{"play", "--filter", "x"},
+			expected: configTestCommand{Host: "mongodb://localhost:27017", Speed: 1, Collect: "none", Filter: "x"},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		opts := Options{}
+		command := &configTestCommand{}
+		parser := flags.NewParser(&opts, flags.None)
+		if _, err := parser.AddCommand("play", "", "", command); err != nil {
+			t.Fatal(err)
+		}
+		if err := LoadConfigFile(parser, c.args); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parser.ParseArgs(c.args); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*command, c.expected) {
+			t.Errorf("options not matched. Saw %+v -- Expected %+v", *command, c.expected)
+		}
+		if opts.Silent != (opts.Config != "") {
+			t.Errorf("expected the global options of the file to be set")
+		}
+	}
+
+	for _, invalid := range []string{
+		"play:\n  speed: fast\n",
+		"play:\n  collect: xml\n",
+		"play:\n  unknown: 1\n",
+		"replay:\n  speed: 2\n",
+		"config: other.yaml\n",
+	} {
+		if err := ioutil.WriteFile(path, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		opts := Options{}
+		parser := flags.NewParser(&opts, flags.None)
+		if _, err := parser.AddCommand("play", "", "", &configTestCommand{}); err != nil {
+			t.Fatal(err)
+		}
+		err := LoadConfigFile(parser, []string{"play", "--config", path})
+		if err == nil || !strings.Contains(err.Error(), "line 1") && !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("expected an error locating the invalid setting of %q, got %v", invalid, err)
+		}
+	}
+}
+
+func TestLoadConfigFileCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mongotape.yaml")
+	config := "verbosity: [true, true]\nplay:\n  playback-file: ops.bson\n  host: mongodb://replay:27017\n" +
+		"  speed: 2\n  readsOnly: true\n  collect: json\n  tls: true\n  tlsCAFile: ca.pem\n" +
+		"record:\n  i: eth0\n"
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{}
+	parser := flags.NewParser(&opts, flags.None)
+	if err := AddCommands(parser, &opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadConfigFile(parser, []string{"--config", path}); err != nil {
+		t.Fatal(err)
+	}
+	play := parser.Find("play").Group
+	for name, expected := range map[string]interface{}{
+		"host": "mongodb://replay:27017", "speed": 2.0, "readsOnly": true, "tls": true, "tlsCAFile": "ca.pem",
+	} {
+		option := play.FindOptionByLongName(name)
+		if option == nil {
+			t.Fatalf("no --%v option", name)
+		}
+		if !reflect.DeepEqual(option.Value(), expected) {
+			t.Errorf("expected --%v to be %v, got %v", name, expected, option.Value())
+		}
+	}
+	if len(opts.Verbosity) != 2 {
+		t.Errorf("expected a verbosity of 2, got %v", len(opts.Verbosity))
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	mgo "github.com/10gen/llmgo"
+)
+
+const (
+	// connectionModelPerConnection plays each recorded connection on a live
+	// socket of its own.
+	connectionModelPerConnection = "perConnection"
+	// connectionModelPool plays each op on whichever socket of a shared,
+	// bounded pool is free.
+	connectionModelPool = "pool"
+	// connectionModelAffinity plays the ops of each recorded connection on
+	// one of a bounded number of sockets, chosen by hashing its connection
+	// number.
+	connectionModelAffinity = "affinity"
+)
+
+// socketPool shares a bounded number of live sockets between the recorded
+// connections of a playback, for the pool and affinity connection models.
+// Sockets are opened on first use, and those which fail are replaced by new
+// ones.
+type socketPool struct {
+	context  *ExecutionContext
+	affinity bool
+
+	// free holds the sockets of the pool model which are not in use, and a
+	// nil one for each socket yet to be opened.
+	free chan *mgo.MongoSocket
+
+	// affine holds the sockets of the affinity model, whose lock is held by
+	// the connection playing an op on the socket.
+	affine []*affineSocket
+}
+
+type affineSocket struct {
+	sync.Mutex
+	socket *mgo.MongoSocket
+}
+
+func newSocketPool(context *ExecutionContext, model string, size int) *socketPool {
+	pool := &socketPool{context: context}
+	if model == connectionModelAffinity {
+		pool.affinity = true
+		for i := 0; i < size; i++ {
+			pool.affine = append(pool.affine, &affineSocket{})
+		}
+		return pool
+	}
+	pool.free = make(chan *mgo.MongoSocket, size)
+	for i := 0; i < size; i++ {
+		pool.free <- nil
+	}
+	return pool
+}
+
+// acquire returns a socket to play an op of the recorded connection on,
+// waiting until one is free or ctx is done. The socket must be released
+// once the op has been played.
+func (pool *socketPool) acquire(ctx context.Context, connectionNum int64) (*mgo.MongoSocket, error) {
+	if pool.affinity {
+		slot := pool.slot(connectionNum)
+		slot.Lock()
+		if slot.socket == nil {
+			socket, err := pool.open()
+			if err != nil {
+				slot.Unlock()
+				return nil, err
+			}
+			slot.socket = socket
+		}
+		return slot.socket, nil
+	}
+	var socket *mgo.MongoSocket
+	select {
+	case socket = <-pool.free:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if socket == nil {
+		var err error
+		if socket, err = pool.open(); err != nil {
+			pool.free <- nil
+			return nil, err
+		}
+	}
+	return socket, nil
+}
+
+// release returns the socket acquired for the recorded connection to the
+// pool, closing it if the op played on it failed with a network error so
+// that it is replaced.
+func (pool *socketPool) release(connectionNum int64, socket *mgo.MongoSocket, failed bool) {
+	if failed {
+		pool.context.trackSocket(socket, false)
+		socket.Close()
+		socket = nil
+	}
+	if pool.affinity {
+		slot := pool.slot(connectionNum)
+		slot.socket = socket
+		slot.Unlock()
+		return
+	}
+	pool.free <- socket
+}
+
+// close closes the sockets of the pool once no ops are played on them.
+func (pool *socketPool) close() {
+	var sockets []*mgo.MongoSocket
+	if pool.affinity {
+		for _, slot := range pool.affine {
+			sockets = append(sockets, slot.socket)
+			slot.socket = nil
+		}
+	} else {
+		for i := 0; i < cap(pool.free); i++ {
+			socket := <-pool.free
+			sockets = append(sockets, socket)
+			pool.free <- nil
+		}
+	}
+	for _, socket := range sockets {
+		if socket != nil {
+			pool.context.trackSocket(socket, false)
+			socket.Close()
+		}
+	}
+}
+
+func (pool *socketPool) open() (*mgo.MongoSocket, error) {
+	socket, err := pool.context.acquireSocket()
+	if err != nil {
+		return nil, err
+	}
+	pool.context.trackSocket(socket, true)
+	return socket, nil
+}
+
+func (pool *socketPool) slot(connectionNum int64) *affineSocket {
+	return pool.affine[mixConnectionNum(connectionNum, 0)%uint64(len(pool.affine))]
+}
+
+// connectionScopedOp returns the name of op if it depends on state kept by
+// the connection it is played on, which the pool model doesn't preserve as
+// it plays each op on whichever socket is free: getLastError reports the
+// last write of its connection, authenticate and logout change who its
+// connection is authenticated as, and a legacy getMore continues a cursor
+// opened on its connection. It returns the empty string for other ops.
+func connectionScopedOp(op Op) string {
+	if _, ok := op.(*GetMoreOp); ok {
+		return "legacy getMore"
+	}
+	if isGetLastError(op) {
+		return "getLastError"
+	}
+	switch name := commandNameOf(op); strings.ToLower(name) {
+	case "authenticate", "logout":
+		return name
+	}
+	return ""
+}
+
+// cappedConnectionScopedOp returns the name of op if it depends on state kept
+// by the connection it is played on which --maxConnsPerTarget doesn't
+// preserve, as a connection hands its socket over to a waiting one whenever
+// it has no op to play. Only its writes keep the socket until their
+// getLastError is played. It returns the empty string for other ops.
+func cappedConnectionScopedOp(op Op) string {
+	if isGetLastError(op) {
+		return ""
+	}
+	return connectionScopedOp(op)
+}
+
+// parseConnectionScopedOp parses the recorded op if its opcode may depend on
+// the state of its connection, returning it with its name as returned by
+// scoped.
+func parseConnectionScopedOp(op *RecordedOp, scoped func(Op) string) (Op, string) {
+	switch op.RawOp.Header.OpCode {
+	case OpCodeGetMore, OpCodeQuery, OpCodeCommand, OpCodeMessage:
+	default:
+		return nil, ""
+	}
+	parsedOp, err := op.RawOp.Parse()
+	if err != nil || parsedOp == nil {
+		return nil, ""
+	}
+	return parsedOp, scoped(parsedOp)
+}
+
+// checkPoolable returns an error naming the first op of the playback file
+// which depends on the state of its connection, as the pool model would play
+// it on another connection than the ops before it, leaving the file at its
+// beginning.
+func checkPoolable(playbackFileReader *PlaybackFileReader, sampler *connectionSampler) error {
+	found, err := findConnectionScopedOp(playbackFileReader, sampler, connectionScopedOp)
+	if err != nil {
+		return err
+	}
+	if found != "" {
+		return fmt.Errorf("--connectionModel=%v can't play the %v ops of the playback file, which depend on the state of the connection they were recorded on; "+
+			"use --connectionModel=%v", connectionModelPool, found, connectionModelPerConnection)
+	}
+	return nil
+}
+
+// checkCappable works like checkPoolable for --maxConnsPerTarget, which may
+// play the ops of a connection on several sockets.
+func checkCappable(playbackFileReader *PlaybackFileReader, sampler *connectionSampler) error {
+	found, err := findConnectionScopedOp(playbackFileReader, sampler, cappedConnectionScopedOp)
+	if err != nil {
+		return err
+	}
+	if found != "" {
+		return fmt.Errorf("--maxConnsPerTarget can't play the %v ops of the playback file, which depend on the state of the connection they were recorded on", found)
+	}
+	return nil
+}
+
+// findConnectionScopedOp returns the name, as returned by scoped, of the first
+// op of the playback file which depends on the state of its connection, or
+// the empty string if there is none, leaving the file at its beginning.
+func findConnectionScopedOp(playbackFileReader *PlaybackFileReader, sampler *connectionSampler, scoped func(Op) string) (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opChan, errChan := playbackFileReader.OpChanWithContext(ctx, 1)
+	if sampler != nil {
+		opChan = sampleOps(ctx, opChan, sampler)
+	}
+	var found string
+	for op := range opChan {
+		if found != "" || op.EOF || op.RawOp.Header.ResponseTo != 0 {
+			continue
+		}
+		if _, found = parseConnectionScopedOp(op, scoped); found != "" {
+			cancel()
+		}
+	}
+	if err := <-errChan; err != io.EOF && found == "" {
+		return "", fmt.Errorf("OpChan: %v", err)
+	}
+	if _, err := playbackFileReader.Seek(0, 0); err != nil {
+		return "", err
+	}
+	return found, nil
+}
+
+// size returns the number of sockets of the pool.
+func (pool *socketPool) size() int {
+	if pool.affinity {
+		return len(pool.affine)
+	}
+	return cap(pool.free)
+}
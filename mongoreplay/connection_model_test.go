@@ -0,0 +1,201 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// newWarmContext returns a context whose sockets are taken from count
+// sockets opened ahead of playback, which are never used to send ops.
+func newWarmContext(count int) *ExecutionContext {
+	context := NewExecutionContext(&StatCollector{noop: true}, nil, &ExecutionOptions{})
+	context.warmSockets = make(chan *mgo.MongoSocket, count)
+	for i := 0; i < count; i++ {
+		context.warmSockets <- &mgo.MongoSocket{}
+	}
+	return context
+}
+
+func TestSocketPool(t *testing.T) {
+	execContext := newWarmContext(2)
+	pool := newSocketPool(execContext, connectionModelPool, 2)
+	ctx := context.Background()
+
+	// the sockets are opened on first use, and shared by the connections
+	first, err := pool.acquire(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := pool.acquire(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Errorf("expected the ops in flight to be played on different sockets")
+	}
+
+	// once every socket is in use, the ops wait for one to be released
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.acquire(timeout, 2); err != context.DeadlineExceeded {
+		t.Errorf("expected the op to wait for a socket, got %v", err)
+	}
+	pool.release(1, second, false)
+	if socket, err := pool.acquire(ctx, 2); err != nil || socket != second {
+		t.Errorf("expected the released socket to be reused, got %v", err)
+	}
+}
+
+func TestSocketAffinity(t *testing.T) {
+	execContext := newWarmContext(4)
+	pool := newSocketPool(execContext, connectionModelAffinity, 4)
+	ctx := context.Background()
+
+	// the ops of a connection are always played on the same socket
+	sockets := map[int64]*mgo.MongoSocket{}
+	for i := 0; i < 3; i++ {
+		for connectionNum := int64(1); connectionNum <= 8; connectionNum++ {
+			socket, err := pool.acquire(ctx, connectionNum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if previous, ok := sockets[connectionNum]; ok && previous != socket {
+				t.Errorf("expected connection %v to keep its socket", connectionNum)
+			}
+			sockets[connectionNum] = socket
+			pool.release(connectionNum, socket, false)
+		}
+	}
+	distinct := map[*mgo.MongoSocket]bool{}
+	for _, socket := range sockets {
+		distinct[socket] = true
+	}
+	if len(distinct) < 2 || len(distinct) > 4 {
+		t.Errorf("expected the connections to share between 2 and 4 sockets, got %v", len(distinct))
+	}
+}
+
+func TestCheckPoolable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type testCase struct {
+		name     string
+		generate func(generator *recordedOpGenerator) error
+		scoped   string
+		// capped is the name of the ops --maxConnsPerTarget can't play,
+		// which keeps the socket of a write until its getLastError
+		capped string
+	}
+	cases := []testCase{
+		{
+			name: "inserts and finds",
+			generate: func(generator *recordedOpGenerator) error {
+				if err := generator.generateMsgOpInsertHelper("insert", 0, 5); err != nil {
+					return err
+				}
+				return generator.generateMsgOpFind(bson.D{}, 0, 100)
+			},
+		},
+		{
+			name: "getLastError",
+			generate: func(generator *recordedOpGenerator) error {
+				if err := generator.generateInsertHelper("insert", 0, 5); err != nil {
+					return err
+				}
+				return generator.generateGetLastError()
+			},
+			scoped: "getLastError",
+		},
+		{
+			name: "legacy getMore",
+			generate: func(generator *recordedOpGenerator) error {
+				return generator.generateGetMore(1000, 10)
+			},
+			scoped: "legacy getMore",
+			capped: "legacy getMore",
+		},
+		{
+			name: "logout",
+			generate: func(generator *recordedOpGenerator) error {
+				return generator.generateCommandOp("logout", bson.D{{"logout", 1}}, 100)
+			},
+			scoped: "logout",
+			capped: "logout",
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		path := filepath.Join(dir, "pool.playback")
+		writer, err := NewPlaybackFileWriter(path, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		generator := newRecordedOpGenerator()
+		if err := c.generate(generator); err != nil {
+			t.Fatal(err)
+		}
+		close(generator.opChan)
+		numOps := 0
+		for op := range generator.opChan {
+			if err := writer.WriteRecordedOp(op); err != nil {
+				t.Fatal(err)
+			}
+			numOps++
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := NewPlaybackFileReader(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkPoolable(reader, nil)
+		if c.scoped == "" && err != nil {
+			t.Errorf("expected the ops to be poolable, got %v", err)
+		}
+		if c.scoped != "" && (err == nil || !strings.Contains(err.Error(), "the "+c.scoped+" ops")) {
+			t.Errorf("expected an error naming the %v ops, got %v", c.scoped, err)
+		}
+
+		// the file is read again from its beginning
+		opChan, _ := reader.OpChan(1)
+		readOps := 0
+		for range opChan {
+			readOps++
+		}
+		if readOps != numOps {
+			t.Errorf("expected %v ops to be read again, got %v", numOps, readOps)
+		}
+
+		if _, err := reader.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		err = checkCappable(reader, nil)
+		if c.capped == "" && err != nil {
+			t.Errorf("expected the ops to be playable with capped connections, got %v", err)
+		}
+		if c.capped != "" && (err == nil || !strings.Contains(err.Error(), "the "+c.capped+" ops")) {
+			t.Errorf("expected an error naming the %v ops, got %v", c.capped, err)
+		}
+		reader.Close()
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/mongodb/mongo-tools/common/options"
+	"github.com/mongodb/mongo-tools/common/password"
+	"github.com/mongodb/mongo-tools/common/util"
+)
+
+// defaultPlaybackHost is the host played against when none is given on the
+// command line or in MONGOREPLAY_HOST.
+const defaultPlaybackHost = standardScheme + "localhost:27017"
+
+// ConnectionOptions stores the connection, authentication and SSL options
+// that mongoreplay shares with the other mongo-tools, which select the
+// server to connect to and how to authenticate to it.
+type ConnectionOptions struct {
+	URI                string `long:"uri" value-name:"mongodb-uri" description:"mongodb uri connection string of the host to play back against"`
+	options.Connection `group:"connection options"`
+	AuthOptions        `group:"authentication options"`
+	options.SSL        `group:"ssl options"`
+}
+
+// AuthOptions holds the authentication options of the other mongo-tools.
+// --password has no short name, as -p is that of --playback-file.
+type AuthOptions struct {
+	Username  string `short:"u" value-name:"<username>" long:"username" description:"username for authentication"`
+	Password  string `value-name:"<password>" long:"password" description:"password for authentication"`
+	Source    string `long:"authenticationDatabase" value-name:"<database-name>" description:"database that holds the user's credentials"`
+	Mechanism string `long:"authenticationMechanism" value-name:"<mechanism>" description:"authentication mechanism to use"`
+}
+
+// dialInfo returns the DialInfo of the server selected by the options. The
+// server is given either as a connection string by --uri or, like the other
+// mongo-tools, by --host and --port. A connection string is also accepted
+// by --host, which was the only way to select the server before the other
+// options were supported, and by MONGOREPLAY_HOST when neither is set.
+// TLS is enabled in dial if the connection string asks for it, and the
+// servers of a mongodb+srv:// one are only looked up by resolveServers.
+func (opts *ConnectionOptions) dialInfo(dial *DialOptions) (*mgo.DialInfo, error) {
+	uri, host := opts.URI, opts.Host
+	switch {
+	case uri != "" && host != "":
+		return nil, fmt.Errorf("--uri cannot be used with --host")
+	case isConnectionString(host):
+		uri, host = host, ""
+	case uri == "" && host == "":
+		uri = os.Getenv("MONGOREPLAY_HOST")
+		if uri == "" {
+			uri = defaultPlaybackHost
+		} else if !isConnectionString(uri) {
+			uri, host = "", uri
+		}
+	}
+
+	var info *mgo.DialInfo
+	if uri != "" {
+		if opts.Port != "" {
+			return nil, fmt.Errorf("--port cannot be used with a connection string")
+		}
+		var err error
+		if info, err = parseConnectionString(uri, dial); err != nil {
+			return nil, err
+		}
+	} else {
+		addrs, setName := util.ParseConnectionString(host)
+		info = &mgo.DialInfo{
+			Addrs:          addrs,
+			ReplicaSetName: setName,
+		}
+	}
+	for i, addr := range info.Addrs {
+		info.Addrs[i] = normalizeAddr(addr, opts.Port)
+	}
+
+	// the authentication options override those of the connection string
+	if opts.Username != "" {
+		info.Username = opts.Username
+	}
+	if opts.Password != "" {
+		info.Password = opts.Password
+	}
+	if opts.Source != "" {
+		info.Source = opts.Source
+	}
+	if opts.Mechanism != "" {
+		info.Mechanism = opts.Mechanism
+	}
+	auth := options.Auth{Mechanism: info.Mechanism}
+	if info.Source == "" && auth.RequiresExternalDB() {
+		info.Source = "$external"
+	}
+	info.Timeout = time.Duration(opts.Timeout) * time.Second
+	return info, nil
+}
+
+// parseConnectionString returns the DialInfo of a connection string,
+// enabling TLS in dial if it asks for it. The host of a mongodb+srv://
+// connection string is the only server of the DialInfo until
+// resolveServers looks up those it lists.
+func parseConnectionString(uri string, dial *DialOptions) (*mgo.DialInfo, error) {
+	dial.srv = nil
+	if strings.HasPrefix(uri, srvScheme) {
+		srv, err := parseSRV(uri)
+		if err != nil {
+			return nil, err
+		}
+		dial.srv = srv
+		uri = srv.connectionString([]string{srv.host}, srv.options)
+	}
+	uri, useTLS, err := extractTLSOption(uri)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing connection string: %v", err)
+	}
+	if useTLS != nil && *useTLS {
+		dial.TLS = true
+	}
+	info, err := mgo.ParseURL(uri)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing connection string: %v", err)
+	}
+	return info, nil
+}
+
+// resolveServers looks up the servers of info if it is that of a
+// mongodb+srv:// connection string, along with the replica set and
+// authentication database of its TXT record unless they are set otherwise.
+// It is called when connecting, rather than when validating the options,
+// so that DNS isn't queried by playbacks which don't connect.
+func (opts *DialOptions) resolveServers(info *mgo.DialInfo) error {
+	if opts.srv == nil {
+		return nil
+	}
+	uri, err := opts.srv.resolve()
+	if err != nil {
+		return err
+	}
+	if uri, _, err = extractTLSOption(uri); err != nil {
+		return fmt.Errorf("error parsing connection string: %v", err)
+	}
+	resolved, err := mgo.ParseURL(uri)
+	if err != nil {
+		return fmt.Errorf("error parsing connection string: %v", err)
+	}
+	info.Addrs = resolved.Addrs
+	if info.ReplicaSetName == "" {
+		info.ReplicaSetName = resolved.ReplicaSetName
+	}
+	if info.Source == "" {
+		info.Source = resolved.Source
+	}
+	return nil
+}
+
+// promptForPassword prompts for the password of info if a username is given
+// without it.
+func promptForPassword(info *mgo.DialInfo) {
+	auth := options.Auth{Username: info.Username, Password: info.Password, Mechanism: info.Mechanism}
+	if auth.ShouldAskForPassword() {
+		info.Password = password.Prompt()
+	}
+}
+
+// setDialOptions sets the TLS settings of dial matching the SSL options of
+// the other mongo-tools, and parses its proxy, SSH tunnel and compressors.
+func (opts *ConnectionOptions) setDialOptions(dial *DialOptions) error {
+	switch {
+	case opts.SSLCRLFile != "":
+		return fmt.Errorf("--sslCRLFile is not supported by mongoreplay")
+	case opts.SSLFipsMode:
+		return fmt.Errorf("--sslFIPSMode is not supported by mongoreplay")
+	case !opts.UseSSL && !dial.TLS && (opts.SSLCAFile != "" || opts.SSLPEMKeyFile != "" ||
+		opts.SSLPEMKeyPassword != "" || opts.SSLAllowInvalidCert || opts.SSLAllowInvalidHost):
+		return fmt.Errorf("--ssl is required when using other SSL options")
+	case opts.SSLCAFile != "" && dial.TLSCAFile != "":
+		return fmt.Errorf("--sslCAFile cannot be used with --tlsCAFile")
+	case opts.SSLPEMKeyFile != "" && dial.TLSCertificateKeyFile != "":
+		return fmt.Errorf("--sslPEMKeyFile cannot be used with --tlsCertificateKeyFile")
+	case dial.SSHTunnel != "" && dial.Proxy != "":
+		return fmt.Errorf("--sshTunnel cannot be used with --proxy")
+	case dial.SSHTunnel == "" && (dial.SSHIdentityFile != "" || dial.SSHKnownHosts != "" || len(dial.SSHHostMap) > 0):
+		return fmt.Errorf("--sshTunnel is required when using other SSH options")
+	}
+	if opts.UseSSL {
+		dial.TLS = true
+	}
+	if opts.SSLCAFile != "" {
+		dial.TLSCAFile = opts.SSLCAFile
+	}
+	if opts.SSLPEMKeyFile != "" {
+		dial.TLSCertificateKeyFile = opts.SSLPEMKeyFile
+	}
+	if opts.SSLAllowInvalidCert {
+		dial.TLSAllowInvalidCertificates = true
+	}
+	dial.certificateKeyPassword = opts.SSLPEMKeyPassword
+	dial.allowInvalidHostnames = opts.SSLAllowInvalidHost
+	dial.timeout = time.Duration(opts.Timeout) * time.Second
+	if dial.Proxy != "" {
+		proxy, err := parseProxy(dial.Proxy)
+		if err != nil {
+			return fmt.Errorf("Invalid setting for --proxy: %v", err)
+		}
+		proxy.timeout = dial.timeout
+		dial.proxy = proxy
+	}
+	if dial.SSHTunnel != "" {
+		tunnel, err := parseSSHTunnel(dial.SSHTunnel, dial.SSHIdentityFile, dial.SSHKnownHosts, dial.SSHHostMap)
+		if err != nil {
+			return fmt.Errorf("Invalid setting for --sshTunnel: %v", err)
+		}
+		tunnel.timeout = dial.timeout
+		dial.tunnel = tunnel
+	}
+	if dial.NetworkCompression != "" {
+		compressors, err := parseCompressors(dial.NetworkCompression)
+		if err != nil {
+			return fmt.Errorf("Invalid setting for --networkCompression: %v", err)
+		}
+		dial.compressors = compressors
+	}
+	return nil
+}
+
+func isConnectionString(host string) bool {
+	return strings.HasPrefix(host, standardScheme) || strings.HasPrefix(host, srvScheme)
+}
+
+// describeServers returns the servers of a DialInfo, as logged.
+func describeServers(info *mgo.DialInfo) string {
+	servers := strings.Join(info.Addrs, ",")
+	if info.ReplicaSetName != "" {
+		servers = info.ReplicaSetName + "/" + servers
+	}
+	return servers
+}
@@ -0,0 +1,204 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// connectionSummaryRows is the number of the connections which fell behind
+// the recorded timeline listed when playback finishes.
+const connectionSummaryRows = 10
+
+// ConnectionSummary holds the ops played for a recorded connection, the
+// errors they encountered and how far behind the recorded timeline they were
+// played.
+type ConnectionSummary struct {
+	// ConnectionNum is the number of the connection in the playback file,
+	// and PlayedConnectionNum that of the connection it was played as.
+	ConnectionNum       int64
+	PlayedConnectionNum int64
+	Client              string
+	// Ops is the number of ops played, and Errors the number of them which
+	// encountered errors.
+	Ops    int64
+	Errors int64
+	// FirstSeen is when the first op played was recorded.
+	// RecordedDurationMicros is the time between it and the last op played
+	// in the recording, and PlayedDurationMicros the time between them in
+	// the playback.
+	FirstSeen              time.Time
+	RecordedDurationMicros int64
+	PlayedDurationMicros   int64
+	// TotalLagMicros, MeanLagMicros and MaxLagMicros are the sum, the mean
+	// and the highest of the times between when the ops were due to be
+	// played and when they were.
+	TotalLagMicros int64
+	MeanLagMicros  int64
+	MaxLagMicros   int64
+	// Behind is set when an op was played further behind the recorded
+	// timeline than the threshold of --behindThreshold.
+	Behind bool
+
+	lastSeen   time.Time
+	firstPlay  time.Time
+	lastPlay   time.Time
+	lagSamples int64
+}
+
+// observe counts an op of the connection which was played, with the error
+// encountered executing it and the errors found in its reply. It returns how
+// far behind the recorded timeline the op was played.
+func (summary *ConnectionSummary) observe(op *RecordedOp, executionErr error, reply Replyable) time.Duration {
+	if summary.Ops == 0 {
+		summary.ConnectionNum = op.SeenConnectionNum
+		summary.PlayedConnectionNum = op.PlayedConnectionNum
+		summary.Client = op.SrcEndpoint
+		summary.FirstSeen = op.Seen.Time
+		summary.firstPlay = op.PlayedAt.Time
+	}
+	summary.Ops++
+	if executionErr != nil || (reply != nil && len(reply.getErrors()) > 0) {
+		summary.Errors++
+	}
+	summary.lastSeen = op.Seen.Time
+	summary.lastPlay = op.PlayedAt.Time
+	if op.PlayAt == nil || op.PlayAt.IsZero() {
+		return 0
+	}
+	lag := op.PlayedAt.Sub(op.PlayAt.Time)
+	lagMicros := int64(lag / time.Microsecond)
+	summary.TotalLagMicros += lagMicros
+	summary.lagSamples++
+	if lagMicros > summary.MaxLagMicros {
+		summary.MaxLagMicros = lagMicros
+	}
+	return lag
+}
+
+// finish works out the durations and mean lag of the connection once its
+// last op was played, marking it as behind if its lag exceeded threshold.
+func (summary *ConnectionSummary) finish(threshold time.Duration) {
+	summary.RecordedDurationMicros = int64(summary.lastSeen.Sub(summary.FirstSeen) / time.Microsecond)
+	summary.PlayedDurationMicros = int64(summary.lastPlay.Sub(summary.firstPlay) / time.Microsecond)
+	if summary.lagSamples > 0 {
+		summary.MeanLagMicros = summary.TotalLagMicros / summary.lagSamples
+	}
+	summary.Behind = threshold > 0 && summary.MaxLagMicros > int64(threshold/time.Microsecond)
+}
+
+// ConnectionSummaryRecorder is implemented by the StatRecorders which report
+// the summaries of the recorded connections along with the stats of the ops.
+// It is called once the connections have finished playing, before Close.
+type ConnectionSummaryRecorder interface {
+	RecordConnectionSummaries(summaries []*ConnectionSummary)
+}
+
+// RecordConnectionSummaries passes the summaries to the recorders which
+// report them.
+func (msr multiStatRecorder) RecordConnectionSummaries(summaries []*ConnectionSummary) {
+	for _, recorder := range msr {
+		if summaryRecorder, ok := recorder.(ConnectionSummaryRecorder); ok {
+			summaryRecorder.RecordConnectionSummaries(summaries)
+		}
+	}
+}
+
+// connectionSummaries collects the summaries of the recorded connections
+// once they have finished playing.
+type connectionSummaries struct {
+	sync.Mutex
+	summaries []*ConnectionSummary
+}
+
+// add keeps the summary of a connection which played ops.
+func (all *connectionSummaries) add(summary *ConnectionSummary) {
+	if summary.Ops == 0 {
+		return
+	}
+	all.Lock()
+	defer all.Unlock()
+	all.summaries = append(all.summaries, summary)
+}
+
+// merge adds the summaries collected by other.
+func (all *connectionSummaries) merge(other *connectionSummaries) {
+	other.Lock()
+	defer other.Unlock()
+	all.Lock()
+	defer all.Unlock()
+	all.summaries = append(all.summaries, other.summaries...)
+}
+
+// sorted returns the summaries in the order of the recorded connections.
+func (all *connectionSummaries) sorted() []*ConnectionSummary {
+	all.Lock()
+	defer all.Unlock()
+	summaries := make([]*ConnectionSummary, len(all.summaries))
+	copy(summaries, all.summaries)
+	sort.SliceStable(summaries, func(i, j int) bool {
+		if summaries[i].ConnectionNum != summaries[j].ConnectionNum {
+			return summaries[i].ConnectionNum < summaries[j].ConnectionNum
+		}
+		return summaries[i].FirstSeen.Before(summaries[j].FirstSeen)
+	})
+	return summaries
+}
+
+// behind returns the summaries of the connections which fell behind the
+// recorded timeline, furthest behind first.
+func (all *connectionSummaries) behind() []*ConnectionSummary {
+	var behind []*ConnectionSummary
+	for _, summary := range all.sorted() {
+		if summary.Behind {
+			behind = append(behind, summary)
+		}
+	}
+	sort.SliceStable(behind, func(i, j int) bool {
+		return behind[i].MaxLagMicros > behind[j].MaxLagMicros
+	})
+	return behind
+}
+
+// logSummary logs the connections which fell behind the recorded timeline
+// by more than threshold.
+func (all *connectionSummaries) logSummary(threshold time.Duration) {
+	behind := all.behind()
+	if len(behind) == 0 {
+		return
+	}
+	all.Lock()
+	total := len(all.summaries)
+	all.Unlock()
+	userInfoLogger.Logvf(Always, "%v of %v recorded connections fell behind the recorded timeline by more than %v:\n%v",
+		len(behind), total, threshold, formatConnectionTable(behind, connectionSummaryRows))
+}
+
+// formatConnectionTable lays out the first rows summaries as a table.
+func formatConnectionTable(summaries []*ConnectionSummary, rows int) string {
+	out := &bytes.Buffer{}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "conn\tclient\tops\terrors\trecorded\tplayed\tmean lag ms\tmax lag ms\t")
+	for i, summary := range summaries {
+		if i == rows {
+			fmt.Fprintf(w, "... %v more\t\t\t\t\t\t\t\t\n", len(summaries)-i)
+			break
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n", summary.ConnectionNum, summary.Client,
+			summary.Ops, summary.Errors,
+			(time.Duration(summary.RecordedDurationMicros) * time.Microsecond).Round(time.Millisecond),
+			(time.Duration(summary.PlayedDurationMicros) * time.Microsecond).Round(time.Millisecond),
+			formatMillis(summary.MeanLagMicros), formatMillis(summary.MaxLagMicros))
+	}
+	w.Flush()
+	return out.String()
+}
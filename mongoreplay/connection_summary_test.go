@@ -0,0 +1,157 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// playedConnectionOps returns the ops of a recorded connection recorded a
+// second apart, each played lags[i] after it was due.
+func playedConnectionOps(connectionNum int64, start time.Time, lags ...time.Duration) []*RecordedOp {
+	ops := make([]*RecordedOp, len(lags))
+	for i, lag := range lags {
+		seen := start.Add(time.Duration(i) * time.Second)
+		ops[i] = &RecordedOp{
+			SeenConnectionNum:   connectionNum,
+			PlayedConnectionNum: connectionNum + 100,
+			SrcEndpoint:         fmt.Sprintf("10.0.0.1:%v", 50000+connectionNum),
+			Seen:                &PreciseTime{seen},
+			PlayAt:              &PreciseTime{seen},
+			PlayedAt:            &PreciseTime{seen.Add(lag)},
+		}
+	}
+	return ops
+}
+
+func TestConnectionSummary(t *testing.T) {
+	start := time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC)
+	summary := &ConnectionSummary{}
+	for i, op := range playedConnectionOps(3, start, 0, 2*time.Second, 4*time.Second) {
+		var err error
+		if i == 1 {
+			err = fmt.Errorf("error executing op")
+		}
+		summary.observe(op, err, nil)
+	}
+	summary.finish(time.Second)
+
+	expected := ConnectionSummary{
+		ConnectionNum:          3,
+		PlayedConnectionNum:    103,
+		Client:                 "10.0.0.1:50003",
+		Ops:                    3,
+		Errors:                 1,
+		FirstSeen:              start,
+		RecordedDurationMicros: 2000000,
+		PlayedDurationMicros:   6000000,
+		TotalLagMicros:         6000000,
+		MeanLagMicros:          2000000,
+		MaxLagMicros:           4000000,
+		Behind:                 true,
+	}
+	if summary.ConnectionNum != expected.ConnectionNum ||
+		summary.PlayedConnectionNum != expected.PlayedConnectionNum ||
+		summary.Client != expected.Client || summary.Ops != expected.Ops ||
+		summary.Errors != expected.Errors || !summary.FirstSeen.Equal(expected.FirstSeen) ||
+		summary.RecordedDurationMicros != expected.RecordedDurationMicros ||
+		summary.PlayedDurationMicros != expected.PlayedDurationMicros ||
+		summary.TotalLagMicros != expected.TotalLagMicros ||
+		summary.MeanLagMicros != expected.MeanLagMicros ||
+		summary.MaxLagMicros != expected.MaxLagMicros || summary.Behind != expected.Behind {
+		t.Errorf("expected %+v, got %+v", expected, *summary)
+	}
+
+	summary.finish(0)
+	if summary.Behind {
+		t.Errorf("expected no connection to fall behind without a threshold")
+	}
+}
+
+func TestConnectionSummaries(t *testing.T) {
+	start := time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC)
+	lags := map[int64][]time.Duration{
+		1: {0, 10 * time.Millisecond},
+		2: {0, 3 * time.Second},
+		3: {500 * time.Millisecond},
+		4: {2 * time.Second, time.Second},
+	}
+	all := &connectionSummaries{}
+	for _, connectionNum := range []int64{4, 2, 3, 1} {
+		summary := &ConnectionSummary{}
+		for _, op := range playedConnectionOps(connectionNum, start, lags[connectionNum]...) {
+			summary.observe(op, nil, nil)
+		}
+		summary.finish(time.Second)
+		all.add(summary)
+	}
+	// a connection whose ops were all skipped isn't summarized
+	all.add(&ConnectionSummary{})
+
+	var connectionNums []int64
+	for _, summary := range all.sorted() {
+		connectionNums = append(connectionNums, summary.ConnectionNum)
+	}
+	if fmt.Sprint(connectionNums) != "[1 2 3 4]" {
+		t.Errorf("expected the connections in order, got %v", connectionNums)
+	}
+
+	connectionNums = nil
+	for _, summary := range all.behind() {
+		connectionNums = append(connectionNums, summary.ConnectionNum)
+	}
+	if fmt.Sprint(connectionNums) != "[2 4]" {
+		t.Errorf("expected connections 2 and 4 behind, furthest first, got %v", connectionNums)
+	}
+
+	table := formatConnectionTable(all.behind(), 1)
+	lines := strings.Split(strings.TrimSpace(table), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a header, a connection and a line of the others, got:\n%v", table)
+	}
+	if fields := strings.Fields(lines[1]); strings.Join(fields, " ") != "2 10.0.0.1:50002 2 0 1s 4s 1500.000 3000.000" {
+		t.Errorf("unexpected row: %q", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "... 1 more") {
+		t.Errorf("expected the other connection to be counted, got %q", lines[2])
+	}
+
+	// the summaries are added to the HTML report
+	out := &bytes.Buffer{}
+	rec := newHTMLReportRecorder(NopWriteCloser(out))
+	multiStatRecorder{&NopRecorder{}, rec}.RecordConnectionSummaries(all.sorted())
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report := out.String()
+	expected := []string{
+		"4 recorded connections played, 2 of which fell behind the recorded timeline",
+		"<tr><td>2</td><td>10.0.0.1:50002</td><td>2</td><td>0</td><td>1s</td><td>4s</td><td>1500.000</td><td>3000.000</td></tr>",
+	}
+	for _, s := range expected {
+		if !strings.Contains(report, s) {
+			t.Errorf("expected %q in the report", s)
+		}
+	}
+	if strings.Index(report, "<td>10.0.0.1:50002</td>") > strings.Index(report, "<td>10.0.0.1:50004</td>") {
+		t.Errorf("expected the connections furthest behind first")
+	}
+
+	out.Reset()
+	rec = newHTMLReportRecorder(NopWriteCloser(out))
+	rec.RecordConnectionSummaries((&connectionSummaries{}).sorted())
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "<h2>Connections</h2>") {
+		t.Errorf("expected no connections section without connections")
+	}
+}
@@ -0,0 +1,408 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// playbackClock maps the times at which ops are scheduled by the
+// PacingStrategy to the times at which they are played, so that a playback
+// can be paused, resumed, sped up and slowed down while it runs.
+type playbackClock struct {
+	lock sync.Mutex
+	// rate scales the schedule: at a rate of 2, ops are played twice as fast
+	// as they were scheduled.
+	rate float64
+	// scheduled is the time of the schedule reached at wall, the time of the
+	// last change. The schedule doesn't advance while paused.
+	scheduled, wall time.Time
+	paused          bool
+	// changed is closed and replaced on every change, waking the waits.
+	changed chan struct{}
+}
+
+func newPlaybackClock() *playbackClock {
+	now := time.Now()
+	return &playbackClock{rate: 1, scheduled: now, wall: now, changed: make(chan struct{})}
+}
+
+// nowLocked returns the time of the schedule reached at now.
+func (c *playbackClock) nowLocked(now time.Time) time.Time {
+	if c.paused {
+		return c.scheduled
+	}
+	return c.scheduled.Add(time.Duration(float64(now.Sub(c.wall)) * c.rate))
+}
+
+func (c *playbackClock) changeLocked(now time.Time) {
+	c.scheduled = c.nowLocked(now)
+	c.wall = now
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// now returns the time of the schedule reached.
+func (c *playbackClock) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.nowLocked(time.Now())
+}
+
+// pause stops the schedule, returning false if it was already paused.
+func (c *playbackClock) pause() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.paused {
+		return false
+	}
+	c.changeLocked(time.Now())
+	c.paused = true
+	return true
+}
+
+// resume continues the schedule from where it was paused, returning false
+// if it wasn't paused.
+func (c *playbackClock) resume() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.paused {
+		return false
+	}
+	c.paused = false
+	c.changeLocked(time.Now())
+	return true
+}
+
+// setRate changes the rate of the schedule from now on.
+func (c *playbackClock) setRate(rate float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.changeLocked(time.Now())
+	c.rate = rate
+}
+
+// waitUntil waits until the schedule reaches t, or ctx is done, in which case
+// ctx's error is returned. A zero t only waits while the schedule is paused.
+func (c *playbackClock) waitUntil(ctx context.Context, t time.Time) error {
+	for {
+		c.lock.Lock()
+		changed, paused := c.changed, c.paused
+		var wait time.Duration
+		if !t.IsZero() {
+			wait = time.Duration(float64(t.Sub(c.nowLocked(time.Now()))) / c.rate)
+		}
+		c.lock.Unlock()
+		if !paused && wait <= 0 {
+			return nil
+		}
+		var timer *time.Timer
+		var due <-chan time.Time
+		if !paused {
+			timer = time.NewTimer(wait)
+			due = timer.C
+		}
+		select {
+		case <-due:
+		case <-changed:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// sleepUntil waits until t, following the playback's clock if it is
+// controlled, or until ctx is done.
+func (context *ExecutionContext) sleepUntil(ctx context.Context, t time.Time) error {
+	if context.clock != nil {
+		return context.clock.waitUntil(ctx, t)
+	}
+	return sleepUntil(ctx, t)
+}
+
+// waitToPlay waits until it is time to play an op scheduled at playAt. At
+// full speed ops are played at once, unless the playback is paused.
+func (context *ExecutionContext) waitToPlay(ctx context.Context, playAt time.Time) error {
+	switch {
+	case context.fullSpeed && context.clock != nil:
+		return context.clock.waitUntil(ctx, time.Time{})
+	case context.fullSpeed:
+		return nil
+	case context.clock == nil && !time.Now().Before(playAt):
+		return nil
+	}
+	return context.sleepUntil(ctx, playAt)
+}
+
+// playControl serves the control endpoint of 'play --controlAddr', which
+// pauses, resumes, changes the speed of and aborts the playback, and reports
+// its progress.
+type playControl struct {
+	clock *playbackClock
+	// speed is the speed the playback was started at, which the rate of the
+	// clock scales.
+	speed float64
+	abort context.CancelFunc
+
+	mu       sync.Mutex
+	contexts []*ExecutionContext
+	started  time.Time
+	aborted  bool
+}
+
+// playControlStatus is the response of the control endpoint.
+type playControlStatus struct {
+	State           string  `json:"state"`
+	Speed           float64 `json:"speed"`
+	OpsDispatched   int64   `json:"opsDispatched"`
+	OpsCompleted    int64   `json:"opsCompleted"`
+	Errors          int64   `json:"errors"`
+	OpenConnections int64   `json:"openConnections"`
+	ElapsedSeconds  float64 `json:"elapsedSeconds"`
+}
+
+// errControlConflict is returned by the actions requested in a state they
+// can't be performed in, and errControlRequest by those requested with
+// invalid parameters.
+type errControlConflict string
+type errControlRequest string
+
+func (e errControlConflict) Error() string {
+	return string(e)
+}
+
+func (e errControlRequest) Error() string {
+	return string(e)
+}
+
+func newPlayControl(speed float64, abort context.CancelFunc) *playControl {
+	return &playControl{clock: newPlaybackClock(), speed: speed, abort: abort, started: time.Now()}
+}
+
+// control has the clock of the playback of contexts controlled, and their
+// progress reported, by the endpoint.
+func (control *playControl) control(contexts ...*ExecutionContext) {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	for _, context := range contexts {
+		context.clock = control.clock
+		control.contexts = append(control.contexts, context)
+	}
+}
+
+// serve serves the control endpoint on addr until the returned function is
+// called.
+func (control *playControl) serve(addr string) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for control requests: %v", err)
+	}
+	server := &http.Server{Handler: control.handler()}
+	go server.Serve(listener)
+	userInfoLogger.Logvf(Always, "Listening for control requests on http://%v", listener.Addr())
+	return func() { server.Close() }, nil
+}
+
+// handler returns the handler of the control endpoint.
+func (control *playControl) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "status must be requested with GET", http.StatusMethodNotAllowed)
+			return
+		}
+		control.respond(w)
+	})
+	control.handleAction(mux, "/pause", func(r *http.Request) error {
+		if !control.clock.pause() {
+			return errControlConflict("already paused")
+		}
+		userInfoLogger.Logvf(Always, "Playback paused")
+		return nil
+	})
+	control.handleAction(mux, "/resume", func(r *http.Request) error {
+		if !control.clock.resume() {
+			return errControlConflict("not paused")
+		}
+		userInfoLogger.Logvf(Always, "Playback resumed")
+		return nil
+	})
+	control.handleAction(mux, "/speed", func(r *http.Request) error {
+		speed, err := parseSpeed(r.FormValue("speed"))
+		if err != nil {
+			return errControlRequest(err.Error())
+		}
+		control.setSpeed(speed)
+		return nil
+	})
+	control.handleAction(mux, "/abort", func(r *http.Request) error {
+		control.mu.Lock()
+		control.aborted = true
+		control.mu.Unlock()
+		userInfoLogger.Logvf(Always, "Playback aborted")
+		control.abort()
+		return nil
+	})
+	return mux
+}
+
+// setSpeed changes the speed of the rest of the playback.
+func (control *playControl) setSpeed(speed float64) {
+	control.clock.setRate(speed / control.speed)
+	userInfoLogger.Logvf(Always, "Playback speed changed to %.2fx", speed)
+}
+
+// togglePause pauses the playback, or resumes it if it is paused.
+func (control *playControl) togglePause() {
+	if control.clock.pause() {
+		userInfoLogger.Logvf(Always, "Playback paused")
+	} else if control.clock.resume() {
+		userInfoLogger.Logvf(Always, "Playback resumed")
+	}
+}
+
+// speedFilePollInterval is how often the --speedFile of a playback is checked
+// for changes.
+const speedFilePollInterval = time.Second
+
+// watch pauses or resumes the playback on pauseSignal, and changes its speed
+// to that of speedFile, if set, whenever speedSignal is received or the file
+// is modified, until ctx is done.
+func (control *playControl) watch(ctx context.Context, speedFile string) {
+	sigChan := make(chan os.Signal, 1)
+	if pauseSignal != nil {
+		signal.Notify(sigChan, pauseSignal, speedSignal)
+		defer signal.Stop(sigChan)
+	}
+	var ticks <-chan time.Time
+	var modified time.Time
+	if speedFile != "" {
+		ticker := time.NewTicker(speedFilePollInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+		if info, err := os.Stat(speedFile); err == nil {
+			modified = info.ModTime()
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-sigChan:
+			switch {
+			case s == pauseSignal:
+				control.togglePause()
+			case speedFile == "":
+				userInfoLogger.Logvf(Always, "Got signal %v, but there is no --speedFile to read the speed from", s)
+			default:
+				control.readSpeedFile(speedFile)
+			}
+		case <-ticks:
+			info, err := os.Stat(speedFile)
+			if err != nil || info.ModTime().Equal(modified) {
+				continue
+			}
+			modified = info.ModTime()
+			control.readSpeedFile(speedFile)
+		}
+	}
+}
+
+// readSpeedFile changes the speed of the playback to the one written in
+// path.
+func (control *playControl) readSpeedFile(path string) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		userInfoLogger.Logvf(Always, "Error reading --speedFile: %v", err)
+		return
+	}
+	speed, err := parseSpeed(string(contents))
+	if err != nil {
+		userInfoLogger.Logvf(Always, "Error reading --speedFile: %v", err)
+		return
+	}
+	control.setSpeed(speed)
+}
+
+// parseSpeed parses a speed multiplier.
+func parseSpeed(s string) (float64, error) {
+	speed, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("invalid speed '%v'", strings.TrimSpace(s))
+	}
+	return speed, nil
+}
+
+// handleAction serves the POST requests of path by running action, then
+// responding with the status of the playback.
+func (control *playControl) handleAction(mux *http.ServeMux, path string, action func(r *http.Request) error) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, fmt.Sprintf("%v must be requested with POST", path[1:]), http.StatusMethodNotAllowed)
+			return
+		}
+		if err := action(r); err != nil {
+			code := http.StatusInternalServerError
+			switch err.(type) {
+			case errControlConflict:
+				code = http.StatusConflict
+			case errControlRequest:
+				code = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		control.respond(w)
+	})
+}
+
+// status returns the state and speed of the playback, and the progress of
+// every context it plays.
+func (control *playControl) status() playControlStatus {
+	control.clock.lock.Lock()
+	status := playControlStatus{State: "playing", Speed: control.speed * control.clock.rate}
+	if control.clock.paused {
+		status.State = "paused"
+	}
+	control.clock.lock.Unlock()
+
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	if control.aborted {
+		status.State = "aborted"
+	}
+	for _, context := range control.contexts {
+		progress := context.events.progress(control.started)
+		status.OpsDispatched += progress.OpsDispatched
+		status.OpsCompleted += progress.OpsCompleted
+		status.Errors += progress.Errors
+		status.OpenConnections += progress.OpenConnections
+	}
+	status.ElapsedSeconds = time.Since(control.started).Seconds()
+	return status
+}
+
+func (control *playControl) respond(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(control.status())
+}
@@ -0,0 +1,18 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+// +build !windows
+
+package mongoreplay
+
+import (
+	"os"
+	"syscall"
+)
+
+// pauseSignal pauses or resumes a playback, and speedSignal has it re-read
+// its --speedFile.
+var pauseSignal, speedSignal os.Signal = syscall.SIGUSR1, syscall.SIGUSR2
@@ -0,0 +1,13 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import "os"
+
+// there are no signals to pause a playback or to have it re-read its
+// --speedFile on Windows, where the file is only polled.
+var pauseSignal, speedSignal os.Signal
@@ -0,0 +1,175 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPlaybackClock(t *testing.T) {
+	clock := newPlaybackClock()
+	ctx := context.Background()
+
+	// a paused clock holds back the ops until it is resumed
+	clock.pause()
+	done := make(chan error, 1)
+	go func() {
+		done <- clock.waitUntil(ctx, time.Now())
+	}()
+	select {
+	case <-done:
+		t.Fatalf("expected the wait to be held back while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !clock.resume() || clock.resume() {
+		t.Errorf("expected the clock to be resumed once")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// at a rate of 100, an op scheduled in 5 seconds is played in 50ms
+	clock.setRate(100)
+	start := time.Now()
+	if err := clock.waitUntil(ctx, start.Add(5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("expected the wait to be sped up, waited %v", waited)
+	}
+
+	// a wait is interrupted by its context
+	clock.pause()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := clock.waitUntil(ctx, time.Time{}); err != context.DeadlineExceeded {
+		t.Errorf("expected the wait to be interrupted, got %v", err)
+	}
+}
+
+func TestPlayControl(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	control := newPlayControl(2, cancel)
+	context := NewExecutionContext(&StatCollector{noop: true}, nil, &ExecutionOptions{})
+	control.control(context)
+	context.events.send(Event{Type: OpDispatched})
+	server := httptest.NewServer(control.handler())
+	defer server.Close()
+
+	type testCase struct {
+		name  string
+		path  string
+		form  url.Values
+		code  int
+		state string
+		speed float64
+	}
+	cases := []testCase{
+		{name: "status", path: "/status", code: http.StatusOK, state: "playing", speed: 2},
+		{name: "pause", path: "/pause", code: http.StatusOK, state: "paused", speed: 2},
+		{name: "pause again", path: "/pause", code: http.StatusConflict},
+		{name: "change speed", path: "/speed", form: url.Values{"speed": {"0.5"}}, code: http.StatusOK, state: "paused", speed: 0.5},
+		{name: "invalid speed", path: "/speed", form: url.Values{"speed": {"-1"}}, code: http.StatusBadRequest},
+		{name: "resume", path: "/resume", code: http.StatusOK, state: "playing", speed: 0.5},
+		{name: "abort", path: "/abort", code: http.StatusOK, state: "aborted", speed: 0.5},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		var response *http.Response
+		var err error
+		if c.path == "/status" {
+			response, err = http.Get(server.URL + c.path)
+		} else {
+			response, err = http.PostForm(server.URL+c.path, c.form)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		if response.StatusCode != c.code {
+			t.Errorf("expected status %v, got %v", c.code, response.StatusCode)
+			continue
+		}
+		if c.code != http.StatusOK {
+			continue
+		}
+		var status playControlStatus
+		if err := json.NewDecoder(response.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		if status.State != c.state || status.Speed != c.speed || status.OpsDispatched != 1 {
+			t.Errorf("expected %v at %vx with 1 op dispatched, got %+v", c.state, c.speed, status)
+		}
+	}
+	if ctx.Err() == nil {
+		t.Errorf("expected the playback to be aborted")
+	}
+}
+
+func TestPlayControlWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	speedFile := filepath.Join(dir, "speed")
+	if err := ioutil.WriteFile(speedFile, []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	control := newPlayControl(1, cancel)
+	go control.watch(ctx, speedFile)
+	// wait until the signals are handled
+	time.Sleep(100 * time.Millisecond)
+
+	// the speed changes once the file is modified
+	if err := ioutil.WriteFile(speedFile, []byte("3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(speedFile, later, later)
+	deadline := time.Now().Add(5 * time.Second)
+	for control.status().Speed != 3 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if speed := control.status().Speed; speed != 3 {
+		t.Errorf("expected the speed to change to 3, got %v", speed)
+	}
+
+	if pauseSignal == nil {
+		return
+	}
+	// the pause signal pauses, then resumes, the playback
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"paused", "playing"} {
+		if err := process.Signal(pauseSignal); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for control.status().State != expected && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if state := control.status().State; state != expected {
+			t.Errorf("expected the playback to be %v, got %v", expected, state)
+		}
+	}
+}
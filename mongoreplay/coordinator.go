@@ -0,0 +1,335 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CoordinateCommand stores settings for the mongoreplay 'coordinate'
+// subcommand. Its arguments are the play options the workers play their
+// segments with.
+type CoordinateCommand struct {
+	GlobalOpts *Options `no-flag:"true"`
+	StatOptions
+	PlaybackFile string `description:"path to the playback file to distribute" short:"p" long:"playback-file" required:"yes"`
+	Workers      string `long:"workers" value-name:"<host:port>[,<host:port>]" description:"comma-separated endpoints of the 'worker' processes the connections of the playback file are distributed to" required:"yes"`
+	StartDelay   int    `long:"startDelay" description:"number of seconds after the segments are sent at which the workers start playing them, together" default:"5"`
+	Collect      string `long:"collect" description:"Stat collection format for the stats of every worker: json, csv, prometheus, mongodb, sqlite or none, or format to use the --format string" default:"none"`
+	SecretFile   string `long:"secretFile" value-name:"<filename>" description:"file holding the secret sent with every request to the workers, shared with their --secretFile" required:"yes"`
+	Gzip         bool   `long:"gzip" description:"decompress gzipped input"`
+
+	workers     []string
+	playOptions workerPlayOptions
+	secret      string
+}
+
+// workerSummary sums up the stats a worker streamed.
+type workerSummary struct {
+	worker    string
+	ops       int64
+	errors    int64
+	latencies LatencyHistogram
+	err       error
+}
+
+// ValidateParams validates the settings described in the CoordinateCommand
+// struct.
+func (coordinate *CoordinateCommand) ValidateParams(args []string) error {
+	if coordinate.StartDelay < 0 {
+		return fmt.Errorf("Invalid setting for --startDelay: '%v', value must be >=0", coordinate.StartDelay)
+	}
+	coordinate.workers = nil
+	for _, worker := range strings.Split(coordinate.Workers, ",") {
+		if worker = strings.TrimSpace(worker); worker != "" {
+			coordinate.workers = append(coordinate.workers, worker)
+		}
+	}
+	if len(coordinate.workers) == 0 {
+		return fmt.Errorf("must specify the workers to distribute the playback to")
+	}
+	// the play options are checked before they are sent to the workers
+	var err error
+	if coordinate.playOptions, err = parseWorkerPlayOptions(args); err != nil {
+		return err
+	}
+	coordinate.secret, err = readSecretFile(coordinate.SecretFile)
+	return err
+}
+
+// Execute runs the program for the 'coordinate' subcommand
+func (coordinate *CoordinateCommand) Execute(args []string) error {
+	err := coordinate.ValidateParams(args)
+	if err != nil {
+		return err
+	}
+	coordinate.GlobalOpts.SetLogging()
+
+	playbackFileReader, err := NewPlaybackFileReader(coordinate.PlaybackFile, coordinate.Gzip)
+	if err != nil {
+		return err
+	}
+	statColl, err := NewStatCollector(coordinate.StatOptions, coordinate.Collect, true, true)
+	if err != nil {
+		return err
+	}
+	var recorder StatRecorder = &NopRecorder{}
+	if !statColl.noop {
+		recorder = statColl.StatRecorder
+	}
+
+	client := &http.Client{Transport: &workerTransport{secret: coordinate.secret}}
+	segments, err := distributeTape(client, playbackFileReader, coordinate.workers)
+	if err != nil {
+		return err
+	}
+	startAt := time.Now().Add(time.Duration(coordinate.StartDelay) * time.Second)
+	userInfoLogger.Logvf(Always, "Sent the segments of %v to %v workers, which start playing them at %v",
+		coordinate.PlaybackFile, len(segments), startAt.Format(time.RFC3339))
+
+	summaries := playSegments(client, coordinate.workers, segments, coordinate.playOptions, startAt, recorder)
+	if err := recorder.Close(); err != nil {
+		userInfoLogger.Logvf(Always, "Error closing stat recorder: %v", err)
+	}
+	return summarizeWorkers(summaries)
+}
+
+// workerTransport authenticates the requests to the workers with their
+// shared secret.
+type workerTransport struct {
+	secret string
+}
+
+func (transport *workerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+transport.secret)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// workerURL returns the URL of a path of a worker's endpoint.
+func workerURL(worker, path string) string {
+	if !strings.Contains(worker, "://") {
+		worker = "http://" + worker
+	}
+	return strings.TrimSuffix(worker, "/") + path
+}
+
+// workerResponseError returns the error of a response of a worker which
+// didn't succeed.
+func workerResponseError(worker string, response *http.Response) error {
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 4096))
+	return fmt.Errorf("worker %v responded with status %v: %s", worker, response.StatusCode, bytes.TrimSpace(message))
+}
+
+// distributeTape sends the ops of a playback file to the workers as one
+// segment each, the connections being dealt to the workers in the order
+// they are first seen, so that each connection is played whole by a single
+// worker. The segments are streamed as the playback file is read, and the
+// names the workers stored them under are returned.
+func distributeTape(client *http.Client, playbackFileReader *PlaybackFileReader, workers []string) ([]string, error) {
+	segments := make([]string, len(workers))
+	writers := make([]*PlaybackFileWriter, len(workers))
+	uploadErrs := make([]error, len(workers))
+	var uploads sync.WaitGroup
+	for i, worker := range workers {
+		pr, pw := io.Pipe()
+		uploads.Add(1)
+		go func(i int, worker string) {
+			defer uploads.Done()
+			err := func() error {
+				response, err := client.Post(workerURL(worker, "/segments"), "application/octet-stream", pr)
+				if err != nil {
+					return err
+				}
+				defer response.Body.Close()
+				if response.StatusCode != http.StatusOK {
+					return workerResponseError(worker, response)
+				}
+				var segment workerSegment
+				if err := json.NewDecoder(response.Body).Decode(&segment); err != nil {
+					return fmt.Errorf("invalid response of worker %v: %v", worker, err)
+				}
+				segments[i] = segment.Segment
+				return nil
+			}()
+			if err != nil {
+				uploadErrs[i] = fmt.Errorf("error sending segment to worker %v: %v", worker, err)
+				// the writes to the segment fail from now on
+				pr.CloseWithError(uploadErrs[i])
+			}
+		}(i, worker)
+		// the header is written once the upload reads from the pipe
+		writer, err := playbackFileWriterFromWriteCloser(pw, worker, playbackFileReader.metadata)
+		if err != nil {
+			pw.CloseWithError(err)
+			for _, writer := range writers[:i] {
+				writer.Close()
+			}
+			uploads.Wait()
+			return nil, err
+		}
+		writers[i] = writer
+	}
+
+	opChan, errChan := playbackFileReader.OpChan(1)
+	assigned := map[int64]int{}
+	var writeErr error
+	for op := range opChan {
+		if writeErr != nil {
+			continue
+		}
+		i, ok := assigned[op.SeenConnectionNum]
+		if !ok {
+			i = len(assigned) % len(workers)
+			assigned[op.SeenConnectionNum] = i
+		}
+		writeErr = writers[i].WriteRecordedOp(op)
+	}
+	if err := <-errChan; err != io.EOF && writeErr == nil {
+		writeErr = err
+	}
+	for _, writer := range writers {
+		writer.Close()
+	}
+	uploads.Wait()
+	for _, err := range uploadErrs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	userInfoLogger.Logvf(DebugLow, "Distributed %v connections to %v workers", len(assigned), len(workers))
+	return segments, nil
+}
+
+// playSegments has every worker play its segment at startAt, with the play
+// options given, recording the stats they stream with recorder.
+func playSegments(client *http.Client, workers, segments []string, options workerPlayOptions, startAt time.Time,
+	recorder StatRecorder) []*workerSummary {
+
+	summaries := make([]*workerSummary, len(workers))
+	stats := make(chan *OpStat, 1024)
+	var playing sync.WaitGroup
+	for i, worker := range workers {
+		summary := &workerSummary{worker: worker}
+		summaries[i] = summary
+		playing.Add(1)
+		go func(segment string, summary *workerSummary) {
+			defer playing.Done()
+			summary.err = playSegment(client, summary, workerPlayRequest{Segment: segment, Options: options, StartAt: startAt}, stats)
+		}(segments[i], summary)
+	}
+	go func() {
+		playing.Wait()
+		close(stats)
+	}()
+	// the stats of every worker are recorded by a single goroutine
+	for stat := range stats {
+		recorder.RecordStat(stat)
+	}
+	return summaries
+}
+
+// playSegment has a worker play a segment, summing up and forwarding the
+// stats it streams until it is done.
+func playSegment(client *http.Client, summary *workerSummary, request workerPlayRequest, stats chan<- *OpStat) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	response, err := client.Post(workerURL(summary.worker, "/play"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error playing segment on worker %v: %v", summary.worker, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return workerResponseError(summary.worker, response)
+	}
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), MaxMessageSize)
+	for scanner.Scan() {
+		var message workerMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			return fmt.Errorf("invalid stat streamed by worker %v: %v", summary.worker, err)
+		}
+		switch {
+		case message.Done && message.ThresholdExceeded:
+			return ErrThresholdExceeded{fmt.Sprintf("worker %v: %v", summary.worker, message.Error)}
+		case message.Done && message.Error != "":
+			return fmt.Errorf("worker %v failed: %v", summary.worker, message.Error)
+		case message.Done:
+			return nil
+		case message.Stat != nil:
+			stat := message.stat()
+			summary.ops++
+			if len(stat.Errors) > 0 {
+				summary.errors++
+			}
+			if stat.LatencyMicros > 0 {
+				summary.latencies.Record(stat.LatencyMicros)
+			}
+			stats <- stat
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading the stats of worker %v: %v", summary.worker, err)
+	}
+	return fmt.Errorf("worker %v stopped streaming stats before its playback was done", summary.worker)
+}
+
+// summarizeWorkers logs the ops played, errors and latencies of each worker
+// and of the whole playback, returning the error of the first worker which
+// failed, if any. A failed threshold is only returned if no worker failed
+// otherwise.
+func summarizeWorkers(summaries []*workerSummary) error {
+	total := &workerSummary{}
+	var failed, exceeded error
+	for _, summary := range summaries {
+		userInfoLogger.Logvf(Always, "Worker %v: %v", summary.worker, summary.describe())
+		total.ops += summary.ops
+		total.errors += summary.errors
+		total.latencies.Merge(&summary.latencies)
+		switch summary.err.(type) {
+		case nil:
+		case ErrThresholdExceeded:
+			if exceeded == nil {
+				exceeded = summary.err
+			}
+		default:
+			userInfoLogger.Logvf(Always, "%v", summary.err)
+			if failed == nil {
+				failed = summary.err
+			}
+		}
+	}
+	userInfoLogger.Logvf(Always, "Distributed playback on %v workers: %v", len(summaries), total.describe())
+	if failed != nil {
+		return failed
+	}
+	return exceeded
+}
+
+func (summary *workerSummary) describe() string {
+	if summary.latencies.Count() == 0 {
+		return fmt.Sprintf("%v ops played, %v with errors", summary.ops, summary.errors)
+	}
+	return fmt.Sprintf("%v ops played, %v with errors, latency p50 %.3fms p95 %.3fms p99 %.3fms max %.3fms",
+		summary.ops, summary.errors,
+		float64(summary.latencies.Percentile(50))/1000, float64(summary.latencies.Percentile(95))/1000,
+		float64(summary.latencies.Percentile(99))/1000, float64(summary.latencies.Max())/1000)
+}
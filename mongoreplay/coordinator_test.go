@@ -0,0 +1,168 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSecretFile writes the secret shared by a coordinator and its workers
+// to dir.
+func writeSecretFile(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "worker.secret")
+	if err := ioutil.WriteFile(path, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCoordinateParams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-coordinate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := writeSecretFile(t, dir)
+
+	type testCase struct {
+		name    string
+		workers string
+		args    []string
+		err     bool
+	}
+	cases := []testCase{
+		{name: "play options", workers: "a:9190, b:9190", args: []string{"--speed", "2", "--dryRun"}},
+		{name: "no workers", workers: " , ", err: true},
+		{name: "unknown play option", workers: "a:9190", args: []string{"--spede", "2"}, err: true},
+		{name: "playback file in the play options", workers: "a:9190", args: []string{"-p", "other.playback"}, err: true},
+		{name: "destructive commands", workers: "a:9190", args: []string{"--allowDestructive"}, err: true},
+		{name: "file written", workers: "a:9190", args: []string{"--reportHtml", "/etc/cron.d/x"}, err: true},
+		{name: "listener", workers: "a:9190", args: []string{"--controlAddr", "0.0.0.0:9191"}, err: true},
+		{name: "before command", workers: "a:9190", args: []string{"--before", "touch /tmp/x"}, err: true},
+		{name: "after command", workers: "a:9190", args: []string{"--after", "touch /tmp/x"}, err: true},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		coordinate := &CoordinateCommand{Workers: c.workers, SecretFile: secretFile}
+		err := coordinate.ValidateParams(c.args)
+		if (err != nil) != c.err {
+			t.Errorf("expected error %v, got %v", c.err, err)
+		}
+	}
+}
+
+func TestDistributedDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-coordinate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// six inserts on three connections, the first and third of which are
+	// played by the first worker
+	generator := newRecordedOpGenerator()
+	if err := generator.generateMsgOpInsertHelper("distributed", 0, 6); err != nil {
+		t.Fatal(err)
+	}
+	close(generator.opChan)
+	path := filepath.Join(dir, "tape.playback")
+	writer, err := NewPlaybackFileWriter(path, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var i int64
+	for op := range generator.opChan {
+		op.SeenConnectionNum = i % 3
+		i++
+		if err := writer.WriteRecordedOp(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close()
+
+	var workers []string
+	for i := 0; i < 2; i++ {
+		worker := &WorkerCommand{GlobalOpts: &Options{}, SegmentDir: dir, secret: "s3cret"}
+		server := httptest.NewServer(newReplayWorker(worker).handler())
+		defer server.Close()
+		workers = append(workers, server.URL)
+	}
+
+	reader, err := NewPlaybackFileReader(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &workerTransport{secret: "s3cret"}}
+	segments, err := distributeTape(client, reader, workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &BufferedStatRecorder{}
+	options, err := parseWorkerPlayOptions([]string{"--dryRun"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaries := playSegments(client, workers, segments, options, time.Now(), recorder)
+	for i, expected := range []int64{4, 2} {
+		if summaries[i].err != nil {
+			t.Errorf("worker %v failed: %v", i, summaries[i].err)
+		} else if summaries[i].ops != expected {
+			t.Errorf("expected worker %v to play %v ops, got %v", i, expected, summaries[i].ops)
+		}
+	}
+	if len(recorder.Buffer) != 6 {
+		t.Errorf("expected the stats of 6 ops, got %v", len(recorder.Buffer))
+	}
+
+	// the segments are removed once played
+	if err := playSegment(client, &workerSummary{worker: workers[0]}, workerPlayRequest{Segment: segments[0]}, nil); err == nil {
+		t.Errorf("expected an error playing a segment already played")
+	}
+}
+
+func TestWorkerRejectsRequests(t *testing.T) {
+	worker := &WorkerCommand{GlobalOpts: &Options{}, SegmentDir: os.TempDir(), secret: "s3cret"}
+	server := httptest.NewServer(newReplayWorker(worker).handler())
+	defer server.Close()
+
+	type testCase struct {
+		name   string
+		secret string
+		body   string
+		status int
+	}
+	cases := []testCase{
+		{name: "no secret", body: `{"segment": "s"}`, status: http.StatusUnauthorized},
+		{name: "wrong secret", secret: "guess", body: `{"segment": "s"}`, status: http.StatusUnauthorized},
+		{name: "play arguments", secret: "s3cret", body: `{"segment": "s", "args": ["--allowDestructive"]}`, status: http.StatusBadRequest},
+		{name: "option not allowed", secret: "s3cret", body: `{"segment": "s", "options": {"reportHtml": "/tmp/x"}}`, status: http.StatusBadRequest},
+		{name: "before command", secret: "s3cret", body: `{"segment": "s", "options": {"before": ["touch /tmp/x"]}}`, status: http.StatusBadRequest},
+		{name: "after command", secret: "s3cret", body: `{"segment": "s", "options": {"after": ["touch /tmp/x"]}}`, status: http.StatusBadRequest},
+		{name: "unknown segment", secret: "s3cret", body: `{"segment": "s", "options": {"dryRun": true}}`, status: http.StatusNotFound},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		client := &http.Client{Transport: &workerTransport{secret: c.secret}}
+		response, err := client.Post(server.URL+"/play", "application/json", bytes.NewReader([]byte(c.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != c.status {
+			t.Errorf("expected status %v, got %v: %s", c.status, response.StatusCode, strings.TrimSpace(string(message)))
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// killCursorsBatchSize is the number of cursors killed by each killCursors
+// command sent by --killCursors.
+const killCursorsBatchSize = 1000
+
+// openCursor is a live cursor opened by a replayed op, with the namespace it
+// iterates over and the session of the op which opened it, if it had one.
+type openCursor struct {
+	ns   string
+	lsid bson.D
+}
+
+// cursorLeaks tracks the live cursors opened by the replayed ops which the
+// playback file has not exhausted or killed, so that those left open once
+// playback finishes can be reported, and killed with --killCursors.
+type cursorLeaks struct {
+	sync.Mutex
+	cursors map[int64]openCursor
+}
+
+func newCursorLeaks() *cursorLeaks {
+	return &cursorLeaks{cursors: map[int64]openCursor{}}
+}
+
+// observe follows the cursors of an op played successfully and its reply:
+// a reply holding a cursor opens it, a getMore whose reply holds none
+// exhausts it, and a killCursors closes the cursors it names. The cursors of
+// op must have been rewritten to the live ones.
+func (leaks *cursorLeaks) observe(op Op, reply Replyable) {
+	if killCursors, ok := op.(*KillCursorsOp); ok {
+		leaks.Lock()
+		for _, cursorID := range killCursors.CursorIds {
+			delete(leaks.cursors, cursorID)
+		}
+		leaks.Unlock()
+		return
+	}
+	if reply == nil {
+		return
+	}
+	replyCursorID, err := reply.getCursorID()
+	if err != nil {
+		return
+	}
+	if _, cursorID, ok := getMoreCursor(op); ok {
+		if replyCursorID == 0 || replyCursorNotFound(reply) {
+			leaks.Lock()
+			delete(leaks.cursors, cursorID)
+			leaks.Unlock()
+		}
+		return
+	}
+	if replyCursorID == 0 {
+		return
+	}
+	cursor := openCursor{ns: namespaceOf(op), lsid: commandSession(op)}
+	leaks.Lock()
+	leaks.cursors[replyCursorID] = cursor
+	leaks.Unlock()
+}
+
+// merge adds the cursors left open by other.
+func (leaks *cursorLeaks) merge(other *cursorLeaks) {
+	other.Lock()
+	defer other.Unlock()
+	leaks.Lock()
+	defer leaks.Unlock()
+	for cursorID, cursor := range other.cursors {
+		leaks.cursors[cursorID] = cursor
+	}
+}
+
+// countsByNamespace returns the number of cursors left open on each
+// namespace.
+func (leaks *cursorLeaks) countsByNamespace() map[string]int {
+	leaks.Lock()
+	defer leaks.Unlock()
+	counts := map[string]int{}
+	for _, cursor := range leaks.cursors {
+		counts[cursor.ns]++
+	}
+	return counts
+}
+
+// formatCursorLeakTable lays out the counts of the cursors left open by
+// namespace, from the most to the fewest.
+func formatCursorLeakTable(counts map[string]int) string {
+	namespaces := make([]string, 0, len(counts))
+	for ns := range counts {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		if counts[namespaces[i]] != counts[namespaces[j]] {
+			return counts[namespaces[i]] > counts[namespaces[j]]
+		}
+		return namespaces[i] < namespaces[j]
+	})
+	out := &bytes.Buffer{}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "cursors\tns\t")
+	for _, ns := range namespaces {
+		fmt.Fprintf(w, "%v\t%v\t\n", counts[ns], ns)
+	}
+	w.Flush()
+	return out.String()
+}
+
+// logSummary logs the cursors left open by namespace.
+func (leaks *cursorLeaks) logSummary() {
+	counts := leaks.countsByNamespace()
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	if total == 0 {
+		return
+	}
+	userInfoLogger.Logvf(Always, "%v cursors opened by the playback were neither exhausted nor killed by the playback file:\n%v",
+		total, formatCursorLeakTable(counts))
+}
+
+// killBatch is the cursors left open on a namespace by a session, killed
+// together.
+type killBatch struct {
+	ns        string
+	lsid      bson.D
+	cursorIDs []int64
+}
+
+// batches groups the cursors left open by namespace and session, in
+// batches of at most killCursorsBatchSize cursors.
+func (leaks *cursorLeaks) batches() []*killBatch {
+	leaks.Lock()
+	defer leaks.Unlock()
+	byKey := map[string]*killBatch{}
+	var batches []*killBatch
+	cursorIDs := make([]int64, 0, len(leaks.cursors))
+	for cursorID := range leaks.cursors {
+		cursorIDs = append(cursorIDs, cursorID)
+	}
+	sort.Slice(cursorIDs, func(i, j int) bool { return cursorIDs[i] < cursorIDs[j] })
+	for _, cursorID := range cursorIDs {
+		cursor := leaks.cursors[cursorID]
+		key := fmt.Sprintf("%v %v", cursor.ns, cursor.lsid)
+		batch, ok := byKey[key]
+		if !ok || len(batch.cursorIDs) == killCursorsBatchSize {
+			batch = &killBatch{ns: cursor.ns, lsid: cursor.lsid}
+			byKey[key] = batch
+			batches = append(batches, batch)
+		}
+		batch.cursorIDs = append(batch.cursorIDs, cursorID)
+	}
+	return batches
+}
+
+// kill kills the cursors left open with killCursors commands sent on
+// session, in the sessions of the ops which opened them. It returns the
+// number of cursors the server reports as killed.
+func (leaks *cursorLeaks) kill(session *mgo.Session) (int, error) {
+	killed := 0
+	for _, batch := range leaks.batches() {
+		db, collection := batch.ns, ""
+		if i := strings.Index(batch.ns, "."); i >= 0 {
+			db, collection = batch.ns[:i], batch.ns[i+1:]
+		}
+		command := bson.D{{Name: "killCursors", Value: collection}, {Name: "cursors", Value: batch.cursorIDs}}
+		if batch.lsid != nil {
+			command = append(command, bson.DocElem{Name: "lsid", Value: batch.lsid})
+		}
+		var result struct {
+			CursorsKilled []int64 `bson:"cursorsKilled"`
+		}
+		if err := session.DB(db).Run(command, &result); err != nil {
+			return killed, fmt.Errorf("error killing %v cursors on %v: %v", len(batch.cursorIDs), batch.ns, err)
+		}
+		killed += len(result.CursorsKilled)
+		leaks.Lock()
+		for _, cursorID := range batch.cursorIDs {
+			delete(leaks.cursors, cursorID)
+		}
+		leaks.Unlock()
+	}
+	return killed, nil
+}
+
+// commandSession returns the lsid of a command, if it has one.
+func commandSession(op Op) bson.D {
+	var body interface{}
+	switch castOp := op.(type) {
+	case *QueryOp:
+		if !strings.HasSuffix(castOp.Collection, ".$cmd") {
+			return nil
+		}
+		body = castOp.Query
+	case *CommandOp:
+		body = castOp.CommandArgs
+	case *MsgOp:
+		payload, _, err := fetchPayload0Data(castOp.Sections)
+		if err != nil {
+			return nil
+		}
+		body = payload
+	default:
+		return nil
+	}
+	command, err := bsonToD(body)
+	if err != nil {
+		return nil
+	}
+	value, ok := FindValueByKey("lsid", &command)
+	if !ok {
+		return nil
+	}
+	lsid, err := bsonToD(value)
+	if err != nil {
+		return nil
+	}
+	return lsid
+}
@@ -0,0 +1,105 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"strings"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// msgOpWithDoc returns an OP_MSG command of the database db with doc as its
+// body.
+func msgOpWithDoc(t *testing.T, db string, doc bson.D) MsgOp {
+	raw, err := dToRaw(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return MsgOp{CommandName: doc[0].Name, Database: db,
+		MsgOp: mgo.MsgOp{Sections: []mgo.MsgSection{{PayloadType: mgo.MsgPayload0, Data: raw}}}}
+}
+
+func TestCursorLeaks(t *testing.T) {
+	lsid := bson.D{{"id", bson.Binary{Kind: 4, Data: []byte("0123456789abcdef")}}}
+	find := func(collection string) Op {
+		op := msgOpWithDoc(t, "test", bson.D{{"find", collection}, {"lsid", lsid}})
+		return &op
+	}
+	getMore := func(cursorID int64) Op {
+		return &MsgOpGetMore{MsgOp: msgOpWithDoc(t, "test", bson.D{{"getMore", cursorID}, {"collection", "c"}})}
+	}
+	cursorReply := func(cursorID int64) Replyable {
+		return msgOpReplyWith(t, bson.D{{"cursor", bson.D{{"id", cursorID}}}, {"ok", 1}})
+	}
+
+	leaks := newCursorLeaks()
+	leaks.observe(find("c"), cursorReply(1))
+	leaks.observe(find("c"), cursorReply(2))
+	leaks.observe(find("c"), cursorReply(3))
+	leaks.observe(find("d"), cursorReply(4))
+	// a query whose results fit in its first batch opens no cursor
+	leaks.observe(find("d"), cursorReply(0))
+	// a getMore which isn't the last leaves its cursor open
+	leaks.observe(getMore(1), cursorReply(1))
+	// the last getMore exhausts its cursor
+	leaks.observe(getMore(2), cursorReply(0))
+	// a getMore of a cursor not found closes it too
+	leaks.observe(getMore(4), msgOpReplyWith(t, bson.D{{"ok", 0}, {"errmsg", "cursor id 4 not found"}, {"code", 43}}))
+	// a legacy killCursors closes the cursors it names
+	leaks.observe(&KillCursorsOp{KillCursorsOp: mgo.KillCursorsOp{CursorIds: []int64{3}}}, nil)
+	leaks.observe(find("e"), cursorReply(5))
+
+	counts := leaks.countsByNamespace()
+	if len(counts) != 2 || counts["test.c"] != 1 || counts["test.e"] != 1 {
+		t.Errorf("expected a cursor left open on test.c and on test.e, got %v", counts)
+	}
+
+	other := newCursorLeaks()
+	other.observe(find("e"), cursorReply(6))
+	leaks.merge(other)
+	table := formatCursorLeakTable(leaks.countsByNamespace())
+	lines := strings.Split(strings.TrimSpace(table), "\n")
+	if len(lines) != 3 || strings.Join(strings.Fields(lines[1]), " ") != "2 test.e" ||
+		strings.Join(strings.Fields(lines[2]), " ") != "1 test.c" {
+		t.Errorf("unexpected table:\n%v", table)
+	}
+
+	batches := leaks.batches()
+	if len(batches) != 2 {
+		t.Fatalf("expected a batch for each namespace, got %v", len(batches))
+	}
+	for _, batch := range batches {
+		if len(batch.lsid) != 1 || batch.lsid[0].Name != "id" {
+			t.Errorf("expected the cursors to be killed in the session which opened them, got %v", batch.lsid)
+		}
+		switch batch.ns {
+		case "test.c":
+			if len(batch.cursorIDs) != 1 || batch.cursorIDs[0] != 1 {
+				t.Errorf("unexpected cursors of test.c: %v", batch.cursorIDs)
+			}
+		case "test.e":
+			if len(batch.cursorIDs) != 2 || batch.cursorIDs[0] != 5 || batch.cursorIDs[1] != 6 {
+				t.Errorf("unexpected cursors of test.e: %v", batch.cursorIDs)
+			}
+		default:
+			t.Errorf("unexpected namespace %v", batch.ns)
+		}
+	}
+}
+
+func TestCursorLeakBatches(t *testing.T) {
+	leaks := newCursorLeaks()
+	for i := int64(1); i <= killCursorsBatchSize+1; i++ {
+		leaks.cursors[i] = openCursor{ns: "test.c"}
+	}
+	batches := leaks.batches()
+	if len(batches) != 2 || len(batches[0].cursorIDs) != killCursorsBatchSize || len(batches[1].cursorIDs) != 1 {
+		t.Errorf("expected the cursors to be killed in batches of %v", killCursorsBatchSize)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	// cursorNotFoundError plays the getMores of cursors the server doesn't
+	// have, which fail like any other op.
+	cursorNotFoundError = "error"
+	// cursorNotFoundSkip doesn't play them, counting them instead.
+	cursorNotFoundSkip = "skip"
+	// cursorNotFoundReissue plays the query which created their cursor
+	// again, then plays them against the new cursor.
+	cursorNotFoundReissue = "reissue"
+	// cursorNotFoundAbort stops the playback with an error.
+	cursorNotFoundAbort = "abort"
+)
+
+// ErrGetMoreSkipped is returned when a getMore is not played because its
+// cursor was not found on the server and --cursorNotFound=skip was set.
+var ErrGetMoreSkipped = fmt.Errorf("getMore of a cursor not found on the server skipped")
+
+// cursorOriginTimeout is how long the op which created a cursor is kept to
+// be reissued, from its last use. It matches the default timeout of idle
+// cursors on the server.
+const cursorOriginTimeout = 600 * time.Second
+
+// cursorOrigin is the op which created a cursor of the playback file, kept
+// to be played again if its cursor is not found on the server.
+type cursorOrigin struct {
+	op Op
+	// reissuedCursorID is the live cursorID of the op once it has been
+	// played again, which replaces the one of the CursorIDMap.
+	reissuedCursorID int64
+	// reissuing is set while the op is being played again, and closed once
+	// it has been.
+	reissuing chan struct{}
+}
+
+// getMoreCursor returns whether op is a getMore, and the cursorID it
+// continues, which is that of the playback file until it is rewritten.
+func getMoreCursor(op Op) (cursorsRewriteable, int64, bool) {
+	if _, ok := op.(*KillCursorsOp); ok {
+		return nil, 0, false
+	}
+	getMore, ok := op.(cursorsRewriteable)
+	if !ok {
+		return nil, 0, false
+	}
+	cursorIDs, err := getMore.getCursorIDs()
+	if err != nil || len(cursorIDs) != 1 || cursorIDs[0] == 0 {
+		return nil, 0, false
+	}
+	return getMore, cursorIDs[0], true
+}
+
+// replyCursorNotFound returns whether the reply to a getMore reports that its
+// cursor was not found, either through the CursorNotFound flag of a legacy
+// reply or through the error of a command reply.
+func replyCursorNotFound(reply Replyable) bool {
+	if reply == nil {
+		return false
+	}
+	if legacy, ok := reply.(*ReplyOp); ok && legacy.Flags&1 != 0 {
+		return true
+	}
+	for _, err := range reply.getErrors() {
+		if classifyServerError(err) == ErrorClassCursorNotFound {
+			return true
+		}
+	}
+	return false
+}
+
+// setCursorOrigin keeps the op which created the cursor of the playback file
+// fileCursorID, for --cursorNotFound=reissue.
+func (context *ExecutionContext) setCursorOrigin(fileCursorID int64, op Op) {
+	if context.cursorOrigins == nil {
+		return
+	}
+	context.cursorOrigins.Set(strconv.FormatInt(fileCursorID, 10), &cursorOrigin{op: op}, cache.DefaultExpiration)
+}
+
+// reissuedCursor returns the live cursorID of the cursor of the playback file
+// fileCursorID, if its query was reissued.
+func (context *ExecutionContext) reissuedCursor(fileCursorID int64) (int64, bool) {
+	if context.cursorOrigins == nil {
+		return 0, false
+	}
+	context.cursorOriginsLock.Lock()
+	defer context.cursorOriginsLock.Unlock()
+	value, ok := context.cursorOrigins.Get(strconv.FormatInt(fileCursorID, 10))
+	if !ok || value.(*cursorOrigin).reissuedCursorID == 0 {
+		return 0, false
+	}
+	return value.(*cursorOrigin).reissuedCursorID, true
+}
+
+// sendGetMore sends a getMore like send, handling the cursor not being found
+// on the server as set by --cursorNotFound. A cursor is not found when the
+// server reports so, or, without sending the getMore, when the live query or
+// the previous getMores exhausted it while the recorded ones didn't.
+// Reissuing the query falls back to skipping the getMore when the query
+// isn't known, or doesn't return a cursor.
+func (context *ExecutionContext) sendGetMore(ctx context.Context, op Op, getMore cursorsRewriteable, fileCursorID int64, socket **mgo.MongoSocket) (Replyable, error) {
+	var reply Replyable
+	cursorIDs, err := getMore.getCursorIDs()
+	if err != nil || len(cursorIDs) != 1 || cursorIDs[0] != 0 {
+		reply, err = context.send(ctx, op, socket)
+		if err != nil || !replyCursorNotFound(reply) {
+			return reply, err
+		}
+	}
+	userInfoLogger.Logvf(DebugLow, "Cursor %v of the playback file not found on the server", fileCursorID)
+	switch context.cursorPolicy {
+	case cursorNotFoundAbort:
+		err := fmt.Errorf("cursor %v of the playback file not found on the server, aborting as set by --cursorNotFound", fileCursorID)
+		if context.abort != nil {
+			context.abort(err)
+		}
+		return reply, err
+	case cursorNotFoundReissue:
+		if liveCursorID, ok := context.reissue(ctx, fileCursorID, socket); ok {
+			if err := getMore.setCursorIDs([]int64{liveCursorID}); err != nil {
+				return nil, err
+			}
+			return context.send(ctx, op, socket)
+		}
+	}
+	atomic.AddInt64(&context.skippedGetMores, 1)
+	return nil, ErrGetMoreSkipped
+}
+
+// reissue plays the op which created the cursor of the playback file
+// fileCursorID again, returning the live cursorID it created, which the
+// rest of the getMores of the cursor are played against. A cursor is only
+// reissued once when its getMores fail on several connections at once: the
+// others wait for the reissue, without holding the lock of the
+// cursorOrigins, and continue the cursor it created.
+func (context *ExecutionContext) reissue(ctx context.Context, fileCursorID int64, socket **mgo.MongoSocket) (int64, bool) {
+	key := strconv.FormatInt(fileCursorID, 10)
+	context.cursorOriginsLock.Lock()
+	value, ok := context.cursorOrigins.Get(key)
+	if !ok {
+		context.cursorOriginsLock.Unlock()
+		userInfoLogger.Logvf(DebugLow, "No query to reissue for cursor %v of the playback file", fileCursorID)
+		return 0, false
+	}
+	origin := value.(*cursorOrigin)
+	if reissuing := origin.reissuing; reissuing != nil {
+		context.cursorOriginsLock.Unlock()
+		select {
+		case <-reissuing:
+		case <-ctx.Done():
+			return 0, false
+		}
+		return context.reissuedCursor(fileCursorID)
+	}
+	reissuing := make(chan struct{})
+	origin.reissuing = reissuing
+	op := origin.op
+	context.cursorOriginsLock.Unlock()
+
+	var liveCursorID int64
+	reply, err := context.send(ctx, op, socket)
+	if err != nil {
+		userInfoLogger.Logvf(DebugLow, "Error reissuing the query of cursor %v of the playback file: %v", fileCursorID, err)
+	} else if liveCursorID, err = reply.getCursorID(); err != nil {
+		liveCursorID = 0
+	}
+
+	context.cursorOriginsLock.Lock()
+	defer context.cursorOriginsLock.Unlock()
+	origin.reissuing = nil
+	close(reissuing)
+	if liveCursorID == 0 {
+		return 0, false
+	}
+	atomic.AddInt64(&context.reissuedQueries, 1)
+	origin.reissuedCursorID = liveCursorID
+	context.cursorOrigins.Set(key, origin, cache.DefaultExpiration)
+	return liveCursorID, true
+}
+
+// SkippedGetMores returns the number of getMores that were not played
+// because their cursor was not found on the server.
+func (context *ExecutionContext) SkippedGetMores() int64 {
+	return atomic.LoadInt64(&context.skippedGetMores)
+}
+
+// ReissuedQueries returns the number of queries that were played again
+// because their cursor was not found on the server.
+func (context *ExecutionContext) ReissuedQueries() int64 {
+	return atomic.LoadInt64(&context.reissuedQueries)
+}
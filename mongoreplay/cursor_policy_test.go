@@ -0,0 +1,188 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	gocontext "context"
+	"sync"
+	"testing"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestReplyCursorNotFound(t *testing.T) {
+	legacy := &ReplyOp{}
+	legacy.Flags = 1
+	type testCase struct {
+		name     string
+		reply    Replyable
+		notFound bool
+	}
+	cases := []testCase{
+		{name: "legacy reply flag", reply: legacy, notFound: true},
+		{name: "command error", reply: msgOpReplyWith(t, bson.D{{"ok", 0}, {"errmsg", "cursor id 12345 not found"}, {"code", 43}}), notFound: true},
+		{name: "other error", reply: msgOpReplyWith(t, bson.D{{"ok", 0}, {"errmsg", "not primary"}, {"code", 10107}})},
+		{name: "success", reply: msgOpReplyWith(t, bson.D{{"ok", 1}})},
+		{name: "no reply"},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		if notFound := replyCursorNotFound(c.reply); notFound != c.notFound {
+			t.Errorf("expected %v, got %v", c.notFound, notFound)
+		}
+	}
+}
+
+// cursorQuery is a query which creates the cursor cursorID.
+type cursorQuery struct {
+	MsgOp
+	cursorID   int64
+	executions int
+	t          *testing.T
+}
+
+func (op *cursorQuery) Execute(socket *mgo.MongoSocket) (Replyable, error) {
+	op.executions++
+	return msgOpReplyWith(op.t, bson.D{{"cursor", bson.D{{"id", op.cursorID}}}, {"ok", 1}}), nil
+}
+
+// cursorGetMore is a getMore which fails unless its cursor is one of live.
+type cursorGetMore struct {
+	MsgOp
+	cursorID   int64
+	live       map[int64]bool
+	executions int
+	t          *testing.T
+}
+
+func (op *cursorGetMore) getCursorIDs() ([]int64, error) {
+	return []int64{op.cursorID}, nil
+}
+
+func (op *cursorGetMore) setCursorIDs(cursorIDs []int64) error {
+	op.cursorID = cursorIDs[0]
+	return nil
+}
+
+func (op *cursorGetMore) Execute(socket *mgo.MongoSocket) (Replyable, error) {
+	op.executions++
+	if !op.live[op.cursorID] {
+		return msgOpReplyWith(op.t, bson.D{{"ok", 0}, {"errmsg", "cursor id not found"}, {"code", 43}}), nil
+	}
+	return msgOpReplyWith(op.t, bson.D{{"cursor", bson.D{{"id", op.cursorID}}}, {"ok", 1}}), nil
+}
+
+func TestSendGetMore(t *testing.T) {
+	type testCase struct {
+		name string
+		// policy is the --cursorNotFound setting, and liveCursorID the
+		// cursor the getMore is played against
+		policy       string
+		liveCursorID int64
+		origin       bool
+		err          error
+		executions   int
+		skipped      int64
+		reissued     int64
+		aborted      bool
+	}
+	cases := []testCase{
+		{name: "cursor found", policy: cursorNotFoundSkip, liveCursorID: 20, executions: 1},
+		{name: "skipped", policy: cursorNotFoundSkip, liveCursorID: 30, err: ErrGetMoreSkipped, executions: 1, skipped: 1},
+		{name: "exhausted cursor not sent", policy: cursorNotFoundSkip, liveCursorID: 0, err: ErrGetMoreSkipped, skipped: 1},
+		{name: "reissued", policy: cursorNotFoundReissue, liveCursorID: 30, origin: true, executions: 2, reissued: 1},
+		{name: "reissued exhausted cursor", policy: cursorNotFoundReissue, liveCursorID: 0, origin: true, executions: 1, reissued: 1},
+		{name: "no query to reissue", policy: cursorNotFoundReissue, liveCursorID: 30, err: ErrGetMoreSkipped, executions: 1, skipped: 1},
+		{name: "aborted", policy: cursorNotFoundAbort, liveCursorID: 30, executions: 1, aborted: true},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		context := NewExecutionContext(&StatCollector{noop: true}, nil, &ExecutionOptions{cursorPolicy: c.policy})
+		var aborted error
+		context.abort = func(err error) { aborted = err }
+		query := &cursorQuery{cursorID: 20, t: t}
+		if c.origin {
+			context.setCursorOrigin(10, query)
+		}
+		getMore := &cursorGetMore{cursorID: c.liveCursorID, live: map[int64]bool{20: true}, t: t}
+		var socket *mgo.MongoSocket
+		_, err := context.sendGetMore(gocontext.Background(), getMore, getMore, 10, &socket)
+		switch {
+		case c.aborted && (err == nil || aborted != err):
+			t.Errorf("expected the playback to be aborted with the error of the getMore, got %v and %v", aborted, err)
+		case !c.aborted && err != c.err:
+			t.Errorf("expected error %v, got %v", c.err, err)
+		}
+		if getMore.executions != c.executions || context.SkippedGetMores() != c.skipped || context.ReissuedQueries() != c.reissued {
+			t.Errorf("expected %v executions, %v skipped and %v reissued, got %v, %v and %v",
+				c.executions, c.skipped, c.reissued, getMore.executions, context.SkippedGetMores(), context.ReissuedQueries())
+		}
+		if c.reissued > 0 {
+			if liveCursorID, ok := context.reissuedCursor(10); !ok || liveCursorID != 20 {
+				t.Errorf("expected the cursor to be reissued as 20, got %v", liveCursorID)
+			}
+		}
+	}
+}
+
+// blockingCursorQuery is a cursorQuery whose executions start by closing
+// started, once, and wait until release is closed.
+type blockingCursorQuery struct {
+	cursorQuery
+	startOnce sync.Once
+	started   chan struct{}
+	release   chan struct{}
+}
+
+func (op *blockingCursorQuery) Execute(socket *mgo.MongoSocket) (Replyable, error) {
+	op.startOnce.Do(func() { close(op.started) })
+	<-op.release
+	return op.cursorQuery.Execute(socket)
+}
+
+func TestReissueConcurrently(t *testing.T) {
+	context := NewExecutionContext(&StatCollector{noop: true}, nil, &ExecutionOptions{cursorPolicy: cursorNotFoundReissue})
+	query := &blockingCursorQuery{cursorQuery: cursorQuery{cursorID: 20, t: t},
+		started: make(chan struct{}), release: make(chan struct{})}
+	context.setCursorOrigin(10, query)
+	reissued := make(chan int64, 2)
+	reissue := func() {
+		var socket *mgo.MongoSocket
+		liveCursorID, _ := context.reissue(gocontext.Background(), 10, &socket)
+		reissued <- liveCursorID
+	}
+	go reissue()
+	<-query.started
+
+	// the cursors can be looked up while the query is played
+	lookedUp := make(chan struct{})
+	go func() {
+		context.reissuedCursor(10)
+		close(lookedUp)
+	}()
+	select {
+	case <-lookedUp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the cursors not to be locked while the query is reissued")
+	}
+
+	// a reissue of the same cursor waits for the one in progress
+	go reissue()
+	time.Sleep(50 * time.Millisecond)
+	close(query.release)
+	for i := 0; i < 2; i++ {
+		if liveCursorID := <-reissued; liveCursorID != 20 {
+			t.Errorf("expected the cursor to be reissued as 20, got %v", liveCursorID)
+		}
+	}
+	if query.executions != 1 || context.ReissuedQueries() != 1 {
+		t.Errorf("expected the query to be reissued once, got %v executions and %v reissued",
+			query.executions, context.ReissuedQueries())
+	}
+}
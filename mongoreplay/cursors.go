@@ -71,6 +71,13 @@ type preprocessCursorManager struct {
 	cursorInfos map[int64]*preprocessCursorInfo
 	opToCursors map[opKey]int64
 	sync.RWMutex
+
+	// opCount is the number of ops preprocessed, not counting the ends of
+	// connections.
+	opCount int64
+
+	// opCodes counts the requests preprocessed by opcode.
+	opCodes map[OpCode]int64
 }
 
 // preprocessCursorInfo holds information about a cursor that was seen during
@@ -142,17 +149,43 @@ func (c *cursorsSeenMap) trackReplied(cursorID int64, op *RecordedOp) {
 // MarkFailed communicates to any waiting execution sessions that the op
 // associated with certain cursor has failed. It closes the failChan for that
 // op so that execution for any sessions waiting on that cursor could continue.
+// Cursors whose live cursorID has already been set are left alone, and it is
+// safe to mark the same op as failed more than once.
 func (p *preprocessCursorManager) MarkFailed(failedOp *RecordedOp) {
 	key := opKey{
 		driverEndpoint: failedOp.SrcEndpoint,
 		serverEndpoint: failedOp.DstEndpoint,
 		opID:           failedOp.Header.RequestID,
 	}
+	p.Lock()
+	defer p.Unlock()
 	if cursor, ok := p.opToCursors[key]; ok {
 		if cursorInfo, ok := p.cursorInfos[cursor]; ok {
-			close(cursorInfo.failChan)
+			select {
+			case <-cursorInfo.successChan:
+			case <-cursorInfo.failChan:
+			default:
+				close(cursorInfo.failChan)
+			}
+		}
+	}
+}
+
+// LiveCursors returns the mapping from the cursorIDs of the playback file to
+// the live cursorIDs seen so far during playback, for those cursors which
+// have uses left.
+func (p *preprocessCursorManager) LiveCursors() map[int64]int64 {
+	p.RLock()
+	defer p.RUnlock()
+	liveCursors := make(map[int64]int64)
+	for fileCursorID, cursorInfo := range p.cursorInfos {
+		select {
+		case <-cursorInfo.successChan:
+			liveCursors[fileCursorID] = cursorInfo.liveCursorID
+		default:
 		}
 	}
+	return liveCursors
 }
 
 // newPreprocessCursorManager generates a map of cursorIDs that were found when
@@ -166,14 +199,21 @@ func newPreprocessCursorManager(opChan <-chan *RecordedOp) (*preprocessCursorMan
 	result := preprocessCursorManager{
 		cursorInfos: make(map[int64]*preprocessCursorInfo),
 		opToCursors: make(map[opKey]int64),
+		opCodes:     make(map[OpCode]int64),
 	}
 
 	cursorsSeen := &cursorsSeenMap{}
 
 	// Loop over all the ops found in the file
 	for op := range opChan {
+		if !op.EOF {
+			result.opCount++
+		}
 
 		opCode := op.RawOp.Header.OpCode
+		if !op.EOF && op.RawOp.Header.ResponseTo == 0 {
+			result.opCodes[opCode]++
+		}
 		// If they don't produce a cursor, skip them
 		if opCode != OpCodeGetMore && opCode != OpCodeKillCursors &&
 			opCode != OpCodeReply && opCode != OpCodeCommandReply &&
@@ -0,0 +1,379 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// dashboardHistory is the number of seconds charted by the sparklines of
+	// the dashboard.
+	dashboardHistory = 120
+	// dashboardLogLines is the number of log lines kept while the dashboard
+	// is shown, which are written out once it is closed.
+	dashboardLogLines = 200
+	// dashboardLabelWidth is the width of the labels of the dashboard.
+	dashboardLabelWidth = 10
+)
+
+// sparklineLevels are the characters of the sparklines, from lowest to
+// highest.
+var sparklineLevels = []rune("▁▂▃▄▅▆▇█")
+
+// startTerminalDashboard, if the dashboard can be drawn on this platform,
+// takes over the terminal to draw the dashboard every time the events of the
+// playback tick, until the channel of events is closed. Pressing 'q' calls
+// stop. The returned channel is closed once the terminal is given back.
+var startTerminalDashboard func(dash *dashboard, events <-chan Event, stop func()) (<-chan struct{}, error)
+
+// dashboardOp holds the counts and latencies of the ops with the same name.
+type dashboardOp struct {
+	name      string
+	count     int64
+	errors    int64
+	recent    int64
+	rate      float64
+	latencies LatencyHistogram
+}
+
+// dashboardSample holds the rates, latencies and lag of a second of
+// playback, as charted by the sparklines.
+type dashboardSample struct {
+	opsPerSecond float64
+	p95Micros    int64
+	lagMicros    int64
+}
+
+// dashboard implements the StatRecorder interface, keeping the figures of a
+// playback shown by --tui as it runs: the ops played and their rate, the
+// errors, the open connections, how far behind the recorded timeline the ops
+// are played, and a breakdown by command, or op type for ops which are not
+// commands. It also implements io.Writer, keeping the last lines of the log
+// which is written to it while it is shown.
+type dashboard struct {
+	sync.Mutex
+	title    string
+	total    int64
+	stopping bool
+
+	progress   Progress
+	lastTickAt time.Time
+	lastOps    int64
+	ops        map[string]*dashboardOp
+	history    []dashboardSample
+
+	// the latencies and lags of the stats recorded since the last tick
+	latencies LatencyHistogram
+	lagMicros int64
+	maxLag    int64
+
+	logs        []string
+	droppedLogs int
+	partialLog  []byte
+}
+
+// newDashboard returns an empty dashboard headed by title.
+func newDashboard(title string) *dashboard {
+	return &dashboard{
+		title: title,
+		ops:   map[string]*dashboardOp{},
+	}
+}
+
+// RecordStat counts the stat's op and its latency.
+func (dash *dashboard) RecordStat(stat *OpStat) {
+	if stat == nil {
+		return
+	}
+	name := stat.Command
+	if name == "" {
+		name = stat.OpType
+	}
+	dash.Lock()
+	defer dash.Unlock()
+	op, ok := dash.ops[name]
+	if !ok {
+		op = &dashboardOp{name: name}
+		dash.ops[name] = op
+	}
+	op.count++
+	op.recent++
+	if len(stat.Errors) > 0 {
+		op.errors++
+	}
+	if stat.LatencyMicros > 0 {
+		op.latencies.Record(stat.LatencyMicros)
+		dash.latencies.Record(stat.LatencyMicros)
+	}
+	if stat.PlaybackLagMicros > dash.lagMicros {
+		dash.lagMicros = stat.PlaybackLagMicros
+	}
+	if stat.PlaybackLagMicros > dash.maxLag {
+		dash.maxLag = stat.PlaybackLagMicros
+	}
+}
+
+// Close implements the StatRecorder interface; the dashboard is closed with
+// the terminal it is drawn on.
+func (dash *dashboard) Close() error {
+	return nil
+}
+
+// tick adds a sample of the second of playback ending at now, which has
+// reached progress.
+func (dash *dashboard) tick(progress *Progress, now time.Time) {
+	dash.Lock()
+	defer dash.Unlock()
+	if dash.lastTickAt.IsZero() {
+		dash.lastTickAt = now.Add(-progress.Elapsed)
+	}
+	interval := now.Sub(dash.lastTickAt).Seconds()
+	if interval <= 0 {
+		return
+	}
+	dash.history = append(dash.history, dashboardSample{
+		opsPerSecond: float64(progress.OpsCompleted-dash.lastOps) / interval,
+		p95Micros:    dash.latencies.Percentile(95),
+		lagMicros:    dash.lagMicros,
+	})
+	if len(dash.history) > dashboardHistory {
+		dash.history = dash.history[len(dash.history)-dashboardHistory:]
+	}
+	for _, op := range dash.ops {
+		op.rate = float64(op.recent) / interval
+		op.recent = 0
+	}
+	dash.progress = *progress
+	dash.lastTickAt = now
+	dash.lastOps = progress.OpsCompleted
+	dash.latencies = LatencyHistogram{}
+	dash.lagMicros = 0
+}
+
+// show draws the dashboard of the playback of the context, which plays total
+// ops, or an unknown number if total is 0, on the terminal. It must be called
+// before playback starts. The returned channel is closed once playback
+// finishes and the terminal is given back.
+func (dash *dashboard) show(context *ExecutionContext, total int64, stop func()) (<-chan struct{}, error) {
+	dash.Lock()
+	dash.total = total
+	dash.Unlock()
+	return startTerminalDashboard(dash, context.Events(10000), stop)
+}
+
+// run ticks the dashboard with the progress of the events, calling draw
+// after each tick, until the channel of events is closed.
+func (dash *dashboard) run(events <-chan Event, draw func()) {
+	for event := range events {
+		if event.Type == ProgressTick && event.Progress != nil {
+			dash.tick(event.Progress, event.Time)
+			draw()
+		}
+	}
+}
+
+// stop marks the playback as being stopped.
+func (dash *dashboard) stop() {
+	dash.Lock()
+	defer dash.Unlock()
+	dash.stopping = true
+}
+
+// Write keeps the lines of the log written to the dashboard.
+func (dash *dashboard) Write(p []byte) (int, error) {
+	dash.Lock()
+	defer dash.Unlock()
+	data := append(dash.partialLog, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		dash.logs = append(dash.logs, string(data[:i]))
+		data = data[i+1:]
+	}
+	dash.partialLog = append([]byte(nil), data...)
+	if len(dash.logs) > dashboardLogLines {
+		dash.droppedLogs += len(dash.logs) - dashboardLogLines
+		dash.logs = append([]string(nil), dash.logs[len(dash.logs)-dashboardLogLines:]...)
+	}
+	return len(p), nil
+}
+
+// keptLogs returns the log lines kept while the dashboard was shown, and the
+// number of earlier lines which were not.
+func (dash *dashboard) keptLogs() ([]string, int) {
+	dash.Lock()
+	defer dash.Unlock()
+	logs := dash.logs
+	if len(dash.partialLog) > 0 {
+		logs = append(logs, string(dash.partialLog))
+	}
+	return logs, dash.droppedLogs
+}
+
+// lines lays out the dashboard in lines of at most width characters, filling
+// at most height lines. The breakdown by op is cut short, and the log is
+// shown in the lines left over.
+func (dash *dashboard) lines(width, height int) []string {
+	dash.Lock()
+	defer dash.Unlock()
+
+	var lines []string
+	add := func(format string, a ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, a...))
+	}
+	label := func(name string) string {
+		return fmt.Sprintf("%-*v", dashboardLabelWidth, name)
+	}
+
+	state := "playing"
+	if dash.stopping {
+		state = "stopping"
+	}
+	add("%v  elapsed %v  %v", dash.title, dash.progress.Elapsed.Round(time.Second), state)
+	add("")
+
+	var rate float64
+	if len(dash.history) > 0 {
+		rate = dash.history[len(dash.history)-1].opsPerSecond
+	}
+	played := fmt.Sprintf("%v", dash.progress.OpsCompleted)
+	if dash.total > 0 {
+		fraction := float64(dash.progress.OpsCompleted) / float64(dash.total)
+		if fraction > 1 {
+			fraction = 1
+		}
+		played = fmt.Sprintf("%v %v/%v (%.1f%%)", drawProgressBar(fraction), dash.progress.OpsCompleted, dash.total, fraction*100)
+	}
+	add("%v%v  %.1f ops/s", label("ops"), played, rate)
+	errorRate := 0.0
+	if dash.progress.OpsCompleted > 0 {
+		errorRate = float64(dash.progress.Errors) / float64(dash.progress.OpsCompleted) * 100
+	}
+	add("%v%v (%.2f%%)", label("errors"), dash.progress.Errors, errorRate)
+	add("%v%v open", label("conns"), dash.progress.OpenConnections)
+	var lag int64
+	if len(dash.history) > 0 {
+		lag = dash.history[len(dash.history)-1].lagMicros
+	}
+	add("%v%v ms behind the recorded timeline, at most %v ms", label("lag"), formatMillis(lag), formatMillis(dash.maxLag))
+	add("")
+
+	chartWidth := width - dashboardLabelWidth - 20
+	if chartWidth < 10 {
+		chartWidth = 10
+	}
+	charts := []struct {
+		name  string
+		value func(sample dashboardSample) float64
+		unit  string
+	}{
+		{"ops/s", func(sample dashboardSample) float64 { return sample.opsPerSecond }, "ops/s"},
+		{"p95", func(sample dashboardSample) float64 { return float64(sample.p95Micros) / 1000 }, "ms"},
+		{"lag", func(sample dashboardSample) float64 { return float64(sample.lagMicros) / 1000 }, "ms"},
+	}
+	for _, chart := range charts {
+		values := make([]float64, len(dash.history))
+		for i, sample := range dash.history {
+			values[i] = chart.value(sample)
+		}
+		line, max := sparkline(values, chartWidth)
+		add("%v%v  max %.1f %v", label(chart.name), line, max, chart.unit)
+	}
+	add("")
+
+	ops := make([]*dashboardOp, 0, len(dash.ops))
+	for _, op := range dash.ops {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].count != ops[j].count {
+			return ops[i].count > ops[j].count
+		}
+		return ops[i].name < ops[j].name
+	})
+	tableFormat := "%-20v %10v %10v %8v %10v %10v %10v"
+	add(tableFormat, "op", "count", "ops/s", "errors", "p50 ms", "p95 ms", "p99 ms")
+	// the ops take the lines left, but for a blank line and the footer
+	rows := height - len(lines) - 2
+	for i, op := range ops {
+		if i == rows-1 && len(ops) > rows {
+			add("... %v more", len(ops)-i)
+			break
+		}
+		if i >= rows {
+			break
+		}
+		add(tableFormat, op.name, op.count, fmt.Sprintf("%.1f", op.rate), op.errors,
+			formatMillis(op.latencies.Percentile(50)), formatMillis(op.latencies.Percentile(95)),
+			formatMillis(op.latencies.Percentile(99)))
+	}
+	add("")
+
+	if logLines := height - len(lines) - 1; logLines > 0 && len(dash.logs) > 0 {
+		logs := dash.logs
+		if len(logs) > logLines {
+			logs = logs[len(logs)-logLines:]
+		}
+		lines = append(lines, logs...)
+	}
+	for len(lines) < height-1 {
+		add("")
+	}
+	add("q: stop playback")
+
+	for i, line := range lines {
+		lines[i] = truncateLine(line, width)
+	}
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+	return lines
+}
+
+// sparkline charts the last width values, scaled to the highest of them,
+// which it returns along with the chart.
+func sparkline(values []float64, width int) (string, float64) {
+	if len(values) > width {
+		values = values[len(values)-width:]
+	}
+	max := 0.0
+	for _, value := range values {
+		if value > max {
+			max = value
+		}
+	}
+	chart := make([]rune, 0, width)
+	for _, value := range values {
+		if max <= 0 || value <= 0 {
+			chart = append(chart, ' ')
+			continue
+		}
+		level := int(value / max * float64(len(sparklineLevels)))
+		if level >= len(sparklineLevels) {
+			level = len(sparklineLevels) - 1
+		}
+		chart = append(chart, sparklineLevels[level])
+	}
+	return string(chart) + strings.Repeat(" ", width-len(chart)), max
+}
+
+// truncateLine cuts line down to width characters.
+func truncateLine(line string, width int) string {
+	if width < 0 || utf8.RuneCountInString(line) <= width {
+		return line
+	}
+	return string([]rune(line)[:width])
+}
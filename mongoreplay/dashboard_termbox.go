@@ -0,0 +1,89 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+// +build !solaris
+
+package mongoreplay
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/nsf/termbox-go"
+)
+
+func init() {
+	startTerminalDashboard = startTermboxDashboard
+}
+
+// startTermboxDashboard draws the dashboard with termbox, capturing the log
+// while it is shown so that it doesn't scroll the dashboard away.
+func startTermboxDashboard(dash *dashboard, events <-chan Event, stop func()) (<-chan struct{}, error) {
+	if err := termbox.Init(); err != nil {
+		return nil, fmt.Errorf("error setting up the terminal dashboard: %v", err)
+	}
+	termbox.HideCursor()
+	logger.SetOutput(dash)
+
+	var drawLock sync.Mutex
+	draw := func() {
+		drawLock.Lock()
+		defer drawLock.Unlock()
+		termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
+		width, height := termbox.Size()
+		for y, line := range dash.lines(width, height) {
+			fg := termbox.ColorDefault
+			if y == 0 {
+				fg |= termbox.AttrBold
+			}
+			x := 0
+			for _, ch := range line {
+				termbox.SetCell(x, y, ch, fg, termbox.ColorDefault)
+				x++
+			}
+		}
+		termbox.Flush()
+	}
+
+	keysDone := make(chan struct{})
+	go func() {
+		defer close(keysDone)
+		for {
+			ev := termbox.PollEvent()
+			switch {
+			case ev.Type == termbox.EventInterrupt:
+				return
+			case ev.Type == termbox.EventResize:
+				draw()
+			case ev.Type == termbox.EventKey && (ev.Ch == 'q' || ev.Key == termbox.KeyCtrlC || ev.Key == termbox.KeyEsc):
+				dash.stop()
+				draw()
+				stop()
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		draw()
+		dash.run(events, draw)
+		termbox.Interrupt()
+		<-keysDone
+		termbox.Close()
+		logger.SetOutput(os.Stderr)
+
+		logs, dropped := dash.keptLogs()
+		if dropped > 0 {
+			userInfoLogger.Logvf(Always, "The first %v lines of the log written while the dashboard was shown were not kept", dropped)
+		}
+		for _, line := range logs {
+			fmt.Fprintln(os.Stderr, line)
+		}
+	}()
+	return done, nil
+}
@@ -0,0 +1,108 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSparkline(t *testing.T) {
+	type testCase struct {
+		name     string
+		values   []float64
+		width    int
+		expected string
+		max      float64
+	}
+	cases := []testCase{
+		{"empty", nil, 4, "    ", 0},
+		{"levels", []float64{0, 1, 4, 8}, 4, " ▂▅█", 8},
+		{"last values", []float64{100, 1, 2}, 2, "▅█", 2},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		chart, max := sparkline(c.values, c.width)
+		if chart != c.expected || max != c.max {
+			t.Errorf("expected %q with max %v, got %q with max %v", c.expected, c.max, chart, max)
+		}
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	dash := newDashboard("mongoreplay play test.playback")
+	dash.total = 200
+	start := time.Now()
+	dash.tick(&Progress{}, start)
+	for i := 0; i < 100; i++ {
+		stat := &OpStat{OpType: "op_msg", Command: "find", LatencyMicros: 2000, PlaybackLagMicros: 3000}
+		if i%2 == 1 {
+			stat.Command = "insert"
+			stat.LatencyMicros = 5000
+		}
+		if i < 3 {
+			stat.Errors = []error{fmt.Errorf("failed")}
+		}
+		dash.RecordStat(stat)
+	}
+	dash.RecordStat(&OpStat{OpType: "op_query"})
+	dash.tick(&Progress{OpsCompleted: 101, Errors: 3, OpenConnections: 4, Elapsed: 2 * time.Second}, start.Add(2*time.Second))
+	fmt.Fprintf(dash, "first line\nsecond ")
+	fmt.Fprintf(dash, "line\n")
+
+	lines := dash.lines(100, 30)
+	if len(lines) != 30 {
+		t.Fatalf("expected 30 lines, got %v", len(lines))
+	}
+	text := strings.Join(lines, "\n")
+	t.Log(text)
+	for _, expected := range []string{
+		"mongoreplay play test.playback  elapsed 2s  playing",
+		"101/200 (50.5%)  50.5 ops/s",
+		"errors    3 (2.97%)",
+		"conns     4 open",
+		"lag       3.000 ms behind the recorded timeline, at most 3.000 ms",
+		"find                         50       25.0        2      2.000      2.000      2.000",
+		"insert                       50       25.0        1      5.000      5.000      5.000",
+		"op_query                      1        0.5        0      0.000      0.000      0.000",
+		"first line\nsecond line",
+		"q: stop playback",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("expected the dashboard to contain %q", expected)
+		}
+	}
+	for _, line := range lines {
+		if utf8.RuneCountInString(line) > 100 {
+			t.Errorf("expected lines of at most 100 characters, got %q", line)
+		}
+	}
+
+	t.Log("Laying out the dashboard in too few lines for every op")
+	lines = dash.lines(100, 16)
+	if len(lines) != 16 || !strings.Contains(strings.Join(lines, "\n"), "... 2 more") {
+		t.Errorf("expected 16 lines, leaving out 2 ops, got %q", lines)
+	}
+}
+
+func TestDashboardLogs(t *testing.T) {
+	dash := newDashboard("")
+	for i := 0; i < dashboardLogLines+10; i++ {
+		fmt.Fprintf(dash, "line %v\n", i)
+	}
+	fmt.Fprintf(dash, "partial")
+	logs, dropped := dash.keptLogs()
+	if dropped != 10 || len(logs) != dashboardLogLines+1 {
+		t.Fatalf("expected %v lines kept and 10 dropped, got %v and %v", dashboardLogLines+1, len(logs), dropped)
+	}
+	if logs[0] != "line 10" || logs[len(logs)-1] != "partial" {
+		t.Errorf("expected the last lines to be kept, got %q to %q", logs[0], logs[len(logs)-1])
+	}
+}
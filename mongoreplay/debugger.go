@@ -0,0 +1,225 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// debuggerOpChars is the number of characters an op or reply is abbreviated
+// to when the debugger stops at it, unless printed in full.
+const debuggerOpChars = 2048
+
+// errSkippedByDebugger vetoes the ops skipped from the debugger.
+var errSkippedByDebugger = fmt.Errorf("op skipped from the debugger")
+
+const debuggerHelp = `Commands:
+  s, step      play the op and stop at the next one
+  c, continue  play the op and stop at the next breakpoint
+  k, skip      don't play the op and stop at the next one
+  p, print     print the op in full
+  q, quit      stop playing ops, as if interrupted
+  h, help      print this help
+An empty line steps.`
+
+// breakpoint is a --break condition, matching the ops the playback stops at:
+// 'op:<n>', the op of order n, 'ns:<pattern>', the ops on the namespaces
+// matching the pattern, such as 'test.*', or 'command:<name>', the commands
+// of the given name.
+type breakpoint struct {
+	spec    string
+	order   *int64
+	ns      string
+	command string
+}
+
+func parseBreakpoint(spec string) (*breakpoint, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("'%v' is neither 'op:<n>', 'ns:<pattern>' nor 'command:<name>'", spec)
+	}
+	bp := &breakpoint{spec: spec}
+	switch parts[0] {
+	case "op":
+		order, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || order < 0 {
+			return nil, fmt.Errorf("invalid op order '%v'", parts[1])
+		}
+		bp.order = &order
+	case "ns":
+		if _, err := path.Match(parts[1], ""); err != nil {
+			return nil, fmt.Errorf("invalid namespace pattern '%v': %v", parts[1], err)
+		}
+		bp.ns = parts[1]
+	case "command":
+		bp.command = parts[1]
+	default:
+		return nil, fmt.Errorf("'%v' is neither 'op:<n>', 'ns:<pattern>' nor 'command:<name>'", spec)
+	}
+	return bp, nil
+}
+
+// matches returns whether the playback stops before op.
+func (bp *breakpoint) matches(op *RecordedOp, parsedOp Op) bool {
+	switch {
+	case bp.order != nil:
+		return op.Order == *bp.order
+	case bp.ns != "":
+		matched, _ := path.Match(bp.ns, namespaceOf(parsedOp))
+		return matched
+	default:
+		return commandNameOf(parsedOp) == bp.command
+	}
+}
+
+// debugger implements the PreOpHook and PostOpHook interfaces, stopping the
+// playback before the ops matching its breakpoints, or before every op when
+// stepping. It prints the op stopped at and reads what to do with it from
+// its input, keeping the playback clock paused meanwhile, so that no other
+// op is played until the op is stepped over, continued from or skipped.
+// Once an op stopped at is played, the reply or error it got is printed.
+type debugger struct {
+	in          *bufio.Reader
+	out         io.Writer
+	breakpoints []*breakpoint
+	// clock, when set, is paused while the debugger is stopped.
+	clock *playbackClock
+	// quit stops the playback.
+	quit func()
+
+	sync.Mutex
+	stepping bool
+	// stopped holds the ops stopped at which are being played, whose reply
+	// is printed.
+	stopped map[*RecordedOp]bool
+	// done is set once the input is exhausted or the playback quit, after
+	// which the debugger no longer stops.
+	done bool
+}
+
+func newDebugger(in io.Reader, out io.Writer, breakpoints []*breakpoint, step bool) *debugger {
+	return &debugger{
+		in:          bufio.NewReader(in),
+		out:         out,
+		breakpoints: breakpoints,
+		stepping:    step,
+		stopped:     map[*RecordedOp]bool{},
+	}
+}
+
+func (debugger *debugger) BeforeOp(op *RecordedOp, parsedOp Op) error {
+	debugger.Lock()
+	defer debugger.Unlock()
+	if debugger.done {
+		return nil
+	}
+	reason := ""
+	if debugger.stepping {
+		reason = "step"
+	} else {
+		for _, bp := range debugger.breakpoints {
+			if bp.matches(op, parsedOp) {
+				reason = "breakpoint " + bp.spec
+				break
+			}
+		}
+	}
+	if reason == "" {
+		return nil
+	}
+	if debugger.clock != nil && debugger.clock.pause() {
+		defer debugger.clock.resume()
+	}
+	debugger.printOp(op, parsedOp, reason)
+	for {
+		fmt.Fprint(debugger.out, "(mongoreplay) ")
+		line, err := debugger.in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(debugger.out, "\nNo more input; playing on without stopping")
+			debugger.done = true
+			return nil
+		}
+		switch strings.TrimSpace(line) {
+		case "", "s", "step":
+			debugger.stepping = true
+			debugger.stopped[op] = true
+			return nil
+		case "c", "continue":
+			debugger.stepping = false
+			debugger.stopped[op] = true
+			return nil
+		case "k", "skip":
+			debugger.stepping = true
+			return errSkippedByDebugger
+		case "p", "print":
+			fmt.Fprintln(debugger.out, describeDebuggedOp(parsedOp, math.MaxInt32))
+		case "q", "quit":
+			debugger.done = true
+			if debugger.quit != nil {
+				debugger.quit()
+			}
+			return errSkippedByDebugger
+		case "h", "help", "?":
+			fmt.Fprintln(debugger.out, debuggerHelp)
+		default:
+			fmt.Fprintf(debugger.out, "Unknown command '%v'; type 'help' for the commands\n", strings.TrimSpace(line))
+		}
+	}
+}
+
+func (debugger *debugger) AfterOp(op *RecordedOp, parsedOp Op, reply Replyable, err error) {
+	debugger.Lock()
+	defer debugger.Unlock()
+	if !debugger.stopped[op] {
+		return
+	}
+	delete(debugger.stopped, op)
+	switch {
+	case err != nil:
+		fmt.Fprintf(debugger.out, "Op %v failed: %v\n", op.Order, err)
+	case reply == nil:
+		fmt.Fprintf(debugger.out, "Op %v played, without a reply\n", op.Order)
+	default:
+		fmt.Fprintf(debugger.out, "Op %v played in %vµs, returning %v documents\n",
+			op.Order, reply.getLatencyMicros(), reply.getNumReturned())
+		for _, replyErr := range reply.getErrors() {
+			fmt.Fprintf(debugger.out, "  error: %v\n", replyErr)
+		}
+		if abbreviated, ok := reply.(interface{ Abbreviated(int) string }); ok {
+			fmt.Fprintf(debugger.out, "  %v\n", abbreviated.Abbreviated(debuggerOpChars))
+		}
+	}
+}
+
+// printOp prints the op the debugger stopped at.
+func (debugger *debugger) printOp(op *RecordedOp, parsedOp Op, reason string) {
+	fmt.Fprintf(debugger.out, "Stopped at op %v of connection %v (%v)", op.Order, op.SeenConnectionNum, reason)
+	if op.Seen != nil {
+		fmt.Fprintf(debugger.out, ", recorded at %v", op.Seen.Format("2006-01-02T15:04:05.000Z07:00"))
+	}
+	fmt.Fprintln(debugger.out, ":")
+	if name := commandNameOf(parsedOp); name != "" {
+		fmt.Fprintf(debugger.out, "  %v on %v\n", name, namespaceOf(parsedOp))
+	} else if ns := namespaceOf(parsedOp); ns != "" {
+		fmt.Fprintf(debugger.out, "  %v on %v\n", op.RawOp.Header.OpCode, ns)
+	}
+	fmt.Fprintf(debugger.out, "  %v\n", describeDebuggedOp(parsedOp, debuggerOpChars))
+}
+
+func describeDebuggedOp(parsedOp Op, chars int) string {
+	if parsedOp == nil {
+		return "(unparsed op)"
+	}
+	return parsedOp.Abbreviated(chars)
+}
@@ -0,0 +1,112 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestBreakpointMatches(t *testing.T) {
+	type testCase struct {
+		name    string
+		spec    string
+		order   int64
+		doc     bson.D
+		matches bool
+		err     string
+	}
+	cases := []testCase{
+		{name: "op order", spec: "op:7", order: 7, doc: bson.D{{"find", "c"}}, matches: true},
+		{name: "other op order", spec: "op:7", order: 8, doc: bson.D{{"find", "c"}}},
+		{name: "namespace", spec: "ns:test.c", doc: bson.D{{"find", "c"}}, matches: true},
+		{name: "namespace pattern", spec: "ns:test.*", doc: bson.D{{"insert", "other"}}, matches: true},
+		{name: "other namespace", spec: "ns:test.c", doc: bson.D{{"find", "other"}}},
+		{name: "command", spec: "command:aggregate", doc: bson.D{{"aggregate", "c"}}, matches: true},
+		{name: "other command", spec: "command:aggregate", doc: bson.D{{"find", "c"}}},
+		{name: "unknown kind", spec: "collection:c", err: "is neither"},
+		{name: "empty", spec: "ns:", err: "is neither"},
+		{name: "invalid op", spec: "op:x", err: "invalid op order"},
+		{name: "invalid pattern", spec: "ns:test.[", err: "invalid namespace pattern"},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		bp, err := parseBreakpoint(c.spec)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("expected an error containing %q, got %v", c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		op := msgOpWithDoc(t, "test", c.doc)
+		if matches := bp.matches(&RecordedOp{Order: c.order}, &op); matches != c.matches {
+			t.Errorf("expected %v to match: %v, got %v", c.spec, c.matches, matches)
+		}
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	bp, err := parseBreakpoint("command:aggregate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	// continue from the first breakpoint, print and step over the second,
+	// then skip the op after it and step over the next
+	input := "c\np\n\nk\nbogus\ns\n"
+	debug := newDebugger(strings.NewReader(input), out, []*breakpoint{bp}, false)
+	debug.clock = newPlaybackClock()
+	var skipped []int64
+	play := func(order int64, doc bson.D) {
+		op := msgOpWithDoc(t, "test", doc)
+		recordedOp := &RecordedOp{Order: order}
+		if err := debug.BeforeOp(recordedOp, &op); err != nil {
+			skipped = append(skipped, order)
+			return
+		}
+		debug.AfterOp(recordedOp, &op, msgOpReplyWith(t, bson.D{{"ok", 1}}), nil)
+	}
+	play(1, bson.D{{"find", "c"}})
+	play(2, bson.D{{"aggregate", "c"}})
+	play(3, bson.D{{"find", "c"}})
+	play(4, bson.D{{"aggregate", "c"}})
+	play(5, bson.D{{"insert", "c"}})
+	play(6, bson.D{{"delete", "c"}})
+	// the input is exhausted at the op after it, and the rest are played on
+	play(7, bson.D{{"update", "c"}})
+	play(8, bson.D{{"aggregate", "c"}})
+
+	output := out.String()
+	for _, stop := range []string{"op 2 of connection 0 (breakpoint command:aggregate)", "op 4 of connection 0 (breakpoint command:aggregate)",
+		"op 5 of connection 0 (step)", "op 6 of connection 0 (step)", "op 7 of connection 0 (step)"} {
+		if !strings.Contains(output, "Stopped at "+stop) {
+			t.Errorf("expected to stop at %v, got:\n%v", stop, output)
+		}
+	}
+	if strings.Contains(output, "Stopped at op 3") || strings.Contains(output, "Stopped at op 8") {
+		t.Errorf("expected not to stop at ops 3 and 8, got:\n%v", output)
+	}
+	if len(skipped) != 1 || skipped[0] != 5 {
+		t.Errorf("expected op 5 to be skipped, got %v", skipped)
+	}
+	if !strings.Contains(output, "Op 4 played in") || strings.Contains(output, "Op 5 played") {
+		t.Errorf("expected the replies of the ops stepped over, got:\n%v", output)
+	}
+	if !strings.Contains(output, "Unknown command 'bogus'") || !strings.Contains(output, "No more input") {
+		t.Errorf("unexpected output:\n%v", output)
+	}
+	if debug.clock.paused {
+		t.Errorf("expected the clock to be resumed")
+	}
+}
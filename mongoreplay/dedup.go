@@ -0,0 +1,454 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// DedupCommand stores settings for the mongoreplay 'dedup' subcommand
+type DedupCommand struct {
+	GlobalOpts   *Options `no-flag:"true"`
+	PlaybackFile string   `description:"path to the playback file to read from" short:"p" long:"playback-file" required:"yes"`
+	OutFile      string   `short:"o" long:"outputFile" description:"path to the playback file to write the representative workload to" required:"yes"`
+	Ops          int      `long:"ops" description:"number of ops of the representative workload, which each shape has a share of as close to its share of the ops of the playback file as possible, with at least one op" default:"1000"`
+	Samples      int      `long:"samples" description:"number of ops of each shape sampled as its representatives, which its ops in the representative workload cycle through" default:"1"`
+	Connections  int      `long:"connections" description:"number of connections the ops of the representative workload are spread over" default:"10"`
+	Seed         int64    `long:"seed" description:"seed of the sampling of the representatives; each seed samples different ops"`
+	UniqueFields []string `long:"uniqueFields" value-name:"<field>" description:"field of the inserted documents, besides _id, which is unique in its collection, and which the copies of an insert replace like their _id. May be repeated"`
+	Weights      string   `long:"weights" description:"write the shapes with their number of ops in the playback file and in the representative workload as json to the given path"`
+	Gzip         bool     `long:"gzip" description:"decompress gzipped input and compress the output"`
+
+	EncryptionOptions `group:"encryption options"`
+}
+
+// dedupShape holds the ops of a playback file sharing a fingerprint.
+type dedupShape struct {
+	Fingerprint string `json:"fingerprint"`
+	// Count is the number of ops of the shape in the playback file, and
+	// Copies in the representative workload.
+	Count  int64 `json:"count"`
+	Copies int64 `json:"copies"`
+	// Orders are those of the representatives in the playback file.
+	Orders []int64 `json:"representatives"`
+
+	representatives []*RecordedOp
+	first           int
+}
+
+// workloadDeduper samples representatives of the ops of a playback file by
+// their fingerprint. Replies, the ops of drivers handshaking and
+// authenticating, and the ops continuing cursors, which couldn't be played
+// without the ops opening them, are left out.
+type workloadDeduper struct {
+	samples int
+	rand    *rand.Rand
+	// uniqueFields are the fields of the inserted documents which the
+	// copies of an insert replace like their _id.
+	uniqueFields []string
+
+	shapes  map[string]*dedupShape
+	ops     int64
+	skipped int64
+	// first and last are the times the first and the last ops kept were
+	// seen.
+	first time.Time
+	last  time.Time
+}
+
+// add counts an op of the shape, keeping up to samples of its ops as its
+// representatives by reservoir sampling, so that every op of the shape is as
+// likely to be kept.
+func (shape *dedupShape) add(op *RecordedOp, samples int, rand *rand.Rand) {
+	shape.Count++
+	if len(shape.representatives) < samples {
+		shape.representatives = append(shape.representatives, op)
+	} else if i := rand.Int63n(shape.Count); i < int64(samples) {
+		shape.representatives[i] = op
+	}
+}
+
+func newWorkloadDeduper(samples int, seed int64) *workloadDeduper {
+	return &workloadDeduper{
+		samples: samples,
+		rand:    rand.New(rand.NewSource(seed)),
+		shapes:  map[string]*dedupShape{},
+	}
+}
+
+// ValidateParams validates the settings described in the DedupCommand
+// struct.
+func (dedup *DedupCommand) ValidateParams(args []string) error {
+	switch {
+	case len(args) > 0:
+		return fmt.Errorf("unknown argument: %s", args[0])
+	case dedup.Ops < 1:
+		return fmt.Errorf("Invalid setting for --ops: '%v', value must be >=1", dedup.Ops)
+	case dedup.Samples < 1:
+		return fmt.Errorf("Invalid setting for --samples: '%v', value must be >=1", dedup.Samples)
+	case dedup.Connections < 1:
+		return fmt.Errorf("Invalid setting for --connections: '%v', value must be >=1", dedup.Connections)
+	}
+	return nil
+}
+
+// Execute runs the program for the 'dedup' subcommand
+func (dedup *DedupCommand) Execute(args []string) error {
+	if err := dedup.ValidateParams(args); err != nil {
+		return err
+	}
+	dedup.GlobalOpts.SetLogging()
+	if err := dedup.setTapeEncryption(); err != nil {
+		return err
+	}
+
+	reader, err := NewPlaybackFileReader(dedup.PlaybackFile, dedup.Gzip)
+	if err != nil {
+		return err
+	}
+	deduper := newWorkloadDeduper(dedup.Samples, dedup.Seed)
+	deduper.uniqueFields = dedup.UniqueFields
+	opChan, errChan := reader.OpChan(1)
+	var addErr error
+	for op := range opChan {
+		if addErr == nil {
+			addErr = deduper.add(op)
+		}
+	}
+	if err := <-errChan; err != nil && err != io.EOF {
+		return err
+	}
+	if addErr != nil {
+		return addErr
+	}
+
+	writer, err := NewPlaybackFileWriter(dedup.OutFile, reader.metadata.DriverOpsFiltered, dedup.Gzip)
+	if err != nil {
+		return err
+	}
+	ops, err := deduper.workload(int64(dedup.Ops), dedup.Connections)
+	if err != nil {
+		writer.Close()
+		return err
+	}
+	for _, op := range ops {
+		if err := writer.WriteRecordedOp(op); err != nil {
+			writer.Close()
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if dedup.Weights != "" {
+		if err := deduper.writeWeights(dedup.Weights); err != nil {
+			return fmt.Errorf("error writing weights: %v", err)
+		}
+	}
+	userInfoLogger.Logvf(Always, "Wrote %v ops of %v shapes, representing the %v ops of %v (%v replies, driver ops and cursor continuations left out)",
+		len(ops), len(deduper.shapes), deduper.ops, dedup.PlaybackFile, deduper.skipped)
+	return nil
+}
+
+// add counts an op under its fingerprint, sampling it as one of the
+// representatives of the fingerprint.
+func (deduper *workloadDeduper) add(op *RecordedOp) error {
+	if op.EOF {
+		return nil
+	}
+	parsedOp, err := op.RawOp.Parse()
+	if err != nil {
+		return fmt.Errorf("error parsing op %v: %v", op.Order, err)
+	}
+	if parsedOp == nil {
+		return nil
+	}
+	if _, ok := parsedOp.(Replyable); ok {
+		deduper.skipped++
+		return nil
+	}
+	if IsDriverOp(parsedOp) || continuesCursor(parsedOp) {
+		deduper.skipped++
+		return nil
+	}
+	fingerprint, err := opFingerprint(parsedOp)
+	if err != nil {
+		return fmt.Errorf("error fingerprinting op %v: %v", op.Order, err)
+	}
+	shape, ok := deduper.shapes[fingerprint]
+	if !ok {
+		shape = &dedupShape{Fingerprint: fingerprint, first: len(deduper.shapes)}
+		deduper.shapes[fingerprint] = shape
+	}
+	shape.add(op, deduper.samples, deduper.rand)
+	deduper.ops++
+	if op.Seen != nil {
+		if deduper.first.IsZero() || op.Seen.Before(deduper.first) {
+			deduper.first = op.Seen.Time
+		}
+		if op.Seen.After(deduper.last) {
+			deduper.last = op.Seen.Time
+		}
+	}
+	return nil
+}
+
+// workload returns the ops of the representative workload: about total
+// ops, each shape having at least one, interleaved so that the mix of shapes
+// is even throughout, and seen at the mean rate of the ops of the playback
+// file, spread over the given number of connections. The inserts of the
+// representatives played more than once insert their documents with other
+// _ids and unique fields each time, so that they don't fail as duplicates.
+func (deduper *workloadDeduper) workload(total int64, connections int) ([]*RecordedOp, error) {
+	type slot struct {
+		shape *dedupShape
+		copy  int64
+		at    float64
+	}
+	var slots []slot
+	for _, shape := range deduper.shapes {
+		shape.Copies = shape.Count
+		if deduper.ops > total {
+			shape.Copies = int64(math.Max(1, math.Round(float64(shape.Count)*float64(total)/float64(deduper.ops))))
+		}
+		shape.Orders = nil
+		for _, op := range shape.representatives {
+			shape.Orders = append(shape.Orders, op.Order)
+		}
+		for i := int64(0); i < shape.Copies; i++ {
+			slots = append(slots, slot{shape, i, (float64(i) + 0.5) / float64(shape.Copies)})
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		if slots[i].at != slots[j].at {
+			return slots[i].at < slots[j].at
+		}
+		return slots[i].shape.first < slots[j].shape.first
+	})
+
+	var interval time.Duration
+	if deduper.ops > 1 {
+		interval = deduper.last.Sub(deduper.first) / time.Duration(deduper.ops-1)
+	}
+	ops := make([]*RecordedOp, len(slots))
+	for i, s := range slots {
+		representatives := s.shape.representatives
+		op := *representatives[s.copy%int64(len(representatives))]
+		if round := s.copy / int64(len(representatives)); round > 0 {
+			rawOp, err := deduper.copyInsert(&op, round)
+			if err != nil {
+				return nil, fmt.Errorf("error copying op %v: %v", op.Order, err)
+			}
+			op.RawOp = *rawOp
+		}
+		op.Seen = &PreciseTime{deduper.first.Add(time.Duration(i) * interval)}
+		op.PlayAt, op.PlayedAt = nil, nil
+		op.SeenConnectionNum = int64(i % connections)
+		op.PlayedConnectionNum = 0
+		op.Generation = 0
+		op.Order = int64(i)
+		ops[i] = &op
+	}
+	return ops, nil
+}
+
+// copyInsert returns the op played as the given round of the copies of a
+// representative: the op itself, unless it inserts documents, in which case
+// it is an OP_MSG insert of the documents with new ObjectIds replacing
+// their ObjectId _ids and unique fields, and the other _ids and unique
+// fields prefixed with the round.
+func (deduper *workloadDeduper) copyInsert(op *RecordedOp, round int64) (*RawOp, error) {
+	parsedOp, err := op.RawOp.Parse()
+	if err != nil {
+		return nil, err
+	}
+	if commandNameOf(parsedOp) != "insert" {
+		if _, ok := parsedOp.(*InsertOp); !ok {
+			return &op.RawOp, nil
+		}
+	}
+	if translated, err := translateLegacyOp(parsedOp); err != nil {
+		return nil, err
+	} else if translated != nil {
+		parsedOp = translated
+	}
+	msgOp, ok := parsedOp.(*MsgOp)
+	if !ok {
+		return nil, fmt.Errorf("inserts sent as %T can't be copied", parsedOp)
+	}
+	command, err := insertCommandOf(msgOp)
+	if err != nil {
+		return nil, err
+	}
+	prefix := fmt.Sprintf("copy%v", round)
+	fields := append([]string{"_id"}, deduper.uniqueFields...)
+	command, err = rewriteDocumentsField(command, func(doc bson.D) bson.D {
+		for i := range doc {
+			for _, field := range fields {
+				if doc[i].Name != field {
+					continue
+				}
+				if _, ok := doc[i].Value.(bson.ObjectId); ok {
+					doc[i].Value = bson.NewObjectId()
+				} else {
+					doc[i].Value = prefixValue(doc[i].Value, prefix)
+				}
+			}
+		}
+		return doc
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newMsgRawOp(op.Header.RequestID, 0, command)
+}
+
+// insertCommandOf returns the body of an OP_MSG insert with the documents
+// of its document sequence, if any, moved to its 'documents' array.
+func insertCommandOf(msgOp *MsgOp) (bson.D, error) {
+	raw, _, err := fetchPayload0Data(msgOp.Sections)
+	if err != nil {
+		return nil, err
+	}
+	command, err := bsonToD(raw)
+	if err != nil {
+		return nil, err
+	}
+	for _, section := range msgOp.Sections {
+		payload, ok := section.Data.(mgo.PayloadType1)
+		if section.PayloadType != mgo.MsgPayload1 || !ok || payload.Identifier != "documents" {
+			continue
+		}
+		value, _ := FindValueByKey("documents", &command)
+		docs, _ := value.([]interface{})
+		command = setDocField(command, "documents", append(docs, payload.Docs...))
+	}
+	return command, nil
+}
+
+// writeWeights writes the shapes, the most frequent first, as json.
+func (deduper *workloadDeduper) writeWeights(path string) error {
+	shapes := make([]*dedupShape, 0, len(deduper.shapes))
+	for _, shape := range deduper.shapes {
+		shapes = append(shapes, shape)
+	}
+	sort.Slice(shapes, func(i, j int) bool {
+		if shapes[i].Count != shapes[j].Count {
+			return shapes[i].Count > shapes[j].Count
+		}
+		return shapes[i].first < shapes[j].first
+	})
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(shapes)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// continuesCursor returns whether op uses a cursor opened by another op, as
+// getMores and killCursors do.
+func continuesCursor(op Op) bool {
+	if _, ok := op.(cursorsRewriteable); ok {
+		return true
+	}
+	switch commandNameOf(op) {
+	case "getMore", "getmore", "killCursors":
+		return true
+	}
+	return false
+}
+
+// opFingerprint returns the fingerprint of an op, which the ops differing
+// only by the values they hold share: the shape of its query, or its command
+// or op type and namespace, with the shapes of the statements of inserts,
+// updates and deletes.
+func opFingerprint(op Op) (string, error) {
+	shape, err := queryShapeOfOp(op)
+	if err != nil {
+		return "", err
+	}
+	if shape != nil {
+		return shape.String(), nil
+	}
+	meta := op.Meta()
+	ns := namespaceOf(op)
+	if ns == "" {
+		ns = meta.Ns
+	}
+	fingerprint := heatmapName(meta.Op, meta.Command, ns)
+
+	var field string
+	switch meta.Command {
+	case "insert":
+		field = "documents"
+	case "update":
+		field = "updates"
+	case "delete":
+		field = "deletes"
+	default:
+		return fingerprint, nil
+	}
+	request, err := requestOf(op)
+	if err != nil {
+		return "", err
+	}
+	doc, ok := request.(bson.D)
+	if !ok {
+		return fingerprint, nil
+	}
+	statements, _ := FindValueByKey(field, &doc)
+	array, _ := statements.([]interface{})
+	seen := map[string]bool{}
+	var shapes []string
+	for _, statement := range array {
+		var statementShape interface{}
+		if field == "documents" {
+			statementShape = shapeOfValue(statement)
+		} else {
+			statementDoc, err := bsonToD(statement)
+			if err != nil {
+				continue
+			}
+			var parts bson.D
+			if q, ok := FindValueByKey("q", &statementDoc); ok {
+				if filter, err := bsonToD(q); err == nil {
+					parts = append(parts, bson.DocElem{Name: "q", Value: shapeOfFilter(filter)})
+				}
+			}
+			if u, ok := FindValueByKey("u", &statementDoc); ok {
+				parts = append(parts, bson.DocElem{Name: "u", Value: shapeOfValue(u)})
+			}
+			statementShape = parts
+		}
+		if formatted := formatShape(statementShape); !seen[formatted] {
+			seen[formatted] = true
+			shapes = append(shapes, formatted)
+		}
+	}
+	sort.Strings(shapes)
+	if len(shapes) > 0 {
+		fingerprint += " [" + strings.Join(shapes, ", ") + "]"
+	}
+	return fingerprint, nil
+}
@@ -0,0 +1,222 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestOpFingerprint(t *testing.T) {
+	fingerprint := func(doc bson.D) string {
+		op := msgOpWithDoc(t, "test", doc)
+		fingerprint, err := opFingerprint(&op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fingerprint
+	}
+	type testCase struct {
+		name  string
+		a, b  bson.D
+		equal bool
+	}
+	cases := []testCase{
+		{name: "finds of other values", equal: true,
+			a: bson.D{{"find", "c"}, {"filter", bson.D{{"a", 1}}}},
+			b: bson.D{{"find", "c"}, {"filter", bson.D{{"a", 2}}}}},
+		{name: "finds of other fields",
+			a: bson.D{{"find", "c"}, {"filter", bson.D{{"a", 1}}}},
+			b: bson.D{{"find", "c"}, {"filter", bson.D{{"b", 1}}}}},
+		{name: "inserts of other values", equal: true,
+			a: bson.D{{"insert", "c"}, {"documents", []interface{}{bson.D{{"a", 1}}}}},
+			b: bson.D{{"insert", "c"}, {"documents", []interface{}{bson.D{{"a", 2}}, bson.D{{"a", 3}}}}}},
+		{name: "inserts of other documents",
+			a: bson.D{{"insert", "c"}, {"documents", []interface{}{bson.D{{"a", 1}}}}},
+			b: bson.D{{"insert", "c"}, {"documents", []interface{}{bson.D{{"a", "x"}}}}}},
+		{name: "updates of other values", equal: true,
+			a: bson.D{{"update", "c"}, {"updates", []interface{}{bson.D{{"q", bson.D{{"_id", 1}}}, {"u", bson.D{{"$set", bson.D{{"n", 1}}}}}}}}},
+			b: bson.D{{"update", "c"}, {"updates", []interface{}{bson.D{{"q", bson.D{{"_id", 2}}}, {"u", bson.D{{"$set", bson.D{{"n", 5}}}}}}}}}},
+		{name: "updates of other fields",
+			a: bson.D{{"update", "c"}, {"updates", []interface{}{bson.D{{"q", bson.D{{"_id", 1}}}, {"u", bson.D{{"$set", bson.D{{"n", 1}}}}}}}}},
+			b: bson.D{{"update", "c"}, {"updates", []interface{}{bson.D{{"q", bson.D{{"_id", 1}}}, {"u", bson.D{{"$inc", bson.D{{"n", 1}}}}}}}}}},
+		{name: "deletes of other collections",
+			a: bson.D{{"delete", "c"}, {"deletes", []interface{}{bson.D{{"q", bson.D{{"_id", 1}}}}}}},
+			b: bson.D{{"delete", "d"}, {"deletes", []interface{}{bson.D{{"q", bson.D{{"_id", 1}}}}}}}},
+		{name: "other commands", equal: true,
+			a: bson.D{{"create", "c"}},
+			b: bson.D{{"create", "c"}, {"capped", true}}},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		a, b := fingerprint(c.a), fingerprint(c.b)
+		if (a == b) != c.equal {
+			t.Errorf("expected the fingerprints to be equal: %v, got %v and %v", c.equal, a, b)
+		}
+	}
+}
+
+func TestDedupWorkload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	reader, err := NewPlaybackFileReader(writeDumpTape(t, dir), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deduper := newWorkloadDeduper(2, 0)
+	opChan, errChan := reader.OpChan(1)
+	for op := range opChan {
+		if err := deduper.add(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-errChan; err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if len(deduper.shapes) != 2 || deduper.ops != 6 || deduper.skipped != 2 {
+		t.Fatalf("expected 6 ops of 2 shapes and 2 replies skipped, got %v ops of %v shapes and %v skipped",
+			deduper.ops, len(deduper.shapes), deduper.skipped)
+	}
+
+	// the 4 inserts and 2 finds are played as 2 inserts and 1 find
+	ops, err := deduper.workload(3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []string
+	for i, op := range ops {
+		parsedOp, err := op.RawOp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		commands = append(commands, commandNameOf(parsedOp))
+		if op.Order != int64(i) || op.SeenConnectionNum != int64(i%2) {
+			t.Errorf("expected op %v on connection %v, got op %v on connection %v", i, i%2, op.Order, op.SeenConnectionNum)
+		}
+		if i > 0 && op.Seen.Sub(ops[i-1].Seen.Time) != deduper.last.Sub(deduper.first)/5 {
+			t.Errorf("expected the ops to be seen at the mean rate of the playback file")
+		}
+	}
+	if strings.Join(commands, ",") != "insert,find,insert" {
+		t.Errorf("expected the inserts and find to be interleaved, got %v", commands)
+	}
+	if bytes.Equal(ops[0].RawOp.Body, ops[2].RawOp.Body) {
+		t.Errorf("expected the inserts to cycle through the representatives")
+	}
+
+	// a shape has at least one op, and none is dropped from small workloads
+	for _, c := range []struct {
+		total    int64
+		expected int
+	}{{1, 2}, {100, 6}} {
+		if ops, _ := deduper.workload(c.total, 1); len(ops) != c.expected {
+			t.Errorf("expected %v ops for %v, got %v", c.expected, c.total, len(ops))
+		}
+	}
+}
+
+func TestDedupShapeSamplesEvenly(t *testing.T) {
+	counts := map[int64]int{}
+	for seed := int64(0); seed < 200; seed++ {
+		random := rand.New(rand.NewSource(seed))
+		shape := &dedupShape{}
+		for order := int64(0); order < 4; order++ {
+			shape.add(&RecordedOp{Order: order}, 1, random)
+		}
+		if shape.Count != 4 || len(shape.representatives) != 1 {
+			t.Fatalf("expected 1 representative of 4 ops, got %v of %v", len(shape.representatives), shape.Count)
+		}
+		counts[shape.representatives[0].Order]++
+	}
+	for order := int64(0); order < 4; order++ {
+		if counts[order] < 25 {
+			t.Errorf("expected op %v to be sampled about 50 times out of 200, got %v", order, counts[order])
+		}
+	}
+}
+
+func TestDedupCopiesInserts(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	for i := 0; i < 3; i++ {
+		doc := bson.D{{"_id", i}, {"email", fmt.Sprintf("user%v@example.com", i%2)}}
+		if err := generator.generateMsgOpAgainstCollection("insert", "documents", []interface{}{doc}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := generator.generateInsert([]interface{}{bson.D{{"_id", bson.NewObjectId()}, {"n", i}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(generator.opChan)
+	deduper := newWorkloadDeduper(1, 0)
+	deduper.uniqueFields = []string{"email"}
+	for op := range generator.opChan {
+		if err := deduper.add(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each insert is played from its single representative
+	ops, err := deduper.workload(5, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var legacyInserts int
+	for _, op := range ops {
+		if op.Header.OpCode == OpCodeInsert {
+			legacyInserts++
+		}
+	}
+	if len(ops) != 5 || legacyInserts != 1 {
+		t.Fatalf("expected 5 ops, of which the legacy insert copied as an OP_MSG, got %v ops and %v legacy inserts", len(ops), legacyInserts)
+	}
+
+	server := newFakeServer(t)
+	defer server.Close()
+	session := server.session()
+	defer session.Close()
+	statColl, err := NewStatCollector(testCollectorOpts, "format", true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opChan := make(chan *RecordedOp, len(ops))
+	for _, op := range ops {
+		opChan <- op
+	}
+	close(opChan)
+	if err := Play(NewExecutionContext(statColl, session, &ExecutionOptions{}), opChan, 10, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	if inserts := server.commands("insert"); len(inserts) != 4 || server.duplicates != 0 {
+		t.Errorf("expected 4 inserts played without duplicate _ids, got %v inserts and %v duplicates", len(inserts), server.duplicates)
+	}
+	emails := map[string]bool{}
+	for _, insert := range server.commands("insert") {
+		documents, _ := FindValueByKey("documents", &insert)
+		for _, inserted := range documents.([]interface{}) {
+			doc, _ := bsonToD(inserted)
+			if email, ok := FindValueByKey("email", &doc); ok {
+				if emails[email.(string)] {
+					t.Errorf("expected the emails inserted to be unique, got %v twice", email)
+				}
+				emails[email.(string)] = true
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestDialerOverrides(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// the listener stands in for a TLS-terminating proxy, recording the server
+	// name requested by each client hello and then rejecting the handshake
+	serverNames := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server := tls.Server(conn, &tls.Config{
+				GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+					serverNames <- hello.ServerName
+					return nil, fmt.Errorf("handshake rejected")
+				},
+			})
+			server.Handshake()
+			server.Close()
+		}
+	}()
+
+	t.Log("Dialing a server through an address override with SNI")
+	opts := &DialOptions{
+		DialAddress:   listener.Addr().String(),
+		TLS:           true,
+		TLSServerName: "mongodb.example.net",
+	}
+	if _, err := opts.newDialer(nil)("db0.internal:27017"); err == nil {
+		t.Errorf("expected handshake to fail")
+	}
+	if name := <-serverNames; name != opts.TLSServerName {
+		t.Errorf("expected server name %v, saw %v", opts.TLSServerName, name)
+	}
+
+	t.Log("Defaulting the server name to the host being connected to")
+	opts.TLSServerName = ""
+	opts.newDialer(nil)("db0.internal:27017")
+	if name := <-serverNames; name != "db0.internal" {
+		t.Errorf("expected server name db0.internal, saw %v", name)
+	}
+
+	t.Log("Dialing through a custom dialer")
+	var dialed string
+	custom := func(addr string) (net.Conn, error) {
+		dialed = addr
+		return nil, fmt.Errorf("not connecting")
+	}
+	opts = &DialOptions{DialAddress: "localhost:30000"}
+	if _, err := opts.newDialer(custom)("db0.internal:27017"); err == nil {
+		t.Errorf("expected error from custom dialer")
+	}
+	if dialed != "localhost:30000" {
+		t.Errorf("expected custom dialer to be given localhost:30000, saw %v", dialed)
+	}
+
+	if (&DialOptions{}).newDialer(nil) != nil {
+		t.Errorf("expected no dialer without overrides")
+	}
+}
@@ -0,0 +1,395 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// defaultIgnoredReplyFields are the fields of replies which vary from one
+// run to the next regardless of the server's behavior.
+var defaultIgnoredReplyFields = []string{"operationTime", "$clusterTime", "$gleStats", "$configServerState",
+	"$replData", "$oplogQueryData", "electionId", "opTime", "lastCommittedOpTime", "localTime", "connectionId"}
+
+// DiffRepliesCommand stores settings for the mongoreplay 'diff-replies'
+// subcommand
+type DiffRepliesCommand struct {
+	GlobalOpts          *Options `no-flag:"true"`
+	Ignore              []string `long:"ignore" description:"field to ignore, by name or by dotted path (e.g. 'cursor.ns'), in addition to those which vary between runs such as operationTime and $clusterTime. May be repeated"`
+	IgnoreArrayOrder    bool     `long:"ignoreArrayOrder" description:"compare arrays, including the documents returned by queries, regardless of their order"`
+	IgnoreErrorMessages bool     `long:"ignoreErrorMessages" description:"ignore the text of error messages, comparing only error codes"`
+	StrictTypes         bool     `long:"strictTypes" description:"report numbers of different types, such as an int32 and an int64, as different even when equal"`
+	MaxDiffs            int      `long:"maxDiffs" description:"maximum number of differing ops to print" default:"100"`
+
+	normalization *replyNormalization
+}
+
+// replyNormalization holds the rules applied when comparing replies.
+type replyNormalization struct {
+	ignore           map[string]bool
+	ignoreArrayOrder bool
+	strictTypes      bool
+}
+
+// replyDifference is a difference between two replies at a path.
+type replyDifference struct {
+	Path string
+	A, B interface{}
+}
+
+// opReplyDiff holds the differences between the replies to an op.
+type opReplyDiff struct {
+	Entry       *ReplyTapeEntry
+	Differences []replyDifference
+}
+
+// missingValue stands for a field present in only one of the replies.
+type missingValue struct{}
+
+func (missingValue) String() string {
+	return "<missing>"
+}
+
+// ValidateParams validates the settings described in the DiffRepliesCommand
+// struct.
+func (diff *DiffRepliesCommand) ValidateParams(args []string) error {
+	switch {
+	case len(args) != 2:
+		return fmt.Errorf("expected the paths of two reply tapes, saw %v arguments", len(args))
+	case diff.MaxDiffs < 0:
+		return fmt.Errorf("Invalid setting for --maxDiffs: must not be negative")
+	}
+	diff.normalization = newReplyNormalization(diff.Ignore, diff.IgnoreArrayOrder, diff.IgnoreErrorMessages, diff.StrictTypes)
+	return nil
+}
+
+// newReplyNormalization creates the rules ignoring the fields which vary
+// between runs and the given fields.
+func newReplyNormalization(ignore []string, ignoreArrayOrder, ignoreErrorMessages, strictTypes bool) *replyNormalization {
+	normalization := &replyNormalization{
+		ignore:           map[string]bool{},
+		ignoreArrayOrder: ignoreArrayOrder,
+		strictTypes:      strictTypes,
+	}
+	for _, field := range defaultIgnoredReplyFields {
+		normalization.ignore[field] = true
+	}
+	for _, field := range ignore {
+		normalization.ignore[field] = true
+	}
+	if ignoreErrorMessages {
+		normalization.ignore["errmsg"] = true
+		normalization.ignore["error"] = true
+	}
+	return normalization
+}
+
+// Execute runs the program for the 'diff-replies' subcommand
+func (diff *DiffRepliesCommand) Execute(args []string) error {
+	err := diff.ValidateParams(args)
+	if err != nil {
+		return err
+	}
+	diff.GlobalOpts.SetLogging()
+
+	tapeA, err := ReadReplyTape(args[0])
+	if err != nil {
+		return fmt.Errorf("error reading %v: %v", args[0], err)
+	}
+	tapeB, err := ReadReplyTape(args[1])
+	if err != nil {
+		return fmt.Errorf("error reading %v: %v", args[1], err)
+	}
+	if tapeA.Metadata.PlaybackFile != tapeB.Metadata.PlaybackFile {
+		userInfoLogger.Logvf(Always, "Warning: the tapes were recorded playing different files, %v and %v",
+			tapeA.Metadata.PlaybackFile, tapeB.Metadata.PlaybackFile)
+	}
+
+	diffs, onlyA, onlyB := diff.normalization.diffTapes(tapeA, tapeB)
+	writeReplyDiffs(os.Stdout, args[0], args[1], tapeA, tapeB, diffs, diff.MaxDiffs)
+	fmt.Fprintln(os.Stdout, replyDiffSummary(len(tapeA.Entries), diffs, onlyA, onlyB, args[0], args[1]))
+	if len(diffs) > 0 || onlyA > 0 || onlyB > 0 {
+		return fmt.Errorf("replies differ")
+	}
+	return nil
+}
+
+// diffTapes compares the replies to the ops found in both tapes, returning
+// the differences ordered by op, and the number of ops found in only one of
+// the tapes.
+func (normalization *replyNormalization) diffTapes(tapeA, tapeB *ReplyTape) (diffs []opReplyDiff, onlyA, onlyB int) {
+	for key, entryA := range tapeA.Entries {
+		entryB, ok := tapeB.Entries[key]
+		if !ok {
+			onlyA++
+			continue
+		}
+		if differences := normalization.diffEntries(entryA, entryB); len(differences) > 0 {
+			diffs = append(diffs, opReplyDiff{entryA, differences})
+		}
+	}
+	for key := range tapeB.Entries {
+		if _, ok := tapeA.Entries[key]; !ok {
+			onlyB++
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		a, b := diffs[i].Entry, diffs[j].Entry
+		if a.Generation != b.Generation {
+			return a.Generation < b.Generation
+		}
+		return a.Order < b.Order
+	})
+	return diffs, onlyA, onlyB
+}
+
+// diffEntries compares the errors and reply documents of two entries.
+func (normalization *replyNormalization) diffEntries(a, b *ReplyTapeEntry) []replyDifference {
+	var differences []replyDifference
+	if a.Error != b.Error && !normalization.ignore["error"] {
+		differences = append(differences, replyDifference{"error", a.Error, b.Error})
+	}
+	docsA, errA := rawsToValues(a.Docs)
+	docsB, errB := rawsToValues(b.Docs)
+	if errA != nil || errB != nil {
+		return append(differences, replyDifference{"docs", errA, errB})
+	}
+	return normalization.diffValues("docs", "", docsA, docsB, differences)
+}
+
+func rawsToValues(raws []bson.Raw) ([]interface{}, error) {
+	values := make([]interface{}, len(raws))
+	for i, raw := range raws {
+		doc := bson.D{}
+		if err := raw.Unmarshal(&doc); err != nil {
+			return nil, err
+		}
+		values[i] = doc
+	}
+	return values, nil
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// diffValues appends the differences between a and b, found at path, to
+// differences. The document paths matched by --ignore do not include the
+// leading "docs.<n>" of the reply document.
+func (normalization *replyNormalization) diffValues(path, docPath string, a, b interface{}, differences []replyDifference) []replyDifference {
+	if normalization.ignore[docPath] {
+		return differences
+	}
+	a, b = normalizeDocument(a), normalizeDocument(b)
+	switch av := a.(type) {
+	case bson.M:
+		bv, ok := b.(bson.M)
+		if !ok {
+			break
+		}
+		for _, key := range unionKeys(av, bv) {
+			if normalization.ignore[key] {
+				continue
+			}
+			aField, aOK := av[key]
+			bField, bOK := bv[key]
+			if !aOK {
+				aField = missingValue{}
+			}
+			if !bOK {
+				bField = missingValue{}
+			}
+			differences = normalization.diffValues(joinPath(path, key), joinPath(docPath, key), aField, bField, differences)
+		}
+		return differences
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		if normalization.ignoreArrayOrder {
+			if !reflect.DeepEqual(normalization.canonicalElements(av), normalization.canonicalElements(bv)) {
+				differences = append(differences, replyDifference{path, a, b})
+			}
+			return differences
+		}
+		if len(av) != len(bv) {
+			differences = append(differences, replyDifference{path + ".length", len(av), len(bv)})
+		}
+		for i := 0; i < len(av) && i < len(bv); i++ {
+			elementPath := docPath
+			if path != "docs" {
+				elementPath = joinPath(docPath, fmt.Sprint(i))
+			}
+			differences = normalization.diffValues(joinPath(path, fmt.Sprint(i)), elementPath, av[i], bv[i], differences)
+		}
+		return differences
+	}
+	if !normalization.equalValues(docPath, a, b) {
+		differences = append(differences, replyDifference{path, a, b})
+	}
+	return differences
+}
+
+// equalValues compares values which are neither documents nor arrays.
+func (normalization *replyNormalization) equalValues(docPath string, a, b interface{}) bool {
+	// cursor ids are assigned by the server, so only whether a cursor was
+	// left open is compared
+	if docPath == "cursor.id" || strings.HasSuffix(docPath, "cursorId") {
+		aID, aOK := toFloat(a)
+		bID, bOK := toFloat(b)
+		if aOK && bOK {
+			return (aID == 0) == (bID == 0)
+		}
+	}
+	if !normalization.strictTypes {
+		aNum, aOK := toFloat(a)
+		bNum, bOK := toFloat(b)
+		if aOK && bOK {
+			return aNum == bNum
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch t := value.(type) {
+	case int:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case float64:
+		return t, true
+	}
+	return 0, false
+}
+
+// normalizeDocument converts documents into bson.M, so that their fields are
+// compared regardless of their order.
+func normalizeDocument(value interface{}) interface{} {
+	switch t := value.(type) {
+	case bson.D:
+		return t.Map()
+	case *bson.D:
+		return t.Map()
+	}
+	return value
+}
+
+func unionKeys(a, b bson.M) []string {
+	keys := make([]string, 0, len(a))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// canonicalElements returns a sorted representation of the elements of an
+// array, with ignored fields removed, for comparing arrays regardless of
+// their order.
+func (normalization *replyNormalization) canonicalElements(values []interface{}) []string {
+	elements := make([]string, len(values))
+	for i, value := range values {
+		elements[i] = normalization.canonicalString(value)
+	}
+	sort.Strings(elements)
+	return elements
+}
+
+func (normalization *replyNormalization) canonicalString(value interface{}) string {
+	value = normalizeDocument(value)
+	switch t := value.(type) {
+	case bson.M:
+		var fields []string
+		for _, key := range unionKeys(t, nil) {
+			if normalization.ignore[key] {
+				continue
+			}
+			fields = append(fields, fmt.Sprintf("%q:%v", key, normalization.canonicalString(t[key])))
+		}
+		return "{" + strings.Join(fields, ",") + "}"
+	case []interface{}:
+		return "[" + strings.Join(normalization.canonicalElements(t), ",") + "]"
+	}
+	if number, ok := toFloat(value); ok && !normalization.strictTypes {
+		return fmt.Sprint(number)
+	}
+	return fmt.Sprintf("%T(%#v)", value, value)
+}
+
+// formatReplyValue formats a value of a reply as abbreviated JSON.
+func formatReplyValue(value interface{}) string {
+	if _, ok := value.(missingValue); ok {
+		return "<missing>"
+	}
+	if jsonValue, err := ConvertBSONValueToJSON(value); err == nil {
+		if data, err := json.Marshal(jsonValue); err == nil {
+			return Abbreviate(string(data), TruncateLength)
+		}
+	}
+	return Abbreviate(fmt.Sprintf("%v", value), TruncateLength)
+}
+
+func writeReplyDiffs(out io.Writer, nameA, nameB string, tapeA, tapeB *ReplyTape, diffs []opReplyDiff, maxDiffs int) {
+	fmt.Fprintf(out, "--- %v%v\n+++ %v%v\n", nameA, serverVersionSuffix(tapeA), nameB, serverVersionSuffix(tapeB))
+	for i, diff := range diffs {
+		if i == maxDiffs {
+			fmt.Fprintf(out, "... %v more ops differ\n", len(diffs)-maxDiffs)
+			break
+		}
+		fmt.Fprintf(out, "op %v (connection %v) %v %v\n", diff.Entry.key(), diff.Entry.ConnectionNum,
+			diff.Entry.name(), diff.Entry.Ns)
+		for _, difference := range diff.Differences {
+			fmt.Fprintf(out, "  %v:\n  - %v\n  + %v\n", difference.Path,
+				formatReplyValue(difference.A), formatReplyValue(difference.B))
+		}
+	}
+}
+
+func serverVersionSuffix(tape *ReplyTape) string {
+	if tape.Metadata.ServerVersion == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (server %v)", tape.Metadata.ServerVersion)
+}
+
+// replyDiffSummary describes the number of ops whose replies differ, by
+// command.
+func replyDiffSummary(compared int, diffs []opReplyDiff, onlyA, onlyB int, nameA, nameB string) string {
+	byName := map[string]int64{}
+	for _, diff := range diffs {
+		byName[diff.Entry.name()]++
+	}
+	var names []string
+	for _, count := range sortedCounts(byName) {
+		names = append(names, fmt.Sprintf("%v %v", count.Name, count.Count))
+	}
+	summary := fmt.Sprintf("Compared %v replies: %v differ", compared-onlyA, len(diffs))
+	if len(names) > 0 {
+		summary += fmt.Sprintf(" (%v)", strings.Join(names, ", "))
+	}
+	return summary + fmt.Sprintf(", %v only in %v, %v only in %v", onlyA, nameA, onlyB, nameB)
+}
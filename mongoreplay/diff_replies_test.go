@@ -0,0 +1,170 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestDiffReplies(t *testing.T) {
+	entryWith := func(t *testing.T, docs ...bson.D) *ReplyTapeEntry {
+		entry := &ReplyTapeEntry{Op: "op_msg", Command: "find"}
+		for _, doc := range docs {
+			raw, err := dToRaw(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry.Docs = append(entry.Docs, *raw)
+		}
+		return entry
+	}
+	batch := func(ids ...int) bson.D {
+		var docs []interface{}
+		for _, id := range ids {
+			docs = append(docs, bson.D{{"_id", id}})
+		}
+		return bson.D{{"cursor", bson.D{{"id", int64(0)}, {"firstBatch", docs}}}, {"ok", 1.0}}
+	}
+
+	testCases := []struct {
+		name          string
+		a, b          bson.D
+		diff          DiffRepliesCommand
+		expectedPaths []string
+	}{
+		{
+			name: "identical",
+			a:    batch(1, 2),
+			b:    batch(1, 2),
+		},
+		{
+			name:          "different documents",
+			a:             batch(1, 2),
+			b:             batch(1, 3),
+			expectedPaths: []string{"docs.0.cursor.firstBatch.1._id"},
+		},
+		{
+			name:          "different lengths",
+			a:             batch(1, 2),
+			b:             batch(1),
+			expectedPaths: []string{"docs.0.cursor.firstBatch.length"},
+		},
+		{
+			name:          "different order",
+			a:             batch(1, 2),
+			b:             batch(2, 1),
+			expectedPaths: []string{"docs.0.cursor.firstBatch.0._id", "docs.0.cursor.firstBatch.1._id"},
+		},
+		{
+			name: "different order ignored",
+			a:    batch(1, 2),
+			b:    batch(2, 1),
+			diff: DiffRepliesCommand{IgnoreArrayOrder: true},
+		},
+		{
+			name: "fields which vary between runs",
+			a:    bson.D{{"ok", 1.0}, {"operationTime", bson.MongoTimestamp(1)}, {"$clusterTime", bson.D{{"clusterTime", bson.MongoTimestamp(1)}}}},
+			b:    bson.D{{"operationTime", bson.MongoTimestamp(2)}, {"ok", 1.0}},
+		},
+		{
+			name:          "missing field",
+			a:             bson.D{{"ok", 1.0}, {"n", 1}},
+			b:             bson.D{{"ok", 1.0}},
+			expectedPaths: []string{"docs.0.n"},
+		},
+		{
+			name: "ignored path",
+			a:    bson.D{{"ok", 1.0}, {"cursor", bson.D{{"ns", "test.a"}}}},
+			b:    bson.D{{"ok", 1.0}, {"cursor", bson.D{{"ns", "test.b"}}}},
+			diff: DiffRepliesCommand{Ignore: []string{"cursor.ns"}},
+		},
+		{
+			name: "cursor ids",
+			a:    bson.D{{"cursor", bson.D{{"id", int64(12345)}}}},
+			b:    bson.D{{"cursor", bson.D{{"id", int64(67890)}}}},
+		},
+		{
+			name:          "closed cursor",
+			a:             bson.D{{"cursor", bson.D{{"id", int64(12345)}}}},
+			b:             bson.D{{"cursor", bson.D{{"id", int64(0)}}}},
+			expectedPaths: []string{"docs.0.cursor.id"},
+		},
+		{
+			name: "numeric types",
+			a:    bson.D{{"n", int32(1)}},
+			b:    bson.D{{"n", 1.0}},
+		},
+		{
+			name:          "strict numeric types",
+			a:             bson.D{{"n", int32(1)}},
+			b:             bson.D{{"n", 1.0}},
+			diff:          DiffRepliesCommand{StrictTypes: true},
+			expectedPaths: []string{"docs.0.n"},
+		},
+		{
+			name: "error messages ignored",
+			a:    bson.D{{"ok", 0.0}, {"errmsg", "bad value"}, {"code", 2}},
+			b:    bson.D{{"ok", 0.0}, {"errmsg", "BadValue: bad value"}, {"code", 2}},
+			diff: DiffRepliesCommand{IgnoreErrorMessages: true},
+		},
+	}
+	for _, c := range testCases {
+		t.Logf("running case: %s", c.name)
+		if err := c.diff.ValidateParams([]string{"a", "b"}); err != nil {
+			t.Fatal(err)
+		}
+		differences := c.diff.normalization.diffEntries(entryWith(t, c.a), entryWith(t, c.b))
+		if len(differences) != len(c.expectedPaths) {
+			t.Errorf("expected differences at %v, saw %v", c.expectedPaths, differences)
+			continue
+		}
+		for i, difference := range differences {
+			if difference.Path != c.expectedPaths[i] {
+				t.Errorf("expected a difference at %v, saw one at %v", c.expectedPaths[i], difference.Path)
+			}
+		}
+	}
+}
+
+func TestDiffTapes(t *testing.T) {
+	entry := func(order int64, err string) *ReplyTapeEntry {
+		return &ReplyTapeEntry{Order: order, Op: "op_msg", Command: "insert", Error: err}
+	}
+	tapeA := &ReplyTape{Entries: map[replyTapeKey]*ReplyTapeEntry{}}
+	tapeB := &ReplyTape{Entries: map[replyTapeKey]*ReplyTapeEntry{}}
+	for _, e := range []*ReplyTapeEntry{entry(1, ""), entry(2, ""), entry(3, ""), entry(4, "")} {
+		tapeA.Entries[e.key()] = e
+	}
+	for _, e := range []*ReplyTapeEntry{entry(2, "duplicate key"), entry(1, ""), entry(3, "duplicate key"), entry(5, "")} {
+		tapeB.Entries[e.key()] = e
+	}
+
+	diff := &DiffRepliesCommand{}
+	if err := diff.ValidateParams([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	diffs, onlyA, onlyB := diff.normalization.diffTapes(tapeA, tapeB)
+	if len(diffs) != 2 || diffs[0].Entry.Order != 2 || diffs[1].Entry.Order != 3 {
+		t.Errorf("expected ops 2 and 3 to differ, saw %v", diffs)
+	}
+	if onlyA != 1 || onlyB != 1 {
+		t.Errorf("expected 1 op only in each tape, saw %v and %v", onlyA, onlyB)
+	}
+	expected := "Compared 3 replies: 2 differ (insert 2), 1 only in a, 1 only in b"
+	if summary := replyDiffSummary(len(tapeA.Entries), diffs, onlyA, onlyB, "a", "b"); summary != expected {
+		t.Errorf("expected summary %q, saw %q", expected, summary)
+	}
+}
+
+func TestDiffRepliesValidateParams(t *testing.T) {
+	diff := &DiffRepliesCommand{}
+	if err := diff.ValidateParams([]string{"a"}); err == nil {
+		t.Errorf("expected an error with a single reply tape")
+	}
+}
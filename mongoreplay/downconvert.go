@@ -0,0 +1,209 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"sync/atomic"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// downconvertibleFields lists, for each command downconvertMsgOp converts,
+// the fields it carries over. Commands with any other field, besides the
+// droppedFields, are played as recorded.
+var downconvertibleFields = map[string]map[string]bool{
+	"find": {"find": true, "filter": true, "sort": true, "projection": true, "hint": true, "skip": true,
+		"limit": true, "batchSize": true, "singleBatch": true, "$readPreference": true},
+	"getMore": {"getMore": true, "collection": true, "batchSize": true},
+	"insert":  {"insert": true, "documents": true, "ordered": true, "writeConcern": true},
+}
+
+// droppedFields are the fields of commands the legacy ops don't carry: the
+// database, which is part of their namespace, and the session, which servers
+// predating OP_MSG don't support.
+var droppedFields = map[string]bool{"$db": true, "lsid": true, "$clusterTime": true}
+
+// downconvertMsgOp returns the legacy OP_QUERY, OP_GET_MORE or OP_INSERT
+// equivalent to an OP_MSG find, getMore or insert command, or nil if op
+// isn't one of them or uses options the legacy opcodes can't express. The
+// legacy inserts aren't acknowledged, so their write concern is carried by
+// the getLastError which follows them; see downconvertedGetLastError.
+func downconvertMsgOp(op Op) (Op, error) {
+	var msgOp *MsgOp
+	switch castOp := op.(type) {
+	case *MsgOp:
+		msgOp = castOp
+	case *MsgOpGetMore:
+		msgOp = &castOp.MsgOp
+	default:
+		return nil, nil
+	}
+	if msgOp.Flags&^mgo.MsgFlagChecksumPresent != 0 {
+		return nil, nil
+	}
+	raw, _, err := fetchPayload0Data(msgOp.Sections)
+	if err != nil {
+		return nil, err
+	}
+	body, err := bsonToD(raw)
+	if err != nil || len(body) == 0 {
+		return nil, err
+	}
+	fields, ok := downconvertibleFields[body[0].Name]
+	if !ok {
+		return nil, nil
+	}
+	for _, elem := range body {
+		if !fields[elem.Name] && !droppedFields[elem.Name] {
+			return nil, nil
+		}
+	}
+	database, _ := FindValueByKey("$db", &body)
+	databaseName, _ := database.(string)
+	collection, _ := body[0].Value.(string)
+
+	switch body[0].Name {
+	case "find":
+		return downconvertFind(databaseName+"."+collection, body)
+	case "getMore":
+		cursorID, ok := body[0].Value.(int64)
+		if !ok {
+			return nil, nil
+		}
+		collection, _ := FindValueByKey("collection", &body)
+		collectionName, _ := collection.(string)
+		getMore := &GetMoreOp{}
+		getMore.Collection = databaseName + "." + collectionName
+		getMore.CursorId = cursorID
+		getMore.Limit = int32Field(body, "batchSize")
+		return getMore, nil
+	}
+	documents, ok := FindValueByKey("documents", &body)
+	var docs []interface{}
+	if ok {
+		if docs, ok = documents.([]interface{}); !ok {
+			return nil, nil
+		}
+	}
+	for _, section := range msgOp.Sections {
+		if payload, ok := section.Data.(mgo.PayloadType1); ok && payload.Identifier == "documents" {
+			docs = append(docs, payload.Docs...)
+		}
+	}
+	insert := &InsertOp{}
+	insert.Collection = databaseName + "." + collection
+	insert.Documents = docs
+	if ordered, ok := FindValueByKey("ordered", &body); ok && ordered == false {
+		insert.Flags = insertFlagContinueOnError
+	}
+	return insert, nil
+}
+
+// downconvertedGetLastError returns the getLastError command which follows
+// the legacy write downconverted from the OP_MSG command op, carrying the
+// command's write concern, or nil if downconverted isn't a write or the
+// command asked for no acknowledgement.
+func downconvertedGetLastError(op, downconverted Op) (*QueryOp, error) {
+	getLastError := getLastErrorFor(downconverted)
+	if getLastError == nil {
+		return nil, nil
+	}
+	var msgOp *MsgOp
+	switch castOp := op.(type) {
+	case *MsgOp:
+		msgOp = castOp
+	case *MsgOpGetMore:
+		msgOp = &castOp.MsgOp
+	default:
+		return getLastError, nil
+	}
+	raw, _, err := fetchPayload0Data(msgOp.Sections)
+	if err != nil {
+		return nil, err
+	}
+	body, err := bsonToD(raw)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := FindValueByKey("writeConcern", &body)
+	if !ok {
+		return getLastError, nil
+	}
+	writeConcern, err := bsonToD(value)
+	if err != nil {
+		return nil, err
+	}
+	if w, _ := FindValueByKey("w", &writeConcern); w != nil {
+		if number, ok := toFloat(w); ok && number == 0 {
+			return nil, nil
+		}
+	}
+	getLastError.Query = append(getLastError.Query.(bson.D), writeConcern...)
+	return getLastError, nil
+}
+
+// downconvertFind returns the legacy OP_QUERY equivalent to a find command.
+// Legacy queries can't bound their results separately from their batches,
+// so a limit is played as a single batch of at most that many documents.
+func downconvertFind(namespace string, body bson.D) (Op, error) {
+	query := &QueryOp{}
+	query.Collection = namespace
+	filter, _ := FindValueByKey("filter", &body)
+	if filter == nil {
+		filter = bson.D{}
+	}
+	var wrapper bson.D
+	for _, modifier := range []struct{ field, name string }{
+		{"sort", "$orderby"}, {"hint", "$hint"}, {"$readPreference", "$readPreference"},
+	} {
+		if value, ok := FindValueByKey(modifier.field, &body); ok {
+			wrapper = append(wrapper, bson.DocElem{Name: modifier.name, Value: value})
+		}
+	}
+	if wrapper != nil {
+		query.Query = append(bson.D{{Name: "$query", Value: filter}}, wrapper...)
+	} else {
+		query.Query = filter
+	}
+	if readPreference, ok := FindValueByKey("$readPreference", &body); ok {
+		if doc, err := bsonToD(readPreference); err == nil {
+			if mode, _ := FindValueByKey("mode", &doc); mode != "primary" {
+				query.Flags |= queryFlagSlaveOk
+			}
+		}
+	}
+	if projection, ok := FindValueByKey("projection", &body); ok {
+		query.Selector = projection
+	}
+	query.Skip = int32Field(body, "skip")
+	limit, batchSize := int32Field(body, "limit"), int32Field(body, "batchSize")
+	singleBatch, _ := FindValueByKey("singleBatch", &body)
+	switch {
+	case limit > 0:
+		query.Limit = -limit
+	case singleBatch == true:
+		query.Limit = -batchSize
+	default:
+		query.Limit = batchSize
+	}
+	return query, nil
+}
+
+// int32Field returns the numeric field of doc as an int32, or 0 if it is
+// missing.
+func int32Field(doc bson.D, name string) int32 {
+	value, _ := FindValueByKey(name, &doc)
+	number, _ := toFloat(value)
+	return int32(number)
+}
+
+// DownconvertedOps returns the number of OP_MSG commands that were played as
+// the equivalent legacy ops.
+func (context *ExecutionContext) DownconvertedOps() int64 {
+	return atomic.LoadInt64(&context.downconvertedOps)
+}
@@ -0,0 +1,147 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"reflect"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestDownconvertMsgOp(t *testing.T) {
+	filter := bson.D{{"a", 1}}
+	lsid := bson.D{{"id", "session"}}
+	type testCase struct {
+		name     string
+		command  bson.D
+		sequence []interface{}
+		// expected is the legacy op, or nil if the command is played as
+		// recorded
+		expected Op
+	}
+	cases := []testCase{
+		{
+			name:     "find",
+			command:  bson.D{{"find", "c"}, {"filter", filter}, {"projection", bson.D{{"a", 1}}}, {"skip", int32(2)}, {"batchSize", int32(10)}, {"lsid", lsid}},
+			expected: &QueryOp{QueryOp: mgo.QueryOp{Collection: "test.c", Query: filter, Selector: bson.D{{"a", 1}}, Skip: 2, Limit: 10}},
+		},
+		{
+			name:    "find with modifiers",
+			command: bson.D{{"find", "c"}, {"filter", filter}, {"sort", bson.D{{"a", -1}}}, {"limit", int64(5)}, {"$readPreference", bson.D{{"mode", "secondary"}}}},
+			expected: &QueryOp{QueryOp: mgo.QueryOp{Collection: "test.c", Limit: -5, Flags: queryFlagSlaveOk,
+				Query: bson.D{{"$query", filter}, {"$orderby", bson.D{{"a", -1}}}, {"$readPreference", bson.D{{"mode", "secondary"}}}}}},
+		},
+		{
+			name:    "find with unsupported option",
+			command: bson.D{{"find", "c"}, {"filter", filter}, {"collation", bson.D{{"locale", "fr"}}}},
+		},
+		{
+			name:     "getMore",
+			command:  bson.D{{"getMore", int64(12345)}, {"collection", "c"}, {"batchSize", int32(10)}},
+			expected: &GetMoreOp{GetMoreOp: mgo.GetMoreOp{Collection: "test.c", CursorId: 12345, Limit: 10}},
+		},
+		{
+			name:     "unordered insert",
+			command:  bson.D{{"insert", "c"}, {"documents", []interface{}{filter}}, {"ordered", false}},
+			expected: &InsertOp{InsertOp: mgo.InsertOp{Collection: "test.c", Documents: []interface{}{filter}, Flags: insertFlagContinueOnError}},
+		},
+		{
+			name:     "insert with document sequence",
+			command:  bson.D{{"insert", "c"}, {"writeConcern", bson.D{{"w", 1}}}},
+			sequence: []interface{}{filter},
+			expected: &InsertOp{InsertOp: mgo.InsertOp{Collection: "test.c", Documents: []interface{}{filter}}},
+		},
+		{
+			name:    "other command",
+			command: bson.D{{"count", "c"}},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		msgOp, err := newMsgCommand("test", c.command)
+		if err != nil {
+			t.Fatalf("error building the command: %v", err)
+		}
+		if c.sequence != nil {
+			msgOp.Sections = append(msgOp.Sections, mgo.MsgSection{
+				PayloadType: mgo.MsgPayload1,
+				Data:        mgo.PayloadType1{Identifier: "documents", Docs: c.sequence},
+			})
+		}
+		downconverted, err := downconvertMsgOp(msgOp)
+		if err != nil {
+			t.Errorf("error downconverting the command: %v", err)
+			continue
+		}
+		if c.expected == nil {
+			if downconverted != nil {
+				t.Errorf("expected the command to be played as recorded, got %#v", downconverted)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(downconverted, c.expected) {
+			t.Errorf("expected %#v, got %#v", c.expected, downconverted)
+		}
+	}
+}
+
+func TestDownconvertedGetLastError(t *testing.T) {
+	documents := []interface{}{bson.D{{"a", 1}}}
+	type testCase struct {
+		name    string
+		command bson.D
+		// expected is the getLastError command, or nil if none follows
+		expected interface{}
+	}
+	cases := []testCase{
+		{
+			name:     "insert",
+			command:  bson.D{{"insert", "c"}, {"documents", documents}},
+			expected: bson.D{{"getLastError", 1}},
+		},
+		{
+			name:     "insert with write concern",
+			command:  bson.D{{"insert", "c"}, {"documents", documents}, {"writeConcern", bson.D{{"w", "majority"}, {"wtimeout", 100}}}},
+			expected: bson.D{{"getLastError", 1}, {"w", "majority"}, {"wtimeout", 100}},
+		},
+		{
+			name:    "unacknowledged insert",
+			command: bson.D{{"insert", "c"}, {"documents", documents}, {"writeConcern", bson.D{{"w", 0}}}},
+		},
+		{
+			name:    "find",
+			command: bson.D{{"find", "c"}},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		msgOp, err := newMsgCommand("test", c.command)
+		if err != nil {
+			t.Fatalf("error building the command: %v", err)
+		}
+		downconverted, err := downconvertMsgOp(msgOp)
+		if err != nil || downconverted == nil {
+			t.Fatalf("expected the command to be downconverted, got %v", err)
+		}
+		getLastError, err := downconvertedGetLastError(msgOp, downconverted)
+		if err != nil {
+			t.Errorf("error building the getLastError: %v", err)
+			continue
+		}
+		if c.expected == nil {
+			if getLastError != nil {
+				t.Errorf("expected no getLastError, got %#v", getLastError.Query)
+			}
+			continue
+		}
+		if getLastError == nil || getLastError.Collection != "test.$cmd" || !reflect.DeepEqual(getLastError.Query, c.expected) {
+			t.Errorf("expected %#v, got %#v", c.expected, getLastError)
+		}
+	}
+}
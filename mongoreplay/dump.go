@@ -0,0 +1,345 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// the ANSI escape sequences dump highlights the json with
+const (
+	dumpColorKey     = "\x1b[34m"
+	dumpColorString  = "\x1b[32m"
+	dumpColorNumber  = "\x1b[36m"
+	dumpColorLiteral = "\x1b[35m"
+	dumpColorReset   = "\x1b[0m"
+)
+
+// DumpCommand stores settings for the mongoreplay 'dump' subcommand
+type DumpCommand struct {
+	GlobalOpts   *Options `no-flag:"true"`
+	PlaybackFile string   `description:"path to the playback file to dump" short:"p" long:"playback-file" required:"yes"`
+	Match        string   `long:"match" description:"json document the dumped ops must match, such as '{\"op\": \"query\", \"ns\": \"app.users\"}': each field, which may be a dotted path such as 'request.filter.accountId', must equal that of the op, or match it if it is a regular expression such as /^app\\./"`
+	Limit        int      `long:"limit" description:"stop after dumping this number of ops; 0 dumps every op matched"`
+	Replies      bool     `long:"replies" description:"dump the replies as well as the ops"`
+	JSONMode     string   `long:"jsonMode" description:"Extended JSON mode of the dumped ops: relaxed, writing numbers and dates as plain JSON where possible, or canonical, keeping the BSON type of every value" choice:"relaxed" choice:"canonical" default:"relaxed"`
+	NoColors     bool     `long:"no-colors" description:"don't highlight the json, which is otherwise highlighted when written to a terminal"`
+	Gzip         bool     `long:"gzip" description:"decompress gzipped input"`
+
+	match bson.D
+}
+
+// ValidateParams validates the settings described in the DumpCommand struct.
+func (dump *DumpCommand) ValidateParams(args []string) error {
+	switch {
+	case len(args) > 0:
+		return fmt.Errorf("unknown argument: %s", args[0])
+	case dump.Limit < 0:
+		return fmt.Errorf("Invalid setting for --limit: '%v', value must be >=0", dump.Limit)
+	}
+	dump.match = nil
+	if dump.Match != "" {
+		match, err := parseOpMatch(dump.Match)
+		if err != nil {
+			return fmt.Errorf("Invalid setting for --match: %v", err)
+		}
+		dump.match = match
+	}
+	return nil
+}
+
+// Execute runs the program for the 'dump' subcommand
+func (dump *DumpCommand) Execute(args []string) error {
+	if err := dump.ValidateParams(args); err != nil {
+		return err
+	}
+	dump.GlobalOpts.SetLogging()
+
+	reader, err := NewPlaybackFileReader(dump.PlaybackFile, dump.Gzip)
+	if err != nil {
+		return err
+	}
+	color := false
+	if info, err := os.Stdout.Stat(); err == nil && !dump.NoColors {
+		color = info.Mode()&os.ModeCharDevice != 0
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	dumped, err := dumpOps(reader, out, dump.match, dump.Limit, dump.Replies, dump.JSONMode == extJSONCanonical, color)
+	if err != nil {
+		return err
+	}
+	userInfoLogger.Logvf(Info, "Dumped %v ops", dumped)
+	return nil
+}
+
+// dumpOps writes the ops of a playback file matching match to out, as
+// indented Extended JSON, highlighted if color is set, returning the number
+// of ops dumped. At most limit ops are dumped, unless it is 0.
+func dumpOps(reader *PlaybackFileReader, out io.Writer, match bson.D, limit int, replies, canonical, color bool) (int, error) {
+	opChan, errChan := reader.OpChan(1)
+	var dumped int
+	var dumpErr error
+	for op := range opChan {
+		if dumpErr != nil || op.EOF || (limit > 0 && dumped == limit) {
+			continue
+		}
+		parsedOp, err := op.RawOp.Parse()
+		if err != nil {
+			dumpErr = fmt.Errorf("error parsing op %v: %v", op.Order, err)
+			continue
+		}
+		if parsedOp == nil {
+			continue
+		}
+		if _, ok := parsedOp.(Replyable); ok && !replies {
+			continue
+		}
+		doc, err := dumpDocOf(op, parsedOp)
+		if err != nil {
+			dumpErr = fmt.Errorf("error dumping op %v: %v", op.Order, err)
+			continue
+		}
+		if !opMatches(doc, match) {
+			continue
+		}
+		if dumpErr = writeDumpDoc(out, doc, canonical, color); dumpErr == nil {
+			dumped++
+		}
+	}
+	if err := <-errChan; err != nil && err != io.EOF {
+		return dumped, err
+	}
+	return dumped, dumpErr
+}
+
+// dumpDocOf returns the document an op is dumped as, which its --match is
+// matched against.
+func dumpDocOf(op *RecordedOp, parsedOp Op) (bson.D, error) {
+	meta := parsedOp.Meta()
+	ns := namespaceOf(parsedOp)
+	if ns == "" {
+		ns = meta.Ns
+	}
+	request, err := requestOf(parsedOp)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.D{
+		{Name: "order", Value: op.Order},
+		{Name: "connection", Value: op.SeenConnectionNum},
+		{Name: "seen", Value: op.Seen.Time},
+		{Name: "src", Value: op.SrcEndpoint},
+		{Name: "dst", Value: op.DstEndpoint},
+		{Name: "requestID", Value: op.Header.RequestID},
+		{Name: "opcode", Value: op.Header.OpCode.String()},
+		{Name: "op", Value: meta.Op},
+		{Name: "ns", Value: ns},
+	}
+	if meta.Command != "" {
+		doc = append(doc, bson.DocElem{Name: "command", Value: meta.Command})
+	}
+	return append(doc, bson.DocElem{Name: "request", Value: request}), nil
+}
+
+// requestOf returns the document sent by an op as the server reads it: the
+// body of an OP_MSG, with its document sequences as arrays of its fields,
+// or the payload of a legacy op.
+func requestOf(parsedOp Op) (interface{}, error) {
+	var msgOp *MsgOp
+	switch castOp := parsedOp.(type) {
+	case *MsgOp:
+		msgOp = castOp
+	case *MsgOpGetMore:
+		msgOp = &castOp.MsgOp
+	case *MsgOpReply:
+		msgOp = &castOp.MsgOp
+	default:
+		return parsedOp.Meta().Data, nil
+	}
+	var body, sequences bson.D
+	for _, section := range msgOp.Sections {
+		switch section.PayloadType {
+		case mgo.MsgPayload0:
+			doc, err := bsonToD(section.Data)
+			if err != nil {
+				return nil, err
+			}
+			body = doc
+		case mgo.MsgPayload1:
+			payload, ok := section.Data.(mgo.PayloadType1)
+			if !ok {
+				continue
+			}
+			docs := make([]interface{}, len(payload.Docs))
+			for i, doc := range payload.Docs {
+				d, err := bsonToD(doc)
+				if err != nil {
+					return nil, err
+				}
+				docs[i] = d
+			}
+			sequences = append(sequences, bson.DocElem{Name: payload.Identifier, Value: docs})
+		}
+	}
+	return append(body, sequences...), nil
+}
+
+// parseOpMatch parses a --match document, compiling its regular
+// expressions.
+func parseOpMatch(text string) (bson.D, error) {
+	match, err := extendedJSONToD([]byte(text))
+	if err != nil {
+		return nil, err
+	}
+	for i, elem := range match {
+		if re, ok := elem.Value.(bson.RegEx); ok {
+			pattern := re.Pattern
+			if strings.Contains(re.Options, "i") {
+				pattern = "(?i)" + pattern
+			}
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression for %v: %v", elem.Name, err)
+			}
+			match[i].Value = compiled
+		}
+	}
+	return match, nil
+}
+
+// opMatches returns whether each field of match, which may be a dotted path,
+// equals that of doc.
+func opMatches(doc bson.D, match bson.D) bool {
+	for _, elem := range match {
+		value, ok := lookupDottedField(doc, elem.Name)
+		if !ok || !valueMatches(elem.Value, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupDottedField returns the value of a field of doc, given by a dotted
+// path through its subdocuments and arrays.
+func lookupDottedField(doc bson.D, path string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, name := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case bson.D:
+			found, ok := FindValueByKey(name, &v)
+			if !ok {
+				return nil, false
+			}
+			value = found
+		case []interface{}:
+			var i int
+			if _, err := fmt.Sscanf(name, "%d", &i); err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// valueMatches returns whether value matches want: numbers match those equal
+// to them whatever their types, and regular expressions the strings they
+// match.
+func valueMatches(want, value interface{}) bool {
+	if re, ok := want.(*regexp.Regexp); ok {
+		s, ok := value.(string)
+		return ok && re.MatchString(s)
+	}
+	wantNum, wantOK := toFloat(want)
+	num, ok := toFloat(value)
+	if wantOK && ok {
+		return wantNum == num
+	}
+	return reflect.DeepEqual(want, value)
+}
+
+// writeDumpDoc writes a dumped op as indented Extended JSON.
+func writeDumpDoc(out io.Writer, doc bson.D, canonical, color bool) error {
+	compact, err := marshalExtJSON(doc, canonical)
+	if err != nil {
+		return err
+	}
+	indented := &bytes.Buffer{}
+	if err := json.Indent(indented, compact, "", "  "); err != nil {
+		return err
+	}
+	output := indented.Bytes()
+	if color {
+		output = highlightJSON(output)
+	}
+	_, err = fmt.Fprintf(out, "%s\n", output)
+	return err
+}
+
+// highlightJSON colors the keys, strings, numbers and literals of valid
+// json.
+func highlightJSON(src []byte) []byte {
+	out := &bytes.Buffer{}
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '"':
+			end := i + 1
+			for end < len(src) && src[end] != '"' {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end++
+			// a string followed by a colon is a key
+			next := end
+			for next < len(src) && (src[next] == ' ' || src[next] == '\n') {
+				next++
+			}
+			color := dumpColorString
+			if next < len(src) && src[next] == ':' {
+				color = dumpColorKey
+			}
+			out.WriteString(color)
+			out.Write(src[i:end])
+			out.WriteString(dumpColorReset)
+			i = end
+		case c == '-' || (c >= '0' && c <= '9') || c == 't' || c == 'f' || c == 'n':
+			end := i
+			for end < len(src) && strings.IndexByte(",]} \n", src[end]) < 0 {
+				end++
+			}
+			color := dumpColorNumber
+			if c == 't' || c == 'f' || c == 'n' {
+				color = dumpColorLiteral
+			}
+			out.WriteString(color)
+			out.Write(src[i:end])
+			out.WriteString(dumpColorReset)
+			i = end
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,135 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// writeDumpTape writes a playback file of 4 OP_MSG inserts, followed by 2
+// finds with their replies.
+func writeDumpTape(t *testing.T, dir string) string {
+	generator := newRecordedOpGenerator()
+	if err := generator.generateMsgOpInsertHelper("dump", 0, 4); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := generator.generateMsgOpFind(bson.D{{"docNum", i}}, 0, int32(100+i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := generator.generateMsgOpReply(int32(100+i), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(generator.opChan)
+
+	path := filepath.Join(dir, "dump.playback")
+	w, err := NewPlaybackFileWriter(path, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for op := range generator.opChan {
+		if err := w.WriteRecordedOp(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	return path
+}
+
+func TestDumpOps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeDumpTape(t, dir)
+
+	type testCase struct {
+		name     string
+		match    string
+		limit    int
+		replies  bool
+		commands []string
+	}
+	cases := []testCase{
+		{name: "every op", commands: []string{"insert", "insert", "insert", "insert", "find", "find"}},
+		{name: "with replies", replies: true, commands: []string{"insert", "insert", "insert", "insert", "find", "reply", "find", "reply"}},
+		{name: "by command and namespace", match: `{"command": "find", "ns": "mongoreplay.test"}`, commands: []string{"find", "find"}},
+		{name: "by regular expression", match: `{"command": /^INS/i}`, limit: 2, commands: []string{"insert", "insert"}},
+		{name: "by document sequence", match: `{"request.documents.0.docNum": 2}`, commands: []string{"insert"}},
+		{name: "by filter", match: `{"request.filter.docNum": 1}`, commands: []string{"find"}},
+		{name: "by other namespace", match: `{"ns": "other.test"}`},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		var match bson.D
+		if c.match != "" {
+			if match, err = parseOpMatch(c.match); err != nil {
+				t.Fatal(err)
+			}
+		}
+		reader, err := NewPlaybackFileReader(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &bytes.Buffer{}
+		dumped, err := dumpOps(reader, out, match, c.limit, c.replies, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dumped != len(c.commands) {
+			t.Errorf("expected %v ops to be dumped, got %v", len(c.commands), dumped)
+		}
+		// the ops are dumped as a stream of indented json documents
+		decoder := json.NewDecoder(out)
+		var commands []string
+		for decoder.More() {
+			var doc struct {
+				Command string `json:"command"`
+			}
+			if err := decoder.Decode(&doc); err != nil {
+				t.Fatal(err)
+			}
+			commands = append(commands, doc.Command)
+		}
+		if strings.Join(commands, ",") != strings.Join(c.commands, ",") {
+			t.Errorf("expected %v to be dumped, got %v", c.commands, commands)
+		}
+	}
+}
+
+func TestParseOpMatch(t *testing.T) {
+	if _, err := parseOpMatch(`{"ns": /[/}`); err == nil || !strings.Contains(err.Error(), "invalid regular expression") {
+		t.Errorf("expected an invalid regular expression to be rejected, got %v", err)
+	}
+	if _, err := parseOpMatch(`{"ns": `); err == nil {
+		t.Errorf("expected invalid json to be rejected")
+	}
+}
+
+func TestHighlightJSON(t *testing.T) {
+	highlighted := string(highlightJSON([]byte(`{"a": "x\"y", "b": [1, -2.5], "c": {"d": true, "e": null}}`)))
+	for _, expected := range []string{
+		dumpColorKey + `"a"` + dumpColorReset + ": " + dumpColorString + `"x\"y"` + dumpColorReset,
+		dumpColorNumber + "1" + dumpColorReset + ", " + dumpColorNumber + "-2.5" + dumpColorReset + "]",
+		dumpColorLiteral + "true" + dumpColorReset,
+		dumpColorLiteral + "null" + dumpColorReset + "}}",
+	} {
+		if !strings.Contains(highlighted, expected) {
+			t.Errorf("expected %q in %q", expected, highlighted)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/mongodb/mongo-tools/common/util"
+)
+
+// formatEndpoint returns the address of one end of a captured connection,
+// made of the IP address of its network endpoint and the port of its
+// transport endpoint, such as 10.0.0.1:27017 or [2001:db8::1]:27017.
+// Link-local IPv6 addresses are only meaningful on the interface they were
+// seen on, which is given as their zone when it is known.
+func formatEndpoint(ip, port gopacket.Endpoint, zone string) string {
+	host := ip.String()
+	if addr := net.IP(ip.Raw()); zone != "" && addr.To4() == nil && addr.IsLinkLocalUnicast() {
+		host += "%" + zone
+	}
+	return net.JoinHostPort(host, port.String())
+}
+
+// normalizeAddr returns the host:port form of a server address, as dialed
+// by mgo. IPv6 addresses are bracketed, with or without a port, and may
+// have a zone, which is unescaped if it comes from a connection string
+// (%25). port is used if the address doesn't have one, and the default
+// port if it is empty.
+func normalizeAddr(addr, port string) string {
+	host := addr
+	if strings.HasPrefix(addr, "[") {
+		if end := strings.Index(addr, "]"); end > 0 {
+			host = addr[1:end]
+			if rest := addr[end+1:]; strings.HasPrefix(rest, ":") {
+				port = rest[1:]
+			}
+		}
+	} else if strings.Count(addr, ":") == 1 {
+		i := strings.Index(addr, ":")
+		host, port = addr[:i], addr[i+1:]
+	}
+	host = strings.Replace(host, "%25", "%", 1)
+	if port == "" {
+		port = util.DefaultPort
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// serverName returns the host of a server address, without the zone of an
+// IPv6 address, as expected in the certificate of the server.
+func serverName(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
@@ -0,0 +1,275 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestNormalizeAddr(t *testing.T) {
+	for _, c := range []struct {
+		addr, port, expected string
+	}{
+		{"db0", "", "db0:27017"},
+		{"db0:27018", "", "db0:27018"},
+		{"db0", "27019", "db0:27019"},
+		{"10.0.0.1:27018", "", "10.0.0.1:27018"},
+		{"2001:db8::1", "", "[2001:db8::1]:27017"},
+		{"2001:db8::1", "27018", "[2001:db8::1]:27018"},
+		{"[2001:db8::1]", "", "[2001:db8::1]:27017"},
+		{"[2001:db8::1]:27018", "", "[2001:db8::1]:27018"},
+		{"[fe80::1%25eth0]:27018", "", "[fe80::1%eth0]:27018"},
+		{"fe80::1%eth0", "", "[fe80::1%eth0]:27017"},
+	} {
+		if normalized := normalizeAddr(c.addr, c.port); normalized != c.expected {
+			t.Errorf("expected %v and port %q to be %v, got %v", c.addr, c.port, c.expected, normalized)
+		}
+	}
+}
+
+func TestServerName(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"db0.example.net:27017": "db0.example.net",
+		"[2001:db8::1]:27017":   "2001:db8::1",
+		"[fe80::1%eth0]:27017":  "fe80::1",
+		"db0.example.net":       "db0.example.net",
+	} {
+		if name := serverName(addr); name != expected {
+			t.Errorf("expected the server name of %v to be %v, got %v", addr, expected, name)
+		}
+	}
+}
+
+func TestIPv6DialInfo(t *testing.T) {
+	for _, c := range []struct {
+		opts  ConnectionOptions
+		addrs []string
+	}{
+		{opts: ConnectionOptions{URI: "mongodb://[2001:db8::1]:27018,[2001:db8::2]/test"},
+			addrs: []string{"[2001:db8::1]:27018", "[2001:db8::2]:27017"}},
+		{opts: ConnectionOptions{URI: "mongodb://[fe80::1%25eth0]:27017"},
+			addrs: []string{"[fe80::1%eth0]:27017"}},
+	} {
+		info, err := c.opts.dialInfo(&DialOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(info.Addrs, c.addrs) {
+			t.Errorf("expected servers %v for %v, got %v", c.addrs, c.opts.URI, info.Addrs)
+		}
+	}
+
+	opts := &ConnectionOptions{}
+	opts.Host = "rs0/2001:db8::1,2001:db8::2"
+	opts.Port = "27018"
+	info, err := opts.dialInfo(&DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"[2001:db8::1]:27018", "[2001:db8::2]:27018"}
+	if !reflect.DeepEqual(info.Addrs, expected) || info.ReplicaSetName != "rs0" {
+		t.Errorf("expected servers rs0/%v, got %v", expected, describeServers(info))
+	}
+}
+
+// tcpPacket returns a decoded packet of a TCP segment sent over IPv4 or IPv6.
+func tcpPacket(t *testing.T, src, dst net.IP, srcPort, dstPort int, seq uint32, payload []byte) gopacket.Packet {
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     seq,
+		ACK:     true,
+		PSH:     true,
+		Window:  65535,
+	}
+	return serializePacket(t, src, dst, tcp, payload)
+}
+
+// synPacket returns a decoded packet of the SYN starting a TCP connection.
+func synPacket(t *testing.T, src, dst net.IP, srcPort, dstPort int, seq uint32) gopacket.Packet {
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     seq,
+		SYN:     true,
+		Window:  65535,
+	}
+	return serializePacket(t, src, dst, tcp, nil)
+}
+
+func serializePacket(t *testing.T, src, dst net.IP, tcp *layers.TCP, payload []byte) gopacket.Packet {
+	var network gopacket.SerializableLayer
+	var firstLayer gopacket.LayerType
+	if src.To4() != nil {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+		tcp.SetNetworkLayerForChecksum(ip)
+		network, firstLayer = ip, layers.LayerTypeIPv4
+	} else {
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+		tcp.SetNetworkLayerForChecksum(ip)
+		network, firstLayer = ip, layers.LayerTypeIPv6
+	}
+	buf := gopacket.NewSerializeBuffer()
+	serializeOpts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, serializeOpts, network, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	pkt := gopacket.NewPacket(buf.Bytes(), firstLayer, gopacket.Default)
+	pkt.Metadata().Timestamp = time.Now()
+	return pkt
+}
+
+// pingQuery returns an OP_QUERY running ping, as sent on the wire.
+func pingQuery(t *testing.T, requestID int32) []byte {
+	doc, err := bson.Marshal(bson.D{{Name: "ping", Value: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := append([]byte{0, 0, 0, 0}, "admin.$cmd\x00"...)
+	body = append(body, 0, 0, 0, 0, 1, 0, 0, 0)
+	body = append(body, doc...)
+	header := MsgHeader{
+		MessageLength: int32(MsgHeaderLen + len(body)),
+		RequestID:     requestID,
+		OpCode:        OpCodeQuery,
+	}
+	return append(header.ToWire(), body...)
+}
+
+// pingMessage returns an OP_MSG running ping, as sent on the wire.
+func pingMessage(t *testing.T, requestID int32) []byte {
+	doc, err := bson.Marshal(bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := append([]byte{0, 0, 0, 0, 0}, doc...)
+	header := MsgHeader{
+		MessageLength: int32(MsgHeaderLen + len(body)),
+		RequestID:     requestID,
+		OpCode:        OpCodeMessage,
+	}
+	return append(header.ToWire(), body...)
+}
+
+// pingReply returns the OP_REPLY to pingQuery, as sent on the wire.
+func pingReply(t *testing.T, requestID, responseTo int32) []byte {
+	doc, err := bson.Marshal(bson.D{{Name: "ok", Value: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, 20)
+	body[16] = 1 // numberReturned
+	body = append(body, doc...)
+	header := MsgHeader{
+		MessageLength: int32(MsgHeaderLen + len(body)),
+		RequestID:     requestID,
+		ResponseTo:    responseTo,
+		OpCode:        OpCodeReply,
+	}
+	return append(header.ToWire(), body...)
+}
+
+// assembleOps assembles packets into the ops of a MongoOpStream capturing
+// on zone, leaving out the EOF ops of the connections.
+func assembleOps(t *testing.T, zone string, pkts []gopacket.Packet) []RecordedOp {
+	opStream := NewMongoOpStream(1)
+	opStream.zone = zone
+	return assembleOpStream(t, opStream, pkts)
+}
+
+func assembleOpStream(t *testing.T, opStream *MongoOpStream, pkts []gopacket.Packet) []RecordedOp {
+	assembler := NewAssembler(NewStreamPool(opStream))
+	done := make(chan []RecordedOp)
+	go func() {
+		var ops []RecordedOp
+		for op := range opStream.Ops {
+			if !op.EOF {
+				ops = append(ops, *op)
+			}
+		}
+		done <- ops
+	}()
+	for _, pkt := range pkts {
+		assemblePacket(assembler, pkt)
+	}
+	assembler.FlushAll()
+	opStream.Close()
+	select {
+	case ops := <-done:
+		return ops
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the assembled ops")
+	}
+	return nil
+}
+
+func TestIPv6Endpoints(t *testing.T) {
+	type testCase struct {
+		name     string
+		src, dst string
+		zone     string
+		expected [2]string
+	}
+	cases := []testCase{
+		{
+			name:     "IPv4",
+			src:      "10.0.0.1",
+			dst:      "10.0.0.2",
+			expected: [2]string{"10.0.0.1:50000", "10.0.0.2:27017"},
+		},
+		{
+			name:     "IPv6",
+			src:      "2001:db8::1",
+			dst:      "2001:db8::2",
+			zone:     "eth0",
+			expected: [2]string{"[2001:db8::1]:50000", "[2001:db8::2]:27017"},
+		},
+		{
+			name:     "link-local IPv6",
+			src:      "fe80::1",
+			dst:      "fe80::2",
+			zone:     "eth0",
+			expected: [2]string{"[fe80::1%eth0]:50000", "[fe80::2%eth0]:27017"},
+		},
+		{
+			name:     "link-local IPv6 read from a file",
+			src:      "fe80::1",
+			dst:      "fe80::2",
+			expected: [2]string{"[fe80::1]:50000", "[fe80::2]:27017"},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		src, dst := net.ParseIP(c.src), net.ParseIP(c.dst)
+		ops := assembleOps(t, c.zone, []gopacket.Packet{
+			tcpPacket(t, src, dst, 50000, 27017, 1000, pingQuery(t, 1)),
+		})
+		if len(ops) != 1 {
+			t.Fatalf("expected 1 op, got %v", len(ops))
+		}
+		if endpoints := [2]string{ops[0].SrcEndpoint, ops[0].DstEndpoint}; endpoints != c.expected {
+			t.Errorf("expected endpoints %v, got %v", c.expected, endpoints)
+		}
+	}
+
+	t.Log("Assembling connections differing only by their addresses")
+	pkts := []gopacket.Packet{
+		tcpPacket(t, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 50000, 27017, 1000, pingQuery(t, 1)),
+		tcpPacket(t, net.ParseIP("2001:db8::3"), net.ParseIP("2001:db8::2"), 50000, 27017, 5000, pingQuery(t, 2)),
+	}
+	ops := assembleOps(t, "", pkts)
+	if len(ops) != 2 || ops[0].SeenConnectionNum == ops[1].SeenConnectionNum {
+		t.Errorf("expected the ops of two connections, got %v", ops)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrorClass groups the errors encountered during playback by their likely
+// cause.
+type ErrorClass string
+
+const (
+	// ErrorClassNetwork holds errors reaching the server or reading its
+	// replies.
+	ErrorClassNetwork ErrorClass = "network"
+	// ErrorClassCursorNotFound holds errors on cursors the server no longer
+	// has, often because the ops which created them were not replayed.
+	ErrorClassCursorNotFound ErrorClass = "cursorNotFound"
+	// ErrorClassAuth holds authentication and authorization errors.
+	ErrorClassAuth ErrorClass = "auth"
+	// ErrorClassServer holds every other error returned by the server.
+	ErrorClassServer ErrorClass = "server"
+	// ErrorClassOther holds every other error encountered playing an op.
+	ErrorClassOther ErrorClass = "other"
+)
+
+// ErrThresholdExceeded is returned when a playback completes but fails a
+// threshold set on its results, such as --maxErrorRate.
+type ErrThresholdExceeded struct {
+	Reason string
+}
+
+func (e ErrThresholdExceeded) Error() string {
+	return fmt.Sprintf("playback failed threshold: %v", e.Reason)
+}
+
+var (
+	authMessages = []string{"not authorized", "unauthorized", "authentication failed",
+		"auth failed", "requires authentication"}
+	networkMessages = []string{"connection reset", "broken pipe", "connection refused", "i/o timeout",
+		"closed explicitly", "no reachable servers", "eof"}
+)
+
+func containsAny(s string, substrings []string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(s, substring) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyServerError classifies an error found in a reply from the server.
+func classifyServerError(err error) ErrorClass {
+	message := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(message, "cursornotfound"),
+		strings.Contains(message, "cursor") && strings.Contains(message, "not found"):
+		return ErrorClassCursorNotFound
+	case containsAny(message, authMessages):
+		return ErrorClassAuth
+	}
+	return ErrorClassServer
+}
+
+// classifyExecutionError classifies an error encountered sending an op or
+// waiting for its reply.
+func classifyExecutionError(err error) ErrorClass {
+	if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrorClassNetwork
+	}
+	message := strings.ToLower(err.Error())
+	switch {
+	case containsAny(message, networkMessages):
+		return ErrorClassNetwork
+	case containsAny(message, authMessages):
+		return ErrorClassAuth
+	}
+	return ErrorClassOther
+}
+
+// errorSummary counts the ops played and the errors they encountered, by
+// class.
+type errorSummary struct {
+	sync.Mutex
+	opsPlayed     int64
+	opsWithErrors int64
+	counts        map[ErrorClass]int64
+}
+
+// observe counts an op that was played, with the error encountered
+// executing it and the errors found in its reply.
+func (summary *errorSummary) observe(executionErr error, reply Replyable) {
+	var classes []ErrorClass
+	if executionErr != nil {
+		classes = append(classes, classifyExecutionError(executionErr))
+	}
+	if reply != nil {
+		for _, err := range reply.getErrors() {
+			classes = append(classes, classifyServerError(err))
+		}
+	}
+	summary.Lock()
+	defer summary.Unlock()
+	summary.opsPlayed++
+	if len(classes) == 0 {
+		return
+	}
+	summary.opsWithErrors++
+	if summary.counts == nil {
+		summary.counts = map[ErrorClass]int64{}
+	}
+	for _, class := range classes {
+		summary.counts[class]++
+	}
+}
+
+// merge adds the ops and errors counted by other to the summary.
+func (summary *errorSummary) merge(other *errorSummary) {
+	other.Lock()
+	defer other.Unlock()
+	summary.Lock()
+	defer summary.Unlock()
+	summary.opsPlayed += other.opsPlayed
+	summary.opsWithErrors += other.opsWithErrors
+	for class, count := range other.counts {
+		if summary.counts == nil {
+			summary.counts = map[ErrorClass]int64{}
+		}
+		summary.counts[class] += count
+	}
+}
+
+// String lists the error counts by class, from most to least frequent.
+func (summary *errorSummary) String() string {
+	summary.Lock()
+	defer summary.Unlock()
+	classes := make([]ErrorClass, 0, len(summary.counts))
+	for class := range summary.counts {
+		classes = append(classes, class)
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		if summary.counts[classes[i]] != summary.counts[classes[j]] {
+			return summary.counts[classes[i]] > summary.counts[classes[j]]
+		}
+		return classes[i] < classes[j]
+	})
+	parts := make([]string, len(classes))
+	for i, class := range classes {
+		parts[i] = fmt.Sprintf("%v %v", class, summary.counts[class])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ErrorCounts returns the number of errors encountered during playback in
+// each class.
+func (context *ExecutionContext) ErrorCounts() map[ErrorClass]int64 {
+	context.errors.Lock()
+	defer context.errors.Unlock()
+	counts := make(map[ErrorClass]int64, len(context.errors.counts))
+	for class, count := range context.errors.counts {
+		counts[class] = count
+	}
+	return counts
+}
+
+// ErrorRate returns the fraction of the ops played which encountered an
+// error.
+func (context *ExecutionContext) ErrorRate() float64 {
+	context.errors.Lock()
+	defer context.errors.Unlock()
+	if context.errors.opsPlayed == 0 {
+		return 0
+	}
+	return float64(context.errors.opsWithErrors) / float64(context.errors.opsPlayed)
+}
+
+// parseRate parses a rate given either as a percentage, such as "1%", or as
+// a fraction, such as "0.01".
+func parseRate(setting string) (float64, error) {
+	value := strings.TrimSpace(setting)
+	percent := strings.HasSuffix(value, "%")
+	value = strings.TrimSuffix(value, "%")
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("'%v' is not a percentage or a fraction", setting)
+	}
+	if percent {
+		rate /= 100
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("'%v' is not between 0 and 100%%", setting)
+	}
+	return rate, nil
+}
@@ -0,0 +1,94 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestClassifyErrors(t *testing.T) {
+	serverCases := []struct {
+		message  string
+		expected ErrorClass
+	}{
+		{"cursor id 12345 not found", ErrorClassCursorNotFound},
+		{"Cursor not found, cursor id: 12345", ErrorClassCursorNotFound},
+		{"not authorized on test to execute command { find: \"c\" }", ErrorClassAuth},
+		{"Authentication failed.", ErrorClassAuth},
+		{"E11000 duplicate key error collection: test.c index: _id_", ErrorClassServer},
+	}
+	for _, c := range serverCases {
+		t.Logf("running case: %s", c.message)
+		if class := classifyServerError(fmt.Errorf("%v", c.message)); class != c.expected {
+			t.Errorf("expected class %v, saw %v", c.expected, class)
+		}
+	}
+
+	executionCases := []struct {
+		err      error
+		expected ErrorClass
+	}{
+		{io.EOF, ErrorClassNetwork},
+		{fmt.Errorf("error executing op: read tcp 127.0.0.1:1234: i/o timeout"), ErrorClassNetwork},
+		{fmt.Errorf("error executing op: Closed explicitly"), ErrorClassNetwork},
+		{fmt.Errorf("ParseOpRawError: bad message"), ErrorClassOther},
+	}
+	for _, c := range executionCases {
+		t.Logf("running case: %v", c.err)
+		if class := classifyExecutionError(c.err); class != c.expected {
+			t.Errorf("expected class %v, saw %v", c.expected, class)
+		}
+	}
+}
+
+func TestErrorSummary(t *testing.T) {
+	context := NewExecutionContext(nil, nil, &ExecutionOptions{})
+	if rate := context.ErrorRate(); rate != 0 {
+		t.Errorf("expected no errors before playback, saw a rate of %v", rate)
+	}
+	context.errors.observe(nil, nil)
+	context.errors.observe(io.EOF, nil)
+	context.errors.observe(fmt.Errorf("error executing op: EOF"), nil)
+	context.errors.observe(nil, nil)
+
+	if rate := context.ErrorRate(); rate != 0.5 {
+		t.Errorf("expected an error rate of 0.5, saw %v", rate)
+	}
+	if counts := context.ErrorCounts(); len(counts) != 1 || counts[ErrorClassNetwork] != 2 {
+		t.Errorf("unexpected error counts %v", counts)
+	}
+	if summary := context.errors.String(); summary != "network 2" {
+		t.Errorf("unexpected summary %q", summary)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	testCases := []struct {
+		setting  string
+		expected float64
+		valid    bool
+	}{
+		{"1%", 0.01, true},
+		{"0.5", 0.5, true},
+		{" 100% ", 1, true},
+		{"0", 0, true},
+		{"150%", 0, false},
+		{"-1", 0, false},
+		{"lots", 0, false},
+	}
+	for _, c := range testCases {
+		t.Logf("running case: %s", c.setting)
+		rate, err := parseRate(c.setting)
+		if (err == nil) != c.valid {
+			t.Errorf("expected valid to be %v, saw error %v", c.valid, err)
+		} else if rate != c.expected {
+			t.Errorf("expected %v, saw %v", c.expected, rate)
+		}
+	}
+}
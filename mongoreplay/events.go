@@ -0,0 +1,206 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressTickInterval is how often a ProgressTick event is sent while
+// playback is running.
+const progressTickInterval = time.Second
+
+// EventType identifies the kind of an Event.
+type EventType int
+
+const (
+	// OpDispatched is sent when an op is about to be played on its
+	// connection.
+	OpDispatched EventType = iota
+	// OpCompleted is sent once an op has been played, or skipped.
+	OpCompleted
+	// ConnectionOpened is sent when a connection of the playback is opened.
+	ConnectionOpened
+	// ConnectionClosed is sent once a connection of the playback has played
+	// all of its ops.
+	ConnectionClosed
+	// EventError is sent when an op or a connection fails.
+	EventError
+	// ProgressTick is sent periodically while playback is running, and once
+	// more when it finishes.
+	ProgressTick
+)
+
+var eventTypeNames = map[EventType]string{
+	OpDispatched:     "OpDispatched",
+	OpCompleted:      "OpCompleted",
+	ConnectionOpened: "ConnectionOpened",
+	ConnectionClosed: "ConnectionClosed",
+	EventError:       "EventError",
+	ProgressTick:     "ProgressTick",
+}
+
+func (eventType EventType) String() string {
+	if name, ok := eventTypeNames[eventType]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// Event describes something that happened during playback. Only the fields
+// relevant to its Type are set.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// ConnectionNum is the number of the connection the op is played on, or
+	// of the connection that was opened or closed.
+	ConnectionNum int64
+
+	// Op is the op that was dispatched, completed or failed.
+	Op *RecordedOp
+
+	// Latency is the time taken to play the op of an OpCompleted event.
+	Latency time.Duration
+
+	// Err is the error of an Error event, or of the op of an OpCompleted
+	// event.
+	Err error
+
+	// Progress is the progress of the playback at a ProgressTick event.
+	Progress *Progress
+}
+
+// Progress summarizes how far along a playback is.
+type Progress struct {
+	OpsDispatched   int64
+	OpsCompleted    int64
+	Errors          int64
+	OpenConnections int64
+	Elapsed         time.Duration
+}
+
+// eventBus distributes Events to the channels returned by
+// ExecutionContext.Events. Events are never waited on: an event is dropped
+// for a subscriber whose channel is full, so that a slow subscriber does not
+// hold up playback.
+type eventBus struct {
+	lock        sync.RWMutex
+	subscribers []chan Event
+	closed      bool
+
+	// the counters are accessed atomically
+	dropped         int64
+	opsDispatched   int64
+	opsCompleted    int64
+	errors          int64
+	openConnections int64
+}
+
+// Events returns a channel on which the events of the playback are sent, for
+// programs embedding mongoreplay to report on or control it. It must be
+// called before playback starts, and the channel is closed once playback
+// finishes. Events are dropped rather than waited on when the channel's
+// buffer of size bufferSize is full; DroppedEvents reports how many were.
+func (context *ExecutionContext) Events(bufferSize int) <-chan Event {
+	ch := make(chan Event, bufferSize)
+	context.events.lock.Lock()
+	defer context.events.lock.Unlock()
+	if context.events.closed {
+		close(ch)
+	} else {
+		context.events.subscribers = append(context.events.subscribers, ch)
+	}
+	return ch
+}
+
+// DroppedEvents returns the number of events that were dropped because the
+// channel of a subscriber was full.
+func (context *ExecutionContext) DroppedEvents() int64 {
+	return atomic.LoadInt64(&context.events.dropped)
+}
+
+// send updates the progress counters with the event and passes it to every
+// subscriber.
+func (bus *eventBus) send(event Event) {
+	switch event.Type {
+	case OpDispatched:
+		atomic.AddInt64(&bus.opsDispatched, 1)
+	case OpCompleted:
+		atomic.AddInt64(&bus.opsCompleted, 1)
+	case ConnectionOpened:
+		atomic.AddInt64(&bus.openConnections, 1)
+	case ConnectionClosed:
+		atomic.AddInt64(&bus.openConnections, -1)
+	case EventError:
+		atomic.AddInt64(&bus.errors, 1)
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+	for _, ch := range bus.subscribers {
+		select {
+		case ch <- event:
+		default:
+			atomic.AddInt64(&bus.dropped, 1)
+		}
+	}
+}
+
+// progress returns the progress of a playback started at start.
+func (bus *eventBus) progress(start time.Time) *Progress {
+	return &Progress{
+		OpsDispatched:   atomic.LoadInt64(&bus.opsDispatched),
+		OpsCompleted:    atomic.LoadInt64(&bus.opsCompleted),
+		Errors:          atomic.LoadInt64(&bus.errors),
+		OpenConnections: atomic.LoadInt64(&bus.openConnections),
+		Elapsed:         time.Since(start),
+	}
+}
+
+// startProgressTicks sends a ProgressTick event every progressTickInterval
+// until the returned function is called, which sends a final one.
+func (bus *eventBus) startProgressTicks(start time.Time) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(progressTickInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				bus.send(Event{Type: ProgressTick, Progress: bus.progress(start)})
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		bus.send(Event{Type: ProgressTick, Progress: bus.progress(start)})
+	}
+}
+
+// close closes the channels of every subscriber.
+func (bus *eventBus) close() {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	if bus.closed {
+		return
+	}
+	bus.closed = true
+	for _, ch := range bus.subscribers {
+		close(ch)
+	}
+	bus.subscribers = nil
+}
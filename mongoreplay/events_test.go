@@ -0,0 +1,81 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"testing"
+)
+
+func TestPlayEvents(t *testing.T) {
+	numInserts := 3
+	generator := newRecordedOpGenerator()
+	go func() {
+		defer close(generator.opChan)
+		if err := generator.generateMsgOpInsertHelper("events", 0, numInserts); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	statCollector, _ := NewStatCollector(StatOptions{Buffered: true}, "format", true, true)
+	context := NewExecutionContext(statCollector, nil, &ExecutionOptions{fullSpeed: true, dryRun: true})
+	events := context.Events(100)
+	if err := Play(context, generator.opChan, 1, 1, 10); err != nil {
+		t.Fatalf("error playing traffic: %v", err)
+	}
+
+	counts := map[EventType]int{}
+	var last Event
+	for event := range events {
+		counts[event.Type]++
+		if (event.Type == OpDispatched || event.Type == OpCompleted) && event.Op == nil {
+			t.Errorf("%v event without an op", event.Type)
+		}
+		last = event
+	}
+	expected := map[EventType]int{
+		ConnectionOpened: 1,
+		OpDispatched:     numInserts,
+		OpCompleted:      numInserts,
+		ConnectionClosed: 1,
+	}
+	for eventType, count := range expected {
+		if counts[eventType] != count {
+			t.Errorf("expected %v %v events, saw %v", count, eventType, counts[eventType])
+		}
+	}
+	if last.Type != ProgressTick {
+		t.Fatalf("expected the last event to be a ProgressTick, saw %v", last.Type)
+	}
+	if last.Progress.OpsCompleted != int64(numInserts) || last.Progress.OpenConnections != 0 {
+		t.Errorf("unexpected final progress: %#v", last.Progress)
+	}
+	if dropped := context.DroppedEvents(); dropped != 0 {
+		t.Errorf("expected no dropped events, saw %v", dropped)
+	}
+}
+
+func TestEventsDropped(t *testing.T) {
+	context := NewExecutionContext(nil, nil, &ExecutionOptions{})
+	events := context.Events(1)
+	context.events.send(Event{Type: OpDispatched})
+	context.events.send(Event{Type: OpDispatched})
+	context.events.close()
+
+	if dropped := context.DroppedEvents(); dropped != 1 {
+		t.Errorf("expected 1 dropped event, saw %v", dropped)
+	}
+	if event := <-events; event.Type != OpDispatched || event.Time.IsZero() {
+		t.Errorf("unexpected event: %#v", event)
+	}
+	if _, ok := <-events; ok {
+		t.Errorf("expected the events channel to be closed")
+	}
+	// subscribing after playback finished returns a closed channel
+	if _, ok := <-context.Events(1); ok {
+		t.Errorf("expected a closed events channel")
+	}
+}
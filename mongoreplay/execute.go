@@ -7,8 +7,10 @@
 package mongoreplay
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	mgo "github.com/10gen/llmgo"
@@ -19,8 +21,19 @@ import (
 // occupied.
 type ReplyPair struct {
 	ops [2]Replyable
+	// origin is the op the live reply replied to, kept when its cursor may
+	// have to be reissued.
+	origin Op
 }
 
+// ErrDestructiveOpBlocked is returned when a destructive command is not played
+// because destructive commands were not allowed.
+var ErrDestructiveOpBlocked = fmt.Errorf("destructive command not played")
+
+// ErrCursorsNotMapped is the reason given to SkippedOpHooks for the ops which
+// are not sent because none of their cursors were opened during playback.
+var ErrCursorsNotMapped = fmt.Errorf("op on cursors not opened during playback skipped")
+
 const (
 	// ReplyFromWire is the ReplyPair index for live replies.
 	ReplyFromWire = 0
@@ -50,6 +63,15 @@ type ExecutionContext struct {
 
 	*StatCollector
 
+	// Pacing determines when each op is played. If unset when playback
+	// begins, ops follow the timing of the recording.
+	Pacing PacingStrategy
+
+	// PreOpHooks and PostOpHooks are called before each op is sent and after
+	// its reply is received, in order.
+	PreOpHooks  []PreOpHook
+	PostOpHooks []PostOpHook
+
 	// fullSpeed is a control to indicate whether the tool will sleep to synchronize
 	// the playback of operations or if it will play back all operations as fast
 	// as possible.
@@ -57,6 +79,232 @@ type ExecutionContext struct {
 
 	driverOpsFiltered bool
 
+	// allowDestructive disables the safety guard which prevents commands
+	// such as dropDatabase and shutdown from being played.
+	allowDestructive bool
+
+	// blockedOps counts the destructive commands that were not played. It
+	// must be accessed atomically.
+	blockedOps int64
+
+	// playOnly, when set, restricts the ops played to reads or to writes.
+	// Ops which are neither are always played.
+	playOnly string
+
+	// filteredOps counts the ops that were not played because of playOnly.
+	// It must be accessed atomically.
+	filteredOps int64
+
+	// readPreference, when set, replaces the read preference of every
+	// replayed read and determines which members the connections target.
+	readPreference *readPreference
+
+	// hedgedReads, when set, enables or disables hedging of every replayed
+	// read with a non-primary read preference.
+	hedgedReads *bool
+
+	// serverAPI, when set, is the Stable API version declared by every
+	// replayed command.
+	serverAPI *serverAPI
+
+	// explain, when set, causes the queries to be explained rather than
+	// executed, and collects their plans by query shape.
+	explain *explainer
+
+	// dryRun causes ops to be processed as for playback but never sent, and
+	// no connections to be opened.
+	dryRun bool
+
+	// dryRunOps counts the ops that would have been executed during a dry
+	// run. It must be accessed atomically.
+	dryRunOps int64
+
+	// warmup is the length of the beginning of the playback whose
+	// connections are opened before playback starts.
+	warmup time.Duration
+
+	// warmSockets holds the sockets opened before playback started which
+	// have yet to be used by a connection.
+	warmSockets chan *mgo.MongoSocket
+
+	// checkpoint, when set, tracks the progress of the playback and writes
+	// it to a checkpoint file.
+	checkpoint         *checkpointer
+	checkpointInterval time.Duration
+
+	// resumeFrom, when set, causes the ops that were played before the
+	// checkpoint was written to be skipped.
+	resumeFrom *PlaybackCheckpoint
+
+	// drainTimeout bounds how long an interrupted playback waits for the ops
+	// in flight to complete before their connections are closed.
+	drainTimeout time.Duration
+
+	// liveSockets holds the sockets used by the connections of the playback,
+	// so that they can be closed if an interrupted playback must stop
+	// waiting for replies.
+	liveSockets     map[*mgo.MongoSocket]bool
+	liveSocketsLock sync.Mutex
+
+	// errors counts the ops played and the errors they encountered.
+	errors errorSummary
+
+	// latencies counts the latencies of the ops played, for checking
+	// assertions.
+	latencies latencySummary
+
+	// connections holds the summaries of the recorded connections once they
+	// have finished playing, and behindThreshold is how far behind the
+	// recorded timeline their ops may be played before they are reported as
+	// having fallen behind; 0 doesn't report them.
+	connections     connectionSummaries
+	behindThreshold time.Duration
+
+	// maxLag, when set, aborts the playback once an op is played further
+	// behind the recorded timeline. laggingConnections counts the
+	// connections which have fallen behind it by more than behindThreshold,
+	// and lagWarnedAt holds when the last warning that playback is falling
+	// behind was logged, in nanoseconds since the epoch. They must be
+	// accessed atomically.
+	maxLag             time.Duration
+	laggingConnections int64
+	lagWarnedAt        int64
+
+	// quiet suppresses the summary logged when playback finishes, for the
+	// copies of an amplified playback, which are summarized together.
+	quiet bool
+
+	// events passes the events of the playback to the channels returned by
+	// Events.
+	events eventBus
+
+	// opTimeout bounds how long an op waits for its reply, and retry
+	// determines whether the ops which fail with transient errors are sent
+	// again.
+	opTimeout time.Duration
+	retry     retryPolicy
+
+	// retriedOps and abandonedOps count the ops sent again and those which
+	// failed once retried as many times as allowed. They must be accessed
+	// atomically.
+	retriedOps   int64
+	abandonedOps int64
+
+	// cursorPolicy determines how the getMores of cursors not found on the
+	// server are handled, as set by --cursorNotFound.
+	cursorPolicy string
+
+	// cursorOrigins holds the ops which created the cursors of the playback
+	// file, by their cursorIDs in the file, to be reissued when
+	// cursorPolicy is reissue. cursorOriginsLock guards the cursorOrigins,
+	// but isn't held while their ops are reissued.
+	cursorOrigins     *cache.Cache
+	cursorOriginsLock sync.Mutex
+
+	// cursorLeaks tracks the live cursors which the playback file has not
+	// exhausted or killed.
+	cursorLeaks *cursorLeaks
+
+	// skippedGetMores and reissuedQueries count the getMores not played and
+	// the queries played again because their cursors were not found. They
+	// must be accessed atomically.
+	skippedGetMores int64
+	reissuedQueries int64
+
+	// abort, when set, stops the playback with an error.
+	abort func(error)
+
+	// strictOrder causes each op to wait until the previous op of its
+	// connection has been acknowledged, and a connection to stop playing
+	// once one of its ops fails with a network error.
+	strictOrder bool
+
+	// limits, when set, caps the connections opened to the host and the ops
+	// played on it at the same time.
+	limits *hostLimits
+
+	// watchdog, when set, tracks the ops in flight so that those currentOp
+	// reports as running for too long can be traced to their recorded ops.
+	watchdog *opWatchdog
+
+	// pool, when set, holds the live sockets shared by the recorded
+	// connections, which otherwise each open one of their own.
+	pool *socketPool
+
+	// barriers are the points of the playback at which the ops sent to the
+	// connections must complete before any op after them is played, and
+	// pendingOps counts the ops sent to the connections which haven't
+	// completed.
+	barriers   []*playbackPoint
+	pendingOps sync.WaitGroup
+
+	// brokenConnectionOps counts the ops not played because their
+	// connection failed with strictOrder set. It must be accessed
+	// atomically.
+	brokenConnectionOps int64
+
+	// translate causes legacy ops to be played as the equivalent OP_MSG
+	// commands.
+	translate bool
+
+	// translatedOps counts the legacy ops that were translated, and
+	// droppedGetLastErrors the getLastError commands not played as they
+	// were. They must be accessed atomically.
+	translatedOps        int64
+	droppedGetLastErrors int64
+
+	// maxAwait and tailableBudget, when set, bound how long the getMores of
+	// a tailable cursor wait for new results, each and in total.
+	maxAwait       time.Duration
+	tailableBudget time.Duration
+
+	// tailableCursors holds the live tailable cursors, by cursorID, if
+	// their waits are bounded.
+	tailableCursors *cache.Cache
+
+	// truncatedWaits and budgetSpentGetMores count the getMores whose wait
+	// was shortened and those not played. They must be accessed atomically.
+	truncatedWaits      int64
+	budgetSpentGetMores int64
+
+	// changeStreamResume is how the options of change streams resuming
+	// from a recorded position are played.
+	changeStreamResume string
+
+	// changeStreamTokens maps the recorded resume tokens of change streams
+	// to the live ones, if they are remapped.
+	changeStreamTokens *cache.Cache
+
+	// remappedResumeTokens and restartedChangeStreams count the change
+	// streams resumed from a remapped token and those restarted from now.
+	// They must be accessed atomically.
+	remappedResumeTokens   int64
+	restartedChangeStreams int64
+
+	// exhaustStreams holds the keys of the recorded replies which would
+	// continue the stream of batches of an exhaust cursor.
+	exhaustStreams *cache.Cache
+
+	// exhaustBatches counts the batches of exhaust cursors fetched with
+	// getMores. It must be accessed atomically.
+	exhaustBatches int64
+
+	// unacknowledgedWrites counts the writes played which the server didn't
+	// acknowledge. It must be accessed atomically.
+	unacknowledgedWrites int64
+
+	// downconvert causes OP_MSG find, getMore and insert commands to be
+	// played as the equivalent legacy ops.
+	downconvert bool
+
+	// downconvertedOps counts the OP_MSG commands that were downconverted.
+	// It must be accessed atomically.
+	downconvertedOps int64
+
+	// clock, when set, is the clock of a playback controlled through
+	// --controlAddr, which the ops wait on to be played.
+	clock *playbackClock
+
 	session *mgo.Session
 }
 
@@ -65,19 +313,101 @@ type ExecutionContext struct {
 type ExecutionOptions struct {
 	fullSpeed         bool
 	driverOpsFiltered bool
+	allowDestructive  bool
+	playOnly          string
+	dryRun            bool
+	warmup            time.Duration
+	readPreference    *readPreference
+	hedgedReads       *bool
+	serverAPI         *serverAPI
+	explain           *explainer
+	quiet             bool
+	behindThreshold   time.Duration
+	maxLag            time.Duration
+
+	checkpointFile     string
+	checkpointInterval time.Duration
+	playbackFile       string
+	resumeFrom         *PlaybackCheckpoint
+	drainTimeout       time.Duration
+	opTimeout          time.Duration
+	retry              retryPolicy
+	cursorPolicy       string
+	strictOrder        bool
+	translate          bool
+	downconvert        bool
+	connectionModel    string
+	poolSize           int
+	maxAwait           time.Duration
+	tailableBudget     time.Duration
+	changeStreamResume string
+	barriers           []*playbackPoint
 }
 
 // NewExecutionContext initializes a new ExecutionContext.
 func NewExecutionContext(statColl *StatCollector, session *mgo.Session, options *ExecutionOptions) *ExecutionContext {
-	return &ExecutionContext{
-		IncompleteReplies: cache.New(60*time.Second, 60*time.Second),
-		CompleteReplies:   map[string]*ReplyPair{},
-		CursorIDMap:       newCursorCache(),
-		StatCollector:     statColl,
-		fullSpeed:         options.fullSpeed,
-		driverOpsFiltered: options.driverOpsFiltered,
-		session:           session,
+	var checkpoint *checkpointer
+	if options.checkpointFile != "" {
+		checkpoint = newCheckpointer(options.checkpointFile, options.playbackFile, options.resumeFrom)
+	}
+	var cursorOrigins *cache.Cache
+	if options.cursorPolicy == cursorNotFoundReissue {
+		cursorOrigins = cache.New(cursorOriginTimeout, 60*time.Second)
+	}
+	cursorPolicy := options.cursorPolicy
+	if cursorPolicy == "" {
+		cursorPolicy = cursorNotFoundError
+	}
+	context := &ExecutionContext{
+		IncompleteReplies:  cache.New(60*time.Second, 60*time.Second),
+		CompleteReplies:    map[string]*ReplyPair{},
+		exhaustStreams:     cache.New(60*time.Second, 60*time.Second),
+		CursorIDMap:        newCursorCache(),
+		StatCollector:      statColl,
+		fullSpeed:          options.fullSpeed,
+		driverOpsFiltered:  options.driverOpsFiltered,
+		allowDestructive:   options.allowDestructive,
+		playOnly:           options.playOnly,
+		dryRun:             options.dryRun,
+		warmup:             options.warmup,
+		checkpoint:         checkpoint,
+		checkpointInterval: options.checkpointInterval,
+		resumeFrom:         options.resumeFrom,
+		drainTimeout:       options.drainTimeout,
+		opTimeout:          options.opTimeout,
+		retry:              options.retry,
+		cursorPolicy:       cursorPolicy,
+		cursorOrigins:      cursorOrigins,
+		strictOrder:        options.strictOrder,
+		maxAwait:           options.maxAwait,
+		tailableBudget:     options.tailableBudget,
+		changeStreamResume: options.changeStreamResume,
+		translate:          options.translate,
+		downconvert:        options.downconvert,
+		liveSockets:        map[*mgo.MongoSocket]bool{},
+		readPreference:     options.readPreference,
+		hedgedReads:        options.hedgedReads,
+		serverAPI:          options.serverAPI,
+		explain:            options.explain,
+		quiet:              options.quiet,
+		behindThreshold:    options.behindThreshold,
+		maxLag:             options.maxLag,
+		barriers:           options.barriers,
+		session:            session,
+	}
+	if !options.dryRun {
+		context.cursorLeaks = newCursorLeaks()
 	}
+	if options.maxAwait > 0 || options.tailableBudget > 0 {
+		context.tailableCursors = cache.New(cursorOriginTimeout, 60*time.Second)
+	}
+	if options.changeStreamResume == changeStreamResumeRemap {
+		context.changeStreamTokens = cache.New(cursorOriginTimeout, 60*time.Second)
+	}
+	if options.connectionModel != "" && options.connectionModel != connectionModelPerConnection && !options.dryRun {
+		context.pool = newSocketPool(context, options.connectionModel, options.poolSize)
+	}
+	return context
 }
 
 // AddFromWire adds a from-wire reply to its IncompleteReplies ReplyPair and
@@ -85,12 +415,26 @@ func NewExecutionContext(statColl *StatCollector, session *mgo.Session, options
 // on the src/dest of the recordedOp which should be the op that this ReplyOp is
 // a reply to.
 func (context *ExecutionContext) AddFromWire(reply Replyable, recordedOp *RecordedOp) {
+	context.addFromWire(reply, recordedOp, nil)
+}
+
+// addFromWire works like AddFromWire, keeping the op the reply replied to
+// if its cursor may have to be reissued. Unless the getMores of cursors not
+// found on the server are played as errors, the replies to reads without a
+// cursor are added too, so that the getMores of the cursors they exhausted
+// are known not to be found.
+func (context *ExecutionContext) addFromWire(reply Replyable, recordedOp *RecordedOp, origin Op) {
 	if cursorID, _ := reply.getCursorID(); cursorID == 0 {
-		return
+		if origin == nil || context.cursorPolicy == cursorNotFoundError || opKindOf(origin) != opKindRead {
+			return
+		}
+	}
+	if _, ok := origin.(cursorsRewriteable); ok || context.cursorOrigins == nil {
+		origin = nil
 	}
 	key := cacheKey(recordedOp, false)
 	toolDebugLogger.Logvf(DebugHigh, "Adding live reply with key %v", key)
-	context.completeReply(key, reply, ReplyFromWire)
+	context.completeReply(key, reply, ReplyFromWire, origin)
 }
 
 // AddFromFile adds a from-file reply to its IncompleteReplies ReplyPair and
@@ -98,23 +442,29 @@ func (context *ExecutionContext) AddFromWire(reply Replyable, recordedOp *Record
 // on the reversed src/dest of the recordedOp which should the RecordedOp that
 // this ReplyOp was unmarshaled out of.
 func (context *ExecutionContext) AddFromFile(reply Replyable, recordedOp *RecordedOp) {
+	if context.continuesExhaustStream(reply, recordedOp) {
+		return
+	}
 	if cursorID, _ := reply.getCursorID(); cursorID == 0 {
 		return
 	}
 	key := cacheKey(recordedOp, true)
 	toolDebugLogger.Logvf(DebugHigh, "Adding recorded reply with key %v", key)
-	context.completeReply(key, reply, ReplyFromFile)
+	context.completeReply(key, reply, ReplyFromFile, nil)
 }
 
-func (context *ExecutionContext) completeReply(key string, reply Replyable, opSource int) {
+func (context *ExecutionContext) completeReply(key string, reply Replyable, opSource int, origin Op) {
 	context.Lock()
 	if cacheValue, ok := context.IncompleteReplies.Get(key); !ok {
-		rp := &ReplyPair{}
+		rp := &ReplyPair{origin: origin}
 		rp.ops[opSource] = reply
 		context.IncompleteReplies.Set(key, rp, cache.DefaultExpiration)
 	} else {
 		rp := cacheValue.(*ReplyPair)
 		rp.ops[opSource] = reply
+		if origin != nil {
+			rp.origin = origin
+		}
 		if rp.ops[1-opSource] != nil {
 			context.CompleteReplies[key] = rp
 			context.IncompleteReplies.Delete(key)
@@ -129,6 +479,11 @@ func (context *ExecutionContext) rewriteCursors(rewriteable cursorsRewriteable,
 	index := 0
 	for _, cursorID := range cursorIDs {
 		userInfoLogger.Logvf(DebugLow, "Rewriting cursorID : %v", cursorID)
+		if liveCursorID, ok := context.reissuedCursor(cursorID); ok {
+			cursorIDs[index] = liveCursorID
+			index++
+			continue
+		}
 		liveCursorID, ok := context.CursorIDMap.GetCursor(cursorID, connectionNum)
 		if ok {
 			cursorIDs[index] = liveCursorID
@@ -159,6 +514,12 @@ func (context *ExecutionContext) handleCompletedReplies() error {
 		}
 		if cursorFromFile != 0 {
 			context.CursorIDMap.SetCursor(cursorFromFile, cursorFromWire)
+			if rp.origin != nil {
+				context.setCursorOrigin(cursorFromFile, rp.origin)
+			}
+		}
+		if context.changeStreamTokens != nil {
+			context.mapResumeTokens(rp.ops[ReplyFromFile], rp.ops[ReplyFromWire])
 		}
 
 		delete(context.CompleteReplies, key)
@@ -168,42 +529,215 @@ func (context *ExecutionContext) handleCompletedReplies() error {
 	return nil
 }
 
-func (context *ExecutionContext) newExecutionConnection(start time.Time, connectionNum int64) chan<- *RecordedOp {
-	ch := make(chan *RecordedOp, 10000)
+// acquireSocket returns a socket for a replayed connection, using one opened
+// ahead of playback if any remain.
+func (context *ExecutionContext) acquireSocket() (*mgo.MongoSocket, error) {
+	select {
+	case socket, ok := <-context.warmSockets:
+		if ok {
+			return socket, nil
+		}
+	default:
+	}
+	return context.dialSocket()
+}
+
+// dialSocket opens a new socket. Sockets target the primary unless a read
+// preference override selects other members.
+func (context *ExecutionContext) dialSocket() (*mgo.MongoSocket, error) {
+	var socket *mgo.MongoSocket
+	var err error
+	if context.readPreference == nil {
+		socket, err = context.session.AcquireSocketDirect()
+	} else {
+		session := context.session.Copy()
+		defer session.Close()
+		session.SetMode(context.readPreference.mode, true)
+		session.SelectServers(context.readPreference.tags...)
+		socket, err = session.AcquireSocketPrivate(true)
+	}
+	if err == nil && context.opTimeout > 0 {
+		socket.SetTimeout(context.opTimeout)
+	}
+	return socket, err
+}
+
+// drainConnections waits for the connections of an interrupted playback to
+// finish. If the ops in flight have not completed within the drainTimeout,
+// the sockets are closed so that the ops stop waiting for replies.
+func (context *ExecutionContext) drainConnections() {
+	done := make(chan struct{})
+	go func() {
+		context.ConnectionChansWaitGroup.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(context.drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+	closed := context.closeLiveSockets()
+	userInfoLogger.Logvf(Always, "Ops in flight did not complete within %v; closed %v connections", context.drainTimeout, closed)
+	<-done
+}
+
+// trackSocket adds or removes a socket from the set of sockets in use.
+func (context *ExecutionContext) trackSocket(socket *mgo.MongoSocket, live bool) {
+	context.liveSocketsLock.Lock()
+	defer context.liveSocketsLock.Unlock()
+	if live {
+		context.liveSockets[socket] = true
+	} else {
+		delete(context.liveSockets, socket)
+	}
+}
+
+// closeLiveSockets closes every socket in use, causing the ops waiting on
+// them for replies to fail.
+func (context *ExecutionContext) closeLiveSockets() int {
+	context.liveSocketsLock.Lock()
+	defer context.liveSocketsLock.Unlock()
+	for socket := range context.liveSockets {
+		socket.Close()
+	}
+	return len(context.liveSockets)
+}
+
+// connectionQueueLength is the number of ops queued for each connection
+// before the ops which follow them in the playback file wait to be queued.
+var connectionQueueLength = 10000
+
+// newExecutionConnection starts a goroutine playing the ops sent to the
+// returned channel on a new connection. Once ctx is done, ops are no longer
+// played and are drained from the channel.
+func (context *ExecutionContext) newExecutionConnection(ctx context.Context, start time.Time, connectionNum int64) chan<- *RecordedOp {
+	ch := make(chan *RecordedOp, connectionQueueLength)
 	context.ConnectionChansWaitGroup.Add(1)
 
 	go func() {
-		now := time.Now()
 		var connected bool
-		time.Sleep(start.Add(-5 * time.Second).Sub(now)) // Sleep until five seconds before the start time
-		socket, err := context.session.AcquireSocketDirect()
-		if err == nil {
-			userInfoLogger.Logvf(Info, "(Connection %v) New connection CREATED.", connectionNum)
+		var socket *mgo.MongoSocket
+		if context.dryRun {
+			// ops are executed against a nil socket, which Execute never uses
+			// during a dry run
 			connected = true
-			defer socket.Close()
-		} else {
-			userInfoLogger.Logvf(Info, "(Connection %v) New Connection FAILED: %v", connectionNum, err)
+			context.events.send(Event{Type: ConnectionOpened, ConnectionNum: connectionNum})
+		} else if context.sleepUntil(ctx, start.Add(-5*time.Second)) == nil { // Sleep until five seconds before the start time
+			var err error
+			// with a pool, each op is played on a socket of the pool, and
+			// with capped connections the socket is opened for the first op
+			if context.pool == nil && !context.limits.capsConns() {
+				socket, err = context.acquireSocket()
+				if err == nil {
+					context.trackSocket(socket, true)
+				}
+			}
+			if err == nil {
+				userInfoLogger.Logvf(Info, "(Connection %v) New connection CREATED.", connectionNum)
+				connected = true
+				context.events.send(Event{Type: ConnectionOpened, ConnectionNum: connectionNum})
+				defer func() {
+					if socket != nil {
+						context.closeSocket(&socket)
+					}
+				}()
+			} else {
+				userInfoLogger.Logvf(Info, "(Connection %v) New Connection FAILED: %v", connectionNum, err)
+				context.events.send(Event{Type: EventError, ConnectionNum: connectionNum, Err: err})
+			}
 		}
-		for recordedOp := range ch {
+		// broken is set once an op fails with a network error while ops are
+		// played in strict order, after which the rest are not played
+		var broken bool
+		summary := &ConnectionSummary{}
+		// unacknowledged is set once a write is played whose getLastError,
+		// if any, must be played on the same socket
+		var unacknowledged bool
+		for {
+			recordedOp, ok := context.nextConnectionOp(ch, &socket, unacknowledged)
+			if !ok {
+				break
+			}
+			if ctx.Err() != nil {
+				context.pendingOps.Done()
+				continue
+			}
 			var parsedOp Op
 			var reply Replyable
 			var err error
 			msg := ""
-			if connected {
+			if connected && broken {
+				parsedOp, _ = recordedOp.Parse()
+				atomic.AddInt64(&context.brokenConnectionOps, 1)
+				msg = fmt.Sprintf("Skipped after connection failed (Connection %v)", connectionNum)
+				context.events.send(Event{Type: OpCompleted, ConnectionNum: connectionNum, Op: recordedOp})
+			} else if connected {
 				// Populate the op with the connection num it's being played on.
 				// This allows it to be used for downstream reporting of stats.
 				recordedOp.PlayedConnectionNum = connectionNum
-				t := time.Now()
 
-				if !context.fullSpeed && recordedOp.RawOp.Header.OpCode != OpCodeReply {
-					if t.Before(recordedOp.PlayAt.Time) {
-						time.Sleep(recordedOp.PlayAt.Sub(t))
+				if recordedOp.RawOp.Header.OpCode != OpCodeReply && context.waitToPlay(ctx, recordedOp.PlayAt.Time) != nil {
+					context.pendingOps.Done()
+					continue
+				}
+				// with capped connections, the socket is opened before the op
+				// waits for --workersPerHost, so that a connection waiting for
+				// a socket doesn't hold back the ops of those which have one.
+				// Failing to open it is reported once the op is played.
+				if socket == nil && context.pool == nil && context.limits.capsConns() &&
+					!context.dryRun && recordedOp.RawOp.Header.OpCode != OpCodeReply {
+					if context.openSocket(ctx, &socket) != nil && ctx.Err() != nil {
+						context.pendingOps.Done()
+						continue
 					}
 				}
+				if context.limits.acquireWorker(ctx) != nil {
+					context.pendingOps.Done()
+					continue
+				}
 				userInfoLogger.Logvf(DebugHigh, "(Connection %v) op %v", connectionNum, recordedOp.String())
-				parsedOp, reply, err = context.Execute(recordedOp, socket)
-				if err != nil {
+				context.events.send(Event{Type: OpDispatched, ConnectionNum: connectionNum, Op: recordedOp})
+				dispatchedAt := time.Now()
+				parsedOp, reply, err = context.executeOnConnection(ctx, recordedOp, &socket)
+				context.limits.releaseWorker()
+				if recordedOp.RawOp.Header.OpCode != OpCodeReply {
+					unacknowledged = parsedOp != nil && isUnacknowledgedWrite(parsedOp)
+				}
+				context.events.send(Event{Type: OpCompleted, ConnectionNum: connectionNum, Op: recordedOp,
+					Latency: time.Since(dispatchedAt), Err: err})
+				if err == ErrDestructiveOpBlocked {
+					msg = fmt.Sprintf("Skipped destructive command (Connection %v)", connectionNum)
+				} else if err == ErrGetLastErrorDropped {
+					msg = fmt.Sprintf("Skipped getLastError of translated writes (Connection %v)", connectionNum)
+				} else if err == ErrOpFiltered {
+					msg = fmt.Sprintf("Skipped %v (Connection %v)", opKindOf(parsedOp), connectionNum)
+				} else if err == ErrGetMoreSkipped {
+					msg = fmt.Sprintf("Skipped getMore of a cursor not found (Connection %v)", connectionNum)
+				} else if err == ErrWaitBudgetSpent {
+					msg = fmt.Sprintf("Skipped getMore of a tailable cursor past its wait budget (Connection %v)", connectionNum)
+				} else if err == ErrOpVetoed {
+					msg = fmt.Sprintf("Vetoed by hook (Connection %v)", connectionNum)
+				} else if err != nil {
 					toolDebugLogger.Logvf(Always, "context.Execute error: %v", err)
+					context.events.send(Event{Type: EventError, ConnectionNum: connectionNum, Op: recordedOp, Err: err})
+					if context.strictOrder && classifyExecutionError(err) == ErrorClassNetwork {
+						userInfoLogger.Logvf(Info, "(Connection %v) Connection FAILED; its remaining ops will not be played", connectionNum)
+						broken = true
+					}
+				} else if context.dryRun && recordedOp.PlayedAt != nil && !recordedOp.PlayedAt.IsZero() {
+					msg = fmt.Sprintf("Not executed during dry run (Connection %v)", connectionNum)
+				}
+				if recordedOp.PlayedAt != nil && !recordedOp.PlayedAt.IsZero() {
+					context.errors.observe(err, reply)
+					context.checkLag(summary, summary.observe(recordedOp, err, reply))
+					if err == nil {
+						context.latencies.observe(reply)
+					}
+				}
+				if observer, ok := context.Pacing.(PacingObserver); ok {
+					observer.ObservePlayed(recordedOp)
 				}
 			} else {
 				parsedOp, err = recordedOp.Parse()
@@ -213,19 +747,135 @@ func (context *ExecutionContext) newExecutionConnection(start time.Time, connect
 
 				msg = fmt.Sprintf("Skipped on non-connected socket (Connection %v)", connectionNum)
 				toolDebugLogger.Logv(Always, msg)
+				context.events.send(Event{Type: OpCompleted, ConnectionNum: connectionNum, Op: recordedOp})
 			}
 			if shouldCollectOp(parsedOp, context.driverOpsFiltered) {
 				context.Collect(recordedOp, parsedOp, reply, msg)
 			}
+			if context.checkpoint != nil {
+				context.checkpoint.observePlayed(recordedOp)
+			}
+			context.pendingOps.Done()
 		}
 		userInfoLogger.Logvf(Info, "(Connection %v) Connection ENDED.", connectionNum)
+		summary.finish(context.behindThreshold)
+		context.connections.add(summary)
+		if connected {
+			context.events.send(Event{Type: ConnectionClosed, ConnectionNum: connectionNum})
+		}
 		context.ConnectionChansWaitGroup.Done()
 	}()
 	return ch
 }
 
+// executeOnConnection plays an op on the socket of its connection, opening it
+// if the connections are capped and it isn't open, or on one of the pool
+// when the sockets are shared by the recorded connections.
+func (context *ExecutionContext) executeOnConnection(ctx context.Context, op *RecordedOp, socket **mgo.MongoSocket) (Op, Replyable, error) {
+	if op.RawOp.Header.OpCode == OpCodeReply {
+		return context.execute(ctx, op, socket)
+	}
+	if context.pool == nil {
+		if context.limits.capsConns() {
+			// the playback file is checked before playback when it is
+			// preprocessed, but ops read from stdin or Kafka are only seen
+			// here
+			if parsedOp, name := parseConnectionScopedOp(op, cappedConnectionScopedOp); name != "" {
+				context.CursorIDMap.MarkFailed(op)
+				return parsedOp, nil, fmt.Errorf("%v can't be played with --maxConnsPerTarget, as it depends on the state of the connection it was recorded on", name)
+			}
+		}
+		if *socket == nil && !context.dryRun {
+			if err := context.openSocket(ctx, socket); err != nil {
+				context.CursorIDMap.MarkFailed(op)
+				parsedOp, _ := op.RawOp.Parse()
+				return parsedOp, nil, fmt.Errorf("error opening connection: %v", err)
+			}
+		}
+		return context.execute(ctx, op, socket)
+	}
+	if !context.pool.affinity {
+		// the playback file is checked before playback when it is
+		// preprocessed, but ops read from stdin or Kafka are only seen here
+		if parsedOp, name := parseConnectionScopedOp(op, connectionScopedOp); name != "" {
+			context.CursorIDMap.MarkFailed(op)
+			return parsedOp, nil, fmt.Errorf("%v can't be played with --connectionModel=%v, as it depends on the state of the connection it was recorded on", name, connectionModelPool)
+		}
+	}
+	pooled, err := context.pool.acquire(ctx, op.SeenConnectionNum)
+	if err != nil {
+		context.CursorIDMap.MarkFailed(op)
+		parsedOp, _ := op.RawOp.Parse()
+		return parsedOp, nil, fmt.Errorf("error acquiring pooled connection: %v", err)
+	}
+	parsedOp, reply, err := context.execute(ctx, op, &pooled)
+	context.pool.release(op.SeenConnectionNum, pooled, err != nil && classifyExecutionError(err) == ErrorClassNetwork)
+	return parsedOp, reply, err
+}
+
+// openSocket opens the socket of a connection whose socket is opened for its
+// first op, waiting until the connections to the host are below their cap.
+func (context *ExecutionContext) openSocket(ctx context.Context, socket **mgo.MongoSocket) error {
+	if err := context.limits.acquireConn(ctx); err != nil {
+		return err
+	}
+	opened, err := context.acquireSocket()
+	if err != nil {
+		context.limits.releaseConn()
+		return err
+	}
+	context.trackSocket(opened, true)
+	*socket = opened
+	return nil
+}
+
+// closeSocket closes the socket of a connection, letting another connection
+// open one if the connections to the host are capped.
+func (context *ExecutionContext) closeSocket(socket **mgo.MongoSocket) {
+	context.dropSocket(socket)
+	context.limits.releaseConn()
+}
+
+// dropSocket closes the socket of a connection whose place under the cap of
+// the connections to the host was handed over to another connection.
+func (context *ExecutionContext) dropSocket(socket **mgo.MongoSocket) {
+	context.trackSocket(*socket, false)
+	(*socket).Close()
+	*socket = nil
+}
+
+// nextConnectionOp receives the next op of a connection from ch. With capped
+// connections, a connection with no op to play hands its socket over to a
+// connection waiting for one, unless keepSocket is set because its next op
+// may depend on the state of the socket. Holding on to it instead could leave
+// the waiting connection with a full queue, holding back the ops of every
+// connection.
+func (context *ExecutionContext) nextConnectionOp(ch <-chan *RecordedOp, socket **mgo.MongoSocket, keepSocket bool) (*RecordedOp, bool) {
+	if *socket != nil && !keepSocket && context.limits.capsConns() {
+		select {
+		case op, ok := <-ch:
+			return op, ok
+		default:
+		}
+		select {
+		case op, ok := <-ch:
+			return op, ok
+		case context.limits.handoffs() <- struct{}{}:
+			context.dropSocket(socket)
+		}
+	}
+	op, ok := <-ch
+	return op, ok
+}
+
 // Execute plays a particular command on an mgo socket.
-func (context *ExecutionContext) Execute(op *RecordedOp, socket *mgo.MongoSocket) (Op, Replyable, error) {
+func (execContext *ExecutionContext) Execute(op *RecordedOp, socket *mgo.MongoSocket) (Op, Replyable, error) {
+	return execContext.execute(context.Background(), op, &socket)
+}
+
+// execute works like Execute, replacing the socket if it fails and the op is
+// retried, and no longer retrying it once ctx is done.
+func (context *ExecutionContext) execute(ctx context.Context, op *RecordedOp, socket **mgo.MongoSocket) (Op, Replyable, error) {
 	opToExec, err := op.RawOp.Parse()
 	var reply Replyable
 
@@ -247,12 +897,65 @@ func (context *ExecutionContext) Execute(op *RecordedOp, socket *mgo.MongoSocket
 		if !context.driverOpsFiltered && IsDriverOp(opToExec) {
 			return opToExec, nil, nil
 		}
-		if rewriteable, ok1 := opToExec.(cursorsRewriteable); ok1 {
+		if context.playOnly != "" {
+			if kind := opKindOf(opToExec); kind != "" && kind != context.playOnly {
+				atomic.AddInt64(&context.filteredOps, 1)
+				context.CursorIDMap.MarkFailed(op)
+				return opToExec, nil, ErrOpFiltered
+			}
+		}
+		if !context.allowDestructive && IsDestructiveOp(opToExec) {
+			atomic.AddInt64(&context.blockedOps, 1)
+			userInfoLogger.Logvf(Info, "Not playing destructive command '%v'", commandNameOf(opToExec))
+			return opToExec, nil, ErrDestructiveOpBlocked
+		}
+		if context.translate && isGetLastError(opToExec) {
+			atomic.AddInt64(&context.droppedGetLastErrors, 1)
+			return opToExec, nil, ErrGetLastErrorDropped
+		}
+		if context.translate {
+			translated, err := translateLegacyOp(opToExec)
+			if err != nil {
+				context.CursorIDMap.MarkFailed(op)
+				return opToExec, nil, fmt.Errorf("error translating legacy op: %v", err)
+			}
+			if translated != nil {
+				atomic.AddInt64(&context.translatedOps, 1)
+				opToExec = translated
+			}
+		}
+		// getLastError acknowledges the legacy writes of downconverted
+		// commands, with their write concern
+		var getLastError *QueryOp
+		if context.downconvert {
+			downconverted, err := downconvertMsgOp(opToExec)
+			if err == nil && downconverted != nil {
+				getLastError, err = downconvertedGetLastError(opToExec, downconverted)
+			}
+			if err != nil {
+				context.CursorIDMap.MarkFailed(op)
+				return opToExec, nil, fmt.Errorf("error downconverting command: %v", err)
+			}
+			if downconverted != nil {
+				atomic.AddInt64(&context.downconvertedOps, 1)
+				opToExec = downconverted
+			}
+		}
+		// the getMores of cursors not found on the server are handled by
+		// sendGetMore unless they are played as errors
+		var getMore cursorsRewriteable
+		var fileCursorID int64
+		if context.cursorPolicy != cursorNotFoundError {
+			getMore, fileCursorID, _ = getMoreCursor(opToExec)
+		}
+		// there are no live cursors to map to during a dry run
+		if rewriteable, ok1 := opToExec.(cursorsRewriteable); ok1 && !context.dryRun {
 			ok2, err := context.rewriteCursors(rewriteable, op.SeenConnectionNum)
 			if err != nil {
 				return opToExec, nil, err
 			}
 			if !ok2 {
+				context.runSkippedOpHooks(op, opToExec, ErrCursorsNotMapped)
 				return opToExec, nil, nil
 			}
 		}
@@ -261,19 +964,130 @@ func (context *ExecutionContext) Execute(op *RecordedOp, socket *mgo.MongoSocket
 		if op, ok := opToExec.(Preprocessable); ok {
 			op.Preprocess()
 		}
+		if context.readPreference != nil {
+			if err := context.readPreference.apply(opToExec); err != nil {
+				return opToExec, nil, fmt.Errorf("error overriding read preference: %v", err)
+			}
+		}
+		if context.hedgedReads != nil {
+			if err := setHedgedRead(opToExec, *context.hedgedReads); err != nil {
+				return opToExec, nil, fmt.Errorf("error setting hedged reads: %v", err)
+			}
+		}
+		if context.serverAPI != nil {
+			if err := context.serverAPI.apply(opToExec); err != nil {
+				return opToExec, nil, fmt.Errorf("error declaring the API version: %v", err)
+			}
+		}
+		if context.changeStreamResume != "" && context.changeStreamResume != changeStreamResumeRecorded {
+			if err := context.rewriteChangeStream(opToExec); err != nil {
+				return opToExec, nil, fmt.Errorf("error rewriting change stream: %v", err)
+			}
+		}
+
+		if err := context.runPreOpHooks(op, opToExec); err != nil {
+			context.CursorIDMap.MarkFailed(op)
+			return opToExec, nil, err
+		}
+
+		var shape *queryShape
+		if context.explain != nil {
+			explained, explainedShape, err := context.explain.wrap(opToExec)
+			if err != nil {
+				context.CursorIDMap.MarkFailed(op)
+				return opToExec, nil, fmt.Errorf("error wrapping query in explain: %v", err)
+			}
+			if explained != nil {
+				// the cursors of explained queries are never opened, so their
+				// getMores are skipped
+				context.CursorIDMap.MarkFailed(op)
+				opToExec, shape = explained, explainedShape
+			}
+		}
 
+		var tailing *tailableCursor
+		if context.tracksTailable() && !context.dryRun {
+			if opToExec, tailing, err = context.boundTailableWait(opToExec); err != nil {
+				return opToExec, nil, err
+			}
+			// a legacy getMore may have been replaced by an OP_MSG one
+			if getMore != nil {
+				getMore, _ = opToExec.(cursorsRewriteable)
+			}
+		}
+		exhaust := clearExhaust(opToExec)
 		op.PlayedAt = &PreciseTime{time.Now()}
 
-		reply, err = opToExec.Execute(socket)
+		if context.dryRun {
+			atomic.AddInt64(&context.dryRunOps, 1)
+			context.runPostOpHooks(op, opToExec, nil, nil)
+			return opToExec, nil, nil
+		}
+		if context.watchdog != nil {
+			defer context.watchdog.track(op, opToExec)()
+		}
+
+		if getMore != nil {
+			reply, err = context.sendGetMore(ctx, opToExec, getMore, fileCursorID, socket)
+			if err == ErrGetMoreSkipped {
+				op.PlayedAt = nil
+				context.runSkippedOpHooks(op, opToExec, err)
+				return opToExec, nil, err
+			}
+		} else {
+			reply, err = context.send(ctx, opToExec, socket)
+			if err == nil && reply == nil && getLastError != nil {
+				reply, err = getLastError.Execute(*socket)
+			}
+			if err == nil && reply == nil && isUnacknowledgedWrite(opToExec) {
+				atomic.AddInt64(&context.unacknowledgedWrites, 1)
+			}
+			if err == nil && reply == nil && context.strictOrder {
+				err = acknowledge(opToExec, *socket)
+			}
+		}
+		if err == nil && exhaust {
+			err = context.drainExhaust(opToExec, reply, *socket)
+		}
+		if tailing != nil {
+			tailing.addWait(time.Since(op.PlayedAt.Time))
+		} else if err == nil && context.tracksTailable() {
+			context.trackTailable(opToExec, reply)
+		}
+		context.runPostOpHooks(op, opToExec, reply, err)
 
 		if err != nil {
 			context.CursorIDMap.MarkFailed(op)
 			return opToExec, reply, fmt.Errorf("error executing op: %v", err)
 		}
+		if shape != nil {
+			context.explain.record(shape, reply)
+		}
+		if context.cursorLeaks != nil {
+			context.cursorLeaks.observe(opToExec, reply)
+		}
 		if reply != nil {
-			context.AddFromWire(reply, op)
+			context.addFromWire(reply, op, opToExec)
 		}
 	}
 	context.handleCompletedReplies()
 	return opToExec, reply, nil
 }
+
+// BlockedOps returns the number of destructive commands that were not played
+// because destructive commands were not allowed.
+func (context *ExecutionContext) BlockedOps() int64 {
+	return atomic.LoadInt64(&context.blockedOps)
+}
+
+// FilteredOps returns the number of ops that were not played because only
+// reads or only writes were played.
+func (context *ExecutionContext) FilteredOps() int64 {
+	return atomic.LoadInt64(&context.filteredOps)
+}
+
+// DryRunOps returns the number of ops that would have been executed during a
+// dry run.
+func (context *ExecutionContext) DryRunOps() int64 {
+	return atomic.LoadInt64(&context.dryRunOps)
+}
@@ -0,0 +1,143 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+	"github.com/patrickmn/go-cache"
+)
+
+// queryFlagExhaust is the OP_QUERY flag bit asking the server to stream every
+// batch of the query's cursor without waiting for getMores.
+const queryFlagExhaust = mgo.QueryOpFlags(1 << 6)
+
+// clearExhaust clears the flag of a legacy query or an OP_MSG which lets the
+// server stream the batches of its cursor, returning whether it was set.
+// The batches of exhaust cursors are fetched with getMores instead, since
+// the sockets of the playback only read the first reply to each op.
+func clearExhaust(op Op) bool {
+	switch castOp := op.(type) {
+	case *QueryOp:
+		if castOp.Flags&queryFlagExhaust != 0 {
+			castOp.Flags &^= queryFlagExhaust
+			return true
+		}
+	case *MsgOp:
+		return clearExhaustAllowed(castOp)
+	case *MsgOpGetMore:
+		return clearExhaustAllowed(&castOp.MsgOp)
+	}
+	return false
+}
+
+func clearExhaustAllowed(op *MsgOp) bool {
+	if op.Flags&mgo.MsgFlagExhaustAllowed == 0 {
+		return false
+	}
+	op.Flags &^= mgo.MsgFlagExhaustAllowed
+	return true
+}
+
+// exhaustGetMore returns the getMore fetching the next batch of the cursor
+// of an exhaust op, or nil if the cursor's collection isn't known.
+func exhaustGetMore(op Op, cursorID int64) (Op, error) {
+	var msgOp *MsgOp
+	switch castOp := op.(type) {
+	case *QueryOp:
+		getMore := &GetMoreOp{}
+		getMore.Collection = castOp.Collection
+		getMore.CursorId = cursorID
+		return getMore, nil
+	case *MsgOp:
+		msgOp = castOp
+	case *MsgOpGetMore:
+		msgOp = &castOp.MsgOp
+	default:
+		return nil, nil
+	}
+	raw, _, err := fetchPayload0Data(msgOp.Sections)
+	if err != nil {
+		return nil, err
+	}
+	body, err := bsonToD(raw)
+	if err != nil || len(body) == 0 {
+		return nil, err
+	}
+	collection := body[0].Value
+	if body[0].Name == "getMore" {
+		collection, _ = FindValueByKey("collection", &body)
+	}
+	collectionName, ok := collection.(string)
+	if !ok {
+		return nil, nil
+	}
+	database, _ := FindValueByKey("$db", &body)
+	databaseName, _ := database.(string)
+	getMore, err := newMsgCommand(databaseName, bson.D{
+		{Name: "getMore", Value: cursorID},
+		{Name: "collection", Value: collectionName},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MsgOpGetMore{MsgOp: *getMore}, nil
+}
+
+// drainExhaust fetches the batches the server would have streamed after the
+// reply to an exhaust op, until its cursor is exhausted or a getMore fails.
+func (context *ExecutionContext) drainExhaust(op Op, reply Replyable, socket *mgo.MongoSocket) error {
+	for reply != nil && len(reply.getErrors()) == 0 {
+		cursorID, err := reply.getCursorID()
+		if err != nil || cursorID == 0 {
+			return err
+		}
+		getMore, err := exhaustGetMore(op, cursorID)
+		if err != nil || getMore == nil {
+			return err
+		}
+		if reply, err = getMore.Execute(socket); err != nil {
+			return fmt.Errorf("error fetching the next batch of an exhaust cursor: %v", err)
+		}
+		atomic.AddInt64(&context.exhaustBatches, 1)
+	}
+	return nil
+}
+
+// continuesExhaustStream returns whether a recorded reply follows another in
+// the stream of batches of an exhaust cursor, in which case it replies to no
+// op of its own. Each OP_REPLY of the stream replies to the query, like the
+// first, and each OP_MSG to the previous one, which has moreToCome set.
+func (context *ExecutionContext) continuesExhaustStream(reply Replyable, recordedOp *RecordedOp) bool {
+	key := cacheKey(recordedOp, true)
+	_, continued := context.exhaustStreams.Get(key)
+	switch castReply := reply.(type) {
+	case *ReplyOp:
+		if cursorID, _ := castReply.getCursorID(); !continued && cursorID != 0 {
+			context.exhaustStreams.Set(key, true, cache.DefaultExpiration)
+		}
+	case *MsgOpReply:
+		if continued {
+			context.exhaustStreams.Delete(key)
+		}
+		if castReply.Flags&mgo.MsgFlagMoreToCome != 0 {
+			// the key of the reply to this one
+			context.exhaustStreams.Set(fmt.Sprintf("%v:%v:%d:%v", recordedOp.DstEndpoint,
+				recordedOp.SrcEndpoint, recordedOp.Header.RequestID, recordedOp.Generation), true, cache.DefaultExpiration)
+		}
+	}
+	return continued
+}
+
+// ExhaustBatches returns the number of batches of exhaust cursors fetched
+// with getMores.
+func (context *ExecutionContext) ExhaustBatches() int64 {
+	return atomic.LoadInt64(&context.exhaustBatches)
+}
@@ -0,0 +1,120 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"reflect"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestExhaustGetMore(t *testing.T) {
+	msgOp := func(command bson.D, flags uint32) *MsgOp {
+		op, err := newMsgCommand("test", command)
+		if err != nil {
+			t.Fatalf("error building the command: %v", err)
+		}
+		op.Flags = flags
+		return op
+	}
+	type testCase struct {
+		name    string
+		op      Op
+		exhaust bool
+		// getMore is the command fetching the next batch, if the op is an
+		// OP_MSG
+		getMore bson.D
+	}
+	cases := []testCase{
+		{
+			name:    "legacy exhaust query",
+			op:      &QueryOp{QueryOp: mgo.QueryOp{Collection: "test.c", Flags: queryFlagExhaust | queryFlagSlaveOk}},
+			exhaust: true,
+		},
+		{
+			name:    "exhaust getMore",
+			op:      &MsgOpGetMore{MsgOp: *msgOp(bson.D{{"getMore", int64(10)}, {"collection", "c"}}, mgo.MsgFlagExhaustAllowed)},
+			exhaust: true,
+			getMore: bson.D{{"getMore", int64(20)}, {"collection", "c"}, {"$db", "test"}},
+		},
+		{
+			name:    "find",
+			op:      msgOp(bson.D{{"find", "c"}}, 0),
+			getMore: bson.D{{"getMore", int64(20)}, {"collection", "c"}, {"$db", "test"}},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		if exhaust := clearExhaust(c.op); exhaust != c.exhaust {
+			t.Errorf("expected exhaust %v, got %v", c.exhaust, exhaust)
+		}
+		if clearExhaust(c.op) {
+			t.Errorf("expected the exhaust flag to be cleared")
+		}
+		getMore, err := exhaustGetMore(c.op, 20)
+		if err != nil {
+			t.Errorf("error building the getMore: %v", err)
+			continue
+		}
+		switch castOp := getMore.(type) {
+		case *GetMoreOp:
+			if castOp.Collection != "test.c" || castOp.CursorId != 20 {
+				t.Errorf("expected a getMore of cursor 20 of test.c, got %#v", castOp)
+			}
+		case *MsgOpGetMore:
+			body, _ := bsonToD(castOp.Sections[0].Data)
+			if !reflect.DeepEqual(body, c.getMore) {
+				t.Errorf("expected getMore %v, got %v", c.getMore, body)
+			}
+		default:
+			t.Errorf("expected a getMore, got %#v", getMore)
+		}
+	}
+}
+
+func TestContinuesExhaustStream(t *testing.T) {
+	context := NewExecutionContext(&StatCollector{noop: true}, nil, &ExecutionOptions{})
+	recorded := func(requestID, responseTo int32) *RecordedOp {
+		return &RecordedOp{RawOp: RawOp{Header: MsgHeader{RequestID: requestID, ResponseTo: responseTo}},
+			SrcEndpoint: "server", DstEndpoint: "client"}
+	}
+	msgReply := func(flags uint32) Replyable {
+		reply := &MsgOpReply{}
+		reply.Flags = flags
+		return reply
+	}
+	legacyReply := func(cursorID int64) Replyable {
+		reply := &ReplyOp{}
+		reply.CursorId = cursorID
+		return reply
+	}
+	type testCase struct {
+		name      string
+		reply     Replyable
+		op        *RecordedOp
+		continued bool
+	}
+	// the replies are added in order
+	cases := []testCase{
+		{name: "first OP_MSG", reply: msgReply(mgo.MsgFlagMoreToCome), op: recorded(100, 1)},
+		{name: "streamed OP_MSG", reply: msgReply(mgo.MsgFlagMoreToCome), op: recorded(101, 100), continued: true},
+		{name: "last OP_MSG", reply: msgReply(0), op: recorded(102, 101), continued: true},
+		{name: "reply to another op", reply: msgReply(0), op: recorded(103, 102)},
+		{name: "first OP_REPLY", reply: legacyReply(30), op: recorded(200, 2)},
+		{name: "streamed OP_REPLY", reply: legacyReply(30), op: recorded(201, 2), continued: true},
+		{name: "OP_REPLY without a cursor", reply: legacyReply(0), op: recorded(300, 3)},
+		{name: "other OP_REPLY without a cursor", reply: legacyReply(0), op: recorded(301, 3)},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		if continued := context.continuesExhaustStream(c.reply, c.op); continued != c.continued {
+			t.Errorf("expected continued %v, got %v", c.continued, continued)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// explainGenericFields are the fields of a command which are sent with the
+// explain command wrapping it rather than with the command explained.
+var explainGenericFields = map[string]bool{
+	"$db":                  true,
+	"lsid":                 true,
+	"$clusterTime":         true,
+	"$readPreference":      true,
+	"apiVersion":           true,
+	"apiStrict":            true,
+	"apiDeprecationErrors": true,
+	"comment":              true,
+}
+
+// explainUnsupportedFields are the fields of a command which explain
+// rejects, and which are dropped from the commands explained.
+var explainUnsupportedFields = map[string]bool{
+	"txnNumber":        true,
+	"startTransaction": true,
+	"autocommit":       true,
+	"readConcern":      true,
+	"writeConcern":     true,
+}
+
+// ShapeExplain summarizes the explains of the queries of one shape.
+type ShapeExplain struct {
+	Ns      string
+	Command string
+	Shape   string
+	// Count is the number of queries of the shape explained, and Errors
+	// the number of their explains which failed.
+	Count  int64
+	Errors int64
+	// Plans counts the winning plans chosen for the queries, summarized
+	// by their stages, such as "FETCH > IXSCAN(a_1)".
+	Plans map[string]int64
+	// KeysExamined, DocsExamined, Returned and ExecutionMillis total the
+	// execution stats of the queries, which are only returned when the
+	// queries are explained with the executionStats or allPlansExecution
+	// verbosities.
+	KeysExamined    int64
+	DocsExamined    int64
+	Returned        int64
+	ExecutionMillis int64
+}
+
+// explainResult is what is recorded of the explain of a single query.
+type explainResult struct {
+	plan            string
+	hasStats        bool
+	keysExamined    int64
+	docsExamined    int64
+	returned        int64
+	executionMillis int64
+}
+
+// explainer wraps the queries played in explain commands run with its
+// verbosity, and summarizes the explains of the queries by their shapes.
+type explainer struct {
+	verbosity string
+
+	sync.Mutex
+	shapes map[string]*ShapeExplain
+}
+
+func newExplainer(verbosity string) *explainer {
+	return &explainer{verbosity: verbosity, shapes: map[string]*ShapeExplain{}}
+}
+
+// wrap returns an op running the explain of the query op, and the shape of
+// the query. It returns a nil op if op is not a query.
+func (explain *explainer) wrap(op Op) (Op, *queryShape, error) {
+	switch castOp := op.(type) {
+	case *QueryOp:
+		return explain.wrapQuery(castOp)
+	case *CommandOp:
+		if !queryShapeCommands[castOp.CommandName] {
+			return nil, nil, nil
+		}
+		args, err := bsonToD(castOp.CommandArgs)
+		if err != nil {
+			return nil, nil, err
+		}
+		command, generic := splitExplainFields(args)
+		explained := *castOp
+		explained.CommandName = "explain"
+		explained.CommandArgs = append(explain.command(command), generic...)
+		return &explained, queryShapeOf(castOp.Database, command), nil
+	case *MsgOp:
+		if !queryShapeCommands[castOp.CommandName] {
+			return nil, nil, nil
+		}
+		body, _, err := fetchPayload0Data(castOp.Sections)
+		if err != nil {
+			return nil, nil, err
+		}
+		doc, err := bsonToD(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		command, generic := splitExplainFields(doc)
+		raw, err := dToRaw(append(explain.command(command), generic...))
+		if err != nil {
+			return nil, nil, err
+		}
+		explained := *castOp
+		explained.CommandName = "explain"
+		explained.Sections = []mgo.MsgSection{{PayloadType: mgo.MsgPayload0, Data: raw}}
+		// the checksum of the recorded message no longer matches its body
+		explained.Flags &^= mgo.MsgFlagChecksumPresent
+		return &explained, queryShapeOf(castOp.Database, command), nil
+	}
+	return nil, nil, nil
+}
+
+// wrapQuery wraps an OP_QUERY in an explain command. Legacy queries are
+// explained as the equivalent find command.
+func (explain *explainer) wrapQuery(op *QueryOp) (Op, *queryShape, error) {
+	query, wrapper, err := unwrapQuery(op.Query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	explained := *op
+	var db string
+	var command bson.D
+	if strings.HasSuffix(op.Collection, ".$cmd") {
+		if len(query) == 0 || !queryShapeCommands[query[0].Name] {
+			return nil, nil, nil
+		}
+		db = strings.TrimSuffix(op.Collection, ".$cmd")
+		command, _ = splitExplainFields(query)
+	} else {
+		db, command = legacyFindCommand(op, query, wrapper)
+		explained.Collection = db + ".$cmd"
+		explained.Skip = 0
+		explained.Limit = -1
+		explained.Selector = nil
+	}
+
+	explainCommand := explain.command(command)
+	if wrapper == nil {
+		explained.Query = explainCommand
+	} else {
+		asWrapper := bson.D{{Name: wrapper[0].Name, Value: explainCommand}}
+		if readPref, ok := FindValueByKey("$readPreference", &wrapper); ok {
+			asWrapper = append(asWrapper, bson.DocElem{Name: "$readPreference", Value: readPref})
+		}
+		explained.Query = asWrapper
+	}
+	return &explained, queryShapeOf(db, command), nil
+}
+
+// splitExplainFields separates the fields of a command which are sent with
+// the explain command wrapping it, dropping those explain rejects.
+func splitExplainFields(command bson.D) (explained, generic bson.D) {
+	for _, elem := range command {
+		switch {
+		case explainGenericFields[elem.Name]:
+			generic = append(generic, elem)
+		case !explainUnsupportedFields[elem.Name]:
+			explained = append(explained, elem)
+		}
+	}
+	return explained, generic
+}
+
+func (explain *explainer) command(command bson.D) bson.D {
+	return bson.D{{Name: "explain", Value: command}, {Name: "verbosity", Value: explain.verbosity}}
+}
+
+// record adds the explain of a query of the shape to its summary.
+func (explain *explainer) record(shape *queryShape, reply Replyable) {
+	result, err := parseExplainReply(reply)
+	if err != nil {
+		userInfoLogger.Logvf(DebugLow, "Explain of %v failed: %v", shape, err)
+	}
+
+	explain.Lock()
+	defer explain.Unlock()
+	key := shape.String()
+	summary, ok := explain.shapes[key]
+	if !ok {
+		summary = &ShapeExplain{Ns: shape.Ns, Command: shape.Command, Shape: shape.Shape, Plans: map[string]int64{}}
+		explain.shapes[key] = summary
+	}
+	summary.Count++
+	if err != nil {
+		summary.Errors++
+		return
+	}
+	summary.Plans[result.plan]++
+	if result.hasStats {
+		summary.KeysExamined += result.keysExamined
+		summary.DocsExamined += result.docsExamined
+		summary.Returned += result.returned
+		summary.ExecutionMillis += result.executionMillis
+	}
+}
+
+// parseExplainReply returns the winning plan and execution stats of the
+// explain of a query, whether it was run on a single server or on a sharded
+// cluster and whether the query is a find or an aggregation.
+func parseExplainReply(reply Replyable) (*explainResult, error) {
+	if reply == nil {
+		return nil, fmt.Errorf("no reply")
+	}
+	if errs := reply.getErrors(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	docs, err := replyDocuments(reply)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("empty reply")
+	}
+	doc := bson.D{}
+	if err := docs[0].Unmarshal(&doc); err != nil {
+		return nil, err
+	}
+	// aggregations which are not fully pushed down to the query layer
+	// report the plan of the query feeding their first stage
+	if value, ok := FindValueByKey("stages", &doc); ok {
+		if stages, ok := value.([]interface{}); ok && len(stages) > 0 {
+			first, _ := bsonToD(stages[0])
+			if cursor, ok := FindValueByKey("$cursor", &first); ok {
+				if cursorDoc, err := bsonToD(cursor); err == nil {
+					doc = cursorDoc
+				}
+			}
+		}
+	}
+	queryPlanner, err := subdocument(doc, "queryPlanner")
+	if err != nil {
+		return nil, err
+	}
+	winningPlan, err := subdocument(queryPlanner, "winningPlan")
+	if err != nil {
+		return nil, err
+	}
+	result := &explainResult{plan: planSummary(winningPlan)}
+	if stats, err := subdocument(doc, "executionStats"); err == nil {
+		result.hasStats = true
+		result.keysExamined = int64Field(stats, "totalKeysExamined")
+		result.docsExamined = int64Field(stats, "totalDocsExamined")
+		result.returned = int64Field(stats, "nReturned")
+		result.executionMillis = int64Field(stats, "executionTimeMillis")
+	}
+	return result, nil
+}
+
+func subdocument(doc bson.D, name string) (bson.D, error) {
+	value, ok := FindValueByKey(name, &doc)
+	if !ok {
+		return nil, fmt.Errorf("no %v in explain", name)
+	}
+	return bsonToD(value)
+}
+
+func int64Field(doc bson.D, name string) int64 {
+	value, _ := FindValueByKey(name, &doc)
+	f, _ := toFloat(value)
+	return int64(f)
+}
+
+// planSummary lays out the stages of a plan from the root down, such as
+// "FETCH > IXSCAN(a_1)", with the plans of the shards of a sharded cluster
+// and the inputs of stages with several in brackets.
+func planSummary(plan bson.D) string {
+	// the slot-based execution engine nests the plan it runs
+	if queryPlan, err := subdocument(plan, "queryPlan"); err == nil {
+		plan = queryPlan
+	}
+	stage, _ := FindValueByKey("stage", &plan)
+	summary := fmt.Sprintf("%v", stage)
+	if indexName, ok := FindValueByKey("indexName", &plan); ok {
+		summary = fmt.Sprintf("%v(%v)", summary, indexName)
+	}
+	if input, err := subdocument(plan, "inputStage"); err == nil {
+		return summary + " > " + planSummary(input)
+	}
+	var inputs []string
+	if value, ok := FindValueByKey("inputStages", &plan); ok {
+		stages, _ := value.([]interface{})
+		for _, stage := range stages {
+			if input, err := bsonToD(stage); err == nil {
+				inputs = append(inputs, planSummary(input))
+			}
+		}
+	}
+	if value, ok := FindValueByKey("shards", &plan); ok {
+		shards, _ := value.([]interface{})
+		for _, shard := range shards {
+			shardDoc, err := bsonToD(shard)
+			if err != nil {
+				continue
+			}
+			if shardPlan, err := subdocument(shardDoc, "winningPlan"); err == nil {
+				inputs = append(inputs, planSummary(shardPlan))
+			}
+		}
+	}
+	if len(inputs) > 0 {
+		summary += "[" + strings.Join(inputs, ", ") + "]"
+	}
+	return summary
+}
+
+// summaries returns the summaries of the query shapes explained, from the
+// most to the least frequent.
+func (explain *explainer) summaries() []*ShapeExplain {
+	explain.Lock()
+	defer explain.Unlock()
+	summaries := make([]*ShapeExplain, 0, len(explain.shapes))
+	for _, summary := range explain.shapes {
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Count != summaries[j].Count {
+			return summaries[i].Count > summaries[j].Count
+		}
+		if summaries[i].Ns != summaries[j].Ns {
+			return summaries[i].Ns < summaries[j].Ns
+		}
+		return summaries[i].Shape < summaries[j].Shape
+	})
+	return summaries
+}
+
+// mostCommonPlan returns the plan chosen most often for the queries of a
+// shape, and the number of other plans chosen.
+func (summary *ShapeExplain) mostCommonPlan() (string, int) {
+	plan := ""
+	for candidate, count := range summary.Plans {
+		if plan == "" || count > summary.Plans[plan] || count == summary.Plans[plan] && candidate < plan {
+			plan = candidate
+		}
+	}
+	return plan, len(summary.Plans) - 1
+}
+
+// formatExplainTable lays out the summaries in a table, with the averages
+// of the execution stats of each shape when they were collected.
+func formatExplainTable(summaries []*ShapeExplain) string {
+	out := &bytes.Buffer{}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "count\tns\tshape\tplan\tkeys\tdocs\tmillis\t")
+	for _, summary := range summaries {
+		plan, others := summary.mostCommonPlan()
+		if others > 0 {
+			plan = fmt.Sprintf("%v (+%v other plans)", plan, others)
+		}
+		if summary.Errors > 0 {
+			plan = fmt.Sprintf("%v (%v errors)", plan, summary.Errors)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v %v\t%v\t", summary.Count, summary.Ns, summary.Command,
+			Abbreviate(summary.Shape, TruncateLength), plan)
+		if explained := summary.Count - summary.Errors; explained > 0 {
+			fmt.Fprintf(w, "%.1f\t%.1f\t%.1f\t\n", float64(summary.KeysExamined)/float64(explained),
+				float64(summary.DocsExamined)/float64(explained), float64(summary.ExecutionMillis)/float64(explained))
+		} else {
+			fmt.Fprintln(w, "\t\t\t")
+		}
+	}
+	w.Flush()
+	return out.String()
+}
+
+// logSummary logs the summaries of the query shapes explained.
+func (explain *explainer) logSummary() {
+	summaries := explain.summaries()
+	if len(summaries) == 0 {
+		userInfoLogger.Logvf(Always, "No queries were explained")
+		return
+	}
+	userInfoLogger.Logvf(Always, "Explained %v query shapes with verbosity %v:\n%v",
+		len(summaries), explain.verbosity, formatExplainTable(summaries))
+}
+
+// writeReport writes the summaries of the query shapes explained as json
+// to the given path.
+func (explain *explainer) writeReport(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = writeExplainReport(file, explain.summaries())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func writeExplainReport(out io.Writer, summaries []*ShapeExplain) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(summaries)
+}
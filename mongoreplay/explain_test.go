@@ -0,0 +1,217 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestExplainWrap(t *testing.T) {
+	explain := newExplainer("executionStats")
+	lsid := bson.D{{"id", bson.Binary{Kind: 4, Data: []byte("0123456789abcdef")}}}
+
+	raw, err := dToRaw(bson.D{{"find", "c"}, {"filter", bson.D{{"a", 1}}}, {"lsid", lsid},
+		{"txnNumber", int64(1)}, {"$db", "test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgOp := &MsgOp{CommandName: "find", Database: "test",
+		MsgOp: mgo.MsgOp{Flags: mgo.MsgFlagChecksumPresent, Sections: []mgo.MsgSection{{PayloadType: mgo.MsgPayload0, Data: raw}}}}
+	op, shape, err := explain.wrap(msgOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	explained, ok := op.(*MsgOp)
+	if !ok {
+		t.Fatalf("expected an OP_MSG, got %T", op)
+	}
+	if explained.Flags&mgo.MsgFlagChecksumPresent != 0 {
+		t.Errorf("expected the checksum flag to be cleared")
+	}
+	body, _, err := fetchPayload0Data(explained.Sections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, _ := bsonToD(body)
+	if len(doc) == 0 || doc[0].Name != "explain" {
+		t.Fatalf("expected an explain command, got %v", doc)
+	}
+	inner, _ := bsonToD(doc[0].Value)
+	if _, ok := FindValueByKey("txnNumber", &inner); ok {
+		t.Errorf("expected txnNumber to be dropped, got %v", inner)
+	}
+	if _, ok := FindValueByKey("lsid", &inner); ok {
+		t.Errorf("expected lsid to be moved to the explain command, got %v", inner)
+	}
+	for _, name := range []string{"lsid", "$db"} {
+		if _, ok := FindValueByKey(name, &doc); !ok {
+			t.Errorf("expected %v to be sent with the explain command, got %v", name, doc)
+		}
+	}
+	if verbosity, _ := FindValueByKey("verbosity", &doc); verbosity != "executionStats" {
+		t.Errorf("expected verbosity executionStats, got %v", verbosity)
+	}
+	if shape.String() != "test.c find {filter: {a: ?number}}" {
+		t.Errorf("unexpected shape %v", shape)
+	}
+	// the recorded op is left untouched
+	if original, _, _ := fetchPayload0Data(msgOp.Sections); original != raw {
+		t.Errorf("expected the recorded op to be left untouched")
+	}
+
+	queryOp := &QueryOp{QueryOp: mgo.QueryOp{Collection: "test.c", Limit: -1, Skip: 2,
+		Query: bson.D{{"$query", bson.D{{"a", 1}}}, {"$orderby", bson.D{{"b", 1}}}}}}
+	op, shape, err = explain.wrap(queryOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	explainedQuery, ok := op.(*QueryOp)
+	if !ok {
+		t.Fatalf("expected an OP_QUERY, got %T", op)
+	}
+	if explainedQuery.Collection != "test.$cmd" || explainedQuery.Skip != 0 {
+		t.Errorf("expected a command against test.$cmd, got %v with skip %v", explainedQuery.Collection, explainedQuery.Skip)
+	}
+	if shape.String() != "test.c find {filter: {a: ?number}, sort: {b: 1}}" {
+		t.Errorf("unexpected shape %v", shape)
+	}
+	query, _ := bsonToD(explainedQuery.Query)
+	command, _ := subdocument(query, "$query")
+	find, _ := subdocument(command, "explain")
+	if skip, _ := FindValueByKey("skip", &find); skip != int32(2) {
+		t.Errorf("expected the skip of the query to be kept, got %v", find)
+	}
+
+	if op, _, err := explain.wrap(&InsertOp{}); op != nil || err != nil {
+		t.Errorf("expected an insert not to be explained, got %v, %v", op, err)
+	}
+}
+
+func TestParseExplainReply(t *testing.T) {
+	reply := func(doc bson.D) Replyable {
+		raw, err := dToRaw(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &MsgOpReply{MsgOp: MsgOp{MsgOp: mgo.MsgOp{Sections: []mgo.MsgSection{{PayloadType: mgo.MsgPayload0, Data: raw}}}}}
+	}
+	ixscan := bson.D{{"stage", "FETCH"}, {"inputStage", bson.D{{"stage", "IXSCAN"}, {"indexName", "a_1"}}}}
+	stats := bson.D{{"nReturned", 3}, {"executionTimeMillis", 2}, {"totalKeysExamined", 3}, {"totalDocsExamined", int64(3)}}
+	type testCase struct {
+		name         string
+		reply        bson.D
+		expectedPlan string
+		expectedKeys int64
+	}
+	cases := []testCase{
+		{
+			name:         "find",
+			reply:        bson.D{{"queryPlanner", bson.D{{"winningPlan", ixscan}}}, {"executionStats", stats}, {"ok", 1}},
+			expectedPlan: "FETCH > IXSCAN(a_1)",
+			expectedKeys: 3,
+		},
+		{
+			name:         "slot-based plan",
+			reply:        bson.D{{"queryPlanner", bson.D{{"winningPlan", bson.D{{"queryPlan", bson.D{{"stage", "COLLSCAN"}}}}}}}, {"ok", 1}},
+			expectedPlan: "COLLSCAN",
+		},
+		{
+			name: "aggregate",
+			reply: bson.D{{"stages", []interface{}{
+				bson.D{{"$cursor", bson.D{{"queryPlanner", bson.D{{"winningPlan", ixscan}}}, {"executionStats", stats}}}},
+				bson.D{{"$group", bson.D{}}},
+			}}, {"ok", 1}},
+			expectedPlan: "FETCH > IXSCAN(a_1)",
+			expectedKeys: 3,
+		},
+		{
+			name: "sharded",
+			reply: bson.D{{"queryPlanner", bson.D{{"winningPlan", bson.D{{"stage", "SHARD_MERGE"}, {"shards", []interface{}{
+				bson.D{{"shardName", "s0"}, {"winningPlan", ixscan}},
+				bson.D{{"shardName", "s1"}, {"winningPlan", bson.D{{"stage", "COLLSCAN"}}}},
+			}}}}}}, {"ok", 1}},
+			expectedPlan: "SHARD_MERGE[FETCH > IXSCAN(a_1), COLLSCAN]",
+		},
+		{
+			name: "or",
+			reply: bson.D{{"queryPlanner", bson.D{{"winningPlan", bson.D{{"stage", "OR"}, {"inputStages", []interface{}{
+				bson.D{{"stage", "IXSCAN"}, {"indexName", "a_1"}},
+				bson.D{{"stage", "IXSCAN"}, {"indexName", "b_1"}},
+			}}}}}}, {"ok", 1}},
+			expectedPlan: "OR[IXSCAN(a_1), IXSCAN(b_1)]",
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		result, err := parseExplainReply(reply(c.reply))
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if result.plan != c.expectedPlan {
+			t.Errorf("expected plan %v, got %v", c.expectedPlan, result.plan)
+		}
+		if result.keysExamined != c.expectedKeys {
+			t.Errorf("expected %v keys examined, got %v", c.expectedKeys, result.keysExamined)
+		}
+	}
+
+	if _, err := parseExplainReply(reply(bson.D{{"ok", 0}, {"errmsg", "bad query"}})); err == nil {
+		t.Errorf("expected an error for a failed explain")
+	}
+}
+
+func TestExplainerSummaries(t *testing.T) {
+	explain := newExplainer("executionStats")
+	frequent := queryShapeOf("test", bson.D{{"find", "c"}, {"filter", bson.D{{"a", 1}}}})
+	rare := queryShapeOf("test", bson.D{{"find", "c"}, {"filter", bson.D{{"b", 1}}}})
+	reply := func(plan bson.D) Replyable {
+		raw, _ := dToRaw(bson.D{{"queryPlanner", bson.D{{"winningPlan", plan}}},
+			{"executionStats", bson.D{{"totalKeysExamined", 2}, {"totalDocsExamined", 4}}}, {"ok", 1}})
+		return &MsgOpReply{MsgOp: MsgOp{MsgOp: mgo.MsgOp{Sections: []mgo.MsgSection{{PayloadType: mgo.MsgPayload0, Data: raw}}}}}
+	}
+	explain.record(frequent, reply(bson.D{{"stage", "COLLSCAN"}}))
+	explain.record(frequent, reply(bson.D{{"stage", "COLLSCAN"}}))
+	explain.record(frequent, reply(bson.D{{"stage", "IXSCAN"}, {"indexName", "a_1"}}))
+	explain.record(rare, nil)
+
+	summaries := explain.summaries()
+	if len(summaries) != 2 {
+		t.Fatalf("expected 2 shapes, got %v", len(summaries))
+	}
+	if summaries[0].Count != 3 || summaries[0].KeysExamined != 6 || summaries[0].DocsExamined != 12 {
+		t.Errorf("unexpected summary of the most frequent shape: %+v", summaries[0])
+	}
+	if plan, others := summaries[0].mostCommonPlan(); plan != "COLLSCAN" || others != 1 {
+		t.Errorf("expected COLLSCAN and one other plan, got %v and %v", plan, others)
+	}
+	if summaries[1].Errors != 1 {
+		t.Errorf("expected the explain of the rare shape to have failed, got %+v", summaries[1])
+	}
+	table := formatExplainTable(summaries)
+	if !strings.Contains(table, "COLLSCAN (+1 other plans)") || !strings.Contains(table, "2.0") {
+		t.Errorf("unexpected table:\n%v", table)
+	}
+
+	out := &bytes.Buffer{}
+	if err := writeExplainReport(out, summaries); err != nil {
+		t.Fatal(err)
+	}
+	var report []ShapeExplain
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 2 || report[0].Plans["COLLSCAN"] != 2 || report[0].Shape != "{filter: {a: ?number}}" {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
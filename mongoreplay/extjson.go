@@ -0,0 +1,242 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// the modes of the Extended JSON v2 the documents of the stats are written
+// in, as set by --jsonMode
+const (
+	// extJSONRelaxed writes numbers as JSON numbers and dates as ISO-8601
+	// strings where they can be, for readability.
+	extJSONRelaxed = "relaxed"
+	// extJSONCanonical writes every value with its BSON type, so that the
+	// documents can be converted back to BSON exactly.
+	extJSONCanonical = "canonical"
+)
+
+// extJSONDateFormat is the format of the dates of relaxed Extended JSON.
+const extJSONDateFormat = "2006-01-02T15:04:05.000Z"
+
+// marshalExtJSON serializes a value decoded from BSON, such as the request
+// or reply documents of a stat, in Extended JSON v2, canonical if canonical
+// is set and relaxed otherwise. The fields of documents keep their order.
+func marshalExtJSON(value interface{}, canonical bool) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := writeExtJSON(buf, value, canonical); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeExtJSON writes value to buf in Extended JSON v2.
+func writeExtJSON(buf *bytes.Buffer, value interface{}, canonical bool) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case string:
+		writeJSONString(buf, v)
+	case bson.Symbol:
+		buf.WriteString(`{"$symbol":`)
+		writeJSONString(buf, string(v))
+		buf.WriteByte('}')
+	case int:
+		// the bson package decodes 32-bit integers as int
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			writeExtJSONNumber(buf, "$numberInt", strconv.Itoa(v), canonical)
+		} else {
+			writeExtJSONNumber(buf, "$numberLong", strconv.Itoa(v), canonical)
+		}
+	case int32:
+		writeExtJSONNumber(buf, "$numberInt", strconv.FormatInt(int64(v), 10), canonical)
+	case int64:
+		writeExtJSONNumber(buf, "$numberLong", strconv.FormatInt(v, 10), canonical)
+	case float32:
+		writeExtJSONDouble(buf, float64(v), canonical)
+	case float64:
+		writeExtJSONDouble(buf, v, canonical)
+	case bson.ObjectId:
+		fmt.Fprintf(buf, `{"$oid":"%v"}`, v.Hex())
+	case time.Time:
+		millis := v.Unix()*1000 + int64(v.Nanosecond()/1e6)
+		if year := v.UTC().Year(); !canonical && year >= 1970 && year <= 9999 {
+			fmt.Fprintf(buf, `{"$date":"%v"}`, v.UTC().Format(extJSONDateFormat))
+		} else {
+			fmt.Fprintf(buf, `{"$date":{"$numberLong":"%v"}}`, millis)
+		}
+	case bson.MongoTimestamp:
+		fmt.Fprintf(buf, `{"$timestamp":{"t":%v,"i":%v}}`, uint32(v>>32), uint32(v))
+	case []byte:
+		writeExtJSONBinary(buf, v, 0)
+	case bson.Binary:
+		writeExtJSONBinary(buf, v.Data, v.Kind)
+	case bson.RegEx:
+		// the options of a regular expression are written sorted
+		options := strings.Split(v.Options, "")
+		sort.Strings(options)
+		buf.WriteString(`{"$regularExpression":{"pattern":`)
+		writeJSONString(buf, v.Pattern)
+		buf.WriteString(`,"options":`)
+		writeJSONString(buf, strings.Join(options, ""))
+		buf.WriteString("}}")
+	case bson.JavaScript:
+		buf.WriteString(`{"$code":`)
+		writeJSONString(buf, v.Code)
+		if v.Scope != nil {
+			buf.WriteString(`,"$scope":`)
+			if err := writeExtJSON(buf, v.Scope, canonical); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case bson.DBPointer:
+		buf.WriteString(`{"$dbPointer":{"$ref":`)
+		writeJSONString(buf, v.Namespace)
+		fmt.Fprintf(buf, `,"$id":{"$oid":"%v"}}}`, v.Id.Hex())
+	case mgo.DBRef:
+		doc := bson.D{{Name: "$ref", Value: v.Collection}, {Name: "$id", Value: v.Id}}
+		if v.Database != "" {
+			doc = append(doc, bson.DocElem{Name: "$db", Value: v.Database})
+		}
+		return writeExtJSON(buf, doc, canonical)
+	case bson.D:
+		buf.WriteByte('{')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(buf, elem.Name)
+			buf.WriteByte(':')
+			if err := writeExtJSON(buf, elem.Value, canonical); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case *bson.D:
+		return writeExtJSON(buf, *v, canonical)
+	case bson.M:
+		return writeExtJSON(buf, map[string]interface{}(v), canonical)
+	case *bson.M:
+		return writeExtJSON(buf, map[string]interface{}(*v), canonical)
+	case map[string]interface{}:
+		// maps have no order, so their keys are sorted for the output to be
+		// stable
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		doc := make(bson.D, len(keys))
+		for i, key := range keys {
+			doc[i] = bson.DocElem{Name: key, Value: v[key]}
+		}
+		return writeExtJSON(buf, doc, canonical)
+	case bson.Raw:
+		var decoded interface{}
+		if v.Kind == 0 || v.Kind == 3 {
+			doc := bson.D{}
+			if err := v.Unmarshal(&doc); err != nil {
+				return err
+			}
+			decoded = doc
+		} else if err := v.Unmarshal(&decoded); err != nil {
+			return err
+		}
+		return writeExtJSON(buf, decoded, canonical)
+	case *bson.Raw:
+		return writeExtJSON(buf, *v, canonical)
+	default:
+		switch value {
+		case bson.MinKey:
+			buf.WriteString(`{"$minKey":1}`)
+			return nil
+		case bson.MaxKey:
+			buf.WriteString(`{"$maxKey":1}`)
+			return nil
+		case bson.Undefined:
+			buf.WriteString(`{"$undefined":true}`)
+			return nil
+		}
+		array := reflect.ValueOf(value)
+		if array.Kind() != reflect.Slice && array.Kind() != reflect.Array {
+			return fmt.Errorf("conversion of BSON type '%v' to extended JSON not supported", reflect.TypeOf(value))
+		}
+		buf.WriteByte('[')
+		for i := 0; i < array.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeExtJSON(buf, array.Index(i).Interface(), canonical); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	}
+	return nil
+}
+
+// writeJSONString writes s to buf as a JSON string.
+func writeJSONString(buf *bytes.Buffer, s string) {
+	quoted, _ := json.Marshal(s)
+	buf.Write(quoted)
+}
+
+// writeExtJSONNumber writes an integer, as a plain number in relaxed mode
+// or wrapped in its type in canonical mode.
+func writeExtJSONNumber(buf *bytes.Buffer, typeName, number string, canonical bool) {
+	if canonical {
+		fmt.Fprintf(buf, `{"%v":"%v"}`, typeName, number)
+	} else {
+		buf.WriteString(number)
+	}
+}
+
+// writeExtJSONDouble writes a double, as a plain number in relaxed mode if
+// it is finite. Integral doubles are written with a fractional part, which
+// distinguishes them from integers.
+func writeExtJSONDouble(buf *bytes.Buffer, f float64, canonical bool) {
+	var number string
+	switch {
+	case math.IsNaN(f):
+		number = "NaN"
+	case math.IsInf(f, 1):
+		number = "Infinity"
+	case math.IsInf(f, -1):
+		number = "-Infinity"
+	default:
+		number = strconv.FormatFloat(f, 'G', -1, 64)
+		if !strings.ContainsAny(number, ".E") {
+			number += ".0"
+		}
+		if !canonical {
+			buf.WriteString(number)
+			return
+		}
+	}
+	fmt.Fprintf(buf, `{"$numberDouble":"%v"}`, number)
+}
+
+// writeExtJSONBinary writes binary data of the subtype.
+func writeExtJSONBinary(buf *bytes.Buffer, data []byte, subtype byte) {
+	encoded, _ := json.Marshal(data)
+	fmt.Fprintf(buf, `{"$binary":{"base64":%s,"subType":"%02x"}}`, encoded, subtype)
+}
@@ -0,0 +1,104 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestMarshalExtJSON(t *testing.T) {
+	type testCase struct {
+		name      string
+		value     interface{}
+		relaxed   string
+		canonical string
+	}
+	date := time.Date(2020, 5, 20, 12, 30, 0, 123e6, time.UTC)
+	cases := []testCase{
+		{name: "int32", value: 5, relaxed: `5`, canonical: `{"$numberInt":"5"}`},
+		{name: "int64", value: int64(5), relaxed: `5`, canonical: `{"$numberLong":"5"}`},
+		{name: "large int", value: int(math.MaxInt32) + 1, relaxed: `2147483648`, canonical: `{"$numberLong":"2147483648"}`},
+		{name: "double", value: 1.5, relaxed: `1.5`, canonical: `{"$numberDouble":"1.5"}`},
+		{name: "integral double", value: 2.0, relaxed: `2.0`, canonical: `{"$numberDouble":"2.0"}`},
+		{name: "infinity", value: math.Inf(-1), relaxed: `{"$numberDouble":"-Infinity"}`, canonical: `{"$numberDouble":"-Infinity"}`},
+		{name: "date", value: date, relaxed: `{"$date":"2020-05-20T12:30:00.123Z"}`, canonical: `{"$date":{"$numberLong":"1589977800123"}}`},
+		{name: "date before 1970", value: time.Unix(-1, 0), relaxed: `{"$date":{"$numberLong":"-1000"}}`, canonical: `{"$date":{"$numberLong":"-1000"}}`},
+		{name: "object id", value: bson.ObjectIdHex("5ec58e8c5f1f1b4f1c9f6b4e"), relaxed: `{"$oid":"5ec58e8c5f1f1b4f1c9f6b4e"}`, canonical: `{"$oid":"5ec58e8c5f1f1b4f1c9f6b4e"}`},
+		{name: "binary", value: bson.Binary{Kind: 4, Data: []byte{1, 2}}, relaxed: `{"$binary":{"base64":"AQI=","subType":"04"}}`, canonical: `{"$binary":{"base64":"AQI=","subType":"04"}}`},
+		{name: "regex", value: bson.RegEx{Pattern: "^a", Options: "mi"}, relaxed: `{"$regularExpression":{"pattern":"^a","options":"im"}}`, canonical: `{"$regularExpression":{"pattern":"^a","options":"im"}}`},
+		{name: "timestamp", value: bson.MongoTimestamp(7<<32 | 3), relaxed: `{"$timestamp":{"t":7,"i":3}}`, canonical: `{"$timestamp":{"t":7,"i":3}}`},
+		{name: "min key", value: bson.MinKey, relaxed: `{"$minKey":1}`, canonical: `{"$minKey":1}`},
+		{
+			name:      "ordered document",
+			value:     bson.D{{"find", "c"}, {"filter", bson.D{{"b", 1}, {"a", []interface{}{"x", nil}}}}},
+			relaxed:   `{"find":"c","filter":{"b":1,"a":["x",null]}}`,
+			canonical: `{"find":"c","filter":{"b":{"$numberInt":"1"},"a":["x",null]}}`,
+		},
+		{name: "map", value: bson.M{"b": true, "a": "x"}, relaxed: `{"a":"x","b":true}`, canonical: `{"a":"x","b":true}`},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		relaxed, err := marshalExtJSON(c.value, false)
+		if err != nil || string(relaxed) != c.relaxed {
+			t.Errorf("expected relaxed %v, got %s (%v)", c.relaxed, relaxed, err)
+		}
+		canonical, err := marshalExtJSON(c.value, true)
+		if err != nil || string(canonical) != c.canonical {
+			t.Errorf("expected canonical %v, got %s (%v)", c.canonical, canonical, err)
+		}
+	}
+}
+
+func TestMarshalExtJSONRaw(t *testing.T) {
+	raw, err := dToRaw(bson.D{{"insert", "c"}, {"n", int64(2)}, {"at", time.Unix(0, 0)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := marshalExtJSON([]bson.Raw{*raw}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"insert":"c","n":{"$numberLong":"2"},"at":{"$date":{"$numberLong":"0"}}}]`
+	if string(out) != expected {
+		t.Errorf("expected %v, got %s", expected, out)
+	}
+}
+
+func TestJSONStatRecorderExtJSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	recorder, err := newJSONStatRecorder(StatOptions{JSONMode: extJSONCanonical}, NopWriteCloser(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.RecordStat(&OpStat{
+		Order:       1,
+		RequestData: bson.D{{"count", "c"}, {"limit", int64(10)}},
+		ReplyData:   bson.D{{"n", 3}, {"ok", 1.0}},
+	})
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var stat struct {
+		RequestData json.RawMessage `json:"request_data"`
+		ReplyData   json.RawMessage `json:"reply_data"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &stat); err != nil {
+		t.Fatalf("expected the stat to be valid JSON, got %s (%v)", out.Bytes(), err)
+	}
+	if string(stat.RequestData) != `{"count":"c","limit":{"$numberLong":"10"}}` {
+		t.Errorf("unexpected request data %s", stat.RequestData)
+	}
+	if string(stat.ReplyData) != `{"n":{"$numberInt":"3"},"ok":{"$numberDouble":"1.0"}}` {
+		t.Errorf("unexpected reply data %s", stat.ReplyData)
+	}
+}
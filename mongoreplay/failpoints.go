@@ -0,0 +1,223 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// failpointStep is a configureFailPoint command of a --failpoints file, with
+// the point of the playback at which it is run.
+type failpointStep struct {
+	playbackPoint
+	line    int
+	command bson.D
+	name    string
+	off     bool
+}
+
+// parseFailpointStep parses a line of a --failpoints file: a
+// configureFailPoint command in extended JSON, with an 'at' field saying
+// when it is run.
+func parseFailpointStep(line int, text string) (*failpointStep, error) {
+	doc, err := extendedJSONToD([]byte(text))
+	if err != nil {
+		return nil, err
+	}
+	step := &failpointStep{line: line}
+	var at interface{}
+	for _, elem := range doc {
+		if elem.Name == "at" {
+			at = elem.Value
+		} else {
+			step.command = append(step.command, elem)
+		}
+	}
+	if len(step.command) == 0 || step.command[0].Name != "configureFailPoint" {
+		return nil, fmt.Errorf("expected a configureFailPoint command")
+	}
+	name, ok := step.command[0].Value.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected the name of a failpoint, got %v", step.command[0].Value)
+	}
+	step.name = name
+	mode, ok := FindValueByKey("mode", &step.command)
+	if !ok {
+		return nil, fmt.Errorf("missing mode of failpoint %v", name)
+	}
+	step.off = mode == "off"
+	atString, ok := at.(string)
+	if !ok {
+		return nil, fmt.Errorf("missing 'at' of failpoint %v", name)
+	}
+	point, err := parsePlaybackPoint(atString, true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'at' of failpoint %v: %v", name, err)
+	}
+	step.playbackPoint = *point
+	return step, nil
+}
+
+// failpointSchedule implements the PreOpHook interface, running the
+// configureFailPoint commands of a --failpoints file on the server played
+// against as the playback reaches the points they are scheduled at, before
+// the op which reaches them is played. The connections wait while a command
+// runs, so that no op scheduled after it is played before the failpoint is
+// set. The failpoints left enabled are turned off once playback finishes.
+type failpointSchedule struct {
+	// run runs a command against the admin database of the server.
+	run func(command bson.D) error
+	// abort, when set, stops the playback once a command fails.
+	abort func(error)
+
+	sync.Mutex
+	pending []*failpointStep
+	// start is the time the first op of the recording was seen, which the
+	// offsets are relative to; unless set before playback begins, it is
+	// that of the first op played.
+	start time.Time
+	// enabled holds the failpoints which were set to a mode other than
+	// 'off'.
+	enabled map[string]bool
+}
+
+// readFailpointSchedule reads the steps of the --failpoints file at path.
+// Blank lines and lines starting with '#' are skipped.
+func readFailpointSchedule(path string) (*failpointSchedule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	schedule := &failpointSchedule{enabled: map[string]bool{}}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		step, err := parseFailpointStep(line, text)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		schedule.pending = append(schedule.pending, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(schedule.pending) == 0 {
+		return nil, fmt.Errorf("%v holds no failpoints", path)
+	}
+	return schedule, nil
+}
+
+// runStart runs the steps scheduled at the start, before playback begins.
+// If one fails, those already set are turned off before its error is
+// returned.
+func (schedule *failpointSchedule) runStart() error {
+	schedule.Lock()
+	defer schedule.Unlock()
+	err := schedule.runDue(func(step *failpointStep) bool { return step.atStart }, "before playback")
+	if err != nil {
+		// playback won't begin, so the failpoints set before the step which
+		// failed are turned off again
+		if offErr := schedule.turnOff(); offErr != nil {
+			userInfoLogger.Logvf(Always, "%v", offErr)
+		}
+	}
+	return err
+}
+
+func (schedule *failpointSchedule) BeforeOp(op *RecordedOp, parsedOp Op) error {
+	schedule.Lock()
+	defer schedule.Unlock()
+	if len(schedule.pending) == 0 {
+		return nil
+	}
+	if schedule.start.IsZero() && op.Seen != nil {
+		schedule.start = op.Seen.Time
+	}
+	when := fmt.Sprintf("before op %v of connection %v", op.Order, op.SeenConnectionNum)
+	err := schedule.runDue(func(step *failpointStep) bool { return step.due(op, schedule.start) }, when)
+	if err != nil && schedule.abort != nil {
+		schedule.abort(err)
+	}
+	return nil
+}
+
+// runDue runs the pending steps which are due, in the order of the file,
+// stopping at the first which fails. The schedule must be locked.
+func (schedule *failpointSchedule) runDue(due func(*failpointStep) bool, when string) error {
+	var pending []*failpointStep
+	var err error
+	for _, step := range schedule.pending {
+		if err != nil || !due(step) {
+			pending = append(pending, step)
+			continue
+		}
+		if runErr := schedule.run(step.command); runErr != nil {
+			err = fmt.Errorf("error setting failpoint %v of line %v: %v", step.name, step.line, runErr)
+			pending = append(pending, step)
+			continue
+		}
+		schedule.enabled[step.name] = !step.off
+		mode, _ := FindValueByKey("mode", &step.command)
+		userInfoLogger.Logvf(Always, "Set failpoint %v to %v %v (at %v)", step.name, mode, when, step.at)
+	}
+	schedule.pending = pending
+	return err
+}
+
+// finish turns off the failpoints left enabled, and logs the steps which
+// the playback never reached.
+func (schedule *failpointSchedule) finish() error {
+	schedule.Lock()
+	defer schedule.Unlock()
+	if len(schedule.pending) > 0 {
+		var ats []string
+		for _, step := range schedule.pending {
+			ats = append(ats, fmt.Sprintf("%v at %v", step.name, step.at))
+		}
+		userInfoLogger.Logvf(Always, "%v failpoints were never set, as playback didn't reach them: %v",
+			len(schedule.pending), strings.Join(ats, ", "))
+	}
+	return schedule.turnOff()
+}
+
+// turnOff turns off the failpoints left enabled, trying each of them even
+// if one fails, and returns the first error. The schedule must be locked.
+func (schedule *failpointSchedule) turnOff() error {
+	var names []string
+	for name, enabled := range schedule.enabled {
+		if enabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var firstErr error
+	for _, name := range names {
+		command := bson.D{{Name: "configureFailPoint", Value: name}, {Name: "mode", Value: "off"}}
+		if err := schedule.run(command); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error turning off failpoint %v: %v", name, err)
+			}
+			continue
+		}
+		schedule.enabled[name] = false
+		userInfoLogger.Logvf(Always, "Turned off failpoint %v", name)
+	}
+	return firstErr
+}
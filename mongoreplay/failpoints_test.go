@@ -0,0 +1,203 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestParseFailpointStep(t *testing.T) {
+	type testCase struct {
+		name string
+		line string
+		err  string
+	}
+	cases := []testCase{
+		{
+			name: "at start",
+			line: `{"at": "start", "configureFailPoint": "failCommand", "mode": "alwaysOn", "data": {"failCommands": ["insert"], "errorCode": 91}}`,
+		},
+		{
+			name: "at an offset",
+			line: `{"configureFailPoint": "failCommand", "mode": {"times": 3}, "at": "90s"}`,
+		},
+		{
+			name: "at an op",
+			line: `{"configureFailPoint": "failCommand", "mode": "off", "at": "op:1000"}`,
+		},
+		{
+			name: "at a time",
+			line: `{"configureFailPoint": "failCommand", "mode": "off", "at": "2020-05-20T12:00:00Z"}`,
+		},
+		{
+			name: "not a configureFailPoint",
+			line: `{"at": "start", "ping": 1}`,
+			err:  "expected a configureFailPoint command",
+		},
+		{
+			name: "no mode",
+			line: `{"at": "start", "configureFailPoint": "failCommand"}`,
+			err:  "missing mode",
+		},
+		{
+			name: "no at",
+			line: `{"configureFailPoint": "failCommand", "mode": "off"}`,
+			err:  "missing 'at'",
+		},
+		{
+			name: "invalid at",
+			line: `{"configureFailPoint": "failCommand", "mode": "off", "at": "soon"}`,
+			err:  "is neither",
+		},
+		{
+			name: "negative offset",
+			line: `{"configureFailPoint": "failCommand", "mode": "off", "at": "-5s"}`,
+			err:  "negative",
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		step, err := parseFailpointStep(1, c.line)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("expected an error containing %q, got %v", c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if step.name != "failCommand" || step.command[0].Name != "configureFailPoint" {
+			t.Errorf("unexpected command %v", step.command)
+		}
+		if _, ok := FindValueByKey("at", &step.command); ok {
+			t.Errorf("expected 'at' to be removed from the command")
+		}
+	}
+}
+
+func TestFailpointSchedule(t *testing.T) {
+	file, err := ioutil.TempFile("", "failpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	fmt.Fprint(file, `# fail inserts from the start, reads after a minute
+{"at": "start", "configureFailPoint": "failInserts", "mode": "alwaysOn"}
+
+{"at": "1m", "configureFailPoint": "failReads", "mode": "alwaysOn"}
+{"at": "op:5", "configureFailPoint": "failInserts", "mode": "off"}
+{"at": "1h", "configureFailPoint": "neverReached", "mode": "alwaysOn"}
+`)
+	file.Close()
+
+	schedule, err := readFailpointSchedule(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var run []string
+	schedule.run = func(command bson.D) error {
+		mode, _ := FindValueByKey("mode", &command)
+		run = append(run, fmt.Sprintf("%v %v", command[0].Value, mode))
+		return nil
+	}
+	start := time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC)
+	schedule.start = start
+	if err := schedule.runStart(); err != nil {
+		t.Fatal(err)
+	}
+	play := func(order int64, offset time.Duration) {
+		schedule.BeforeOp(&RecordedOp{Order: order, Seen: &PreciseTime{start.Add(offset)}}, nil)
+	}
+	play(1, 0)
+	play(2, 30*time.Second)
+	if strings.Join(run, ", ") != "failInserts alwaysOn" {
+		t.Errorf("expected only the failpoint at the start to be set, got %v", run)
+	}
+	play(3, time.Minute)
+	play(5, time.Minute)
+	if strings.Join(run, ", ") != "failInserts alwaysOn, failReads alwaysOn, failInserts off" {
+		t.Errorf("unexpected failpoints set: %v", run)
+	}
+
+	run = nil
+	if err := schedule.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(run, ", ") != "failReads off" {
+		t.Errorf("expected the failpoints left enabled to be turned off, got %v", run)
+	}
+	if len(schedule.pending) != 1 || schedule.pending[0].name != "neverReached" {
+		t.Errorf("expected the last failpoint to never be set")
+	}
+}
+
+func TestFailpointScheduleStartFails(t *testing.T) {
+	var steps []*failpointStep
+	for i, line := range []string{
+		`{"at": "start", "configureFailPoint": "failInserts", "mode": "alwaysOn"}`,
+		`{"at": "start", "configureFailPoint": "failReads", "mode": "alwaysOn"}`,
+		`{"at": "start", "configureFailPoint": "unknown", "mode": "alwaysOn"}`,
+	} {
+		step, err := parseFailpointStep(i+1, line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		steps = append(steps, step)
+	}
+	var run []string
+	schedule := &failpointSchedule{
+		pending: steps,
+		enabled: map[string]bool{},
+		run: func(command bson.D) error {
+			mode, _ := FindValueByKey("mode", &command)
+			run = append(run, fmt.Sprintf("%v %v", command[0].Value, mode))
+			if command[0].Value == "unknown" || (command[0].Value == "failInserts" && mode == "off") {
+				return fmt.Errorf("unknown failpoint")
+			}
+			return nil
+		},
+	}
+	if err := schedule.runStart(); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Fatalf("expected the failpoint of line 3 to fail, got %v", err)
+	}
+	expected := "failInserts alwaysOn, failReads alwaysOn, unknown alwaysOn, failInserts off, failReads off"
+	if strings.Join(run, ", ") != expected {
+		t.Errorf("expected the failpoints set to be turned off, even after one fails to be, got %v", run)
+	}
+	if !schedule.enabled["failInserts"] || schedule.enabled["failReads"] {
+		t.Errorf("expected only the failpoint which failed to be turned off to be left enabled, got %v", schedule.enabled)
+	}
+}
+
+func TestFailpointScheduleAborts(t *testing.T) {
+	step, err := parseFailpointStep(1, `{"at": "op:1", "configureFailPoint": "unknown", "mode": "alwaysOn"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var aborted error
+	schedule := &failpointSchedule{
+		pending: []*failpointStep{step},
+		enabled: map[string]bool{},
+		run:     func(bson.D) error { return fmt.Errorf("unknown failpoint") },
+		abort:   func(err error) { aborted = err },
+	}
+	if err := schedule.BeforeOp(&RecordedOp{Order: 1}, nil); err != nil {
+		t.Errorf("expected the op to be played, got %v", err)
+	}
+	if aborted == nil || !strings.Contains(aborted.Error(), "unknown failpoint") {
+		t.Errorf("expected the playback to be aborted, got %v", aborted)
+	}
+}
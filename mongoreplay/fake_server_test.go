@@ -0,0 +1,203 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// fakeServer is a server answering every OP_QUERY and OP_MSG with a reply
+// which is acknowledged and describes a primary, so that ops can be played
+// without a live server. It counts the connections open to it and the ops
+// it receives, with the connections they were received on, and keeps the
+// _ids of the documents inserted in each collection, failing the inserts of
+// the _ids already inserted with duplicate key errors.
+type fakeServer struct {
+	t        *testing.T
+	listener net.Listener
+
+	mu         sync.Mutex
+	open       int
+	maxOpen    int
+	accepted   int
+	opCodes    []receivedOpCode
+	received   []bson.D
+	ids        map[string]map[string]bool
+	duplicates int
+}
+
+// receivedOpCode is the opcode of an op received by a fakeServer, with the
+// number of the connection it was received on, counted from 1 in the order
+// they were accepted.
+type receivedOpCode struct {
+	conn   int
+	opCode OpCode
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeServer{t: t, listener: listener, ids: map[string]map[string]bool{}}
+	go server.serve()
+	return server
+}
+
+func (server *fakeServer) addr() string {
+	return server.listener.Addr().String()
+}
+
+// session returns a session connected directly to the server.
+func (server *fakeServer) session() *mgo.Session {
+	session, err := mgo.DialWithTimeout(server.addr()+"?connect=direct", 5*time.Second)
+	if err != nil {
+		server.t.Fatal(err)
+	}
+	return session
+}
+
+func (server *fakeServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+	server.mu.Lock()
+	server.open++
+	if server.open > server.maxOpen {
+		server.maxOpen = server.open
+	}
+	server.accepted++
+	connNum := server.accepted
+	server.mu.Unlock()
+	defer func() {
+		server.mu.Lock()
+		server.open--
+		server.mu.Unlock()
+	}()
+
+	reply := bson.D{{"ok", 1}, {"ismaster", true}, {"maxWireVersion", 6}, {"nonce", "2375531c32080ae8"}, {"n", 1}}
+	for {
+		header, err := ReadHeader(conn)
+		if err != nil {
+			return
+		}
+		op := RawOp{Header: *header, Body: make([]byte, MsgHeaderLen)}
+		if err := op.FromReader(conn); err != nil {
+			return
+		}
+		server.mu.Lock()
+		server.opCodes = append(server.opCodes, receivedOpCode{connNum, header.OpCode})
+		server.mu.Unlock()
+		var response []byte
+		switch header.OpCode {
+		case OpCodeQuery:
+			response = replyMessage(server.t, header.RequestID, reply)
+		case OpCodeMessage:
+			msgReply := reply
+			if parsed, err := op.Parse(); err == nil {
+				if msgOp, ok := parsed.(*MsgOp); ok {
+					msgReply = server.receive(msgOp, reply)
+				}
+			}
+			raw, err := newMsgRawOp(0, header.RequestID, msgReply)
+			if err != nil {
+				return
+			}
+			response = raw.Body
+		}
+		if response != nil {
+			if _, err := conn.Write(response); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// receive keeps the payload of type 0 of the OP_MSG received, with the
+// documents of its document sequence, if any, in its 'documents' array,
+// returning its reply.
+func (server *fakeServer) receive(op *MsgOp, reply bson.D) bson.D {
+	raw, _, err := fetchPayload0Data(op.Sections)
+	if err != nil {
+		return reply
+	}
+	doc, err := bsonToD(raw)
+	if err != nil {
+		return reply
+	}
+	value, _ := FindValueByKey("documents", &doc)
+	docs, _ := value.([]interface{})
+	for _, section := range op.Sections {
+		if payload, ok := section.Data.(mgo.PayloadType1); ok && payload.Identifier == "documents" {
+			docs = append(docs, payload.Docs...)
+			doc = setDocField(doc, "documents", docs)
+		}
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.received = append(server.received, doc)
+	if len(doc) == 0 || doc[0].Name != "insert" {
+		return reply
+	}
+	ns := fmt.Sprintf("%v", doc[0].Value)
+	if server.ids[ns] == nil {
+		server.ids[ns] = map[string]bool{}
+	}
+	var writeErrors []interface{}
+	for i, inserted := range docs {
+		insertedDoc, err := bsonToD(inserted)
+		if err != nil {
+			continue
+		}
+		id, ok := FindValueByKey("_id", &insertedDoc)
+		if !ok {
+			continue
+		}
+		key := fmt.Sprintf("%#v", id)
+		if server.ids[ns][key] {
+			server.duplicates++
+			writeErrors = append(writeErrors, bson.D{{"index", i}, {"code", 11000}, {"errmsg", "E11000 duplicate key error"}})
+		}
+		server.ids[ns][key] = true
+	}
+	if len(writeErrors) == 0 {
+		return reply
+	}
+	return append(append(bson.D{}, reply...), bson.DocElem{Name: "writeErrors", Value: writeErrors})
+}
+
+// commands returns the OP_MSG commands received named name.
+func (server *fakeServer) commands(name string) []bson.D {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	var commands []bson.D
+	for _, doc := range server.received {
+		if len(doc) > 0 && doc[0].Name == name {
+			commands = append(commands, doc)
+		}
+	}
+	return commands
+}
+
+func (server *fakeServer) Close() {
+	server.listener.Close()
+}
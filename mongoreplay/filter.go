@@ -26,6 +26,8 @@ type FilterCommand struct {
 	RemoveDriverOps bool     `description:"remove driver issued operations from the playback" long:"removeDriverOps"`
 	Gzip            bool     `long:"gzip" description:"decompress gzipped input"`
 
+	EncryptionOptions `group:"encryption options"`
+
 	duration  time.Duration
 	startTime time.Time
 }
@@ -56,6 +58,9 @@ func (filter *FilterCommand) Execute(args []string) error {
 		return err
 	}
 	filter.GlobalOpts.SetLogging()
+	if err := filter.setTapeEncryption(); err != nil {
+		return err
+	}
 
 	playbackFileReader, err := NewPlaybackFileReader(filter.PlaybackFile, filter.Gzip)
 	if err != nil {
@@ -73,6 +78,7 @@ func (filter *FilterCommand) Execute(args []string) error {
 			return err
 		}
 		outfiles[0] = playbackWriter
+		defer playbackWriter.Close()
 	} else {
 		for i := 0; i < filter.Split; i++ {
 			playbackWriter, err := NewPlaybackFileWriter(
@@ -12,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	mgo "github.com/10gen/llmgo"
 	"github.com/10gen/llmgo/bson"
 )
 
@@ -446,3 +447,57 @@ type nopWriteCloser struct {
 func (wc *nopWriteCloser) Close() error {
 	return nil
 }
+
+func TestIsDriverOp(t *testing.T) {
+	speculative := bson.D{{"saslStart", 1}, {"mechanism", "SCRAM-SHA-256"}, {"payload", []byte("n,,n=user,r=nonce")}, {"db", "admin"}}
+	type testCase struct {
+		name     string
+		op       Op
+		expected bool
+	}
+	cases := []testCase{
+		{
+			name:     "legacy isMaster",
+			op:       &QueryOp{QueryOp: mgo.QueryOp{Collection: "admin.$cmd", Query: bson.D{{"isMaster", 1}}}},
+			expected: true,
+		},
+		{
+			name:     "legacy isMaster with speculative authentication",
+			op:       &QueryOp{QueryOp: mgo.QueryOp{Collection: "admin.$cmd", Query: bson.D{{"isMaster", 1}, {"speculativeAuthenticate", speculative}}}},
+			expected: true,
+		},
+		{
+			name: "wrapped legacy isMaster",
+			op: &QueryOp{QueryOp: mgo.QueryOp{Collection: "admin.$cmd",
+				Query: bson.D{{"$query", bson.D{{"isMaster", 1}}}, {"$readPreference", bson.D{{"mode", "primaryPreferred"}}}}}},
+			expected: true,
+		},
+		{
+			name:     "legacy find",
+			op:       &QueryOp{QueryOp: mgo.QueryOp{Collection: "test.c", Query: bson.D{{"$query", bson.D{{"a", 1}}}}}},
+			expected: false,
+		},
+	}
+	for _, command := range []struct {
+		name     string
+		body     bson.D
+		expected bool
+	}{
+		{"hello", bson.D{{"hello", 1}}, true},
+		{"hello with speculative authentication", bson.D{{"hello", 1}, {"speculativeAuthenticate", speculative}}, true},
+		{"saslContinue", bson.D{{"saslContinue", 1}, {"conversationId", 1}}, true},
+		{"find", bson.D{{"find", "c"}}, false},
+	} {
+		op, err := newMsgCommand("admin", command.body)
+		if err != nil {
+			t.Fatalf("error building the command: %v", err)
+		}
+		cases = append(cases, testCase{name: "OP_MSG " + command.name, op: op, expected: command.expected})
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		if isDriverOp := IsDriverOp(c.op); isDriverOp != c.expected {
+			t.Errorf("expected %v, got %v", c.expected, isDriverOp)
+		}
+	}
+}
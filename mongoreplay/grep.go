@@ -0,0 +1,282 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// GrepCommand stores settings for the mongoreplay 'grep' subcommand
+type GrepCommand struct {
+	GlobalOpts   *Options `no-flag:"true"`
+	PlaybackFile string   `description:"path to the playback file to search" short:"p" long:"playback-file" required:"yes"`
+	Limit        int      `long:"limit" description:"stop after printing this number of ops; 0 prints every op matched"`
+	Replies      bool     `long:"replies" description:"search the replies as well as the ops"`
+	Gzip         bool     `long:"gzip" description:"decompress gzipped input"`
+
+	predicates []*grepPredicate
+}
+
+// grepPredicate is a '<field>=<value>' argument of grep, matching the ops
+// holding the field, at any depth of the document they send, with a value
+// matching the given one. The field may be a dotted path, such as
+// 'customer.id', which matches the fields ending with it. Without a value,
+// it matches the ops holding the field, whatever its value.
+type grepPredicate struct {
+	spec  string
+	names []string
+	value interface{}
+	// any is set when no value was given.
+	any bool
+}
+
+// parseGrepPredicate parses a grep argument. The value is read as an
+// extended JSON value, such as 123, "abc", /^abc/i or ObjectId("..."), or
+// else taken as a string.
+func parseGrepPredicate(spec string) (*grepPredicate, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("'%v' is not '<field>=<value>'", spec)
+	}
+	predicate := &grepPredicate{spec: spec, names: strings.Split(parts[0], ".")}
+	for _, name := range predicate.names {
+		if name == "" {
+			return nil, fmt.Errorf("invalid field '%v'", parts[0])
+		}
+	}
+	if len(parts) == 1 {
+		predicate.any = true
+		return predicate, nil
+	}
+	predicate.value = parts[1]
+	if match, err := parseOpMatch(`{"v": ` + parts[1] + `}`); err == nil && len(match) == 1 {
+		predicate.value = match[0].Value
+	} else if err != nil && strings.Contains(err.Error(), "invalid regular expression") {
+		return nil, err
+	}
+	return predicate, nil
+}
+
+// find returns the paths of the fields of doc the predicate matches.
+func (predicate *grepPredicate) find(doc interface{}) []string {
+	var found []string
+	var walk func(value interface{}, path, names []string)
+	visit := func(name string, value interface{}, path, names []string) {
+		path = append(path[:len(path):len(path)], name)
+		names = append(names[:len(names):len(names)], name)
+		if predicate.matchesField(names) && predicate.matchesValue(value) {
+			found = append(found, strings.Join(path, "."))
+		}
+		walk(value, path, names)
+	}
+	walk = func(value interface{}, path, names []string) {
+		switch v := value.(type) {
+		case bson.D:
+			for _, elem := range v {
+				visit(elem.Name, elem.Value, path, names)
+			}
+		case *bson.D:
+			walk(*v, path, names)
+		case bson.M:
+			walk(map[string]interface{}(v), path, names)
+		case map[string]interface{}:
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				visit(key, v[key], path, names)
+			}
+		case bson.Raw:
+			walk(rawToValue(v), path, names)
+		case *bson.Raw:
+			walk(rawToValue(*v), path, names)
+		case []interface{}:
+			// the elements of arrays are searched as the array itself, so
+			// that 'documents.accountId' matches every inserted document
+			for i, elem := range v {
+				walk(elem, append(path[:len(path):len(path)], strconv.Itoa(i)), names)
+			}
+		case []bson.D:
+			for i, elem := range v {
+				walk(elem, append(path[:len(path):len(path)], strconv.Itoa(i)), names)
+			}
+		}
+	}
+	walk(doc, nil, nil)
+	return found
+}
+
+// matchesField returns whether the field path ends with that of the
+// predicate.
+func (predicate *grepPredicate) matchesField(names []string) bool {
+	if len(names) < len(predicate.names) {
+		return false
+	}
+	suffix := names[len(names)-len(predicate.names):]
+	for i, name := range predicate.names {
+		if suffix[i] != name {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesValue returns whether the value of a field matches that of the
+// predicate, or one of its elements does if it is an array.
+func (predicate *grepPredicate) matchesValue(value interface{}) bool {
+	if predicate.any || valueMatches(predicate.value, value) {
+		return true
+	}
+	if array, ok := value.([]interface{}); ok {
+		for _, elem := range array {
+			if valueMatches(predicate.value, elem) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rawToValue unmarshals a bson document or array, returning nil if it can't
+// be read.
+func rawToValue(raw bson.Raw) interface{} {
+	if raw.Kind == 0x04 {
+		var array []interface{}
+		if err := raw.Unmarshal(&array); err != nil {
+			return nil
+		}
+		return array
+	}
+	doc, err := bsonToD(raw)
+	if err != nil {
+		return nil
+	}
+	return doc
+}
+
+// ValidateParams validates the settings described in the GrepCommand struct.
+func (grep *GrepCommand) ValidateParams(args []string) error {
+	switch {
+	case len(args) == 0:
+		return fmt.Errorf("expected at least one '<field>=<value>' to search for")
+	case grep.Limit < 0:
+		return fmt.Errorf("Invalid setting for --limit: '%v', value must be >=0", grep.Limit)
+	}
+	grep.predicates = nil
+	for _, arg := range args {
+		predicate, err := parseGrepPredicate(arg)
+		if err != nil {
+			return err
+		}
+		grep.predicates = append(grep.predicates, predicate)
+	}
+	return nil
+}
+
+// Execute runs the program for the 'grep' subcommand
+func (grep *GrepCommand) Execute(args []string) error {
+	if err := grep.ValidateParams(args); err != nil {
+		return err
+	}
+	grep.GlobalOpts.SetLogging()
+
+	reader, err := NewPlaybackFileReader(grep.PlaybackFile, grep.Gzip)
+	if err != nil {
+		return err
+	}
+	if grep.Replies && reader.metadata.RepliesCompacted {
+		userInfoLogger.Logvf(Always, "Warning: the replies of %v were compacted, only their cursors and errors can be matched", grep.PlaybackFile)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	matched, err := grepOps(reader, out, grep.predicates, grep.Limit, grep.Replies)
+	if err != nil {
+		return err
+	}
+	userInfoLogger.Logvf(Info, "Found %v ops", matched)
+	return nil
+}
+
+// grepOps writes a line summarizing each op of a playback file matching
+// every predicate to out, returning the number of ops matched. Each line
+// holds the offset of the op in the playback file, its order, connection,
+// the time it was seen, its command and namespace, and the fields matched.
+// At most limit ops are printed, unless it is 0.
+func grepOps(reader *PlaybackFileReader, out io.Writer, predicates []*grepPredicate, limit int, replies bool) (int, error) {
+	opChan, errChan := reader.OpChan(1)
+	var matched int
+	var grepErr error
+	for op := range opChan {
+		if grepErr != nil || op.EOF || (limit > 0 && matched == limit) {
+			continue
+		}
+		parsedOp, err := op.RawOp.Parse()
+		if err != nil {
+			grepErr = fmt.Errorf("error parsing op %v: %v", op.Order, err)
+			continue
+		}
+		if parsedOp == nil {
+			continue
+		}
+		if _, ok := parsedOp.(Replyable); ok && !replies {
+			continue
+		}
+		request, err := requestOf(parsedOp)
+		if err != nil {
+			grepErr = fmt.Errorf("error reading op %v: %v", op.Order, err)
+			continue
+		}
+		var fields []string
+		for _, predicate := range predicates {
+			found := predicate.find(request)
+			if len(found) == 0 {
+				fields = nil
+				break
+			}
+			fields = append(fields, found...)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if grepErr = writeGrepLine(out, op, parsedOp, fields); grepErr == nil {
+			matched++
+		}
+	}
+	if err := <-errChan; err != nil && err != io.EOF {
+		return matched, err
+	}
+	return matched, grepErr
+}
+
+func writeGrepLine(out io.Writer, op *RecordedOp, parsedOp Op, fields []string) error {
+	meta := parsedOp.Meta()
+	name := commandNameOf(parsedOp)
+	if name == "" {
+		name = meta.Op
+	}
+	ns := namespaceOf(parsedOp)
+	if ns == "" {
+		ns = meta.Ns
+	}
+	seen := ""
+	if op.Seen != nil {
+		seen = op.Seen.Format("2006-01-02T15:04:05.000Z07:00")
+	}
+	_, err := fmt.Fprintf(out, "offset %v\top %v\tconnection %v\t%v\t%v %v\t%v\n",
+		op.Offset, op.Order, op.SeenConnectionNum, seen, name, ns, strings.Join(fields, ","))
+	return err
+}
@@ -0,0 +1,156 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestGrepOps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-grep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeDumpTape(t, dir)
+
+	type testCase struct {
+		name       string
+		predicates []string
+		limit      int
+		replies    bool
+		lines      []string
+	}
+	cases := []testCase{
+		{name: "inserted document", predicates: []string{"docNum=2"}, lines: []string{"insert mongoreplay.test\tdocuments.0.docNum"}},
+		{name: "filter", predicates: []string{"filter.docNum=1"}, lines: []string{"find mongoreplay.test\tfilter.docNum"}},
+		{name: "any depth", predicates: []string{"docNum=1"},
+			lines: []string{"insert mongoreplay.test\tdocuments.0.docNum", "find mongoreplay.test\tfilter.docNum"}},
+		{name: "array path", predicates: []string{"documents.docNum=3"}, lines: []string{"documents.0.docNum"}},
+		{name: "every predicate", predicates: []string{"docNum=0", "find"}, lines: []string{"find mongoreplay.test\tfilter.docNum,find"}},
+		{name: "any value", predicates: []string{"filter"}, limit: 1, lines: []string{"find mongoreplay.test\tfilter"}},
+		{name: "string value", predicates: []string{"insert=test"}, limit: 1, lines: []string{"insert mongoreplay.test\tinsert"}},
+		{name: "regular expression", predicates: []string{"find=/^TE/i"}, lines: []string{"\tfind", "\tfind"}},
+		{name: "replies", predicates: []string{"cursor.id=0"}, replies: true, lines: []string{"cursor.id", "cursor.id"}},
+		{name: "no match", predicates: []string{"docNum=7"}},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		var predicates []*grepPredicate
+		for _, spec := range c.predicates {
+			predicate, err := parseGrepPredicate(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			predicates = append(predicates, predicate)
+		}
+		reader, err := NewPlaybackFileReader(path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &bytes.Buffer{}
+		matched, err := grepOps(reader, out, predicates, c.limit, c.replies)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != len(c.lines) {
+			t.Errorf("expected %v ops to match, got %v:\n%v", len(c.lines), matched, out)
+			continue
+		}
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		for i, expected := range c.lines {
+			if !strings.Contains(lines[i], expected) {
+				t.Errorf("expected %q in line %q", expected, lines[i])
+			}
+		}
+	}
+}
+
+func TestParseGrepPredicate(t *testing.T) {
+	type testCase struct {
+		spec  string
+		value interface{}
+		err   string
+	}
+	cases := []testCase{
+		{spec: "accountId=123", value: 123},
+		{spec: `accountId="123"`, value: "123"},
+		{spec: "name=acme corp", value: "acme corp"},
+		{spec: "active=true", value: true},
+		{spec: "=123", err: "is not"},
+		{spec: "customer..id=1", err: "invalid field"},
+		{spec: "name=/[/", err: "invalid regular expression"},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.spec)
+		predicate, err := parseGrepPredicate(c.spec)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("expected an error containing %q, got %v", c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if !valueMatches(predicate.value, c.value) {
+			t.Errorf("expected %v to be parsed as %v, got %#v", c.spec, c.value, predicate.value)
+		}
+	}
+}
+
+// TestOpOffsets checks that the ops read from a playback file hold their
+// offset in it.
+func TestOpOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-grep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeDumpTape(t, dir)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewPlaybackFileReader(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opChan, errChan := reader.OpChan(1)
+	var ops int
+	for op := range opChan {
+		if op.EOF {
+			continue
+		}
+		doc, err := ReadDocument(bytes.NewReader(data[op.Offset:]))
+		if err != nil {
+			t.Fatalf("error reading op %v at offset %v: %v", op.Order, op.Offset, err)
+		}
+		fromOffset := new(RecordedOp)
+		if err := bson.Unmarshal(doc, fromOffset); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(fromOffset.RawOp.Body, op.RawOp.Body) {
+			t.Errorf("expected op %v at offset %v", op.Order, op.Offset)
+		}
+		ops++
+	}
+	if err := <-errChan; err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if ops != 8 {
+		t.Errorf("expected 8 ops, got %v", ops)
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	heatmapFormatCSV  = "csv"
+	heatmapFormatJSON = "json"
+)
+
+// HeatmapCommand stores settings for the mongoreplay 'heatmap' subcommand
+type HeatmapCommand struct {
+	GlobalOpts   *Options `no-flag:"true"`
+	PlaybackFile string   `description:"path to the playback file to analyze" short:"p" long:"playback-file" required:"yes"`
+	Bucket       string   `long:"bucket" description:"length of the time buckets the ops are counted in, such as 1m or 10s" default:"1m"`
+	Format       string   `long:"format" description:"output format: csv, with a row per bucket and a column per op type and namespace, or json" choice:"csv" choice:"json" default:"csv"`
+	Gzip         bool     `long:"gzip" description:"decompress gzipped input"`
+
+	bucket time.Duration
+}
+
+// heatmap counts ops by their type and namespace in buckets of time.
+type heatmap struct {
+	bucket time.Duration
+	counts map[time.Time]map[string]int64
+	names  map[string]bool
+}
+
+// heatmapBucket holds the counts of a bucket of a heatmap, in its json form.
+type heatmapBucket struct {
+	Start  time.Time        `json:"start"`
+	Total  int64            `json:"total"`
+	Counts map[string]int64 `json:"counts"`
+}
+
+func newHeatmap(bucket time.Duration) *heatmap {
+	return &heatmap{
+		bucket: bucket,
+		counts: map[time.Time]map[string]int64{},
+		names:  map[string]bool{},
+	}
+}
+
+// parseHeatmapBucket parses the length of the buckets of a heatmap.
+func parseHeatmapBucket(flag, value string) (time.Duration, error) {
+	bucket, err := time.ParseDuration(value)
+	if err != nil || bucket <= 0 {
+		return 0, fmt.Errorf("Invalid setting for --%v: '%v', value must be a duration such as 1m or 10s", flag, value)
+	}
+	return bucket, nil
+}
+
+// heatmapName returns the name an op is counted under: its command name, or
+// its op type, and its namespace.
+func heatmapName(op, command, ns string) string {
+	name := command
+	if name == "" {
+		name = op
+	}
+	if ns != "" {
+		name += " " + ns
+	}
+	return name
+}
+
+// add counts an op seen or played at the given time.
+func (h *heatmap) add(at time.Time, name string) {
+	start := at.Truncate(h.bucket)
+	counts, ok := h.counts[start]
+	if !ok {
+		counts = map[string]int64{}
+		h.counts[start] = counts
+	}
+	counts[name]++
+	h.names[name] = true
+}
+
+// buckets returns the buckets of the heatmap in order, from the first op
+// counted to the last, including the buckets without ops between them.
+func (h *heatmap) buckets() []heatmapBucket {
+	if len(h.counts) == 0 {
+		return nil
+	}
+	var first, last time.Time
+	for start := range h.counts {
+		if first.IsZero() || start.Before(first) {
+			first = start
+		}
+		if start.After(last) {
+			last = start
+		}
+	}
+	var buckets []heatmapBucket
+	for start := first; !start.After(last); start = start.Add(h.bucket) {
+		bucket := heatmapBucket{Start: start, Counts: map[string]int64{}}
+		for name, count := range h.counts[start] {
+			bucket.Counts[name] = count
+			bucket.Total += count
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets
+}
+
+// sortedNames returns the names counted, those of the most ops first.
+func (h *heatmap) sortedNames() []string {
+	totals := map[string]int64{}
+	for _, counts := range h.counts {
+		for name, count := range counts {
+			totals[name] += count
+		}
+	}
+	names := make([]string, 0, len(h.names))
+	for name := range h.names {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if totals[names[i]] != totals[names[j]] {
+			return totals[names[i]] > totals[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// write writes the heatmap in the given format.
+func (h *heatmap) write(out io.Writer, format string) error {
+	if format == heatmapFormatJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			BucketSeconds float64         `json:"bucketSeconds"`
+			Names         []string        `json:"names"`
+			Buckets       []heatmapBucket `json:"buckets"`
+		}{h.bucket.Seconds(), h.sortedNames(), h.buckets()})
+	}
+	names := h.sortedNames()
+	w := csv.NewWriter(out)
+	if err := w.Write(append(append([]string{"start"}, names...), "total")); err != nil {
+		return err
+	}
+	for _, bucket := range h.buckets() {
+		row := []string{bucket.Start.UTC().Format(time.RFC3339Nano)}
+		for _, name := range names {
+			row = append(row, strconv.FormatInt(bucket.Counts[name], 10))
+		}
+		if err := w.Write(append(row, strconv.FormatInt(bucket.Total, 10))); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// HeatmapRecorder implements the StatRecorder interface, counting the ops of
+// a run by their type and namespace in buckets of the time they were played,
+// or seen when monitoring, and writing them to a file once closed.
+type HeatmapRecorder struct {
+	heatmap *heatmap
+	path    string
+}
+
+// NewHeatmapRecorder returns a HeatmapRecorder writing to path, as json if
+// it ends in .json and as csv otherwise.
+func NewHeatmapRecorder(path string, bucket time.Duration) (*HeatmapRecorder, error) {
+	// the file is created now, so that an invalid path fails the run
+	// before it starts
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	return &HeatmapRecorder{heatmap: newHeatmap(bucket), path: path}, nil
+}
+
+// RecordStat counts the op of the stat.
+func (recorder *HeatmapRecorder) RecordStat(stat *OpStat) {
+	if stat == nil {
+		return
+	}
+	at := stat.PlayedAt
+	if at == nil {
+		at = stat.Seen
+	}
+	if at == nil {
+		return
+	}
+	recorder.heatmap.add(*at, heatmapName(stat.OpType, stat.Command, stat.Ns))
+}
+
+// Close writes the heatmap.
+func (recorder *HeatmapRecorder) Close() error {
+	file, err := os.Create(recorder.path)
+	if err != nil {
+		return err
+	}
+	format := heatmapFormatCSV
+	if strings.HasSuffix(strings.ToLower(recorder.path), ".json") {
+		format = heatmapFormatJSON
+	}
+	out := bufio.NewWriter(file)
+	err = recorder.heatmap.write(out, format)
+	if flushErr := out.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ValidateParams validates the settings described in the HeatmapCommand
+// struct.
+func (heat *HeatmapCommand) ValidateParams(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unknown argument: %s", args[0])
+	}
+	bucket, err := parseHeatmapBucket("bucket", heat.Bucket)
+	if err != nil {
+		return err
+	}
+	heat.bucket = bucket
+	return nil
+}
+
+// Execute runs the program for the 'heatmap' subcommand
+func (heat *HeatmapCommand) Execute(args []string) error {
+	if err := heat.ValidateParams(args); err != nil {
+		return err
+	}
+	heat.GlobalOpts.SetLogging()
+
+	reader, err := NewPlaybackFileReader(heat.PlaybackFile, heat.Gzip)
+	if err != nil {
+		return err
+	}
+	h, err := heatmapOfTape(reader, heat.bucket)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	return h.write(out, heat.Format)
+}
+
+// heatmapOfTape counts the ops of a playback file in buckets of the time
+// they were seen. Replies are not counted.
+func heatmapOfTape(reader *PlaybackFileReader, bucket time.Duration) (*heatmap, error) {
+	h := newHeatmap(bucket)
+	opChan, errChan := reader.OpChan(1)
+	var parseErr error
+	for op := range opChan {
+		if parseErr != nil || op.EOF || op.Seen == nil {
+			continue
+		}
+		parsedOp, err := op.RawOp.Parse()
+		if err != nil {
+			parseErr = fmt.Errorf("error parsing op %v: %v", op.Order, err)
+			continue
+		}
+		if parsedOp == nil {
+			continue
+		}
+		if _, ok := parsedOp.(Replyable); ok {
+			continue
+		}
+		meta := parsedOp.Meta()
+		ns := namespaceOf(parsedOp)
+		if ns == "" {
+			ns = meta.Ns
+		}
+		h.add(op.Seen.Time, heatmapName(meta.Op, meta.Command, ns))
+	}
+	if err := <-errChan; err != nil && err != io.EOF {
+		return nil, err
+	}
+	return h, parseErr
+}
@@ -0,0 +1,128 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeatmap(t *testing.T) {
+	start := time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC)
+	h := newHeatmap(time.Minute)
+	h.add(start.Add(10*time.Second), "find app.users")
+	h.add(start.Add(50*time.Second), "find app.users")
+	h.add(start.Add(20*time.Second), "insert app.orders")
+	// nothing is played in the second minute
+	h.add(start.Add(2*time.Minute+time.Second), "find app.users")
+
+	out := &bytes.Buffer{}
+	if err := h.write(out, heatmapFormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	expected := "start,find app.users,insert app.orders,total\n" +
+		"2020-05-20T12:00:00Z,2,1,3\n" +
+		"2020-05-20T12:01:00Z,0,0,0\n" +
+		"2020-05-20T12:02:00Z,1,0,1\n"
+	if out.String() != expected {
+		t.Errorf("expected csv:\n%v\ngot:\n%v", expected, out)
+	}
+
+	out.Reset()
+	if err := h.write(out, heatmapFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		BucketSeconds float64         `json:"bucketSeconds"`
+		Names         []string        `json:"names"`
+		Buckets       []heatmapBucket `json:"buckets"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.BucketSeconds != 60 || len(decoded.Names) != 2 || len(decoded.Buckets) != 3 ||
+		decoded.Buckets[0].Counts["insert app.orders"] != 1 || decoded.Buckets[2].Total != 1 {
+		t.Errorf("unexpected json heatmap: %v", out)
+	}
+}
+
+func TestHeatmapRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-heatmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "heatmap.csv")
+	recorder, err := NewHeatmapRecorder(path, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	played := time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC)
+	seen := played.Add(-time.Hour)
+	recorder.RecordStat(&OpStat{OpType: "op_msg", Command: "find", Ns: "app.users", PlayedAt: &played, Seen: &seen})
+	// monitored ops are counted when they were seen
+	recorder.RecordStat(&OpStat{OpType: "query", Ns: "app.users", Seen: &seen})
+	recorder.RecordStat(nil)
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	written, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(written)), "\n")
+	if len(lines) != 362 || lines[0] != "start,find app.users,query app.users,total" ||
+		lines[1] != "2020-05-20T11:00:00Z,0,1,1" || lines[361] != "2020-05-20T12:00:00Z,1,0,1" {
+		t.Errorf("unexpected heatmap of %v lines, starting with %v", len(lines), lines[:2])
+	}
+
+	if _, err := NewHeatmapRecorder(filepath.Join(dir, "missing", "heatmap.csv"), time.Minute); err == nil {
+		t.Errorf("expected an error creating a heatmap in a missing directory")
+	}
+}
+
+func TestHeatmapOfTape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-heatmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	reader, err := NewPlaybackFileReader(writeDumpTape(t, dir), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := heatmapOfTape(reader, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inserts, finds, total int64
+	for _, bucket := range h.buckets() {
+		inserts += bucket.Counts["insert mongoreplay.test"]
+		finds += bucket.Counts["find mongoreplay.test"]
+		total += bucket.Total
+	}
+	if inserts != 4 || finds != 2 || total != 6 {
+		t.Errorf("expected 4 inserts and 2 finds without replies, got %v, %v and %v ops", inserts, finds, total)
+	}
+}
+
+func TestParseHeatmapBucket(t *testing.T) {
+	if bucket, err := parseHeatmapBucket("bucket", "10s"); err != nil || bucket != 10*time.Second {
+		t.Errorf("expected 10s, got %v, %v", bucket, err)
+	}
+	for _, value := range []string{"0s", "-1m", "10"} {
+		if _, err := parseHeatmapBucket("bucket", value); err == nil || !strings.Contains(err.Error(), "--bucket") {
+			t.Errorf("expected %v to be rejected, got %v", value, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// readOptionsDocs returns the document holding the command of a read op and
+// the document holding its $readPreference, which differ for OP_COMMAND
+// where the read preference is sent in the metadata. ok is false if the op is
+// not a read.
+func readOptionsDocs(op Op) (command, readPrefHolder bson.D, ok bool, err error) {
+	switch castOp := op.(type) {
+	case *QueryOp:
+		if strings.HasSuffix(castOp.Collection, "$cmd") {
+			if _, commandName := extractOpType(castOp.Query); !readCommands[commandName] {
+				return nil, nil, false, nil
+			}
+		}
+		command, err = bsonToD(castOp.Query)
+		return command, command, err == nil, err
+	case *CommandOp:
+		if !readCommands[castOp.CommandName] {
+			return nil, nil, false, nil
+		}
+		if command, err = bsonToD(castOp.CommandArgs); err != nil {
+			return nil, nil, false, err
+		}
+		readPrefHolder, err = bsonToD(castOp.Metadata)
+		return command, readPrefHolder, err == nil, err
+	case *MsgOp:
+		if !readCommands[castOp.CommandName] {
+			return nil, nil, false, nil
+		}
+		payload, _, err := fetchPayload0Data(castOp.Sections)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		command, err = bsonToD(payload)
+		return command, command, err == nil, err
+	}
+	return nil, nil, false, nil
+}
+
+// readPreferenceDocOf returns the $readPreference document found in doc.
+func readPreferenceDocOf(doc bson.D) (bson.D, bool) {
+	value, ok := FindValueByKey("$readPreference", &doc)
+	if !ok {
+		return nil, false
+	}
+	readPref, err := bsonToD(value)
+	if err != nil {
+		return nil, false
+	}
+	return readPref, true
+}
+
+// setReadMetadata reports in the stat whether the op is a hedged read, as
+// set by the hedge option of its read preference, and whether it is a read
+// mirrored by a primary to a secondary.
+func (stat *OpStat) setReadMetadata(op Op) {
+	command, readPrefHolder, ok, err := readOptionsDocs(op)
+	if !ok || err != nil {
+		return
+	}
+	if mirrored, ok := FindValueByKey("mirrored", &command); ok {
+		stat.Mirrored, _ = mirrored.(bool)
+	}
+	readPref, ok := readPreferenceDocOf(readPrefHolder)
+	if !ok {
+		return
+	}
+	hedgeValue, ok := FindValueByKey("hedge", &readPref)
+	if !ok {
+		return
+	}
+	hedge, err := bsonToD(hedgeValue)
+	if err != nil {
+		return
+	}
+	// a hedge document without 'enabled' enables hedging
+	enabled := true
+	if value, ok := FindValueByKey("enabled", &hedge); ok {
+		enabled, _ = value.(bool)
+	}
+	stat.HedgeEnabled = &enabled
+}
+
+// parseHedgedReads parses the --hedgedReads option, returning nil if the
+// hedge options of the recording are to be played unmodified.
+func parseHedgedReads(setting string) (*bool, error) {
+	var enabled bool
+	switch setting {
+	case "", "recorded":
+		return nil, nil
+	case "enabled":
+		enabled = true
+	case "disabled":
+		enabled = false
+	default:
+		return nil, fmt.Errorf("unknown setting '%v'", setting)
+	}
+	return &enabled, nil
+}
+
+// setHedgedRead enables or disables hedging of a read op. Only reads with a
+// non-primary read preference can be hedged, so other ops are left untouched.
+func setHedgedRead(op Op, enabled bool) error {
+	_, readPrefHolder, ok, err := readOptionsDocs(op)
+	if !ok || err != nil {
+		return err
+	}
+	readPref, ok := readPreferenceDocOf(readPrefHolder)
+	if !ok {
+		return nil
+	}
+	if mode, _ := FindValueByKey("mode", &readPref); mode == nil || mode == "primary" {
+		return nil
+	}
+	readPref = setDocField(readPref, "hedge", bson.D{{Name: "enabled", Value: enabled}})
+
+	switch castOp := op.(type) {
+	case *QueryOp:
+		castOp.Query = setDocField(readPrefHolder, "$readPreference", readPref)
+	case *CommandOp:
+		castOp.Metadata = setDocField(readPrefHolder, "$readPreference", readPref)
+	case *MsgOp:
+		return setMsgOpField(castOp, "$readPreference", readPref)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestHedgedReads(t *testing.T) {
+	msgOpWith := func(t *testing.T, doc bson.D) *MsgOp {
+		raw, err := dToRaw(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, commandName := extractOpType(doc)
+		msgOp := &MsgOp{CommandName: commandName}
+		msgOp.Sections = []mgo.MsgSection{{PayloadType: mgo.MsgPayload0, Data: raw}}
+		return msgOp
+	}
+
+	enabled, disabled := true, false
+	testCases := []struct {
+		name           string
+		doc            bson.D
+		expectedHedge  *bool
+		expectedMirror bool
+		hedgeOnReplay  bool
+		expectedReplay *bool
+	}{
+		{
+			name:           "hedged find",
+			doc:            bson.D{{"find", "test"}, {"$readPreference", bson.D{{"mode", "nearest"}, {"hedge", bson.D{}}}}},
+			expectedHedge:  &enabled,
+			hedgeOnReplay:  false,
+			expectedReplay: &disabled,
+		},
+		{
+			name:           "unhedged secondary read",
+			doc:            bson.D{{"count", "test"}, {"$readPreference", bson.D{{"mode", "secondary"}}}},
+			hedgeOnReplay:  true,
+			expectedReplay: &enabled,
+		},
+		{
+			name:          "primary reads are never hedged",
+			doc:           bson.D{{"find", "test"}, {"$readPreference", bson.D{{"mode", "primary"}}}},
+			hedgeOnReplay: true,
+		},
+		{
+			name:           "mirrored read",
+			doc:            bson.D{{"find", "test"}, {"mirrored", true}},
+			expectedMirror: true,
+			hedgeOnReplay:  true,
+		},
+	}
+	for _, c := range testCases {
+		t.Logf("running case: %s", c.name)
+		op := msgOpWith(t, c.doc)
+		stat := &OpStat{}
+		stat.setReadMetadata(op)
+		if !equalBoolPtr(stat.HedgeEnabled, c.expectedHedge) {
+			t.Errorf("hedge not matched. Saw %v -- Expected %v", stat.HedgeEnabled, c.expectedHedge)
+		}
+		if stat.Mirrored != c.expectedMirror {
+			t.Errorf("mirrored not matched. Saw %v -- Expected %v", stat.Mirrored, c.expectedMirror)
+		}
+
+		if err := setHedgedRead(op, c.hedgeOnReplay); err != nil {
+			t.Fatal(err)
+		}
+		replayed := &OpStat{}
+		replayed.setReadMetadata(op)
+		if !equalBoolPtr(replayed.HedgeEnabled, c.expectedReplay) {
+			t.Errorf("hedge on replay not matched. Saw %v -- Expected %v", replayed.HedgeEnabled, c.expectedReplay)
+		}
+	}
+}
+
+func equalBoolPtr(a, b *bool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
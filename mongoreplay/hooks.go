@@ -0,0 +1,66 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+)
+
+// ErrOpVetoed is returned when an op is not played because a PreOpHook
+// vetoed it.
+var ErrOpVetoed = fmt.Errorf("op vetoed by hook")
+
+// PreOpHook is called before each op is sent, once it has been parsed and
+// its cursors rewritten, and may modify the parsed op to change what is sent.
+// Returning an error vetoes the op, which is then not sent. Hooks are called
+// from the connection goroutines, so they must be safe for concurrent use.
+type PreOpHook interface {
+	BeforeOp(op *RecordedOp, parsedOp Op) error
+}
+
+// PostOpHook is called after each op that was sent, with the reply received
+// or the error encountered. Hooks are called from the connection goroutines,
+// so they must be safe for concurrent use.
+type PostOpHook interface {
+	AfterOp(op *RecordedOp, parsedOp Op, reply Replyable, err error)
+}
+
+// SkippedOpHook may be implemented by a PostOpHook to also be told of the ops
+// which were not sent because their cursors were not found, with the reason
+// they were skipped.
+type SkippedOpHook interface {
+	OpSkipped(op *RecordedOp, parsedOp Op, reason error)
+}
+
+// runPreOpHooks calls every PreOpHook in turn, stopping at the first that
+// vetoes the op.
+func (context *ExecutionContext) runPreOpHooks(op *RecordedOp, parsedOp Op) error {
+	for _, hook := range context.PreOpHooks {
+		if err := hook.BeforeOp(op, parsedOp); err != nil {
+			userInfoLogger.Logvf(Info, "Not playing op vetoed by hook: %v", err)
+			return ErrOpVetoed
+		}
+	}
+	return nil
+}
+
+// runPostOpHooks calls every PostOpHook in turn.
+func (context *ExecutionContext) runPostOpHooks(op *RecordedOp, parsedOp Op, reply Replyable, err error) {
+	for _, hook := range context.PostOpHooks {
+		hook.AfterOp(op, parsedOp, reply, err)
+	}
+}
+
+// runSkippedOpHooks calls every PostOpHook which is also a SkippedOpHook in
+// turn.
+func (context *ExecutionContext) runSkippedOpHooks(op *RecordedOp, parsedOp Op, reason error) {
+	for _, hook := range context.PostOpHooks {
+		if skipped, ok := hook.(SkippedOpHook); ok {
+			skipped.OpSkipped(op, parsedOp, reason)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testOpHook vetoes every second op, tags the others with a comment, and
+// counts the ops it sees after they are played, and those that were tagged.
+type testOpHook struct {
+	sync.Mutex
+	before int
+	after  int
+	tagged int
+}
+
+func (hook *testOpHook) BeforeOp(op *RecordedOp, parsedOp Op) error {
+	hook.Lock()
+	defer hook.Unlock()
+	hook.before++
+	if hook.before%2 == 0 {
+		return fmt.Errorf("even op")
+	}
+	return setMsgOpField(parsedOp.(*MsgOp), "comment", "hooked")
+}
+
+func (hook *testOpHook) AfterOp(op *RecordedOp, parsedOp Op, reply Replyable, err error) {
+	hook.Lock()
+	defer hook.Unlock()
+	hook.after++
+	payload, _, err := fetchPayload0Data(parsedOp.(*MsgOp).Sections)
+	if err != nil {
+		return
+	}
+	doc, err := bsonToD(payload)
+	if err != nil {
+		return
+	}
+	if comment, _ := FindValueByKey("comment", &doc); comment == "hooked" {
+		hook.tagged++
+	}
+}
+
+func TestPlayOpHooks(t *testing.T) {
+	numInserts := 4
+	generator := newRecordedOpGenerator()
+	go func() {
+		defer close(generator.opChan)
+		if err := generator.generateMsgOpInsertHelper("hooks", 0, numInserts); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	statCollector, _ := NewStatCollector(StatOptions{Buffered: true}, "format", true, true)
+	statRec := statCollector.StatRecorder.(*BufferedStatRecorder)
+	context := NewExecutionContext(statCollector, nil, &ExecutionOptions{fullSpeed: true, dryRun: true})
+	hook := &testOpHook{}
+	context.PreOpHooks = []PreOpHook{hook}
+	context.PostOpHooks = []PostOpHook{hook}
+	if err := Play(context, generator.opChan, 1, 1, 10); err != nil {
+		t.Fatalf("error playing traffic: %v", err)
+	}
+
+	if hook.before != numInserts || hook.after != numInserts/2 {
+		t.Errorf("expected hooks to be called %v and %v times, saw %v and %v",
+			numInserts, numInserts/2, hook.before, hook.after)
+	}
+	if hook.tagged != numInserts/2 {
+		t.Errorf("expected the %v played ops to be modified by the hook, saw %v", numInserts/2, hook.tagged)
+	}
+	if ops := context.DryRunOps(); ops != int64(numInserts/2) {
+		t.Errorf("expected %v ops to be played, saw %v", numInserts/2, ops)
+	}
+	var vetoed int
+	for _, stat := range statRec.Buffer {
+		if strings.HasPrefix(stat.Message, "Vetoed by hook") {
+			vetoed++
+		}
+	}
+	if vetoed != numInserts/2 {
+		t.Errorf("expected %v vetoed ops, saw %v", numInserts/2, vetoed)
+	}
+}
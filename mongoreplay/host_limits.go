@@ -0,0 +1,148 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hostLimits caps the live connections a playback opens to a host and the
+// ops it plays on the host at the same time, as set by --maxConnsPerTarget
+// and --workersPerHost. It is shared by the copies of an amplified playback,
+// and counts how often and how long the caps held the playback back.
+type hostLimits struct {
+	host string
+
+	// conns and workers hold a token per connection open and per op in
+	// flight. They are nil when not capped.
+	conns   chan struct{}
+	workers chan struct{}
+	// handoff passes the token of an idle connection to one waiting for a
+	// token, without returning it to conns first.
+	handoff chan struct{}
+
+	// the counts of the waits and the nanoseconds waited must be accessed
+	// atomically.
+	connWaits  int64
+	connWaited int64
+	opWaits    int64
+	opWaited   int64
+
+	connsReached, workersReached sync.Once
+}
+
+func newHostLimits(host string, maxConns, workers int) *hostLimits {
+	limits := &hostLimits{host: host}
+	if maxConns > 0 {
+		limits.conns = make(chan struct{}, maxConns)
+		limits.handoff = make(chan struct{})
+	}
+	if workers > 0 {
+		limits.workers = make(chan struct{}, workers)
+	}
+	return limits
+}
+
+// capsConns returns whether the connections are capped.
+func (limits *hostLimits) capsConns() bool {
+	return limits != nil && limits.conns != nil
+}
+
+// acquireConn waits until a connection can be opened, either below the cap or
+// in place of an idle connection which hands its token over, or ctx is done.
+func (limits *hostLimits) acquireConn(ctx context.Context) error {
+	if !limits.capsConns() {
+		return nil
+	}
+	select {
+	case limits.conns <- struct{}{}:
+		return nil
+	default:
+	}
+	limits.connsReached.Do(func() {
+		userInfoLogger.Logvf(Always, "Reached the --maxConnsPerTarget of %v connections to %v; "+
+			"further connections wait for one to become idle", cap(limits.conns), limits.host)
+	})
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&limits.connWaits, 1)
+		atomic.AddInt64(&limits.connWaited, int64(time.Since(start)))
+	}()
+	select {
+	case limits.conns <- struct{}{}:
+		return nil
+	case <-limits.handoff:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handoffs returns the channel on which an idle connection hands its token
+// over to a connection waiting for one. Sending on it blocks until one is
+// waiting, and it is nil when the connections are not capped.
+func (limits *hostLimits) handoffs() chan<- struct{} {
+	if !limits.capsConns() {
+		return nil
+	}
+	return limits.handoff
+}
+
+func (limits *hostLimits) releaseConn() {
+	if limits.capsConns() {
+		<-limits.conns
+	}
+}
+
+// acquireWorker waits until an op can be played, or ctx is done.
+func (limits *hostLimits) acquireWorker(ctx context.Context) error {
+	if limits == nil || limits.workers == nil {
+		return nil
+	}
+	select {
+	case limits.workers <- struct{}{}:
+		return nil
+	default:
+	}
+	limits.workersReached.Do(func() {
+		userInfoLogger.Logvf(Always, "Reached the --workersPerHost of %v ops in flight against %v; "+
+			"further ops wait for one to complete", cap(limits.workers), limits.host)
+	})
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&limits.opWaits, 1)
+		atomic.AddInt64(&limits.opWaited, int64(time.Since(start)))
+	}()
+	select {
+	case limits.workers <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (limits *hostLimits) releaseWorker() {
+	if limits == nil || limits.workers == nil {
+		return
+	}
+	<-limits.workers
+}
+
+// logSummary logs how often and how long the caps held the playback back.
+func (limits *hostLimits) logSummary() {
+	if waits := atomic.LoadInt64(&limits.connWaits); waits > 0 {
+		userInfoLogger.Logvf(Always, "Connections waited %v times, for %v in total, for one of the %v connections to %v allowed by --maxConnsPerTarget",
+			waits, time.Duration(atomic.LoadInt64(&limits.connWaited)), cap(limits.conns), limits.host)
+	}
+	if waits := atomic.LoadInt64(&limits.opWaits); waits > 0 {
+		userInfoLogger.Logvf(Always, "%v ops waited %v in total for one of the %v ops in flight against %v allowed by --workersPerHost",
+			waits, time.Duration(atomic.LoadInt64(&limits.opWaited)), cap(limits.workers), limits.host)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestHostLimits(t *testing.T) {
+	ctx := context.Background()
+
+	// without caps, nothing waits
+	var unlimited *hostLimits
+	if unlimited.capsConns() || unlimited.acquireConn(ctx) != nil || unlimited.acquireWorker(ctx) != nil {
+		t.Errorf("expected no caps")
+	}
+	unlimited.releaseConn()
+	unlimited.releaseWorker()
+
+	limits := newHostLimits("localhost:27017", 1, 1)
+	if err := limits.acquireConn(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := limits.acquireWorker(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// once the caps are reached, further connections and ops wait
+	acquired := make(chan error, 2)
+	go func() { acquired <- limits.acquireConn(ctx) }()
+	go func() { acquired <- limits.acquireWorker(ctx) }()
+	select {
+	case <-acquired:
+		t.Fatalf("expected the caps to hold back the connection and the op")
+	case <-time.After(20 * time.Millisecond):
+	}
+	limits.releaseConn()
+	limits.releaseWorker()
+	for i := 0; i < 2; i++ {
+		if err := <-acquired; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if limits.connWaits != 1 || limits.opWaits != 1 || limits.connWaited <= 0 || limits.opWaited <= 0 {
+		t.Errorf("expected a connection and an op to have waited, got %v and %v", limits.connWaits, limits.opWaits)
+	}
+
+	// a wait is interrupted by its context
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := limits.acquireConn(canceled); err != context.Canceled {
+		t.Errorf("expected the wait to be interrupted, got %v", err)
+	}
+}
+
+func TestMaxConnsPerTargetPlayback(t *testing.T) {
+	server := newFakeServer(t)
+	defer server.Close()
+	session := server.session()
+	defer session.Close()
+	defer func(length int) { connectionQueueLength = length }(connectionQueueLength)
+	connectionQueueLength = 2
+
+	// recorded connections 0 and 1 play an insert, go idle while 2 and 3
+	// play more inserts than their queues hold, then play another insert
+	generator := newRecordedOpGenerator()
+	if err := generator.generateMsgOpInsertHelper("capped", 0, 12); err != nil {
+		t.Fatal(err)
+	}
+	close(generator.opChan)
+	opChan := make(chan *RecordedOp, 12)
+	var i int64
+	for op := range generator.opChan {
+		switch {
+		case i < 2:
+			op.SeenConnectionNum = i
+		case i < 10:
+			op.SeenConnectionNum = 2 + i%2
+		default:
+			op.SeenConnectionNum = i - 10
+		}
+		i++
+		opChan <- op
+	}
+	close(opChan)
+
+	statColl, err := NewStatCollector(testCollectorOpts, "format", true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := NewExecutionContext(statColl, session, &ExecutionOptions{})
+	context.limits = newHostLimits(server.addr(), 2, 1)
+	played := make(chan error, 1)
+	go func() { played <- Play(context, opChan, 1, 1, 10) }()
+	select {
+	case err := <-played:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the playback to finish with fewer connections than were recorded")
+	}
+	if inserts := server.commands("insert"); len(inserts) != 12 {
+		t.Errorf("expected 12 inserts played, got %v", len(inserts))
+	}
+}
+
+func TestMaxConnsPerTargetGetLastError(t *testing.T) {
+	server := newFakeServer(t)
+	defer server.Close()
+	session := server.session()
+	defer session.Close()
+
+	// recorded connection 0 plays a legacy insert and, once connection 1 is
+	// waiting for the only socket, its getLastError
+	generator := newRecordedOpGenerator()
+	if err := generator.generateInsert([]interface{}{bson.D{{"_id", 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateMsgOpInsertHelper("capped", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateGetLastError(); err != nil {
+		t.Fatal(err)
+	}
+	close(generator.opChan)
+	insert, waiting, getLastError := <-generator.opChan, <-generator.opChan, <-generator.opChan
+	waiting.SeenConnectionNum = 1
+
+	statColl, err := NewStatCollector(testCollectorOpts, "format", true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := NewExecutionContext(statColl, session, &ExecutionOptions{fullSpeed: true})
+	context.limits = newHostLimits(server.addr(), 1, 0)
+	opChan := make(chan *RecordedOp)
+	played := make(chan error, 1)
+	go func() { played <- Play(context, opChan, 1, 1, 10) }()
+	opChan <- insert
+	opChan <- waiting
+	time.Sleep(100 * time.Millisecond)
+	opChan <- getLastError
+	close(opChan)
+	select {
+	case err := <-played:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the playback to finish")
+	}
+
+	// the getLastError is played on the socket of the insert, before the
+	// socket is handed over to the waiting connection
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	insertConn, getLastErrorConn, waitingConn := -1, -1, -1
+	for _, received := range server.opCodes {
+		switch {
+		case received.opCode == OpCodeInsert:
+			insertConn = received.conn
+		case received.opCode == OpCodeQuery && insertConn == received.conn:
+			getLastErrorConn = received.conn
+		case received.opCode == OpCodeMessage:
+			waitingConn = received.conn
+		}
+	}
+	if insertConn == -1 || getLastErrorConn != insertConn {
+		t.Errorf("expected the getLastError to be played on the connection of the insert %v, got %v", insertConn, getLastErrorConn)
+	}
+	if waitingConn == -1 || waitingConn == insertConn {
+		t.Errorf("expected the waiting connection to play its insert on a socket of its own, got %v", waitingConn)
+	}
+	if server.maxOpen > 2 {
+		t.Errorf("expected at most one connection played on at a time besides that of the session, got %v", server.maxOpen)
+	}
+}
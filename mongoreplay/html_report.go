@@ -0,0 +1,517 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// htmlReportMaxPoints bounds the number of points of the throughput
+	// chart, widening its intervals for long runs.
+	htmlReportMaxPoints = 600
+
+	// htmlReportTopNamespaces is the number of namespaces listed.
+	htmlReportTopNamespaces = 10
+
+	// htmlReportErrorLength truncates error messages so that errors which
+	// differ only in their details are counted together.
+	htmlReportErrorLength = 200
+
+	htmlChartWidth  = 900
+	htmlChartHeight = 200
+
+	htmlSparklineWidth  = 200
+	htmlSparklineHeight = 30
+)
+
+// HTMLReportRecorder implements the StatRecorder interface, writing a
+// self-contained HTML report on the ops when closed, with their throughput
+// over time, latency percentiles, errors and busiest namespaces, along with
+// the metrics of the server sampled by --serverStatus and the recorded
+// connections which fell behind the recorded timeline.
+type HTMLReportRecorder struct {
+	out         io.WriteCloser
+	percentiles *PercentileStatRecorder
+
+	opsPerSecond map[int64]int64
+	ops          int64
+	opsWithError int64
+	errors       map[string]int64
+	errorsByOp   map[string]int64
+	namespaces   map[string]int64
+	generatedAt  func() time.Time
+
+	// serverStatus is recorded concurrently with the stats.
+	serverStatusLock sync.Mutex
+	serverStatus     []*ServerStatusSample
+
+	connections connectionSummaries
+}
+
+// NewHTMLReportRecorder creates an HTMLReportRecorder writing to the file at
+// path.
+func NewHTMLReportRecorder(path string) (*HTMLReportRecorder, error) {
+	out, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return newHTMLReportRecorder(out), nil
+}
+
+func newHTMLReportRecorder(out io.WriteCloser) *HTMLReportRecorder {
+	return &HTMLReportRecorder{
+		out:          out,
+		percentiles:  NewPercentileStatRecorder(),
+		opsPerSecond: map[int64]int64{},
+		errors:       map[string]int64{},
+		errorsByOp:   map[string]int64{},
+		namespaces:   map[string]int64{},
+		generatedAt:  time.Now,
+	}
+}
+
+// RecordStat adds the stat to the report.
+func (hrr *HTMLReportRecorder) RecordStat(stat *OpStat) {
+	if stat == nil {
+		return
+	}
+	hrr.percentiles.RecordStat(stat)
+	hrr.ops++
+	at := stat.PlayedAt
+	if at == nil {
+		at = stat.Seen
+	}
+	if at != nil {
+		hrr.opsPerSecond[at.Unix()]++
+	}
+	if stat.Ns != "" {
+		hrr.namespaces[stat.Ns]++
+	}
+	if len(stat.Errors) > 0 {
+		hrr.opsWithError++
+		name := stat.Command
+		if name == "" {
+			name = stat.OpType
+		}
+		hrr.errorsByOp[name]++
+		for _, err := range stat.Errors {
+			hrr.errors[string(AbbreviateBytes([]byte(err.Error()), htmlReportErrorLength))]++
+		}
+	}
+}
+
+// RecordServerStatus adds the sample to the report.
+func (hrr *HTMLReportRecorder) RecordServerStatus(sample *ServerStatusSample) {
+	hrr.serverStatusLock.Lock()
+	hrr.serverStatus = append(hrr.serverStatus, sample)
+	hrr.serverStatusLock.Unlock()
+}
+
+// RecordConnectionSummaries adds the summaries of the recorded connections
+// to the report.
+func (hrr *HTMLReportRecorder) RecordConnectionSummaries(summaries []*ConnectionSummary) {
+	for _, summary := range summaries {
+		hrr.connections.add(summary)
+	}
+}
+
+// Close writes the report and closes the HTMLReportRecorder.
+func (hrr *HTMLReportRecorder) Close() error {
+	err := htmlReportTemplate.Execute(hrr.out, hrr.reportData())
+	if closeErr := hrr.out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type htmlCount struct {
+	Name  string
+	Count int64
+}
+
+type htmlPercentileRow struct {
+	Name        string
+	Count       int64
+	Percentiles []string
+	Max         string
+}
+
+type htmlServerStatusRow struct {
+	Name            string
+	Min, Mean, Max  string
+	SparklinePoints string
+}
+
+type htmlConnectionRow struct {
+	ConnectionNum    int64
+	Client           string
+	Ops, Errors      int64
+	Recorded, Played time.Duration
+	MeanLag, MaxLag  string
+}
+
+type htmlReport struct {
+	GeneratedAt       time.Time
+	Ops               int64
+	OpsWithError      int64
+	Start, End        time.Time
+	Interval          time.Duration
+	PeakThroughput    float64
+	ChartWidth        int
+	ChartHeight       int
+	ChartPoints       string
+	Percentiles       []string
+	LatencyByOp       []htmlPercentileRow
+	LatencyByNs       []htmlPercentileRow
+	Errors            []htmlCount
+	ErrorsByOp        []htmlCount
+	TopNamespaces     []htmlCount
+	OtherNamespaces   int
+	ServerStatus      []htmlServerStatusRow
+	ServerSamples     int
+	Connections       int
+	ConnectionsBehind int
+	Behind            []htmlConnectionRow
+	OtherBehind       int
+	SparklineWidth    int
+	SparklineHeight   int
+}
+
+// sortedCounts returns the counts ordered from highest to lowest, then by
+// name.
+func sortedCounts(counts map[string]int64) []htmlCount {
+	sorted := make([]htmlCount, 0, len(counts))
+	for name, count := range counts {
+		sorted = append(sorted, htmlCount{name, count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+func formatMillis(micros int64) string {
+	return fmt.Sprintf("%.3f", float64(micros)/1000)
+}
+
+func percentileRows(histograms map[string]*LatencyHistogram) []htmlPercentileRow {
+	var rows []htmlPercentileRow
+	for name, histogram := range histograms {
+		row := htmlPercentileRow{Name: name, Count: histogram.Count(), Max: formatMillis(histogram.Max())}
+		for _, percentile := range summaryPercentiles {
+			row.Percentiles = append(row.Percentiles, formatMillis(histogram.Percentile(percentile)))
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Name < rows[j].Name })
+	return rows
+}
+
+// throughputChart returns the points of an SVG polyline plotting the ops per
+// second over time, along with the interval of each point and the peak
+// throughput.
+func (hrr *HTMLReportRecorder) throughputChart() (points string, start, end time.Time, interval time.Duration, peak float64) {
+	if len(hrr.opsPerSecond) == 0 {
+		return "", start, end, 0, 0
+	}
+	first, last := int64(1<<62), int64(-1<<62)
+	for second := range hrr.opsPerSecond {
+		if second < first {
+			first = second
+		}
+		if second > last {
+			last = second
+		}
+	}
+	width := (last-first)/htmlReportMaxPoints + 1
+	numPoints := (last-first)/width + 1
+	throughput := make([]float64, numPoints)
+	for second, count := range hrr.opsPerSecond {
+		throughput[(second-first)/width] += float64(count) / float64(width)
+	}
+	for _, value := range throughput {
+		if value > peak {
+			peak = value
+		}
+	}
+
+	var coords []string
+	for i, value := range throughput {
+		x := float64(htmlChartWidth) / 2
+		if numPoints > 1 {
+			x = float64(i) * float64(htmlChartWidth) / float64(numPoints-1)
+		}
+		y := float64(htmlChartHeight) * (1 - value/peak)
+		coords = append(coords, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	return strings.Join(coords, " "), time.Unix(first, 0), time.Unix(last+1, 0), time.Duration(width) * time.Second, peak
+}
+
+// sparklinePoints returns the points of an SVG polyline plotting the values
+// evenly spaced between the minimum and the maximum of the values.
+func sparklinePoints(values []float64) string {
+	low, high := values[0], values[0]
+	for _, value := range values {
+		if value < low {
+			low = value
+		}
+		if value > high {
+			high = value
+		}
+	}
+	var coords []string
+	for i, value := range values {
+		x := float64(htmlSparklineWidth) / 2
+		if len(values) > 1 {
+			x = float64(i) * float64(htmlSparklineWidth) / float64(len(values)-1)
+		}
+		y := float64(htmlSparklineHeight) / 2
+		if high > low {
+			y = float64(htmlSparklineHeight) * (1 - (value-low)/(high-low))
+		}
+		coords = append(coords, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	return strings.Join(coords, " ")
+}
+
+func serverStatusRow(name string, values []float64) htmlServerStatusRow {
+	low, high, total := values[0], values[0], 0.0
+	for _, value := range values {
+		if value < low {
+			low = value
+		}
+		if value > high {
+			high = value
+		}
+		total += value
+	}
+	return htmlServerStatusRow{
+		Name:            name,
+		Min:             fmt.Sprintf("%.1f", low),
+		Mean:            fmt.Sprintf("%.1f", total/float64(len(values))),
+		Max:             fmt.Sprintf("%.1f", high),
+		SparklinePoints: sparklinePoints(values),
+	}
+}
+
+// serverStatusRows summarizes the samples of --serverStatus taken without
+// error, with the rates of the cumulative counters computed between
+// consecutive samples. It also returns the number of samples summarized.
+func serverStatusRows(samples []*ServerStatusSample) ([]htmlServerStatusRow, int) {
+	const mb = 1024 * 1024
+	names := []string{"connections", "active readers", "active writers", "queued readers", "queued writers",
+		"cache (MB)", "dirty cache (MB)", "ops/s", "cache read in (MB/s)", "cache written out (MB/s)",
+		"replication lag (s)"}
+	series := map[string][]float64{}
+	var taken int
+	var previous *ServerStatusSample
+	for _, sample := range samples {
+		if sample.Error != "" {
+			continue
+		}
+		taken++
+		series["connections"] = append(series["connections"], float64(sample.Connections))
+		series["active readers"] = append(series["active readers"], float64(sample.ActiveReaders))
+		series["active writers"] = append(series["active writers"], float64(sample.ActiveWriters))
+		series["queued readers"] = append(series["queued readers"], float64(sample.QueuedReaders))
+		series["queued writers"] = append(series["queued writers"], float64(sample.QueuedWriters))
+		series["cache (MB)"] = append(series["cache (MB)"], float64(sample.CacheBytes)/mb)
+		series["dirty cache (MB)"] = append(series["dirty cache (MB)"], float64(sample.CacheDirtyBytes)/mb)
+		if sample.ReplicationLagSeconds != nil {
+			series["replication lag (s)"] = append(series["replication lag (s)"], *sample.ReplicationLagSeconds)
+		}
+		// counters which went backwards were reset by a restart
+		if previous != nil && sample.Time.After(previous.Time) && sample.Ops() >= previous.Ops() {
+			seconds := sample.Time.Sub(previous.Time).Seconds()
+			series["ops/s"] = append(series["ops/s"], float64(sample.Ops()-previous.Ops())/seconds)
+			series["cache read in (MB/s)"] = append(series["cache read in (MB/s)"],
+				float64(sample.CacheReadBytes-previous.CacheReadBytes)/mb/seconds)
+			series["cache written out (MB/s)"] = append(series["cache written out (MB/s)"],
+				float64(sample.CacheWrittenBytes-previous.CacheWrittenBytes)/mb/seconds)
+		}
+		previous = sample
+	}
+	var rows []htmlServerStatusRow
+	for _, name := range names {
+		if values := series[name]; len(values) > 0 {
+			rows = append(rows, serverStatusRow(name, values))
+		}
+	}
+	return rows, taken
+}
+
+// behindRows returns the rows of the connections which fell behind the
+// recorded timeline, furthest behind first, at most connectionSummaryRows of
+// them.
+func behindRows(behind []*ConnectionSummary) []htmlConnectionRow {
+	var rows []htmlConnectionRow
+	for i, summary := range behind {
+		if i == connectionSummaryRows {
+			break
+		}
+		rows = append(rows, htmlConnectionRow{
+			ConnectionNum: summary.ConnectionNum,
+			Client:        summary.Client,
+			Ops:           summary.Ops,
+			Errors:        summary.Errors,
+			Recorded:      (time.Duration(summary.RecordedDurationMicros) * time.Microsecond).Round(time.Millisecond),
+			Played:        (time.Duration(summary.PlayedDurationMicros) * time.Microsecond).Round(time.Millisecond),
+			MeanLag:       formatMillis(summary.MeanLagMicros),
+			MaxLag:        formatMillis(summary.MaxLagMicros),
+		})
+	}
+	return rows
+}
+
+func (hrr *HTMLReportRecorder) reportData() *htmlReport {
+	report := &htmlReport{
+		GeneratedAt:   hrr.generatedAt(),
+		Ops:           hrr.ops,
+		OpsWithError:  hrr.opsWithError,
+		ChartWidth:    htmlChartWidth,
+		ChartHeight:   htmlChartHeight,
+		LatencyByOp:   percentileRows(hrr.percentiles.ByOp),
+		LatencyByNs:   percentileRows(hrr.percentiles.ByNamespace),
+		Errors:        sortedCounts(hrr.errors),
+		ErrorsByOp:    sortedCounts(hrr.errorsByOp),
+		TopNamespaces: sortedCounts(hrr.namespaces),
+
+		SparklineWidth:  htmlSparklineWidth,
+		SparklineHeight: htmlSparklineHeight,
+	}
+	hrr.serverStatusLock.Lock()
+	report.ServerStatus, report.ServerSamples = serverStatusRows(hrr.serverStatus)
+	hrr.serverStatusLock.Unlock()
+	report.Connections = len(hrr.connections.sorted())
+	behind := hrr.connections.behind()
+	report.ConnectionsBehind = len(behind)
+	report.Behind = behindRows(behind)
+	report.OtherBehind = len(behind) - len(report.Behind)
+	report.ChartPoints, report.Start, report.End, report.Interval, report.PeakThroughput = hrr.throughputChart()
+	for _, percentile := range summaryPercentiles {
+		report.Percentiles = append(report.Percentiles, fmt.Sprintf("p%v", percentile))
+	}
+	if len(report.TopNamespaces) > htmlReportTopNamespaces {
+		report.OtherNamespaces = len(report.TopNamespaces) - htmlReportTopNamespaces
+		report.TopNamespaces = report.TopNamespaces[:htmlReportTopNamespaces]
+	}
+	return report
+}
+
+// latencyTable passes the rows of a latency table to its template.
+func latencyTable(key string, percentiles []string, rows []htmlPercentileRow) map[string]interface{} {
+	return map[string]interface{}{"Key": key, "Percentiles": percentiles, "Rows": rows}
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"latencyTable": latencyTable,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mongoreplay report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+th { background: #f0f0f0; }
+svg { border: 1px solid #ccc; background: #fafafa; }
+polyline { fill: none; stroke: #13aa52; stroke-width: 1.5; }
+.muted { color: #777; }
+</style>
+</head>
+<body>
+<h1>mongoreplay report</h1>
+<p class="muted">Generated {{.GeneratedAt.Format "2006-01-02 15:04:05 MST"}}</p>
+<p>{{.Ops}} ops, {{.OpsWithError}} of which received errors.</p>
+
+<h2>Throughput</h2>
+{{if .ChartPoints}}
+<p class="muted">{{.Start.Format "15:04:05"}} to {{.End.Format "15:04:05"}}, averaged over {{.Interval}}; peak {{printf "%.1f" .PeakThroughput}} ops/s</p>
+<svg width="{{.ChartWidth}}" height="{{.ChartHeight}}" viewBox="0 0 {{.ChartWidth}} {{.ChartHeight}}">
+<polyline points="{{.ChartPoints}}"/>
+</svg>
+{{else}}
+<p class="muted">No timed ops were recorded.</p>
+{{end}}
+
+<h2>Latency (ms)</h2>
+{{define "latency"}}
+<table>
+<tr><th>{{.Key}}</th><th>count</th>{{range .Percentiles}}<th>{{.}}</th>{{end}}<th>max</th></tr>
+{{range .Rows}}<tr><td>{{.Name}}</td><td>{{.Count}}</td>{{range .Percentiles}}<td>{{.}}</td>{{end}}<td>{{.Max}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .LatencyByOp}}
+<h3>By op</h3>
+{{template "latency" (latencyTable "op" .Percentiles .LatencyByOp)}}
+<h3>By namespace</h3>
+{{template "latency" (latencyTable "namespace" .Percentiles .LatencyByNs)}}
+{{else}}
+<p class="muted">No latencies were recorded.</p>
+{{end}}
+
+<h2>Errors</h2>
+{{if .Errors}}
+<table>
+<tr><th>op</th><th>ops with errors</th></tr>
+{{range .ErrorsByOp}}<tr><td>{{.Name}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+<table>
+<tr><th>error</th><th>count</th></tr>
+{{range .Errors}}<tr><td>{{.Name}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+{{else}}
+<p class="muted">No errors were received.</p>
+{{end}}
+
+<h2>Top namespaces</h2>
+{{if .TopNamespaces}}
+<table>
+<tr><th>namespace</th><th>ops</th></tr>
+{{range .TopNamespaces}}<tr><td>{{.Name}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+{{if .OtherNamespaces}}<p class="muted">and {{.OtherNamespaces}} more namespaces</p>{{end}}
+{{else}}
+<p class="muted">No namespaces were recorded.</p>
+{{end}}
+{{if .Connections}}
+
+<h2>Connections</h2>
+<p>{{.Connections}} recorded connections played, {{.ConnectionsBehind}} of which fell behind the recorded timeline.</p>
+{{if .Behind}}
+<table>
+<tr><th>conn</th><th>client</th><th>ops</th><th>errors</th><th>recorded</th><th>played</th><th>mean lag (ms)</th><th>max lag (ms)</th></tr>
+{{range .Behind}}<tr><td>{{.ConnectionNum}}</td><td>{{.Client}}</td><td>{{.Ops}}</td><td>{{.Errors}}</td><td>{{.Recorded}}</td><td>{{.Played}}</td><td>{{.MeanLag}}</td><td>{{.MaxLag}}</td></tr>
+{{end}}</table>
+{{if .OtherBehind}}<p class="muted">and {{.OtherBehind}} more connections which fell behind</p>{{end}}
+{{end}}
+{{end}}
+{{if .ServerStatus}}
+
+<h2>Server status</h2>
+<p class="muted">{{.ServerSamples}} samples of serverStatus</p>
+<table>
+<tr><th>metric</th><th>min</th><th>mean</th><th>max</th><th>over time</th></tr>
+{{range .ServerStatus}}<tr><td>{{.Name}}</td><td>{{.Min}}</td><td>{{.Mean}}</td><td>{{.Max}}</td><td><svg width="{{$.SparklineWidth}}" height="{{$.SparklineHeight}}" viewBox="0 0 {{$.SparklineWidth}} {{$.SparklineHeight}}"><polyline points="{{.SparklinePoints}}"/></svg></td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,69 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTMLReportRecorder(t *testing.T) {
+	out := &bytes.Buffer{}
+	rec := newHTMLReportRecorder(NopWriteCloser(out))
+	start := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	rec.generatedAt = func() time.Time { return start }
+	for i := 0; i < 10; i++ {
+		playedAt := start.Add(time.Duration(i) * 100 * time.Millisecond)
+		rec.RecordStat(&OpStat{OpType: "op_msg", Command: "find", Ns: "test.busy", PlayedAt: &playedAt, LatencyMicros: 1500})
+	}
+	playedAt := start.Add(3 * time.Second)
+	rec.RecordStat(&OpStat{OpType: "op_msg", Command: "insert", Ns: "test.<script>", PlayedAt: &playedAt,
+		LatencyMicros: 500, Errors: []error{fmt.Errorf("E11000 duplicate key error")}})
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report := out.String()
+	expected := []string{
+		"11 ops, 1 of which received errors",
+		"peak 10.0 ops/s",
+		"<td>find</td><td>10</td>",
+		"<td>test.busy</td><td>10</td>",
+		"<td>E11000 duplicate key error</td><td>1</td>",
+		"test.&lt;script&gt;",
+		"<polyline points=",
+	}
+	for _, s := range expected {
+		if !strings.Contains(report, s) {
+			t.Errorf("expected %q in the report", s)
+		}
+	}
+	if strings.Contains(report, "test.<script>") {
+		t.Errorf("expected namespaces to be escaped")
+	}
+}
+
+func TestHTMLReportThroughputChart(t *testing.T) {
+	rec := newHTMLReportRecorder(NopWriteCloser(&bytes.Buffer{}))
+	// an hour of ops is averaged over intervals of several seconds
+	for second := int64(0); second < 3600; second++ {
+		rec.opsPerSecond[1000+second] = 5
+	}
+	points, start, end, interval, peak := rec.throughputChart()
+	if numPoints := len(strings.Fields(points)); numPoints > htmlReportMaxPoints {
+		t.Errorf("expected at most %v points, saw %v", htmlReportMaxPoints, numPoints)
+	}
+	if interval != 6*time.Second || end.Sub(start) != time.Hour {
+		t.Errorf("unexpected interval %v from %v to %v", interval, start, end)
+	}
+	if peak != 5 {
+		t.Errorf("expected a peak of 5 ops/s, saw %v", peak)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+	"github.com/mongodb/mongo-tools/common/bsonutil"
+	"github.com/mongodb/mongo-tools/common/json"
+	mgobson "gopkg.in/mgo.v2/bson"
+)
+
+// slowQueryLogID is the id of the 'Slow query' entries of the structured
+// logs of mongod 4.4 and later, which are written for the operations that
+// take longer than slowms or are sampled by the profiler.
+const slowQueryLogID = 51803
+
+// ImportLogCommand stores settings for the mongoreplay 'import log'
+// subcommand
+type ImportLogCommand struct {
+	GlobalOpts *Options `no-flag:"true"`
+	OutputFile string   `short:"o" long:"outputFile" description:"path to the playback file to write to" required:"yes"`
+	Gzip       bool     `long:"gzip" description:"compress the output"`
+
+	EncryptionOptions `group:"encryption options"`
+}
+
+// logEntry is the part of a line of a structured mongod log read by 'import
+// log'.
+type logEntry struct {
+	T struct {
+		Date string `json:"$date"`
+	} `json:"t"`
+	ID   int    `json:"id"`
+	Ctx  string `json:"ctx"`
+	Attr struct {
+		Type           string          `json:"type"`
+		NS             string          `json:"ns"`
+		AppName        string          `json:"appName"`
+		Remote         string          `json:"remote"`
+		Command        json.RawMessage `json:"command"`
+		CursorID       int64           `json:"cursorid"`
+		DurationMillis float64         `json:"durationMillis"`
+		ErrMsg         string          `json:"errMsg"`
+		ErrCode        int             `json:"errCode"`
+	} `json:"attr"`
+}
+
+// ValidateParams validates the settings described in the ImportLogCommand
+// struct.
+func (importLog *ImportLogCommand) ValidateParams(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("must specify the log files to import")
+	}
+	return nil
+}
+
+// Execute runs the program for the 'import log' subcommand
+func (importLog *ImportLogCommand) Execute(args []string) error {
+	err := importLog.ValidateParams(args)
+	if err != nil {
+		return err
+	}
+	importLog.GlobalOpts.SetLogging()
+	if err := importLog.setTapeEncryption(); err != nil {
+		return err
+	}
+
+	importer := newProfileImporter("mongod")
+	for _, file := range args {
+		if err := importLogFile(file, importer); err != nil {
+			return err
+		}
+	}
+
+	writer, err := NewPlaybackFileWriter(importLog.OutputFile, false, importLog.Gzip)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	if err := importer.write(writer); err != nil {
+		return err
+	}
+	userInfoLogger.Logvf(Always, "Imported %v ops on %v connections, skipped %v slow queries",
+		importer.imported, len(importer.connections), importer.skipped)
+	return nil
+}
+
+// importLogFile imports the slow queries of a structured mongod log, which
+// is read gzipped if its name ends in .gz. The lines which aren't slow
+// queries, including those of logs written before 4.4, are ignored.
+func importLogFile(file string, importer *profileImporter) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(file, ".gz") {
+		gzipReader, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		r = gzipReader
+	}
+
+	scanner := bufio.NewScanner(r)
+	// the commands of slow queries can make lines of several megabytes
+	scanner.Buffer(make([]byte, 64*1024), MaxMessageSize)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Bytes()
+		if len(text) == 0 || text[0] != '{' {
+			continue
+		}
+		var entry logEntry
+		if err := json.Unmarshal(text, &entry); err != nil || entry.ID != slowQueryLogID {
+			continue
+		}
+		profile, err := logEntryProfile(&entry)
+		if err != nil {
+			importer.skipped++
+			toolDebugLogger.Logvf(DebugLow, "Skipping slow query on line %v of %v: %v", line, file, err)
+			continue
+		}
+		// the context of the entry names the connection the op was run on
+		importer.add(profile, file+" "+entry.Ctx)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading %v: %v", file, err)
+	}
+	return nil
+}
+
+// logEntryProfile returns the profile document of the op logged by a slow
+// query entry, which it describes with the same fields.
+func logEntryProfile(entry *logEntry) (bson.D, error) {
+	ended, err := time.Parse(time.RFC3339Nano, entry.T.Date)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time: %v", err)
+	}
+	if len(entry.Attr.Command) == 0 {
+		return nil, fmt.Errorf("%v on %v has no command", entry.Attr.Type, entry.Attr.NS)
+	}
+	command, err := extendedJSONToD(entry.Attr.Command)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the command of %v on %v: %v", entry.Attr.Type, entry.Attr.NS, err)
+	}
+	profile := bson.D{
+		{"op", entry.Attr.Type},
+		{"ns", entry.Attr.NS},
+		{"command", command},
+		{"millis", entry.Attr.DurationMillis},
+		{"ts", ended},
+		{"client", entry.Attr.Remote},
+		{"appName", entry.Attr.AppName},
+	}
+	if entry.Attr.CursorID != 0 {
+		profile = append(profile, bson.DocElem{Name: "cursorid", Value: entry.Attr.CursorID})
+	}
+	if entry.Attr.ErrMsg != "" {
+		profile = append(profile, bson.DocElem{Name: "errMsg", Value: entry.Attr.ErrMsg},
+			bson.DocElem{Name: "errCode", Value: entry.Attr.ErrCode})
+	}
+	return profile, nil
+}
+
+// extendedJSONToD converts a document in extended JSON, as mongod logs
+// commands, into a bson.D. The fields are kept in order, as the first one
+// names the command.
+func extendedJSONToD(data []byte) (bson.D, error) {
+	doc, err := json.UnmarshalBsonD(data)
+	if err != nil {
+		return nil, err
+	}
+	extended, err := bsonutil.GetExtendedBsonD(doc)
+	if err != nil {
+		return nil, err
+	}
+	// the document is converted through its serialization, as the other
+	// tools use another bson package
+	asSlice, err := mgobson.Marshal(extended)
+	if err != nil {
+		return nil, err
+	}
+	var out bson.D
+	if err := bson.Unmarshal(asSlice, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,83 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+const testMongodLog = `{"t":{"$date":"2020-05-20T20:10:08.000+00:00"},"s":"I","c":"NETWORK","id":22943,"ctx":"listener","msg":"Connection accepted"}
+{"t":{"$date":"2020-05-20T20:10:08.731+00:00"},"s":"I","c":"COMMAND","id":51803,"ctx":"conn12","msg":"Slow query","attr":{"type":"command","ns":"test.c","appName":"app","command":{"find":"c","filter":{"_id":{"$oid":"5ec58e8c5f1f1b4f1c9f6b4e"},"at":{"$date":"2020-05-20T00:00:00.000Z"}},"batchSize":2,"lsid":{"id":{"$uuid":"d1b0e4b4-7a5b-4a7e-9d1c-2b6f0c1e3a4f"}},"$db":"test"},"planSummary":"IDHACK","cursorid":7766,"durationMillis":120}}
+not a structured log line
+{"t":{"$date":"2020-05-20T20:10:09.000+00:00"},"s":"I","c":"COMMAND","id":51803,"ctx":"conn12","msg":"Slow query","attr":{"type":"command","ns":"test.c","command":{"getMore":7766,"collection":"c","$db":"test"},"cursorid":7766,"durationMillis":3}}
+{"t":{"$date":"2020-05-20T20:10:09.500+00:00"},"s":"I","c":"WRITE","id":51803,"ctx":"conn13","msg":"Slow query","attr":{"type":"update","ns":"test.c","command":{"q":{"x":1},"u":{"$set":{"y":{"$numberLong":"2"}}},"multi":false,"upsert":false},"durationMillis":101}}
+`
+
+func TestImportLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-import-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mongod.log")
+	if err := ioutil.WriteFile(path, []byte(testMongodLog), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	importer := newProfileImporter("mongod")
+	if err := importLogFile(path, importer); err != nil {
+		t.Fatal(err)
+	}
+	if importer.imported != 3 || importer.skipped != 0 || len(importer.connections) != 2 {
+		t.Fatalf("expected 3 slow queries imported on 2 connections, got %v on %v and %v skipped",
+			importer.imported, len(importer.connections), importer.skipped)
+	}
+
+	// the find started 120ms before it was logged
+	started := time.Date(2020, 5, 20, 20, 10, 8, 611*int(time.Millisecond), time.UTC)
+	if seen := importer.ops[0].Seen.Time; !seen.Equal(started) {
+		t.Errorf("expected the find to be seen at %v, got %v", started, seen)
+	}
+	// the update is the last of the ops imported
+	parsedOp, err := importer.ops[4].RawOp.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _, err := fetchPayload0Data(parsedOp.(*MsgOp).Sections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	command, err := bsonToD(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{{"update", "c"}, {"updates", []interface{}{bson.D{{"q", bson.D{{"x", 1}}},
+		{"u", bson.D{{"$set", bson.D{{"y", int64(2)}}}}}, {"multi", false}, {"upsert", false}}}}, {"$db", "test"}}
+	if !reflect.DeepEqual(command, expected) {
+		t.Errorf("expected the update %v, got %v", expected, command)
+	}
+}
+
+func TestExtendedJSONToD(t *testing.T) {
+	doc, err := extendedJSONToD([]byte(`{"find":"c","filter":{"_id":{"$oid":"5ec58e8c5f1f1b4f1c9f6b4e"},` +
+		`"at":{"$date":"2020-05-20T00:00:00.000Z"},"n":{"$numberLong":"5"}},"batchSize":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bson.D{{"find", "c"}, {"filter", bson.D{{"_id", bson.ObjectIdHex("5ec58e8c5f1f1b4f1c9f6b4e")},
+		{"at", time.Date(2020, 5, 20, 0, 0, 0, 0, time.UTC).Local()}, {"n", int64(5)}}}, {"batchSize", 2}}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Errorf("expected %v, got %v", expected, doc)
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// ImportCommand stores settings for the mongoreplay 'import' subcommand,
+// whose own subcommands write playback files from records of the ops run by
+// a server other than its network traffic.
+type ImportCommand struct {
+	Profiler ImportProfilerCommand `command:"profiler" description:"Synthesize a playback file from the documents of a system.profile collection"`
+	Log      ImportLogCommand      `command:"log" description:"Synthesize a playback file from the slow queries of mongod logs"`
+}
+
+// Execute runs the program for the 'import' subcommand. The parser requires
+// one of its subcommands, which is run instead.
+func (importCmd *ImportCommand) Execute(args []string) error {
+	return fmt.Errorf("must specify what to import from")
+}
+
+// ImportProfilerCommand stores settings for the mongoreplay 'import
+// profiler' subcommand
+type ImportProfilerCommand struct {
+	GlobalOpts *Options `no-flag:"true"`
+	DialOptions
+	ConnectionOptions
+	DB         string `long:"db" description:"database whose system.profile collection is read from the host"`
+	File       string `long:"file" description:"path to a dump of a system.profile collection, e.g. the system.profile.bson written by mongodump, to read instead of a host. Gzipped dumps end in .gz"`
+	OutputFile string `short:"o" long:"outputFile" description:"path to the playback file to write to" required:"yes"`
+	Gzip       bool   `long:"gzip" description:"compress the output"`
+
+	EncryptionOptions `group:"encryption options"`
+
+	target *mgo.DialInfo
+}
+
+// profileSessionFields are the fields of the commands of profile documents
+// which tie them to the sessions and transactions of the client which ran
+// them, and are left out of the commands played from the playback file.
+var profileSessionFields = []string{"lsid", "txnNumber", "autocommit", "startTransaction",
+	"$clusterTime", "$client", "$configServerState", "$audit", "$db"}
+
+// ValidateParams validates the settings described in the
+// ImportProfilerCommand struct.
+func (importProfiler *ImportProfilerCommand) ValidateParams(args []string) error {
+	switch {
+	case len(args) > 0:
+		return fmt.Errorf("unknown argument: %s", args[0])
+	case importProfiler.DB != "" && importProfiler.File != "":
+		return fmt.Errorf("must only specify a database or a file")
+	case importProfiler.DB == "" && importProfiler.File == "":
+		return fmt.Errorf("must specify the database to read the system.profile collection of, or a dump of it")
+	case importProfiler.File != "":
+		return nil
+	}
+	target, err := importProfiler.dialInfo(&importProfiler.DialOptions)
+	if err != nil {
+		return err
+	}
+	if err := importProfiler.setDialOptions(&importProfiler.DialOptions); err != nil {
+		return err
+	}
+	promptForPassword(target)
+	importProfiler.target = target
+	return nil
+}
+
+// Execute runs the program for the 'import profiler' subcommand
+func (importProfiler *ImportProfilerCommand) Execute(args []string) error {
+	err := importProfiler.ValidateParams(args)
+	if err != nil {
+		return err
+	}
+	importProfiler.GlobalOpts.SetLogging()
+	if err := importProfiler.setTapeEncryption(); err != nil {
+		return err
+	}
+
+	var importer *profileImporter
+	if importProfiler.File != "" {
+		importer = newProfileImporter(importProfiler.File)
+		err = importProfiler.readFile(importer)
+	} else {
+		if err := importProfiler.DialOptions.resolveServers(importProfiler.target); err != nil {
+			return err
+		}
+		importer = newProfileImporter(strings.Join(importProfiler.target.Addrs, ","))
+		err = importProfiler.readCollection(importer)
+	}
+	if err != nil {
+		return err
+	}
+
+	writer, err := NewPlaybackFileWriter(importProfiler.OutputFile, false, importProfiler.Gzip)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	if err := importer.write(writer); err != nil {
+		return err
+	}
+	userInfoLogger.Logvf(Always, "Imported %v ops on %v connections, skipped %v profile documents",
+		importer.imported, len(importer.connections), importer.skipped)
+	return nil
+}
+
+// readCollection reads the profile documents of the system.profile
+// collection of --db, in the order they were written.
+func (importProfiler *ImportProfilerCommand) readCollection(importer *profileImporter) error {
+	session, err := dialSession(importProfiler.target, importProfiler.DialOptions.newDialer(nil))
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	iter := session.DB(importProfiler.DB).C("system.profile").Find(nil).Sort("$natural").Iter()
+	for {
+		var entry bson.D
+		if !iter.Next(&entry) {
+			break
+		}
+		importer.add(entry, profileConnectionKey(entry))
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("error reading %v.system.profile: %v", importProfiler.DB, err)
+	}
+	return nil
+}
+
+// readFile reads the profile documents of a dump of a system.profile
+// collection.
+func (importProfiler *ImportProfilerCommand) readFile(importer *profileImporter) error {
+	file, err := os.Open(importProfiler.File)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(importProfiler.File, ".gz") {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		r = gzipReader
+	}
+	for {
+		doc, err := ReadDocument(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %v: %v", importProfiler.File, err)
+		}
+		var entry bson.D
+		if err := bson.Unmarshal(doc, &entry); err != nil {
+			return fmt.Errorf("error reading %v: %v", importProfiler.File, err)
+		}
+		importer.add(entry, profileConnectionKey(entry))
+	}
+}
+
+// profileImporter synthesizes the ops of a playback file from profile
+// documents. Each document is imported as the command it profiles, seen when
+// the command started, and a reply to it seen when it ended, which holds the
+// id of the cursor it opened so that the getMores on the cursor can be
+// played. The ops of the documents with the same connection key are imported
+// on the same connection.
+type profileImporter struct {
+	// server is the endpoint of the server the ops were sent to.
+	server      string
+	connections map[string]int64
+	// last is the time the last op of each connection was seen, when the
+	// connection is closed.
+	last      map[int64]time.Time
+	requestID int32
+	ops       []*RecordedOp
+	imported  int
+	skipped   int
+}
+
+func newProfileImporter(server string) *profileImporter {
+	return &profileImporter{
+		server:      server,
+		connections: map[string]int64{},
+		last:        map[int64]time.Time{},
+	}
+}
+
+// add imports the command of a profile document and its reply on the
+// connection of connectionKey, or skips the document if the command can't be
+// played.
+func (importer *profileImporter) add(entry bson.D, connectionKey string) {
+	command, err := profileCommand(entry)
+	if err == nil {
+		err = importer.addCommand(entry, command, connectionKey)
+	}
+	if err != nil {
+		importer.skipped++
+		toolDebugLogger.Logvf(DebugLow, "Skipping profile document: %v", err)
+	}
+}
+
+func (importer *profileImporter) addCommand(entry bson.D, command bson.D, connectionKey string) error {
+	ended, ok := lookupTime(entry, "ts")
+	if !ok {
+		return fmt.Errorf("no ts")
+	}
+	var duration time.Duration
+	if millis, ok := lookupValue(entry, "millis"); ok {
+		if millis, ok := toFloat(millis); ok {
+			duration = time.Duration(millis * float64(time.Millisecond))
+		}
+	}
+	clientValue, _ := lookupValue(entry, "client")
+	clientEndpoint, _ := clientValue.(string)
+	connection, ok := importer.connections[connectionKey]
+	if !ok {
+		connection = int64(len(importer.connections))
+		importer.connections[connectionKey] = connection
+	}
+
+	importer.requestID++
+	requestID := importer.requestID
+	request, err := newMsgRawOp(requestID, 0, command)
+	if err != nil {
+		return fmt.Errorf("error serializing command: %v", err)
+	}
+	importer.requestID++
+	reply, err := newMsgRawOp(importer.requestID, requestID, profileReply(entry))
+	if err != nil {
+		return fmt.Errorf("error serializing reply: %v", err)
+	}
+	importer.ops = append(importer.ops,
+		&RecordedOp{RawOp: *request, Seen: &PreciseTime{ended.Add(-duration)}, PlayedAt: &PreciseTime{},
+			SrcEndpoint: clientEndpoint, DstEndpoint: importer.server, SeenConnectionNum: connection},
+		&RecordedOp{RawOp: *reply, Seen: &PreciseTime{ended}, PlayedAt: &PreciseTime{},
+			SrcEndpoint: importer.server, DstEndpoint: clientEndpoint, SeenConnectionNum: connection})
+	if ended.After(importer.last[connection]) {
+		importer.last[connection] = ended
+	}
+	importer.imported++
+	return nil
+}
+
+// write writes the imported ops in the order they were seen, followed by the
+// end of each connection.
+func (importer *profileImporter) write(writer *PlaybackFileWriter) error {
+	for connection := int64(0); connection < int64(len(importer.connections)); connection++ {
+		importer.ops = append(importer.ops, &RecordedOp{EOF: true, Seen: &PreciseTime{importer.last[connection]},
+			PlayedAt: &PreciseTime{}, SeenConnectionNum: connection})
+	}
+	// each connection ends after its last reply, which is seen at the same
+	// time but was imported before
+	sort.SliceStable(importer.ops, func(i, j int) bool {
+		return importer.ops[i].Seen.Before(importer.ops[j].Seen.Time)
+	})
+	for _, op := range importer.ops {
+		if err := writer.WriteRecordedOp(op); err != nil {
+			return fmt.Errorf("error writing op: %v", err)
+		}
+	}
+	return nil
+}
+
+// profileConnectionKey returns the connection key of a document of the
+// system.profile collection. As the documents don't tell the connections of
+// a client apart, the ops of each client and application are imported on a
+// connection of their own.
+func profileConnectionKey(entry bson.D) string {
+	client, _ := lookupValue(entry, "client")
+	appName, _ := lookupValue(entry, "appName")
+	return fmt.Sprintf("%v %v", client, appName)
+}
+
+// profileCommand returns the command profiled by a profile document, with
+// the database it was run against and without the fields tying it to the
+// session of its client. Updates and deletes are profiled as their single
+// statement, from which an update or delete command is made.
+func profileCommand(entry bson.D) (bson.D, error) {
+	op, _ := lookupValue(entry, "op")
+	ns, _ := lookupValue(entry, "ns")
+	nsString, _ := ns.(string)
+	db, collection := nsString, ""
+	if i := strings.Index(nsString, "."); i >= 0 {
+		db, collection = nsString[:i], nsString[i+1:]
+	}
+	if db == "" {
+		return nil, fmt.Errorf("%v has no namespace", op)
+	}
+	value, ok := lookupValue(entry, "command")
+	if !ok {
+		return nil, fmt.Errorf("%v on %v has no command", op, ns)
+	}
+	command, err := bsonToD(value)
+	if err != nil {
+		return nil, fmt.Errorf("%v on %v: %v", op, ns, err)
+	}
+	if _, ok := lookupValue(command, "$truncated"); ok {
+		return nil, fmt.Errorf("the command of %v on %v was truncated", op, ns)
+	}
+
+	switch {
+	case op == "update" && len(command) > 0 && command[0].Name == "q":
+		command = bson.D{{"update", collection}, {"updates", []bson.D{command}}}
+	case op == "remove" && len(command) > 0 && command[0].Name == "q":
+		command = bson.D{{"delete", collection}, {"deletes", []bson.D{command}}}
+	case op == "insert":
+		if _, ok := lookupValue(command, "documents"); !ok {
+			return nil, fmt.Errorf("the insert on %v has no documents", ns)
+		}
+	}
+	played := make(bson.D, 0, len(command)+1)
+	for _, elem := range command {
+		if !containsString(profileSessionFields, elem.Name) {
+			played = append(played, elem)
+		}
+	}
+	return append(played, bson.DocElem{Name: "$db", Value: db}), nil
+}
+
+// profileReply returns the reply of the command profiled by a profile
+// document: the error it failed with, or the cursor it opened or continued.
+func profileReply(entry bson.D) bson.D {
+	if errMsg, ok := lookupValue(entry, "errMsg"); ok {
+		code, _ := lookupValue(entry, "errCode")
+		return bson.D{{"ok", 0}, {"errmsg", errMsg}, {"code", code}}
+	}
+	cursorID, ok := lookupValue(entry, "cursorid")
+	if !ok {
+		return bson.D{{"ok", 1}}
+	}
+	ns, _ := lookupValue(entry, "ns")
+	batch := "firstBatch"
+	if op, _ := lookupValue(entry, "op"); op == "getmore" {
+		batch = "nextBatch"
+	}
+	return bson.D{
+		{"cursor", bson.D{{"id", cursorID}, {"ns", ns}, {batch, []interface{}{}}}},
+		{"ok", 1},
+	}
+}
+
+// lookupValue returns the value of the named field of doc.
+func lookupValue(doc bson.D, name string) (interface{}, bool) {
+	return FindValueByKey(name, &doc)
+}
+
+// lookupTime returns the value of the named field of doc if it is a date.
+func lookupTime(doc bson.D, name string) (time.Time, bool) {
+	value, _ := lookupValue(doc, name)
+	t, ok := value.(time.Time)
+	return t, ok
+}
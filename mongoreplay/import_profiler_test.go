@@ -0,0 +1,140 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestProfileCommand(t *testing.T) {
+	type testCase struct {
+		name     string
+		entry    bson.D
+		expected bson.D
+		err      bool
+	}
+	cases := []testCase{
+		{
+			name: "find",
+			entry: bson.D{{"op", "query"}, {"ns", "test.c"},
+				{"command", bson.D{{"find", "c"}, {"filter", bson.D{{"x", 1}}}, {"lsid", bson.D{{"id", 1}}}, {"$db", "test"}}}},
+			expected: bson.D{{"find", "c"}, {"filter", bson.D{{"x", 1}}}, {"$db", "test"}},
+		},
+		{
+			name:     "update statement",
+			entry:    bson.D{{"op", "update"}, {"ns", "test.c"}, {"command", bson.D{{"q", bson.D{}}, {"u", bson.D{{"y", 2}}}}}},
+			expected: bson.D{{"update", "c"}, {"updates", []bson.D{{{"q", bson.D{}}, {"u", bson.D{{"y", 2}}}}}}, {"$db", "test"}},
+		},
+		{
+			name:     "remove statement",
+			entry:    bson.D{{"op", "remove"}, {"ns", "test.c"}, {"command", bson.D{{"q", bson.D{}}, {"limit", 0}}}},
+			expected: bson.D{{"delete", "c"}, {"deletes", []bson.D{{{"q", bson.D{}}, {"limit", 0}}}}, {"$db", "test"}},
+		},
+		{
+			name:  "insert without documents",
+			entry: bson.D{{"op", "insert"}, {"ns", "test.c"}, {"command", bson.D{{"insert", "c"}, {"ordered", true}}}},
+			err:   true,
+		},
+		{
+			name:  "truncated command",
+			entry: bson.D{{"op", "command"}, {"ns", "test.c"}, {"command", bson.D{{"$truncated", "{ aggregate: ..."}}}},
+			err:   true,
+		},
+		{
+			name:  "no command",
+			entry: bson.D{{"op", "query"}, {"ns", "test.c"}, {"query", bson.D{}}},
+			err:   true,
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		command, err := profileCommand(c.entry)
+		if (err != nil) != c.err {
+			t.Errorf("expected error %v, got %v", c.err, err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(command, c.expected) {
+			t.Errorf("expected command %v, got %v", c.expected, command)
+		}
+	}
+}
+
+func TestProfileImporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-import-profiler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the getMore started after the find ended, and the find after the
+	// insert of another client
+	importer := newProfileImporter("localhost:27017")
+	importer.add(bson.D{{"op", "query"}, {"ns", "test.c"}, {"command", bson.D{{"find", "c"}}},
+		{"cursorid", int64(42)}, {"millis", 20}, {"ts", testTime.Add(30 * time.Millisecond)}, {"client", "10.0.0.1"}}, "10.0.0.1")
+	importer.add(bson.D{{"op", "getmore"}, {"ns", "test.c"}, {"command", bson.D{{"getMore", int64(42)}, {"collection", "c"}}},
+		{"cursorid", int64(42)}, {"millis", 5}, {"ts", testTime.Add(50 * time.Millisecond)}, {"client", "10.0.0.1"}}, "10.0.0.1")
+	importer.add(bson.D{{"op", "insert"}, {"ns", "test.c"}, {"command", bson.D{{"insert", "c"}, {"documents", []bson.D{{{"_id", 1}}}}}},
+		{"millis", 1}, {"ts", testTime.Add(2 * time.Millisecond)}, {"client", "10.0.0.2"}}, "10.0.0.2")
+	importer.add(bson.D{{"op", "command"}, {"ns", "test.c"}}, "")
+	if importer.imported != 3 || importer.skipped != 1 {
+		t.Errorf("expected 3 profile documents imported and 1 skipped, got %v and %v", importer.imported, importer.skipped)
+	}
+
+	path := filepath.Join(dir, "profile.playback")
+	writer, err := NewPlaybackFileWriter(path, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := importer.write(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	reader, err := NewPlaybackFileReader(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opChan, errChan := reader.OpChan(1)
+	var read []string
+	var cursorIDs []int64
+	for op := range opChan {
+		if op.EOF {
+			read = append(read, "EOF")
+			continue
+		}
+		parsedOp, err := op.RawOp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		read = append(read, parsedOp.Meta().Command)
+		if reply, ok := parsedOp.(*MsgOpReply); ok {
+			cursorID, err := reply.getCursorID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cursorIDs = append(cursorIDs, cursorID)
+		}
+	}
+	if err := <-errChan; err != io.EOF {
+		t.Fatal(err)
+	}
+	expected := []string{"insert", "reply", "EOF", "find", "reply", "getMore", "reply", "EOF"}
+	if !reflect.DeepEqual(read, expected) {
+		t.Errorf("expected ops %v, got %v", expected, read)
+	}
+	if !reflect.DeepEqual(cursorIDs, []int64{0, 42, 42}) {
+		t.Errorf("expected the replies to hold cursors 0, 42 and 42, got %v", cursorIDs)
+	}
+}
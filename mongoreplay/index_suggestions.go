@@ -0,0 +1,337 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// equalityOperators are the operators of a filter which match a field
+// against exact values, and so let an index seek to the documents matched.
+var equalityOperators = map[string]bool{
+	"$eq": true,
+	"$in": true,
+}
+
+// unindexableOperators are the operators of a filter which need an index
+// other than a plain ascending or descending one.
+var unindexableOperators = map[string]bool{
+	"$near":          true,
+	"$nearSphere":    true,
+	"$geoWithin":     true,
+	"$geoIntersects": true,
+	"$within":        true,
+}
+
+// indexAdvisor implements the PreOpHook interface, counting the queries
+// played by their shapes in order to suggest the indexes which would serve
+// them.
+type indexAdvisor struct {
+	sync.Mutex
+	shapes map[string]*shapeCount
+}
+
+type shapeCount struct {
+	shape *queryShape
+	count int64
+}
+
+func newIndexAdvisor() *indexAdvisor {
+	return &indexAdvisor{shapes: map[string]*shapeCount{}}
+}
+
+func (advisor *indexAdvisor) BeforeOp(op *RecordedOp, parsedOp Op) error {
+	shape, err := queryShapeOfOp(parsedOp)
+	if err != nil {
+		// queries which can't be read are played anyway
+		userInfoLogger.Logvf(DebugLow, "Error reading the shape of a query: %v", err)
+		return nil
+	}
+	if shape == nil {
+		return nil
+	}
+	advisor.Lock()
+	defer advisor.Unlock()
+	key := shape.String()
+	count, ok := advisor.shapes[key]
+	if !ok {
+		count = &shapeCount{shape: shape}
+		advisor.shapes[key] = count
+	}
+	count.count++
+	return nil
+}
+
+// indexSuggestion is an index suggested for the queries of a collection.
+type indexSuggestion struct {
+	ns  string
+	key bson.D
+	// shapes are the query shapes the index serves, and covered the number
+	// of queries of those shapes played.
+	shapes  []string
+	covered int64
+}
+
+// suggestions returns the indexes suggested for the queries counted, from
+// the collection queried most to that queried least, along with the number
+// of queries played against each namespace.
+func (advisor *indexAdvisor) suggestions() ([]*indexSuggestion, map[string]int64) {
+	advisor.Lock()
+	defer advisor.Unlock()
+	totals := map[string]int64{}
+	candidates := map[string]*indexSuggestion{}
+	for _, count := range advisor.shapes {
+		totals[count.shape.Ns] += count.count
+		key := suggestedIndexKey(count.shape)
+		if len(key) == 0 || !strings.Contains(count.shape.Ns, ".") {
+			continue
+		}
+		name := count.shape.Ns + " " + indexName(key)
+		candidate, ok := candidates[name]
+		if !ok {
+			candidate = &indexSuggestion{ns: count.shape.Ns, key: key}
+			candidates[name] = candidate
+		}
+		candidate.shapes = append(candidate.shapes, count.shape.Command+" "+count.shape.Shape)
+		candidate.covered += count.count
+	}
+
+	// a query is served by any index whose key starts with that suggested
+	// for it, so the longest suggestions are kept and absorb the others
+	sorted := make([]*indexSuggestion, 0, len(candidates))
+	for _, candidate := range candidates {
+		sort.Strings(candidate.shapes)
+		sorted = append(sorted, candidate)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i].key) != len(sorted[j].key) {
+			return len(sorted[i].key) > len(sorted[j].key)
+		}
+		if sorted[i].covered != sorted[j].covered {
+			return sorted[i].covered > sorted[j].covered
+		}
+		return indexName(sorted[i].key) < indexName(sorted[j].key)
+	})
+	var suggestions []*indexSuggestion
+	for _, candidate := range sorted {
+		absorbed := false
+		for _, suggestion := range suggestions {
+			if suggestion.ns == candidate.ns && isKeyPrefix(candidate.key, suggestion.key) {
+				suggestion.shapes = append(suggestion.shapes, candidate.shapes...)
+				suggestion.covered += candidate.covered
+				absorbed = true
+				break
+			}
+		}
+		if !absorbed {
+			suggestions = append(suggestions, candidate)
+		}
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		if suggestions[i].ns != suggestions[j].ns {
+			if totals[suggestions[i].ns] != totals[suggestions[j].ns] {
+				return totals[suggestions[i].ns] > totals[suggestions[j].ns]
+			}
+			return suggestions[i].ns < suggestions[j].ns
+		}
+		return suggestions[i].covered > suggestions[j].covered
+	})
+	return suggestions, totals
+}
+
+// suggestedIndexKey returns the key of the index serving the queries of a
+// shape, following the equality, sort, range rule: the fields matched
+// exactly come first, so that the index seeks straight to the documents
+// matched, then the fields sorted by, so that the documents are read in
+// order, then the fields matched against ranges. It returns nil if the
+// queries can't be served by such an index, or are served by that of _id.
+func suggestedIndexKey(shape *queryShape) bson.D {
+	var equality, ranges []string
+	var addFilter func(filter bson.D)
+	addFilter = func(filter bson.D) {
+		for _, elem := range filter {
+			switch {
+			case elem.Name == "$and":
+				clauses, _ := elem.Value.([]interface{})
+				for _, clause := range clauses {
+					if clauseDoc, ok := clause.(bson.D); ok {
+						addFilter(clauseDoc)
+					}
+				}
+			case strings.HasPrefix(elem.Name, "$"):
+				// $or, $expr, $text and $where can't be served by a single
+				// compound index
+			default:
+				switch matchKind(elem.Value) {
+				case "equality":
+					equality = append(equality, elem.Name)
+				case "range":
+					ranges = append(ranges, elem.Name)
+				}
+			}
+		}
+	}
+	addFilter(shape.filter)
+
+	key := bson.D{}
+	seen := map[string]bool{}
+	addField := func(name string, direction int) {
+		if !seen[name] {
+			seen[name] = true
+			key = append(key, bson.DocElem{Name: name, Value: direction})
+		}
+	}
+	for _, name := range equality {
+		addField(name, 1)
+	}
+	for _, elem := range shape.sort {
+		direction, ok := toFloat(elem.Value)
+		if !ok {
+			// sorts by text score or other $meta values aren't served by the
+			// index
+			break
+		}
+		if direction < 0 {
+			addField(elem.Name, -1)
+		} else {
+			addField(elem.Name, 1)
+		}
+	}
+	for _, name := range ranges {
+		addField(name, 1)
+	}
+	if len(key) == 0 || key[0].Name == "_id" {
+		return nil
+	}
+	return key
+}
+
+// matchKind returns whether the shape of the value a field is matched
+// against is an equality or a range, or "" if an ordinary index can't serve
+// the match.
+func matchKind(value interface{}) string {
+	switch v := value.(type) {
+	case typeMarker:
+		if v == "?regex" {
+			return "range"
+		}
+		return "equality"
+	case bson.D:
+		kind := "equality"
+		for _, elem := range v {
+			if unindexableOperators[elem.Name] {
+				return ""
+			}
+			if !equalityOperators[elem.Name] {
+				kind = "range"
+			}
+		}
+		return kind
+	}
+	return "equality"
+}
+
+// isKeyPrefix returns whether the fields and directions of key start those
+// of other.
+func isKeyPrefix(key, other bson.D) bool {
+	if len(key) > len(other) {
+		return false
+	}
+	for i := range key {
+		if key[i].Name != other[i].Name || key[i].Value != other[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+// indexName returns the name the server gives an index by default, such as
+// "a_1_b_-1".
+func indexName(key bson.D) string {
+	parts := make([]string, 0, 2*len(key))
+	for _, elem := range key {
+		parts = append(parts, elem.Name, fmt.Sprintf("%v", elem.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+// writeIndexSuggestions writes the suggested indexes as a script of
+// createIndexes commands for the mongo shell, each commented with the share
+// of the queries replayed that it serves and with the shapes of those
+// queries, to be reviewed before running it.
+func writeIndexSuggestions(out io.Writer, suggestions []*indexSuggestion, totals map[string]int64) error {
+	var total int64
+	for _, count := range totals {
+		total += count
+	}
+	for i, suggestion := range suggestions {
+		if i > 0 {
+			if _, err := fmt.Fprintln(out); err != nil {
+				return err
+			}
+		}
+		db, collection := suggestion.ns, ""
+		if i := strings.Index(suggestion.ns, "."); i >= 0 {
+			db, collection = suggestion.ns[:i], suggestion.ns[i+1:]
+		}
+		fmt.Fprintf(out, "// serves %v of the %v queries replayed against %v (%.1f%%), %.1f%% of all %v queries replayed\n",
+			suggestion.covered, totals[suggestion.ns], suggestion.ns,
+			percentOf(suggestion.covered, totals[suggestion.ns]), percentOf(suggestion.covered, total), total)
+		for _, shape := range suggestion.shapes {
+			fmt.Fprintf(out, "//   %v\n", shape)
+		}
+		keyFields := make([]string, len(suggestion.key))
+		for i, elem := range suggestion.key {
+			keyFields[i] = fmt.Sprintf("%v: %v", strconv.Quote(elem.Name), elem.Value)
+		}
+		_, err := fmt.Fprintf(out, "db.getSiblingDB(%v).runCommand({createIndexes: %v, indexes: [{key: {%v}, name: %v}]});\n",
+			strconv.Quote(db), strconv.Quote(collection), strings.Join(keyFields, ", "), strconv.Quote(indexName(suggestion.key)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func percentOf(count, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(count) / float64(total)
+}
+
+// writeReport writes the indexes suggested for the queries counted to the
+// given path, returning the number of indexes suggested and the share of
+// the queries they serve.
+func (advisor *indexAdvisor) writeReport(path string) (int, float64, error) {
+	suggestions, totals := advisor.suggestions()
+	var covered, total int64
+	for _, suggestion := range suggestions {
+		covered += suggestion.covered
+	}
+	for _, count := range totals {
+		total += count
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = writeIndexSuggestions(file, suggestions, totals)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return len(suggestions), percentOf(covered, total), err
+}
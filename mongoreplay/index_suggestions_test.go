@@ -0,0 +1,134 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestSuggestedIndexKey(t *testing.T) {
+	type testCase struct {
+		name     string
+		command  bson.D
+		expected string
+	}
+	cases := []testCase{
+		{
+			name: "equality, sort and range",
+			command: bson.D{{"find", "c"}, {"filter", bson.D{{"createdAt", bson.D{{"$gt", 1}}}, {"status", "A"}}},
+				{"sort", bson.D{{"score", -1}}}},
+			expected: "status_1_score_-1_createdAt_1",
+		},
+		{
+			name:     "$in is an equality",
+			command:  bson.D{{"find", "c"}, {"filter", bson.D{{"a", bson.D{{"$in", []interface{}{1, 2}}}}}}},
+			expected: "a_1",
+		},
+		{
+			name:     "regex is a range",
+			command:  bson.D{{"find", "c"}, {"filter", bson.D{{"name", bson.RegEx{Pattern: "^a"}}, {"b", 1}}}},
+			expected: "b_1_name_1",
+		},
+		{
+			name: "$and clauses",
+			command: bson.D{{"count", "c"}, {"query", bson.D{{"$and", []interface{}{
+				bson.D{{"a", 1}}, bson.D{{"b", bson.D{{"$lt", 2}}}}}}}}},
+			expected: "a_1_b_1",
+		},
+		{
+			name: "aggregation",
+			command: bson.D{{"aggregate", "c"}, {"pipeline", []interface{}{
+				bson.D{{"$match", bson.D{{"a", 1}}}}, bson.D{{"$sort", bson.D{{"b", 1}}}}}}},
+			expected: "a_1_b_1",
+		},
+		{
+			name:    "_id",
+			command: bson.D{{"find", "c"}, {"filter", bson.D{{"_id", bson.NewObjectId()}}}},
+		},
+		{
+			name:    "$or",
+			command: bson.D{{"find", "c"}, {"filter", bson.D{{"$or", []interface{}{bson.D{{"a", 1}}, bson.D{{"b", 1}}}}}}},
+		},
+		{
+			name:    "geo",
+			command: bson.D{{"find", "c"}, {"filter", bson.D{{"loc", bson.D{{"$near", []interface{}{0, 0}}}}}}},
+		},
+		{
+			name:    "no filter",
+			command: bson.D{{"find", "c"}},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		key := suggestedIndexKey(queryShapeOf("test", c.command))
+		if name := indexName(key); name != c.expected {
+			t.Errorf("expected index %q, got %q", c.expected, name)
+		}
+	}
+}
+
+func TestIndexAdvisor(t *testing.T) {
+	msgOp := func(body bson.D) *MsgOp {
+		raw, err := dToRaw(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &MsgOp{CommandName: body[0].Name, Database: "test",
+			MsgOp: mgo.MsgOp{Sections: []mgo.MsgSection{{PayloadType: mgo.MsgPayload0, Data: raw}}}}
+	}
+	advisor := newIndexAdvisor()
+	ops := []Op{
+		msgOp(bson.D{{"find", "c"}, {"filter", bson.D{{"a", 1}}}}),
+		msgOp(bson.D{{"find", "c"}, {"filter", bson.D{{"a", 2}}}, {"sort", bson.D{{"b", 1}}}}),
+		msgOp(bson.D{{"find", "c"}, {"filter", bson.D{{"a", 3}}}, {"sort", bson.D{{"b", 1}}}}),
+		msgOp(bson.D{{"find", "c"}, {"filter", bson.D{{"_id", 1}}}}),
+		msgOp(bson.D{{"find", "d"}, {"filter", bson.D{{"x", "y"}}}}),
+		msgOp(bson.D{{"insert", "c"}, {"documents", []interface{}{bson.D{{"a", 1}}}}}),
+		&QueryOp{QueryOp: mgo.QueryOp{Collection: "test.d", Query: bson.D{{"x", "z"}}}},
+	}
+	for _, op := range ops {
+		if err := advisor.BeforeOp(&RecordedOp{}, op); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	suggestions, totals := advisor.suggestions()
+	if totals["test.c"] != 4 || totals["test.d"] != 2 {
+		t.Errorf("expected 4 queries of test.c and 2 of test.d, got %v", totals)
+	}
+	if len(suggestions) != 2 {
+		t.Fatalf("expected 2 suggestions, got %v", len(suggestions))
+	}
+	if suggestions[0].ns != "test.c" || indexName(suggestions[0].key) != "a_1_b_1" || suggestions[0].covered != 3 {
+		t.Errorf("expected a_1_b_1 on test.c to serve 3 queries, got %v on %v serving %v",
+			indexName(suggestions[0].key), suggestions[0].ns, suggestions[0].covered)
+	}
+	if suggestions[1].ns != "test.d" || indexName(suggestions[1].key) != "x_1" || suggestions[1].covered != 2 {
+		t.Errorf("expected x_1 on test.d to serve 2 queries, got %v on %v serving %v",
+			indexName(suggestions[1].key), suggestions[1].ns, suggestions[1].covered)
+	}
+
+	out := &bytes.Buffer{}
+	if err := writeIndexSuggestions(out, suggestions, totals); err != nil {
+		t.Fatal(err)
+	}
+	script := out.String()
+	for _, expected := range []string{
+		`db.getSiblingDB("test").runCommand({createIndexes: "c", indexes: [{key: {"a": 1, "b": 1}, name: "a_1_b_1"}]});`,
+		"// serves 3 of the 4 queries replayed against test.c (75.0%), 50.0% of all 6 queries replayed",
+		"//   find {filter: {a: ?number}, sort: {b: 1}}",
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("expected the script to contain %q, got:\n%v", expected, script)
+		}
+	}
+}
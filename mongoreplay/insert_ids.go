@@ -0,0 +1,278 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// rewriteInsertedDocuments replaces each document inserted by an op with the
+// result of rewrite, whether the op is a legacy OP_INSERT or an insert
+// command sent as an OP_QUERY, OP_COMMAND or OP_MSG. Other ops are left
+// untouched.
+func rewriteInsertedDocuments(op Op, rewrite func(bson.D) bson.D) error {
+	switch castOp := op.(type) {
+	case *InsertOp:
+		for i, doc := range castOp.Documents {
+			d, err := bsonToD(doc)
+			if err != nil {
+				return err
+			}
+			castOp.Documents[i] = rewrite(d)
+		}
+	case *QueryOp:
+		if !strings.HasSuffix(castOp.Collection, "$cmd") {
+			return nil
+		}
+		if opType, _ := extractOpType(castOp.Query); opType != "insert" {
+			return nil
+		}
+		query, err := bsonToD(castOp.Query)
+		if err != nil {
+			return err
+		}
+		castOp.Query, err = rewriteDocumentsField(query, rewrite)
+		return err
+	case *CommandOp:
+		if castOp.CommandName != "insert" {
+			return nil
+		}
+		args, err := bsonToD(castOp.CommandArgs)
+		if err != nil {
+			return err
+		}
+		if castOp.CommandArgs, err = rewriteDocumentsField(args, rewrite); err != nil {
+			return err
+		}
+		for i, doc := range castOp.InputDocs {
+			d, err := bsonToD(doc)
+			if err != nil {
+				return err
+			}
+			castOp.InputDocs[i] = rewrite(d)
+		}
+	case *MsgOp:
+		if castOp.CommandName != "insert" {
+			return nil
+		}
+		return rewriteMsgOpDocuments(castOp, rewrite)
+	}
+	return nil
+}
+
+// rewriteDocumentsField rewrites the documents of the 'documents' array of
+// an insert command.
+func rewriteDocumentsField(command bson.D, rewrite func(bson.D) bson.D) (bson.D, error) {
+	value, ok := FindValueByKey("documents", &command)
+	if !ok {
+		return command, nil
+	}
+	docs, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("insert documents are not an array: %T", value)
+	}
+	rewritten := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		d, err := bsonToD(doc)
+		if err != nil {
+			return nil, err
+		}
+		rewritten[i] = rewrite(d)
+	}
+	return setDocField(command, "documents", rewritten), nil
+}
+
+// rewriteMsgOpDocuments rewrites the documents of an OP_MSG insert, which
+// are sent either in the 'documents' array of its body or in a document
+// sequence identified as 'documents'.
+func rewriteMsgOpDocuments(msgOp *MsgOp, rewrite func(bson.D) bson.D) error {
+	for i, section := range msgOp.Sections {
+		switch section.PayloadType {
+		case mgo.MsgPayload0:
+			body, err := bsonToD(section.Data)
+			if err != nil {
+				return err
+			}
+			if _, ok := FindValueByKey("documents", &body); !ok {
+				continue
+			}
+			if body, err = rewriteDocumentsField(body, rewrite); err != nil {
+				return err
+			}
+			if msgOp.Sections[i].Data, err = dToRaw(body); err != nil {
+				return err
+			}
+		case mgo.MsgPayload1:
+			payload, ok := section.Data.(mgo.PayloadType1)
+			if !ok || payload.Identifier != "documents" {
+				continue
+			}
+			payload, err := rewriteDocumentSequence(payload, rewrite)
+			if err != nil {
+				return err
+			}
+			msgOp.Sections[i].Data = payload
+		}
+	}
+	return nil
+}
+
+// rewriteDocumentSequence rewrites the documents of an OP_MSG document
+// sequence. The size of the sequence is sent ahead of its documents, so it
+// is recomputed from the rewritten documents.
+func rewriteDocumentSequence(payload mgo.PayloadType1, rewrite func(bson.D) bson.D) (mgo.PayloadType1, error) {
+	size := 4 + len(payload.Identifier) + 1
+	docs := make([]interface{}, len(payload.Docs))
+	for i, doc := range payload.Docs {
+		d, err := bsonToD(doc)
+		if err != nil {
+			return payload, err
+		}
+		raw, err := dToRaw(rewrite(d))
+		if err != nil {
+			return payload, err
+		}
+		docs[i] = *raw
+		size += len(raw.Data)
+	}
+	payload.Docs = docs
+	payload.Size = int32(size)
+	return payload, nil
+}
+
+// idRegenerator implements the PreOpHook interface, rewriting the _id of
+// every inserted document so that a playback file can be played repeatedly,
+// or several copies of it at once, without its inserts colliding with those
+// already played. Without a prefix, ObjectId _ids are replaced with new
+// ObjectIds and other _ids are left unmodified; with a prefix, every _id is
+// replaced with a string made of the prefix and the recorded _id. Either
+// way, the contexts sharing a regenerator, such as that of --mirrorHost,
+// insert the same _ids.
+type idRegenerator struct {
+	prefix string
+	// seed picks the ObjectIds replacing the recorded ones, which are
+	// derived from it rather than random.
+	seed uint64
+}
+
+// newIDSeed returns a seed of ObjectIds unique to this playback.
+func newIDSeed() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func (regenerator idRegenerator) BeforeOp(op *RecordedOp, parsedOp Op) error {
+	if regenerator.prefix == "" {
+		return rewriteInsertedDocuments(parsedOp, func(doc bson.D) bson.D {
+			return regenerator.regenerateObjectID(doc, op.Generation)
+		})
+	}
+	// each repetition of the playback file inserts the documents anew
+	prefix := regenerator.prefix
+	if op.Generation > 0 {
+		prefix = fmt.Sprintf("%v.%v", prefix, op.Generation)
+	}
+	return rewriteInsertedDocuments(parsedOp, func(doc bson.D) bson.D {
+		return prefixID(doc, prefix)
+	})
+}
+
+// regenerateObjectID replaces an ObjectId _id with one keeping its time,
+// whose other bytes are hashed from the seed, the recorded _id and the
+// generation, so that each repetition of the playback file inserts new ones.
+func (regenerator idRegenerator) regenerateObjectID(doc bson.D, generation int) bson.D {
+	for i := range doc {
+		if doc[i].Name != "_id" {
+			continue
+		}
+		if id, ok := doc[i].Value.(bson.ObjectId); ok && id.Valid() {
+			var seed [16]byte
+			binary.BigEndian.PutUint64(seed[:8], regenerator.seed)
+			binary.BigEndian.PutUint64(seed[8:], uint64(generation))
+			h := fnv.New64a()
+			h.Write(seed[:])
+			h.Write([]byte(id))
+			regenerated := make([]byte, 12)
+			copy(regenerated, id[:4])
+			binary.BigEndian.PutUint64(regenerated[4:], h.Sum64())
+			doc[i].Value = bson.ObjectId(regenerated)
+		}
+		break
+	}
+	return doc
+}
+
+// prefixID replaces the _id of the document with "<prefix>:<_id>", where
+// string _ids are used as they are, ObjectIds as hex and other values as
+// json.
+func prefixID(doc bson.D, prefix string) bson.D {
+	for i := range doc {
+		if doc[i].Name != "_id" {
+			continue
+		}
+		doc[i].Value = prefixValue(doc[i].Value, prefix)
+		break
+	}
+	return doc
+}
+
+// prefixValue returns "<prefix>:<value>", where strings are used as they
+// are, ObjectIds as hex and other values as json.
+func prefixValue(value interface{}, prefix string) string {
+	var id string
+	switch value := value.(type) {
+	case string:
+		id = value
+	case bson.ObjectId:
+		id = value.Hex()
+	default:
+		jsonValue, err := ConvertBSONValueToJSON(value)
+		if err != nil {
+			id = fmt.Sprintf("%v", value)
+			break
+		}
+		asJSON, _ := json.Marshal(jsonValue)
+		id = string(asJSON)
+	}
+	return prefix + ":" + id
+}
+
+// parseRegenerateIDs parses the --regenerateIds option, returning nil if the
+// _ids of inserted documents are played unmodified.
+func parseRegenerateIDs(setting, prefix string) (*idRegenerator, error) {
+	switch setting {
+	case "", "none":
+		if prefix != "" {
+			return nil, fmt.Errorf("--idPrefix requires --regenerateIds=prefix")
+		}
+		return nil, nil
+	case "objectId":
+		if prefix != "" {
+			return nil, fmt.Errorf("--idPrefix requires --regenerateIds=prefix")
+		}
+		return &idRegenerator{seed: newIDSeed()}, nil
+	case "prefix":
+		if prefix == "" {
+			// unique to this playback
+			prefix = bson.NewObjectId().Hex()
+		}
+		return &idRegenerator{prefix: prefix}, nil
+	}
+	return nil, fmt.Errorf("unknown setting '%v'", setting)
+}
@@ -0,0 +1,163 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// insertedIDs returns the _ids of the documents inserted by an op.
+func insertedIDs(t *testing.T, op Op) []interface{} {
+	var ids []interface{}
+	err := rewriteInsertedDocuments(op, func(doc bson.D) bson.D {
+		id, _ := FindValueByKey("_id", &doc)
+		ids = append(ids, id)
+		return doc
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestRegenerateObjectIDs(t *testing.T) {
+	oid := bson.NewObjectId()
+	docs := func() []interface{} {
+		return []interface{}{bson.D{{"_id", oid}, {"a", 1}}, bson.D{{"_id", 2}, {"a", 2}}}
+	}
+	rawDocs := func() []interface{} {
+		var raws []interface{}
+		for _, doc := range docs() {
+			raw, err := dToRaw(doc.(bson.D))
+			if err != nil {
+				t.Fatal(err)
+			}
+			raws = append(raws, *raw)
+		}
+		return raws
+	}
+	body := func(doc bson.D) *bson.Raw {
+		raw, err := dToRaw(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	type testCase struct {
+		name string
+		op   Op
+	}
+	cases := []testCase{
+		{
+			name: "legacy insert",
+			op:   &InsertOp{InsertOp: mgo.InsertOp{Collection: "test.c", Documents: docs()}},
+		},
+		{
+			name: "insert command in a query",
+			op: &QueryOp{QueryOp: mgo.QueryOp{Collection: "test.$cmd",
+				Query: bson.D{{"insert", "c"}, {"documents", docs()}}}},
+		},
+		{
+			name: "OP_MSG insert with documents in its body",
+			op: &MsgOp{CommandName: "insert", MsgOp: mgo.MsgOp{Sections: []mgo.MsgSection{
+				{PayloadType: mgo.MsgPayload0, Data: body(bson.D{{"insert", "c"}, {"documents", docs()}, {"$db", "test"}})},
+			}}},
+		},
+		{
+			name: "OP_MSG insert with a document sequence",
+			op: &MsgOp{CommandName: "insert", MsgOp: mgo.MsgOp{Sections: []mgo.MsgSection{
+				{PayloadType: mgo.MsgPayload0, Data: body(bson.D{{"insert", "c"}, {"$db", "test"}})},
+				{PayloadType: mgo.MsgPayload1, Data: mgo.PayloadType1{Identifier: "documents", Docs: rawDocs()}},
+			}}},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		if err := (idRegenerator{}).BeforeOp(&RecordedOp{}, c.op); err != nil {
+			t.Fatal(err)
+		}
+		ids := insertedIDs(t, c.op)
+		if len(ids) != 2 {
+			t.Fatalf("expected 2 inserted documents, saw %v", len(ids))
+		}
+		if id, ok := ids[0].(bson.ObjectId); !ok || id == oid {
+			t.Errorf("expected a new ObjectId, saw %v", ids[0])
+		}
+		if ids[1] != 2 {
+			t.Errorf("expected an _id which is not an ObjectId to be kept, saw %v", ids[1])
+		}
+	}
+
+	// the size of a document sequence covers its identifier and documents
+	msgOp := cases[3].op.(*MsgOp)
+	payload := msgOp.Sections[1].Data.(mgo.PayloadType1)
+	size := 4 + len("documents") + 1
+	for _, doc := range payload.Docs {
+		size += len(doc.(bson.Raw).Data)
+	}
+	if int(payload.Size) != size {
+		t.Errorf("expected a document sequence of %v bytes, saw %v", size, payload.Size)
+	}
+
+	find := &MsgOp{CommandName: "find", MsgOp: mgo.MsgOp{Sections: []mgo.MsgSection{
+		{PayloadType: mgo.MsgPayload0, Data: body(bson.D{{"find", "c"}, {"filter", bson.D{{"_id", oid}}}})},
+	}}}
+	if ids := insertedIDs(t, find); len(ids) != 0 {
+		t.Errorf("expected no documents to be inserted by a find, saw %v", ids)
+	}
+}
+
+func TestPrefixIDs(t *testing.T) {
+	oid := bson.NewObjectId()
+	type testCase struct {
+		name       string
+		id         interface{}
+		generation int
+		expected   string
+	}
+	cases := []testCase{
+		{name: "string", id: "alice", expected: "run:alice"},
+		{name: "ObjectId", id: oid, expected: "run:" + oid.Hex()},
+		{name: "number", id: 42, expected: "run:42"},
+		{name: "document", id: bson.D{{"a", 1}}, expected: `run:{"a":1}`},
+		{name: "repetition", id: "alice", generation: 2, expected: "run.2:alice"},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		op := &InsertOp{InsertOp: mgo.InsertOp{Collection: "test.c", Documents: []interface{}{bson.D{{"a", 1}, {"_id", c.id}}}}}
+		if err := (idRegenerator{prefix: "run"}).BeforeOp(&RecordedOp{Generation: c.generation}, op); err != nil {
+			t.Fatal(err)
+		}
+		if ids := insertedIDs(t, op); len(ids) != 1 || ids[0] != c.expected {
+			t.Errorf("expected _id %v, saw %v", c.expected, ids)
+		}
+	}
+}
+
+func TestParseRegenerateIDs(t *testing.T) {
+	if regenerator, err := parseRegenerateIDs("none", ""); err != nil || regenerator != nil {
+		t.Errorf("expected no regeneration, saw %v, %v", regenerator, err)
+	}
+	if regenerator, err := parseRegenerateIDs("objectId", ""); err != nil || regenerator == nil || regenerator.prefix != "" {
+		t.Errorf("expected ObjectId regeneration, saw %v, %v", regenerator, err)
+	}
+	if regenerator, err := parseRegenerateIDs("prefix", "run1"); err != nil || regenerator == nil || regenerator.prefix != "run1" {
+		t.Errorf("expected the prefix run1, saw %v, %v", regenerator, err)
+	}
+	first, _ := parseRegenerateIDs("prefix", "")
+	second, _ := parseRegenerateIDs("prefix", "")
+	if first.prefix == "" || first.prefix == second.prefix {
+		t.Errorf("expected a prefix unique to each playback, saw %v and %v", first.prefix, second.prefix)
+	}
+	if _, err := parseRegenerateIDs("objectId", "run1"); err == nil {
+		t.Errorf("expected --idPrefix to require --regenerateIds=prefix")
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// InterfacesCommand stores settings for the mongoreplay 'interfaces'
+// subcommand
+type InterfacesCommand struct {
+	GlobalOpts *Options `no-flag:"true"`
+}
+
+// captureInterface is a network interface which can be captured on.
+type captureInterface struct {
+	// device is the name of the interface for pcap, which on Windows is the
+	// name of its Npcap device, such as \Device\NPF_{GUID}.
+	device string
+	// name is the name of the interface for the operating system, which on
+	// Windows is its friendly name, such as "Ethernet".
+	name        string
+	description string
+	addresses   []net.IP
+}
+
+// systemInterface is a network interface of the operating system, with the
+// addresses assigned to it.
+type systemInterface struct {
+	name      string
+	addresses []net.IP
+}
+
+// captureInterfaces lists the network interfaces which can be captured on.
+func captureInterfaces() ([]captureInterface, error) {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, fmt.Errorf("error listing network interfaces: %v", err)
+	}
+	return matchCaptureInterfaces(devs, systemInterfaces()), nil
+}
+
+// systemInterfaces lists the network interfaces of the operating system,
+// leaving out those whose addresses can't be read.
+func systemInterfaces() []systemInterface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var system []systemInterface
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		s := systemInterface{name: iface.Name}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				s.addresses = append(s.addresses, ipNet.IP)
+			}
+		}
+		system = append(system, s)
+	}
+	return system
+}
+
+// matchCaptureInterfaces names the pcap devices after the interfaces of the
+// operating system which share one of their addresses. Devices matching no
+// interface keep their pcap name.
+func matchCaptureInterfaces(devs []pcap.Interface, system []systemInterface) []captureInterface {
+	interfaces := make([]captureInterface, 0, len(devs))
+	for _, dev := range devs {
+		iface := captureInterface{
+			device:      dev.Name,
+			name:        dev.Name,
+			description: dev.Description,
+		}
+		for _, addr := range dev.Addresses {
+			iface.addresses = append(iface.addresses, addr.IP)
+		}
+	match:
+		for _, s := range system {
+			for _, addr := range s.addresses {
+				if containsIP(iface.addresses, addr) {
+					iface.name = s.name
+					break match
+				}
+			}
+		}
+		interfaces = append(interfaces, iface)
+	}
+	return interfaces
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, candidate := range ips {
+		if candidate.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoopbackName returns whether name is one of the usual names of the
+// loopback interface.
+func isLoopbackName(name string) bool {
+	switch strings.ToLower(name) {
+	case "lo", "lo0", "loopback":
+		return true
+	}
+	return false
+}
+
+// findCaptureInterface finds the interface given to -i among interfaces, by
+// its pcap name, its name for the operating system or its description. The
+// usual names of the loopback interface also find the Npcap loopback
+// adapter, which is the only way to capture loopback traffic on Windows.
+func findCaptureInterface(name string, interfaces []captureInterface) (captureInterface, bool) {
+	for _, iface := range interfaces {
+		if iface.device == name {
+			return iface, true
+		}
+	}
+	for _, iface := range interfaces {
+		if iface.name == name || strings.EqualFold(iface.description, name) {
+			return iface, true
+		}
+	}
+	if isLoopbackName(name) {
+		for _, iface := range interfaces {
+			if strings.HasSuffix(iface.device, "NPF_Loopback") {
+				return iface, true
+			}
+		}
+	}
+	return captureInterface{}, false
+}
+
+// lookupCaptureInterface resolves the interface given to -i. When the
+// interfaces can't be listed or none matches, the name is used as given,
+// leaving pcap to report it if it can't be captured on.
+func lookupCaptureInterface(name string) captureInterface {
+	interfaces, err := captureInterfaces()
+	if err != nil {
+		toolDebugLogger.Logvf(DebugLow, "%v", err)
+		return captureInterface{device: name, name: name}
+	}
+	if iface, ok := findCaptureInterface(name, interfaces); ok {
+		if iface.device != name {
+			userInfoLogger.Logvf(DebugLow, "Capturing on %v for network interface %v", iface.device, name)
+		}
+		return iface
+	}
+	return captureInterface{device: name, name: name}
+}
+
+// Execute runs the program for the 'interfaces' subcommand
+func (interfaces *InterfacesCommand) Execute(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unknown argument: %s", args[0])
+	}
+	interfaces.GlobalOpts.SetLogging()
+
+	list, err := captureInterfaces()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDEVICE\tADDRESSES\tDESCRIPTION")
+	for _, iface := range list {
+		addresses := make([]string, len(iface.addresses))
+		for i, addr := range iface.addresses {
+			addresses[i] = addr.String()
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", iface.name, iface.device, strings.Join(addresses, ","), iface.description)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,98 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/pcap"
+)
+
+func TestFindCaptureInterface(t *testing.T) {
+	devs := []pcap.Interface{
+		{
+			Name:        `\Device\NPF_{6C3D1A2B-0000-4E1F-9A55-1234567890AB}`,
+			Description: "Intel(R) Ethernet Connection",
+			Addresses:   []pcap.InterfaceAddress{{IP: net.ParseIP("fe80::1")}, {IP: net.ParseIP("10.0.0.5")}},
+		},
+		{
+			Name:        `\Device\NPF_Loopback`,
+			Description: "Adapter for loopback traffic capture",
+		},
+		{
+			Name:      "eth1",
+			Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("10.0.1.5")}},
+		},
+	}
+	system := []systemInterface{
+		{name: "Ethernet", addresses: []net.IP{net.ParseIP("10.0.0.5")}},
+		{name: "Loopback Pseudo-Interface 1", addresses: []net.IP{net.ParseIP("127.0.0.1")}},
+		{name: "eth1", addresses: []net.IP{net.ParseIP("10.0.1.5")}},
+	}
+	interfaces := matchCaptureInterfaces(devs, system)
+
+	type testCase struct {
+		name   string
+		given  string
+		device string
+		zone   string
+		found  bool
+	}
+	cases := []testCase{
+		{
+			name:   "friendly name",
+			given:  "Ethernet",
+			device: devs[0].Name,
+			zone:   "Ethernet",
+			found:  true,
+		},
+		{
+			name:   "npcap device name",
+			given:  devs[0].Name,
+			device: devs[0].Name,
+			zone:   "Ethernet",
+			found:  true,
+		},
+		{
+			name:   "description",
+			given:  "intel(r) ethernet connection",
+			device: devs[0].Name,
+			zone:   "Ethernet",
+			found:  true,
+		},
+		{
+			name:   "loopback",
+			given:  "lo",
+			device: devs[1].Name,
+			zone:   devs[1].Name,
+			found:  true,
+		},
+		{
+			name:   "same device and interface names",
+			given:  "eth1",
+			device: "eth1",
+			zone:   "eth1",
+			found:  true,
+		},
+		{
+			name:  "unknown interface",
+			given: "Wi-Fi",
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		iface, found := findCaptureInterface(c.given, interfaces)
+		if found != c.found {
+			t.Errorf("expected the interface to be found: %v, got %v", c.found, found)
+			continue
+		}
+		if iface.device != c.device || iface.name != c.zone {
+			t.Errorf("expected device %v named %v, got device %v named %v", c.device, c.zone, iface.device, iface.name)
+		}
+	}
+}
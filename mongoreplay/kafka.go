@@ -0,0 +1,1189 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// KafkaOptions select the partition of a Kafka topic which record publishes
+// the recorded ops to, and play consumes the ops it plays from. Each op is
+// the value of a record of the partition, serialized as in a playback file,
+// and the capture stats which end a playback file end the recording.
+type KafkaOptions struct {
+	KafkaBrokers               string `long:"kafkaBrokers" value-name:"<host:port>[,<host:port>]" description:"comma-separated Kafka brokers of the cluster of --kafkaTopic"`
+	KafkaTopic                 string `long:"kafkaTopic" description:"Kafka topic the recorded ops are published to by record, and consumed from by play instead of a playback file"`
+	KafkaPartition             int32  `long:"kafkaPartition" description:"partition of --kafkaTopic the ops are published to and consumed from" default:"0"`
+	KafkaOffset                string `long:"kafkaOffset" value-name:"<earliest|latest|offset>" description:"offset of the partition play consumes the ops from: earliest, the first the partition still holds, which may be that of an older recording; latest, that of the next op published; or an offset" default:"earliest"`
+	KafkaGroup                 string `long:"kafkaGroup" description:"consumer group play commits the offsets of the ops it consumes to, and resumes from the offset committed by instead of --kafkaOffset"`
+	KafkaCompression           string `long:"kafkaCompression" description:"codec the ops published by record are compressed with" choice:"none" choice:"gzip" default:"none"`
+	KafkaTLS                   bool   `long:"kafkaTLS" description:"connect to the Kafka brokers using TLS"`
+	KafkaTLSCAFile             string `long:"kafkaTLSCAFile" description:"PEM file of the certificate authorities used to verify the certificates of the Kafka brokers"`
+	KafkaTLSCertificateKeyFile string `long:"kafkaTLSCertificateKeyFile" description:"PEM file holding the client certificate presented to the Kafka brokers and its private key"`
+	KafkaUsername              string `long:"kafkaUsername" description:"user authenticating to the Kafka brokers with SASL/PLAIN"`
+	KafkaPassword              string `long:"kafkaPassword" description:"password of --kafkaUsername"`
+}
+
+// The Kafka APIs used, and the versions they are used at: those of the
+// record batches of Kafka 0.11 and later, and of the SASL authentication of
+// Kafka 1.0 and later.
+const (
+	kafkaAPIProduce          int16 = 0
+	kafkaAPIFetch            int16 = 1
+	kafkaAPIListOffsets      int16 = 2
+	kafkaAPIMetadata         int16 = 3
+	kafkaAPIOffsetCommit     int16 = 8
+	kafkaAPIOffsetFetch      int16 = 9
+	kafkaAPIFindCoordinator  int16 = 10
+	kafkaAPISaslHandshake    int16 = 17
+	kafkaAPISaslAuthenticate int16 = 36
+
+	kafkaProduceVersion          int16 = 3
+	kafkaFetchVersion            int16 = 4
+	kafkaListOffsetsVersion      int16 = 1
+	kafkaMetadataVersion         int16 = 1
+	kafkaOffsetCommitVersion     int16 = 2
+	kafkaOffsetFetchVersion      int16 = 1
+	kafkaFindCoordinatorVersion  int16 = 0
+	kafkaSaslHandshakeVersion    int16 = 1
+	kafkaSaslAuthenticateVersion int16 = 0
+)
+
+// The codecs of record batches, of which only gzip is supported.
+const (
+	kafkaCompressionNone int16 = 0
+	kafkaCompressionGzip int16 = 1
+)
+
+var kafkaCompressionNames = map[int16]string{2: "snappy", 3: "lz4", 4: "zstd"}
+
+const (
+	kafkaClientID       = "mongoreplay"
+	kafkaDialTimeout    = 10 * time.Second
+	kafkaRequestTimeout = 30 * time.Second
+	// the ops are published in batches of at most kafkaBatchOps ops or
+	// kafkaBatchBytes bytes, and at least every kafkaFlushInterval
+	kafkaBatchOps      = 500
+	kafkaBatchBytes    = 512 * 1024
+	kafkaFlushInterval = 200 * time.Millisecond
+	// kafkaFetchWait is how long a fetch waits for ops to be published
+	kafkaFetchWait     = 500 * time.Millisecond
+	kafkaFetchMaxBytes = 4 * 1024 * 1024
+	// kafkaFetchMaxBytesLimit is how large the fetches grow to for the
+	// batches larger than kafkaFetchMaxBytes
+	kafkaFetchMaxBytesLimit = 128 * 1024 * 1024
+	// a request failing as the broker it is sent to is no longer the one to
+	// send it to, or as its connection broke, is sent again up to
+	// kafkaRetries times, to the broker found anew
+	kafkaRetries      = 3
+	kafkaRetryBackoff = 500 * time.Millisecond
+	// kafkaOffsetEarliest and kafkaOffsetLatest ask ListOffsets for the first
+	// offset of a partition, and for the offset of its next record
+	kafkaOffsetEarliest int64 = -2
+	kafkaOffsetLatest   int64 = -1
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaError is an error code returned by a Kafka broker.
+type kafkaError int16
+
+func (code kafkaError) Error() string {
+	switch code {
+	case 1:
+		return "Kafka error: offset out of range"
+	case 3:
+		return "Kafka error: unknown topic or partition"
+	case 5:
+		return "Kafka error: leader not available"
+	case 6:
+		return "Kafka error: not the leader of the partition"
+	case 7:
+		return "Kafka error: request timed out"
+	case 10:
+		return "Kafka error: message too large"
+	case 14:
+		return "Kafka error: coordinator load in progress"
+	case 15:
+		return "Kafka error: coordinator not available"
+	case 16:
+		return "Kafka error: not the coordinator of the group"
+	case 25:
+		return "Kafka error: unknown member of the group"
+	case 33:
+		return "Kafka error: unsupported SASL mechanism"
+	case 58:
+		return "Kafka error: SASL authentication failed"
+	}
+	return fmt.Sprintf("Kafka error code %d", int16(code))
+}
+
+// isKafkaRetriable returns whether a request which failed with err is sent
+// again: when the broker it was sent to is no longer the leader of the
+// partition or the coordinator of the group, or didn't answer.
+func isKafkaRetriable(err error) bool {
+	code, ok := err.(kafkaError)
+	if !ok {
+		return true
+	}
+	switch code {
+	case 5, 6, 7, 14, 15, 16:
+		return true
+	}
+	return false
+}
+
+// validate checks that the options select a partition, if any is selected.
+func (options *KafkaOptions) validate() error {
+	switch {
+	case options.KafkaTopic != "" && options.KafkaBrokers == "":
+		return fmt.Errorf("--kafkaTopic requires --kafkaBrokers")
+	case options.KafkaTopic == "" && options.KafkaBrokers != "":
+		return fmt.Errorf("--kafkaBrokers requires --kafkaTopic")
+	case options.KafkaPartition < 0:
+		return fmt.Errorf("Invalid setting for --kafkaPartition: '%v', value must be >=0", options.KafkaPartition)
+	case (options.KafkaTLSCAFile != "" || options.KafkaTLSCertificateKeyFile != "") && !options.KafkaTLS:
+		return fmt.Errorf("--kafkaTLSCAFile and --kafkaTLSCertificateKeyFile require --kafkaTLS")
+	case options.KafkaPassword != "" && options.KafkaUsername == "":
+		return fmt.Errorf("--kafkaPassword requires --kafkaUsername")
+	}
+	switch options.KafkaOffset {
+	case "", "earliest", "latest":
+	default:
+		if offset, err := strconv.ParseInt(options.KafkaOffset, 10, 64); err != nil || offset < 0 {
+			return fmt.Errorf("Invalid setting for --kafkaOffset: '%v', value must be earliest, latest or an offset >=0", options.KafkaOffset)
+		}
+	}
+	return nil
+}
+
+// validateConsuming checks that the options don't set how the ops are
+// published, for play, which consumes them.
+func (options *KafkaOptions) validateConsuming() error {
+	if options.KafkaCompression != "" && options.KafkaCompression != "none" {
+		return fmt.Errorf("--kafkaCompression only applies to record, which publishes the ops")
+	}
+	return options.validate()
+}
+
+// validatePublishing checks that the options don't set where the ops are
+// consumed from, for record, which publishes them.
+func (options *KafkaOptions) validatePublishing() error {
+	if options.KafkaGroup != "" || (options.KafkaOffset != "" && options.KafkaOffset != "earliest") {
+		return fmt.Errorf("--kafkaGroup and --kafkaOffset only apply to play, which consumes the ops")
+	}
+	return options.validate()
+}
+
+// kafkaEncoder serializes the fields of Kafka requests.
+type kafkaEncoder struct {
+	b []byte
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.b = append(e.b, byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	e.b = append(e.b, byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	e.b = append(e.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	e.int32(int32(v >> 32))
+	e.int32(int32(v))
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// nullString appends the null of a nullable string.
+func (e *kafkaEncoder) nullString() {
+	e.int16(-1)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// varint appends a zig-zag encoded variable length integer, as used by the
+// records of record batches.
+func (e *kafkaEncoder) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.b = append(e.b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+// kafkaDecoder reads the fields of Kafka responses. Once a field can't be
+// read, it keeps the error and reads zero values.
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = fmt.Errorf("truncated Kafka response")
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+func (d *kafkaDecoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+func (d *kafkaDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = fmt.Errorf("invalid varint in Kafka response")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// skipArray skips an array of fixed size elements.
+func (d *kafkaDecoder) skipArray(size int) {
+	if n := d.int32(); n > 0 {
+		d.take(int(n) * size)
+	}
+}
+
+// kafkaConn is a connection to a Kafka broker, which sends one request at a
+// time.
+type kafkaConn struct {
+	conn          net.Conn
+	correlationID int32
+}
+
+// dialKafka connects to the broker at addr, over TLS and authenticated as
+// the user of options if they ask for it.
+func dialKafka(options KafkaOptions, addr string) (*kafkaConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, kafkaDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to Kafka broker %v: %v", addr, err)
+	}
+	if options.KafkaTLS {
+		tlsOptions := &DialOptions{TLSCAFile: options.KafkaTLSCAFile, TLSCertificateKeyFile: options.KafkaTLSCertificateKeyFile}
+		config, err := tlsOptions.tlsConfig(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		client := tls.Client(conn, config)
+		client.SetDeadline(time.Now().Add(kafkaDialTimeout))
+		if err = client.Handshake(); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("error doing TLS handshake with Kafka broker %v: %v", addr, err)
+		}
+		conn = client
+	}
+	c := &kafkaConn{conn: conn}
+	if options.KafkaUsername != "" {
+		if err := c.authenticate(options.KafkaUsername, options.KafkaPassword); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("error authenticating to Kafka broker %v: %v", addr, err)
+		}
+	}
+	return c, nil
+}
+
+// authenticate authenticates the connection as username with SASL/PLAIN.
+func (c *kafkaConn) authenticate(username, password string) error {
+	request := kafkaEncoder{}
+	request.string("PLAIN")
+	d, err := c.roundTrip(kafkaAPISaslHandshake, kafkaSaslHandshakeVersion, request.b)
+	if err != nil {
+		return err
+	}
+	if code := d.int16(); code != 0 {
+		return kafkaError(code)
+	}
+	if d.err != nil {
+		return d.err
+	}
+	request = kafkaEncoder{}
+	request.bytes([]byte("\x00" + username + "\x00" + password))
+	d, err = c.roundTrip(kafkaAPISaslAuthenticate, kafkaSaslAuthenticateVersion, request.b)
+	if err != nil {
+		return err
+	}
+	code, message := d.int16(), d.string()
+	switch {
+	case d.err != nil:
+		return d.err
+	case code != 0 && message != "":
+		return errors.New(message)
+	case code != 0:
+		return kafkaError(code)
+	}
+	return nil
+}
+
+func (c *kafkaConn) Close() error {
+	return c.conn.Close()
+}
+
+// roundTrip sends a request of the given API and version with the given
+// body, returning a decoder of the body of its response.
+func (c *kafkaConn) roundTrip(apiKey, version int16, body []byte) (*kafkaDecoder, error) {
+	c.correlationID++
+	request := kafkaEncoder{b: make([]byte, 4, 4+10+len(kafkaClientID)+len(body))}
+	request.int16(apiKey)
+	request.int16(version)
+	request.int32(c.correlationID)
+	request.string(kafkaClientID)
+	request.b = append(request.b, body...)
+	binary.BigEndian.PutUint32(request.b, uint32(len(request.b)-4))
+
+	c.conn.SetDeadline(time.Now().Add(kafkaRequestTimeout))
+	if _, err := c.conn.Write(request.b); err != nil {
+		return nil, fmt.Errorf("error sending Kafka request: %v", err)
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+		return nil, fmt.Errorf("error reading Kafka response: %v", err)
+	}
+	response := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c.conn, response); err != nil {
+		return nil, fmt.Errorf("error reading Kafka response: %v", err)
+	}
+	d := &kafkaDecoder{b: response}
+	if correlationID := d.int32(); correlationID != c.correlationID {
+		return nil, fmt.Errorf("Kafka response to request %v received for request %v", correlationID, c.correlationID)
+	}
+	return d, nil
+}
+
+// partitionLeader returns the address of the broker leading a partition.
+func (c *kafkaConn) partitionLeader(topic string, partition int32) (string, error) {
+	request := kafkaEncoder{}
+	request.int32(1)
+	request.string(topic)
+	d, err := c.roundTrip(kafkaAPIMetadata, kafkaMetadataVersion, request.b)
+	if err != nil {
+		return "", err
+	}
+	brokers := map[int32]string{}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		nodeID := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		brokers[nodeID] = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+	d.int32() // controller
+	var leader string
+	var leaderErr error = kafkaError(3)
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		code := d.int16()
+		name := d.string()
+		d.int8() // internal
+		for p := d.int32(); p > 0 && d.err == nil; p-- {
+			partitionCode := d.int16()
+			index := d.int32()
+			leaderID := d.int32()
+			d.skipArray(4) // replicas
+			d.skipArray(4) // in-sync replicas
+			if name != topic || index != partition {
+				continue
+			}
+			switch {
+			case code != 0:
+				leaderErr = kafkaError(code)
+			case partitionCode != 0:
+				leaderErr = kafkaError(partitionCode)
+			default:
+				leader, leaderErr = brokers[leaderID], nil
+			}
+		}
+	}
+	if d.err != nil {
+		return "", d.err
+	}
+	if leaderErr != nil {
+		return "", fmt.Errorf("partition %v of %v: %v", partition, topic, leaderErr)
+	}
+	return leader, nil
+}
+
+// groupCoordinator returns the address of the broker coordinating a
+// consumer group.
+func (c *kafkaConn) groupCoordinator(group string) (string, error) {
+	request := kafkaEncoder{}
+	request.string(group)
+	d, err := c.roundTrip(kafkaAPIFindCoordinator, kafkaFindCoordinatorVersion, request.b)
+	if err != nil {
+		return "", err
+	}
+	code := d.int16()
+	d.int32() // node id
+	host := d.string()
+	port := d.int32()
+	if d.err != nil {
+		return "", d.err
+	}
+	if code != 0 {
+		return "", fmt.Errorf("group %v: %v", group, kafkaError(code))
+	}
+	return net.JoinHostPort(host, fmt.Sprint(port)), nil
+}
+
+// dialKafkaBroker connects to the broker found by find, which is asked of
+// the first of the brokers of options that answers.
+func dialKafkaBroker(options KafkaOptions, find func(conn *kafkaConn) (string, error)) (*kafkaConn, error) {
+	var lastErr error
+	for _, broker := range strings.Split(options.KafkaBrokers, ",") {
+		conn, err := dialKafka(options, strings.TrimSpace(broker))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addr, err := find(conn)
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return dialKafka(options, addr)
+	}
+	return nil, lastErr
+}
+
+// kafkaBroker is the connection to the broker which the requests about a
+// partition or a group are sent to, the one found by find. When a request
+// fails as that broker changed or its connection broke, the broker is found
+// and connected to again, and the request sent again.
+type kafkaBroker struct {
+	options KafkaOptions
+	find    func(conn *kafkaConn) (string, error)
+	conn    *kafkaConn
+}
+
+// dialKafkaLeader connects to the leader of the partition selected by
+// options.
+func dialKafkaLeader(options KafkaOptions) (*kafkaBroker, error) {
+	return newKafkaBroker(options, func(conn *kafkaConn) (string, error) {
+		return conn.partitionLeader(options.KafkaTopic, options.KafkaPartition)
+	})
+}
+
+// dialKafkaCoordinator connects to the coordinator of the group of options.
+func dialKafkaCoordinator(options KafkaOptions) (*kafkaBroker, error) {
+	return newKafkaBroker(options, func(conn *kafkaConn) (string, error) {
+		return conn.groupCoordinator(options.KafkaGroup)
+	})
+}
+
+func newKafkaBroker(options KafkaOptions, find func(conn *kafkaConn) (string, error)) (*kafkaBroker, error) {
+	conn, err := dialKafkaBroker(options, find)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaBroker{options: options, find: find, conn: conn}, nil
+}
+
+// do sends a request with the connection to the broker, up to kafkaRetries
+// more times while it fails as the broker changed or its connection broke.
+func (broker *kafkaBroker) do(request func(conn *kafkaConn) error) error {
+	var err error
+	for attempt := 0; attempt <= kafkaRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(kafkaRetryBackoff)
+		}
+		if broker.conn == nil {
+			if broker.conn, err = dialKafkaBroker(broker.options, broker.find); err != nil {
+				continue
+			}
+		}
+		if err = request(broker.conn); err == nil || !isKafkaRetriable(err) {
+			return err
+		}
+		broker.conn.Close()
+		broker.conn = nil
+	}
+	return err
+}
+
+// Close closes the connection to the broker.
+func (broker *kafkaBroker) Close() error {
+	if broker.conn == nil {
+		return nil
+	}
+	return broker.conn.Close()
+}
+
+// encodeKafkaRecordBatch serializes values as the records of a record batch,
+// as published at the given time, compressed with the given codec.
+func encodeKafkaRecordBatch(values [][]byte, at time.Time, compression int16) []byte {
+	records := kafkaEncoder{}
+	for i, value := range values {
+		record := kafkaEncoder{}
+		record.int8(0)          // attributes
+		record.varint(0)        // timestamp delta
+		record.varint(int64(i)) // offset delta
+		record.varint(-1)       // no key
+		record.varint(int64(len(value)))
+		record.b = append(record.b, value...)
+		record.varint(0) // no headers
+		records.varint(int64(len(record.b)))
+		records.b = append(records.b, record.b...)
+	}
+
+	if compression == kafkaCompressionGzip {
+		var compressed bytes.Buffer
+		w := gzip.NewWriter(&compressed)
+		w.Write(records.b)
+		w.Close()
+		records.b = compressed.Bytes()
+	}
+
+	// the fields following the crc, which it is computed over
+	timestamp := at.UnixNano() / int64(time.Millisecond)
+	body := kafkaEncoder{}
+	body.int16(compression) // attributes: the codec, no transaction
+	body.int32(int32(len(values) - 1))
+	body.int64(timestamp)
+	body.int64(timestamp)
+	body.int64(-1) // producer id
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(int32(len(values)))
+	body.b = append(body.b, records.b...)
+
+	batch := kafkaEncoder{}
+	batch.int64(0) // base offset, assigned by the broker
+	batch.int32(int32(4 + 1 + 4 + len(body.b)))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(body.b, castagnoliTable)))
+	batch.b = append(batch.b, body.b...)
+	return batch.b
+}
+
+// kafkaRecord is the offset and value of a record of a partition.
+type kafkaRecord struct {
+	offset int64
+	value  []byte
+}
+
+// decodeKafkaRecordBatches returns the records of the record batches of a
+// fetched partition, and the offset following the last batch, or -1 if no
+// batch is whole. A fetch may end with part of a batch, which is left to
+// the next one.
+func decodeKafkaRecordBatches(b []byte) ([]kafkaRecord, int64, error) {
+	var records []kafkaRecord
+	next := int64(-1)
+	for len(b) >= 12 {
+		baseOffset := int64(binary.BigEndian.Uint64(b))
+		length := int(binary.BigEndian.Uint32(b[8:]))
+		if len(b) < 12+length {
+			break
+		}
+		d := &kafkaDecoder{b: b[12 : 12+length]}
+		b = b[12+length:]
+
+		d.int32() // partition leader epoch
+		if magic := d.int8(); magic != 2 {
+			return nil, next, fmt.Errorf("unsupported Kafka record batch version %v", magic)
+		}
+		crc := uint32(d.int32())
+		if d.err == nil && crc32.Checksum(d.b, castagnoliTable) != crc {
+			return nil, next, fmt.Errorf("corrupt Kafka record batch at offset %v", baseOffset)
+		}
+		attributes := d.int16()
+		next = baseOffset + int64(d.int32()) + 1 // last offset delta
+		if attributes&0x20 != 0 {
+			// a control batch, marking the end of a transaction
+			continue
+		}
+		compression := attributes & 0x7
+		if name, ok := kafkaCompressionNames[compression]; ok {
+			return nil, next, fmt.Errorf("Kafka record batch at offset %v is compressed with %v, which is not supported: only gzip is", baseOffset, name)
+		}
+		d.int64() // first timestamp
+		d.int64() // max timestamp
+		d.int64() // producer id
+		d.int16() // producer epoch
+		d.int32() // base sequence
+		n := d.int32()
+		if compression == kafkaCompressionGzip && d.err == nil {
+			r, err := gzip.NewReader(bytes.NewReader(d.b))
+			if err == nil {
+				d.b, err = ioutil.ReadAll(r)
+			}
+			if err != nil {
+				return nil, next, fmt.Errorf("error decompressing Kafka record batch at offset %v: %v", baseOffset, err)
+			}
+		}
+		for ; n > 0 && d.err == nil; n-- {
+			record := &kafkaDecoder{b: d.take(int(d.varint()))}
+			record.int8()   // attributes
+			record.varint() // timestamp delta
+			offsetDelta := record.varint()
+			if keyLength := record.varint(); keyLength > 0 {
+				record.take(int(keyLength))
+			}
+			var value []byte
+			if valueLength := record.varint(); valueLength >= 0 {
+				value = record.take(int(valueLength))
+			}
+			if record.err != nil {
+				return nil, next, fmt.Errorf("corrupt Kafka record in batch at offset %v: %v", baseOffset, record.err)
+			}
+			records = append(records, kafkaRecord{offset: baseOffset + offsetDelta, value: value})
+		}
+		if d.err != nil {
+			return nil, next, fmt.Errorf("corrupt Kafka record batch at offset %v: %v", baseOffset, d.err)
+		}
+	}
+	return records, next, nil
+}
+
+// KafkaOpWriter publishes recorded ops to a partition of a Kafka topic. It
+// is a RecordWriter, so that Record can publish the ops it records.
+type KafkaOpWriter struct {
+	options     KafkaOptions
+	leader      *kafkaBroker
+	compression int16
+
+	lock    sync.Mutex
+	pending [][]byte
+	size    int
+	err     error
+	done    chan struct{}
+	flushed sync.WaitGroup
+}
+
+// NewKafkaOpWriter connects to the leader of the partition of options, to
+// which the ops written are published.
+func NewKafkaOpWriter(options KafkaOptions) (*KafkaOpWriter, error) {
+	leader, err := dialKafkaLeader(options)
+	if err != nil {
+		return nil, err
+	}
+	writer := &KafkaOpWriter{options: options, leader: leader, done: make(chan struct{})}
+	if options.KafkaCompression == "gzip" {
+		writer.compression = kafkaCompressionGzip
+	}
+	writer.flushed.Add(1)
+	go writer.flushPeriodically()
+	return writer, nil
+}
+
+// flushPeriodically publishes the pending ops every kafkaFlushInterval, so
+// that they aren't held while there is little traffic.
+func (writer *KafkaOpWriter) flushPeriodically() {
+	defer writer.flushed.Done()
+	ticker := time.NewTicker(kafkaFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			writer.lock.Lock()
+			writer.flush()
+			writer.lock.Unlock()
+		case <-writer.done:
+			return
+		}
+	}
+}
+
+// WriteRecordedOp publishes a recorded op, once enough are pending.
+func (writer *KafkaOpWriter) WriteRecordedOp(op *RecordedOp) error {
+	value, err := bson.Marshal(op)
+	if err != nil {
+		return err
+	}
+	return writer.write(value, false)
+}
+
+// WriteCaptureStats publishes the capture stats of the recording, which end
+// it.
+func (writer *KafkaOpWriter) WriteCaptureStats(stats CaptureStats) error {
+	value, err := bson.Marshal(playbackFileTrailer{stats})
+	if err != nil {
+		return fmt.Errorf("error writing capture stats: %v", err)
+	}
+	return writer.write(value, true)
+}
+
+func (writer *KafkaOpWriter) write(value []byte, flush bool) error {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	if writer.err != nil {
+		return writer.err
+	}
+	writer.pending = append(writer.pending, value)
+	writer.size += len(value)
+	if flush || len(writer.pending) >= kafkaBatchOps || writer.size >= kafkaBatchBytes {
+		return writer.flush()
+	}
+	return nil
+}
+
+// flush publishes the pending ops. It is called with the lock held, and
+// once it fails, the leader having been found again kafkaRetries times,
+// every write fails.
+func (writer *KafkaOpWriter) flush() error {
+	if writer.err != nil || len(writer.pending) == 0 {
+		return writer.err
+	}
+	if err := writer.publish(writer.pending); err != nil {
+		writer.err = fmt.Errorf("error publishing %v ops to %v: %v", len(writer.pending), writer.options.KafkaTopic, err)
+		return writer.err
+	}
+	writer.pending, writer.size = nil, 0
+	return nil
+}
+
+// publish publishes values as a batch of records. A batch larger than the
+// topic accepts is split in two, and an op larger than the topic accepts is
+// skipped, so that the recording goes on without it.
+func (writer *KafkaOpWriter) publish(values [][]byte) error {
+	err := writer.leader.do(func(conn *kafkaConn) error {
+		return writer.produce(conn, values)
+	})
+	if err != kafkaError(10) {
+		return err
+	}
+	if len(values) == 1 {
+		userInfoLogger.Logvf(Always, "Skipping an op of %v bytes, larger than %v accepts", len(values[0]), writer.options.KafkaTopic)
+		return nil
+	}
+	if err := writer.publish(values[:len(values)/2]); err != nil {
+		return err
+	}
+	return writer.publish(values[len(values)/2:])
+}
+
+// produce sends the produce request of a batch of records holding values.
+func (writer *KafkaOpWriter) produce(conn *kafkaConn, values [][]byte) error {
+	partition := kafkaEncoder{}
+	partition.int16(-1) // no transaction
+	partition.int16(1)  // acknowledged by the leader
+	partition.int32(int32(kafkaRequestTimeout / time.Millisecond))
+	partition.int32(1)
+	partition.string(writer.options.KafkaTopic)
+	partition.int32(1)
+	partition.int32(writer.options.KafkaPartition)
+	partition.bytes(encodeKafkaRecordBatch(values, time.Now(), writer.compression))
+	d, err := conn.roundTrip(kafkaAPIProduce, kafkaProduceVersion, partition.b)
+	if err != nil {
+		return err
+	}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.string()
+		for p := d.int32(); p > 0 && d.err == nil; p-- {
+			d.int32()
+			if code := d.int16(); code != 0 && err == nil {
+				err = kafkaError(code)
+			}
+			d.int64() // base offset
+			d.int64() // log append time
+		}
+	}
+	if err == nil {
+		err = d.err
+	}
+	return err
+}
+
+// Close publishes the pending ops and closes the connection to the broker.
+func (writer *KafkaOpWriter) Close() error {
+	close(writer.done)
+	writer.flushed.Wait()
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	err := writer.flush()
+	writer.leader.Close()
+	return err
+}
+
+// KafkaOpReader consumes the ops published to a partition of a Kafka topic,
+// from the offset committed by its group, if any, or else from the offset
+// of its options.
+type KafkaOpReader struct {
+	options      KafkaOptions
+	leader       *kafkaBroker
+	coordinator  *kafkaBroker
+	maxBytes     int32
+	committed    int64
+	captureStats *CaptureStats
+}
+
+// NewKafkaOpReader connects to the leader of the partition of options, from
+// which the ops are consumed, and to the coordinator of its group, if any.
+func NewKafkaOpReader(options KafkaOptions) (*KafkaOpReader, error) {
+	leader, err := dialKafkaLeader(options)
+	if err != nil {
+		return nil, err
+	}
+	reader := &KafkaOpReader{options: options, leader: leader, maxBytes: kafkaFetchMaxBytes, committed: -1}
+	if options.KafkaGroup != "" {
+		if reader.coordinator, err = dialKafkaCoordinator(options); err != nil {
+			leader.Close()
+			return nil, err
+		}
+	}
+	return reader, nil
+}
+
+// Close closes the connections to the brokers.
+func (reader *KafkaOpReader) Close() error {
+	if reader.coordinator != nil {
+		reader.coordinator.Close()
+	}
+	return reader.leader.Close()
+}
+
+// CaptureStats returns the capture stats which ended the recording, once
+// they have been consumed, or nil.
+func (reader *KafkaOpReader) CaptureStats() *CaptureStats {
+	return reader.captureStats
+}
+
+// OpChan runs a goroutine that consumes the ops of the partition and pushes
+// them to the recorded op chan until the capture stats ending the recording
+// are consumed, waiting for the ops still to be published until then, or ctx
+// is done. The offsets of the ops pushed are committed to the group, if any,
+// after each fetch and once the capture stats are consumed, so that the
+// next playback of the group plays the next recording. The error chan, which
+// isn't readable until the recorded op chan is closed, then gets io.EOF or
+// the error that stopped the consumption.
+func (reader *KafkaOpReader) OpChan(ctx context.Context) (<-chan *RecordedOp, <-chan error) {
+	ch := make(chan *RecordedOp)
+	e := make(chan error, 1)
+	go func() {
+		defer close(e)
+		e <- func() error {
+			defer close(ch)
+			offset, err := reader.startOffset()
+			if err != nil {
+				return err
+			}
+			var order int64
+			for {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				records, next, err := reader.fetch(offset)
+				if err != nil {
+					return err
+				}
+				for _, record := range records {
+					if record.offset < offset {
+						// batches are fetched whole, from before the offset
+						continue
+					}
+					if isPlaybackFileTrailer(record.value) {
+						trailer := new(playbackFileTrailer)
+						if err := bson.Unmarshal(record.value, trailer); err != nil {
+							return fmt.Errorf("error reading capture stats: %v", err)
+						}
+						reader.captureStats = &trailer.CaptureStats
+						reader.commit(record.offset + 1)
+						return io.EOF
+					}
+					op := new(RecordedOp)
+					if err := bson.Unmarshal(record.value, op); err != nil {
+						return fmt.Errorf("error reading op at offset %v: %v", record.offset, err)
+					}
+					op.Order = order
+					order++
+					select {
+					case ch <- op:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					offset = record.offset + 1
+				}
+				if next > offset {
+					// the batches ended with records that aren't ops, such
+					// as the markers of transactions
+					offset = next
+				}
+				reader.commit(offset)
+			}
+		}()
+	}()
+	return ch, e
+}
+
+// startOffset returns the offset the ops are consumed from: the one
+// committed by the group, or else the one selected by the options.
+func (reader *KafkaOpReader) startOffset() (int64, error) {
+	if reader.coordinator != nil {
+		offset, err := reader.committedOffset()
+		if err != nil {
+			return 0, err
+		}
+		if offset >= 0 {
+			reader.committed = offset
+			return offset, nil
+		}
+	}
+	switch reader.options.KafkaOffset {
+	case "", "earliest":
+		return reader.listOffset(kafkaOffsetEarliest)
+	case "latest":
+		return reader.listOffset(kafkaOffsetLatest)
+	}
+	return strconv.ParseInt(reader.options.KafkaOffset, 10, 64)
+}
+
+// listOffset returns the first offset of the partition, or the offset of
+// its next record, as asked by timestamp.
+func (reader *KafkaOpReader) listOffset(timestamp int64) (int64, error) {
+	request := kafkaEncoder{}
+	request.int32(-1) // replica
+	request.int32(1)
+	request.string(reader.options.KafkaTopic)
+	request.int32(1)
+	request.int32(reader.options.KafkaPartition)
+	request.int64(timestamp)
+	var offset int64
+	err := reader.leader.do(func(conn *kafkaConn) error {
+		d, err := conn.roundTrip(kafkaAPIListOffsets, kafkaListOffsetsVersion, request.b)
+		if err != nil {
+			return err
+		}
+		for n := d.int32(); n > 0 && d.err == nil; n-- {
+			d.string()
+			for p := d.int32(); p > 0 && d.err == nil; p-- {
+				d.int32()
+				if code := d.int16(); code != 0 && err == nil {
+					err = kafkaError(code)
+				}
+				d.int64() // timestamp
+				offset = d.int64()
+			}
+		}
+		if err == nil {
+			err = d.err
+		}
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error finding the offset to consume %v from: %v", reader.options.KafkaTopic, err)
+	}
+	return offset, nil
+}
+
+// committedOffset returns the offset committed by the group for the
+// partition, or -1 if it has none.
+func (reader *KafkaOpReader) committedOffset() (int64, error) {
+	request := kafkaEncoder{}
+	request.string(reader.options.KafkaGroup)
+	request.int32(1)
+	request.string(reader.options.KafkaTopic)
+	request.int32(1)
+	request.int32(reader.options.KafkaPartition)
+	offset := int64(-1)
+	err := reader.coordinator.do(func(conn *kafkaConn) error {
+		d, err := conn.roundTrip(kafkaAPIOffsetFetch, kafkaOffsetFetchVersion, request.b)
+		if err != nil {
+			return err
+		}
+		for n := d.int32(); n > 0 && d.err == nil; n-- {
+			d.string()
+			for p := d.int32(); p > 0 && d.err == nil; p-- {
+				d.int32()
+				offset = d.int64()
+				d.string() // metadata
+				if code := d.int16(); code != 0 && err == nil {
+					err = kafkaError(code)
+				}
+			}
+		}
+		if err == nil {
+			err = d.err
+		}
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error fetching the offset committed by group %v: %v", reader.options.KafkaGroup, err)
+	}
+	return offset, nil
+}
+
+// commit commits offset to the group, if any, unless it is already
+// committed. A commit failing is logged, as the playback can go on.
+func (reader *KafkaOpReader) commit(offset int64) {
+	if reader.coordinator == nil || offset == reader.committed {
+		return
+	}
+	request := kafkaEncoder{}
+	request.string(reader.options.KafkaGroup)
+	request.int32(-1) // generation: committed outside of the group protocol
+	request.string("")
+	request.int64(-1) // retention time of the broker
+	request.int32(1)
+	request.string(reader.options.KafkaTopic)
+	request.int32(1)
+	request.int32(reader.options.KafkaPartition)
+	request.int64(offset)
+	request.nullString() // metadata
+	err := reader.coordinator.do(func(conn *kafkaConn) error {
+		d, err := conn.roundTrip(kafkaAPIOffsetCommit, kafkaOffsetCommitVersion, request.b)
+		if err != nil {
+			return err
+		}
+		for n := d.int32(); n > 0 && d.err == nil; n-- {
+			d.string()
+			for p := d.int32(); p > 0 && d.err == nil; p-- {
+				d.int32()
+				if code := d.int16(); code != 0 && err == nil {
+					err = kafkaError(code)
+				}
+			}
+		}
+		if err == nil {
+			err = d.err
+		}
+		return err
+	})
+	if err != nil {
+		userInfoLogger.Logvf(Always, "Error committing offset %v of %v to group %v: %v", offset, reader.options.KafkaTopic, reader.options.KafkaGroup, err)
+		return
+	}
+	reader.committed = offset
+}
+
+// fetch returns the records of the partition from offset, waiting up to
+// kafkaFetchWait for some to be published, and the offset following the
+// last batch fetched, or -1. The fetches grow up to kafkaFetchMaxBytesLimit
+// for the batches which don't fit.
+func (reader *KafkaOpReader) fetch(offset int64) ([]kafkaRecord, int64, error) {
+	for {
+		batches, err := reader.fetchBatches(offset)
+		if err != nil {
+			return nil, -1, fmt.Errorf("error fetching from %v at offset %v: %v", reader.options.KafkaTopic, offset, err)
+		}
+		records, next, err := decodeKafkaRecordBatches(batches)
+		if err != nil || next >= 0 || len(batches) == 0 {
+			return records, next, err
+		}
+		if reader.maxBytes >= kafkaFetchMaxBytesLimit {
+			return nil, -1, fmt.Errorf("the record batch of %v at offset %v is larger than %v bytes", reader.options.KafkaTopic, offset, kafkaFetchMaxBytesLimit)
+		}
+		reader.maxBytes *= 2
+	}
+}
+
+// fetchBatches returns the record batches of the partition from offset, as
+// many as fit in the fetch.
+func (reader *KafkaOpReader) fetchBatches(offset int64) ([]byte, error) {
+	request := kafkaEncoder{}
+	request.int32(-1) // replica
+	request.int32(int32(kafkaFetchWait / time.Millisecond))
+	request.int32(1) // min bytes
+	request.int32(reader.maxBytes)
+	request.int8(0) // read uncommitted
+	request.int32(1)
+	request.string(reader.options.KafkaTopic)
+	request.int32(1)
+	request.int32(reader.options.KafkaPartition)
+	request.int64(offset)
+	request.int32(reader.maxBytes)
+	var batches []byte
+	err := reader.leader.do(func(conn *kafkaConn) error {
+		d, err := conn.roundTrip(kafkaAPIFetch, kafkaFetchVersion, request.b)
+		if err != nil {
+			return err
+		}
+		d.int32() // throttle time
+		for n := d.int32(); n > 0 && d.err == nil; n-- {
+			d.string()
+			for p := d.int32(); p > 0 && d.err == nil; p-- {
+				d.int32()
+				if code := d.int16(); code != 0 && err == nil {
+					err = kafkaError(code)
+				}
+				d.int64()       // high watermark
+				d.int64()       // last stable offset
+				d.skipArray(16) // aborted transactions
+				batches = d.bytes()
+			}
+		}
+		if err == nil {
+			err = d.err
+		}
+		return err
+	})
+	return batches, err
+}
@@ -0,0 +1,375 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestKafkaRecordBatches(t *testing.T) {
+	values := [][]byte{[]byte("first"), {}, []byte("third")}
+	first := encodeKafkaRecordBatch(values, testTime, kafkaCompressionNone)
+	second := encodeKafkaRecordBatch([][]byte{[]byte("fourth")}, testTime, kafkaCompressionNone)
+	binary.BigEndian.PutUint64(second, 3)
+	gzipped := encodeKafkaRecordBatch([][]byte{[]byte("fifth"), []byte("sixth")}, testTime, kafkaCompressionGzip)
+	binary.BigEndian.PutUint64(gzipped, 4)
+	snappy := append([]byte{}, gzipped...)
+	snappy[22] = 2 // the codec of the attributes, past the crc
+	binary.BigEndian.PutUint32(snappy[17:], crc32.Checksum(snappy[21:], castagnoliTable))
+
+	type testCase struct {
+		name     string
+		batches  []byte
+		expected []kafkaRecord
+		next     int64
+		err      bool
+	}
+	cases := []testCase{
+		{
+			name:    "two batches",
+			batches: append(append([]byte{}, first...), second...),
+			expected: []kafkaRecord{{0, []byte("first")}, {1, []byte{}}, {2, []byte("third")},
+				{3, []byte("fourth")}},
+			next: 4,
+		},
+		{
+			name:     "truncated batch",
+			batches:  append(append([]byte{}, first...), second[:len(second)-1]...),
+			expected: []kafkaRecord{{0, []byte("first")}, {1, []byte{}}, {2, []byte("third")}},
+			next:     3,
+		},
+		{
+			name:    "batch larger than the fetch",
+			batches: second[:len(second)-1],
+			next:    -1,
+		},
+		{
+			name:     "gzip batch",
+			batches:  gzipped,
+			expected: []kafkaRecord{{4, []byte("fifth")}, {5, []byte("sixth")}},
+			next:     6,
+		},
+		{
+			name:    "snappy batch",
+			batches: snappy,
+			err:     true,
+		},
+		{
+			name:    "corrupt batch",
+			batches: append(append([]byte{}, first[:len(first)-1]...), 'x'),
+			err:     true,
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		records, next, err := decodeKafkaRecordBatches(c.batches)
+		if (err != nil) != c.err {
+			t.Errorf("expected error %v, got %v", c.err, err)
+			continue
+		}
+		if err == nil && (!reflect.DeepEqual(records, c.expected) || next != c.next) {
+			t.Errorf("expected records %v up to %v, got %v up to %v", c.expected, c.next, records, next)
+		}
+	}
+}
+
+// fakeKafkaBroker serves the requests of a single partition leader, which
+// is also the coordinator of the consumer groups, the records published to
+// it and the offsets committed being held in memory. It answers the first
+// notLeader produce and fetch requests as if it weren't the leader, and
+// refuses the batches larger than maxBatchBytes, if set.
+type fakeKafkaBroker struct {
+	listener      net.Listener
+	lock          sync.Mutex
+	values        [][]byte
+	committed     map[string]int64
+	notLeader     int
+	maxBatchBytes int
+}
+
+func newFakeKafkaBroker(t *testing.T) *fakeKafkaBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &fakeKafkaBroker{listener: listener, committed: map[string]int64{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (broker *fakeKafkaBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		d := &kafkaDecoder{b: request}
+		apiKey := d.int16()
+		d.int16() // version
+		correlationID := d.int32()
+		d.string() // client id
+
+		response := kafkaEncoder{b: make([]byte, 4)}
+		response.int32(correlationID)
+		broker.lock.Lock()
+		switch apiKey {
+		case kafkaAPIMetadata:
+			host, port, _ := net.SplitHostPort(broker.listener.Addr().String())
+			portNumber, _ := strconv.Atoi(port)
+			response.int32(1)
+			response.int32(7)
+			response.string(host)
+			response.int32(int32(portNumber))
+			response.int16(-1) // rack
+			response.int32(7)  // controller
+			response.int32(1)
+			response.int16(0)
+			response.string("ops")
+			response.int8(0)
+			response.int32(1)
+			response.int16(0)
+			response.int32(0)
+			response.int32(7) // leader
+			response.int32(0)
+			response.int32(0)
+		case kafkaAPIProduce:
+			d.int16() // transactional id
+			d.int16() // acks
+			d.int32() // timeout
+			d.int32()
+			d.string()
+			d.int32()
+			d.int32()
+			batch := d.bytes()
+			code := int16(0)
+			switch {
+			case broker.notLeader > 0:
+				broker.notLeader--
+				code = 6
+			case broker.maxBatchBytes > 0 && len(batch) > broker.maxBatchBytes:
+				code = 10
+			}
+			baseOffset := int64(len(broker.values))
+			if code == 0 {
+				records, _, _ := decodeKafkaRecordBatches(batch)
+				for _, record := range records {
+					broker.values = append(broker.values, record.value)
+				}
+			}
+			response.int32(1)
+			response.string("ops")
+			response.int32(1)
+			response.int32(0)
+			response.int16(code)
+			response.int64(baseOffset)
+			response.int64(-1)
+			response.int32(0) // throttle time
+		case kafkaAPIListOffsets:
+			d.int32() // replica
+			d.int32()
+			d.string()
+			d.int32()
+			d.int32()
+			offset := int64(0)
+			if d.int64() == kafkaOffsetLatest {
+				offset = int64(len(broker.values))
+			}
+			response.int32(1)
+			response.string("ops")
+			response.int32(1)
+			response.int32(0)
+			response.int16(0)
+			response.int64(-1)
+			response.int64(offset)
+		case kafkaAPIFindCoordinator:
+			host, port, _ := net.SplitHostPort(broker.listener.Addr().String())
+			portNumber, _ := strconv.Atoi(port)
+			response.int16(0)
+			response.int32(7)
+			response.string(host)
+			response.int32(int32(portNumber))
+		case kafkaAPIOffsetFetch:
+			offset, ok := broker.committed[d.string()]
+			if !ok {
+				offset = -1
+			}
+			response.int32(1)
+			response.string("ops")
+			response.int32(1)
+			response.int32(0)
+			response.int64(offset)
+			response.nullString()
+			response.int16(0)
+		case kafkaAPIOffsetCommit:
+			group := d.string()
+			d.int32()  // generation
+			d.string() // member
+			d.int64()  // retention time
+			d.int32()
+			d.string()
+			d.int32()
+			d.int32()
+			broker.committed[group] = d.int64()
+			response.int32(1)
+			response.string("ops")
+			response.int32(1)
+			response.int32(0)
+			response.int16(0)
+		case kafkaAPIFetch:
+			d.int32() // replica
+			d.int32() // max wait
+			d.int32() // min bytes
+			d.int32() // max bytes
+			d.int8()  // isolation level
+			d.int32()
+			d.string()
+			d.int32()
+			d.int32()
+			offset := d.int64()
+			var batch []byte
+			if offset < int64(len(broker.values)) {
+				batch = encodeKafkaRecordBatch(broker.values[offset:], testTime, kafkaCompressionNone)
+				binary.BigEndian.PutUint64(batch, uint64(offset))
+			}
+			code := int16(0)
+			if broker.notLeader > 0 {
+				broker.notLeader--
+				code, batch = 6, nil
+			}
+			response.int32(0) // throttle time
+			response.int32(1)
+			response.string("ops")
+			response.int32(1)
+			response.int32(0)
+			response.int16(code)
+			response.int64(int64(len(broker.values)))
+			response.int64(int64(len(broker.values)))
+			response.int32(-1) // no aborted transactions
+			response.bytes(batch)
+		}
+		broker.lock.Unlock()
+		binary.BigEndian.PutUint32(response.b, uint32(len(response.b)-4))
+		if _, err := conn.Write(response.b); err != nil {
+			return
+		}
+	}
+}
+
+// publishKafkaOps publishes ops and capture stats dropping packets as a
+// recording.
+func publishKafkaOps(t *testing.T, options KafkaOptions, ops []*RecordedOp, packetsDropped int64) {
+	writer, err := NewKafkaOpWriter(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		if err := writer.WriteRecordedOp(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.WriteCaptureStats(CaptureStats{PacketsDropped: packetsDropped}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// consumeKafkaOps consumes the ops of a recording, checking that they are
+// ops and that the recording ends with capture stats dropping packets.
+func consumeKafkaOps(t *testing.T, options KafkaOptions, ops []*RecordedOp, packetsDropped int64) {
+	reader, err := NewKafkaOpReader(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	opChan, errChan := reader.OpChan(context.Background())
+	var read []*RecordedOp
+	for op := range opChan {
+		read = append(read, op)
+	}
+	if err := <-errChan; err != io.EOF {
+		t.Fatal(err)
+	}
+	if len(read) != len(ops) {
+		t.Fatalf("expected %v ops consumed, got %v", len(ops), len(read))
+	}
+	for i, op := range read {
+		if op.Header != ops[i].Header || !op.Seen.Equal(ops[i].Seen.Time) || op.SrcEndpoint != ops[i].SrcEndpoint {
+			t.Errorf("expected op %v to be %v, got %v", i, ops[i], op)
+		}
+	}
+	if stats := reader.CaptureStats(); stats == nil || stats.PacketsDropped != packetsDropped {
+		t.Errorf("expected the capture stats to be consumed, got %v", stats)
+	}
+}
+
+func TestKafkaOpWriterAndReader(t *testing.T) {
+	broker := newFakeKafkaBroker(t)
+	defer broker.listener.Close()
+	options := KafkaOptions{KafkaBrokers: broker.listener.Addr().String(), KafkaTopic: "ops", KafkaCompression: "gzip"}
+
+	// the requests failing as the broker isn't the leader are sent again
+	broker.notLeader = 1
+	publishKafkaOps(t, options, skewedOps(), 3)
+	broker.notLeader = 1
+	consumeKafkaOps(t, options, skewedOps(), 3)
+}
+
+func TestKafkaOpWriterSkipsLargeOps(t *testing.T) {
+	broker := newFakeKafkaBroker(t)
+	defer broker.listener.Close()
+	broker.maxBatchBytes = 1000
+	options := KafkaOptions{KafkaBrokers: broker.listener.Addr().String(), KafkaTopic: "ops"}
+
+	ops := skewedOps()
+	large := &RecordedOp{RawOp: RawOp{Body: make([]byte, 2000)}, Seen: &PreciseTime{testTime}}
+	publishKafkaOps(t, options, append(append(ops[:2:2], large), ops[2:]...), 3)
+	consumeKafkaOps(t, options, ops, 3)
+}
+
+func TestKafkaConsumerGroup(t *testing.T) {
+	broker := newFakeKafkaBroker(t)
+	defer broker.listener.Close()
+	options := KafkaOptions{KafkaBrokers: broker.listener.Addr().String(), KafkaTopic: "ops"}
+	ops := skewedOps()
+	publishKafkaOps(t, options, ops, 1)
+	publishKafkaOps(t, options, ops[:2], 2)
+
+	// the group consumes each recording once, and others from --kafkaOffset
+	grouped := options
+	grouped.KafkaGroup = "replays"
+	consumeKafkaOps(t, grouped, ops, 1)
+	consumeKafkaOps(t, grouped, ops[:2], 2)
+	if committed := broker.committed["replays"]; committed != int64(len(ops)+4) {
+		t.Errorf("expected offset %v to be committed, got %v", len(ops)+4, committed)
+	}
+	consumeKafkaOps(t, options, ops, 1)
+	options.KafkaOffset = strconv.Itoa(len(ops) + 1)
+	consumeKafkaOps(t, options, ops[:2], 2)
+}
@@ -0,0 +1,58 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// lagWarningInterval is the least time between the warnings logged while
+// playback is falling behind the recorded timeline.
+const lagWarningInterval = 10 * time.Second
+
+// checkLag checks how far behind the recorded timeline an op of the
+// connection summarized was played. Past the context's behindThreshold the
+// connection is counted as having fallen behind and a warning is logged, at
+// most every lagWarningInterval; past its maxLag the playback is aborted, as
+// it can no longer keep up with the recorded pace.
+func (context *ExecutionContext) checkLag(summary *ConnectionSummary, lag time.Duration) {
+	if context.maxLag > 0 && lag > context.maxLag {
+		err := ErrThresholdExceeded{fmt.Sprintf("connection %v played an op %v behind the recorded timeline, more than the %v allowed by --maxLag",
+			summary.ConnectionNum, lag.Round(time.Millisecond), context.maxLag)}
+		if context.abort != nil {
+			context.abort(err)
+		}
+		return
+	}
+	if context.behindThreshold <= 0 || lag <= context.behindThreshold {
+		return
+	}
+	if !summary.Behind {
+		summary.Behind = true
+		atomic.AddInt64(&context.laggingConnections, 1)
+	}
+	now := time.Now().UnixNano()
+	warnedAt := atomic.LoadInt64(&context.lagWarnedAt)
+	if warnedAt != 0 && now-warnedAt < int64(lagWarningInterval) {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&context.lagWarnedAt, warnedAt, now) {
+		return
+	}
+	userInfoLogger.Logvf(Always, "Warning: playback is falling behind the recorded timeline; connection %v played an op %v late, "+
+		"and %v connections have fallen behind by more than %v so far", summary.ConnectionNum, lag.Round(time.Millisecond),
+		context.LaggingConnections(), context.behindThreshold)
+}
+
+// LaggingConnections returns the number of recorded connections which have
+// had an op played further behind the recorded timeline than the threshold
+// of --behindThreshold.
+func (context *ExecutionContext) LaggingConnections() int64 {
+	return atomic.LoadInt64(&context.laggingConnections)
+}
@@ -0,0 +1,73 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckLag(t *testing.T) {
+	type testCase struct {
+		name     string
+		lags     []time.Duration
+		maxLag   time.Duration
+		behind   bool
+		lagging  int64
+		aborted  bool
+		warnings int
+	}
+	cases := []testCase{
+		{
+			name: "keeping up",
+			lags: []time.Duration{0, 500 * time.Millisecond, time.Second},
+		},
+		{
+			name:     "falling behind",
+			lags:     []time.Duration{0, 2 * time.Second, 3 * time.Second},
+			behind:   true,
+			lagging:  1,
+			warnings: 1,
+		},
+		{
+			name:    "past maxLag",
+			lags:    []time.Duration{2 * time.Minute},
+			maxLag:  time.Minute,
+			aborted: true,
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		logged := &bytes.Buffer{}
+		logger.SetOutput(logged)
+		var aborted error
+		context := &ExecutionContext{behindThreshold: time.Second, maxLag: c.maxLag}
+		context.abort = func(err error) { aborted = err }
+		summary := &ConnectionSummary{ConnectionNum: 7, Ops: 1}
+		for _, lag := range c.lags {
+			context.checkLag(summary, lag)
+		}
+		logger.SetOutput(os.Stderr)
+
+		if summary.Behind != c.behind {
+			t.Errorf("expected behind to be %v", c.behind)
+		}
+		if lagging := context.LaggingConnections(); lagging != c.lagging {
+			t.Errorf("expected %v lagging connections, got %v", c.lagging, lagging)
+		}
+		if _, ok := aborted.(ErrThresholdExceeded); ok != c.aborted {
+			t.Errorf("expected aborted to be %v, got %v", c.aborted, aborted)
+		}
+		warnings := strings.Count(logged.String(), "falling behind the recorded timeline; connection 7")
+		if warnings != c.warnings {
+			t.Errorf("expected %v warnings, got %v: %v", c.warnings, warnings, logged)
+		}
+	}
+}
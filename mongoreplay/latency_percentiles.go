@@ -0,0 +1,201 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"text/tabwriter"
+)
+
+// histogramSubBucketBits sets the precision of a LatencyHistogram: values
+// are counted exactly below 2^histogramSubBucketBits, and above it within
+// buckets no wider than 1/2^(histogramSubBucketBits-1) of their value.
+const histogramSubBucketBits = 8
+
+// summaryPercentiles are the percentiles reported in latency summaries.
+var summaryPercentiles = []float64{50, 90, 95, 99}
+
+// LatencyHistogram counts latencies in log-linear buckets, in the manner of
+// an HDR histogram, so that percentiles can be computed to within 1% of the
+// recorded values in constant memory.
+type LatencyHistogram struct {
+	counts []int64
+	total  int64
+	max    int64
+}
+
+// histogramBucket returns the index of the bucket counting value.
+func histogramBucket(value int64) int {
+	const subBuckets = 1 << histogramSubBucketBits
+	if value < subBuckets {
+		return int(value)
+	}
+	shift := bits.Len64(uint64(value)) - histogramSubBucketBits
+	sub := int(value >> uint(shift))
+	return subBuckets + (shift-1)*subBuckets/2 + sub - subBuckets/2
+}
+
+// histogramBucketMax returns the highest value counted by the bucket.
+func histogramBucketMax(bucket int) int64 {
+	const subBuckets = 1 << histogramSubBucketBits
+	if bucket < subBuckets {
+		return int64(bucket)
+	}
+	shift := (bucket-subBuckets)/(subBuckets/2) + 1
+	sub := int64((bucket-subBuckets)%(subBuckets/2) + subBuckets/2)
+	return (sub+1)<<uint(shift) - 1
+}
+
+// Record counts a latency, in microseconds.
+func (h *LatencyHistogram) Record(latencyMicros int64) {
+	if latencyMicros < 0 {
+		latencyMicros = 0
+	}
+	bucket := histogramBucket(latencyMicros)
+	if bucket >= len(h.counts) {
+		counts := make([]int64, bucket+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[bucket]++
+	h.total++
+	if latencyMicros > h.max {
+		h.max = latencyMicros
+	}
+}
+
+// Merge adds the latencies recorded by other to the histogram.
+func (h *LatencyHistogram) Merge(other *LatencyHistogram) {
+	if len(other.counts) > len(h.counts) {
+		counts := make([]int64, len(other.counts))
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	for bucket, count := range other.counts {
+		h.counts[bucket] += count
+	}
+	h.total += other.total
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+// Count returns the number of latencies recorded.
+func (h *LatencyHistogram) Count() int64 {
+	return h.total
+}
+
+// Max returns the highest latency recorded, in microseconds.
+func (h *LatencyHistogram) Max() int64 {
+	return h.max
+}
+
+// Percentile returns the latency, in microseconds, below which the given
+// percentage of the recorded latencies fall.
+func (h *LatencyHistogram) Percentile(percentile float64) int64 {
+	if h.total == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(percentile / 100 * float64(h.total)))
+	if target < 1 {
+		target = 1
+	}
+	var seen int64
+	for bucket, count := range h.counts {
+		seen += count
+		if seen >= target {
+			if value := histogramBucketMax(bucket); value < h.max {
+				return value
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// PercentileStatRecorder implements the StatRecorder interface, counting
+// the latencies of the ops by command, or by op type for ops which are not
+// commands, and by namespace, and logging their percentiles when closed.
+type PercentileStatRecorder struct {
+	ByOp        map[string]*LatencyHistogram
+	ByNamespace map[string]*LatencyHistogram
+}
+
+// NewPercentileStatRecorder creates an empty PercentileStatRecorder.
+func NewPercentileStatRecorder() *PercentileStatRecorder {
+	return &PercentileStatRecorder{
+		ByOp:        map[string]*LatencyHistogram{},
+		ByNamespace: map[string]*LatencyHistogram{},
+	}
+}
+
+func recordInHistogram(histograms map[string]*LatencyHistogram, key string, latencyMicros int64) {
+	histogram, ok := histograms[key]
+	if !ok {
+		histogram = &LatencyHistogram{}
+		histograms[key] = histogram
+	}
+	histogram.Record(latencyMicros)
+}
+
+// RecordStat counts the latency of the stat's op, if it received a reply.
+func (psr *PercentileStatRecorder) RecordStat(stat *OpStat) {
+	if stat == nil || stat.LatencyMicros <= 0 {
+		return
+	}
+	name := stat.Command
+	if name == "" {
+		name = stat.OpType
+	}
+	recordInHistogram(psr.ByOp, name, stat.LatencyMicros)
+	if stat.Ns != "" {
+		recordInHistogram(psr.ByNamespace, stat.Ns, stat.LatencyMicros)
+	}
+}
+
+// Close logs the latency percentiles.
+func (psr *PercentileStatRecorder) Close() error {
+	if len(psr.ByOp) == 0 {
+		userInfoLogger.Logvf(Always, "No latencies were recorded")
+		return nil
+	}
+	userInfoLogger.Logvf(Always, "Latency percentiles (ms) by op:\n%v", formatPercentileTable("op", psr.ByOp))
+	userInfoLogger.Logvf(Always, "Latency percentiles (ms) by namespace:\n%v", formatPercentileTable("namespace", psr.ByNamespace))
+	return nil
+}
+
+// formatPercentileTable lays out the count, percentiles and maximum of each
+// histogram in a table, sorted by key.
+func formatPercentileTable(keyName string, histograms map[string]*LatencyHistogram) string {
+	keys := make([]string, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	out := &bytes.Buffer{}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "%v\tcount\t", keyName)
+	for _, percentile := range summaryPercentiles {
+		fmt.Fprintf(w, "p%v\t", percentile)
+	}
+	fmt.Fprintln(w, "max\t")
+	for _, key := range keys {
+		histogram := histograms[key]
+		fmt.Fprintf(w, "%v\t%v\t", key, histogram.Count())
+		for _, percentile := range summaryPercentiles {
+			fmt.Fprintf(w, "%.3f\t", float64(histogram.Percentile(percentile))/1000)
+		}
+		fmt.Fprintf(w, "%.3f\t\n", float64(histogram.Max())/1000)
+	}
+	w.Flush()
+	return out.String()
+}
@@ -0,0 +1,84 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	previous := -1
+	for _, value := range []int64{0, 1, 127, 128, 129, 255, 256, 1000, 123456, 1 << 40} {
+		bucket := histogramBucket(value)
+		if bucket < previous {
+			t.Errorf("bucket of %v is lower than that of a lower value", value)
+		}
+		previous = bucket
+		max := histogramBucketMax(bucket)
+		if max < value || float64(max-value) > float64(value)/128 {
+			t.Errorf("value %v counted in bucket %v with highest value %v", value, bucket, max)
+		}
+		if bucket > 0 && histogramBucketMax(bucket-1) >= value {
+			t.Errorf("value %v also fits in the previous bucket", value)
+		}
+	}
+}
+
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	histogram := &LatencyHistogram{}
+	for i := int64(1); i <= 10000; i++ {
+		histogram.Record(i)
+	}
+	testCases := []struct {
+		percentile float64
+		expected   int64
+	}{
+		{50, 5000},
+		{90, 9000},
+		{99, 9900},
+		{100, 10000},
+	}
+	for _, c := range testCases {
+		t.Logf("running case: p%v", c.percentile)
+		value := histogram.Percentile(c.percentile)
+		if math.Abs(float64(value-c.expected)) > float64(c.expected)/100 {
+			t.Errorf("expected p%v within 1%% of %v, saw %v", c.percentile, c.expected, value)
+		}
+	}
+	if histogram.Count() != 10000 || histogram.Max() != 10000 {
+		t.Errorf("unexpected count %v or max %v", histogram.Count(), histogram.Max())
+	}
+	if (&LatencyHistogram{}).Percentile(99) != 0 {
+		t.Errorf("expected an empty histogram to report 0")
+	}
+}
+
+func TestPercentileStatRecorder(t *testing.T) {
+	rec := NewPercentileStatRecorder()
+	rec.RecordStat(&OpStat{OpType: "op_msg", Command: "find", Ns: "test.a", LatencyMicros: 1000})
+	rec.RecordStat(&OpStat{OpType: "op_msg", Command: "find", Ns: "test.b", LatencyMicros: 3000})
+	rec.RecordStat(&OpStat{OpType: "insert", Ns: "test.a", LatencyMicros: 2000})
+	// ops without replies have no latency
+	rec.RecordStat(&OpStat{OpType: "insert", Ns: "test.a"})
+
+	if count := rec.ByOp["find"].Count(); count != 2 {
+		t.Errorf("expected 2 finds, saw %v", count)
+	}
+	if count := rec.ByOp["insert"].Count(); count != 1 {
+		t.Errorf("expected 1 insert, saw %v", count)
+	}
+	if count := rec.ByNamespace["test.a"].Count(); count != 2 {
+		t.Errorf("expected 2 ops on test.a, saw %v", count)
+	}
+	table := formatPercentileTable("op", rec.ByOp)
+	lines := strings.Split(strings.TrimSpace(table), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "p99") || !strings.Contains(lines[1], "3.000") {
+		t.Errorf("unexpected table:\n%v", table)
+	}
+}
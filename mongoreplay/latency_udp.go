@@ -0,0 +1,208 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// The UDPLatencyRecorder packs latency samples into datagrams laid out as
+// follows, with all integers big-endian:
+//
+//	offset  size  field
+//	0       2     format version, currently 1
+//	2       2     number of samples in the datagram
+//	4       8     emitter ID, chosen randomly by each mongoreplay process
+//	12      16*n  samples
+//
+// and each sample as:
+//
+//	offset  size  field
+//	0       8     time the op was played, in nanoseconds since the Unix epoch
+//	8       4     latency in microseconds, saturated at 2^32-1
+//	12      1     op kind, one of the latencyOpKind constants
+//	13      3     reserved, zero
+const (
+	latencyDatagramVersion    = 1
+	latencyDatagramHeaderSize = 12
+	latencySampleSize         = 16
+
+	// latencyDatagramMaxSize keeps datagrams within the MTU of most networks.
+	latencyDatagramMaxSize = 1400
+
+	// latencyFlushInterval is the time between the sends of the datagram
+	// being filled, bounding how long a sample waits to be sent while ops
+	// are played too slowly to fill it.
+	latencyFlushInterval = time.Second
+)
+
+// latencyOpKind identifies the kind of op a latency sample was taken from.
+type latencyOpKind uint8
+
+const (
+	latencyOpOther latencyOpKind = iota
+	latencyOpQuery
+	latencyOpInsert
+	latencyOpUpdate
+	latencyOpDelete
+	latencyOpGetMore
+	latencyOpCommand
+)
+
+// opKindOfStat classifies the op of an OpStat, looking at the command name
+// for ops that carry commands.
+func opKindOfStat(stat *OpStat) latencyOpKind {
+	name := stat.OpType
+	if name == "op_msg" || name == "op_command" || name == "command" {
+		name = stat.Command
+	}
+	switch name {
+	case "query", "find":
+		return latencyOpQuery
+	case "insert":
+		return latencyOpInsert
+	case "update", "findAndModify":
+		return latencyOpUpdate
+	case "delete":
+		return latencyOpDelete
+	case "getmore", "getMore":
+		return latencyOpGetMore
+	case "":
+		return latencyOpOther
+	}
+	return latencyOpCommand
+}
+
+// UDPLatencyRecorder implements the StatRecorder interface, sending the
+// latency of every played op to a UDP address so that an external aggregator
+// can build histograms across many mongoreplay processes. The datagram being
+// filled is sent once full, and every latencyFlushInterval until the
+// recorder is closed.
+type UDPLatencyRecorder struct {
+	conn      net.Conn
+	emitterID uint64
+
+	mutex sync.Mutex
+	buf   []byte
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewUDPLatencyRecorder creates a UDPLatencyRecorder sending to address.
+func NewUDPLatencyRecorder(address string) (*UDPLatencyRecorder, error) {
+	return newUDPLatencyRecorder(address, latencyFlushInterval)
+}
+
+func newUDPLatencyRecorder(address string, flushInterval time.Duration) (*UDPLatencyRecorder, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	ulr := &UDPLatencyRecorder{
+		conn:      conn,
+		emitterID: uint64(rand.New(rand.NewSource(time.Now().UnixNano())).Int63()),
+		buf:       make([]byte, latencyDatagramHeaderSize, latencyDatagramMaxSize),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go ulr.flushEvery(flushInterval)
+	return ulr, nil
+}
+
+// flushEvery sends the datagram being filled every interval until the
+// recorder is closed.
+func (ulr *UDPLatencyRecorder) flushEvery(interval time.Duration) {
+	defer close(ulr.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ulr.done:
+			return
+		case <-ticker.C:
+			ulr.mutex.Lock()
+			ulr.flush()
+			ulr.mutex.Unlock()
+		}
+	}
+}
+
+// RecordStat adds the latency of the stat's op to the datagram being filled,
+// sending it once full.
+func (ulr *UDPLatencyRecorder) RecordStat(stat *OpStat) {
+	if stat == nil || stat.PlayedAt == nil || stat.LatencyMicros <= 0 {
+		return
+	}
+	latency := uint32(math.MaxUint32)
+	if stat.LatencyMicros < math.MaxUint32 {
+		latency = uint32(stat.LatencyMicros)
+	}
+	var sample [latencySampleSize]byte
+	binary.BigEndian.PutUint64(sample[0:], uint64(stat.PlayedAt.UnixNano()))
+	binary.BigEndian.PutUint32(sample[8:], latency)
+	sample[12] = byte(opKindOfStat(stat))
+
+	ulr.mutex.Lock()
+	defer ulr.mutex.Unlock()
+	ulr.buf = append(ulr.buf, sample[:]...)
+	if len(ulr.buf)+latencySampleSize > latencyDatagramMaxSize {
+		ulr.flush()
+	}
+}
+
+// flush sends the samples waiting in the buffer. The caller holds the mutex.
+func (ulr *UDPLatencyRecorder) flush() {
+	count := (len(ulr.buf) - latencyDatagramHeaderSize) / latencySampleSize
+	if count == 0 {
+		return
+	}
+	binary.BigEndian.PutUint16(ulr.buf[0:], latencyDatagramVersion)
+	binary.BigEndian.PutUint16(ulr.buf[2:], uint16(count))
+	binary.BigEndian.PutUint64(ulr.buf[4:], ulr.emitterID)
+	if _, err := ulr.conn.Write(ulr.buf); err != nil {
+		toolDebugLogger.Logvf(DebugLow, "error sending latency samples: %v", err)
+	}
+	ulr.buf = ulr.buf[:latencyDatagramHeaderSize]
+}
+
+// Close sends any remaining samples and closes the UDPLatencyRecorder.
+func (ulr *UDPLatencyRecorder) Close() error {
+	close(ulr.done)
+	<-ulr.stopped
+	ulr.mutex.Lock()
+	defer ulr.mutex.Unlock()
+	ulr.flush()
+	return ulr.conn.Close()
+}
+
+// multiStatRecorder implements the StatRecorder interface, passing each stat
+// to all of its recorders in turn.
+type multiStatRecorder []StatRecorder
+
+// RecordStat records the stat with every recorder.
+func (msr multiStatRecorder) RecordStat(stat *OpStat) {
+	for _, recorder := range msr {
+		recorder.RecordStat(stat)
+	}
+}
+
+// Close closes every recorder, returning the first error encountered.
+func (msr multiStatRecorder) Close() error {
+	var err error
+	for _, recorder := range msr {
+		if closeErr := recorder.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
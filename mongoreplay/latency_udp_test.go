@@ -0,0 +1,102 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPLatencyRecorder(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	recorder, err := NewUDPLatencyRecorder(listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	playedAt := time.Unix(1500000000, 12345)
+	stats := []*OpStat{
+		{OpType: "op_msg", Command: "find", PlayedAt: &playedAt, LatencyMicros: 150},
+		{OpType: "insert", PlayedAt: &playedAt, LatencyMicros: 1 << 40},
+		// ops without a reply are not sampled
+		{OpType: "insert", PlayedAt: &playedAt},
+	}
+	for _, stat := range stats {
+		recorder.RecordStat(stat)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, latencyDatagramMaxSize)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("error reading datagram: %v", err)
+	}
+	if n != latencyDatagramHeaderSize+2*latencySampleSize {
+		t.Fatalf("expected datagram with 2 samples, saw %v bytes", n)
+	}
+	if version := binary.BigEndian.Uint16(buf[0:]); version != latencyDatagramVersion {
+		t.Errorf("expected version %v, saw %v", latencyDatagramVersion, version)
+	}
+	if count := binary.BigEndian.Uint16(buf[2:]); count != 2 {
+		t.Errorf("expected 2 samples, saw %v", count)
+	}
+	expected := []struct {
+		latency uint32
+		kind    latencyOpKind
+	}{
+		{150, latencyOpQuery},
+		{1<<32 - 1, latencyOpInsert},
+	}
+	for i, e := range expected {
+		sample := buf[latencyDatagramHeaderSize+i*latencySampleSize:]
+		if at := int64(binary.BigEndian.Uint64(sample)); at != playedAt.UnixNano() {
+			t.Errorf("sample %v: expected time %v, saw %v", i, playedAt.UnixNano(), at)
+		}
+		if latency := binary.BigEndian.Uint32(sample[8:]); latency != e.latency {
+			t.Errorf("sample %v: expected latency %v, saw %v", i, e.latency, latency)
+		}
+		if kind := latencyOpKind(sample[12]); kind != e.kind {
+			t.Errorf("sample %v: expected op kind %v, saw %v", i, e.kind, kind)
+		}
+	}
+}
+
+func TestUDPLatencyRecorderFlushesPeriodically(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	recorder, err := newUDPLatencyRecorder(listener.LocalAddr().String(), 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+	playedAt := time.Now()
+	recorder.RecordStat(&OpStat{OpType: "op_msg", Command: "find", PlayedAt: &playedAt, LatencyMicros: 150})
+
+	// the partial datagram is sent without another op being recorded
+	buf := make([]byte, latencyDatagramMaxSize)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("error reading datagram: %v", err)
+	}
+	if n != latencyDatagramHeaderSize+latencySampleSize {
+		t.Errorf("expected datagram with 1 sample, saw %v bytes", n)
+	}
+}
@@ -7,8 +7,10 @@
 package mongoreplay
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"sync"
 )
 
 const (
@@ -69,3 +71,43 @@ func (lw *logWrapper) Logv(minVerb int, msg string) {
 func (lw *logWrapper) isInVerbosity(minVerb int) bool {
 	return minVerb <= lw.verbosity
 }
+
+// logFile is the file the log is written to when it isn't written to
+// stderr. It is reopened by reopenLogFile, so that it can be rotated.
+var logFile struct {
+	sync.Mutex
+	path string
+	file *os.File
+}
+
+// setLogFile appends the log to the file at path, creating it if needed.
+func setLogFile(path string) error {
+	logFile.Lock()
+	defer logFile.Unlock()
+	logFile.path = path
+	return openLogFileLocked()
+}
+
+// reopenLogFile reopens the file the log is written to, after it has been
+// moved away by log rotation.
+func reopenLogFile() error {
+	logFile.Lock()
+	defer logFile.Unlock()
+	if logFile.path == "" {
+		return nil
+	}
+	return openLogFileLocked()
+}
+
+func openLogFileLocked() error {
+	file, err := os.OpenFile(logFile.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening log file: %v", err)
+	}
+	logger.SetOutput(file)
+	if logFile.file != nil {
+		logFile.file.Close()
+	}
+	logFile.file = file
+	return nil
+}
@@ -0,0 +1,396 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// longRunningOpRows is the number of long running ops logged when playback
+// finishes.
+const longRunningOpRows = 20
+
+// inFlightOp is an op being played, with the recorded op it was played from.
+type inFlightOp struct {
+	connectionNum int64
+	order         int64
+	seen          time.Time
+	ns            string
+	command       string
+	startedAt     time.Time
+	// tag is the comment the op is played with, if it is tagged.
+	tag string
+
+	// flagged is set, atomically, once the op is flagged as long running
+	// as record, which is guarded by the watchdog.
+	flagged int32
+	record  *LongRunningOp
+}
+
+// LongRunningOp is a replayed op which currentOp saw running on the server
+// for longer than --longRunningOps.
+type LongRunningOp struct {
+	ConnectionNum int64
+	Order         int64
+	Seen          time.Time
+	Ns            string
+	Command       string
+	PlanSummary   string
+	// Running is the longest time currentOp saw the op running for, and
+	// Latency the time the op took to be played once it completed.
+	Running time.Duration
+	Latency time.Duration
+}
+
+// currentOpEntry is the part of an op reported by currentOp which is used
+// to find the replayed op it was played from.
+type currentOpEntry struct {
+	OpID             interface{} `bson:"opid"`
+	Op               string      `bson:"op"`
+	Ns               string      `bson:"ns"`
+	Command          bson.D      `bson:"command"`
+	MicrosecsRunning int64       `bson:"microsecs_running"`
+	PlanSummary      string      `bson:"planSummary"`
+}
+
+// opWatchdog samples currentOp on the server played against every
+// --currentOpInterval seconds, flagging the replayed ops which have been
+// running for longer than --longRunningOps. When tag is set, the commands
+// are played with a comment naming the recorded op they were played from,
+// as "mongoreplay:<connection>:<order>", which currentOp reports. The other
+// ops are matched to the ops in flight by their namespace, their command and
+// when they started.
+type opWatchdog struct {
+	session   *mgo.Session
+	threshold time.Duration
+	interval  time.Duration
+	tag       bool
+
+	// inFlight holds the ops in flight by their tag, or by a key of their
+	// own if they are untagged, so that tracking them takes no lock shared
+	// by every connection.
+	inFlight sync.Map
+	nextID   int64
+
+	sync.Mutex
+	// flagged holds the long running ops, and byOpID the same ops by the
+	// opid currentOp reports them under.
+	flagged []*LongRunningOp
+	byOpID  map[string]*LongRunningOp
+	done    chan struct{}
+}
+
+func newOpWatchdog(session *mgo.Session, threshold, interval time.Duration) *opWatchdog {
+	return &opWatchdog{
+		session:   session,
+		threshold: threshold,
+		interval:  interval,
+		byOpID:    map[string]*LongRunningOp{},
+		done:      make(chan struct{}),
+	}
+}
+
+// track marks the op as in flight from now, tagging it if the watchdog tags
+// ops, and returns the function which marks it as completed.
+func (watchdog *opWatchdog) track(op *RecordedOp, parsedOp Op) func() {
+	inFlight := &inFlightOp{
+		connectionNum: op.SeenConnectionNum,
+		order:         op.Order,
+		ns:            namespaceOf(parsedOp),
+		command:       commandNameOf(parsedOp),
+		startedAt:     time.Now(),
+	}
+	if op.Seen != nil {
+		inFlight.seen = op.Seen.Time
+	}
+	var key interface{} = atomic.AddInt64(&watchdog.nextID, 1)
+	if watchdog.tag {
+		tag := fmt.Sprintf("%v%v:%v", opTagPrefix, op.SeenConnectionNum, op.Order)
+		tagged, err := tagOp(parsedOp, tag)
+		if err != nil {
+			toolDebugLogger.Logvf(DebugLow, "Error tagging op %v of connection %v: %v", op.Order, op.SeenConnectionNum, err)
+		}
+		if tagged {
+			inFlight.tag, key = tag, tag
+		}
+	}
+	watchdog.inFlight.Store(key, inFlight)
+	return func() {
+		watchdog.inFlight.CompareAndDelete(key, inFlight)
+		if atomic.LoadInt32(&inFlight.flagged) != 0 {
+			watchdog.Lock()
+			inFlight.record.Latency = time.Since(inFlight.startedAt)
+			watchdog.Unlock()
+		}
+	}
+}
+
+// opTagPrefix starts the comments ops are tagged with.
+const opTagPrefix = "mongoreplay:"
+
+// tagOp sets the comment of a command, or the $comment of a legacy query,
+// returning whether it was set. Ops which already carry a comment are left
+// untouched, as are the handshakes, the getMores, whose comments currentOp
+// doesn't report, and the legacy writes, which can't carry one.
+func tagOp(op Op, tag string) (bool, error) {
+	if IsDriverOp(op) {
+		return false, nil
+	}
+	switch commandNameOf(op) {
+	case "getMore", "getmore":
+		return false, nil
+	}
+	switch castOp := op.(type) {
+	case *MsgOp:
+		payload, sectionIx, err := fetchPayload0Data(castOp.Sections)
+		if err != nil {
+			return false, err
+		}
+		body, err := bsonToD(payload)
+		if err != nil || len(body) == 0 {
+			return false, err
+		}
+		if _, ok := FindValueByKey("comment", &body); ok {
+			return false, nil
+		}
+		raw, err := dToRaw(setDocField(body, "comment", tag))
+		if err != nil {
+			return false, err
+		}
+		castOp.Sections[sectionIx].Data = raw
+		return true, nil
+	case *QueryOp:
+		query, wrapper, err := unwrapQuery(castOp.Query)
+		if err != nil {
+			return false, err
+		}
+		if !strings.HasSuffix(castOp.Collection, ".$cmd") {
+			if _, ok := FindValueByKey("$comment", &wrapper); ok {
+				return false, nil
+			}
+			if wrapper == nil {
+				wrapper = bson.D{{Name: "$query", Value: query}}
+			}
+			castOp.Query = setDocField(wrapper, "$comment", tag)
+			return true, nil
+		}
+		if len(query) == 0 {
+			return false, nil
+		}
+		if _, ok := FindValueByKey("comment", &query); ok {
+			return false, nil
+		}
+		query = setDocField(query, "comment", tag)
+		if wrapper != nil {
+			wrapper[0].Value = query
+			castOp.Query = wrapper
+		} else {
+			castOp.Query = query
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// run samples currentOp every interval until ctx is done.
+func (watchdog *opWatchdog) run(ctx context.Context) {
+	defer close(watchdog.done)
+	session := watchdog.session.Copy()
+	defer session.Close()
+	session.SetSocketTimeout(serverStatusTimeout)
+	ticker := time.NewTicker(watchdog.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var result struct {
+			Inprog []currentOpEntry `bson:"inprog"`
+		}
+		command := bson.D{
+			{Name: "currentOp", Value: 1},
+			{Name: "active", Value: true},
+			{Name: "microsecs_running", Value: bson.M{"$gte": int64(watchdog.threshold / time.Microsecond)}},
+		}
+		if err := session.DB("admin").Run(command, &result); err != nil {
+			toolDebugLogger.Logvf(DebugLow, "Error running currentOp: %v", err)
+			continue
+		}
+		watchdog.observe(time.Now(), result.Inprog)
+	}
+}
+
+// wait waits for run to return.
+func (watchdog *opWatchdog) wait() {
+	<-watchdog.done
+}
+
+// observe flags the ops in flight which the entries reported by currentOp at
+// the given time were played from, logging those flagged for the first time.
+func (watchdog *opWatchdog) observe(at time.Time, entries []currentOpEntry) {
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	for _, entry := range entries {
+		running := time.Duration(entry.MicrosecsRunning) * time.Microsecond
+		if running < watchdog.threshold {
+			continue
+		}
+		opID := fmt.Sprint(entry.OpID)
+		if flagged, ok := watchdog.byOpID[opID]; ok {
+			if running > flagged.Running {
+				flagged.Running = running
+			}
+			continue
+		}
+		inFlight := watchdog.match(entry, at.Add(-running))
+		if inFlight == nil {
+			continue
+		}
+		flagged := &LongRunningOp{
+			ConnectionNum: inFlight.connectionNum,
+			Order:         inFlight.order,
+			Seen:          inFlight.seen,
+			Ns:            inFlight.ns,
+			Command:       inFlight.command,
+			PlanSummary:   entry.PlanSummary,
+			Running:       running,
+		}
+		inFlight.record = flagged
+		atomic.StoreInt32(&inFlight.flagged, 1)
+		watchdog.flagged = append(watchdog.flagged, flagged)
+		watchdog.byOpID[opID] = flagged
+		userInfoLogger.Logvf(Always, "Warning: op %v of connection %v (%v on %v) has been running on the server for %v",
+			flagged.Order, flagged.ConnectionNum, describeLongRunningOp(flagged), flagged.Ns, running)
+	}
+}
+
+// match returns the op in flight which the entry was played from, or nil if
+// there is none: the op tagged with the entry's comment or, if it has none,
+// the untagged op which is most likely to have been played from it, given
+// that the server started it at startedAt. That is the op of the same
+// namespace and command, or failing that of the same namespace or command
+// in the same database, which started closest to it. Ops already matched to
+// another entry aren't matched again.
+func (watchdog *opWatchdog) match(entry currentOpEntry, startedAt time.Time) *inFlightOp {
+	if comment, _ := FindValueByKey("comment", &entry.Command); comment != nil {
+		if tag, ok := comment.(string); ok && strings.HasPrefix(tag, opTagPrefix) {
+			if value, ok := watchdog.inFlight.Load(tag); ok {
+				if inFlight := value.(*inFlightOp); atomic.LoadInt32(&inFlight.flagged) == 0 {
+					return inFlight
+				}
+			}
+			return nil
+		}
+	}
+	command := entry.Op
+	if len(entry.Command) > 0 {
+		command = entry.Command[0].Name
+	}
+	db, _ := splitNamespace(entry.Ns)
+	var best *inFlightOp
+	var bestScore int
+	var bestDistance time.Duration
+	watchdog.inFlight.Range(func(_, value interface{}) bool {
+		inFlight := value.(*inFlightOp)
+		if inFlight.tag != "" || atomic.LoadInt32(&inFlight.flagged) != 0 {
+			return true
+		}
+		if inFlightDB, _ := splitNamespace(inFlight.ns); inFlightDB != db {
+			return true
+		}
+		score := 0
+		if inFlight.ns == entry.Ns {
+			score += 2
+		}
+		if inFlight.command != "" && inFlight.command == command {
+			score++
+		}
+		if score == 0 {
+			return true
+		}
+		distance := inFlight.startedAt.Sub(startedAt)
+		if distance < 0 {
+			distance = -distance
+		}
+		if score > bestScore || (score == bestScore && distance < bestDistance) {
+			best, bestScore, bestDistance = inFlight, score, distance
+		}
+		return true
+	})
+	return best
+}
+
+func describeLongRunningOp(op *LongRunningOp) string {
+	if op.Command == "" {
+		return "legacy op"
+	}
+	return op.Command
+}
+
+// LongRunningOps returns the ops flagged so far, longest running first.
+func (watchdog *opWatchdog) LongRunningOps() []*LongRunningOp {
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	ops := append([]*LongRunningOp{}, watchdog.flagged...)
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].Running != ops[j].Running {
+			return ops[i].Running > ops[j].Running
+		}
+		if ops[i].ConnectionNum != ops[j].ConnectionNum {
+			return ops[i].ConnectionNum < ops[j].ConnectionNum
+		}
+		return ops[i].Order < ops[j].Order
+	})
+	return ops
+}
+
+// formatLongRunningOpTable lays out at most rows of the long running ops.
+func formatLongRunningOpTable(ops []*LongRunningOp, rows int) string {
+	out := &bytes.Buffer{}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "running(ms)\tlatency(ms)\tconnection\torder\tseen\tcommand\tns\tplan\t")
+	for i, op := range ops {
+		if i == rows {
+			break
+		}
+		latency := "-"
+		if op.Latency > 0 {
+			latency = fmt.Sprint(int64(op.Latency / time.Millisecond))
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n", int64(op.Running/time.Millisecond), latency, op.ConnectionNum,
+			op.Order, op.Seen.Format(time.RFC3339), describeLongRunningOp(op), op.Ns, op.PlanSummary)
+	}
+	w.Flush()
+	return out.String()
+}
+
+// logSummary logs the ops which ran for longer than the threshold, longest
+// running first.
+func (watchdog *opWatchdog) logSummary() {
+	ops := watchdog.LongRunningOps()
+	if len(ops) == 0 {
+		return
+	}
+	userInfoLogger.Logvf(Always, "%v replayed ops ran on the server for longer than %v:\n%v",
+		len(ops), watchdog.threshold, formatLongRunningOpTable(ops, longRunningOpRows))
+	if len(ops) > longRunningOpRows {
+		userInfoLogger.Logvf(Always, "and %v more", len(ops)-longRunningOpRows)
+	}
+}
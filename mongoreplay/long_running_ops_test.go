@@ -0,0 +1,167 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// inFlightOpAt returns the op the watchdog holds in flight under key.
+func inFlightOpAt(t *testing.T, watchdog *opWatchdog, key interface{}) *inFlightOp {
+	value, ok := watchdog.inFlight.Load(key)
+	if !ok {
+		t.Fatalf("no op in flight under %v", key)
+	}
+	return value.(*inFlightOp)
+}
+
+// numInFlight returns the number of ops the watchdog holds in flight.
+func numInFlight(watchdog *opWatchdog) int {
+	n := 0
+	watchdog.inFlight.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func TestOpWatchdog(t *testing.T) {
+	watchdog := newOpWatchdog(nil, time.Second, time.Second)
+	seen := time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC)
+	track := func(connectionNum, order int64, doc bson.D) func() {
+		op := msgOpWithDoc(t, "test", doc)
+		return watchdog.track(&RecordedOp{SeenConnectionNum: connectionNum, Order: order, Seen: &PreciseTime{seen}}, &op)
+	}
+	doneFind := track(1, 10, bson.D{{"find", "c"}})
+	track(2, 20, bson.D{{"aggregate", "c"}})
+	track(3, 30, bson.D{{"find", "other"}})
+	// the op started last is the one the server started last
+	inFlightOpAt(t, watchdog, int64(1)).startedAt = seen.Add(-5 * time.Second)
+	inFlightOpAt(t, watchdog, int64(2)).startedAt = seen.Add(-2 * time.Second)
+	inFlightOpAt(t, watchdog, int64(3)).startedAt = seen.Add(-2 * time.Second)
+
+	watchdog.observe(seen, []currentOpEntry{
+		{OpID: 100, Op: "command", Ns: "test.c", Command: bson.D{{"find", "c"}}, MicrosecsRunning: 5000000, PlanSummary: "COLLSCAN"},
+		{OpID: 101, Op: "command", Ns: "test.c", Command: bson.D{{"aggregate", "c"}}, MicrosecsRunning: 2000000},
+		// ops below the threshold and of other clients aren't flagged
+		{OpID: 102, Op: "command", Ns: "test.other", Command: bson.D{{"find", "other"}}, MicrosecsRunning: 500000},
+		{OpID: 103, Op: "command", Ns: "admin.$cmd", Command: bson.D{{"fsync", 1}}, MicrosecsRunning: 9000000},
+	})
+	// a later sample of an op already flagged updates its running time
+	watchdog.observe(seen.Add(time.Second), []currentOpEntry{
+		{OpID: 100, Op: "command", Ns: "test.c", Command: bson.D{{"find", "c"}}, MicrosecsRunning: 6000000},
+	})
+	doneFind()
+
+	ops := watchdog.LongRunningOps()
+	if len(ops) != 2 {
+		t.Fatalf("expected 2 long running ops, got %v", len(ops))
+	}
+	if ops[0].ConnectionNum != 1 || ops[0].Order != 10 || ops[0].Command != "find" || ops[0].Ns != "test.c" ||
+		ops[0].Running != 6*time.Second || ops[0].PlanSummary != "COLLSCAN" || ops[0].Latency == 0 {
+		t.Errorf("unexpected long running find: %+v", ops[0])
+	}
+	if ops[1].ConnectionNum != 2 || ops[1].Order != 20 || ops[1].Command != "aggregate" || ops[1].Latency != 0 {
+		t.Errorf("unexpected long running aggregate: %+v", ops[1])
+	}
+	if numInFlight(watchdog) != 2 {
+		t.Errorf("expected the completed find to no longer be in flight")
+	}
+
+	table := formatLongRunningOpTable(ops, 1)
+	lines := strings.Split(strings.TrimSpace(table), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "6000 ") || !strings.Contains(lines[1], "COLLSCAN") {
+		t.Errorf("unexpected table:\n%v", table)
+	}
+}
+
+func TestOpWatchdogMatchesClosestStart(t *testing.T) {
+	watchdog := newOpWatchdog(nil, time.Second, time.Second)
+	now := time.Now()
+	for i := int64(1); i <= 3; i++ {
+		op := msgOpWithDoc(t, "test", bson.D{{"find", "c"}})
+		watchdog.track(&RecordedOp{SeenConnectionNum: i}, &op)
+		inFlightOpAt(t, watchdog, i).startedAt = now.Add(-time.Duration(i) * time.Second)
+	}
+	entry := currentOpEntry{OpID: 1, Ns: "test.c", Command: bson.D{{"find", "c"}}, MicrosecsRunning: 2100000}
+	watchdog.observe(now, []currentOpEntry{entry})
+	// the same op is never matched to two entries
+	entry.OpID = 2
+	watchdog.observe(now, []currentOpEntry{entry})
+	if len(watchdog.flagged) == 0 || watchdog.flagged[0].ConnectionNum != 2 {
+		t.Errorf("expected the op started 2s ago to be matched first")
+	}
+	if len(watchdog.flagged) != 2 {
+		t.Errorf("expected 2 ops to be flagged, got %v", len(watchdog.flagged))
+	}
+}
+
+func TestOpWatchdogMatchesTags(t *testing.T) {
+	watchdog := newOpWatchdog(nil, time.Second, time.Second)
+	watchdog.tag = true
+	now := time.Now()
+	var ops []MsgOp
+	for i := int64(1); i <= 3; i++ {
+		op := msgOpWithDoc(t, "test", bson.D{{"find", "c"}})
+		watchdog.track(&RecordedOp{SeenConnectionNum: i, Order: 10 * i}, &op)
+		ops = append(ops, op)
+	}
+	// the op started closest to the entry isn't the one it was played from
+	inFlightOpAt(t, watchdog, "mongoreplay:2:20").startedAt = now.Add(-2 * time.Second)
+	inFlightOpAt(t, watchdog, "mongoreplay:3:30").startedAt = now.Add(-5 * time.Second)
+
+	payload, _, err := fetchPayload0Data(ops[2].Sections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := bsonToD(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment, _ := FindValueByKey("comment", &body); comment != "mongoreplay:3:30" {
+		t.Fatalf("expected the command to be tagged, got %v", body)
+	}
+	watchdog.observe(now, []currentOpEntry{{OpID: 1, Ns: "test.c", Command: body, MicrosecsRunning: 2000000}})
+	if len(watchdog.flagged) != 1 || watchdog.flagged[0].ConnectionNum != 3 || watchdog.flagged[0].Order != 30 {
+		t.Errorf("expected the tagged op to be flagged, got %+v", watchdog.flagged)
+	}
+
+	// ops already carrying a comment, and getMores, aren't tagged
+	type testCase struct {
+		name string
+		doc  bson.D
+	}
+	cases := []testCase{
+		{name: "comment", doc: bson.D{{"find", "c"}, {"comment", "app"}}},
+		{name: "getMore", doc: bson.D{{"getMore", int64(1)}, {"collection", "c"}}},
+		{name: "hello", doc: bson.D{{"hello", 1}}},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		op := msgOpWithDoc(t, "test", c.doc)
+		if tagged, err := tagOp(&op, "mongoreplay:1:1"); tagged || err != nil {
+			t.Errorf("expected the op not to be tagged, got %v (%v)", tagged, err)
+		}
+	}
+
+	t.Log("Tagging a legacy query")
+	query := &QueryOp{}
+	query.Collection = "test.c"
+	query.Query = bson.D{{"a", 1}}
+	if tagged, err := tagOp(query, "mongoreplay:1:1"); !tagged || err != nil {
+		t.Fatalf("expected the query to be tagged, got %v", err)
+	}
+	expected := bson.D{{"$query", bson.D{{"a", 1}}}, {"$comment", "mongoreplay:1:1"}}
+	if !reflect.DeepEqual(query.Query, expected) {
+		t.Errorf("expected %v, got %v", expected, query.Query)
+	}
+}
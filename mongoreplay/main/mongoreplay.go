@@ -19,6 +19,9 @@ const (
 	ExitOk       = 0
 	ExitError    = 1
 	ExitNonFatal = 3
+	// ExitThresholdExceeded is used when playback completes but fails one of
+	// the thresholds set on its results
+	ExitThresholdExceeded = 4
 	// Go reserves exit code 2 for its own use
 )
 
@@ -26,6 +29,8 @@ func main() {
 	versionOpts := mongoreplay.VersionOptions{}
 	versionFlagParser := flags.NewParser(&versionOpts, flags.Default)
 	versionFlagParser.Options = flags.IgnoreUnknown
+	// completions are listed by the main parser below
+	versionFlagParser.CompletionHandler = func([]flags.Completion) {}
 	_, err := versionFlagParser.Parse()
 	if err != nil {
 		os.Exit(ExitError)
@@ -44,28 +49,15 @@ func main() {
 
 	var parser = flags.NewParser(&opts, flags.Default)
 
-	_, err = parser.AddCommand("play", "Play captured traffic against a mongodb instance", "",
-		&mongoreplay.PlayCommand{GlobalOpts: &opts})
+	err = mongoreplay.AddCommands(parser, &opts)
 	if err != nil {
 		panic(err)
 	}
 
-	_, err = parser.AddCommand("record", "Convert network traffic into mongodb queries", "",
-		&mongoreplay.RecordCommand{GlobalOpts: &opts})
+	err = mongoreplay.LoadConfigFile(parser, os.Args[1:])
 	if err != nil {
-		panic(err)
-	}
-
-	_, err = parser.AddCommand("monitor", "Inspect live or pre-recorded mongodb traffic", "",
-		&mongoreplay.MonitorCommand{GlobalOpts: &opts})
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = parser.AddCommand("filter", "Filter playback file", "",
-		&mongoreplay.FilterCommand{GlobalOpts: &opts})
-	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(ExitError)
 	}
 
 	_, err = parser.Parse()
@@ -74,6 +66,8 @@ func main() {
 		switch err.(type) {
 		case mongoreplay.ErrPacketsDropped:
 			os.Exit(ExitNonFatal)
+		case mongoreplay.ErrThresholdExceeded:
+			os.Exit(ExitThresholdExceeded)
 		default:
 			os.Exit(ExitError)
 		}
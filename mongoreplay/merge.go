@@ -0,0 +1,350 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// MergeCommand stores settings for the mongoreplay 'merge' subcommand
+type MergeCommand struct {
+	GlobalOpts *Options `no-flag:"true"`
+	OutFile    string   `short:"o" long:"outputFile" description:"path to the playback file to write the merged ops to" required:"yes"`
+	Offsets    []string `long:"offset" description:"clock offset added to the times the ops of one of the playback files were seen, as <file>=<duration> (e.g. 'mongos2.playback=-1.5s'), to correct the clock skew between the hosts they were recorded on. May be repeated"`
+	Gzip       bool     `long:"gzip" description:"decompress gzipped input and compress the output"`
+
+	EncryptionOptions `group:"encryption options"`
+
+	offsets []time.Duration
+}
+
+// ValidateParams validates the settings described in the MergeCommand struct.
+func (merge *MergeCommand) ValidateParams(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("must specify at least two playback files to merge")
+	}
+	if countStdStreams(args) > 1 {
+		return fmt.Errorf("only one of the playback files merged can be read from stdin")
+	}
+	merge.offsets = make([]time.Duration, len(args))
+	for _, setting := range merge.Offsets {
+		i := strings.LastIndex(setting, "=")
+		if i < 0 {
+			return fmt.Errorf("Invalid setting for --offset: '%v' is not <file>=<duration>", setting)
+		}
+		offset, err := time.ParseDuration(setting[i+1:])
+		if err != nil {
+			return fmt.Errorf("Invalid setting for --offset: %v", err)
+		}
+		found := false
+		for j, file := range args {
+			if file == setting[:i] {
+				merge.offsets[j] = offset
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Invalid setting for --offset: %v is not one of the playback files merged", setting[:i])
+		}
+	}
+	return nil
+}
+
+// Execute runs the program for the 'merge' subcommand
+func (merge *MergeCommand) Execute(args []string) error {
+	err := merge.ValidateParams(args)
+	if err != nil {
+		return err
+	}
+	merge.GlobalOpts.SetLogging()
+	if err := merge.setTapeEncryption(); err != nil {
+		return err
+	}
+
+	readers := make([]*PlaybackFileReader, len(args))
+	driverOpsFiltered := true
+	for i, file := range args {
+		readers[i], err = NewPlaybackFileReader(file, merge.Gzip)
+		if err != nil {
+			return fmt.Errorf("error opening %v: %v", file, err)
+		}
+		defer readers[i].Close()
+		driverOpsFiltered = driverOpsFiltered && readers[i].metadata.DriverOpsFiltered
+	}
+	writer, err := NewPlaybackFileWriter(merge.OutFile, driverOpsFiltered, merge.Gzip)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	count, err := Merge(readers, merge.offsets, writer)
+	if err != nil {
+		return err
+	}
+	userInfoLogger.Logvf(Always, "Merged %v ops from %v playback files into %v", count, len(args), merge.OutFile)
+	return nil
+}
+
+// mergeInput is the op each playback file being merged is at.
+type mergeInput struct {
+	op     *RecordedOp
+	index  int
+	ops    <-chan *RecordedOp
+	offset time.Duration
+	// connections and cursors map the connection numbers and cursor ids of
+	// the playback file to those of the merged file.
+	connections map[int64]int64
+	cursors     map[int64]int64
+}
+
+// mergeQueue orders the playback files being merged by the time the op each
+// is at was seen, and those seen at the same time by the order in which the
+// files were given.
+type mergeQueue []*mergeInput
+
+func (q mergeQueue) Len() int {
+	return len(q)
+}
+
+func (q mergeQueue) Less(i, j int) bool {
+	if q[i].op.Seen.Equal(q[j].op.Seen.Time) {
+		return q[i].index < q[j].index
+	}
+	return q[i].op.Seen.Before(q[j].op.Seen.Time)
+}
+
+func (q mergeQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *mergeQueue) Push(input interface{}) {
+	*q = append(*q, input.(*mergeInput))
+}
+
+func (q *mergeQueue) Pop() interface{} {
+	i := len(*q) - 1
+	input := (*q)[i]
+	*q = (*q)[:i]
+	return input
+}
+
+// next moves the input to its next op, with its seen time shifted by the
+// offset of the input, returning false once the input has no more ops.
+func (input *mergeInput) next() bool {
+	op, ok := <-input.ops
+	if !ok {
+		return false
+	}
+	op.Seen = &PreciseTime{op.Seen.Add(input.offset)}
+	input.op = op
+	return true
+}
+
+// Merge interleaves the ops of the playback files of readers, each shifted
+// by its offset, into writer by the time they were seen, and ends it with the
+// sum of their capture stats. The connections and cursors of each playback
+// file are renumbered so that they remain distinct in the merged file, where
+// the cursors of files recorded against different servers could otherwise
+// have the same ids. It returns the number of ops written.
+func Merge(readers []*PlaybackFileReader, offsets []time.Duration, writer *PlaybackFileWriter) (int64, error) {
+	var queue mergeQueue
+	var errChans []<-chan error
+	for i, reader := range readers {
+		ops, errChan := reader.OpChan(1)
+		errChans = append(errChans, errChan)
+		input := &mergeInput{
+			index:       i,
+			ops:         ops,
+			offset:      offsets[i],
+			connections: map[int64]int64{},
+			cursors:     map[int64]int64{},
+		}
+		if input.next() {
+			queue = append(queue, input)
+		}
+	}
+	heap.Init(&queue)
+
+	var count, connectionNum, cursorID int64
+	var writeErr error
+	for queue.Len() > 0 {
+		input := queue[0]
+		op := input.op
+		merged, ok := input.connections[op.SeenConnectionNum]
+		if !ok {
+			connectionNum++
+			merged = connectionNum
+			input.connections[op.SeenConnectionNum] = merged
+		}
+		op.SeenConnectionNum = merged
+		if writeErr == nil {
+			writeErr = rewriteCursorIDs(op, func(id int64) int64 {
+				merged, ok := input.cursors[id]
+				if !ok {
+					cursorID++
+					merged = cursorID
+					input.cursors[id] = merged
+				}
+				return merged
+			})
+		}
+		if writeErr == nil {
+			if writeErr = writer.WriteRecordedOp(op); writeErr == nil {
+				count++
+			}
+		}
+		// the inputs are read to their end even after a write error, so
+		// that their goroutines return
+		if input.next() {
+			heap.Fix(&queue, 0)
+		} else {
+			heap.Pop(&queue)
+		}
+	}
+	if writeErr != nil {
+		return count, fmt.Errorf("error writing merged op: %v", writeErr)
+	}
+
+	var stats CaptureStats
+	haveStats := false
+	for i, errChan := range errChans {
+		if err := <-errChan; err != nil && err != io.EOF {
+			return count, fmt.Errorf("error reading %v: %v", readers[i].fname, err)
+		}
+		if readerStats := readers[i].CaptureStats(); readerStats != nil {
+			stats.add(readerStats)
+			haveStats = true
+		}
+	}
+	if haveStats {
+		return count, writer.WriteCaptureStats(stats)
+	}
+	return count, nil
+}
+
+// rewriteCursorIDs replaces the ids of the cursors created by the reply of op,
+// or used by its getMore or killCursors, with those returned by rewrite. 0,
+// which is no cursor, is kept. Compressed ops are rewritten uncompressed, and
+// OP_MSGs lose their checksum, which no longer matches.
+func rewriteCursorIDs(op *RecordedOp, rewrite func(int64) int64) error {
+	if op.EOF {
+		return nil
+	}
+	raw := op.RawOp
+	parsedOp, err := raw.Parse()
+	if err != nil {
+		return err
+	}
+	body := raw.Body
+	var offsets []int
+	switch parsed := parsedOp.(type) {
+	case *ReplyOp:
+		// the cursor id follows the flags
+		offsets = append(offsets, MsgHeaderLen+4)
+	case *GetMoreOp:
+		// the cursor id follows the namespace and the number to return
+		offsets = append(offsets, MsgHeaderLen+4+len(parsed.Collection)+1+4)
+	case *KillCursorsOp:
+		// the cursor ids follow their number
+		for i := range parsed.CursorIds {
+			offsets = append(offsets, MsgHeaderLen+8+8*i)
+		}
+	case *CommandGetMore:
+		// the arguments follow the database and the command name
+		start := MsgHeaderLen + len(parsed.Database) + 1 + len(parsed.CommandName) + 1
+		offsets = appendInt64FieldOffset(offsets, body, start, "getMore")
+	case *CommandReplyOp:
+		offsets = appendInt64FieldOffset(offsets, body, MsgHeaderLen, "cursor", "id")
+	case *MsgOpGetMore:
+		if start, ok := msgPayload0Offset(body); ok {
+			offsets = appendInt64FieldOffset(offsets, body, start, "getMore")
+		}
+	case *MsgOpReply:
+		if start, ok := msgPayload0Offset(body); ok {
+			offsets = appendInt64FieldOffset(offsets, body, start, "cursor", "id")
+		}
+	}
+
+	rewritten := false
+	for _, offset := range offsets {
+		if id := getInt64(body, offset); id != 0 {
+			SetInt64(body, offset, rewrite(id))
+			rewritten = true
+		}
+	}
+	if !rewritten {
+		return nil
+	}
+	if raw.Header.OpCode == OpCodeMessage {
+		if flags := uint32(getInt32(body, MsgHeaderLen)); flags&mgo.MsgFlagChecksumPresent != 0 {
+			SetInt32(body, MsgHeaderLen, int32(flags&^mgo.MsgFlagChecksumPresent))
+			body = body[:len(body)-4]
+			raw.Header.MessageLength = int32(len(body))
+			SetInt32(body, 0, raw.Header.MessageLength)
+		}
+	}
+	raw.Body = body
+	op.RawOp = raw
+	return nil
+}
+
+// msgPayload0Offset returns the offset in the body of an OP_MSG of the
+// document of its section of kind 0.
+func msgPayload0Offset(body []byte) (int, bool) {
+	end := len(body)
+	if uint32(getInt32(body, MsgHeaderLen))&mgo.MsgFlagChecksumPresent != 0 {
+		end -= 4
+	}
+	for offset := MsgHeaderLen + 4; offset+5 <= end; {
+		if body[offset] == byte(mgo.MsgPayload0) {
+			return offset + 1, true
+		}
+		// a document sequence is preceded by its size
+		offset += 1 + int(getInt32(body, offset+1))
+	}
+	return 0, false
+}
+
+// appendInt64FieldOffset appends to offsets the offset in body of the value
+// of the int64 field at path of the document at start, if it has one.
+func appendInt64FieldOffset(offsets []int, body []byte, start int, path ...string) []int {
+	if start+4 > len(body) {
+		return offsets
+	}
+	end := start + int(getInt32(body, start))
+	if end < start || end > len(body) {
+		return offsets
+	}
+	var elems bson.RawD
+	if err := bson.Unmarshal(body[start:end], &elems); err != nil {
+		return offsets
+	}
+	// each element is its kind, its name and its value
+	offset := start + 4
+	for _, elem := range elems {
+		offset += 1 + len(elem.Name) + 1
+		if elem.Name == path[0] {
+			// the kinds of 64-bit integers and of embedded documents
+			switch {
+			case len(path) == 1 && elem.Value.Kind == 0x12:
+				return append(offsets, offset)
+			case len(path) > 1 && elem.Value.Kind == 0x03:
+				return appendInt64FieldOffset(offsets, body, offset, path[1:]...)
+			}
+			return offsets
+		}
+		offset += len(elem.Value.Data)
+	}
+	return offsets
+}
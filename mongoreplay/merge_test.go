@@ -0,0 +1,206 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	if err := generator.generateInsertHelper("insert", 0, 6); err != nil {
+		t.Fatal(err)
+	}
+	close(generator.opChan)
+	var ops []*RecordedOp
+	for op := range generator.opChan {
+		ops = append(ops, op)
+	}
+
+	dir, err := ioutil.TempDir("", "mongoreplay-merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// each file holds three ops of connection 1, seen a second apart; the
+	// ops of the second file are seen 1.5s after those of the first, which
+	// its offset brings back to 0.5s
+	type file struct {
+		name   string
+		ops    []*RecordedOp
+		start  time.Duration
+		offset time.Duration
+		stats  CaptureStats
+	}
+	files := []file{
+		{name: "a.playback", ops: ops[:3], stats: CaptureStats{PacketsCaptured: 10}},
+		{name: "b.playback", ops: ops[3:], start: 1500 * time.Millisecond, offset: -time.Second,
+			stats: CaptureStats{PacketsCaptured: 20, PacketsDropped: 1}},
+	}
+	var readers []*PlaybackFileReader
+	var offsets []time.Duration
+	for _, f := range files {
+		name := filepath.Join(dir, f.name)
+		w, err := NewPlaybackFileWriter(name, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, op := range f.ops {
+			op.Seen = &PreciseTime{testTime.Add(f.start + time.Duration(i)*time.Second)}
+			op.SeenConnectionNum = 1
+			if err := w.WriteRecordedOp(op); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.WriteCaptureStats(f.stats); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		reader, err := NewPlaybackFileReader(name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, reader)
+		offsets = append(offsets, f.offset)
+	}
+
+	merged := filepath.Join(dir, "merged.playback")
+	w, err := NewPlaybackFileWriter(merged, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := Merge(readers, offsets, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if count != 6 {
+		t.Errorf("expected 6 ops to be merged, got %v", count)
+	}
+
+	type expectedOp struct {
+		requestID     int32
+		seen          time.Duration
+		connectionNum int64
+	}
+	expected := []expectedOp{
+		{ops[0].Header.RequestID, 0, 1},
+		{ops[3].Header.RequestID, 500 * time.Millisecond, 2},
+		{ops[1].Header.RequestID, time.Second, 1},
+		{ops[4].Header.RequestID, 1500 * time.Millisecond, 2},
+		{ops[2].Header.RequestID, 2 * time.Second, 1},
+		{ops[5].Header.RequestID, 2500 * time.Millisecond, 2},
+	}
+	reader, err := NewPlaybackFileReader(merged, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opChan, errChan := reader.OpChan(1)
+	var i int
+	for op := range opChan {
+		if i >= len(expected) {
+			t.Fatalf("expected %v ops, got more", len(expected))
+		}
+		e := expected[i]
+		if op.Header.RequestID != e.requestID || !op.Seen.Equal(testTime.Add(e.seen)) ||
+			op.SeenConnectionNum != e.connectionNum {
+			t.Errorf("expected op %v to be request %v seen at %v on connection %v, got request %v seen at %v on connection %v",
+				i, e.requestID, testTime.Add(e.seen), e.connectionNum, op.Header.RequestID, op.Seen.Time, op.SeenConnectionNum)
+		}
+		i++
+	}
+	if err := <-errChan; err != io.EOF {
+		t.Fatal(err)
+	}
+	stats := reader.CaptureStats()
+	if stats == nil || stats.PacketsCaptured != 30 || stats.PacketsDropped != 1 {
+		t.Errorf("expected the capture stats of both files to be summed, got %v", stats)
+	}
+}
+
+func TestMergeParams(t *testing.T) {
+	type testCase struct {
+		name    string
+		args    []string
+		offsets []string
+		ok      bool
+	}
+	cases := []testCase{
+		{name: "single file", args: []string{"a"}},
+		{name: "two files", args: []string{"a", "b"}, ok: true},
+		{name: "offset", args: []string{"a", "b"}, offsets: []string{"b=-1.5s"}, ok: true},
+		{name: "offset of a file with = in its name", args: []string{"a=1", "b"}, offsets: []string{"a=1=2ms"}, ok: true},
+		{name: "offset of an unknown file", args: []string{"a", "b"}, offsets: []string{"c=1s"}},
+		{name: "offset without a duration", args: []string{"a", "b"}, offsets: []string{"a"}},
+		{name: "invalid duration", args: []string{"a", "b"}, offsets: []string{"a=soon"}},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		merge := &MergeCommand{Offsets: c.offsets}
+		err := merge.ValidateParams(c.args)
+		if c.ok && err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else if !c.ok && err == nil {
+			t.Errorf("expected an error")
+		}
+	}
+}
+
+func TestRewriteCursorIDs(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	type testCase struct {
+		name     string
+		generate func() error
+	}
+	cases := []testCase{
+		{"reply", func() error { return generator.generateReply(1, 42) }},
+		{"getmore", func() error { return generator.generateGetMore(42, 0) }},
+		{"killcursors", func() error { return generator.generateKillCursors([]int64{42, 0}) }},
+		{"command getMore", func() error { return generator.generateCommandGetMore(42, 0) }},
+		{"command reply", func() error { return generator.generateCommandReply(1, 42) }},
+		{"op_msg getMore", func() error { return generator.generateMsgOpGetMore(42, 0) }},
+		{"op_msg reply", func() error { return generator.generateMsgOpReply(1, 42) }},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		if err := c.generate(); err != nil {
+			t.Fatal(err)
+		}
+		op := <-generator.opChan
+		if err := rewriteCursorIDs(op, func(id int64) int64 { return id + 1000 }); err != nil {
+			t.Fatal(err)
+		}
+		parsedOp, err := op.RawOp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		switch parsed := parsedOp.(type) {
+		case cursorsRewriteable:
+			ids, err = parsed.getCursorIDs()
+		case Replyable:
+			var id int64
+			id, err = parsed.getCursorID()
+			ids = []int64{id}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) == 0 || ids[0] != 1042 {
+			t.Errorf("expected cursor 42 to be rewritten to 1042, got %v", ids)
+		}
+		if len(ids) > 1 && ids[1] != 0 {
+			t.Errorf("expected cursor 0 to be kept, got %v", ids[1])
+		}
+	}
+}
@@ -89,6 +89,7 @@ var goodOpCode = map[int32]bool{
 	2010: true, //OP_COMMAND        A new wire protocol message representing a command request
 	2011: true, //OP_COMMANDREPLY   A new wire protocol message representing a command
 	2012: true, //OP_COMPRESSED     Compressed op
+	2013: true, //OP_MSG            Extensible message format of commands and their replies
 }
 
 // LooksReal does a best efffort to detect if a MsgHeadr is not invalid
@@ -107,6 +108,78 @@ func (m *MsgHeader) LooksReal() bool {
 	return goodOpCode[int32(m.OpCode)]
 }
 
+// looksLikeMessage does a best effort to detect if b starts with a wire
+// protocol message. Besides its header, the first fields of its body are
+// checked as far as they are in b, since the data searched for a message
+// when out of sync may hold bytes that look like a header by chance.
+func looksLikeMessage(b []byte) bool {
+	var header MsgHeader
+	header.FromWire(b)
+	if !header.LooksReal() {
+		return false
+	}
+	body := b[MsgHeaderLen:]
+	if bodyLen := int(header.MessageLength) - MsgHeaderLen; len(body) > bodyLen {
+		body = body[:bodyLen]
+	}
+	switch header.OpCode {
+	case OpCodeReply:
+		// responseFlags, cursorID, startingFrom and numberReturned come
+		// before the documents
+		if len(body) < 20 {
+			return true
+		}
+		numberReturned := getInt32(body, 16)
+		switch {
+		case numberReturned < 0:
+			return false
+		case numberReturned == 0:
+			return header.MessageLength == MsgHeaderLen+20
+		case len(body) >= 24:
+			docLen := getInt32(body, 20)
+			return docLen >= 5 && docLen <= header.MessageLength-MsgHeaderLen-20
+		}
+	case OpCodeMessage:
+		// the required flag bits unknown to the server must be unset, and
+		// the first section is of kind 0, 1 or 2
+		if len(body) < 5 {
+			return true
+		}
+		return uint32(getInt32(body, 0))&0xfffc == 0 && body[4] <= 2
+	case OpCodeQuery, OpCodeInsert, OpCodeUpdate, OpCodeDelete, OpCodeGetMore:
+		return len(body) < 4 || looksLikeNamespace(body[4:])
+	case OpCodeKillCursors:
+		if len(body) < 8 {
+			return true
+		}
+		return getInt32(body, 0) == 0 && MsgHeaderLen+8+8*int(getInt32(body, 4)) == int(header.MessageLength)
+	case OpCodeCompressed:
+		// originalOpcode, uncompressedSize and compressorId come first
+		if len(body) < 9 {
+			return true
+		}
+		return goodOpCode[getInt32(body, 0)] && body[8] <= 3
+	}
+	return true
+}
+
+// looksLikeNamespace returns whether b starts with a namespace, as far as it
+// is in b.
+func looksLikeNamespace(b []byte) bool {
+	dot := false
+	for i, c := range b {
+		switch {
+		case c == 0:
+			return i > 0 && dot
+		case c == '.':
+			dot = true
+		case c < 0x20 || c > 0x7e:
+			return false
+		}
+	}
+	return true
+}
+
 // String returns a string representation of the message header.
 // Useful for debugging.
 func (m *MsgHeader) String() string {
@@ -0,0 +1,182 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// mirrorLoggedDiffs is the number of ops whose replies differ between the
+// targets of a mirrored playback that are logged in full; the others are
+// only counted.
+const mirrorLoggedDiffs = 10
+
+// mirrorMaxPending is the number of replies of each target of a mirrored
+// playback kept waiting for that of the other target. Once it is reached,
+// the oldest is given up on and counted as played against its target only,
+// so that a target which falls behind or stops replying doesn't grow the
+// replies kept without bound.
+const mirrorMaxPending = 100000
+
+// teeOps sends every op received from in to both of the returned channels,
+// giving the second a copy of the op so that the two can be played
+// independently. Sending blocks until both channels have received the op,
+// so that neither target gets ahead of the other.
+func teeOps(ctx context.Context, in <-chan *RecordedOp) (<-chan *RecordedOp, <-chan *RecordedOp) {
+	outs := fanOutOps(ctx, in, 2)
+	return outs[0], outs[1]
+}
+
+// copyRecordedOp returns a copy of op which shares none of the state changed
+// while it is played.
+func copyRecordedOp(op *RecordedOp) *RecordedOp {
+	copied := *op
+	copied.RawOp.Body = append([]byte(nil), op.RawOp.Body...)
+	copied.PlayAt = nil
+	copied.PlayedAt = nil
+	return &copied
+}
+
+// mirrorComparator compares the replies received from the two targets of a
+// mirrored playback. Its sides implement the PostOpHook interface, one for
+// each target, and the replies are compared as soon as both have arrived.
+// The replies waiting for that of the other target are kept in the order
+// they arrived, of which at most maxPending are kept for each target.
+type mirrorComparator struct {
+	sync.Mutex
+	normalization *replyNormalization
+	pending       [2]map[replyTapeKey]*list.Element
+	arrivals      [2]*list.List
+	maxPending    int
+	unmatched     [2]int64
+	compared      int64
+	differing     int64
+	byName        map[string]int64
+}
+
+func newMirrorComparator(normalization *replyNormalization) *mirrorComparator {
+	return &mirrorComparator{
+		normalization: normalization,
+		pending:       [2]map[replyTapeKey]*list.Element{{}, {}},
+		arrivals:      [2]*list.List{list.New(), list.New()},
+		maxPending:    mirrorMaxPending,
+		byName:        map[string]int64{},
+	}
+}
+
+// mirrorSide is the PostOpHook of one of the targets of a mirrorComparator.
+type mirrorSide struct {
+	comparator *mirrorComparator
+	side       int
+}
+
+// side returns the PostOpHook receiving the replies of the first (0) or
+// second (1) target.
+func (comparator *mirrorComparator) side(side int) PostOpHook {
+	return mirrorSide{comparator, side}
+}
+
+func (side mirrorSide) AfterOp(op *RecordedOp, parsedOp Op, reply Replyable, err error) {
+	side.comparator.add(side.side, newReplyTapeEntry(op, parsedOp, reply, err))
+}
+
+// OpSkipped compares the ops skipped like those played, so that an op skipped
+// against both targets isn't counted as played against either only.
+func (side mirrorSide) OpSkipped(op *RecordedOp, parsedOp Op, reason error) {
+	side.comparator.add(side.side, newReplyTapeEntry(op, parsedOp, nil, reason))
+}
+
+// add keeps the entry until the reply of the other target arrives, then
+// compares the two. Once maxPending entries of side are kept, the oldest is
+// dropped.
+func (comparator *mirrorComparator) add(side int, entry *ReplyTapeEntry) {
+	comparator.Lock()
+	element, ok := comparator.pending[1-side][entry.key()]
+	if !ok {
+		if comparator.arrivals[side].Len() >= comparator.maxPending {
+			oldest := comparator.arrivals[side].Remove(comparator.arrivals[side].Front()).(*ReplyTapeEntry)
+			delete(comparator.pending[side], oldest.key())
+			comparator.unmatched[side]++
+		}
+		comparator.pending[side][entry.key()] = comparator.arrivals[side].PushBack(entry)
+		comparator.Unlock()
+		return
+	}
+	other := comparator.arrivals[1-side].Remove(element).(*ReplyTapeEntry)
+	delete(comparator.pending[1-side], entry.key())
+	comparator.Unlock()
+
+	first, second := other, entry
+	if side == 0 {
+		first, second = entry, other
+	}
+	differences := comparator.normalization.diffEntries(first, second)
+
+	comparator.Lock()
+	defer comparator.Unlock()
+	comparator.compared++
+	if len(differences) == 0 {
+		return
+	}
+	comparator.differing++
+	comparator.byName[entry.name()]++
+	if comparator.differing <= mirrorLoggedDiffs {
+		userInfoLogger.Logvf(Always, "Replies differ for op %v (connection %v) %v %v: %v", entry.key(),
+			entry.ConnectionNum, entry.name(), entry.Ns, formatReplyDifferences(differences))
+	} else if comparator.differing == mirrorLoggedDiffs+1 {
+		userInfoLogger.Logvf(Always, "More replies differ; only the number of differing ops will be reported")
+	}
+}
+
+func formatReplyDifferences(differences []replyDifference) string {
+	parts := make([]string, len(differences))
+	for i, difference := range differences {
+		parts[i] = fmt.Sprintf("%v: %v != %v", difference.Path,
+			formatReplyValue(difference.A), formatReplyValue(difference.B))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// summary describes the number of ops whose replies were compared and
+// differ, and of those which received a reply from only one target,
+// including those dropped while waiting for the other.
+func (comparator *mirrorComparator) summary(nameA, nameB string) string {
+	comparator.Lock()
+	defer comparator.Unlock()
+	summary := fmt.Sprintf("Compared %v replies: %v differ", comparator.compared, comparator.differing)
+	var names []string
+	for _, count := range sortedCounts(comparator.byName) {
+		names = append(names, fmt.Sprintf("%v %v", count.Name, count.Count))
+	}
+	if len(names) > 0 {
+		summary += fmt.Sprintf(" (%v)", strings.Join(names, ", "))
+	}
+	return summary + fmt.Sprintf(", %v played only against %v, %v only against %v",
+		int64(len(comparator.pending[0]))+comparator.unmatched[0], nameA,
+		int64(len(comparator.pending[1]))+comparator.unmatched[1], nameB)
+}
+
+// logMirrorSummary logs the latency percentiles and error rate of each
+// target of a mirrored playback, and the comparison of their replies.
+func logMirrorSummary(primary, mirror *ExecutionContext, comparator *mirrorComparator) {
+	primary.latencies.Lock()
+	mirror.latencies.Lock()
+	table := formatPercentileTable("target", map[string]*LatencyHistogram{
+		"host":       &primary.latencies.histogram,
+		"mirrorHost": &mirror.latencies.histogram,
+	})
+	mirror.latencies.Unlock()
+	primary.latencies.Unlock()
+	userInfoLogger.Logvf(Always, "Latency percentiles (ms) by target:\n%v", table)
+	userInfoLogger.Logvf(Always, "%.2f%% of ops encountered errors against host, %.2f%% against mirrorHost",
+		primary.ErrorRate()*100, mirror.ErrorRate()*100)
+	userInfoLogger.Logv(Always, comparator.summary("host", "mirrorHost"))
+}
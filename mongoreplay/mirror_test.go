@@ -0,0 +1,274 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	gocontext "context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+	flags "github.com/jessevdk/go-flags"
+)
+
+func TestTeeOps(t *testing.T) {
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	defer cancel()
+	in := make(chan *RecordedOp)
+	a, b := teeOps(ctx, in)
+
+	go func() {
+		for i := int64(1); i <= 3; i++ {
+			in <- &RecordedOp{RawOp: RawOp{Body: []byte{byte(i)}}, Order: i}
+		}
+		close(in)
+	}()
+	for i := int64(1); i <= 3; i++ {
+		opA, opB := <-a, <-b
+		if opA.Order != i || opB.Order != i {
+			t.Fatalf("expected op %v on both channels, saw %v and %v", i, opA.Order, opB.Order)
+		}
+		if opA == opB {
+			t.Errorf("expected op %v to be copied", i)
+		}
+		opA.Body[0] = 0
+		if opB.Body[0] != byte(i) {
+			t.Errorf("expected the body of op %v to be copied", i)
+		}
+	}
+	if _, ok := <-a; ok {
+		t.Errorf("expected the first channel to be closed")
+	}
+	if _, ok := <-b; ok {
+		t.Errorf("expected the second channel to be closed")
+	}
+}
+
+func TestTeeOpsCanceled(t *testing.T) {
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	in := make(chan *RecordedOp, 1)
+	a, b := teeOps(ctx, in)
+	in <- &RecordedOp{Order: 1}
+	<-a
+	// the second channel is never read, so the tee stops only when canceled
+	cancel()
+	select {
+	case <-b:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("tee did not stop when canceled")
+	}
+}
+
+func TestMirrorComparator(t *testing.T) {
+	entry := func(order int64, err string) *ReplyTapeEntry {
+		return &ReplyTapeEntry{Order: order, Op: "op_msg", Command: "insert", Error: err}
+	}
+	comparator := newMirrorComparator(newReplyNormalization(nil, false, false, false))
+	comparator.add(0, entry(1, ""))
+	comparator.add(1, entry(1, ""))
+	comparator.add(1, entry(2, "duplicate key"))
+	comparator.add(0, entry(2, ""))
+	comparator.add(0, entry(3, ""))
+	for i := int64(4); i < 4+mirrorLoggedDiffs; i++ {
+		comparator.add(0, entry(i, ""))
+		comparator.add(1, entry(i, fmt.Sprintf("error %v", i)))
+	}
+
+	expected := fmt.Sprintf("Compared %v replies: %v differ (insert %v), 1 played only against host, 0 only against mirrorHost",
+		2+mirrorLoggedDiffs, 1+mirrorLoggedDiffs, 1+mirrorLoggedDiffs)
+	if summary := comparator.summary("host", "mirrorHost"); summary != expected {
+		t.Errorf("expected summary %q, saw %q", expected, summary)
+	}
+
+	// the oldest replies waiting for the other target are dropped
+	comparator = newMirrorComparator(newReplyNormalization(nil, false, false, false))
+	comparator.maxPending = 2
+	for i := int64(1); i <= 5; i++ {
+		comparator.add(1, entry(i, ""))
+	}
+	comparator.add(0, entry(1, ""))
+	comparator.add(0, entry(5, ""))
+	if len(comparator.pending[1]) != 1 || comparator.arrivals[1].Len() != 1 {
+		t.Errorf("expected a single reply kept, got %v", len(comparator.pending[1]))
+	}
+	expected = "Compared 1 replies: 0 differ, 1 played only against host, 4 only against mirrorHost"
+	if summary := comparator.summary("host", "mirrorHost"); summary != expected {
+		t.Errorf("expected summary %q, saw %q", expected, summary)
+	}
+}
+
+// insertedIDsOf returns the _ids inserted on server, in the order they were
+// received.
+func insertedIDsOf(server *fakeServer) []string {
+	var ids []string
+	for _, insert := range server.commands("insert") {
+		documents, _ := FindValueByKey("documents", &insert)
+		docs, _ := documents.([]interface{})
+		for _, inserted := range docs {
+			doc, _ := bsonToD(inserted)
+			id, _ := FindValueByKey("_id", &doc)
+			ids = append(ids, fmt.Sprintf("%#v", id))
+		}
+	}
+	return ids
+}
+
+// mirroredPlayCommand writes the ops generated by generate to a playback file
+// in dir, and returns the command playing it against primary and mirror with
+// the extra args.
+func mirroredPlayCommand(t *testing.T, dir string, primary, mirror *fakeServer, generate func(*recordedOpGenerator) error, args ...string) *PlayCommand {
+	path := filepath.Join(dir, "mirrored.playback")
+	writer, err := NewPlaybackFileWriter(path, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generator := newRecordedOpGenerator()
+	if err := generate(generator); err != nil {
+		t.Fatal(err)
+	}
+	close(generator.opChan)
+	for op := range generator.opChan {
+		if err := writer.WriteRecordedOp(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	play := &PlayCommand{GlobalOpts: &Options{}}
+	args = append([]string{"-p", path, "--host", primary.addr(), "--mirrorHost", "mongodb://" + mirror.addr() + "/?connect=direct",
+		"--fullSpeed", "--no-detect"}, args...)
+	if _, err := flags.NewParser(play, flags.None).ParseArgs(args); err != nil {
+		t.Fatal(err)
+	}
+	return play
+}
+
+func TestMirrorRegeneratesIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	primary, mirror := newFakeServer(t), newFakeServer(t)
+	defer primary.Close()
+	defer mirror.Close()
+	play := mirroredPlayCommand(t, dir, primary, mirror, func(generator *recordedOpGenerator) error {
+		for i := 0; i < 3; i++ {
+			doc := bson.D{{"_id", bson.NewObjectId()}, {"n", i}}
+			if err := generator.generateMsgOpAgainstCollection("insert", "documents", []interface{}{doc}, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, "--regenerateIds", "objectId", "--repeat", "2")
+	if err := play.Execute(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// both hosts are sent the same new _ids, anew for each repetition
+	primaryIDs, mirrorIDs := insertedIDsOf(primary), insertedIDsOf(mirror)
+	if len(primaryIDs) != 6 || primary.duplicates != 0 || mirror.duplicates != 0 {
+		t.Errorf("expected 6 inserts without duplicate _ids, got %v inserts and %v and %v duplicates",
+			len(primaryIDs), primary.duplicates, mirror.duplicates)
+	}
+	sortedPrimary, sortedMirror := append([]string{}, primaryIDs...), append([]string{}, mirrorIDs...)
+	sort.Strings(sortedPrimary)
+	sort.Strings(sortedMirror)
+	if !reflect.DeepEqual(sortedPrimary, sortedMirror) {
+		t.Errorf("expected the mirror to insert the _ids of the primary, got %v and %v", primaryIDs, mirrorIDs)
+	}
+}
+
+// generateExhaustedCursor generates a find whose recorded reply opens a
+// cursor, and a getMore of that cursor on another connection, which waits for
+// the reply to the find. The replies of the fakeServer open no cursor, so the
+// getMore is of a cursor not found on the server.
+func generateExhaustedCursor(generator *recordedOpGenerator) error {
+	if err := generator.generateMsgOpFind(bson.D{}, 0, 100); err != nil {
+		return err
+	}
+	if err := generator.generateMsgOpReply(100, 42); err != nil {
+		return err
+	}
+	if err := generator.generateMsgOpGetMore(42, 0); err != nil {
+		return err
+	}
+	ops := []*RecordedOp{<-generator.opChan, <-generator.opChan, <-generator.opChan}
+	ops[2].SeenConnectionNum = 1
+	for _, op := range ops {
+		generator.opChan <- op
+	}
+	return nil
+}
+
+func TestMirrorSkipsGetMores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	primary, mirror := newFakeServer(t), newFakeServer(t)
+	defer primary.Close()
+	defer mirror.Close()
+	play := mirroredPlayCommand(t, dir, primary, mirror, generateExhaustedCursor, "--cursorNotFound", "skip")
+	// --cursorNotFound applies to the mirror too, whose getMore otherwise
+	// waits for its cursor indefinitely
+	done := make(chan error, 1)
+	go func() {
+		done <- play.Execute(nil)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("playback did not finish")
+	}
+	if len(primary.commands("find")) != 1 || len(mirror.commands("find")) != 1 {
+		t.Errorf("expected the find to be played against both hosts")
+	}
+	if len(primary.commands("getMore")) != 0 || len(mirror.commands("getMore")) != 0 {
+		t.Errorf("expected the getMore to be skipped against both hosts, saw %v and %v",
+			len(primary.commands("getMore")), len(mirror.commands("getMore")))
+	}
+
+	// the skipped getMores are compared like the ops played
+	comparator := newMirrorComparator(newReplyNormalization(nil, false, false, false))
+	for side, server := range []*fakeServer{primary, mirror} {
+		generator := newRecordedOpGenerator()
+		if err := generateExhaustedCursor(generator); err != nil {
+			t.Fatal(err)
+		}
+		close(generator.opChan)
+		// the replies are matched by the order of their ops in the file
+		ops := make(chan *RecordedOp, len(generator.opChan))
+		for op := range generator.opChan {
+			op.Order = int64(len(ops))
+			ops <- op
+		}
+		close(ops)
+		context := NewExecutionContext(&StatCollector{noop: true}, server.session(),
+			&ExecutionOptions{fullSpeed: true, cursorPolicy: cursorNotFoundSkip})
+		context.PostOpHooks = []PostOpHook{comparator.side(side)}
+		if err := Play(context, ops, 1, 1, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := "Compared 2 replies: 0 differ, 0 played only against host, 0 only against mirrorHost"
+	if summary := comparator.summary("host", "mirrorHost"); summary != expected {
+		t.Errorf("expected summary %q, saw %q", expected, summary)
+	}
+}
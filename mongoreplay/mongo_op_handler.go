@@ -19,12 +19,16 @@ import (
 // OpStreamSettings stores settings for any command which may listen to an
 // opstream.
 type OpStreamSettings struct {
-	PcapFile         string `short:"f" description:"path to the pcap file to be read"`
-	PacketBufSize    int    `short:"b" description:"Size of heap used to merge separate streams together"`
-	CaptureBufSize   int    `long:"capSize" description:"Size in KiB of the PCAP capture buffer"`
-	Expression       string `short:"e" long:"expr" description:"BPF filter expression to apply to packets"`
-	NetworkInterface string `short:"i" description:"network interface to listen on"`
-	MaxBufferedPages int    `long:"maxBufferedPages" description:"maximum number of memory pages to store when buffering packets. The cache size is unlimited if not set"`
+	PcapFile          string `short:"f" description:"path to the pcap file to be read, or - to read it from stdin"`
+	PacketBufSize     int    `short:"b" description:"Size of heap used to merge separate streams together"`
+	CaptureBufSize    int    `long:"capSize" description:"Size in KiB of the PCAP capture buffer"`
+	Expression        string `short:"e" long:"expr" description:"BPF filter expression to apply to packets"`
+	NetworkInterface  string `short:"i" description:"network interface to listen on"`
+	CaptureEngine     string `long:"captureEngine" description:"engine capturing packets on the network interface: pcap, or afpacket for the memory-mapped AF_PACKET rings of Linux" choice:"pcap" choice:"afpacket" default:"pcap"`
+	CaptureThreads    int    `long:"captureThreads" description:"number of AF_PACKET sockets the afpacket engine fans packets out across, each read by its own goroutine" default:"1"`
+	MaxBufferedPages  int    `long:"maxBufferedPages" description:"maximum number of memory pages to store when buffering packets. The cache size is unlimited if not set"`
+	MaxBufferedMemory int    `long:"maxBufferedMemory" description:"maximum MiB of memory used to store packets when buffering packets, as an alternative to maxBufferedPages"`
+	SpoolDir          string `long:"spoolDir" description:"directory of the temporary file to which buffered packets are spooled once maxBufferedPages or maxBufferedMemory is reached, rather than giving up on the packets their connections are missing"`
 }
 
 // tcpassembly.Stream implementation.
@@ -110,8 +114,14 @@ func (bidi *bidi) close() {
 	close(bidi.streams[0].done)
 	close(bidi.streams[1].reassembled)
 	close(bidi.streams[1].done)
-	delete(bidi.opStream.bidiMap, bidiKey{bidi.streams[1].netFlow, bidi.streams[1].tcpFlow})
-	delete(bidi.opStream.bidiMap, bidiKey{bidi.streams[0].netFlow, bidi.streams[0].tcpFlow})
+	// the keys may already be those of a new connection reusing the ports of
+	// this one
+	for _, stream := range bidi.streams {
+		key := bidiKey{stream.netFlow, stream.tcpFlow}
+		if bidi.opStream.bidiMap[key] == bidi {
+			delete(bidi.opStream.bidiMap, key)
+		}
+	}
 	// probably not important, just trying to make the garbage collection easier.
 	bidi.streams[0].bidi = nil
 	bidi.streams[1].bidi = nil
@@ -131,6 +141,16 @@ type MongoOpStream struct {
 	bidiMap           map[bidiKey]*bidi
 	connectionCounter chan int64
 	connectionNumber  int64
+
+	// truncatedOps counts the ops missing some of their bytes, which are not
+	// recorded, and corruptions the places where a message was expected but
+	// the data couldn't be one.
+	truncatedOps int64
+	corruptions  int64
+
+	// zone is the network interface the ops are captured on, which is the
+	// zone of the link-local IPv6 addresses of their endpoints.
+	zone string
 }
 
 // NewMongoOpStream initializes a new MongoOpStream
@@ -179,6 +199,19 @@ func (os *MongoOpStream) Close() error {
 	return nil
 }
 
+// reportLostOps logs the number of ops that were not recorded because they
+// were truncated, and the number of times corrupt data was skipped.
+func (os *MongoOpStream) reportLostOps() {
+	if truncated := atomic.LoadInt64(&os.truncatedOps); truncated > 0 {
+		userInfoLogger.Logvf(Always, "%v ops were truncated by the capture or by lost packets and not recorded; "+
+			"if the capture was taken with a small snaplen, capture again with a larger one, e.g. tcpdump -s 0", truncated)
+	}
+	if corruptions := atomic.LoadInt64(&os.corruptions); corruptions > 0 {
+		userInfoLogger.Logvf(Always, "skipped corrupt data where %v messages were expected, "+
+			"recording from the next plausible message header", corruptions)
+	}
+}
+
 // SetFirstSeen sets the time for the first message on the MongoOpStream.
 // All of this SetFirstSeen/FirstSeen/SetFirstseer stuff can go away ( from here
 // and from packet_handler.go ) it's a cruft and was how someone was trying to
@@ -253,8 +286,14 @@ func (bidi *bidi) handleStreamStateBeforeMessage(stream *stream) {
 		// whole stream should be discarded.
 		bidi.logvf(DebugLow, "not a good header %#v", stream.op.Header)
 		bidi.logvf(Info, "Expected to, but didn't see a valid protocol message")
+		atomic.AddInt64(&bidi.opStream.corruptions, 1)
 		stream.state = streamStateOutOfSync
-		stream.reassembly.Bytes = stream.reassembly.Bytes[:0]
+		// the corrupt data may be followed by more messages in the same bytes
+		length := len(stream.reassembly.Bytes)
+		if bidi.resync(stream, 1) {
+			bidi.logvf(Info, "Connection %v: skipped %v bytes of corrupt data to the next message",
+				bidi.connectionNumber, length-len(stream.reassembly.Bytes))
+		}
 		return
 	}
 	stream.op.Body = make([]byte, 16, stream.op.Header.MessageLength)
@@ -285,8 +324,8 @@ func (bidi *bidi) handleStreamStateInMessage(stream *stream) {
 		bidi.opStream.unorderedOps <- RecordedOp{
 			RawOp:             *stream.op,
 			Seen:              &PreciseTime{stream.opTimeStamp},
-			SrcEndpoint:       stream.netFlow.Src().String(),
-			DstEndpoint:       stream.netFlow.Dst().String(),
+			SrcEndpoint:       formatEndpoint(stream.netFlow.Src(), stream.tcpFlow.Src(), bidi.opStream.zone),
+			DstEndpoint:       formatEndpoint(stream.netFlow.Dst(), stream.tcpFlow.Dst(), bidi.opStream.zone),
 			SeenConnectionNum: bidi.connectionNumber,
 		}
 
@@ -301,20 +340,30 @@ func (bidi *bidi) handleStreamStateInMessage(stream *stream) {
 }
 func (bidi *bidi) handleStreamStateOutOfSync(stream *stream) {
 	bidi.logvf(DebugHigh, "out of sync")
-	if len(stream.reassembly.Bytes) < 16 {
-		stream.reassembly.Bytes = stream.reassembly.Bytes[:0]
-		return
-	}
-	stream.op.Header.FromWire(stream.reassembly.Bytes)
-	bidi.logvf(DebugHigh, "possible message header %#v", stream.op.Header)
-	if stream.op.Header.LooksReal() {
-		stream.state = streamStateBeforeMessage
+	if bidi.resync(stream, 0) {
+		bidi.logvf(DebugHigh, "possible message header %#v", stream.op.Header)
 		bidi.logvf(DebugLow, "synchronized")
-		return
 	}
-	stream.reassembly.Bytes = stream.reassembly.Bytes[:0]
 	return
 }
+
+// resync skips the bytes of a stream up to the first plausible message
+// header found after from bytes, after which the stream is read again from
+// that message. If none is found, the bytes are discarded, and false is
+// returned.
+func (bidi *bidi) resync(stream *stream, from int) bool {
+	bytes := stream.reassembly.Bytes
+	for i := from; i+MsgHeaderLen <= len(bytes); i++ {
+		if looksLikeMessage(bytes[i:]) {
+			stream.op.Header.FromWire(bytes[i:])
+			stream.reassembly.Bytes = bytes[i:]
+			stream.state = streamStateBeforeMessage
+			return true
+		}
+	}
+	stream.reassembly.Bytes = bytes[:0]
+	return false
+}
 func (bidi *bidi) handleStreamCompleted() {
 	var lastOpTimeStamp time.Time
 	if bidi.streams[0].opTimeStamp.After(bidi.streams[1].opTimeStamp) {
@@ -356,6 +405,12 @@ func (bidi *bidi) streamOps() {
 			// incomplete packets in hand.
 			if stream.reassembly.Skip > 0 {
 				// TODO, we may want to do more state specific reporting here.
+				if stream.state == streamStateInMessage {
+					// the op was truncated, by the capture or by lost packets
+					atomic.AddInt64(&bidi.opStream.truncatedOps, 1)
+					bidi.logvf(DebugLow, "Connection %v: op of %v bytes truncated after %v bytes",
+						bidi.connectionNumber, stream.op.Header.MessageLength, len(stream.op.Body))
+				}
 				stream.state = streamStateOutOfSync
 				//when we have skip, we destroy this buffer
 				stream.op.Body = stream.op.Body[:0]
@@ -0,0 +1,110 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+func TestResyncCorruptData(t *testing.T) {
+	src, dst := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	msg := pingMessage(t, 3)
+	garbage := []byte{0xff, 0xff, 0xff, 0xff, 0x01, 0x02}
+
+	type testCase struct {
+		name        string
+		syn         bool
+		payloads    [][]byte
+		requestIDs  []int32
+		corruptions int64
+	}
+	cases := []testCase{
+		{
+			name:        "corrupt bytes between messages",
+			syn:         true,
+			payloads:    [][]byte{concatBytes(pingQuery(t, 1), garbage, pingQuery(t, 2), msg)},
+			requestIDs:  []int32{1, 2, 3},
+			corruptions: 1,
+		},
+		{
+			name:        "corrupt packet",
+			syn:         true,
+			payloads:    [][]byte{pingQuery(t, 1), concatBytes(garbage, garbage, pingQuery(t, 2)), msg},
+			requestIDs:  []int32{1, 2, 3},
+			corruptions: 1,
+		},
+		{
+			name:       "capture started in the middle of a message",
+			payloads:   [][]byte{concatBytes(pingQuery(t, 1)[20:], pingQuery(t, 2)), msg},
+			requestIDs: []int32{2, 3},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		var pkts []gopacket.Packet
+		seq := uint32(1000)
+		if c.syn {
+			pkts = append(pkts, synPacket(t, src, dst, 50000, 27017, seq-1))
+		}
+		for _, payload := range c.payloads {
+			pkts = append(pkts, tcpPacket(t, src, dst, 50000, 27017, seq, payload))
+			seq += uint32(len(payload))
+		}
+		opStream := NewMongoOpStream(10)
+		ops := assembleOpStream(t, opStream, pkts)
+		var requestIDs []int32
+		for _, op := range ops {
+			requestIDs = append(requestIDs, op.Header.RequestID)
+		}
+		if len(requestIDs) != len(c.requestIDs) {
+			t.Fatalf("expected ops %v to be recorded, got %v", c.requestIDs, requestIDs)
+		}
+		for i := range requestIDs {
+			if requestIDs[i] != c.requestIDs[i] {
+				t.Errorf("expected ops %v to be recorded, got %v", c.requestIDs, requestIDs)
+				break
+			}
+		}
+		if opStream.corruptions != c.corruptions {
+			t.Errorf("expected %v corruptions, got %v", c.corruptions, opStream.corruptions)
+		}
+	}
+}
+
+func TestLooksLikeMessage(t *testing.T) {
+	query := pingQuery(t, 1)
+	badSection := pingMessage(t, 2)
+	badSection[MsgHeaderLen+4] = 3
+	for _, c := range []struct {
+		name     string
+		b        []byte
+		expected bool
+	}{
+		{"query", query, true},
+		{"reply", pingReply(t, 2, 1), true},
+		{"OP_MSG", pingMessage(t, 3), true},
+		{"start of a query", query[:24], true},
+		{"header found by chance in a query", concatBytes(query[20:], query)[17:], false},
+		{"OP_MSG with an unknown kind of section", badSection, false},
+		{"bad opcode", concatBytes([]byte{24, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 9, 0, 0, 0}, make([]byte, 8)), false},
+	} {
+		if looks := looksLikeMessage(c.b); looks != c.expected {
+			t.Errorf("expected %v to look like a message: %v, got %v", c.name, c.expected, looks)
+		}
+	}
+}
+
+func concatBytes(slices ...[]byte) []byte {
+	var b []byte
+	for _, slice := range slices {
+		b = append(b, slice...)
+	}
+	return b
+}
@@ -0,0 +1,201 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// the batching of the stats inserted by the MongoDBStatRecorder
+const (
+	// mongoDBStatBatchSize is the number of stats inserted at once.
+	mongoDBStatBatchSize = 1000
+	// mongoDBStatFlushInterval is the longest a stat waits for its batch to
+	// fill before being inserted, as long as stats keep being recorded.
+	mongoDBStatFlushInterval = time.Second
+	// mongoDBStatPendingBatches is the number of batches waiting to be
+	// inserted before recording blocks, slowing playback down rather than
+	// buffering without bound when the server can't keep up.
+	mongoDBStatPendingBatches = 4
+)
+
+// MongoDBStatRecorder inserts a document per stat into the collection of
+// --statsNamespace on the server of --statsUri, so that the results of a
+// playback can be queried and charted as they come in. The stats are
+// inserted in batches by a separate goroutine. Each playback is told apart
+// by the run field of its documents.
+type MongoDBStatRecorder struct {
+	run       bson.ObjectId
+	batch     []interface{}
+	flushedAt time.Time
+
+	// batches holds the batches waiting to be inserted by insert, and done
+	// is closed once they all are, with the error of the first insert which
+	// failed.
+	batches chan []interface{}
+	done    chan error
+	insert  func(docs []interface{}) error
+	close   func()
+}
+
+func newMongoDBStatRecorder(opts StatOptions, out io.WriteCloser) (StatRecorder, error) {
+	switch {
+	case opts.StatsURI == "":
+		return nil, fmt.Errorf("--statsUri is required when using --collect mongodb")
+	case opts.Report != "":
+		return nil, fmt.Errorf("--report cannot be used with --collect mongodb")
+	}
+	i := strings.Index(opts.StatsNamespace, ".")
+	if i <= 0 || i == len(opts.StatsNamespace)-1 {
+		return nil, fmt.Errorf("Invalid setting for --statsNamespace: '%v' is not <database>.<collection>", opts.StatsNamespace)
+	}
+	info, err := mgo.ParseURL(opts.StatsURI)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid setting for --statsUri: %v", err)
+	}
+	session, err := dialSession(info, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %v: %v", describeServers(info), err)
+	}
+	collection := session.DB(opts.StatsNamespace[:i]).C(opts.StatsNamespace[i+1:])
+	recorder := startMongoDBStatRecorder(collection.Insert, session.Close)
+	userInfoLogger.Logvf(Always, "Recording stats to %v on %v as run %v",
+		opts.StatsNamespace, describeServers(info), recorder.run.Hex())
+	return recorder, nil
+}
+
+// startMongoDBStatRecorder returns a MongoDBStatRecorder inserting the
+// stats with insert, and calling close once they all are.
+func startMongoDBStatRecorder(insert func(docs ...interface{}) error, close func()) *MongoDBStatRecorder {
+	recorder := &MongoDBStatRecorder{
+		run:       bson.NewObjectId(),
+		flushedAt: time.Now(),
+		batches:   make(chan []interface{}, mongoDBStatPendingBatches),
+		done:      make(chan error, 1),
+		insert:    func(docs []interface{}) error { return insert(docs...) },
+		close:     close,
+	}
+	go func() {
+		var err error
+		for batch := range recorder.batches {
+			if insertErr := recorder.insert(batch); insertErr != nil {
+				toolDebugLogger.Logvf(Always, "error inserting %v stats: %v", len(batch), insertErr)
+				if err == nil {
+					err = insertErr
+				}
+			}
+		}
+		recorder.done <- err
+	}()
+	return recorder
+}
+
+// RecordStat adds the document of the stat to the batch being filled,
+// handing the batch over to be inserted once it is full or has waited long
+// enough.
+func (msr *MongoDBStatRecorder) RecordStat(stat *OpStat) {
+	if stat == nil {
+		return
+	}
+	msr.batch = append(msr.batch, msr.statDocument(stat))
+	if len(msr.batch) >= mongoDBStatBatchSize || time.Since(msr.flushedAt) >= mongoDBStatFlushInterval {
+		msr.flush()
+	}
+}
+
+// flush hands the batch being filled over to be inserted, blocking while
+// too many batches are pending.
+func (msr *MongoDBStatRecorder) flush() {
+	if len(msr.batch) > 0 {
+		msr.batches <- msr.batch
+		msr.batch = nil
+	}
+	msr.flushedAt = time.Now()
+}
+
+// statDocument returns the document inserted for a stat. The request and
+// reply are inserted as the BSON they were decoded from.
+func (msr *MongoDBStatRecorder) statDocument(stat *OpStat) bson.D {
+	doc := bson.D{
+		{Name: "run", Value: msr.run},
+		{Name: "order", Value: stat.Order},
+		{Name: "op", Value: stat.OpType},
+	}
+	optional := []bson.DocElem{
+		{Name: "command", Value: stat.Command},
+		{Name: "ns", Value: stat.Ns},
+		{Name: "request", Value: stat.RequestData},
+		{Name: "reply", Value: stat.ReplyData},
+		{Name: "nreturned", Value: stat.NumReturned},
+		{Name: "connection_num", Value: stat.ConnectionNum},
+		{Name: "latency_us", Value: stat.LatencyMicros},
+		{Name: "playbacklag_us", Value: stat.PlaybackLagMicros},
+		{Name: "msg", Value: stat.Message},
+		{Name: "unacknowledged", Value: stat.Unacknowledged},
+	}
+	for _, elem := range optional {
+		switch value := elem.Value.(type) {
+		case nil:
+		case string:
+			if value != "" {
+				doc = append(doc, elem)
+			}
+		case int:
+			if value != 0 {
+				doc = append(doc, elem)
+			}
+		case int64:
+			if value != 0 {
+				doc = append(doc, elem)
+			}
+		case bool:
+			if value {
+				doc = append(doc, elem)
+			}
+		default:
+			doc = append(doc, elem)
+		}
+	}
+	for _, at := range []struct {
+		name string
+		time *time.Time
+	}{{"played_at", stat.PlayedAt}, {"play_at", stat.PlayAt}, {"seen", stat.Seen}} {
+		if at.time != nil {
+			doc = append(doc, bson.DocElem{Name: at.name, Value: *at.time})
+		}
+	}
+	if len(stat.Errors) > 0 {
+		errs := make([]string, len(stat.Errors))
+		for i, err := range stat.Errors {
+			errs[i] = err.Error()
+		}
+		doc = append(doc, bson.DocElem{Name: "errors", Value: errs})
+	}
+	return doc
+}
+
+// Flush hands the batch being filled over to be inserted.
+func (msr *MongoDBStatRecorder) Flush() error {
+	msr.flush()
+	return nil
+}
+
+// Close inserts the last batch, waits for every batch to be inserted, and
+// disconnects.
+func (msr *MongoDBStatRecorder) Close() error {
+	msr.flush()
+	close(msr.batches)
+	err := <-msr.done
+	msr.close()
+	return err
+}
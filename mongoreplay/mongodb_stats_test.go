@@ -0,0 +1,76 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestMongoDBStatRecorder(t *testing.T) {
+	var inserted [][]interface{}
+	closed := false
+	recorder := startMongoDBStatRecorder(func(docs ...interface{}) error {
+		inserted = append(inserted, docs)
+		return nil
+	}, func() { closed = true })
+
+	playedAt := time.Now()
+	for i := 0; i < mongoDBStatBatchSize+1; i++ {
+		recorder.RecordStat(&OpStat{
+			Order:       int64(i),
+			OpType:      "op_msg",
+			Command:     "find",
+			Ns:          "test.c",
+			RequestData: bson.D{{"find", "c"}},
+			PlayedAt:    &playedAt,
+			Errors:      []error{fmt.Errorf("failed")},
+		})
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !closed {
+		t.Errorf("expected the session to be closed")
+	}
+	if len(inserted) != 2 || len(inserted[0]) != mongoDBStatBatchSize || len(inserted[1]) != 1 {
+		t.Fatalf("expected a full batch and a batch of 1, got %v batches", len(inserted))
+	}
+
+	doc := inserted[1][0].(bson.D)
+	expected := bson.D{
+		{"run", recorder.run},
+		{"order", int64(mongoDBStatBatchSize)},
+		{"op", "op_msg"},
+		{"command", "find"},
+		{"ns", "test.c"},
+		{"request", bson.D{{"find", "c"}}},
+		{"played_at", playedAt},
+		{"errors", []string{"failed"}},
+	}
+	if fmt.Sprintf("%v", doc) != fmt.Sprintf("%v", expected) {
+		t.Errorf("expected %v, got %v", expected, doc)
+	}
+}
+
+func TestMongoDBStatRecorderErrors(t *testing.T) {
+	recorder := startMongoDBStatRecorder(func(docs ...interface{}) error {
+		return fmt.Errorf("not primary")
+	}, func() {})
+	recorder.RecordStat(&OpStat{Order: 1, OpType: "op_msg"})
+	if err := recorder.Close(); err == nil {
+		t.Errorf("expected the error of the insert")
+	}
+
+	t.Log("Collecting to MongoDB without --statsUri")
+	if _, err := newMongoDBStatRecorder(StatOptions{StatsNamespace: "mongoreplay.stats"}, nil); err == nil {
+		t.Errorf("expected an error")
+	}
+}
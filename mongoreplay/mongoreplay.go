@@ -11,6 +11,7 @@ type Options struct {
 	Verbosity []bool `short:"v" long:"verbosity" description:"increase the detail regarding the tools performance on the input file that is output to logs (include multiple times for increased logging verbosity, e.g. -vvv)"`
 	Debug     []bool `short:"d" long:"debug" description:"increase the detail regarding the operations and errors of the tool that is output to the logs(include multiple times for increased debugging information, e.g. -ddd)"`
 	Silent    bool   `short:"s" long:"silent" description:"silence all log output"`
+	Config    string `long:"config" no-ini:"true" description:"YAML file of settings for the global options and those of each command, which options given on the command line override"`
 }
 
 // SetLogging sets the verbosity/debug level for log output.
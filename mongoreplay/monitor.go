@@ -20,10 +20,13 @@ type MonitorCommand struct {
 	GlobalOpts *Options `no-flag:"true"`
 	StatOptions
 	OpStreamSettings
-	Collect      string `long:"collect" description:"Stat collection format; 'format' option uses the --format string" choice:"json" choice:"format" choice:"none" default:"format"`
+	Collect      string `long:"collect" description:"Stat collection format: json, csv, prometheus, mongodb, sqlite or none, or format to use the --format string" default:"format"`
 	PairedMode   bool   `long:"paired" description:"Output only one line for a request/reply pair"`
 	Gzip         bool   `long:"gzip" description:"decompress gzipped input"`
 	PlaybackFile string `short:"p" description:"path to playback file to read from" long:"playback-file"`
+	Top          bool   `long:"top" description:"instead of a line per op, write a table of the ops per second and bytes per second of the requests and replies of each namespace and op type every --topInterval seconds, refreshed in place when capturing from a network interface to a terminal"`
+	TopInterval  int    `long:"topInterval" description:"number of seconds counted by each table of --top" default:"1"`
+	TopRows      int    `long:"topRows" description:"number of namespaces and op types listed by each table of --top, busiest first" default:"20"`
 }
 
 // UnresolvedOpInfo holds information about an op
@@ -95,7 +98,9 @@ func (gen *RegularStatGenerator) ResolveOp(recordedReply *RecordedOp, reply Repl
 // Execute runs the program for the 'monitor' subcommand
 func (monitor *MonitorCommand) Execute(args []string) error {
 	monitor.GlobalOpts.SetLogging()
-	monitor.ValidateParams(args)
+	if err := monitor.ValidateParams(args); err != nil {
+		return err
+	}
 
 	var opChan <-chan *RecordedOp
 	var errChan <-chan error
@@ -118,7 +123,9 @@ func (monitor *MonitorCommand) Execute(args []string) error {
 			defer close(e)
 			if err := ctx.packetHandler.Handle(ctx.mongoOpStream, -1); err != nil {
 				e <- fmt.Errorf("monitor: error handling packet stream: %s", err)
+				return
 			}
+			ctx.mongoOpStream.reportLostOps()
 		}()
 		// When a signal is received to kill the process, stop the packet
 		// handler so we gracefully flush all ops being processed before
@@ -132,18 +139,58 @@ func (monitor *MonitorCommand) Execute(args []string) error {
 			ctx.packetHandler.Close()
 		}()
 	}
-	statColl, err := newStatCollector(monitor.StatOptions, monitor.Collect, monitor.PairedMode, false)
+	collect := monitor.Collect
+	var top *namespaceTop
+	var ticks <-chan time.Time
+	if monitor.Top {
+		// the stats are only collected to a report, not written over the
+		// tables
+		if monitor.Report == "" {
+			collect = "none"
+		}
+		live := false
+		if info, err := os.Stdout.Stat(); err == nil && monitor.NetworkInterface != "" {
+			live = info.Mode()&os.ModeCharDevice != 0
+		}
+		top = newNamespaceTop(os.Stdout, time.Duration(monitor.TopInterval)*time.Second, monitor.TopRows, live)
+		if monitor.NetworkInterface != "" {
+			// the tables keep coming while no traffic is captured
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			ticks = ticker.C
+		}
+	}
+	statColl, err := NewStatCollector(monitor.StatOptions, collect, monitor.PairedMode, false)
 	if err != nil {
 		return err
 	}
 	defer statColl.Close()
 
-	for op := range opChan {
-		parsedOp, err := op.RawOp.Parse()
-		if err != nil {
-			return err
+	var lastSeen time.Time
+ops:
+	for {
+		select {
+		case op, ok := <-opChan:
+			if !ok {
+				break ops
+			}
+			// the wire length of compressed ops is replaced by parsing
+			wireLength := op.Header.MessageLength
+			parsedOp, err := op.RawOp.Parse()
+			if err != nil {
+				return err
+			}
+			if top != nil {
+				top.observe(op, parsedOp, wireLength)
+				lastSeen = op.Seen.Time
+			}
+			statColl.Collect(op, parsedOp, nil, "")
+		case now := <-ticks:
+			top.advance(now)
 		}
-		statColl.Collect(op, parsedOp, nil, "")
+	}
+	if top != nil && !lastSeen.IsZero() {
+		top.finish(lastSeen)
 	}
 	err = <-errChan
 	if err != nil && err != io.EOF {
@@ -181,6 +228,10 @@ func (monitor *MonitorCommand) ValidateParams(args []string) error {
 		return fmt.Errorf("must specify one input source")
 	case numInputTypes > 1:
 		return fmt.Errorf("must not specify more than one input")
+	case monitor.TopInterval < 1:
+		return fmt.Errorf("Invalid setting for --topInterval: '%v', value must be >=1", monitor.TopInterval)
+	case monitor.TopRows < 1:
+		return fmt.Errorf("Invalid setting for --topRows: '%v', value must be >=1", monitor.TopRows)
 	}
 
 	if monitor.OpStreamSettings.PacketBufSize == 0 {
@@ -0,0 +1,47 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"sync/atomic"
+
+	mgo "github.com/10gen/llmgo"
+)
+
+// expectsReply returns whether the server replies to the request op. The
+// legacy writes and killCursors, and the OP_MSGs with the moreToCome flag
+// set, are not replied to.
+func (op *RawOp) expectsReply() bool {
+	switch op.Header.OpCode {
+	case OpCodeInsert, OpCodeUpdate, OpCodeDelete, OpCodeKillCursors:
+		return false
+	case OpCodeMessage:
+		if len(op.Body) >= MsgHeaderLen+4 {
+			return uint32(getInt32(op.Body, MsgHeaderLen))&mgo.MsgFlagMoreToCome == 0
+		}
+	}
+	return true
+}
+
+// isUnacknowledgedWrite returns whether op is a write the server doesn't
+// acknowledge: a legacy write, or an OP_MSG write with the moreToCome flag
+// set.
+func isUnacknowledgedWrite(op Op) bool {
+	switch castOp := op.(type) {
+	case *InsertOp, *UpdateOp, *DeleteOp:
+		return true
+	case *MsgOp:
+		return castOp.Flags&mgo.MsgFlagMoreToCome != 0 && opKindOf(op) == opKindWrite
+	}
+	return false
+}
+
+// UnacknowledgedWrites returns the number of writes played which the server
+// didn't acknowledge.
+func (context *ExecutionContext) UnacknowledgedWrites() int64 {
+	return atomic.LoadInt64(&context.unacknowledgedWrites)
+}
@@ -0,0 +1,57 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestMoreToCome(t *testing.T) {
+	type testCase struct {
+		name           string
+		command        bson.D
+		flags          uint32
+		expectsReply   bool
+		unacknowledged bool
+	}
+	cases := []testCase{
+		{name: "acknowledged insert", command: bson.D{{"insert", "c"}}, expectsReply: true},
+		{name: "unacknowledged insert", command: bson.D{{"insert", "c"}}, flags: mgo.MsgFlagMoreToCome, unacknowledged: true},
+		{name: "find", command: bson.D{{"find", "c"}}, expectsReply: true},
+		{name: "checksummed find", command: bson.D{{"find", "c"}}, flags: mgo.MsgFlagChecksumPresent, expectsReply: true},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		rawOp, err := newMsgRawOp(1, 0, append(c.command, bson.DocElem{Name: "$db", Value: "test"}))
+		if err != nil {
+			t.Fatalf("error building the op: %v", err)
+		}
+		SetInt32(rawOp.Body, MsgHeaderLen, int32(c.flags))
+		if expectsReply := rawOp.expectsReply(); expectsReply != c.expectsReply {
+			t.Errorf("expected a reply to be expected %v, got %v", c.expectsReply, expectsReply)
+		}
+		op, err := newMsgCommand("test", c.command)
+		if err != nil {
+			t.Fatalf("error building the command: %v", err)
+		}
+		op.Flags = c.flags
+		if unacknowledged := isUnacknowledgedWrite(op); unacknowledged != c.unacknowledged {
+			t.Errorf("expected the write to be unacknowledged %v, got %v", c.unacknowledged, unacknowledged)
+		}
+	}
+
+	legacyInsert := &RawOp{Header: MsgHeader{OpCode: OpCodeInsert}}
+	if legacyInsert.expectsReply() {
+		t.Errorf("expected no reply to be expected to a legacy insert")
+	}
+	if !isUnacknowledgedWrite(&InsertOp{}) {
+		t.Errorf("expected a legacy insert to be unacknowledged")
+	}
+}
@@ -139,6 +139,10 @@ func (op *MsgOp) FromReader(r io.Reader) error {
 // Execute performs the MsgOp on a given session, yielding the reply when
 // successful (and an error otherwise).
 func (op *MsgOp) Execute(socket *mgo.MongoSocket) (Replyable, error) {
+	// the server doesn't reply to an op with moreToCome set
+	if op.Flags&mgo.MsgFlagMoreToCome != 0 {
+		return nil, mgo.ExecOpWithoutReply(socket, &op.MsgOp)
+	}
 	before := time.Now()
 	_, sectionsData, _, resultReply, err := mgo.ExecOpWithReply(socket, &op.MsgOp)
 	after := time.Now()
@@ -461,3 +465,44 @@ func fetchPayload0Data(sections []mgo.MsgSection) (*bson.Raw, int, error) {
 	}
 	return nil, 0, fmt.Errorf("payload 0 not found")
 }
+
+// setMsgOpField sets a top-level field in the payload type 0 document of the
+// MsgOp, adding the field if it is not already present.
+func setMsgOpField(msgOp *MsgOp, name string, value interface{}) error {
+	payload0DataRaw, sectionIx, err := fetchPayload0Data(msgOp.Sections)
+	if err != nil {
+		return err
+	}
+	doc, err := bsonToD(payload0DataRaw)
+	if err != nil {
+		return err
+	}
+	newDocAsRaw, err := dToRaw(setDocField(doc, name, value))
+	if err != nil {
+		return err
+	}
+	msgOp.Sections[sectionIx].Data = newDocAsRaw
+	return nil
+}
+
+// newMsgRawOp serializes doc as the single payload type 0 section of an
+// OP_MSG with the given request id, which replies to responseTo if it is not
+// 0.
+func newMsgRawOp(requestID, responseTo int32, doc bson.D) (*RawOp, error) {
+	docAsSlice, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	// the header is followed by the flag bits and the kind of the section
+	body := make([]byte, MsgHeaderLen+5, MsgHeaderLen+5+len(docAsSlice))
+	body = append(body, docAsSlice...)
+	header := MsgHeader{
+		MessageLength: int32(len(body)),
+		RequestID:     requestID,
+		ResponseTo:    responseTo,
+		OpCode:        OpCodeMessage,
+	}
+	copy(body, header.ToWire())
+	body[MsgHeaderLen+4] = byte(mgo.MsgPayload0)
+	return &RawOp{Header: header, Body: body}, nil
+}
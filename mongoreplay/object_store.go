@@ -0,0 +1,566 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Playback files can be read from and written to the buckets of S3, and of
+// Google Cloud Storage through its S3 compatible XML API, by naming them
+// s3://<bucket>/<key> and gs://<bucket>/<key>. The requests are signed with
+// AWS signature version 4, using the credentials of the environment:
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and AWS_REGION
+// for S3, of which AWS_ENDPOINT_URL can name another S3 compatible endpoint,
+// and the HMAC keys of GOOGLE_ACCESS_KEY_ID and GOOGLE_SECRET_ACCESS_KEY for
+// Cloud Storage. Only these variables are read: shared config and
+// credentials files, profiles, SSO and the roles of instances and
+// containers aren't, as the requests are signed here rather than by an SDK.
+//
+// Buckets are addressed in the host of the requests, as
+// <bucket>.s3.<region>.amazonaws.com, unless their names aren't valid host
+// names or AWS_ENDPOINT_URL is set, in which case they are addressed in the
+// path of the requests. AWS_S3_ADDRESSING_STYLE, virtual or path, overrides
+// the choice.
+const (
+	objectStoreS3Scheme  = "s3://"
+	objectStoreGCSScheme = "gs://"
+	objectStoreGCSURL    = "https://storage.googleapis.com"
+
+	objectStoreVirtualHosted = "virtual"
+	objectStorePathStyle     = "path"
+
+	// objectPartSize is the size of the parts a playback file is uploaded
+	// in, which S3 requires to be at least 5 MiB
+	objectPartSize = 16 * 1024 * 1024
+	// objectRetries is the number of times a failed request, or a read
+	// interrupted by a network error, is retried
+	objectRetries   = 5
+	objectRetryWait = 500 * time.Millisecond
+)
+
+// isObjectURL returns whether a playback file name is that of an object of
+// S3 or Cloud Storage.
+func isObjectURL(name string) bool {
+	return strings.HasPrefix(name, objectStoreS3Scheme) || strings.HasPrefix(name, objectStoreGCSScheme)
+}
+
+// objectStore sends the signed requests of the objects of a bucket.
+type objectStore struct {
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	// virtualHosted is whether buckets are addressed in the host of the
+	// requests rather than in their path
+	virtualHosted bool
+	// service is the AWS service the requests are signed for, s3 unless
+	// set
+	service string
+	client  *http.Client
+	// now is the time requests are signed at
+	now func() time.Time
+}
+
+// object is an object of an objectStore.
+type object struct {
+	store  *objectStore
+	bucket string
+	key    string
+}
+
+// parseObjectURL returns the object named by an s3:// or gs:// URL, with the
+// store and credentials of the environment.
+func parseObjectURL(name string) (*object, error) {
+	var store *objectStore
+	var path string
+	// customEndpoint is whether the requests are sent to an endpoint named
+	// by the environment, which may not serve buckets by host name
+	var customEndpoint bool
+	switch {
+	case strings.HasPrefix(name, objectStoreS3Scheme):
+		path = strings.TrimPrefix(name, objectStoreS3Scheme)
+		region := firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		endpoint := os.Getenv("AWS_ENDPOINT_URL")
+		customEndpoint = endpoint != ""
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		store = &objectStore{
+			region:       region,
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		var err error
+		if store.endpoint, err = url.Parse(endpoint); err != nil {
+			return nil, fmt.Errorf("invalid AWS_ENDPOINT_URL: %v", err)
+		}
+	case strings.HasPrefix(name, objectStoreGCSScheme):
+		path = strings.TrimPrefix(name, objectStoreGCSScheme)
+		store = &objectStore{
+			region:    "auto",
+			accessKey: os.Getenv("GOOGLE_ACCESS_KEY_ID"),
+			secretKey: os.Getenv("GOOGLE_SECRET_ACCESS_KEY"),
+		}
+		store.endpoint, _ = url.Parse(objectStoreGCSURL)
+	default:
+		return nil, fmt.Errorf("%v is not an s3:// or gs:// URL", name)
+	}
+	if store.accessKey == "" || store.secretKey == "" {
+		return nil, fmt.Errorf("no credentials in the environment to access %v", name)
+	}
+	store.client = &http.Client{}
+	store.now = time.Now
+
+	slash := strings.Index(path, "/")
+	if slash <= 0 || slash == len(path)-1 {
+		return nil, fmt.Errorf("%v doesn't name a bucket and an object", name)
+	}
+	bucket := path[:slash]
+	switch style := os.Getenv("AWS_S3_ADDRESSING_STYLE"); style {
+	case "":
+		store.virtualHosted = !customEndpoint && isHostCompatibleBucket(bucket)
+	case objectStoreVirtualHosted:
+		if !isHostCompatibleBucket(bucket) {
+			return nil, fmt.Errorf("bucket %v can't be addressed in a host name", bucket)
+		}
+		store.virtualHosted = true
+	case objectStorePathStyle:
+	default:
+		return nil, fmt.Errorf("invalid AWS_S3_ADDRESSING_STYLE %q, expected %v or %v",
+			style, objectStoreVirtualHosted, objectStorePathStyle)
+	}
+	return &object{store: store, bucket: bucket, key: path[slash+1:]}, nil
+}
+
+// isHostCompatibleBucket returns whether a bucket can be addressed as a
+// label of the host name of the requests. Names with dots can't, as they
+// don't match the wildcard certificates of the stores.
+func isHostCompatibleBucket(bucket string) bool {
+	if len(bucket) < 3 || len(bucket) > 63 || bucket[0] == '-' || bucket[len(bucket)-1] == '-' {
+		return false
+	}
+	for _, c := range bucket {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// objectError is the error returned by an object store for a request.
+type objectError struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *objectError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("object store responded with status %v", e.Status)
+	}
+	return fmt.Sprintf("object store responded with status %v: %v: %v", e.Status, e.Code, e.Message)
+}
+
+// retryable returns whether a request that failed with err may succeed when
+// sent again.
+func retryable(err error) bool {
+	if e, ok := err.(*objectError); ok {
+		return e.Status >= 500 || e.Status == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// do sends a request of the object, retrying it while it fails with a
+// network or server error. The response is returned once its status is
+// successful, with its body unread.
+func (obj *object) do(method string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	var err error
+	for attempt := 0; attempt <= objectRetries; attempt++ {
+		if attempt > 0 {
+			toolDebugLogger.Logvf(DebugLow, "Retrying %v of %v/%v after error: %v", method, obj.bucket, obj.key, err)
+			time.Sleep(objectRetryWait << uint(attempt-1))
+		}
+		var response *http.Response
+		response, err = obj.send(method, query, header, body)
+		if err == nil {
+			return response, nil
+		}
+		if !retryable(err) {
+			break
+		}
+	}
+	return nil, err
+}
+
+// url returns the URL of the object, with its bucket in the host or in the
+// path.
+func (obj *object) url(query url.Values) *url.URL {
+	u := *obj.store.endpoint
+	if obj.store.virtualHosted {
+		u.Host = obj.bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + obj.key
+	} else {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + obj.bucket + "/" + obj.key
+	}
+	// the path is sent as it is signed
+	u.RawPath = awsURIEncode(u.Path, false)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+func (obj *object) send(method string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, obj.url(query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	obj.store.sign(request, body)
+	response, err := obj.store.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 == 2 {
+		return response, nil
+	}
+	defer response.Body.Close()
+	objErr := &objectError{Status: response.StatusCode}
+	if data, err := ioutil.ReadAll(io.LimitReader(response.Body, 64*1024)); err == nil {
+		xml.Unmarshal(data, objErr)
+	}
+	return nil, objErr
+}
+
+// sign adds the AWS signature version 4 of a request to its headers, signing
+// its host, its range and the x-amz- headers.
+func (store *objectStore) sign(request *http.Request, body []byte) {
+	now := store.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if store.sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", store.sessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	service := store.service
+	if service == "" {
+		service = "s3"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		awsURIEncode(request.URL.Path, false),
+		awsCanonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		request.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := date + "/" + store.region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+store.secretKey), date)
+	key = hmacSHA256(key, store.region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+store.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode percent-encodes every byte but the unreserved characters,
+// and the slashes of paths unless encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var encoded bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			encoded.WriteByte(c)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
+
+func awsCanonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// objectReader reads an object as an io.ReadSeeker. It streams the object
+// from the offset read from, and when the stream is interrupted, continues
+// with a range request from the offset it was interrupted at.
+type objectReader struct {
+	obj    *object
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+// openObjectReader opens the object named by an s3:// or gs:// URL for
+// reading.
+func openObjectReader(name string) (*objectReader, error) {
+	obj, err := parseObjectURL(name)
+	if err != nil {
+		return nil, err
+	}
+	response, err := obj.do("HEAD", nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %v: %v", name, err)
+	}
+	response.Body.Close()
+	return &objectReader{obj: obj, size: response.ContentLength}, nil
+}
+
+func (reader *objectReader) Read(p []byte) (int, error) {
+	if reader.offset >= reader.size {
+		return 0, io.EOF
+	}
+	var err error
+	for attempt := 0; attempt <= objectRetries; attempt++ {
+		if reader.body == nil {
+			header := http.Header{}
+			header.Set("Range", fmt.Sprintf("bytes=%d-", reader.offset))
+			response, err := reader.obj.do("GET", nil, header, nil)
+			if err != nil {
+				return 0, fmt.Errorf("error reading %v/%v: %v", reader.obj.bucket, reader.obj.key, err)
+			}
+			reader.body = response.Body
+		}
+		var n int
+		n, err = reader.body.Read(p)
+		reader.offset += int64(n)
+		if err == nil || (err == io.EOF && reader.offset >= reader.size) {
+			return n, err
+		}
+		// the stream was interrupted, and is opened again from the offset
+		// it was interrupted at
+		toolDebugLogger.Logvf(DebugLow, "Reading %v/%v interrupted at offset %v: %v",
+			reader.obj.bucket, reader.obj.key, reader.offset, err)
+		reader.body.Close()
+		reader.body = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("error reading %v/%v: %v", reader.obj.bucket, reader.obj.key, err)
+}
+
+// Seek sets the offset for the next Read, from which the object is streamed.
+func (reader *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += reader.offset
+	case io.SeekEnd:
+		offset += reader.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid seek to offset %v of %v/%v", offset, reader.obj.bucket, reader.obj.key)
+	}
+	if offset != reader.offset && reader.body != nil {
+		reader.body.Close()
+		reader.body = nil
+	}
+	reader.offset = offset
+	return offset, nil
+}
+
+// Close closes the stream of the object.
+func (reader *objectReader) Close() error {
+	if reader.body != nil {
+		reader.body.Close()
+		reader.body = nil
+	}
+	return nil
+}
+
+// objectWriter writes an object as an io.WriteCloser. Objects of more than
+// objectPartSize bytes are uploaded in parts as they are written, and those
+// of less when they are closed. The object is only created once it is
+// closed.
+type objectWriter struct {
+	obj      *object
+	buffer   []byte
+	uploadID string
+	parts    []objectPart
+}
+
+type objectPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// createObjectWriter opens the object named by an s3:// or gs:// URL for
+// writing.
+func createObjectWriter(name string) (*objectWriter, error) {
+	obj, err := parseObjectURL(name)
+	if err != nil {
+		return nil, err
+	}
+	return &objectWriter{obj: obj, buffer: make([]byte, 0, objectPartSize)}, nil
+}
+
+func (writer *objectWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := objectPartSize - len(writer.buffer)
+		if n > len(p) {
+			n = len(p)
+		}
+		writer.buffer = append(writer.buffer, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(writer.buffer) == objectPartSize {
+			if err := writer.uploadPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// uploadPart uploads the buffered bytes as the next part of the object,
+// starting a multipart upload with the first part.
+func (writer *objectWriter) uploadPart() error {
+	if writer.uploadID == "" {
+		response, err := writer.obj.do("POST", url.Values{"uploads": {""}}, nil, nil)
+		if err != nil {
+			return fmt.Errorf("error starting upload of %v/%v: %v", writer.obj.bucket, writer.obj.key, err)
+		}
+		defer response.Body.Close()
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := xml.NewDecoder(response.Body).Decode(&result); err != nil || result.UploadID == "" {
+			return fmt.Errorf("error starting upload of %v/%v: no upload id returned", writer.obj.bucket, writer.obj.key)
+		}
+		writer.uploadID = result.UploadID
+	}
+	number := len(writer.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {writer.uploadID}}
+	response, err := writer.obj.do("PUT", query, nil, writer.buffer)
+	if err != nil {
+		return fmt.Errorf("error uploading part %v of %v/%v: %v", number, writer.obj.bucket, writer.obj.key, err)
+	}
+	response.Body.Close()
+	writer.parts = append(writer.parts, objectPart{PartNumber: number, ETag: response.Header.Get("ETag")})
+	writer.buffer = writer.buffer[:0]
+	return nil
+}
+
+// Close creates the object from the bytes written, or aborts its upload if
+// the last of them can't be uploaded.
+func (writer *objectWriter) Close() error {
+	if writer.uploadID == "" {
+		response, err := writer.obj.do("PUT", nil, nil, writer.buffer)
+		if err != nil {
+			return fmt.Errorf("error uploading %v/%v: %v", writer.obj.bucket, writer.obj.key, err)
+		}
+		response.Body.Close()
+		return nil
+	}
+	err := func() error {
+		if len(writer.buffer) > 0 {
+			if err := writer.uploadPart(); err != nil {
+				return err
+			}
+		}
+		complete, err := xml.Marshal(struct {
+			XMLName xml.Name     `xml:"CompleteMultipartUpload"`
+			Parts   []objectPart `xml:"Part"`
+		}{Parts: writer.parts})
+		if err != nil {
+			return err
+		}
+		response, err := writer.obj.do("POST", url.Values{"uploadId": {writer.uploadID}}, nil, complete)
+		if err != nil {
+			return fmt.Errorf("error completing upload of %v/%v: %v", writer.obj.bucket, writer.obj.key, err)
+		}
+		defer response.Body.Close()
+		// the completion can fail after the response started, with an error
+		// in its body
+		var result struct {
+			XMLName xml.Name
+			objectError
+		}
+		if err := xml.NewDecoder(response.Body).Decode(&result); err == nil && result.XMLName.Local == "Error" {
+			result.objectError.Status = response.StatusCode
+			return fmt.Errorf("error completing upload of %v/%v: %v", writer.obj.bucket, writer.obj.key, &result.objectError)
+		}
+		return nil
+	}()
+	if err != nil {
+		if response, abortErr := writer.obj.do("DELETE", url.Values{"uploadId": {writer.uploadID}}, nil, nil); abortErr == nil {
+			response.Body.Close()
+		}
+	}
+	return err
+}
@@ -9,6 +9,7 @@ package mongoreplay
 import (
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/10gen/llmgo"
 )
@@ -99,24 +100,38 @@ func (e ErrUnknownOpcode) Error() string {
 // IsDriverOp checks if an operation is one of the types generated by the driver
 // such as 'ismaster', or 'getnonce'. It takes an Op that has already been
 // unmarshalled using its 'FromReader' method and checks if it is a command
-// matching the ones the driver generates.
+// matching the ones the driver generates. Since 4.4, drivers authenticate
+// speculatively, embedding their saslStart in the hello or isMaster opening
+// a connection as its speculativeAuthenticate field and following it with
+// saslContinue, so those handshakes are driver ops with or without it.
 func IsDriverOp(op Op) bool {
 	var commandType string
 	var opType string
 	switch castOp := op.(type) {
 	case *QueryOp:
 		opType, commandType = extractOpType(castOp.QueryOp.Query)
+		if commandType == "$query" || commandType == "query" {
+			// drivers wrap the handshakes they send to mongos with their
+			// read preference
+			query, _, err := unwrapQuery(castOp.QueryOp.Query)
+			if err != nil {
+				return false
+			}
+			opType, commandType = extractOpType(query)
+		}
 		if opType != "command" {
 			return false
 		}
 	case *CommandOp:
 		commandType = castOp.CommandName
+	case *MsgOp:
+		commandType = castOp.CommandName
 	default:
 		return false
 	}
 
 	switch commandType {
-	case "isMaster", "ismaster":
+	case "hello", "isMaster", "ismaster":
 		return true
 	case "getnonce":
 		return true
@@ -130,3 +145,92 @@ func IsDriverOp(op Op) bool {
 		return false
 	}
 }
+
+// commandNameOf returns the name of the command executed by op, or the empty
+// string if op is not a command. The legacy commands which drivers wrap with
+// their read preference are named after the command they wrap.
+func commandNameOf(op Op) string {
+	switch castOp := op.(type) {
+	case *QueryOp:
+		if !strings.HasSuffix(castOp.Collection, "$cmd") {
+			return ""
+		}
+		query, _, err := unwrapQuery(castOp.QueryOp.Query)
+		if err != nil {
+			return ""
+		}
+		opType, commandName := extractOpType(query)
+		if opType != "command" {
+			return opType
+		}
+		return commandName
+	case *CommandOp:
+		return castOp.CommandName
+	case *CommandGetMore:
+		return castOp.CommandName
+	case *MsgOp:
+		return castOp.CommandName
+	case *MsgOpGetMore:
+		return castOp.CommandName
+	}
+	return ""
+}
+
+// namespaceOf returns the namespace op runs against, as
+// "database.collection", or only the database of the commands which don't
+// run against a collection. It returns the empty string for the ops which
+// have no namespace, such as replies and killCursors.
+func namespaceOf(op Op) string {
+	var db string
+	var body interface{}
+	switch castOp := op.(type) {
+	case *InsertOp:
+		return castOp.Collection
+	case *UpdateOp:
+		return castOp.Collection
+	case *DeleteOp:
+		return castOp.Collection
+	case *GetMoreOp:
+		return castOp.Collection
+	case *QueryOp:
+		if !strings.HasSuffix(castOp.Collection, ".$cmd") {
+			return castOp.Collection
+		}
+		db, body = strings.TrimSuffix(castOp.Collection, ".$cmd"), castOp.Query
+	case *CommandOp:
+		db, body = castOp.Database, castOp.CommandArgs
+	case *CommandGetMore:
+		db, body = castOp.Database, castOp.CommandArgs
+	case *MsgOp:
+		db = castOp.Database
+		if payload, _, err := fetchPayload0Data(castOp.Sections); err == nil {
+			body = payload
+		}
+	case *MsgOpGetMore:
+		db = castOp.Database
+		if payload, _, err := fetchPayload0Data(castOp.Sections); err == nil {
+			body = payload
+		}
+	default:
+		return ""
+	}
+	command, err := bsonToD(body)
+	if err != nil {
+		return db
+	}
+	if value, ok := FindValueByKey("$query", &command); ok {
+		if command, err = bsonToD(value); err != nil {
+			return db
+		}
+	}
+	// the collection is the value of the command, except for getMores
+	commandName := commandNameOf(op)
+	if commandName == "getMore" || commandName == "getmore" {
+		commandName = "collection"
+	}
+	collection, _ := FindValueByKey(commandName, &command)
+	if name, ok := collection.(string); ok && name != "" {
+		return db + "." + name
+	}
+	return db
+}
@@ -0,0 +1,162 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrOpFiltered is returned when an op is not played because only reads or
+// only writes are being played.
+var ErrOpFiltered = fmt.Errorf("op not played by --readsOnly or --writesOnly")
+
+const (
+	// opKindRead is the kind of the queries, read commands and getMores,
+	// which don't modify data.
+	opKindRead = "read"
+	// opKindWrite is the kind of the inserts, updates, deletes and commands
+	// which modify data or collections.
+	opKindWrite = "write"
+)
+
+// writeCommands is the set of commands which modify data, collections or
+// indexes.
+var writeCommands = map[string]bool{
+	"insert":                  true,
+	"update":                  true,
+	"delete":                  true,
+	"findAndModify":           true,
+	"findandmodify":           true,
+	"bulkWrite":               true,
+	"create":                  true,
+	"createIndexes":           true,
+	"dropIndexes":             true,
+	"deleteIndexes":           true,
+	"collMod":                 true,
+	"convertToCapped":         true,
+	"cloneCollectionAsCapped": true,
+	"emptycapped":             true,
+	"compact":                 true,
+	"applyOps":                true,
+	"commitTransaction":       true,
+	"abortTransaction":        true,
+	"drop":                    true,
+	"dropDatabase":            true,
+	"renameCollection":        true,
+}
+
+// cursorCommands is the set of commands which continue or close the cursors
+// of reads.
+var cursorCommands = map[string]bool{
+	"getMore":     true,
+	"killCursors": true,
+	"explain":     true,
+}
+
+// opKindOf classifies an op as a read or a write, returning "" for ops
+// which are neither, such as handshakes, authentication and administrative
+// commands, and which are played whichever kind is being played.
+func opKindOf(op Op) string {
+	switch castOp := op.(type) {
+	case *InsertOp, *UpdateOp, *DeleteOp:
+		return opKindWrite
+	case *GetMoreOp, *KillCursorsOp, *CommandGetMore, *MsgOpGetMore:
+		return opKindRead
+	case *QueryOp:
+		if !strings.HasSuffix(castOp.Collection, "$cmd") {
+			return opKindRead
+		}
+	}
+	commandName := commandNameOf(op)
+	switch {
+	case commandName == "aggregate" || commandName == "mapReduce" || commandName == "mapreduce":
+		// aggregations with $out or $merge and map-reduces with an output
+		// collection write their results
+		if writesResults(op, commandName) {
+			return opKindWrite
+		}
+		return opKindRead
+	case writeCommands[commandName]:
+		return opKindWrite
+	case readCommands[commandName] || cursorCommands[commandName]:
+		return opKindRead
+	}
+	return ""
+}
+
+// writesResults returns whether an aggregate or map-reduce command writes
+// its results to a collection.
+func writesResults(op Op, commandName string) bool {
+	var body interface{}
+	switch castOp := op.(type) {
+	case *QueryOp:
+		body = castOp.Query
+	case *CommandOp:
+		body = castOp.CommandArgs
+	case *MsgOp:
+		payload, _, err := fetchPayload0Data(castOp.Sections)
+		if err != nil {
+			return false
+		}
+		body = payload
+	}
+	command, err := bsonToD(body)
+	if err != nil {
+		return false
+	}
+	if value, ok := FindValueByKey("$query", &command); ok {
+		if command, err = bsonToD(value); err != nil {
+			return false
+		}
+	}
+	if commandName != "aggregate" {
+		out, ok := FindValueByKey("out", &command)
+		if !ok {
+			return false
+		}
+		// {out: {inline: 1}} returns the results
+		outDoc, err := bsonToD(out)
+		if err != nil {
+			return true
+		}
+		_, inline := FindValueByKey("inline", &outDoc)
+		return !inline
+	}
+	pipeline, ok := FindValueByKey("pipeline", &command)
+	if !ok {
+		return false
+	}
+	stages, ok := pipeline.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, stage := range stages {
+		stageDoc, err := bsonToD(stage)
+		if err != nil || len(stageDoc) == 0 {
+			continue
+		}
+		if stageDoc[0].Name == "$out" || stageDoc[0].Name == "$merge" {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePlayOnly returns the kind of ops played when --readsOnly or
+// --writesOnly is set, or "" if every op is played.
+func parsePlayOnly(readsOnly, writesOnly bool) (string, error) {
+	switch {
+	case readsOnly && writesOnly:
+		return "", fmt.Errorf("--readsOnly and --writesOnly cannot be used together")
+	case readsOnly:
+		return opKindRead, nil
+	case writesOnly:
+		return opKindWrite, nil
+	}
+	return "", nil
+}
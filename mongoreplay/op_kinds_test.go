@@ -0,0 +1,121 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestOpKindOf(t *testing.T) {
+	msgOp := func(commandName string, body bson.D) *MsgOp {
+		raw, err := dToRaw(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &MsgOp{CommandName: commandName, MsgOp: mgo.MsgOp{Sections: []mgo.MsgSection{{PayloadType: mgo.MsgPayload0, Data: raw}}}}
+	}
+	type testCase struct {
+		name     string
+		op       Op
+		expected string
+	}
+	cases := []testCase{
+		{name: "legacy insert", op: &InsertOp{}, expected: opKindWrite},
+		{name: "legacy update", op: &UpdateOp{}, expected: opKindWrite},
+		{name: "legacy query", op: &QueryOp{QueryOp: mgo.QueryOp{Collection: "test.c", Query: bson.D{}}}, expected: opKindRead},
+		{name: "legacy getMore", op: &GetMoreOp{}, expected: opKindRead},
+		{
+			name:     "insert command in a query",
+			op:       &QueryOp{QueryOp: mgo.QueryOp{Collection: "test.$cmd", Query: bson.D{{"insert", "c"}}}},
+			expected: opKindWrite,
+		},
+		{
+			name:     "count command in a query",
+			op:       &QueryOp{QueryOp: mgo.QueryOp{Collection: "test.$cmd", Query: bson.D{{"count", "c"}}}},
+			expected: opKindRead,
+		},
+		{name: "find", op: msgOp("find", bson.D{{"find", "c"}}), expected: opKindRead},
+		{name: "getMore", op: msgOp("getMore", bson.D{{"getMore", int64(1)}}), expected: opKindRead},
+		{name: "findAndModify", op: msgOp("findAndModify", bson.D{{"findAndModify", "c"}}), expected: opKindWrite},
+		{name: "createIndexes", op: msgOp("createIndexes", bson.D{{"createIndexes", "c"}}), expected: opKindWrite},
+		{
+			name:     "aggregate",
+			op:       msgOp("aggregate", bson.D{{"aggregate", "c"}, {"pipeline", []interface{}{bson.D{{"$match", bson.D{}}}}}}),
+			expected: opKindRead,
+		},
+		{
+			name: "aggregate with $merge",
+			op: msgOp("aggregate", bson.D{{"aggregate", "c"}, {"pipeline", []interface{}{
+				bson.D{{"$match", bson.D{}}}, bson.D{{"$merge", bson.D{{"into", "d"}}}}}}}),
+			expected: opKindWrite,
+		},
+		{
+			name:     "inline mapReduce",
+			op:       msgOp("mapReduce", bson.D{{"mapReduce", "c"}, {"out", bson.D{{"inline", 1}}}}),
+			expected: opKindRead,
+		},
+		{
+			name:     "mapReduce to a collection",
+			op:       msgOp("mapReduce", bson.D{{"mapReduce", "c"}, {"out", "d"}}),
+			expected: opKindWrite,
+		},
+		{name: "isMaster", op: msgOp("isMaster", bson.D{{"isMaster", 1}}), expected: ""},
+		{name: "saslStart", op: msgOp("saslStart", bson.D{{"saslStart", 1}}), expected: ""},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		if kind := opKindOf(c.op); kind != c.expected {
+			t.Errorf("expected kind '%v', saw '%v'", c.expected, kind)
+		}
+	}
+}
+
+func TestParsePlayOnly(t *testing.T) {
+	if kind, err := parsePlayOnly(false, false); err != nil || kind != "" {
+		t.Errorf("expected every op to be played, saw '%v', %v", kind, err)
+	}
+	if kind, err := parsePlayOnly(true, false); err != nil || kind != opKindRead {
+		t.Errorf("expected only reads to be played, saw '%v', %v", kind, err)
+	}
+	if kind, err := parsePlayOnly(false, true); err != nil || kind != opKindWrite {
+		t.Errorf("expected only writes to be played, saw '%v', %v", kind, err)
+	}
+	if _, err := parsePlayOnly(true, true); err == nil {
+		t.Errorf("expected --readsOnly and --writesOnly to be rejected together")
+	}
+}
+
+func TestPlayReadsOnly(t *testing.T) {
+	for _, playOnly := range []string{opKindRead, opKindWrite} {
+		t.Logf("running case: %s", playOnly)
+		numInserts := 4
+		generator := newRecordedOpGenerator()
+		go func() {
+			defer close(generator.opChan)
+			if err := generator.generateMsgOpInsertHelper("kinds", 0, numInserts); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		statCollector, _ := NewStatCollector(StatOptions{}, "none", true, true)
+		context := NewExecutionContext(statCollector, nil, &ExecutionOptions{fullSpeed: true, dryRun: true, playOnly: playOnly})
+		if err := Play(context, generator.opChan, 1, 1, 10); err != nil {
+			t.Fatalf("error playing traffic: %v", err)
+		}
+		expectedPlayed, expectedFiltered := int64(0), int64(numInserts)
+		if playOnly == opKindWrite {
+			expectedPlayed, expectedFiltered = int64(numInserts), 0
+		}
+		if played, filtered := context.DryRunOps(), context.FilteredOps(); played != expectedPlayed || filtered != expectedFiltered {
+			t.Errorf("expected %v inserts to be played and %v not, saw %v and %v",
+				expectedPlayed, expectedFiltered, played, filtered)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// PacingStrategy determines when each op of a playback is to be executed.
+// Play calls Start once with the first op of the playback and then PlayAt
+// once for every op, in the order in which they are read from the playback
+// file.
+type PacingStrategy interface {
+	// Start is called with the time at which playback begins and the first op
+	// that will be played.
+	Start(playbackStart time.Time, firstOp *RecordedOp)
+
+	// PlayAt returns the time at which the op should be played.
+	PlayAt(op *RecordedOp) time.Time
+}
+
+// PacingObserver may be implemented by a PacingStrategy that adjusts its
+// schedule based on how playback is actually proceeding. ObservePlayed is
+// called from the connection goroutines after each op has been executed, so
+// it must be safe for concurrent use.
+type PacingObserver interface {
+	ObservePlayed(op *RecordedOp)
+}
+
+// RecordedPacing plays ops following the timing of the recording, scaled by
+// Speed. This is the default strategy.
+type RecordedPacing struct {
+	Speed float64
+
+	recordingStart, playbackStart time.Time
+}
+
+// Start implements the PacingStrategy interface.
+func (p *RecordedPacing) Start(playbackStart time.Time, firstOp *RecordedOp) {
+	p.playbackStart = playbackStart
+	p.recordingStart = firstOp.Seen.Time
+}
+
+// PlayAt implements the PacingStrategy interface.
+func (p *RecordedPacing) PlayAt(op *RecordedOp) time.Time {
+	// opDelta is the difference in time between when the file's recording
+	// began and and when this particular op is played. For the first
+	// operation in the playback, it's 0.
+	opDelta := op.Seen.Sub(p.recordingStart)
+
+	// Adjust the opDelta for playback by dividing it by playback speed setting;
+	// e.g. 2x speed means the delta is half as long.
+	scaledDelta := float64(opDelta) / p.Speed
+	return p.playbackStart.Add(time.Duration(int64(scaledDelta)))
+}
+
+// FixedRatePacing ignores the recorded timing and plays ops evenly spaced at
+// OpsPerSecond.
+type FixedRatePacing struct {
+	OpsPerSecond float64
+
+	playbackStart time.Time
+	count         int64
+}
+
+// Start implements the PacingStrategy interface.
+func (p *FixedRatePacing) Start(playbackStart time.Time, firstOp *RecordedOp) {
+	p.playbackStart = playbackStart
+	p.count = 0
+}
+
+// PlayAt implements the PacingStrategy interface.
+func (p *FixedRatePacing) PlayAt(op *RecordedOp) time.Time {
+	delta := time.Duration(float64(p.count) / p.OpsPerSecond * float64(time.Second))
+	p.count++
+	return p.playbackStart.Add(delta)
+}
+
+// PoissonPacing ignores the recorded timing and plays ops as a Poisson
+// process averaging OpsPerSecond, i.e. with exponentially distributed gaps
+// between ops. If Rand is nil, a source seeded with the playback start time
+// is used.
+type PoissonPacing struct {
+	OpsPerSecond float64
+	Rand         *rand.Rand
+
+	next time.Time
+}
+
+// Start implements the PacingStrategy interface.
+func (p *PoissonPacing) Start(playbackStart time.Time, firstOp *RecordedOp) {
+	if p.Rand == nil {
+		p.Rand = rand.New(rand.NewSource(playbackStart.UnixNano()))
+	}
+	p.next = playbackStart
+}
+
+// PlayAt implements the PacingStrategy interface.
+func (p *PoissonPacing) PlayAt(op *RecordedOp) time.Time {
+	playAt := p.next
+	gap := p.Rand.ExpFloat64() / p.OpsPerSecond
+	p.next = p.next.Add(time.Duration(gap * float64(time.Second)))
+	return playAt
+}
+
+// AdaptivePacing follows the recorded timing like RecordedPacing, but when
+// executed ops fall behind their schedule by more than MaxLag, the remainder
+// of the schedule is pushed back by the lag observed. This preserves the
+// recorded gaps between ops instead of playing every late op back to back
+// in an attempt to catch up.
+type AdaptivePacing struct {
+	Speed  float64
+	MaxLag time.Duration
+
+	recorded RecordedPacing
+	mutex    sync.Mutex
+	offset   time.Duration
+}
+
+// Start implements the PacingStrategy interface.
+func (p *AdaptivePacing) Start(playbackStart time.Time, firstOp *RecordedOp) {
+	p.recorded.Speed = p.Speed
+	p.recorded.Start(playbackStart, firstOp)
+	p.mutex.Lock()
+	p.offset = 0
+	p.mutex.Unlock()
+}
+
+// PlayAt implements the PacingStrategy interface.
+func (p *AdaptivePacing) PlayAt(op *RecordedOp) time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.recorded.PlayAt(op).Add(p.offset)
+}
+
+// ObservePlayed implements the PacingObserver interface.
+func (p *AdaptivePacing) ObservePlayed(op *RecordedOp) {
+	if op.PlayedAt == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// The lag is measured against the schedule including the current offset
+	// rather than against op.PlayAt, since ops dispatched before the offset
+	// last changed would otherwise have their lag accounted for twice.
+	lag := op.PlayedAt.Sub(p.recorded.PlayAt(op).Add(p.offset))
+	if lag <= p.MaxLag {
+		return
+	}
+	p.offset += lag - p.MaxLag
+	toolDebugLogger.Logvf(DebugLow, "Adaptive pacing pushing back schedule by %v", p.offset)
+}
+
+// defaultAdaptiveMaxLag is the lag tolerated by AdaptivePacing when created
+// from the command line.
+const defaultAdaptiveMaxLag = 100 * time.Millisecond
+
+// newPacingStrategy creates the PacingStrategy named by the --pacing option.
+func newPacingStrategy(name string, speed, rate float64) (PacingStrategy, error) {
+	switch name {
+	case "", "recorded":
+		return &RecordedPacing{Speed: speed}, nil
+	case "adaptive":
+		return &AdaptivePacing{Speed: speed, MaxLag: defaultAdaptiveMaxLag}, nil
+	case "fixed", "poisson":
+		if rate <= 0 {
+			return nil, fmt.Errorf("pacing '%v' requires a positive --rate", name)
+		}
+		if name == "fixed" {
+			return &FixedRatePacing{OpsPerSecond: rate}, nil
+		}
+		return &PoissonPacing{OpsPerSecond: rate}, nil
+	}
+	return nil, fmt.Errorf("unknown pacing strategy '%v'", name)
+}
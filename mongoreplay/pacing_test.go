@@ -0,0 +1,65 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"testing"
+	"time"
+)
+
+func opSeenAt(t time.Time) *RecordedOp {
+	return &RecordedOp{Seen: &PreciseTime{t}}
+}
+
+func TestRecordedAndFixedRatePacing(t *testing.T) {
+	recordingStart := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	playbackStart := time.Now()
+	ops := []*RecordedOp{
+		opSeenAt(recordingStart),
+		opSeenAt(recordingStart.Add(2 * time.Second)),
+		opSeenAt(recordingStart.Add(10 * time.Second)),
+	}
+
+	recorded := &RecordedPacing{Speed: 2}
+	recorded.Start(playbackStart, ops[0])
+	for i, expected := range []time.Duration{0, time.Second, 5 * time.Second} {
+		if delta := recorded.PlayAt(ops[i]).Sub(playbackStart); delta != expected {
+			t.Errorf("recorded pacing op %d: expected delta %v, saw %v", i, expected, delta)
+		}
+	}
+
+	fixed := &FixedRatePacing{OpsPerSecond: 4}
+	fixed.Start(playbackStart, ops[0])
+	for i, expected := range []time.Duration{0, 250 * time.Millisecond, 500 * time.Millisecond} {
+		if delta := fixed.PlayAt(ops[i]).Sub(playbackStart); delta != expected {
+			t.Errorf("fixed pacing op %d: expected delta %v, saw %v", i, expected, delta)
+		}
+	}
+}
+
+func TestAdaptivePacingPushesBackSchedule(t *testing.T) {
+	recordingStart := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	playbackStart := time.Now()
+	first := opSeenAt(recordingStart)
+
+	pacing := &AdaptivePacing{Speed: 1, MaxLag: 100 * time.Millisecond}
+	pacing.Start(playbackStart, first)
+
+	// the first op is played a full second late
+	first.PlayAt = &PreciseTime{pacing.PlayAt(first)}
+	first.PlayedAt = &PreciseTime{first.PlayAt.Add(time.Second)}
+	pacing.ObservePlayed(first)
+
+	// reporting the same op again must not push the schedule back further
+	pacing.ObservePlayed(first)
+
+	second := opSeenAt(recordingStart.Add(time.Second))
+	expected := 2*time.Second - 100*time.Millisecond
+	if delta := pacing.PlayAt(second).Sub(playbackStart); delta != expected {
+		t.Errorf("expected delta %v after lag, saw %v", expected, delta)
+	}
+}
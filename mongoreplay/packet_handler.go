@@ -8,27 +8,35 @@ package mongoreplay
 
 import (
 	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/tcpassembly"
 )
 
-// PacketHandler wraps pcap.Handle to maintain other useful information.
+// PacketHandler wraps a captureSource to maintain other useful information.
 type PacketHandler struct {
 	Verbose          bool
-	pcap             *pcap.Handle
+	source           captureSource
 	assemblerOptions AssemblerOptions
 	numDropped       int64
 	stop             chan struct{}
+	stopOnce         sync.Once
+
+	// packetsCaptured and bufferOverflows are published by Handle for the
+	// capture stats, which are read from other goroutines.
+	packetsCaptured int64
+	bufferOverflows int64
+	spooledPages    int64
 }
 
 // NewPacketHandler initializes a new PacketHandler
-func NewPacketHandler(pcapHandle *pcap.Handle, assemblerOptions AssemblerOptions) *PacketHandler {
+func NewPacketHandler(source captureSource, assemblerOptions AssemblerOptions) *PacketHandler {
 	return &PacketHandler{
-		pcap:             pcapHandle,
+		source:           source,
 		assemblerOptions: assemblerOptions,
 		stop:             make(chan struct{}),
 	}
@@ -46,16 +54,72 @@ type SetFirstSeener interface {
 	SetFirstSeen(t time.Time)
 }
 
-// Close stops the packetHandler
+// Close stops the packetHandler. It may be called more than once, and
+// after Handle has returned.
 func (p *PacketHandler) Close() {
-	p.stop <- struct{}{}
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
 }
 
-func bookkeep(pktCount uint, pkt gopacket.Packet, assembler *Assembler) {
+func (p *PacketHandler) bookkeep(pktCount uint, pkt gopacket.Packet, assembler *Assembler) {
 	if pkt != nil {
 		userInfoLogger.Logvf(DebugLow, "processed packet %7.v with timestamp %v", pktCount, pkt.Metadata().Timestamp.Format(time.RFC3339))
 		assembler.FlushOlderThan(pkt.Metadata().CaptureInfo.Timestamp.Add(time.Minute * -5))
 	}
+	p.publishStats(int64(pktCount), assembler)
+}
+
+// publishStats makes the number of packets handled, and the buffer overflows
+// and spooled pages of the assembler, available to the capture stats.
+func (p *PacketHandler) publishStats(packets int64, assembler *Assembler) {
+	atomic.StoreInt64(&p.packetsCaptured, packets)
+	atomic.StoreInt64(&p.bufferOverflows, assembler.bufferOverflows)
+	atomic.StoreInt64(&p.spooledPages, assembler.spooledPages)
+}
+
+// assemblePacket passes the TCP segment of a packet, if it has one, to the
+// assembler. Connections are keyed by the IPv4 or IPv6 addresses of their
+// network layer as well as by their ports.
+func assemblePacket(assembler *Assembler, pkt gopacket.Packet) {
+	tcpLayer := pkt.Layer(layers.LayerTypeTCP)
+	if tcpLayer == nil || pkt.NetworkLayer() == nil {
+		return
+	}
+	tcp := tcpLayer.(*layers.TCP)
+	userInfoLogger.Logv(DebugHigh, "Assembling TCP layer")
+	// TODO: use time.Now() here when running in realtime mode
+	if length := sentPayloadLength(pkt, tcp); length > len(tcp.Payload) {
+		userInfoLogger.Logvf(DebugHigh, "TCP payload truncated to %v of %v bytes", len(tcp.Payload), length)
+		assembler.AssembleTruncated(pkt.NetworkLayer().NetworkFlow(), tcp, length, pkt.Metadata().Timestamp)
+		return
+	}
+	assembler.AssembleWithTimestamp(pkt.NetworkLayer().NetworkFlow(), tcp, pkt.Metadata().Timestamp)
+}
+
+// sentPayloadLength returns the length of the TCP payload of a packet as it
+// was sent, according to its IP header, which is more than was captured if
+// the packet was truncated by the capture's snaplen.
+func sentPayloadLength(pkt gopacket.Packet, tcp *layers.TCP) int {
+	var missing int
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		missing = int(ip.Length) - int(ip.IHL)*4 - len(ip.Payload)
+	case *layers.IPv6:
+		// the length of IPv6 jumbograms is in an extension header
+		if ip.Length == 0 {
+			return len(tcp.Payload)
+		}
+		missing = int(ip.Length) - len(ip.Payload)
+	default:
+		return len(tcp.Payload)
+	}
+	// the payload of the IP layer may hold extension headers as well as the
+	// TCP segment, so only the bytes missing from it are added
+	if missing <= 0 {
+		return len(tcp.Payload)
+	}
+	return len(tcp.Payload) + missing
 }
 
 // Handle reads the pcap file into assembled packets for the streamHandler
@@ -65,7 +129,6 @@ func (p *PacketHandler) Handle(streamHandler StreamHandler, numToHandle int) err
 	if p.Verbose && numToHandle > 0 {
 		userInfoLogger.Logvf(Always, "Processing", numToHandle, "packets")
 	}
-	source := gopacket.NewPacketSource(p.pcap, p.pcap.LinkType())
 	streamPool := NewStreamPool(streamHandler)
 	assembler := NewAssembler(streamPool)
 	assembler.AssemblerOptions = p.assemblerOptions
@@ -78,6 +141,10 @@ func (p *PacketHandler) Handle(streamHandler StreamHandler, numToHandle int) err
 		} else {
 			assembler.FlushAll()
 		}
+		p.publishStats(count, assembler)
+		if err := assembler.RemoveSpool(); err != nil {
+			userInfoLogger.Logvf(Always, "Error removing spool file: %v", err)
+		}
 		streamHandler.Close()
 	}()
 	defer func() {
@@ -92,19 +159,13 @@ func (p *PacketHandler) Handle(streamHandler StreamHandler, numToHandle int) err
 	var pktCount uint
 	for {
 		select {
-		case pkt = <-source.Packets():
+		case pkt = <-p.source.Packets():
 			pktCount++
 			if pkt == nil { // end of pcap file
 				userInfoLogger.Logv(DebugLow, "Reached end of stream")
-				return nil
-			}
-			if tcpLayer := pkt.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-				userInfoLogger.Logv(DebugHigh, "Assembling TCP layer")
-				assembler.AssembleWithTimestamp(
-					pkt.TransportLayer().TransportFlow(),
-					tcpLayer.(*layers.TCP),
-					pkt.Metadata().Timestamp) // TODO: use time.Now() here when running in realtime mode
+				return p.source.Err()
 			}
+			assemblePacket(assembler, pkt)
 			if count == 0 {
 				if firstSeener, ok := streamHandler.(SetFirstSeener); ok {
 					firstSeener.SetFirstSeen(pkt.Metadata().Timestamp)
@@ -117,11 +178,11 @@ func (p *PacketHandler) Handle(streamHandler StreamHandler, numToHandle int) err
 			}
 			select {
 			case <-ticker:
-				bookkeep(pktCount, pkt, assembler)
+				p.bookkeep(pktCount, pkt, assembler)
 			default:
 			}
 		case <-ticker:
-			bookkeep(pktCount, pkt, assembler)
+			p.bookkeep(pktCount, pkt, assembler)
 		case <-p.stop:
 			return nil
 		}
@@ -19,10 +19,14 @@ type parallelFileReadManager struct {
 	workerResultManagers            []workerResultManager
 	stopChan                        chan struct{}
 	currentWorkerResultManagerIndex int
+
+	// captureStats are those of the trailer of the file, once it is read.
+	captureStats *CaptureStats
 }
 
 type parseJob struct {
 	rawDoc              []byte
+	offset              int64
 	workerResultManager workerResultManager
 }
 
@@ -32,11 +36,13 @@ type workerResultManager struct {
 }
 
 type recordedOpResult struct {
-	recordedOp *RecordedOp
-	err        error
+	recordedOp   *RecordedOp
+	captureStats *CaptureStats
+	footer       bool
+	err          error
 }
 
-func (pm *parallelFileReadManager) runFileReader(numWorkers int, reader io.Reader) {
+func (pm *parallelFileReadManager) runFileReader(numWorkers int, reader io.Reader, offset int64) {
 	currentWorkerResultManagerIndex := 0
 	go func() {
 		defer close(pm.parseJobsChan)
@@ -56,8 +62,10 @@ func (pm *parallelFileReadManager) runFileReader(numWorkers int, reader io.Reade
 			<-currentWorkerResultManager.available
 			pm.parseJobsChan <- &parseJob{
 				rawDoc:              nextDoc,
+				offset:              offset,
 				workerResultManager: currentWorkerResultManager,
 			}
+			offset += int64(len(nextDoc))
 		}
 	}()
 }
@@ -80,12 +88,24 @@ func (pm *parallelFileReadManager) runParsePool(numWorkers int) {
 func runParseWorker(parseJobsChan chan *parseJob, wg *sync.WaitGroup, stop chan struct{}) {
 	defer wg.Done()
 	for parseJob := range parseJobsChan {
-		doc := new(RecordedOp)
-		err := bson.Unmarshal(parseJob.rawDoc, doc)
-
-		result := &recordedOpResult{
-			err:        err,
-			recordedOp: doc,
+		var result *recordedOpResult
+		if isPlaybackFileFooter(parseJob.rawDoc) {
+			result = &recordedOpResult{footer: true}
+		} else if isPlaybackFileTrailer(parseJob.rawDoc) {
+			trailer := new(playbackFileTrailer)
+			err := bson.Unmarshal(parseJob.rawDoc, trailer)
+			result = &recordedOpResult{
+				err:          err,
+				captureStats: &trailer.CaptureStats,
+			}
+		} else {
+			doc := new(RecordedOp)
+			err := bson.Unmarshal(parseJob.rawDoc, doc)
+			doc.Offset = parseJob.offset
+			result = &recordedOpResult{
+				err:        err,
+				recordedOp: doc,
+			}
 		}
 
 		select {
@@ -101,8 +121,9 @@ func runParseWorker(parseJobsChan chan *parseJob, wg *sync.WaitGroup, stop chan
 // begin initiates all aspects of the parallelFileReadManager. begin sets up the
 // channels that work will be communicated on, starts the goroutine that will
 // read through the file, and spawns the pool of goroutines that will parse
-// the file in parallel.
-func (pm *parallelFileReadManager) begin(numWorkers int, reader io.Reader) {
+// the file in parallel. offset is the position in the file of the first
+// document read from reader.
+func (pm *parallelFileReadManager) begin(numWorkers int, reader io.Reader, offset int64) {
 	pm.workerResultManagers = make([]workerResultManager, numWorkers)
 	for i := 0; i < numWorkers; i++ {
 		pm.workerResultManagers[i] = workerResultManager{
@@ -115,22 +136,32 @@ func (pm *parallelFileReadManager) begin(numWorkers int, reader io.Reader) {
 	pm.parseJobsChan = make(chan *parseJob, numWorkers)
 	pm.stopChan = make(chan struct{})
 
-	pm.runFileReader(numWorkers, reader)
+	pm.runFileReader(numWorkers, reader, offset)
 	pm.runParsePool(numWorkers)
 }
 
 // next is the function to be called to fetch each document from the file reader.
-// It returns the next document parsed from the input file. next is not safe to
-// call from a multi-threaded context.
+// It returns the next document parsed from the input file, keeping the capture
+// stats of its trailer rather than returning them, and skipping its integrity
+// footer. next is not safe to call from a multi-threaded context.
 func (pm *parallelFileReadManager) next() (*RecordedOp, error) {
-	currentWorkerResultManager := pm.workerResultManagers[pm.currentWorkerResultManagerIndex]
-	recordedOpResult := <-currentWorkerResultManager.resultChan
-	if recordedOpResult == nil {
-		return nil, io.EOF
-	}
+	for {
+		currentWorkerResultManager := pm.workerResultManagers[pm.currentWorkerResultManagerIndex]
+		recordedOpResult := <-currentWorkerResultManager.resultChan
+		if recordedOpResult == nil {
+			return nil, io.EOF
+		}
 
-	pm.currentWorkerResultManagerIndex = (pm.currentWorkerResultManagerIndex + 1) % len(pm.workerResultManagers)
-	return recordedOpResult.recordedOp, recordedOpResult.err
+		pm.currentWorkerResultManagerIndex = (pm.currentWorkerResultManagerIndex + 1) % len(pm.workerResultManagers)
+		if recordedOpResult.captureStats != nil && recordedOpResult.err == nil {
+			pm.captureStats = recordedOpResult.captureStats
+			continue
+		}
+		if recordedOpResult.footer {
+			continue
+		}
+		return recordedOpResult.recordedOp, recordedOpResult.err
+	}
 }
 
 func (pm *parallelFileReadManager) err() error {
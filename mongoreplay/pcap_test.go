@@ -215,7 +215,7 @@ func pcapTestHelper(t *testing.T, pcapFname string, preprocess bool, verifier ve
 		t.Error(err)
 	}
 
-	statCollector, _ := newStatCollector(testCollectorOpts, "format", true, true)
+	statCollector, _ := NewStatCollector(testCollectorOpts, "format", true, true)
 	statRec := statCollector.StatRecorder.(*BufferedStatRecorder)
 	replaySession, err := mgo.Dial(currentTestURL)
 	if err != nil {
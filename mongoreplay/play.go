@@ -7,39 +7,398 @@
 package mongoreplay
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+	"github.com/mongodb/mongo-tools/common/signals"
 )
 
 // PlayCommand stores settings for the mongoreplay 'play' subcommand
 type PlayCommand struct {
 	GlobalOpts *Options `no-flag:"true"`
 	StatOptions
-	PlaybackFile string  `description:"path to the playback file to play from" short:"p" long:"playback-file" required:"yes"`
-	Speed        float64 `description:"multiplier for playback speed (1.0 = real-time, .5 = half-speed, 3.0 = triple-speed, etc.)" long:"speed" default:"1.0"`
-	URL          string  `short:"h" long:"host" env:"MONGOREPLAY_HOST" description:"Location of the host to play back against" default:"mongodb://localhost:27017"`
-	Repeat       int     `long:"repeat" description:"Number of times to play the playback file" default:"1"`
-	QueueTime    int     `long:"queueTime" description:"don't queue ops much further in the future than this number of seconds" default:"15"`
-	NoPreprocess bool    `long:"no-preprocess" description:"don't preprocess the input file to premap data such as mongo cursorIDs"`
-	Gzip         bool    `long:"gzip" description:"decompress gzipped input"`
-	Collect      string  `long:"collect" description:"Stat collection format; 'format' option uses the --format string" choice:"json" choice:"format" choice:"none" default:"none"`
-	FullSpeed    bool    `long:"fullSpeed" description:"run the playback as fast as possible"`
+	DialOptions
+	ConnectionOptions
+	PlaybackFile       string   `description:"path to the playback file to play from" short:"p" long:"playback-file"`
+	Speed              float64  `description:"multiplier for playback speed (1.0 = real-time, .5 = half-speed, 3.0 = triple-speed, etc.)" long:"speed" default:"1.0"`
+	MirrorHost         string   `long:"mirrorHost" description:"Location of a second host to send every op to at the same time as --host, comparing the latencies and replies of the two"`
+	Repeat             int      `long:"repeat" description:"Number of times to play the playback file" default:"1"`
+	Amplify            int      `long:"amplify" description:"play each recorded connection this number of times in parallel, each copy with its own connections, cursors and sessions and with new ObjectIds for the _ids of its inserts" default:"1"`
+	QueueTime          int      `long:"queueTime" description:"don't queue ops much further in the future than this number of seconds" default:"15"`
+	Checkpoint         string   `long:"checkpoint" description:"periodically save the progress of the playback to this file, so that it can be resumed with --resumeFrom"`
+	CheckpointInterval int      `long:"checkpointInterval" description:"number of seconds between writes of the --checkpoint file" default:"60"`
+	ResumeFrom         string   `long:"resumeFrom" description:"resume an interrupted playback from the checkpoint file it was saving progress to"`
+	DrainTimeout       int      `long:"drainTimeout" description:"number of seconds an interrupted playback waits for the ops in flight to complete before closing their connections" default:"10"`
+	OpTimeout          int      `long:"opTimeout" description:"number of seconds an op waits for its reply before its connection is considered failed; 0 waits indefinitely"`
+	Timeout            int      `long:"timeout" description:"number of seconds after which the playback stops as if it was interrupted; 0 plays it to the end"`
+	Retries            int      `long:"retries" description:"number of times a read, or a write carrying a txnNumber, which fails with a network error or a transient server error, such as a primary stepping down, is sent again, on a new connection after a network error"`
+	RetryBackoff       int      `long:"retryBackoff" description:"number of milliseconds before the first retry of an op, doubling for every further retry" default:"100"`
+	CursorNotFound     string   `long:"cursorNotFound" description:"how the getMores of cursors not found on the server, such as those the live queries exhausted with fewer results than recorded, are handled; 'error' plays them, 'skip' skips and counts them, 'reissue' plays the query which created the cursor again, 'abort' stops the playback with an error" choice:"error" choice:"skip" choice:"reissue" choice:"abort" default:"error"`
+	ConnectionModel    string   `long:"connectionModel" description:"how the recorded connections are mapped to live connections; 'perConnection' opens a live connection for each recorded one, 'pool' plays each op on whichever connection of a shared pool of --poolSize connections is free, 'affinity' plays the ops of each recorded connection on one of --poolSize connections chosen by hashing it" choice:"perConnection" choice:"pool" choice:"affinity" default:"perConnection"`
+	PoolSize           int      `long:"poolSize" description:"number of live connections shared by the recorded connections with --connectionModel=pool or affinity" default:"100"`
+	MaxConnsPerTarget  int      `long:"maxConnsPerTarget" description:"maximum number of live connections opened to --host, and to --mirrorHost, at a time; once reached, further recorded connections wait for an idle one to be closed; 0 doesn't limit them"`
+	WorkersPerHost     int      `long:"workersPerHost" description:"maximum number of ops played against --host, and against --mirrorHost, at a time; once reached, further ops wait for one to complete; 0 doesn't limit them"`
+	MaxAwait           int      `long:"maxAwait" description:"maximum number of milliseconds a getMore of a tailable awaitData cursor waits for new results; 0 waits as recorded"`
+	TailableBudget     int      `long:"tailableBudget" description:"number of seconds the getMores of each tailable cursor may take in total, after which its further getMores are skipped; 0 doesn't limit them"`
+	ChangeStreamResume string   `long:"changeStreamResume" description:"how change streams resuming from a recorded position are played; 'remap' resumes them from the live position reached where the recording reached their resume token, restarting them from now when there is none, 'now' restarts them from now, 'recorded' plays their resume options unmodified" choice:"remap" choice:"now" choice:"recorded" default:"remap"`
+	StrictOrder        bool     `long:"strictOrder" description:"play the ops of each recorded connection strictly in order, each op waiting until the previous one is acknowledged, with legacy writes followed by getLastError, and stop playing a connection once one of its ops fails with a network error"`
+	Translate          bool     `long:"translate" description:"play legacy OP_INSERT, OP_UPDATE, OP_DELETE, OP_QUERY and OP_GET_MORE ops as the equivalent insert, update, delete, find and getMore commands, for servers which no longer support the legacy opcodes"`
+	Downconvert        bool     `long:"downconvert" description:"play OP_MSG find, getMore and insert commands as the equivalent legacy OP_QUERY, OP_GET_MORE and OP_INSERT ops, for servers which predate OP_MSG; commands using options the legacy ops can't express are played as recorded"`
+	Warmup             int      `long:"warmup" description:"before playback begins, open and authenticate the connections needed to play this number of seconds of the playback file"`
+	Progress           bool     `long:"progress" description:"periodically log the ops played, the speed of the playback relative to the recording and, unless --no-preprocess is set, the share of the playback file played and the projected completion time"`
+	ProgressInterval   int      `long:"progressInterval" description:"number of seconds between the reports of --progress" default:"10"`
+	TUI                bool     `long:"tui" description:"show a dashboard of the playback refreshed in place every second, with the rate of ops played, the errors, the lag behind the recorded timeline, sparklines of the rate, latency and lag, and a breakdown by op; pressing 'q' stops the playback"`
+	NoDetect           bool     `long:"no-detect" description:"don't detect the version of the server before playback, which chooses the opcodes ops are played as and warns about the ops the server can't accept"`
+	NoPreprocess       bool     `long:"no-preprocess" description:"don't preprocess the input file to premap data such as mongo cursorIDs"`
+	Gzip               bool     `long:"gzip" description:"decompress gzipped input"`
+	Collect            string   `long:"collect" description:"Stat collection format: json, csv, prometheus, mongodb, sqlite or none, or format to use the --format string" default:"none"`
+	FullSpeed          bool     `long:"fullSpeed" description:"run the playback as fast as possible"`
+	DryRun             bool     `long:"dryRun" description:"process and collect stats on every op as for playback, as fast as possible and without connecting to the server or sending anything"`
+	Pacing             string   `long:"pacing" description:"strategy determining when ops are played; 'recorded' and 'adaptive' follow the recording scaled by --speed, 'adaptive' pushing back the schedule when playback falls behind, 'fixed' and 'poisson' play at --rate ops per second" choice:"recorded" choice:"adaptive" choice:"fixed" choice:"poisson" default:"recorded"`
+	Rate               float64  `long:"rate" description:"ops per second played by the 'fixed' and 'poisson' pacing strategies"`
+	RegenerateIDs      string   `long:"regenerateIds" description:"rewrite the _ids of inserted documents so that the playback file can be played repeatedly without duplicate key errors; 'objectId' replaces ObjectId _ids with new ObjectIds, 'prefix' replaces every _id with a string prefixed by --idPrefix" choice:"none" choice:"objectId" choice:"prefix" default:"none"`
+	IDPrefix           string   `long:"idPrefix" description:"prefix of the _ids of inserted documents with --regenerateIds=prefix; defaults to a value unique to each playback"`
+	ShiftTime          string   `long:"shiftTime" description:"move the dates and timestamps in replayed documents and queries by this duration (e.g. '720h' or '-24h'), or by the time elapsed since the recording started with 'now'"`
+	ReadsOnly          bool     `long:"readsOnly" description:"play only the queries, read commands and getMores of the playback file, so that the data played against is not modified"`
+	WritesOnly         bool     `long:"writesOnly" description:"play only the inserts, updates, deletes and commands of the playback file which modify data, collections or indexes"`
+	Explain            string   `long:"explain" description:"explain the replayed finds, aggregates, counts and distincts with the given verbosity instead of executing them, summarizing their plans by query shape" optional:"yes" optional-value:"executionStats" choice:"queryPlanner" choice:"executionStats" choice:"allPlansExecution"`
+	ExplainReport      string   `long:"explainReport" description:"write the plans and execution stats of each query shape explained by --explain as json to the given path"`
+	SuggestIndexes     string   `long:"suggestIndexes" description:"write createIndexes commands for the indexes which would serve the replayed queries, with the share of the queries each serves, to the given path"`
+	AllowDestructive   bool     `long:"allowDestructive" description:"play commands that drop data, shut down the server or modify users and roles, which are otherwise skipped"`
+	APIVersion         string   `long:"apiVersion" description:"declare this Stable API version in every replayed command" choice:"1"`
+	APIStrict          bool     `long:"apiStrict" description:"declare with --apiVersion that replayed commands fail if they are not part of the declared API version"`
+	APIDeprecation     bool     `long:"apiDeprecationErrors" description:"declare with --apiVersion that replayed commands fail if they are deprecated in the declared API version"`
+	HedgedReads        string   `long:"hedgedReads" description:"whether replayed reads with a non-primary read preference are hedged; 'recorded' plays the hedge options of the recording unmodified" choice:"recorded" choice:"enabled" choice:"disabled" default:"recorded"`
+	MaxErrorRate       string   `long:"maxErrorRate" description:"exit with status 4 if more than this share of the ops played encountered errors, as a percentage (e.g. '1%') or a fraction"`
+	Assert             []string `long:"assert" description:"condition checked once playback finishes, such as 'p95<50ms', 'max<=1s', 'errorRate<0.1%' or 'ops>=1000'; exit with status 4 if any fails. May be repeated"`
+	Verdict            string   `long:"verdict" description:"write the results of the --assert conditions as json to the given path instead of stdout"`
+	KillCursors        bool     `long:"killCursors" description:"once playback finishes, kill the cursors it opened which the playback file neither exhausted nor killed, rather than leaving them open on the server until they time out"`
+	BehindThreshold    int      `long:"behindThreshold" description:"number of milliseconds an op may be played behind the recorded timeline before a warning is logged that playback is falling behind, and its connection is reported as having fallen behind when playback finishes; 0 doesn't report them" default:"1000"`
+	MaxLag             int      `long:"maxLag" description:"abort the playback, exiting with status 4, once an op is played more than this number of milliseconds behind the recorded timeline; 0 doesn't limit the lag"`
+	ServerStatus       int      `long:"serverStatus" description:"sample serverStatus, and replSetGetStatus on a replica set, on the server played against every this number of seconds while playing, adding its connections, queued ops, cache activity and replication lag to the --reportHtml report; 0 doesn't sample it"`
+	ServerStatusReport string   `long:"serverStatusReport" description:"write the samples of --serverStatus as json to the given path"`
+	LongRunningOps     int      `long:"longRunningOps" description:"sample currentOp on the server played against while playing, and log the replayed ops running for longer than this number of milliseconds along with the recorded ops they were played from; 0 doesn't sample it"`
+	CurrentOpInterval  int      `long:"currentOpInterval" description:"number of seconds between the samples of currentOp taken by --longRunningOps" default:"1"`
+	Before             []string `long:"before" description:"shell command run before playback begins, such as a mongorestore resetting the data played against; playback doesn't begin if it fails. May be repeated"`
+	After              []string `long:"after" description:"shell command run once playback finishes, such as a script validating the data played against; exit with status 4 if it fails. May be repeated"`
+	Failpoints         string   `long:"failpoints" description:"file of configureFailPoint commands run on the server played against, each a json document on its own line with an 'at' field: 'start' runs it before playback begins, a duration such as '90s' before the first op recorded that long after the recording started, 'op:<n>' before the op of order n, and an RFC 3339 time before the first op recorded at or after it; the failpoints left enabled are turned off once playback finishes"`
+	Barrier            []string `long:"barrier" description:"point of the playback at which the ops played before it must complete before any op after it is played, so that setup traffic such as index builds and inserts completes before the queries which follow it even at high speeds: 'op:<n>' before the op of order n, a duration such as '90s' before the first op recorded that long after the first op played, or an RFC 3339 time before the first op recorded at or after it. May be repeated"`
+	Break              []string `long:"break" description:"stop the playback before the ops matching the breakpoint, print them and read from stdin whether to step, continue, skip the op or quit: 'op:<n>' stops at the op of order n, 'ns:<pattern>' at the ops on the namespaces matching the pattern, such as 'test.*', and 'command:<name>' at the commands of that name. May be repeated"`
+	Step               bool     `long:"step" description:"stop the playback before the first op, as --break does, to step through it from the start"`
+	SampleConnections  string   `long:"sampleConnections" description:"play only this share of the recorded connections, chosen by hashing their connection numbers, as a percentage (e.g. '10%') or a fraction"`
+	SampleSeed         int64    `long:"sampleSeed" description:"seed of the hash choosing the connections played by --sampleConnections; each seed chooses a different subset"`
+	ReplyTape          string   `long:"replyTape" description:"write the replies received from the server to a reply tape at the given path, to be compared with those of another playback by diff-replies"`
+	SpeedRamp          string   `long:"speedRamp" description:"schedule of the speeds of the playback, such as '1x for 5m, then 2x for 10m, then 5x', instead of a single --speed"`
+	AutoSpeed          string   `long:"autoSpeed" description:"adjust the speed of the playback to hold a target on the cluster played against, either 'opsPerSecond=<n>' or a latency percentile such as 'p95=50ms'"`
+	AutoSpeedInterval  int      `long:"autoSpeedInterval" description:"number of seconds between the adjustments of the speed of --autoSpeed" default:"10"`
+	SpeedFile          string   `long:"speedFile" description:"file holding a speed multiplier (e.g. '2.5') which the speed of the playback is changed to whenever the file is modified or SIGUSR2 is received"`
+	ControlAddr        string   `long:"controlAddr" description:"serve an HTTP endpoint on this address (e.g. 'localhost:9191') through which the playback can be paused, resumed, sped up or slowed down and aborted, and its progress queried"`
+	ReadPref           string   `long:"readPreference" description:"override the read preference of replayed reads, either as a mode (e.g. secondaryPreferred) or as a json document (e.g. '{mode: \"secondary\", tags: {dc: \"east\"}}')"`
+	KafkaOptions       `group:"kafka options"`
+
+	EncryptionOptions `group:"encryption options"`
+
+	// Dialer, if set, is used to open the connections to the servers being
+	// played against instead of a plain TCP dial.
+	Dialer Dialer `no-flag:"true"`
+
+	// remote is set for the playbacks a worker runs for its coordinator,
+	// which may not run commands on the worker's host.
+	remote bool
+
+	target         *mgo.DialInfo
+	mirror         *mgo.DialInfo
+	mirrorDial     DialOptions
+	readPreference *readPreference
+	hedgedReads    *bool
+	serverAPI      *serverAPI
+	playOnly       string
+	explain        *explainer
+	indexAdvisor   *indexAdvisor
+	regenerateIDs  *idRegenerator
+	timeShift      *timeShifter
+	shiftToNow     bool
+	maxErrorRate   *float64
+	assertions     []Assertion
+	sampler        *connectionSampler
+	pacing         PacingStrategy
+	speedRamp      []speedRampStep
+	autoSpeed      *autoSpeedTarget
+	resumeFrom     *PlaybackCheckpoint
+	failpoints     *failpointSchedule
+	barriers       []*playbackPoint
+	breakpoints    []*breakpoint
 }
 
 const queueGranularity = 1000
 
 // ValidateParams validates the settings described in the PlayCommand struct.
 func (play *PlayCommand) ValidateParams(args []string) error {
+	useTLS := play.DialOptions.TLS
+	target, err := play.dialInfo(&play.DialOptions)
+	if err != nil {
+		return err
+	}
+	if err := play.setDialOptions(&play.DialOptions); err != nil {
+		return err
+	}
 	switch {
 	case len(args) > 0:
 		return fmt.Errorf("unknown argument: %s", args[0])
+	case play.remote && (len(play.Before) > 0 || len(play.After) > 0):
+		return fmt.Errorf("--before and --after cannot be used in playbacks run by a worker, which don't run commands")
+	case play.PlaybackFile == "" && play.KafkaTopic == "":
+		return fmt.Errorf("must specify a playback file or a Kafka topic to play from")
+	case play.PlaybackFile != "" && play.KafkaTopic != "":
+		return fmt.Errorf("must only specify a playback file or a Kafka topic")
+	case play.KafkaTopic != "" && (play.Repeat > 1 || play.Checkpoint != "" || play.ResumeFrom != ""):
+		return fmt.Errorf("--kafkaTopic cannot be used with --repeat, --checkpoint or --resumeFrom, which need a playback file")
+	case play.PlaybackFile == stdStream && play.Repeat > 1:
+		return fmt.Errorf("--repeat cannot be used with a playback file read from stdin, which can only be read once")
 	case play.Speed <= 0:
 		return fmt.Errorf("Invalid setting for --speed: '%v'", play.Speed)
+	case play.SpeedRamp != "" && (play.Speed != 1 || play.FullSpeed || play.DryRun):
+		return fmt.Errorf("--speedRamp cannot be used with --speed, --fullSpeed or --dryRun")
+	case play.AutoSpeed != "" && (play.SpeedRamp != "" || play.FullSpeed || play.DryRun):
+		return fmt.Errorf("--autoSpeed cannot be used with --speedRamp, --fullSpeed or --dryRun")
+	case play.AutoSpeedInterval < 1:
+		return fmt.Errorf("Invalid setting for --autoSpeedInterval: '%v', value must be >=1", play.AutoSpeedInterval)
+	case play.BehindThreshold < 0:
+		return fmt.Errorf("Invalid setting for --behindThreshold: '%v', value must be >=0", play.BehindThreshold)
+	case play.MaxLag < 0:
+		return fmt.Errorf("Invalid setting for --maxLag: '%v', value must be >=0", play.MaxLag)
+	case play.MaxLag > 0 && (play.FullSpeed || play.DryRun):
+		return fmt.Errorf("--maxLag cannot be used with --fullSpeed or --dryRun, which don't follow the recorded timeline")
+	case play.ServerStatus < 0:
+		return fmt.Errorf("Invalid setting for --serverStatus: '%v', value must be >=0", play.ServerStatus)
+	case play.ServerStatus > 0 && play.DryRun:
+		return fmt.Errorf("--serverStatus cannot be used with --dryRun, which doesn't connect to the server")
+	case play.ServerStatusReport != "" && play.ServerStatus == 0:
+		return fmt.Errorf("--serverStatusReport requires --serverStatus")
+	case play.LongRunningOps < 0:
+		return fmt.Errorf("Invalid setting for --longRunningOps: '%v', value must be >=0", play.LongRunningOps)
+	case play.LongRunningOps > 0 && play.DryRun:
+		return fmt.Errorf("--longRunningOps cannot be used with --dryRun, which doesn't connect to the server")
+	case play.Failpoints != "" && play.DryRun:
+		return fmt.Errorf("--failpoints cannot be used with --dryRun, which doesn't connect to the server")
+	case play.CurrentOpInterval < 1:
+		return fmt.Errorf("Invalid setting for --currentOpInterval: '%v', value must be >=1", play.CurrentOpInterval)
+	case play.OpTimeout < 0:
+		return fmt.Errorf("Invalid setting for --opTimeout: '%v', value must be >=0", play.OpTimeout)
+	case play.Timeout < 0:
+		return fmt.Errorf("Invalid setting for --timeout: '%v', value must be >=0", play.Timeout)
+	case play.Retries < 0:
+		return fmt.Errorf("Invalid setting for --retries: '%v', value must be >=0", play.Retries)
+	case play.RetryBackoff < 0:
+		return fmt.Errorf("Invalid setting for --retryBackoff: '%v', value must be >=0", play.RetryBackoff)
+	case play.MaxConnsPerTarget < 0:
+		return fmt.Errorf("Invalid setting for --maxConnsPerTarget: '%v', value must be >=0", play.MaxConnsPerTarget)
+	case play.WorkersPerHost < 0:
+		return fmt.Errorf("Invalid setting for --workersPerHost: '%v', value must be >=0", play.WorkersPerHost)
+	case play.MaxConnsPerTarget > 0 && play.ConnectionModel != connectionModelPerConnection:
+		return fmt.Errorf("--maxConnsPerTarget cannot be used with --connectionModel=%v, whose --poolSize bounds the connections", play.ConnectionModel)
+	case play.Translate && play.Downconvert:
+		return fmt.Errorf("--translate cannot be used with --downconvert")
+	case play.MaxAwait < 0:
+		return fmt.Errorf("Invalid setting for --maxAwait: '%v', value must be >=0", play.MaxAwait)
+	case play.TailableBudget < 0:
+		return fmt.Errorf("Invalid setting for --tailableBudget: '%v', value must be >=0", play.TailableBudget)
+	case play.PoolSize < 1:
+		return fmt.Errorf("Invalid setting for --poolSize: '%v', value must be >=1", play.PoolSize)
+	case play.CheckpointInterval < 1:
+		return fmt.Errorf("Invalid setting for --checkpointInterval: '%v', value must be >=1", play.CheckpointInterval)
+	case play.DrainTimeout < 0:
+		return fmt.Errorf("Invalid setting for --drainTimeout: '%v', value must be >=0", play.DrainTimeout)
+	case play.ProgressInterval < 1:
+		return fmt.Errorf("Invalid setting for --progressInterval: '%v', value must be >=1", play.ProgressInterval)
+	case play.Warmup < 0:
+		return fmt.Errorf("Invalid setting for --warmup: '%v', value must be >=0", play.Warmup)
 	case play.Repeat < 1:
 		return fmt.Errorf("Invalid setting for --repeat: '%v', value must be >=1", play.Repeat)
+	case play.Amplify < 1:
+		return fmt.Errorf("Invalid setting for --amplify: '%v', value must be >=1", play.Amplify)
+	case play.Amplify > 1 && (play.MirrorHost != "" || play.ReplyTape != ""):
+		return fmt.Errorf("--amplify cannot be used with --mirrorHost or --replyTape, which compare the replies of a single copy of each op")
+	case play.Amplify > 1 && (play.Checkpoint != "" || play.ResumeFrom != ""):
+		return fmt.Errorf("--amplify cannot be used with --checkpoint or --resumeFrom")
+	case !play.TLS && (play.TLSServerName != "" || play.TLSCAFile != "" ||
+		play.TLSCertificateKeyFile != "" || play.TLSAllowInvalidCertificates):
+		return fmt.Errorf("--tls is required when using other TLS options")
+	case play.ReplyTape != "" && play.DryRun:
+		return fmt.Errorf("--replyTape cannot be used with --dryRun, which receives no replies")
+	case play.MirrorHost != "" && (play.DryRun || play.ResumeFrom != ""):
+		return fmt.Errorf("--mirrorHost cannot be used with --dryRun or --resumeFrom")
+	case play.Explain != "" && (play.DryRun || play.MirrorHost != "" || play.Amplify > 1):
+		return fmt.Errorf("--explain cannot be used with --dryRun, --mirrorHost or --amplify")
+	case play.KillCursors && play.DryRun:
+		return fmt.Errorf("--killCursors cannot be used with --dryRun, which opens no cursors")
+	case play.ExplainReport != "" && play.Explain == "":
+		return fmt.Errorf("--explainReport requires --explain")
+	case play.MirrorHost != "" && (play.DialAddress != "" || play.Dialer != nil):
+		return fmt.Errorf("--mirrorHost cannot be used with --dialAddress, which would send the ops of both hosts to the same address")
+	case play.Proxy != "" && play.Dialer != nil:
+		return fmt.Errorf("--proxy cannot be used with PlayCommand.Dialer, which opens the connections itself")
+	case play.SSHTunnel != "" && play.Dialer != nil:
+		return fmt.Errorf("--sshTunnel cannot be used with PlayCommand.Dialer, which opens the connections itself")
+	case (len(play.Break) > 0 || play.Step) && play.PlaybackFile == stdStream:
+		return fmt.Errorf("--break and --step cannot be used with a playback file read from stdin, which the debugger reads its commands from")
+	case (len(play.Break) > 0 || play.Step) && play.TUI:
+		return fmt.Errorf("--break and --step cannot be used with --tui, which takes over the terminal")
+	case play.TUI && startTerminalDashboard == nil:
+		return fmt.Errorf("--tui is not supported on this platform")
+	case play.TUI && play.Collect != "none" && play.Collect != "mongodb" && play.Report == "":
+		return fmt.Errorf("--tui cannot be used with --collect unless --report is set, as the stats would be written over the dashboard")
+	}
+	if err := play.KafkaOptions.validateConsuming(); err != nil {
+		return err
+	}
+	if !play.DryRun {
+		promptForPassword(target)
+	}
+	play.target = target
+	if play.MirrorHost != "" {
+		// the mirror is dialed like the target, but the TLS asked for by
+		// the connection string of the target is left to its own
+		play.mirrorDial = play.DialOptions
+		play.mirrorDial.TLS = useTLS || play.UseSSL
+		if play.mirror, err = parseConnectionString(play.MirrorHost, &play.mirrorDial); err != nil {
+			return fmt.Errorf("Invalid setting for --mirrorHost: %v", err)
+		}
+	}
+	if play.SpeedRamp != "" {
+		if play.speedRamp, err = parseSpeedRamp(play.SpeedRamp); err != nil {
+			return fmt.Errorf("Invalid setting for --speedRamp: %v", err)
+		}
+		// playback starts at the speed of the first step
+		play.Speed = play.speedRamp[0].speed
+	}
+	if play.AutoSpeed != "" {
+		if play.autoSpeed, err = parseAutoSpeedTarget(play.AutoSpeed); err != nil {
+			return fmt.Errorf("Invalid setting for --autoSpeed: %v", err)
+		}
+	}
+	pacing, err := newPacingStrategy(play.Pacing, play.Speed, play.Rate)
+	if err != nil {
+		return fmt.Errorf("Invalid setting for --pacing: %v", err)
+	}
+	play.pacing = pacing
+	if play.ResumeFrom != "" {
+		checkpoint, err := ReadCheckpointFile(play.ResumeFrom)
+		if err != nil {
+			return fmt.Errorf("Invalid setting for --resumeFrom: %v", err)
+		}
+		if checkpoint.Complete {
+			return fmt.Errorf("Invalid setting for --resumeFrom: playback of %v had already completed", checkpoint.PlaybackFile)
+		}
+		if checkpoint.Generation >= play.Repeat {
+			return fmt.Errorf("Invalid setting for --resumeFrom: checkpoint is past the last of the %v repetitions", play.Repeat)
+		}
+		play.resumeFrom = checkpoint
+		if play.Checkpoint == "" {
+			// keep saving progress where it was being saved before
+			play.Checkpoint = play.ResumeFrom
+		}
+	}
+	if play.ReadPref != "" {
+		readPref, err := parseReadPreference(play.ReadPref)
+		if err != nil {
+			return fmt.Errorf("Invalid setting for --readPreference: %v", err)
+		}
+		play.readPreference = readPref
+	}
+	hedgedReads, err := parseHedgedReads(play.HedgedReads)
+	if err != nil {
+		return fmt.Errorf("Invalid setting for --hedgedReads: %v", err)
+	}
+	play.hedgedReads = hedgedReads
+	if play.APIVersion != "" {
+		play.serverAPI = &serverAPI{version: play.APIVersion, strict: play.APIStrict, deprecationErrors: play.APIDeprecation}
+	} else if play.APIStrict || play.APIDeprecation {
+		return fmt.Errorf("--apiStrict and --apiDeprecationErrors require --apiVersion")
+	}
+	regenerateIDs, err := parseRegenerateIDs(play.RegenerateIDs, play.IDPrefix)
+	if err != nil {
+		return fmt.Errorf("Invalid setting for --regenerateIds: %v", err)
+	}
+	play.regenerateIDs = regenerateIDs
+	if play.playOnly, err = parsePlayOnly(play.ReadsOnly, play.WritesOnly); err != nil {
+		return err
+	}
+	play.explain = nil
+	if play.Explain != "" {
+		play.explain = newExplainer(play.Explain)
+	}
+	play.indexAdvisor = nil
+	if play.SuggestIndexes != "" {
+		play.indexAdvisor = newIndexAdvisor()
+	}
+	play.timeShift = nil
+	if play.ShiftTime != "" {
+		delta, fixed, err := parseShiftTime(play.ShiftTime)
+		if err != nil {
+			return fmt.Errorf("Invalid setting for --shiftTime: %v", err)
+		}
+		play.timeShift = &timeShifter{delta: delta}
+		play.shiftToNow = !fixed
+		if play.shiftToNow && (play.KafkaTopic != "" || play.PlaybackFile == stdStream) {
+			return fmt.Errorf("Invalid setting for --shiftTime: 'now' requires a playback file which isn't read from stdin")
+		}
+	}
+	if play.MaxErrorRate != "" {
+		maxErrorRate, err := parseRate(play.MaxErrorRate)
+		if err != nil {
+			return fmt.Errorf("Invalid setting for --maxErrorRate: %v", err)
+		}
+		play.maxErrorRate = &maxErrorRate
+	}
+	play.sampler = nil
+	if play.SampleConnections != "" {
+		rate, err := parseRate(play.SampleConnections)
+		if err != nil {
+			return fmt.Errorf("Invalid setting for --sampleConnections: %v", err)
+		}
+		if rate == 0 {
+			return fmt.Errorf("Invalid setting for --sampleConnections: no connections would be played")
+		}
+		play.sampler = newConnectionSampler(rate, play.SampleSeed)
+	}
+	play.failpoints = nil
+	if play.Failpoints != "" {
+		if play.failpoints, err = readFailpointSchedule(play.Failpoints); err != nil {
+			return fmt.Errorf("Invalid setting for --failpoints: %v", err)
+		}
+	}
+	play.barriers = nil
+	for _, at := range play.Barrier {
+		barrier, err := parsePlaybackPoint(at, false)
+		if err != nil {
+			return fmt.Errorf("Invalid setting for --barrier: %v", err)
+		}
+		play.barriers = append(play.barriers, barrier)
+	}
+	play.breakpoints = nil
+	for _, spec := range play.Break {
+		bp, err := parseBreakpoint(spec)
+		if err != nil {
+			return fmt.Errorf("Invalid setting for --break: %v", err)
+		}
+		play.breakpoints = append(play.breakpoints, bp)
+	}
+	play.assertions = nil
+	for _, setting := range play.Assert {
+		assertion, err := ParseAssertion(setting)
+		if err != nil {
+			return fmt.Errorf("Invalid setting for --assert: %v", err)
+		}
+		play.assertions = append(play.assertions, assertion)
 	}
 	return nil
 }
@@ -50,103 +409,786 @@ func (play *PlayCommand) Execute(args []string) error {
 	if err != nil {
 		return err
 	}
-	play.GlobalOpts.SetLogging()
+	// a worker sets the logging once for the segments it plays at once
+	if !play.remote {
+		play.GlobalOpts.SetLogging()
+	}
+	if err := play.setTapeEncryption(); err != nil {
+		return err
+	}
+	if !play.DryRun {
+		if err := play.DialOptions.resolveServers(play.target); err != nil {
+			return err
+		}
+	}
+	if err := runScripts("--before", play.Before, play.scriptEnv(), os.Stderr); err != nil {
+		return err
+	}
 
-	statColl, err := newStatCollector(play.StatOptions, play.Collect, true, true)
+	// When a signal is received, stop playing new ops and let those in flight
+	// complete so that the stats and report are flushed before exiting. A
+	// second signal exits immediately.
+	// --timeout stops the playback in the same way.
+	ctx, cancel := context.WithCancel(context.Background())
+	if play.Timeout > 0 {
+		cancel()
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(play.Timeout)*time.Second)
+	}
+	defer cancel()
+	finishedChan := signals.HandleWithInterrupt(cancel)
+	defer close(finishedChan)
+	samplingCtx, stopSampling := context.WithCancel(ctx)
+	defer stopSampling()
+
+	// the dashboard is drawn from the stats of the ops played
+	statOptions := play.StatOptions
+	var dash *dashboard
+	if play.TUI {
+		title := "mongoreplay play " + play.PlaybackFile
+		if play.KafkaTopic != "" {
+			title = "mongoreplay play " + play.KafkaTopic
+		}
+		dash = newDashboard(title)
+		if statOptions.Recorder != nil {
+			statOptions.Recorder = multiStatRecorder{statOptions.Recorder, dash}
+		} else {
+			statOptions.Recorder = dash
+		}
+	}
+	statColl, err := NewStatCollector(statOptions, play.Collect, true, true)
 	if err != nil {
 		return err
 	}
+	// the samples of --serverStatus are added to the reports of statColl
+	// alongside the stats
+	statRecorder := statColl.StatRecorder
 
-	if play.FullSpeed {
+	if play.DryRun {
+		userInfoLogger.Logvf(Always, "Doing dry run; no ops will be sent to %v", describeServers(play.target))
+	} else if play.FullSpeed {
 		userInfoLogger.Logvf(Always, "Doing playback at full speed")
+	} else if play.Pacing == "fixed" || play.Pacing == "poisson" {
+		userInfoLogger.Logvf(Always, "Doing playback at %.2f ops per second using %v pacing", play.Rate, play.Pacing)
+	} else if play.speedRamp != nil {
+		userInfoLogger.Logvf(Always, "Doing playback with speed ramp %v", play.SpeedRamp)
 	} else {
 		userInfoLogger.Logvf(Always, "Doing playback at %.2fx speed", play.Speed)
 	}
+	if play.readPreference != nil {
+		userInfoLogger.Logvf(Always, "Overriding read preference of replayed reads with %v", play.ReadPref)
+	}
+	if play.hedgedReads != nil {
+		userInfoLogger.Logvf(Always, "Hedged reads %v for replayed reads", play.HedgedReads)
+	}
+	if play.serverAPI != nil {
+		userInfoLogger.Logvf(Always, "Declaring Stable API version %v in replayed commands", play.APIVersion)
+	}
+	if play.playOnly != "" {
+		userInfoLogger.Logvf(Always, "Playing only %vs", play.playOnly)
+	}
+	if play.explain != nil {
+		userInfoLogger.Logvf(Always, "Explaining replayed queries with verbosity %v instead of executing them", play.Explain)
+	}
+	if play.regenerateIDs != nil && play.regenerateIDs.prefix != "" {
+		userInfoLogger.Logvf(Always, "Prefixing the _ids of inserted documents with %v", play.regenerateIDs.prefix)
+	} else if play.regenerateIDs != nil {
+		userInfoLogger.Logvf(Always, "Replacing ObjectId _ids of inserted documents with new ObjectIds")
+	}
+	if play.resumeFrom != nil {
+		if play.resumeFrom.PlaybackFile != play.PlaybackFile {
+			userInfoLogger.Logvf(Always, "Warning: checkpoint was written while playing %v", play.resumeFrom.PlaybackFile)
+		}
+		userInfoLogger.Logvf(Always, "Resuming playback after %v ops played, from op %v of generation %v",
+			play.resumeFrom.OpsPlayed, play.resumeFrom.Order, play.resumeFrom.Generation)
+		if open := len(play.resumeFrom.OpenConnections); open > 0 {
+			userInfoLogger.Logvf(Always, "%v recorded connections were open at the checkpoint; their remaining ops are played on new connections, "+
+				"without the state, such as authentication, that their earlier ops set up", open)
+		}
+	}
 
-	playbackFileReader, err := NewPlaybackFileReader(play.PlaybackFile, play.Gzip)
-	if err != nil {
-		return err
+	// the ops are played from the playback file, or consumed from Kafka as
+	// they are published, in which case they can't be preprocessed
+	var playbackFileReader *PlaybackFileReader
+	var kafkaReader *KafkaOpReader
+	var driverOpsFiltered bool
+	if play.KafkaTopic != "" {
+		kafkaReader, err = NewKafkaOpReader(play.KafkaOptions)
+		if err != nil {
+			return err
+		}
+		defer kafkaReader.Close()
+		play.NoPreprocess = true
+		userInfoLogger.Logvf(Always, "Playing the ops published to partition %v of %v", play.KafkaPartition, play.KafkaTopic)
+	} else {
+		playbackFileReader, err = NewPlaybackFileReader(play.PlaybackFile, play.Gzip)
+		if err != nil {
+			return err
+		}
+		driverOpsFiltered = playbackFileReader.metadata.DriverOpsFiltered
+		if play.PlaybackFile == stdStream {
+			// a playback file read from stdin can only be read once
+			play.NoPreprocess = true
+		}
 	}
 
-	session, err := mgo.Dial(play.URL)
-	if err != nil {
-		return err
+	var session *mgo.Session
+	if !play.DryRun {
+		session, err = dialSession(play.target, play.DialOptions.newDialer(play.Dialer))
+		if err != nil {
+			return err
+		}
+		session.SetSocketTimeout(0)
 	}
-	session.SetSocketTimeout(0)
 
-	context := NewExecutionContext(statColl, session, &ExecutionOptions{fullSpeed: play.FullSpeed,
-		driverOpsFiltered: playbackFileReader.metadata.DriverOpsFiltered})
+	// the opcodes the ops are played as are chosen by the server
+	translate, downconvert, api := play.Translate, play.Downconvert, play.serverAPI
+	var features *serverFeatures
+	if session != nil && !play.NoDetect {
+		if features, err = detectServerFeatures(session, describeServers(play.target)); err != nil {
+			userInfoLogger.Logvf(Always, "Error detecting the version of %v: %v", describeServers(play.target), err)
+		} else {
+			userInfoLogger.Logvf(Always, "Playing against server version %v (maxWireVersion %v)", features.version, features.maxWireVersion)
+			translate, downconvert = features.opcodeConversion(translate, downconvert)
+			api = features.apiParameters(api)
+		}
+	}
 
-	session.SetPoolLimit(-1)
+	// ops played as fast as possible don't follow the recorded timeline, so
+	// their connections can't fall behind it
+	behindThreshold := time.Duration(play.BehindThreshold) * time.Millisecond
+	if play.FullSpeed || play.DryRun {
+		behindThreshold = 0
+	}
+	options := ExecutionOptions{fullSpeed: play.FullSpeed || play.DryRun,
+		driverOpsFiltered:  driverOpsFiltered,
+		allowDestructive:   play.AllowDestructive,
+		playOnly:           play.playOnly,
+		dryRun:             play.DryRun,
+		warmup:             time.Duration(play.Warmup) * time.Second,
+		checkpointFile:     play.Checkpoint,
+		checkpointInterval: time.Duration(play.CheckpointInterval) * time.Second,
+		playbackFile:       play.PlaybackFile,
+		resumeFrom:         play.resumeFrom,
+		drainTimeout:       time.Duration(play.DrainTimeout) * time.Second,
+		opTimeout:          time.Duration(play.OpTimeout) * time.Second,
+		retry:              retryPolicy{retries: play.Retries, backoff: time.Duration(play.RetryBackoff) * time.Millisecond},
+		cursorPolicy:       play.CursorNotFound,
+		strictOrder:        play.StrictOrder,
+		maxAwait:           time.Duration(play.MaxAwait) * time.Millisecond,
+		tailableBudget:     time.Duration(play.TailableBudget) * time.Second,
+		changeStreamResume: play.ChangeStreamResume,
+		translate:          translate,
+		downconvert:        downconvert,
+		connectionModel:    play.ConnectionModel,
+		poolSize:           play.PoolSize,
+		readPreference:     play.readPreference,
+		hedgedReads:        play.hedgedReads,
+		serverAPI:          api,
+		explain:            play.explain,
+		behindThreshold:    behindThreshold,
+		maxLag:             time.Duration(play.MaxLag) * time.Millisecond,
+		barriers:           play.barriers,
+		// the copies of an amplified playback are summarized together
+		quiet: play.Amplify > 1}
+	context := NewExecutionContext(statColl, session, &options)
+	context.Pacing = play.pacing
+	if play.regenerateIDs != nil {
+		context.PreOpHooks = append(context.PreOpHooks, *play.regenerateIDs)
+	}
+	if play.timeShift != nil {
+		context.PreOpHooks = append(context.PreOpHooks, play.timeShift)
+	}
+	if play.indexAdvisor != nil {
+		context.PreOpHooks = append(context.PreOpHooks, play.indexAdvisor)
+	}
 
-	var opChan <-chan *RecordedOp
-	var errChan <-chan error
+	// the copies of an amplified playback share the session, each opening
+	// its own connections, and record their stats with statColl
+	var copies []*ExecutionContext
+	var copiesDone sync.WaitGroup
+	if play.Amplify > 1 {
+		collectors := amplifyStatCollector(statColl, play.Amplify, &copiesDone)
+		for i, collector := range collectors[1:] {
+			copyContext := NewExecutionContext(collector, session, &options)
+			if copyContext.Pacing, err = newPacingStrategy(play.Pacing, play.Speed, play.Rate); err != nil {
+				return err
+			}
+			// each copy prefixes the _ids it inserts differently
+			regenerateIDs := idRegenerator{seed: newIDSeed()}
+			if play.regenerateIDs != nil && play.regenerateIDs.prefix != "" {
+				regenerateIDs.prefix = fmt.Sprintf("%v-%v", play.regenerateIDs.prefix, i+1)
+			}
+			copyContext.PreOpHooks = append(copyContext.PreOpHooks, newSessionRemapper(), regenerateIDs)
+			if play.timeShift != nil {
+				copyContext.PreOpHooks = append(copyContext.PreOpHooks, play.timeShift)
+			}
+			copies = append(copies, copyContext)
+		}
+		userInfoLogger.Logvf(Always, "Playing each recorded connection %v times", play.Amplify)
+	}
+	if context.pool != nil {
+		userInfoLogger.Logvf(Always, "Playing the recorded connections on %v shared connections (--connectionModel=%v)", play.PoolSize, play.ConnectionModel)
+	}
 
-	if !play.NoPreprocess {
-		opChan, errChan = playbackFileReader.OpChan(1)
+	// the copies of an amplified playback share the caps of the host
+	if play.MaxConnsPerTarget > 0 || play.WorkersPerHost > 0 {
+		limits := newHostLimits(describeServers(play.target), play.MaxConnsPerTarget, play.WorkersPerHost)
+		context.limits = limits
+		for _, copyContext := range copies {
+			copyContext.limits = limits
+		}
+	}
+
+	// the copies of an amplified playback are watched together
+	var watchdog *opWatchdog
+	if play.LongRunningOps > 0 {
+		watchdog = newOpWatchdog(session, time.Duration(play.LongRunningOps)*time.Millisecond,
+			time.Duration(play.CurrentOpInterval)*time.Second)
+		// older servers reject the comments of some commands
+		watchdog.tag = features != nil && features.maxWireVersion >= wireVersionComment
+		context.watchdog = watchdog
+		for _, copyContext := range copies {
+			copyContext.watchdog = watchdog
+		}
+	}
 
-		preprocessMap, err := newPreprocessCursorManager(opChan)
+	// --cursorNotFound=abort stops the playback at the first getMore of a
+	// cursor not found on the server, and --maxLag once an op is played too
+	// far behind the recorded timeline
+	var aborted error
+	var abortOnce sync.Once
+	abort := func(err error) {
+		abortOnce.Do(func() {
+			aborted = err
+			userInfoLogger.Logvf(Always, "Aborting playback: %v", err)
+			cancel()
+		})
+	}
+	context.abort = abort
+	for _, copyContext := range copies {
+		copyContext.abort = abort
+	}
+
+	// the failpoints are set before whichever copy of an amplified playback
+	// reaches them first
+	if play.failpoints != nil {
+		play.failpoints.run = func(command bson.D) error {
+			return session.DB("admin").Run(command, nil)
+		}
+		play.failpoints.abort = abort
+		context.PreOpHooks = append(context.PreOpHooks, play.failpoints)
+		for _, copyContext := range copies {
+			copyContext.PreOpHooks = append(copyContext.PreOpHooks, play.failpoints)
+		}
+	}
+
+	// the debugger sees the ops as they are sent, once the other hooks
+	// have modified them
+	var debug *debugger
+	if len(play.breakpoints) > 0 || play.Step {
+		debug = newDebugger(os.Stdin, os.Stderr, play.breakpoints, play.Step)
+		debug.quit = func() {
+			userInfoLogger.Logvf(Always, "Playback quit from the debugger")
+			cancel()
+		}
+		context.PreOpHooks = append(context.PreOpHooks, debug)
+		context.PostOpHooks = append(context.PostOpHooks, debug)
+		for _, copyContext := range copies {
+			copyContext.PreOpHooks = append(copyContext.PreOpHooks, debug)
+			copyContext.PostOpHooks = append(copyContext.PostOpHooks, debug)
+		}
+	}
 
+	if play.ReplyTape != "" {
+		metadata := ReplyTapeMetadata{PlaybackFile: play.PlaybackFile, RecordedAt: time.Now()}
+		if buildInfo, err := session.BuildInfo(); err == nil {
+			metadata.ServerVersion = buildInfo.Version
+		}
+		replyTape, err := NewReplyTapeWriter(play.ReplyTape, metadata)
 		if err != nil {
-			return fmt.Errorf("PreprocessMap: %v", err)
+			return err
 		}
+		defer func() {
+			if err := replyTape.Close(); err != nil {
+				userInfoLogger.Logvf(Always, "Error closing reply tape: %v", err)
+			} else {
+				userInfoLogger.Logvf(Always, "Wrote %v replies to %v", replyTape.Entries(), play.ReplyTape)
+			}
+		}()
+		context.PostOpHooks = append(context.PostOpHooks, replyTape)
+	}
 
-		err = <-errChan
-		if err != io.EOF {
-			return fmt.Errorf("OpChan: %v", err)
+	if session != nil {
+		session.SetPoolLimit(-1)
+	}
+
+	var mirrorContext *ExecutionContext
+	var mirrorFeatures *serverFeatures
+	var comparator *mirrorComparator
+	if play.MirrorHost != "" {
+		mirrorInfo := play.mirror
+		if err := play.mirrorDial.resolveServers(mirrorInfo); err != nil {
+			return fmt.Errorf("Invalid setting for --mirrorHost: %v", err)
+		}
+		mirrorSession, err := dialSession(mirrorInfo, play.mirrorDial.newDialer(nil))
+		if err != nil {
+			return err
+		}
+		defer mirrorSession.Close()
+		mirrorSession.SetSocketTimeout(0)
+		mirrorSession.SetPoolLimit(-1)
+		mirrorStats, err := NewStatCollector(StatOptions{}, "none", true, true)
+		if err != nil {
+			return err
+		}
+		mirrorTranslate, mirrorDownconvert, mirrorAPI := play.Translate, play.Downconvert, play.serverAPI
+		if !play.NoDetect {
+			if mirrorFeatures, err = detectServerFeatures(mirrorSession, describeServers(mirrorInfo)); err != nil {
+				userInfoLogger.Logvf(Always, "Error detecting the version of %v: %v", describeServers(mirrorInfo), err)
+			} else {
+				mirrorTranslate, mirrorDownconvert = mirrorFeatures.opcodeConversion(mirrorTranslate, mirrorDownconvert)
+				mirrorAPI = mirrorFeatures.apiParameters(mirrorAPI)
+			}
+		}
+		mirrorContext = NewExecutionContext(mirrorStats, mirrorSession, &ExecutionOptions{fullSpeed: play.FullSpeed,
+			driverOpsFiltered:  driverOpsFiltered,
+			allowDestructive:   play.AllowDestructive,
+			playOnly:           play.playOnly,
+			warmup:             time.Duration(play.Warmup) * time.Second,
+			drainTimeout:       time.Duration(play.DrainTimeout) * time.Second,
+			opTimeout:          time.Duration(play.OpTimeout) * time.Second,
+			retry:              retryPolicy{retries: play.Retries, backoff: time.Duration(play.RetryBackoff) * time.Millisecond},
+			cursorPolicy:       play.CursorNotFound,
+			strictOrder:        play.StrictOrder,
+			maxAwait:           time.Duration(play.MaxAwait) * time.Millisecond,
+			tailableBudget:     time.Duration(play.TailableBudget) * time.Second,
+			changeStreamResume: play.ChangeStreamResume,
+			translate:          mirrorTranslate,
+			downconvert:        mirrorDownconvert,
+			connectionModel:    play.ConnectionModel,
+			poolSize:           play.PoolSize,
+			readPreference:     play.readPreference,
+			hedgedReads:        play.hedgedReads,
+			serverAPI:          mirrorAPI})
+		if play.MaxConnsPerTarget > 0 || play.WorkersPerHost > 0 {
+			mirrorContext.limits = newHostLimits(describeServers(mirrorInfo), play.MaxConnsPerTarget, play.WorkersPerHost)
+		}
+		if mirrorContext.Pacing, err = newPacingStrategy(play.Pacing, play.Speed, play.Rate); err != nil {
+			return err
 		}
+		// both hosts are sent the ops at the same times
+		if pacing, ok := context.Pacing.(*PoissonPacing); ok {
+			seed := time.Now().UnixNano()
+			pacing.Rand = rand.New(rand.NewSource(seed))
+			mirrorContext.Pacing.(*PoissonPacing).Rand = rand.New(rand.NewSource(seed))
+		}
+		comparator = newMirrorComparator(newReplyNormalization(nil, false, false, false))
+		context.PostOpHooks = append(context.PostOpHooks, comparator.side(0))
+		mirrorContext.PostOpHooks = append(mirrorContext.PostOpHooks, comparator.side(1))
+		// both hosts insert the same _ids, so that their replies match
+		if play.regenerateIDs != nil {
+			mirrorContext.PreOpHooks = append(mirrorContext.PreOpHooks, *play.regenerateIDs)
+		}
+		if play.timeShift != nil {
+			mirrorContext.PreOpHooks = append(mirrorContext.PreOpHooks, play.timeShift)
+		}
+		userInfoLogger.Logvf(Always, "Mirroring playback to %v", play.MirrorHost)
+	}
 
-		_, err = playbackFileReader.Seek(0, 0)
+	// the playback can be paused and its speed changed through signals, the
+	// --speedFile and the --controlAddr endpoint
+	control := newPlayControl(play.Speed, cancel)
+	control.control(append([]*ExecutionContext{context}, copies...)...)
+	if mirrorContext != nil {
+		// the mirror follows the clock, but isn't counted in the progress
+		mirrorContext.clock = control.clock
+	}
+	if debug != nil {
+		debug.clock = control.clock
+	}
+	go control.watch(ctx, play.SpeedFile)
+	if play.ControlAddr != "" {
+		stop, err := control.serve(play.ControlAddr)
 		if err != nil {
 			return err
 		}
-		context.CursorIDMap = preprocessMap
+		defer stop()
 	}
 
-	opChan, errChan = playbackFileReader.OpChan(play.Repeat)
+	// the number of ops to play is known once the file is preprocessed
+	var opCount int64
+	if !play.NoPreprocess {
+		if play.ConnectionModel == connectionModelPool {
+			if err := checkPoolable(playbackFileReader, play.sampler); err != nil {
+				return err
+			}
+		}
+		if play.MaxConnsPerTarget > 0 {
+			if err := checkCappable(playbackFileReader, play.sampler); err != nil {
+				return err
+			}
+		}
+		cursors, err := preprocessCursors(playbackFileReader, play.sampler)
+		if err != nil {
+			return err
+		}
+		context.CursorIDMap = cursors
+		opCount = cursors.opCount * int64(play.Repeat)
+		if features != nil {
+			features.warnUnplayable(cursors.opCodes, translate, downconvert)
+		}
+		if mirrorFeatures != nil {
+			mirrorFeatures.warnUnplayable(cursors.opCodes, mirrorContext.translate, mirrorContext.downconvert)
+		}
+		if mirrorContext != nil {
+			if mirrorContext.CursorIDMap, err = preprocessCursors(playbackFileReader, play.sampler); err != nil {
+				return err
+			}
+		}
+		for _, copyContext := range copies {
+			if copyContext.CursorIDMap, err = preprocessCursors(playbackFileReader, play.sampler); err != nil {
+				return err
+			}
+		}
+	}
+	if play.resumeFrom != nil {
+		play.resumeFrom.restoreCursors(context.CursorIDMap)
+		if opCount > 0 {
+			opCount -= play.resumeFrom.OpsPlayed
+		}
+	}
 
-	if err := Play(context, opChan, play.Speed, play.Repeat, play.QueueTime); err != nil {
-		userInfoLogger.Logvf(Always, "Play: %v\n", err)
+	if play.shiftToNow {
+		start, err := recordingStart(playbackFileReader)
+		if err != nil {
+			return err
+		}
+		play.timeShift.delta = time.Since(start)
+	}
+	if play.failpoints != nil && playbackFileReader != nil && play.PlaybackFile != stdStream {
+		if play.failpoints.start, err = recordingStart(playbackFileReader); err != nil {
+			return err
+		}
+	}
+	if play.timeShift != nil {
+		userInfoLogger.Logvf(Always, "Shifting dates and timestamps of replayed ops by %v", play.timeShift.delta)
+	}
+
+	var opChan <-chan *RecordedOp
+	var errChan <-chan error
+	if kafkaReader != nil {
+		opChan, errChan = kafkaReader.OpChan(ctx)
+	} else {
+		opChan, errChan = playbackFileReader.OpChanWithContext(ctx, play.Repeat)
+	}
+	if play.sampler != nil {
+		userInfoLogger.Logvf(Always, "Playing %v of the recorded connections", play.SampleConnections)
+		opChan = sampleOps(ctx, opChan, play.sampler)
 	}
 
+	if mirrorContext != nil {
+		var mirrorChan <-chan *RecordedOp
+		opChan, mirrorChan = teeOps(ctx, opChan)
+		mirrorDone := make(chan struct{})
+		go func() {
+			defer close(mirrorDone)
+			if err := PlayWithContext(ctx, mirrorContext, mirrorChan, play.Speed, play.Repeat, play.QueueTime); err != nil && err != ctx.Err() {
+				userInfoLogger.Logvf(Always, "Play against mirrorHost: %v", err)
+			}
+		}()
+		defer func() {
+			<-mirrorDone
+			logMirrorSummary(context, mirrorContext, comparator)
+		}()
+	}
+
+	if len(copies) > 0 {
+		outs := fanOutOps(ctx, opChan, len(copies)+1)
+		opChan = outs[0]
+		copiesDone.Add(len(copies))
+		for i, copyContext := range copies {
+			go func(copyNum int, copyContext *ExecutionContext, copyChan <-chan *RecordedOp) {
+				defer copiesDone.Done()
+				if err := PlayWithContext(ctx, copyContext, copyChan, play.Speed, play.Repeat, play.QueueTime); err != nil && err != ctx.Err() {
+					userInfoLogger.Logvf(Always, "Play of copy %v: %v", copyNum, err)
+					cancel()
+				}
+			}(i+1, copyContext, outs[i+1])
+		}
+	}
+
+	if play.speedRamp != nil {
+		go control.ramp(ctx, play.speedRamp)
+	}
+	if play.autoSpeed != nil {
+		userInfoLogger.Logvf(Always, "Adjusting the speed of the playback every %vs to hold %v", play.AutoSpeedInterval, play.AutoSpeed)
+		go control.autoSpeed(ctx, context.Events(10000), play.autoSpeed, time.Duration(play.AutoSpeedInterval)*time.Second)
+	}
+	if play.failpoints != nil {
+		if err := play.failpoints.runStart(); err != nil {
+			return err
+		}
+		// the failpoints left enabled are turned off however playback ends
+		defer func() {
+			if err := play.failpoints.finish(); err != nil {
+				userInfoLogger.Logvf(Always, "%v", err)
+			}
+		}()
+	}
+	var statusSampler *serverStatusSampler
+	if play.ServerStatus > 0 {
+		statusSampler = newServerStatusSampler(session, time.Duration(play.ServerStatus)*time.Second, statRecorder)
+		userInfoLogger.Logvf(Always, "Sampling serverStatus of %v every %vs", describeServers(play.target), play.ServerStatus)
+		go statusSampler.run(samplingCtx)
+	}
+	if watchdog != nil {
+		userInfoLogger.Logvf(Always, "Sampling currentOp of %v every %vs for ops running longer than %vms",
+			describeServers(play.target), play.CurrentOpInterval, play.LongRunningOps)
+		go watchdog.run(samplingCtx)
+	}
+	var reporter *progressReporter
+	if play.Progress {
+		reporter = startProgressReporter(context, opCount, time.Duration(play.ProgressInterval)*time.Second)
+	}
+	var dashDone <-chan struct{}
+	if dash != nil {
+		if dashDone, err = dash.show(context, opCount, cancel); err != nil {
+			return err
+		}
+	}
+	if err := PlayWithContext(ctx, context, opChan, play.Speed, play.Repeat, play.QueueTime); err != nil && err != ctx.Err() {
+		userInfoLogger.Logvf(Always, "Play: %v\n", err)
+		// stop reading the playback file and playing it against --mirrorHost
+		// or the other copies of an amplified playback
+		cancel()
+	}
+	if reporter != nil {
+		reporter.wait()
+	}
+	stopSampling()
+	if statusSampler != nil {
+		statusSampler.wait()
+	}
+	if watchdog != nil {
+		watchdog.wait()
+	}
+	if dashDone != nil {
+		<-dashDone
+	}
+	if len(copies) > 0 {
+		copiesDone.Wait()
+		for _, copyContext := range copies {
+			context.absorb(copyContext)
+		}
+		context.logSummary()
+	}
 	//handle the error from the errchan
 	err = <-errChan
-	if err != nil && err != io.EOF {
+	if err != nil && err != io.EOF && err != ctx.Err() {
 		userInfoLogger.Logvf(Always, "OpChan: %v", err)
 	}
+	var stats *CaptureStats
+	if kafkaReader != nil {
+		stats = kafkaReader.CaptureStats()
+	} else {
+		stats = playbackFileReader.CaptureStats()
+	}
+	if stats != nil && stats.Lossy() {
+		userInfoLogger.Logvf(Always, "Warning: the recording of the playback file is missing some of the "+
+			"captured traffic: %v", stats)
+	}
+	if play.explain != nil {
+		play.explain.logSummary()
+		if play.ExplainReport != "" {
+			if err := play.explain.writeReport(play.ExplainReport); err != nil {
+				return fmt.Errorf("error writing explain report: %v", err)
+			}
+			userInfoLogger.Logvf(Always, "Wrote explain report to %v", play.ExplainReport)
+		}
+	}
+	if context.cursorLeaks != nil {
+		context.cursorLeaks.logSummary()
+		if play.KillCursors {
+			killed, err := context.cursorLeaks.kill(session)
+			if err != nil {
+				userInfoLogger.Logvf(Always, "Error killing the cursors left open: %v", err)
+			}
+			if killed > 0 {
+				userInfoLogger.Logvf(Always, "Killed %v cursors left open", killed)
+			}
+		}
+	}
+	if statusSampler != nil {
+		statusSampler.logSummary()
+		if play.ServerStatusReport != "" {
+			if err := statusSampler.writeReport(play.ServerStatusReport); err != nil {
+				return fmt.Errorf("error writing serverStatus report: %v", err)
+			}
+			userInfoLogger.Logvf(Always, "Wrote serverStatus report to %v", play.ServerStatusReport)
+		}
+	}
+	if watchdog != nil {
+		watchdog.logSummary()
+	}
+	if play.indexAdvisor != nil {
+		suggested, coverage, err := play.indexAdvisor.writeReport(play.SuggestIndexes)
+		if err != nil {
+			return fmt.Errorf("error writing index suggestions: %v", err)
+		}
+		userInfoLogger.Logvf(Always, "Wrote %v suggested indexes serving %.1f%% of the replayed queries to %v",
+			suggested, coverage, play.SuggestIndexes)
+	}
+	if play.sampler != nil {
+		kept, seen := play.sampler.counts()
+		userInfoLogger.Logvf(Always, "Played %v of %v connections", kept, seen)
+	}
+	// the --after commands run even if the playback was aborted, and fail it
+	// once the other thresholds have been checked
+	afterErr := runScripts("--after", play.After, play.scriptEnv(), os.Stderr)
+	if aborted != nil {
+		return aborted
+	}
+	if len(play.assertions) > 0 {
+		verdict := context.CheckAssertions(play.assertions)
+		if err := writeVerdict(verdict, play.Verdict); err != nil {
+			return fmt.Errorf("error writing verdict: %v", err)
+		}
+		if failures := verdict.failures(); len(failures) > 0 {
+			return ErrThresholdExceeded{fmt.Sprintf("%v of %v assertions failed: %v",
+				len(failures), len(verdict.Assertions), strings.Join(failures, ", "))}
+		}
+		userInfoLogger.Logvf(Always, "All %v assertions passed", len(verdict.Assertions))
+	}
+	if play.maxErrorRate != nil && context.ErrorRate() > *play.maxErrorRate {
+		return ErrThresholdExceeded{fmt.Sprintf("%.2f%% of ops encountered errors, more than the %v allowed by --maxErrorRate",
+			context.ErrorRate()*100, play.MaxErrorRate)}
+	}
+	if afterErr != nil {
+		return ErrThresholdExceeded{afterErr.Error()}
+	}
 	return nil
 }
 
+// preprocessCursors maps the cursors of the playback file to the ops which
+// create and use them, leaving the file at its beginning. When sampler is
+// set, only the ops of the connections it keeps are preprocessed. The
+// reading and sampling of the ops stop when it returns.
+func preprocessCursors(playbackFileReader *PlaybackFileReader, sampler *connectionSampler) (*preprocessCursorManager, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opChan, errChan := playbackFileReader.OpChanWithContext(ctx, 1)
+	if sampler != nil {
+		opChan = sampleOps(ctx, opChan, sampler)
+	}
+	preprocessMap, err := newPreprocessCursorManager(opChan)
+	if err != nil {
+		cancel()
+		<-errChan
+		return nil, fmt.Errorf("PreprocessMap: %v", err)
+	}
+	if err := <-errChan; err != io.EOF {
+		return nil, fmt.Errorf("OpChan: %v", err)
+	}
+	if _, err := playbackFileReader.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	return preprocessMap, nil
+}
+
 // Play is responsible for playing ops from a RecordedOp channel to the session.
-func Play(context *ExecutionContext,
+// Ops are scheduled by the context's PacingStrategy, which defaults to
+// following the recorded timing at the given speed.
+func Play(execContext *ExecutionContext,
+	opChan <-chan *RecordedOp,
+	speed float64,
+	repeat int,
+	queueTime int) error {
+	return PlayWithContext(context.Background(), execContext, opChan, speed, repeat, queueTime)
+}
+
+// PlayWithContext works like Play, but stops playing new ops once ctx is
+// done, whether it is canceled or its deadline passes. The ops in flight are
+// then given the context's drainTimeout to complete before playback
+// finishes, flushing the collected stats, and ctx's error is returned. ctx is
+// also honored while opening connections ahead of playback and while
+// skipping the ops played before a checkpoint.
+func PlayWithContext(ctx context.Context,
+	context *ExecutionContext,
 	opChan <-chan *RecordedOp,
 	speed float64,
 	repeat int,
 	queueTime int) error {
 
+	if context.Pacing == nil {
+		context.Pacing = &RecordedPacing{Speed: speed}
+	}
+	defer context.events.close()
+	defer context.events.startProgressTicks(time.Now())()
+	if context.warmup > 0 && !context.dryRun {
+		var warmupOps []*RecordedOp
+		warmupOps, opChan = bufferWarmupOps(ctx, opChan, context.warmup)
+		count := countPlaybackConnections(warmupOps)
+		if context.pool != nil && count > context.pool.size() {
+			// the connections share the sockets of the pool
+			count = context.pool.size()
+		}
+		if context.limits.capsConns() && count > cap(context.limits.conns) {
+			count = cap(context.limits.conns)
+		}
+		context.warmConnections(ctx, count)
+		defer context.closeWarmConnections()
+	}
+
+	if context.resumeFrom != nil {
+		opChan = skipPlayedOps(ctx, context, opChan)
+	}
+	if context.checkpoint != nil {
+		context.checkpoint.start(context.checkpointInterval, context.CursorIDMap)
+	}
+
 	connectionChans := make(map[int64]chan<- *RecordedOp)
-	var playbackStartTime, recordingStartTime time.Time
+	var playbackStartTime time.Time
 	var connectionID int64
 	var opCounter int
-	for op := range opChan {
+	barriers := newBarrierSchedule(context.barriers)
+	// barrierDelay is how far the schedule was pushed back while waiting at
+	// barriers.
+	var barrierDelay time.Duration
+ops:
+	for {
+		var op *RecordedOp
+		select {
+		case <-ctx.Done():
+			if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+				userInfoLogger.Logvf(Always, "Playback timed out; no more ops will be played")
+			} else {
+				userInfoLogger.Logvf(Always, "Playback interrupted; no more ops will be played")
+			}
+			break ops
+		case nextOp, ok := <-opChan:
+			if !ok {
+				break ops
+			}
+			op = nextOp
+		}
 		opCounter++
 		if op.Seen.IsZero() {
 			return fmt.Errorf("Can't play operation found with zero-timestamp: %#v", op)
 		}
-		if recordingStartTime.IsZero() {
-			recordingStartTime = op.Seen.Time
+		if playbackStartTime.IsZero() {
 			playbackStartTime = time.Now()
+			context.Pacing.Start(playbackStartTime, op)
+		}
+		op.PlayAt = &PreciseTime{context.Pacing.PlayAt(op).Add(barrierDelay)}
+		if reached := barriers.reached(op); len(reached) > 0 {
+			if err := context.waitAtBarrier(ctx, reached, op); err != nil {
+				continue
+			}
+			if late := context.scheduleNow().Sub(op.PlayAt.Time); late > 0 && !context.fullSpeed {
+				barrierDelay += late
+				op.PlayAt = &PreciseTime{op.PlayAt.Add(late)}
+			}
 		}
-
-		// opDelta is the difference in time between when the file's recording
-		// began and and when this particular op is played. For the first
-		// operation in the playback, it's 0.
-		opDelta := op.Seen.Sub(recordingStartTime)
-
-		// Adjust the opDelta for playback by dividing it by playback speed setting;
-		// e.g. 2x speed means the delta is half as long.
-		scaledDelta := float64(opDelta) / (speed)
-		op.PlayAt = &PreciseTime{playbackStartTime.Add(time.Duration(int64(scaledDelta)))}
 
 		// Every queueGranularity ops make sure that we're no more then
 		// QueueTime seconds ahead Which should mean that the maximum that we're
@@ -158,14 +1200,14 @@ func Play(context *ExecutionContext,
 		if !context.fullSpeed {
 			if opCounter%queueGranularity == 0 {
 				toolDebugLogger.Logvf(DebugHigh, "Waiting to prevent excess buffering with opCounter: %v", opCounter)
-				time.Sleep(op.PlayAt.Add(time.Duration(-queueTime) * time.Second).Sub(time.Now()))
+				context.sleepUntil(ctx, op.PlayAt.Add(time.Duration(-queueTime)*time.Second))
 			}
 		}
 
 		connectionChan, ok := connectionChans[op.SeenConnectionNum]
 		if !ok {
 			connectionID++
-			connectionChan = context.newExecutionConnection(op.PlayAt.Time, connectionID)
+			connectionChan = context.newExecutionConnection(ctx, op.PlayAt.Time, connectionID)
 			connectionChans[op.SeenConnectionNum] = connectionChan
 		}
 		if op.EOF {
@@ -173,6 +1215,7 @@ func Play(context *ExecutionContext,
 			close(connectionChan)
 			delete(connectionChans, op.SeenConnectionNum)
 		} else {
+			context.pendingOps.Add(1)
 			connectionChan <- op
 		}
 	}
@@ -181,12 +1224,95 @@ func Play(context *ExecutionContext,
 		delete(connectionChans, connectionNum)
 	}
 	toolDebugLogger.Logvf(Info, "Waiting for connections to finish")
-	context.ConnectionChansWaitGroup.Wait()
+	if ctx.Err() != nil {
+		context.drainConnections()
+	} else {
+		context.ConnectionChansWaitGroup.Wait()
+	}
+	if context.pool != nil {
+		context.pool.close()
+	}
 
+	// the connections have finished playing, so their summaries are
+	// complete when added to the reports of the stats
+	if recorder, ok := context.StatCollector.StatRecorder.(ConnectionSummaryRecorder); ok {
+		recorder.RecordConnectionSummaries(context.connections.sorted())
+	}
 	context.StatCollector.Close()
+	if context.checkpoint != nil {
+		if err := context.checkpoint.finish(context.CursorIDMap, ctx.Err() == nil); err != nil {
+			userInfoLogger.Logvf(Always, "Error writing checkpoint: %v", err)
+		}
+	}
 	toolDebugLogger.Logvf(Always, "%v ops played back in %v seconds over %v connections", opCounter, time.Now().Sub(playbackStartTime), connectionID)
 	if repeat > 1 {
 		toolDebugLogger.Logvf(Always, "%v ops per generation for %v generations", opCounter/repeat, repeat)
 	}
-	return nil
+	if !context.quiet {
+		context.logSummary()
+	}
+	return ctx.Err()
+}
+
+// logSummary logs the number of ops played during a dry run, the errors
+// encountered and the destructive commands that were not played.
+func (context *ExecutionContext) logSummary() {
+	if context.dryRun {
+		userInfoLogger.Logvf(Always, "Dry run complete; %v ops would have been executed", context.DryRunOps())
+	}
+	if summary := context.errors.String(); summary != "" {
+		userInfoLogger.Logvf(Always, "%.2f%% of ops played encountered errors: %v", context.ErrorRate()*100, summary)
+	}
+	if filtered := context.FilteredOps(); filtered > 0 {
+		userInfoLogger.Logvf(Always, "%v ops were not played since only %vs were played", filtered, context.playOnly)
+	}
+	if blocked := context.BlockedOps(); blocked > 0 {
+		userInfoLogger.Logvf(Always, "%v destructive commands were not played; use --allowDestructive to play them", blocked)
+	}
+	if retried := context.RetriedOps(); retried > 0 {
+		userInfoLogger.Logvf(Always, "Ops were retried %v times after transient errors; %v ops were abandoned after %v retries",
+			retried, context.AbandonedOps(), context.retry.retries)
+	}
+	if skipped := context.SkippedGetMores(); skipped > 0 {
+		userInfoLogger.Logvf(Always, "%v getMores were not played since their cursors were not found on the server", skipped)
+	}
+	if reissued := context.ReissuedQueries(); reissued > 0 {
+		userInfoLogger.Logvf(Always, "%v queries were played again since their cursors were not found on the server", reissued)
+	}
+	if context.limits != nil {
+		context.limits.logSummary()
+	}
+	if translated := context.TranslatedOps(); translated > 0 {
+		userInfoLogger.Logvf(Always, "%v legacy ops were played as the equivalent commands", translated)
+	}
+	if dropped := context.DroppedGetLastErrors(); dropped > 0 {
+		userInfoLogger.Logvf(Always, "%v getLastError commands were not played, as the writes they followed were played as commands", dropped)
+	}
+	if truncated := context.TruncatedWaits(); truncated > 0 {
+		userInfoLogger.Logvf(Always, "%v getMores of tailable cursors waited less for new results than recorded", truncated)
+	}
+	if skipped := context.BudgetSpentGetMores(); skipped > 0 {
+		userInfoLogger.Logvf(Always, "%v getMores of tailable cursors were not played since their cursor's --tailableBudget was spent", skipped)
+	}
+	if remapped := context.RemappedResumeTokens(); remapped > 0 {
+		userInfoLogger.Logvf(Always, "%v change streams were resumed from the live position matching their recorded resume token", remapped)
+	}
+	if restarted := context.RestartedChangeStreams(); restarted > 0 {
+		userInfoLogger.Logvf(Always, "%v change streams resuming from a recorded position were restarted from now", restarted)
+	}
+	if batches := context.ExhaustBatches(); batches > 0 {
+		userInfoLogger.Logvf(Always, "%v batches of exhaust cursors were fetched with getMores", batches)
+	}
+	if unacknowledged := context.UnacknowledgedWrites(); unacknowledged > 0 {
+		userInfoLogger.Logvf(Always, "%v writes were played unacknowledged, as recorded", unacknowledged)
+	}
+	if downconverted := context.DownconvertedOps(); downconverted > 0 {
+		userInfoLogger.Logvf(Always, "%v commands were played as the equivalent legacy ops", downconverted)
+	}
+	if broken := context.BrokenConnectionOps(); broken > 0 {
+		userInfoLogger.Logvf(Always, "%v ops were not played since an earlier op of their connection failed with a network error", broken)
+	}
+	if context.behindThreshold > 0 {
+		context.connections.logSummary(context.behindThreshold)
+	}
 }
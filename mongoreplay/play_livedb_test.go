@@ -153,7 +153,7 @@ func TestOpInsertLiveDB(t *testing.T) {
 		}
 	}()
 
-	statCollector, _ := newStatCollector(testCollectorOpts, "format", true, true)
+	statCollector, _ := NewStatCollector(testCollectorOpts, "format", true, true)
 	statRec := statCollector.StatRecorder.(*BufferedStatRecorder)
 	replaySession, err := mgo.Dial(currentTestURL)
 	if err != nil {
@@ -273,7 +273,7 @@ func TestUpdateOpLiveDB(t *testing.T) {
 		}
 	}()
 
-	statCollector, _ := newStatCollector(testCollectorOpts, "format", true, true)
+	statCollector, _ := NewStatCollector(testCollectorOpts, "format", true, true)
 	statRec := statCollector.StatRecorder.(*BufferedStatRecorder)
 	replaySession, err := mgo.Dial(currentTestURL)
 	if err != nil {
@@ -380,7 +380,7 @@ func TestQueryOpLiveDB(t *testing.T) {
 		}
 	}()
 
-	statCollector, _ := newStatCollector(testCollectorOpts, "format", true, true)
+	statCollector, _ := NewStatCollector(testCollectorOpts, "format", true, true)
 	statRec := statCollector.StatRecorder.(*BufferedStatRecorder)
 	replaySession, err := mgo.Dial(currentTestURL)
 	if err != nil {
@@ -521,7 +521,7 @@ func TestOpGetMoreMultiCursorLiveDB(t *testing.T) {
 			}
 		}
 	}()
-	statCollector, _ := newStatCollector(testCollectorOpts, "format", true, true)
+	statCollector, _ := NewStatCollector(testCollectorOpts, "format", true, true)
 	statRec := statCollector.StatRecorder.(*BufferedStatRecorder)
 	replaySession, err := mgo.Dial(currentTestURL)
 	if err != nil {
@@ -646,7 +646,7 @@ func TestOpKillCursorsLiveDB(t *testing.T) {
 			t.Error(err)
 		}
 	}()
-	statCollector, _ := newStatCollector(testCollectorOpts, "format", true, true)
+	statCollector, _ := NewStatCollector(testCollectorOpts, "format", true, true)
 	statRec := statCollector.StatRecorder.(*BufferedStatRecorder)
 	replaySession, err := mgo.Dial(currentTestURL)
 	if err != nil {
@@ -716,7 +716,7 @@ func TestCommandOpInsertLiveDB(t *testing.T) {
 		}
 	}()
 
-	statCollector, _ := newStatCollector(testCollectorOpts, "format", true, true)
+	statCollector, _ := NewStatCollector(testCollectorOpts, "format", true, true)
 	statRec := statCollector.StatRecorder.(*BufferedStatRecorder)
 	replaySession, err := mgo.Dial(currentTestURL)
 	if err != nil {
@@ -820,7 +820,7 @@ func TestCommandOpFindLiveDB(t *testing.T) {
 		}
 	}()
 
-	statCollector, _ := newStatCollector(testCollectorOpts, "format", true, true)
+	statCollector, _ := NewStatCollector(testCollectorOpts, "format", true, true)
 	statRec := statCollector.StatRecorder.(*BufferedStatRecorder)
 	replaySession, err := mgo.Dial(currentTestURL)
 	if err != nil {
@@ -919,7 +919,7 @@ func TestMsgOpInsertLiveDB(t *testing.T) {
 		}
 	}()
 
-	statCollector, _ := newStatCollector(testCollectorOpts, "format", true, true)
+	statCollector, _ := NewStatCollector(testCollectorOpts, "format", true, true)
 	statRec := statCollector.StatRecorder.(*BufferedStatRecorder)
 	replaySession, err := mgo.Dial(currentTestURL)
 	if err != nil {
@@ -1067,7 +1067,7 @@ func getmoreTestHelper(t *testing.T,
 			}
 		}
 	}()
-	statCollector, _ := newStatCollector(testCollectorOpts, "format", true, true)
+	statCollector, _ := NewStatCollector(testCollectorOpts, "format", true, true)
 	statRec := statCollector.StatRecorder.(*BufferedStatRecorder)
 	replaySession, err := mgo.Dial(currentTestURL)
 	if err != nil {
@@ -8,9 +8,13 @@ package mongoreplay
 
 import (
 	"bytes"
+	gocontext "context"
 	"io"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/10gen/llmgo/bson"
 )
 
 func TestRepeatGeneration(t *testing.T) {
@@ -127,3 +131,78 @@ func TestPlayOpEOF(t *testing.T) {
 		t.Errorf("should have eof at end, but got %v", err)
 	}
 }
+
+func TestPlayDryRun(t *testing.T) {
+	numInserts := 5
+	generator := newRecordedOpGenerator()
+	go func() {
+		defer close(generator.opChan)
+		if err := generator.generateMsgOpInsertHelper("dry run", 0, numInserts); err != nil {
+			t.Error(err)
+		}
+		if err := generator.generateCommandOp("dropDatabase", bson.D{{"dropDatabase", 1}}, 0); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	statCollector, _ := NewStatCollector(StatOptions{Buffered: true}, "format", true, true)
+	statRec := statCollector.StatRecorder.(*BufferedStatRecorder)
+	// no session is given, so any attempt to connect would panic
+	context := NewExecutionContext(statCollector, nil, &ExecutionOptions{fullSpeed: true, dryRun: true})
+	if err := Play(context, generator.opChan, 1, 1, 10); err != nil {
+		t.Fatalf("error playing traffic: %v", err)
+	}
+
+	if ops := context.DryRunOps(); ops != int64(numInserts) {
+		t.Errorf("expected %v ops to be counted by the dry run, saw %v", numInserts, ops)
+	}
+	if blocked := context.BlockedOps(); blocked != 1 {
+		t.Errorf("expected the dropDatabase to be blocked, saw %v blocked ops", blocked)
+	}
+	if len(statRec.Buffer) != numInserts+1 {
+		t.Fatalf("expected %v stats, saw %v", numInserts+1, len(statRec.Buffer))
+	}
+	for _, stat := range statRec.Buffer[:numInserts] {
+		if stat.Command != "insert" || !strings.HasPrefix(stat.Message, "Not executed during dry run") {
+			t.Errorf("unexpected stat for dry run insert: %#v", stat)
+		}
+	}
+}
+
+func TestPlayInterrupted(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	if err := generator.generateMsgOpInsertHelper("interrupted", 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	close(generator.opChan)
+	opChan := make(chan *RecordedOp, 2)
+	for op := range generator.opChan {
+		opChan <- op
+	}
+	// the second op isn't due until long after the playback is interrupted
+	last := <-opChan
+	last.Seen = &PreciseTime{last.Seen.Add(time.Hour)}
+	opChan <- last
+
+	statCollector, _ := NewStatCollector(StatOptions{Buffered: true}, "format", true, true)
+	context := NewExecutionContext(statCollector, nil, &ExecutionOptions{dryRun: true})
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	errChan := make(chan error)
+	go func() {
+		errChan <- PlayWithContext(ctx, context, opChan, 1, 1, 10)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errChan:
+		if err != gocontext.Canceled {
+			t.Errorf("expected playback to be canceled, saw %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("playback did not stop after being interrupted")
+	}
+	if ops := context.DryRunOps(); ops != 1 {
+		t.Errorf("expected only the first op to be played, saw %v ops played", ops)
+	}
+}
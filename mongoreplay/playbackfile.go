@@ -8,6 +8,7 @@ package mongoreplay
 
 import (
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -18,11 +19,37 @@ import (
 	"github.com/mongodb/mongo-tools/common/util"
 )
 
-const PlaybackFileVersion = 1
+// PlaybackFileVersion is the version of the playback files written, which
+// readers reject when it is newer than theirs. Playback files end with an
+// integrity footer from version 2, which readers of version 1 would read as
+// an op.
+const PlaybackFileVersion = 2
+
+// playbackFileFooterVersion is the first version of the playback files which
+// end with an integrity footer.
+const playbackFileFooterVersion = 2
+
+// stdStream is the name of the playback file read from stdin or written to
+// stdout, so that playback files can be piped between commands.
+const stdStream = "-"
+
+// maxStreamRewind is the number of bytes of a playback file read from stdin
+// kept to be read again, which must hold its metadata.
+const maxStreamRewind = 1024 * 1024
 
 type PlaybackFileMetadata struct {
 	PlaybackFileVersion int
 	DriverOpsFiltered   bool
+	// Segment is the position of the playback file among those of a
+	// recording rotated by --rotateSize or --rotateInterval, from 0, and
+	// RecordingStart the time at which that recording started, which all of
+	// its playback files share. Both are zero unless the recording was
+	// rotated.
+	Segment        int       `bson:",omitempty"`
+	RecordingStart time.Time `bson:",omitempty"`
+	// RepliesCompacted is set on the playback files written by compact,
+	// whose replies hold only what playback needs of them.
+	RepliesCompacted bool `bson:",omitempty"`
 }
 
 // PlaybackFileReader stores the necessary information for a playback source,
@@ -32,6 +59,8 @@ type PlaybackFileReader struct {
 	fname                   string
 	parallelFileReadManager *parallelFileReadManager
 	metadata                PlaybackFileMetadata
+	// closer is the file read, which Close closes
+	closer io.Closer
 }
 
 // PlaybackFileWriter stores the necessary information for a playback destination,
@@ -52,20 +81,58 @@ type GzipReadSeeker struct {
 // NewPlaybackFileReader initializes a new PlaybackFileReader
 func NewPlaybackFileReader(filename string, gzip bool) (*PlaybackFileReader, error) {
 	var readSeeker io.ReadSeeker
+	var err error
+
+	if filename == stdStream {
+		readSeeker = &streamReadSeeker{r: os.Stdin}
+	} else if isObjectURL(filename) {
+		readSeeker, err = openObjectReader(filename)
+	} else {
+		readSeeker, err = os.Open(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var closer io.Closer
+	if closable, ok := readSeeker.(io.Closer); ok && filename != stdStream {
+		closer = closable
+	}
+
+	reader, err := playbackFileReaderFromTape(readSeeker, filename, gzip)
+	if err != nil {
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, err
+	}
+	reader.closer = closer
+	return reader, nil
+}
 
-	readSeeker, err := os.Open(filename)
+// playbackFileReaderFromTape reads the playback file stored in rs, which is
+// decrypted and decompressed as needed.
+func playbackFileReaderFromTape(rs io.ReadSeeker, filename string, gzip bool) (*PlaybackFileReader, error) {
+	rs, err := openTape(rs)
 	if err != nil {
 		return nil, err
 	}
 
 	if gzip {
-		readSeeker, err = NewGzipReadSeeker(readSeeker)
+		rs, err = NewGzipReadSeeker(rs)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return playbackFileReaderFromReadSeeker(readSeeker, filename)
+	return playbackFileReaderFromReadSeeker(rs, filename)
+}
+
+// Close closes the file the PlaybackFileReader reads, unless it is stdin.
+func (file *PlaybackFileReader) Close() error {
+	if file.closer == nil {
+		return nil
+	}
+	return file.closer.Close()
 }
 
 func playbackFileReaderFromReadSeeker(rs io.ReadSeeker, filename string) (*PlaybackFileReader, error) {
@@ -75,6 +142,10 @@ func playbackFileReaderFromReadSeeker(rs io.ReadSeeker, filename string) (*Playb
 	if err != nil {
 		return nil, fmt.Errorf("error reading metadata: %v", err)
 	}
+	if metadata.PlaybackFileVersion > PlaybackFileVersion {
+		return nil, fmt.Errorf("playback file %v is of version %v, newer than version %v read by this mongoreplay",
+			filename, metadata.PlaybackFileVersion, PlaybackFileVersion)
+	}
 
 	return &PlaybackFileReader{
 		ReadSeeker: rs,
@@ -84,10 +155,12 @@ func playbackFileReaderFromReadSeeker(rs io.ReadSeeker, filename string) (*Playb
 	}, nil
 }
 
-func (pfReader *PlaybackFileReader) beginParallelRead() {
+// beginParallelRead starts reading the ops of the file, which begin at the
+// given offset, past its metadata.
+func (pfReader *PlaybackFileReader) beginParallelRead(offset int64) {
 	pfReader.parallelFileReadManager = &parallelFileReadManager{}
 	numWorkers := runtime.NumCPU()
-	pfReader.parallelFileReadManager.begin(numWorkers, pfReader.ReadSeeker)
+	pfReader.parallelFileReadManager.begin(numWorkers, pfReader.ReadSeeker, offset)
 }
 
 // NextRecordedOp iterates through the PlaybackFileReader to yield the next
@@ -96,24 +169,49 @@ func (file *PlaybackFileReader) NextRecordedOp() (*RecordedOp, error) {
 	return file.parallelFileReadManager.next()
 }
 
+// CaptureStats returns the capture stats written at the end of the playback
+// file, once it has been read up to them, or nil if it doesn't have any.
+func (file *PlaybackFileReader) CaptureStats() *CaptureStats {
+	if file.parallelFileReadManager == nil {
+		return nil
+	}
+	return file.parallelFileReadManager.captureStats
+}
+
 // NewPlaybackFileWriter initializes a new PlaybackFileWriter
 func NewPlaybackFileWriter(playbackFileName string, driverOpsFiltered, isGzipWriter bool) (*PlaybackFileWriter, error) {
 	metadata := PlaybackFileMetadata{
 		PlaybackFileVersion: PlaybackFileVersion,
 		DriverOpsFiltered:   driverOpsFiltered,
 	}
+	return newPlaybackFileWriter(playbackFileName, metadata, isGzipWriter)
+}
+
+func newPlaybackFileWriter(playbackFileName string, metadata PlaybackFileMetadata,
+	isGzipWriter bool) (*PlaybackFileWriter, error) {
 
 	toolDebugLogger.Logvf(DebugLow, "Opening playback file %v", playbackFileName)
-	file, err := os.Create(playbackFileName)
+	var file io.WriteCloser
+	var err error
+	if playbackFileName == stdStream {
+		file = os.Stdout
+	} else if isObjectURL(playbackFileName) {
+		file, err = createObjectWriter(playbackFileName)
+	} else {
+		file, err = os.Create(playbackFileName)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error opening playback file to write to: %v", err)
 	}
 
-	var wc io.WriteCloser
-	wc = file
+	wc, err := newEncryptingWriteCloser(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error encrypting playback file: %v", err)
+	}
 
 	if isGzipWriter {
-		wc = &util.WrappedWriteCloser{gzip.NewWriter(file), file}
+		wc = &util.WrappedWriteCloser{gzip.NewWriter(wc), wc}
 	}
 
 	return playbackFileWriterFromWriteCloser(wc, playbackFileName, metadata)
@@ -122,6 +220,10 @@ func NewPlaybackFileWriter(playbackFileName string, driverOpsFiltered, isGzipWri
 func playbackFileWriterFromWriteCloser(wc io.WriteCloser, filename string,
 	metadata PlaybackFileMetadata) (*PlaybackFileWriter, error) {
 
+	wc, err := newIntegrityWriteCloser(wc)
+	if err != nil {
+		return nil, err
+	}
 	bsonBytes, err := bson.Marshal(metadata)
 	if err != nil {
 		return nil, fmt.Errorf("error writing metadata: %v", err)
@@ -141,6 +243,20 @@ func playbackFileWriterFromWriteCloser(wc io.WriteCloser, filename string,
 
 }
 
+// WriteRecordedOp writes a recorded op to the playback file.
+func (pfWriter *PlaybackFileWriter) WriteRecordedOp(op *RecordedOp) error {
+	return bsonToWriter(pfWriter, op)
+}
+
+// WriteCaptureStats ends the playback file with the capture stats of its
+// recording. No op may be written after them.
+func (pfWriter *PlaybackFileWriter) WriteCaptureStats(stats CaptureStats) error {
+	if err := bsonToWriter(pfWriter, playbackFileTrailer{stats}); err != nil {
+		return fmt.Errorf("error writing capture stats: %v", err)
+	}
+	return nil
+}
+
 // NewGzipReadSeeker initializes a new GzipReadSeeker
 func NewGzipReadSeeker(rs io.ReadSeeker) (*GzipReadSeeker, error) {
 	gzipReader, err := gzip.NewReader(rs)
@@ -164,12 +280,78 @@ func (g *GzipReadSeeker) Seek(offset int64, whence int) (int64, error) {
 	return 0, nil
 }
 
+// streamReadSeeker reads a stream, such as stdin, as an io.ReadSeeker which
+// can seek back to its start once, as the playback file readers do once
+// they have read the metadata. The bytes read until then are kept, to be
+// read again after the seek.
+type streamReadSeeker struct {
+	r        io.Reader
+	read     []byte
+	replay   []byte
+	offset   int64
+	rewound  bool
+	overflow bool
+}
+
+func (s *streamReadSeeker) Read(p []byte) (int, error) {
+	if len(s.replay) > 0 {
+		n := copy(p, s.replay)
+		s.replay = s.replay[n:]
+		s.offset += int64(n)
+		return n, nil
+	}
+	n, err := s.r.Read(p)
+	if !s.rewound {
+		if len(s.read)+n > maxStreamRewind {
+			s.overflow = true
+			s.read = nil
+		} else if !s.overflow {
+			s.read = append(s.read, p[:n]...)
+		}
+	}
+	s.offset += int64(n)
+	return n, err
+}
+
+// Seek returns the offset of the next Read, or seeks back to the start of
+// the stream the first time it is asked to.
+func (s *streamReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch {
+	case offset == 0 && whence == io.SeekCurrent:
+		return s.offset, nil
+	case offset == 0 && whence == io.SeekStart && !s.rewound && !s.overflow:
+		s.rewound = true
+		s.replay, s.read = s.read, nil
+		s.offset = 0
+		return 0, nil
+	}
+	return 0, fmt.Errorf("can't seek in a playback file read from stdin, which can only be read once")
+}
+
+// countStdStreams returns the number of playback files of names read from
+// stdin, which can't be read by more than one.
+func countStdStreams(names []string) int {
+	count := 0
+	for _, name := range names {
+		if name == stdStream {
+			count++
+		}
+	}
+	return count
+}
+
 // OpChan runs a goroutine that will read and unmarshal recorded ops
 // from a file and push them in to a recorded op chan. Any errors encountered
 // are pushed to an error chan. Both the recorded op chan and the error chan are
 // returned by the function.
 // The error chan won't be readable until the recorded op chan gets closed.
 func (pfReader *PlaybackFileReader) OpChan(repeat int) (<-chan *RecordedOp, <-chan error) {
+	return pfReader.OpChanWithContext(context.Background(), repeat)
+}
+
+// OpChanWithContext works like OpChan, but stops reading once ctx is done,
+// closing the recorded op chan and pushing ctx's error to the error chan.
+func (pfReader *PlaybackFileReader) OpChanWithContext(ctx context.Context, repeat int) (<-chan *RecordedOp, <-chan error) {
 	ch := make(chan *RecordedOp)
 	e := make(chan error)
 
@@ -188,13 +370,12 @@ func (pfReader *PlaybackFileReader) OpChan(repeat int) (<-chan *RecordedOp, <-ch
 				}
 
 				// Must read the metadata since file was seeked to 0
-				metadata := new(PlaybackFileMetadata)
-				err = bsonFromReader(pfReader, metadata)
+				metadata, err := ReadDocument(pfReader)
 				if err != nil {
 					return fmt.Errorf("bson read error: %v", err)
 				}
 
-				pfReader.beginParallelRead()
+				pfReader.beginParallelRead(int64(len(metadata)))
 				var order int64
 				for {
 					if err = pfReader.parallelFileReadManager.err(); err != nil {
@@ -220,7 +401,11 @@ func (pfReader *PlaybackFileReader) OpChan(repeat int) (<-chan *RecordedOp, <-ch
 					// session. We don't want to close the session until the
 					// connection closes in the last generation.
 					if !recordedOp.EOF || generation == repeat-1 {
-						ch <- recordedOp
+						select {
+						case ch <- recordedOp:
+						case <-ctx.Done():
+							return ctx.Err()
+						}
 					}
 					order++
 				}
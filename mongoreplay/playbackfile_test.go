@@ -0,0 +1,108 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/mongodb/mongo-tools/common/util"
+)
+
+func TestStreamReadSeeker(t *testing.T) {
+	type testCase struct {
+		name string
+		gzip bool
+	}
+	cases := []testCase{
+		{name: "playback file piped to stdin"},
+		{name: "gzipped playback file piped to stdin", gzip: true},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		b := &bytes.Buffer{}
+		var wc io.WriteCloser = NopWriteCloser(b)
+		if c.gzip {
+			wc = &util.WrappedWriteCloser{gzip.NewWriter(b), wc}
+		}
+		playbackWriter, err := playbackFileWriterFromWriteCloser(wc, "-", PlaybackFileMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		generator := newRecordedOpGenerator()
+		if err := generator.generateInsertHelper("insert", 0, 10); err != nil {
+			t.Fatal(err)
+		}
+		close(generator.opChan)
+		for op := range generator.opChan {
+			if err := playbackWriter.WriteRecordedOp(op); err != nil {
+				t.Fatal(err)
+			}
+		}
+		playbackWriter.Close()
+
+		// the stream can't seek but for the Seek of the stream reader
+		var rs io.ReadSeeker = &streamReadSeeker{r: struct{ io.Reader }{b}}
+		if c.gzip {
+			if rs, err = NewGzipReadSeeker(rs); err != nil {
+				t.Fatal(err)
+			}
+		}
+		playbackReader, err := playbackFileReaderFromReadSeeker(rs, "-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opChan, errChan := playbackReader.OpChan(1)
+		var numOps int
+		for range opChan {
+			numOps++
+		}
+		if err := <-errChan; err != io.EOF {
+			t.Fatal(err)
+		}
+		if numOps != 10 {
+			t.Errorf("expected 10 ops, got %v", numOps)
+		}
+
+		// the stream can only be read once
+		opChan, errChan = playbackReader.OpChan(1)
+		for range opChan {
+		}
+		if err := <-errChan; err == nil || err == io.EOF {
+			t.Errorf("expected an error reading the stream again, got %v", err)
+		}
+	}
+}
+
+func TestPlaybackFileVersion(t *testing.T) {
+	type testCase struct {
+		name    string
+		version int
+		err     bool
+	}
+	cases := []testCase{
+		{name: "written before footers", version: 1},
+		{name: "current", version: PlaybackFileVersion},
+		{name: "newer", version: PlaybackFileVersion + 1, err: true},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		b := &bytes.Buffer{}
+		playbackWriter, err := playbackFileWriterFromWriteCloser(NopWriteCloser(b), "-",
+			PlaybackFileMetadata{PlaybackFileVersion: c.version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		playbackWriter.Close()
+		_, err = playbackFileReaderFromReadSeeker(bytes.NewReader(b.Bytes()), "-")
+		if (err != nil) != c.err {
+			t.Errorf("expected error %v, got %v", c.err, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-tools/common/progress"
+)
+
+// progressBarLength is the number of characters of the progress bar logged
+// during playback.
+const progressBarLength = 24
+
+// progressReporter logs the progress of a playback every interval: the ops
+// played and, when the number of ops to play is known, the share of the
+// playback they make up and the projected completion time, along with the
+// speed of the playback relative to that of the recording.
+type progressReporter struct {
+	total    int64
+	interval time.Duration
+	done     chan struct{}
+
+	// generation and lastSeen are the latest generation played and the
+	// latest recorded time of its ops played, while the recorded time
+	// played since the previous report is accumulated.
+	generation   int
+	lastSeen     time.Time
+	recorded     time.Duration
+	lastReported time.Time
+}
+
+// startProgressReporter starts logging the progress of the playback of the
+// context, which plays total ops, or an unknown number if total is 0. It
+// must be called before playback starts. The returned reporter logs the
+// final progress once playback finishes.
+func startProgressReporter(context *ExecutionContext, total int64, interval time.Duration) *progressReporter {
+	reporter := &progressReporter{total: total, interval: interval, done: make(chan struct{})}
+	events := context.Events(10000)
+	go func() {
+		defer close(reporter.done)
+		var last *Progress
+		for event := range events {
+			switch event.Type {
+			case OpCompleted:
+				if event.Op != nil {
+					reporter.observe(event.Op)
+				}
+			case ProgressTick:
+				last = event.Progress
+				if reporter.lastReported.IsZero() {
+					reporter.lastReported = event.Time.Add(-last.Elapsed)
+				}
+				if event.Time.Sub(reporter.lastReported) >= reporter.interval {
+					userInfoLogger.Logvf(Always, "Progress: %v", reporter.report(last, event.Time))
+				}
+			}
+		}
+		if last != nil {
+			userInfoLogger.Logvf(Always, "Progress: %v", reporter.report(last, time.Now()))
+		}
+	}()
+	return reporter
+}
+
+// wait waits for the final progress to be logged once playback finishes.
+func (reporter *progressReporter) wait() {
+	<-reporter.done
+}
+
+// observe accumulates the recorded time played with an op. Each repetition
+// of the playback file starts its recorded times over.
+func (reporter *progressReporter) observe(op *RecordedOp) {
+	if op.Generation != reporter.generation || reporter.lastSeen.IsZero() {
+		if op.Generation < reporter.generation {
+			return
+		}
+		reporter.generation = op.Generation
+		reporter.lastSeen = op.Seen.Time
+		return
+	}
+	if op.Seen.After(reporter.lastSeen) {
+		reporter.recorded += op.Seen.Sub(reporter.lastSeen)
+		reporter.lastSeen = op.Seen.Time
+	}
+}
+
+// report formats the progress of the playback at now, resetting the recorded
+// time played since the previous report.
+func (reporter *progressReporter) report(current *Progress, now time.Time) string {
+	sinceReport := now.Sub(reporter.lastReported)
+	recorded := reporter.recorded
+	reporter.recorded = 0
+	reporter.lastReported = now
+	return formatProgress(current, reporter.total, recorded, sinceReport)
+}
+
+// formatProgress lays out the progress of a playback of total ops, in which
+// recorded time of the recording was played back over the last interval.
+func formatProgress(current *Progress, total int64, recorded, interval time.Duration) string {
+	parts := []string{}
+	rate := 0.0
+	if current.Elapsed > 0 {
+		rate = float64(current.OpsCompleted) / current.Elapsed.Seconds()
+	}
+	if total > 0 {
+		fraction := float64(current.OpsCompleted) / float64(total)
+		if fraction > 1 {
+			fraction = 1
+		}
+		parts = append(parts, fmt.Sprintf("%v %.1f%% %v/%v ops", drawProgressBar(fraction), fraction*100,
+			current.OpsCompleted, total))
+	} else {
+		parts = append(parts, fmt.Sprintf("%v ops", current.OpsCompleted))
+	}
+	parts = append(parts, fmt.Sprintf("%.1f ops/s", rate))
+	if interval > 0 {
+		parts = append(parts, fmt.Sprintf("%.2fx recorded speed", recorded.Seconds()/interval.Seconds()))
+	}
+	if current.Errors > 0 {
+		parts = append(parts, fmt.Sprintf("%v errors", current.Errors))
+	}
+	if remaining := total - current.OpsCompleted; total > 0 && remaining > 0 && rate > 0 {
+		eta := time.Duration(float64(remaining) / rate * float64(time.Second)).Round(time.Second)
+		parts = append(parts, fmt.Sprintf("ETA %v (in %v)", time.Now().Add(eta).Format("15:04:05"), eta))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// drawProgressBar draws a bar filled to the given fraction, such as
+// "[######..................]".
+func drawProgressBar(fraction float64) string {
+	filled := int(fraction * progressBarLength)
+	buf := &bytes.Buffer{}
+	buf.WriteString(progress.BarLeft)
+	buf.WriteString(strings.Repeat(progress.BarFilling, filled))
+	buf.WriteString(strings.Repeat(progress.BarEmpty, progressBarLength-filled))
+	buf.WriteString(progress.BarRight)
+	return buf.String()
+}
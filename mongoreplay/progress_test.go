@@ -0,0 +1,108 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatProgress(t *testing.T) {
+	type testCase struct {
+		name     string
+		progress Progress
+		total    int64
+		recorded time.Duration
+		expected []string
+	}
+	cases := []testCase{
+		{
+			name:     "known total",
+			progress: Progress{OpsCompleted: 250, Elapsed: 10 * time.Second},
+			total:    1000,
+			recorded: 20 * time.Second,
+			expected: []string{"[######..................] 25.0% 250/1000 ops", "25.0 ops/s", "2.00x recorded speed", "(in 30s)"},
+		},
+		{
+			name:     "unknown total",
+			progress: Progress{OpsCompleted: 250, Elapsed: 10 * time.Second, Errors: 3},
+			recorded: 5 * time.Second,
+			expected: []string{"250 ops, 25.0 ops/s, 0.50x recorded speed, 3 errors"},
+		},
+		{
+			name:     "complete",
+			progress: Progress{OpsCompleted: 1000, Elapsed: 10 * time.Second},
+			total:    1000,
+			expected: []string{"[########################] 100.0% 1000/1000 ops"},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		formatted := formatProgress(&c.progress, c.total, c.recorded, 10*time.Second)
+		for _, expected := range c.expected {
+			if !strings.Contains(formatted, expected) {
+				t.Errorf("expected %q in %q", expected, formatted)
+			}
+		}
+		if c.total > 0 && c.progress.OpsCompleted >= c.total && strings.Contains(formatted, "ETA") {
+			t.Errorf("expected no ETA once every op was played, got %q", formatted)
+		}
+	}
+}
+
+func TestProgressReporterObserve(t *testing.T) {
+	start := time.Now()
+	op := func(generation int, offset time.Duration) *RecordedOp {
+		return &RecordedOp{Seen: &PreciseTime{start.Add(offset)}, Generation: generation}
+	}
+	reporter := &progressReporter{}
+	for _, recordedOp := range []*RecordedOp{
+		op(0, 0),
+		op(0, 2*time.Second),
+		// ops of other connections may complete out of order
+		op(0, time.Second),
+		op(0, 3*time.Second),
+		// the next repetition starts the recording over
+		op(1, 0),
+		op(1, 4*time.Second),
+		op(0, 10*time.Second),
+	} {
+		reporter.observe(recordedOp)
+	}
+	if reporter.recorded != 7*time.Second {
+		t.Errorf("expected 7s of the recording to be played, got %v", reporter.recorded)
+	}
+}
+
+func TestPlayProgress(t *testing.T) {
+	numInserts := 10
+	generator := newRecordedOpGenerator()
+	go func() {
+		defer close(generator.opChan)
+		if err := generator.generateMsgOpInsertHelper("progress", 0, numInserts); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	statCollector, _ := NewStatCollector(StatOptions{}, "none", true, true)
+	context := NewExecutionContext(statCollector, nil, &ExecutionOptions{fullSpeed: true, dryRun: true})
+	reporter := startProgressReporter(context, int64(numInserts), time.Hour)
+	if err := Play(context, generator.opChan, 1, 1, 10); err != nil {
+		t.Fatalf("error playing traffic: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		reporter.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("progress reporter did not finish once playback finished")
+	}
+}
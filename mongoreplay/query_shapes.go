@@ -0,0 +1,388 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// typeMarker replaces a value matched by a query in its shape, naming the
+// type of the value.
+type typeMarker string
+
+// queryShapeCommands is the set of commands whose queries have shapes.
+var queryShapeCommands = map[string]bool{
+	"find":      true,
+	"aggregate": true,
+	"count":     true,
+	"distinct":  true,
+}
+
+// queryShape is the form of a query: the namespace and command it is run
+// with and its filter, sort and projection, or its pipeline, with the values
+// it matches replaced by their types. Queries which differ only by the values
+// they match share a shape, and usually a plan.
+type queryShape struct {
+	Ns      string
+	Command string
+	// Shape lays out the parts of the query which make up its shape.
+	Shape string
+
+	// filter and sort are the shapes of the filter of the query and of the
+	// order it sorts by, the filter and sort of an aggregation being those
+	// of the stages at the start of its pipeline.
+	filter bson.D
+	sort   bson.D
+}
+
+// queryShapeOf returns the shape of a find, aggregate, count or distinct
+// command run against the database db, or nil if the command is not one of
+// those.
+func queryShapeOf(db string, command bson.D) *queryShape {
+	if len(command) == 0 || !queryShapeCommands[command[0].Name] {
+		return nil
+	}
+	shape := &queryShape{Command: command[0].Name}
+	if collection, ok := command[0].Value.(string); ok {
+		shape.Ns = db + "." + collection
+	} else {
+		// aggregations such as {aggregate: 1} run against the database
+		shape.Ns = db
+	}
+
+	parts := bson.D{}
+	field := func(name string) (bson.D, bool) {
+		value, ok := FindValueByKey(name, &command)
+		if !ok {
+			return nil, false
+		}
+		doc, err := bsonToD(value)
+		return doc, err == nil
+	}
+	switch shape.Command {
+	case "find":
+		if filter, ok := field("filter"); ok && len(filter) > 0 {
+			shape.filter = shapeOfFilter(filter)
+			parts = append(parts, bson.DocElem{Name: "filter", Value: shape.filter})
+		}
+		if sort, ok := field("sort"); ok && len(sort) > 0 {
+			shape.sort = sort
+			parts = append(parts, bson.DocElem{Name: "sort", Value: sort})
+		}
+		if projection, ok := field("projection"); ok && len(projection) > 0 {
+			parts = append(parts, bson.DocElem{Name: "projection", Value: projection})
+		}
+	case "count", "distinct":
+		if key, ok := FindValueByKey("key", &command); ok {
+			parts = append(parts, bson.DocElem{Name: "key", Value: key})
+		}
+		if query, ok := field("query"); ok && len(query) > 0 {
+			shape.filter = shapeOfFilter(query)
+			parts = append(parts, bson.DocElem{Name: "query", Value: shape.filter})
+		}
+	case "aggregate":
+		value, _ := FindValueByKey("pipeline", &command)
+		stages, _ := value.([]interface{})
+		pipeline := make([]interface{}, 0, len(stages))
+		// only the $match and $sort stages at the start of the pipeline can
+		// use an index
+		leading := true
+		for _, stage := range stages {
+			stageDoc, err := bsonToD(stage)
+			if err != nil || len(stageDoc) == 0 {
+				continue
+			}
+			stageShape := shapeOfStage(stageDoc)
+			switch {
+			case !leading:
+			case stageDoc[0].Name == "$match" && shape.filter == nil:
+				shape.filter, _ = stageShape[0].Value.(bson.D)
+			case stageDoc[0].Name == "$sort" && shape.sort == nil:
+				shape.sort, _ = stageShape[0].Value.(bson.D)
+			default:
+				leading = false
+			}
+			pipeline = append(pipeline, stageShape)
+		}
+		parts = append(parts, bson.DocElem{Name: "pipeline", Value: pipeline})
+	}
+	shape.Shape = formatShape(parts)
+	return shape
+}
+
+// queryShapeOfOp returns the shape of the query sent by an op, or nil if the
+// op is not a query. Legacy queries have the shape of the equivalent find
+// command.
+func queryShapeOfOp(op Op) (*queryShape, error) {
+	switch castOp := op.(type) {
+	case *QueryOp:
+		query, wrapper, err := unwrapQuery(castOp.Query)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(castOp.Collection, ".$cmd") {
+			return queryShapeOf(strings.TrimSuffix(castOp.Collection, ".$cmd"), query), nil
+		}
+		return queryShapeOf(legacyFindCommand(castOp, query, wrapper)), nil
+	case *CommandOp:
+		if !queryShapeCommands[castOp.CommandName] {
+			return nil, nil
+		}
+		args, err := bsonToD(castOp.CommandArgs)
+		if err != nil {
+			return nil, err
+		}
+		return queryShapeOf(castOp.Database, args), nil
+	case *MsgOp:
+		if !queryShapeCommands[castOp.CommandName] {
+			return nil, nil
+		}
+		body, _, err := fetchPayload0Data(castOp.Sections)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := bsonToD(body)
+		if err != nil {
+			return nil, err
+		}
+		return queryShapeOf(castOp.Database, doc), nil
+	}
+	return nil, nil
+}
+
+// unwrapQuery returns the query of an OP_QUERY and, if the query is wrapped
+// along with its options, such as its sort or read preference, the wrapper.
+func unwrapQuery(value interface{}) (query, wrapper bson.D, err error) {
+	query, err = bsonToD(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(query) > 0 && (query[0].Name == "$query" || query[0].Name == "query") {
+		wrapper = query
+		if query, err = bsonToD(query[0].Value); err != nil {
+			return nil, nil, err
+		}
+	}
+	return query, wrapper, nil
+}
+
+// legacyFindCommand returns the database and the find command equivalent
+// to a legacy OP_QUERY.
+func legacyFindCommand(op *QueryOp, query, wrapper bson.D) (string, bson.D) {
+	db, collection := op.Collection, ""
+	if i := strings.Index(op.Collection, "."); i >= 0 {
+		db, collection = op.Collection[:i], op.Collection[i+1:]
+	}
+	command := bson.D{{Name: "find", Value: collection}, {Name: "filter", Value: query}}
+	for _, modifier := range []struct{ name, field string }{
+		{"$orderby", "sort"}, {"orderby", "sort"}, {"$hint", "hint"}, {"$min", "min"}, {"$max", "max"},
+	} {
+		if value, ok := FindValueByKey(modifier.name, &wrapper); ok {
+			command = append(command, bson.DocElem{Name: modifier.field, Value: value})
+		}
+	}
+	if op.Selector != nil {
+		command = append(command, bson.DocElem{Name: "projection", Value: op.Selector})
+	}
+	if op.Skip > 0 {
+		command = append(command, bson.DocElem{Name: "skip", Value: op.Skip})
+	}
+	if op.Limit != 0 {
+		limit := op.Limit
+		if limit < 0 {
+			limit = -limit
+		}
+		command = append(command, bson.DocElem{Name: "limit", Value: limit})
+	}
+	return db, command
+}
+
+// String returns the namespace, command and shape of the query, which
+// together identify the shape.
+func (shape *queryShape) String() string {
+	return fmt.Sprintf("%v %v %v", shape.Ns, shape.Command, shape.Shape)
+}
+
+// shapeOfStage returns the shape of an aggregation stage. The order sorted by
+// and the fields projected are part of the shape, while the values of other
+// stages are replaced by their types.
+func shapeOfStage(stage bson.D) bson.D {
+	name := stage[0].Name
+	switch name {
+	case "$match":
+		if filter, err := bsonToD(stage[0].Value); err == nil {
+			return bson.D{{Name: name, Value: shapeOfFilter(filter)}}
+		}
+	case "$sort", "$project", "$unset", "$count":
+		return stage[:1]
+	}
+	return bson.D{{Name: name, Value: shapeOfValue(stage[0].Value)}}
+}
+
+// shapeOfFilter returns the shape of a query filter, keeping the fields and
+// operators it matches with and replacing the values matched by their types.
+func shapeOfFilter(filter bson.D) bson.D {
+	shape := make(bson.D, 0, len(filter))
+	for _, elem := range filter {
+		var value interface{}
+		switch {
+		case elem.Name == "$and" || elem.Name == "$or" || elem.Name == "$nor":
+			clauses, _ := elem.Value.([]interface{})
+			clauseShapes := make([]interface{}, 0, len(clauses))
+			for _, clause := range clauses {
+				if clauseDoc, err := bsonToD(clause); err == nil {
+					clauseShapes = append(clauseShapes, shapeOfFilter(clauseDoc))
+				}
+			}
+			value = clauseShapes
+		case strings.HasPrefix(elem.Name, "$"):
+			value = shapeOfValue(elem.Value)
+		default:
+			value = shapeOfMatch(elem.Value)
+		}
+		shape = append(shape, bson.DocElem{Name: elem.Name, Value: value})
+	}
+	return shape
+}
+
+// shapeOfMatch returns the shape of the value a field is matched against,
+// which is either a value compared for equality or a document of operators.
+func shapeOfMatch(value interface{}) interface{} {
+	doc, err := bsonToD(value)
+	if err != nil || len(doc) == 0 || !strings.HasPrefix(doc[0].Name, "$") {
+		return markerOf(value)
+	}
+	shape := make(bson.D, 0, len(doc))
+	for _, elem := range doc {
+		var operand interface{}
+		switch elem.Name {
+		case "$elemMatch", "$not":
+			if operandDoc, err := bsonToD(elem.Value); err == nil {
+				if len(operandDoc) > 0 && strings.HasPrefix(operandDoc[0].Name, "$") {
+					operand = shapeOfMatch(operandDoc)
+				} else {
+					operand = shapeOfFilter(operandDoc)
+				}
+				break
+			}
+			operand = markerOf(elem.Value)
+		case "$exists":
+			operand = elem.Value
+		default:
+			operand = markerOf(elem.Value)
+		}
+		shape = append(shape, bson.DocElem{Name: elem.Name, Value: operand})
+	}
+	return shape
+}
+
+// shapeOfValue replaces every value in a document or array with its type,
+// leaving the field paths, such as "$a.b", which refer to the documents
+// being processed.
+func shapeOfValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return markerOf(v)
+	case string:
+		if strings.HasPrefix(v, "$") {
+			return v
+		}
+	case []interface{}:
+		shape := make([]interface{}, len(v))
+		for i := range v {
+			shape[i] = shapeOfValue(v[i])
+		}
+		return shape
+	}
+	doc, err := bsonToD(value)
+	if err != nil {
+		return markerOf(value)
+	}
+	shape := make(bson.D, len(doc))
+	for i, elem := range doc {
+		shape[i] = bson.DocElem{Name: elem.Name, Value: shapeOfValue(elem.Value)}
+	}
+	return shape
+}
+
+// markerOf returns the typeMarker replacing a value.
+func markerOf(value interface{}) typeMarker {
+	switch value.(type) {
+	case nil:
+		return "?null"
+	case int, int32, int64, float64:
+		return "?number"
+	case string:
+		return "?string"
+	case bool:
+		return "?bool"
+	case bson.ObjectId:
+		return "?objectId"
+	case time.Time:
+		return "?date"
+	case bson.MongoTimestamp:
+		return "?timestamp"
+	case bson.RegEx:
+		return "?regex"
+	case bson.Binary:
+		return "?binary"
+	case []interface{}:
+		return "?array"
+	case bson.D, *bson.D, bson.M, bson.Raw, *bson.Raw:
+		return "?object"
+	}
+	return typeMarker(fmt.Sprintf("?%T", value))
+}
+
+// formatShape lays out a shape as json, with the type markers and field
+// names unquoted.
+func formatShape(value interface{}) string {
+	out := &bytes.Buffer{}
+	writeShape(out, value)
+	return out.String()
+}
+
+func writeShape(out *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case typeMarker:
+		out.WriteString(string(v))
+	case string:
+		out.WriteString(strconv.Quote(v))
+	case bson.D:
+		out.WriteString("{")
+		for i, elem := range v {
+			if i > 0 {
+				out.WriteString(", ")
+			}
+			out.WriteString(elem.Name)
+			out.WriteString(": ")
+			writeShape(out, elem.Value)
+		}
+		out.WriteString("}")
+	case []interface{}:
+		out.WriteString("[")
+		for i := range v {
+			if i > 0 {
+				out.WriteString(", ")
+			}
+			writeShape(out, v[i])
+		}
+		out.WriteString("]")
+	default:
+		if doc, err := bsonToD(value); err == nil {
+			writeShape(out, doc)
+			return
+		}
+		fmt.Fprintf(out, "%v", value)
+	}
+}
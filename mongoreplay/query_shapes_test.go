@@ -0,0 +1,119 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestQueryShapeOf(t *testing.T) {
+	type testCase struct {
+		name     string
+		command  bson.D
+		expected string
+	}
+	cases := []testCase{
+		{
+			name:     "find with equality and range",
+			command:  bson.D{{"find", "c"}, {"filter", bson.D{{"status", "A"}, {"age", bson.D{{"$gt", 30}, {"$lte", 40.5}}}}}},
+			expected: "test.c find {filter: {status: ?string, age: {$gt: ?number, $lte: ?number}}}",
+		},
+		{
+			name: "find with sort and projection",
+			command: bson.D{{"find", "c"}, {"filter", bson.D{{"createdAt", bson.D{{"$gte", time.Now()}}}}},
+				{"sort", bson.D{{"createdAt", -1}}}, {"projection", bson.D{{"_id", 0}, {"name", 1}}}, {"limit", 10}},
+			expected: "test.c find {filter: {createdAt: {$gte: ?date}}, sort: {createdAt: -1}, projection: {_id: 0, name: 1}}",
+		},
+		{
+			name: "find with $or and $in",
+			command: bson.D{{"find", "c"}, {"filter", bson.D{{"$or", []interface{}{
+				bson.D{{"a", 1}}, bson.D{{"b", bson.D{{"$in", []interface{}{1, 2, 3}}}}}}}}}},
+			expected: "test.c find {filter: {$or: [{a: ?number}, {b: {$in: ?array}}]}}",
+		},
+		{
+			name:     "find with $exists and $elemMatch",
+			command:  bson.D{{"find", "c"}, {"filter", bson.D{{"a", bson.D{{"$exists", true}}}, {"b", bson.D{{"$elemMatch", bson.D{{"x", "y"}}}}}}}},
+			expected: "test.c find {filter: {a: {$exists: true}, b: {$elemMatch: {x: ?string}}}}",
+		},
+		{
+			name:     "find of a subdocument",
+			command:  bson.D{{"find", "c"}, {"filter", bson.D{{"a", bson.D{{"x", 1}}}, {"_id", bson.NewObjectId()}}}},
+			expected: "test.c find {filter: {a: ?object, _id: ?objectId}}",
+		},
+		{
+			name:     "count",
+			command:  bson.D{{"count", "c"}, {"query", bson.D{{"a", nil}}}},
+			expected: "test.c count {query: {a: ?null}}",
+		},
+		{
+			name:     "distinct",
+			command:  bson.D{{"distinct", "c"}, {"key", "k"}, {"query", bson.D{{"a", false}}}},
+			expected: `test.c distinct {key: "k", query: {a: ?bool}}`,
+		},
+		{
+			name: "aggregate",
+			command: bson.D{{"aggregate", "c"}, {"pipeline", []interface{}{
+				bson.D{{"$match", bson.D{{"a", 5}}}},
+				bson.D{{"$group", bson.D{{"_id", "$b"}, {"total", bson.D{{"$sum", 1}}}}}},
+				bson.D{{"$sort", bson.D{{"total", -1}}}},
+				bson.D{{"$limit", 3}},
+			}}, {"cursor", bson.D{}}},
+			expected: `test.c aggregate {pipeline: [{$match: {a: ?number}}, {$group: {_id: "$b", total: {$sum: ?number}}}, {$sort: {total: -1}}, {$limit: ?number}]}`,
+		},
+		{
+			name:     "database aggregate",
+			command:  bson.D{{"aggregate", 1}, {"pipeline", []interface{}{bson.D{{"$currentOp", bson.D{}}}}}},
+			expected: "test aggregate {pipeline: [{$currentOp: {}}]}",
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		shape := queryShapeOf("test", c.command)
+		if shape == nil {
+			t.Errorf("expected a shape, got none")
+			continue
+		}
+		if shape.String() != c.expected {
+			t.Errorf("expected shape %v, got %v", c.expected, shape)
+		}
+	}
+
+	if shape := queryShapeOf("test", bson.D{{"insert", "c"}}); shape != nil {
+		t.Errorf("expected an insert to have no shape, got %v", shape)
+	}
+}
+
+func TestQueryShapeFilterAndSort(t *testing.T) {
+	first := queryShapeOf("test", bson.D{{"find", "c"}, {"filter", bson.D{{"a", 1}}}, {"sort", bson.D{{"b", 1}}}})
+	second := queryShapeOf("test", bson.D{{"find", "c"}, {"filter", bson.D{{"a", 2}}}, {"sort", bson.D{{"b", 1}}}})
+	if first.String() != second.String() {
+		t.Errorf("expected queries differing by their values to share a shape, got %v and %v", first, second)
+	}
+
+	shape := queryShapeOf("test", bson.D{{"aggregate", "c"}, {"pipeline", []interface{}{
+		bson.D{{"$match", bson.D{{"a", 1}}}},
+		bson.D{{"$sort", bson.D{{"b", 1}}}},
+		bson.D{{"$match", bson.D{{"c", 1}}}},
+	}}})
+	if len(shape.filter) != 1 || shape.filter[0].Name != "a" {
+		t.Errorf("expected the filter of the aggregation to be its first $match, got %v", shape.filter)
+	}
+	if len(shape.sort) != 1 || shape.sort[0].Name != "b" {
+		t.Errorf("expected the sort of the aggregation to be its first $sort, got %v", shape.sort)
+	}
+
+	shape = queryShapeOf("test", bson.D{{"aggregate", "c"}, {"pipeline", []interface{}{
+		bson.D{{"$unwind", "$a"}},
+		bson.D{{"$match", bson.D{{"a", 1}}}},
+	}}})
+	if shape.filter != nil {
+		t.Errorf("expected a $match after an $unwind not to be the filter of the aggregation, got %v", shape.filter)
+	}
+}
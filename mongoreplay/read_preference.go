@@ -0,0 +1,148 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+	"github.com/mongodb/mongo-tools/common/json"
+)
+
+// queryFlagSlaveOk is the OP_QUERY flag bit allowing a query to be run against
+// a non-primary member of a replica set.
+const queryFlagSlaveOk = mgo.QueryOpFlags(1 << 2)
+
+// readCommands is the set of commands whose read preference may be overridden
+// during playback. Commands that are not listed are always sent unmodified.
+var readCommands = map[string]bool{
+	"aggregate":       true,
+	"collStats":       true,
+	"count":           true,
+	"dbStats":         true,
+	"distinct":        true,
+	"find":            true,
+	"geoNear":         true,
+	"geoSearch":       true,
+	"group":           true,
+	"listCollections": true,
+	"listIndexes":     true,
+}
+
+// readPreference describes a read preference that replaces whatever read
+// preference was recorded on the ops in a playback file.
+type readPreference struct {
+	mode     mgo.Mode
+	modeName string
+	tags     []bson.D
+}
+
+type readPreferenceDoc struct {
+	Mode string
+	Tags map[string]string
+}
+
+// parseReadPreference parses a read preference given either as a mode name
+// (e.g. 'secondaryPreferred') or as a JSON document of the form
+// '{mode: "secondary", tags: {dc: "east"}}'.
+func parseReadPreference(rp string) (*readPreference, error) {
+	var doc readPreferenceDoc
+	if strings.HasPrefix(rp, "{") {
+		err := json.Unmarshal([]byte(rp), &doc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid readPreference json object: %v", err)
+		}
+	} else {
+		doc.Mode = rp
+	}
+
+	pref := &readPreference{modeName: doc.Mode}
+	switch doc.Mode {
+	case "primary":
+		pref.mode = mgo.Primary
+	case "primaryPreferred":
+		pref.mode = mgo.PrimaryPreferred
+	case "secondary":
+		pref.mode = mgo.Secondary
+	case "secondaryPreferred":
+		pref.mode = mgo.SecondaryPreferred
+	case "nearest":
+		pref.mode = mgo.Nearest
+	default:
+		return nil, fmt.Errorf("invalid readPreference mode '%v'", doc.Mode)
+	}
+
+	if len(doc.Tags) > 0 {
+		if pref.mode == mgo.Primary {
+			return nil, fmt.Errorf("readPreference tags cannot be combined with mode 'primary'")
+		}
+		tagNames := make([]string, 0, len(doc.Tags))
+		for name := range doc.Tags {
+			tagNames = append(tagNames, name)
+		}
+		sort.Strings(tagNames)
+		tagSet := bson.D{}
+		for _, name := range tagNames {
+			tagSet = append(tagSet, bson.DocElem{Name: name, Value: doc.Tags[name]})
+		}
+		pref.tags = []bson.D{tagSet}
+	}
+	return pref, nil
+}
+
+// document returns the $readPreference document sent to the server.
+func (pref *readPreference) document() bson.D {
+	doc := bson.D{{Name: "mode", Value: pref.modeName}}
+	if len(pref.tags) > 0 {
+		doc = append(doc, bson.DocElem{Name: "tags", Value: pref.tags})
+	}
+	return doc
+}
+
+// apply rewrites the read preference of a read op so that it matches the
+// override. Ops that are not reads are left untouched.
+func (pref *readPreference) apply(op Op) error {
+	switch castOp := op.(type) {
+	case *QueryOp:
+		return pref.applyToQuery(castOp)
+	case *CommandOp:
+		if !readCommands[castOp.CommandName] {
+			return nil
+		}
+		castOp.Metadata = &bson.D{{Name: "$readPreference", Value: pref.document()}}
+	case *MsgOp:
+		if !readCommands[castOp.CommandName] {
+			return nil
+		}
+		return setMsgOpField(castOp, "$readPreference", pref.document())
+	}
+	return nil
+}
+
+func (pref *readPreference) applyToQuery(op *QueryOp) error {
+	if strings.HasSuffix(op.Collection, "$cmd") && !readCommands[commandNameOf(op)] {
+		return nil
+	}
+	if pref.mode == mgo.Primary {
+		op.Flags &^= queryFlagSlaveOk
+	} else {
+		op.Flags |= queryFlagSlaveOk
+	}
+
+	query, err := bsonToD(op.Query)
+	if err != nil {
+		return err
+	}
+	if len(query) == 0 || (query[0].Name != "$query" && query[0].Name != "query") {
+		query = bson.D{{Name: "$query", Value: query}}
+	}
+	op.Query = setDocField(query, "$readPreference", pref.document())
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"reflect"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestParseReadPreference(t *testing.T) {
+	testCases := []struct {
+		name         string
+		input        string
+		expectedMode mgo.Mode
+		expectedTags []bson.D
+		expectErr    bool
+	}{
+		{
+			name:         "mode only",
+			input:        "secondaryPreferred",
+			expectedMode: mgo.SecondaryPreferred,
+		},
+		{
+			name:         "json document with tags",
+			input:        `{mode: "secondary", tags: {rack: "1", dc: "east"}}`,
+			expectedMode: mgo.Secondary,
+			expectedTags: []bson.D{{{"dc", "east"}, {"rack", "1"}}},
+		},
+		{
+			name:      "unknown mode",
+			input:     "secondaryOnly",
+			expectErr: true,
+		},
+		{
+			name:      "primary with tags",
+			input:     `{mode: "primary", tags: {dc: "east"}}`,
+			expectErr: true,
+		},
+	}
+	for _, c := range testCases {
+		t.Logf("running case: %s", c.name)
+		pref, err := parseReadPreference(c.input)
+		if c.expectErr {
+			if err == nil {
+				t.Errorf("expected error parsing %q", c.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if pref.mode != c.expectedMode {
+			t.Errorf("mode not matched. Saw %v -- Expected %v", pref.mode, c.expectedMode)
+		}
+		if !reflect.DeepEqual(pref.tags, c.expectedTags) {
+			t.Errorf("tags not matched. Saw %v -- Expected %v", pref.tags, c.expectedTags)
+		}
+	}
+}
+
+func TestApplyReadPreference(t *testing.T) {
+	pref, err := parseReadPreference("secondary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedDoc := bson.D{{"mode", "secondary"}}
+
+	t.Log("Applying read preference to a legacy query")
+	queryOp := &QueryOp{}
+	queryOp.Collection = "mongoreplay.test"
+	queryOp.Query = &bson.D{{"name", "a"}}
+	if err := pref.apply(queryOp); err != nil {
+		t.Fatal(err)
+	}
+	if queryOp.Flags&queryFlagSlaveOk == 0 {
+		t.Errorf("expected slaveOk flag to be set on query")
+	}
+	query, err := bsonToD(queryOp.Query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(query) != 2 || query[0].Name != "$query" {
+		t.Fatalf("expected query to be wrapped in $query, was %v", query)
+	}
+	if !reflect.DeepEqual(query[1], bson.DocElem{"$readPreference", expectedDoc}) {
+		t.Errorf("unexpected $readPreference on query: %v", query[1])
+	}
+
+	t.Log("Applying read preference to wrapped legacy commands")
+	for _, c := range []struct {
+		command  string
+		modified bool
+	}{
+		{"count", true},
+		{"findAndModify", false},
+	} {
+		commandOp := &QueryOp{}
+		commandOp.Collection = "mongoreplay.$cmd"
+		commandOp.Query = bson.D{{"$query", bson.D{{c.command, "test"}}}, {"$readPreference", bson.D{{"mode", "primary"}}}}
+		if err := pref.apply(commandOp); err != nil {
+			t.Fatal(err)
+		}
+		query, err := bsonToD(commandOp.Query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := FindValueByKey("$readPreference", &query)
+		if modified := reflect.DeepEqual(value, expectedDoc); modified != c.modified {
+			t.Errorf("%v: expected $readPreference overridden to be %v, got %v", c.command, c.modified, value)
+		}
+	}
+
+	t.Log("Applying read preference to OP_MSG commands")
+	for _, c := range []struct {
+		command  string
+		modified bool
+	}{
+		{"find", true},
+		{"insert", false},
+	} {
+		raw, err := dToRaw(bson.D{{c.command, "test"}, {"$db", "mongoreplay"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgOp := &MsgOp{CommandName: c.command}
+		msgOp.Sections = []mgo.MsgSection{{PayloadType: mgo.MsgPayload0, Data: raw}}
+		if err := pref.apply(msgOp); err != nil {
+			t.Fatal(err)
+		}
+		payload, _, err := fetchPayload0Data(msgOp.Sections)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := bsonToD(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, found := FindValueByKey("$readPreference", &doc)
+		if found != c.modified {
+			t.Errorf("%v: expected $readPreference present to be %v", c.command, c.modified)
+		}
+		if found {
+			asD, err := bsonToD(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(asD, expectedDoc) {
+				t.Errorf("%v: unexpected $readPreference: %v", c.command, asD)
+			}
+		}
+	}
+}
@@ -11,17 +11,25 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
-
-	"github.com/google/gopacket/pcap"
+	"time"
 )
 
 // RecordCommand stores settings for the mongoreplay 'record' subcommand
 type RecordCommand struct {
 	GlobalOpts *Options `no-flag:"true"`
 	OpStreamSettings
-	Gzip         bool   `long:"gzip" description:"compress output file with Gzip"`
-	FullReplies  bool   `long:"full-replies" description:"save full reply payload in playback file"`
-	PlaybackFile string `short:"p" description:"path to playback file to record to" long:"playback-file" required:"yes"`
+	Gzip           bool   `long:"gzip" description:"compress output file with Gzip"`
+	FullReplies    bool   `long:"full-replies" description:"save full reply payload in playback file"`
+	PlaybackFile   string `short:"p" description:"path to playback file to record to" long:"playback-file"`
+	StatsInterval  int    `long:"statsInterval" description:"number of seconds between the capture stats logged while recording: the packets dropped, the reassembly buffer overflows and the ops lost; 0 disables them" default:"60"`
+	RotateSize     int    `long:"rotateSize" description:"MiB of ops after which the recording continues in a new playback file, the playback files being numbered before the extension of --playback-file"`
+	RotateInterval int    `long:"rotateInterval" description:"number of seconds of traffic after which the recording continues in a new playback file, the playback files being numbered before the extension of --playback-file"`
+	Daemon         bool   `long:"daemon" description:"record to numbered playback files until stopped by a signal, starting, stopping and rotating the capture on requests to the HTTP endpoint of --controlAddr"`
+	ControlAddr    string `long:"controlAddr" description:"address of the HTTP endpoint of --daemon, which serves GET /health and POST /start, /stop and /rotate" default:"localhost:9180"`
+	LogPath        string `long:"logPath" description:"file to append the log to instead of stderr; with --daemon, it is reopened on SIGHUP so that it can be rotated"`
+	KafkaOptions   `group:"kafka options"`
+
+	EncryptionOptions `group:"encryption options"`
 }
 
 // ErrPacketsDropped means that some packets were dropped
@@ -36,7 +44,11 @@ func (e ErrPacketsDropped) Error() string {
 type packetHandlerContext struct {
 	packetHandler *PacketHandler
 	mongoOpStream *MongoOpStream
-	pcapHandle    *pcap.Handle
+	source        captureSource
+
+	// statsInterval is the interval at which Record logs the capture stats,
+	// or 0 if it doesn't.
+	statsInterval time.Duration
 }
 
 func getOpstream(cfg OpStreamSettings) (*packetHandlerContext, error) {
@@ -44,66 +56,34 @@ func getOpstream(cfg OpStreamSettings) (*packetHandlerContext, error) {
 		return nil, fmt.Errorf("invalid packet buffer size")
 	}
 
-	var pcapHandle *pcap.Handle
-	var err error
-	if len(cfg.PcapFile) > 0 {
-		pcapHandle, err = pcap.OpenOffline(cfg.PcapFile)
-		if err != nil {
-			return nil, fmt.Errorf("error opening pcap file: %v", err)
-		}
-	} else if len(cfg.NetworkInterface) > 0 {
-		inactive, err := pcap.NewInactiveHandle(cfg.NetworkInterface)
-		if err != nil {
-			return nil, fmt.Errorf("error creating a pcap handle: %v", err)
-		}
-		// This is safe; calling `Activate()` steals the underlying ptr.
-		defer inactive.CleanUp()
-
-		err = inactive.SetSnapLen(64 * 1024)
-		if err != nil {
-			return nil, fmt.Errorf("error setting snaplen on pcap handle: %v", err)
-		}
-
-		err = inactive.SetPromisc(false)
-		if err != nil {
-			return nil, fmt.Errorf("error setting promisc on pcap handle: %v", err)
-		}
-
-		err = inactive.SetTimeout(pcap.BlockForever)
-		if err != nil {
-			return nil, fmt.Errorf("error setting timeout on pcap handle: %v", err)
-		}
-
-		// CaptureBufSize is in KiB to match units on `tcpdump -B`.
-		err = inactive.SetBufferSize(cfg.CaptureBufSize * 1024)
-		if err != nil {
-			return nil, fmt.Errorf("error setting buffer size on pcap handle: %v", err)
-		}
-
-		pcapHandle, err = inactive.Activate()
-		if err != nil {
-			return nil, fmt.Errorf("error listening to network interface: %v", err)
-		}
-	} else {
-		return nil, fmt.Errorf("must specify either a pcap file or network interface to record from")
+	// the ops are given the name of the interface as the zone of their
+	// endpoints, rather than that of its device on Windows
+	zone := cfg.NetworkInterface
+	if len(cfg.NetworkInterface) > 0 && cfg.CaptureEngine != captureEngineAFPacket {
+		iface := lookupCaptureInterface(cfg.NetworkInterface)
+		cfg.NetworkInterface = iface.device
+		zone = iface.name
 	}
-
-	if len(cfg.Expression) > 0 {
-		err = pcapHandle.SetBPFFilter(cfg.Expression)
-		if err != nil {
-			return nil, fmt.Errorf("error setting packet filter expression: %v", err)
-		}
+	source, err := openCaptureSource(cfg)
+	if err != nil {
+		return nil, err
 	}
 	assemblerOptions := AssemblerOptions{
 		MaxBufferedPagesTotal: cfg.MaxBufferedPages,
+		SpoolDir:              cfg.SpoolDir,
+	}
+	if pages := cfg.MaxBufferedMemory * 1024 * 1024 / pageBytes; pages > 0 &&
+		(assemblerOptions.MaxBufferedPagesTotal <= 0 || pages < assemblerOptions.MaxBufferedPagesTotal) {
+		assemblerOptions.MaxBufferedPagesTotal = pages
 	}
 
-	h := NewPacketHandler(pcapHandle, assemblerOptions)
+	h := NewPacketHandler(source, assemblerOptions)
 	h.Verbose = userInfoLogger.isInVerbosity(DebugLow)
 
 	toolDebugLogger.Logvf(Info, "Created packet buffer size %d", cfg.PacketBufSize)
 	m := NewMongoOpStream(cfg.PacketBufSize)
-	return &packetHandlerContext{h, m, pcapHandle}, nil
+	m.zone = zone
+	return &packetHandlerContext{packetHandler: h, mongoOpStream: m, source: source}, nil
 }
 
 // ValidateParams validates the settings described in the RecordCommand struct.
@@ -122,10 +102,54 @@ func (record *RecordCommand) ValidateParams(args []string) error {
 		// default capture buffer size to 2 MiB (same as libpcap)
 		record.OpStreamSettings.CaptureBufSize = 2 * 1024
 	}
+	switch record.OpStreamSettings.CaptureEngine {
+	case "", captureEnginePcap:
+	case captureEngineAFPacket:
+		if record.NetworkInterface == "" {
+			return fmt.Errorf("captureEngine %v requires a network interface", captureEngineAFPacket)
+		}
+	default:
+		return fmt.Errorf("unknown captureEngine %q", record.OpStreamSettings.CaptureEngine)
+	}
+	if record.OpStreamSettings.CaptureThreads == 0 {
+		record.OpStreamSettings.CaptureThreads = 1
+	}
+	if record.OpStreamSettings.CaptureThreads < 0 {
+		return fmt.Errorf("captureThreads cannot be less than 0")
+	}
+	if record.OpStreamSettings.CaptureThreads > 1 && record.OpStreamSettings.CaptureEngine != captureEngineAFPacket {
+		return fmt.Errorf("captureThreads requires captureEngine %v", captureEngineAFPacket)
+	}
 	if record.OpStreamSettings.MaxBufferedPages < 0 {
 		return fmt.Errorf("bufferedPagesMax cannot be less than 0")
 	}
-	return nil
+	if record.OpStreamSettings.MaxBufferedMemory < 0 {
+		return fmt.Errorf("maxBufferedMemory cannot be less than 0")
+	}
+	if record.OpStreamSettings.SpoolDir != "" {
+		if record.OpStreamSettings.MaxBufferedPages == 0 && record.OpStreamSettings.MaxBufferedMemory == 0 {
+			return fmt.Errorf("spoolDir requires maxBufferedPages or maxBufferedMemory to be set")
+		}
+		if info, err := os.Stat(record.OpStreamSettings.SpoolDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("spoolDir %v is not a directory", record.OpStreamSettings.SpoolDir)
+		}
+	}
+	if record.StatsInterval < 0 {
+		return fmt.Errorf("statsInterval cannot be less than 0")
+	}
+	if record.Daemon && record.PcapFile != "" {
+		return fmt.Errorf("daemon requires a network interface")
+	}
+	if record.RotateSize < 0 {
+		return fmt.Errorf("rotateSize cannot be less than 0")
+	}
+	if record.RotateInterval < 0 {
+		return fmt.Errorf("rotateInterval cannot be less than 0")
+	}
+	if record.PlaybackFile == stdStream && (record.Daemon || record.RotateSize > 0 || record.RotateInterval > 0) {
+		return fmt.Errorf("daemon, rotateSize and rotateInterval record to numbered playback files, not to stdout")
+	}
+	return record.KafkaOptions.validatePublishing()
 }
 
 // Execute runs the program for the 'record' subcommand
@@ -135,11 +159,31 @@ func (record *RecordCommand) Execute(args []string) error {
 		return err
 	}
 	record.GlobalOpts.SetLogging()
+	if err := record.setTapeEncryption(); err != nil {
+		return err
+	}
+	if record.LogPath != "" {
+		if err := setLogFile(record.LogPath); err != nil {
+			return err
+		}
+	}
+	switch {
+	case record.PlaybackFile == "" && record.KafkaTopic == "":
+		return fmt.Errorf("must specify a playback file or a Kafka topic to record to")
+	case record.Daemon && record.PlaybackFile == "":
+		return fmt.Errorf("daemon requires a playback file")
+	case record.Daemon && record.KafkaTopic != "":
+		return fmt.Errorf("daemon cannot be used with --kafkaTopic")
+	}
+	if record.Daemon {
+		return record.runDaemon()
+	}
 
 	ctx, err := getOpstream(record.OpStreamSettings)
 	if err != nil {
 		return err
 	}
+	ctx.statsInterval = time.Duration(record.StatsInterval) * time.Second
 
 	// When a signal is received to kill the process, stop the packet handler so
 	// we gracefully flush all ops being processed before exiting.
@@ -151,19 +195,74 @@ func (record *RecordCommand) Execute(args []string) error {
 		toolDebugLogger.Logvf(Info, "Got signal %v, closing PCAP handle", s)
 		ctx.packetHandler.Close()
 	}()
-	playbackFileWriter, err := NewPlaybackFileWriter(record.PlaybackFile, false, record.Gzip)
-	if err != nil {
-		return err
+	var writers recordWriters
+	if record.KafkaTopic != "" {
+		kafkaWriter, err := NewKafkaOpWriter(record.KafkaOptions)
+		if err != nil {
+			return err
+		}
+		defer kafkaWriter.Close()
+		writers = append(writers, kafkaWriter)
 	}
-	defer playbackFileWriter.Close()
+	if record.PlaybackFile != "" && (record.RotateSize > 0 || record.RotateInterval > 0) {
+		captureStats := func() CaptureStats {
+			stats, _ := ctx.captureStats()
+			return stats
+		}
+		playbackFileWriter, err := NewRotatingPlaybackFileWriter(record.PlaybackFile, record.Gzip,
+			int64(record.RotateSize)*1024*1024, time.Duration(record.RotateInterval)*time.Second, captureStats)
+		if err != nil {
+			return err
+		}
+		defer playbackFileWriter.Close()
+		writers = append(writers, playbackFileWriter)
+	} else if record.PlaybackFile != "" {
+		playbackFileWriter, err := NewPlaybackFileWriter(record.PlaybackFile, false, record.Gzip)
+		if err != nil {
+			return err
+		}
+		defer playbackFileWriter.Close()
+		writers = append(writers, playbackFileWriter)
+	}
+	if len(writers) == 1 {
+		return Record(ctx, writers[0], record.FullReplies)
+	}
+	return Record(ctx, writers, record.FullReplies)
+}
 
-	return Record(ctx, playbackFileWriter, record.FullReplies)
+// RecordWriter is where Record writes the recorded ops, followed by the
+// capture stats of the recording.
+type RecordWriter interface {
+	WriteRecordedOp(op *RecordedOp) error
+	WriteCaptureStats(stats CaptureStats) error
+}
+
+// recordWriters is a RecordWriter writing to each of several RecordWriters,
+// so that a recording can be both saved and published.
+type recordWriters []RecordWriter
+
+func (writers recordWriters) WriteRecordedOp(op *RecordedOp) error {
+	for _, writer := range writers {
+		if err := writer.WriteRecordedOp(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+func (writers recordWriters) WriteCaptureStats(stats CaptureStats) error {
+	for _, writer := range writers {
+		if err := writer.WriteCaptureStats(stats); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Record writes pcap data into a playback file
+// Record writes pcap data into a playback file, ending it with the capture
+// stats of the recording.
 func Record(ctx *packetHandlerContext,
-	playbackWriter *PlaybackFileWriter,
+	playbackWriter RecordWriter,
 	noShortenReply bool) error {
 
 	ch := make(chan error)
@@ -185,7 +284,7 @@ func Record(ctx *packetHandlerContext,
 					continue
 				}
 			}
-			err := bsonToWriter(playbackWriter, op)
+			err := playbackWriter.WriteRecordedOp(op)
 			if err != nil {
 				fail = fmt.Errorf("error writing message: %v", err)
 				userInfoLogger.Logvf(Always, "%v", err)
@@ -195,20 +294,29 @@ func Record(ctx *packetHandlerContext,
 		ch <- fail
 	}()
 
+	if ctx.statsInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go ctx.logCaptureStats(ctx.statsInterval, done)
+	}
+
 	if err := ctx.packetHandler.Handle(ctx.mongoOpStream, -1); err != nil {
 		return fmt.Errorf("record: error handling packet stream: %s", err)
 	}
+	ctx.mongoOpStream.reportLostOps()
 
-	stats, err := ctx.pcapHandle.Stats()
+	stats, err := ctx.captureStats()
 	if err != nil {
 		toolDebugLogger.Logvf(Always, "Warning: got err %v getting pcap handle stats", err)
-	} else {
-		toolDebugLogger.Logvf(Info, "PCAP stats: %#v", stats)
 	}
+	toolDebugLogger.Logvf(Info, "Capture stats: %v", &stats)
 
 	err = <-ch
-	if err == nil && stats != nil && stats.PacketsDropped != 0 {
-		err = ErrPacketsDropped{stats.PacketsDropped}
+	if err == nil {
+		err = playbackWriter.WriteCaptureStats(stats)
+	}
+	if err == nil && stats.PacketsDropped != 0 {
+		err = ErrPacketsDropped{int(stats.PacketsDropped)}
 	}
 	return err
 }
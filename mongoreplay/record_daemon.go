@@ -0,0 +1,256 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// recordDaemon runs the captures of 'record --daemon', which are started,
+// stopped and rotated through its HTTP control endpoint. Every capture is
+// recorded to the segments of a single RotatingPlaybackFileWriter, so that
+// stopping and starting the capture continues the recording in the next
+// segment.
+type recordDaemon struct {
+	record *RecordCommand
+
+	mu     sync.Mutex
+	writer *RotatingPlaybackFileWriter
+	// ctx is the current capture, which is nil while stopped, and done
+	// receives the result of its Record once it has ended.
+	ctx     *packetHandlerContext
+	done    chan error
+	started time.Time
+	// lastErr is the error which ended the last capture, if any.
+	lastErr error
+}
+
+// recordDaemonStatus is the response of the daemon's endpoints.
+type recordDaemonStatus struct {
+	Recording    bool          `json:"recording"`
+	PlaybackFile string        `json:"playbackFile,omitempty"`
+	Segment      int           `json:"segment"`
+	Since        *time.Time    `json:"since,omitempty"`
+	CaptureStats *CaptureStats `json:"captureStats,omitempty"`
+	LastError    string        `json:"lastError,omitempty"`
+}
+
+// runDaemon starts capturing, and serves the control endpoint until a
+// SIGINT or SIGTERM is received. SIGHUP reopens the log file.
+func (record *RecordCommand) runDaemon() error {
+	d := &recordDaemon{record: record}
+	listener, err := net.Listen("tcp", record.ControlAddr)
+	if err != nil {
+		return fmt.Errorf("error listening for control requests: %v", err)
+	}
+	server := &http.Server{Handler: d.handler()}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	userInfoLogger.Logvf(Always, "Listening for control requests on http://%v", listener.Addr())
+
+	if err := d.start(); err != nil {
+		server.Close()
+		return err
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case s := <-sigChan:
+			if s == syscall.SIGHUP {
+				if err := reopenLogFile(); err != nil {
+					userInfoLogger.Logvf(Always, "%v", err)
+				}
+				continue
+			}
+			toolDebugLogger.Logvf(Info, "Got signal %v, stopping", s)
+			server.Close()
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if d.ctx == nil {
+				return nil
+			}
+			return d.stopLocked()
+		case err := <-serveErr:
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if d.ctx != nil {
+				d.stopLocked()
+			}
+			return fmt.Errorf("error serving control requests: %v", err)
+		}
+	}
+}
+
+// handler returns the handler of the control endpoint.
+func (d *recordDaemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "health must be requested with GET", http.StatusMethodNotAllowed)
+			return
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		code := http.StatusOK
+		if d.ctx == nil && d.lastErr != nil {
+			code = http.StatusServiceUnavailable
+		}
+		d.respondLocked(w, code)
+	})
+	d.handleAction(mux, "/start", func() error {
+		if d.ctx != nil {
+			return errDaemonConflict("already recording")
+		}
+		return d.start()
+	})
+	d.handleAction(mux, "/stop", func() error {
+		if d.ctx == nil {
+			return errDaemonConflict("not recording")
+		}
+		return d.stopLocked()
+	})
+	d.handleAction(mux, "/rotate", func() error {
+		if d.ctx == nil {
+			return errDaemonConflict("not recording")
+		}
+		return d.writer.Rotate()
+	})
+	return mux
+}
+
+// errDaemonConflict is returned by the actions requested in a state they
+// can't be performed in.
+type errDaemonConflict string
+
+func (e errDaemonConflict) Error() string {
+	return string(e)
+}
+
+// handleAction serves the POST requests of path by running action, then
+// responding with the status of the daemon.
+func (d *recordDaemon) handleAction(mux *http.ServeMux, path string, action func() error) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, fmt.Sprintf("%v must be requested with POST", path[1:]), http.StatusMethodNotAllowed)
+			return
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if err := action(); err != nil {
+			code := http.StatusInternalServerError
+			if _, ok := err.(errDaemonConflict); ok {
+				code = http.StatusConflict
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		d.respondLocked(w, http.StatusOK)
+	})
+}
+
+func (d *recordDaemon) respondLocked(w http.ResponseWriter, code int) {
+	status := recordDaemonStatus{Recording: d.ctx != nil}
+	if d.writer != nil {
+		status.PlaybackFile, status.Segment = d.writer.segment()
+	}
+	if d.ctx != nil {
+		started := d.started
+		status.Since = &started
+		stats, _ := d.ctx.captureStats()
+		status.CaptureStats = &stats
+	}
+	if d.lastErr != nil {
+		status.LastError = d.lastErr.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// start starts a capture, recording it to the first segment of the
+// recording, or to the segment following the last one.
+func (d *recordDaemon) start() error {
+	ctx, err := getOpstream(d.record.OpStreamSettings)
+	if err != nil {
+		return err
+	}
+	ctx.statsInterval = time.Duration(d.record.StatsInterval) * time.Second
+	captureStats := func() CaptureStats {
+		stats, _ := ctx.captureStats()
+		return stats
+	}
+	if d.writer == nil {
+		d.writer, err = NewRotatingPlaybackFileWriter(d.record.PlaybackFile, d.record.Gzip,
+			int64(d.record.RotateSize)*1024*1024, time.Duration(d.record.RotateInterval)*time.Second, captureStats)
+	} else {
+		err = d.writer.resume(captureStats)
+	}
+	if err != nil {
+		ctx.source.Close()
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := Record(ctx, d.writer, d.record.FullReplies)
+		ctx.source.Close()
+		if closeErr := d.writer.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("error closing playback file: %v", closeErr)
+		}
+		done <- err
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// the capture ended by itself unless it is being stopped
+		if d.done == done {
+			d.endedLocked(<-done)
+		}
+	}()
+	d.ctx, d.done, d.started, d.lastErr = ctx, done, time.Now(), nil
+	userInfoLogger.Logvf(Always, "Started recording")
+	return nil
+}
+
+// stopLocked stops the current capture, waiting for it to be written.
+func (d *recordDaemon) stopLocked() error {
+	d.ctx.packetHandler.Close()
+	done := d.done
+	d.done = nil
+	err := <-done
+	d.endedLocked(err)
+	if _, ok := err.(ErrPacketsDropped); ok {
+		return nil
+	}
+	return err
+}
+
+// endedLocked records the end of the current capture.
+func (d *recordDaemon) endedLocked(err error) {
+	d.ctx = nil
+	d.lastErr = nil
+	switch err.(type) {
+	case nil:
+		userInfoLogger.Logvf(Always, "Stopped recording")
+	case ErrPacketsDropped:
+		userInfoLogger.Logvf(Always, "Stopped recording: %v", err)
+	default:
+		userInfoLogger.Logvf(Always, "Recording failed: %v", err)
+		d.lastErr = err
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordDaemonRequests(t *testing.T) {
+	d := &recordDaemon{record: &RecordCommand{}, lastErr: fmt.Errorf("capture failed")}
+	server := httptest.NewServer(d.handler())
+	defer server.Close()
+
+	type testCase struct {
+		name   string
+		method string
+		path   string
+		code   int
+	}
+	cases := []testCase{
+		{name: "health while stopped after a failure", method: "GET", path: "/health", code: http.StatusServiceUnavailable},
+		{name: "stop while stopped", method: "POST", path: "/stop", code: http.StatusConflict},
+		{name: "rotate while stopped", method: "POST", path: "/rotate", code: http.StatusConflict},
+		{name: "start with GET", method: "GET", path: "/start", code: http.StatusMethodNotAllowed},
+		{name: "health with POST", method: "POST", path: "/health", code: http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		req, err := http.NewRequest(c.method, server.URL+c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.code {
+			t.Errorf("expected status %v, got %v", c.code, resp.StatusCode)
+		}
+		if c.path == "/health" && resp.StatusCode != http.StatusMethodNotAllowed {
+			var status recordDaemonStatus
+			if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if status.Recording || status.LastError != "capture failed" {
+				t.Errorf("expected a stopped daemon with the last error, got %+v", status)
+			}
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestReopenLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mongoreplay.log")
+	if err := setLogFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		logger.SetOutput(os.Stderr)
+		logFile.file.Close()
+		logFile.path, logFile.file = "", nil
+	}()
+	logger.Print("before rotation")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopenLogFile(); err != nil {
+		t.Fatal(err)
+	}
+	logger.Print("after rotation")
+
+	for name, expected := range map[string]string{path + ".1": "before rotation", path: "after rotation"} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(contents), expected) || strings.Count(string(contents), "\n") != 1 {
+			t.Errorf("expected %v to hold %q, got %q", name, expected, contents)
+		}
+	}
+}
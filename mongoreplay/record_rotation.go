@@ -0,0 +1,173 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// RotatingPlaybackFileWriter is a RecordWriter splitting a recording into a
+// sequence of playback files, its segments. A new segment is started once
+// the current one holds maxSize bytes of ops, or ops seen over interval.
+// Every segment ends with the capture stats of its own part of the
+// recording, and its metadata holds its position in the sequence and the
+// time at which the recording started.
+type RotatingPlaybackFileWriter struct {
+	*PlaybackFileWriter
+	name     string
+	gzip     bool
+	maxSize  int64
+	interval time.Duration
+
+	// captureStats returns the capture stats of the capture so far, from
+	// which those ending each segment but the last, which Record ends, are
+	// computed.
+	captureStats func() CaptureStats
+	// segmentStart holds the capture stats of the capture when the current
+	// segment started.
+	segmentStart CaptureStats
+
+	metadata PlaybackFileMetadata
+	// size is the number of bytes of ops written to the current segment,
+	// and first the time at which its first op was seen.
+	size  int64
+	first time.Time
+
+	// mu guards the current segment, which Rotate may replace while Record
+	// writes to it.
+	mu sync.Mutex
+}
+
+// NewRotatingPlaybackFileWriter creates the first segment of a recording
+// written to playback files named after playbackFileName. maxSize and
+// interval are ignored if <= 0.
+func NewRotatingPlaybackFileWriter(playbackFileName string, isGzipWriter bool, maxSize int64,
+	interval time.Duration, captureStats func() CaptureStats) (*RotatingPlaybackFileWriter, error) {
+	w := &RotatingPlaybackFileWriter{
+		name:         playbackFileName,
+		gzip:         isGzipWriter,
+		maxSize:      maxSize,
+		interval:     interval,
+		captureStats: captureStats,
+		metadata: PlaybackFileMetadata{
+			PlaybackFileVersion: PlaybackFileVersion,
+			RecordingStart:      time.Now(),
+		},
+	}
+	var err error
+	w.PlaybackFileWriter, err = newPlaybackFileWriter(segmentFileName(w.name, 0), w.metadata, w.gzip)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// segmentFileName returns the name of a segment of a recording, which is
+// numbered before the extension of the name of the recording, e.g.
+// recording.0003.bson.
+func segmentFileName(name string, segment int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s.%04d%s", strings.TrimSuffix(name, ext), segment, ext)
+}
+
+// WriteRecordedOp writes op to the current segment, after starting a new
+// one if the current one is full.
+func (w *RotatingPlaybackFileWriter) WriteRecordedOp(op *RecordedOp) error {
+	bsonBytes, err := bson.Marshal(op)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size > 0 && ((w.maxSize > 0 && w.size+int64(len(bsonBytes)) > w.maxSize) ||
+		(w.interval > 0 && op.Seen.Sub(w.first) >= w.interval)) {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	if w.size == 0 {
+		w.first = op.Seen.Time
+	}
+	if _, err := w.Write(bsonBytes); err != nil {
+		return err
+	}
+	w.size += int64(len(bsonBytes))
+	return nil
+}
+
+// WriteCaptureStats ends the current segment with its part of stats, the
+// capture stats of the capture.
+func (w *RotatingPlaybackFileWriter) WriteCaptureStats(stats CaptureStats) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.PlaybackFileWriter.WriteCaptureStats(stats.since(w.segmentStart))
+}
+
+// Close closes the current segment.
+func (w *RotatingPlaybackFileWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.PlaybackFileWriter.Close()
+}
+
+// Rotate ends the current segment and starts the next one, regardless of
+// the size and interval of the current one.
+func (w *RotatingPlaybackFileWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rotate()
+}
+
+// rotate ends the current segment with the capture stats since it started,
+// and starts the next one.
+func (w *RotatingPlaybackFileWriter) rotate() error {
+	stats := w.captureStats()
+	if err := w.PlaybackFileWriter.WriteCaptureStats(stats.since(w.segmentStart)); err != nil {
+		return err
+	}
+	w.segmentStart = stats
+	if err := w.PlaybackFileWriter.Close(); err != nil {
+		return fmt.Errorf("error closing playback file: %v", err)
+	}
+	return w.next()
+}
+
+// next starts the segment following the current one, which must be closed.
+func (w *RotatingPlaybackFileWriter) next() error {
+	w.metadata.Segment++
+	next, err := newPlaybackFileWriter(segmentFileName(w.name, w.metadata.Segment), w.metadata, w.gzip)
+	if err != nil {
+		return err
+	}
+	userInfoLogger.Logvf(Info, "Recording to %v", next.fname)
+	w.PlaybackFileWriter = next
+	w.size = 0
+	return nil
+}
+
+// resume starts the segment following the current one, once it has been
+// ended and closed, for a new capture whose stats are captureStats.
+func (w *RotatingPlaybackFileWriter) resume(captureStats func() CaptureStats) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.captureStats = captureStats
+	w.segmentStart = CaptureStats{}
+	return w.next()
+}
+
+// segment returns the name and number of the current segment.
+func (w *RotatingPlaybackFileWriter) segment() (string, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.fname, w.metadata.Segment
+}
@@ -0,0 +1,136 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestSegmentFileName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"recording.bson":         "recording.0002.bson",
+		"dir/recording.playback": "dir/recording.0002.playback",
+		"recording":              "recording.0002",
+	} {
+		if segment := segmentFileName(name, 2); segment != expected {
+			t.Errorf("expected segment 2 of %v to be %v, got %v", name, expected, segment)
+		}
+	}
+}
+
+func TestRotatingPlaybackFileWriter(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	if err := generator.generateInsertHelper("insert", 0, 6); err != nil {
+		t.Fatal(err)
+	}
+	close(generator.opChan)
+	var ops []*RecordedOp
+	for op := range generator.opChan {
+		ops = append(ops, op)
+	}
+	opBytes, err := bson.Marshal(ops[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	opSize := int64(len(opBytes))
+
+	type testCase struct {
+		name       string
+		maxSize    int64
+		interval   time.Duration
+		offsets    []time.Duration
+		segmentOps []int
+	}
+	cases := []testCase{
+		{
+			name:       "rotated by size",
+			maxSize:    2*opSize + 1,
+			offsets:    []time.Duration{0, 0, 0, 0, 0, 0},
+			segmentOps: []int{2, 2, 2},
+		},
+		{
+			name:     "rotated by interval",
+			interval: time.Second,
+			offsets: []time.Duration{0, 500 * time.Millisecond, 1200 * time.Millisecond,
+				1300 * time.Millisecond, 2200 * time.Millisecond, 5 * time.Second},
+			segmentOps: []int{2, 2, 1, 1},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		dir, err := ioutil.TempDir("", "mongoreplay-rotation")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		name := filepath.Join(dir, "recording.bson")
+		// each op is captured in 10 packets, one of which is dropped
+		var stats CaptureStats
+		w, err := NewRotatingPlaybackFileWriter(name, false, c.maxSize, c.interval, func() CaptureStats {
+			return stats
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, op := range ops {
+			op.Seen = &PreciseTime{testTime.Add(c.offsets[i])}
+			if err := w.WriteRecordedOp(op); err != nil {
+				t.Fatal(err)
+			}
+			stats.PacketsCaptured += 10
+			stats.PacketsDropped++
+		}
+		if err := w.WriteCaptureStats(stats); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		var recordingStart time.Time
+		for segment, expected := range c.segmentOps {
+			reader, err := NewPlaybackFileReader(segmentFileName(name, segment), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reader.metadata.Segment != segment {
+				t.Errorf("expected segment %v, got %v", segment, reader.metadata.Segment)
+			}
+			if segment == 0 {
+				recordingStart = reader.metadata.RecordingStart
+			} else if !reader.metadata.RecordingStart.Equal(recordingStart) {
+				t.Errorf("expected segment %v to start at %v, got %v", segment, recordingStart,
+					reader.metadata.RecordingStart)
+			}
+			opChan, errChan := reader.OpChan(1)
+			var numOps int
+			for range opChan {
+				numOps++
+			}
+			if err := <-errChan; err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			if numOps != expected {
+				t.Errorf("expected %v ops in segment %v, got %v", expected, segment, numOps)
+			}
+			segmentStats := CaptureStats{PacketsCaptured: 10 * int64(expected), PacketsDropped: int64(expected)}
+			if read := reader.CaptureStats(); read == nil || *read != segmentStats {
+				t.Errorf("expected segment %v to end with its capture stats %v, got %v", segment, &segmentStats, read)
+			}
+		}
+		if _, err := os.Stat(segmentFileName(name, len(c.segmentOps))); !os.IsNotExist(err) {
+			t.Errorf("expected %v segments, got more (%v)", len(c.segmentOps), err)
+		}
+	}
+}
@@ -19,6 +19,9 @@ type RecordedOp struct {
 	PlayedAt            *PreciseTime `bson:",omitempty"`
 	Generation          int
 	Order               int64
+	// Offset is the position of the op in the playback file it was read
+	// from, which isn't written to playback files.
+	Offset int64 `bson:"-"`
 }
 
 // ConnectionString gives a serialized representation of the endpoints
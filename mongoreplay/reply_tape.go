@@ -0,0 +1,254 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// ReplyTapeVersion is the version of the reply tape format written by the
+// ReplyTapeWriter.
+const ReplyTapeVersion = 1
+
+// ReplyTapeMetadata is the first document of a reply tape.
+type ReplyTapeMetadata struct {
+	ReplyTapeVersion int       `bson:"replyTapeVersion"`
+	PlaybackFile     string    `bson:"playbackFile"`
+	ServerVersion    string    `bson:"serverVersion,omitempty"`
+	RecordedAt       time.Time `bson:"recordedAt"`
+}
+
+// ReplyTapeEntry holds the reply received for one played op. Entries are
+// identified by the generation and order of their op in the playback file,
+// so that the entries of tapes recorded by playing the same file can be
+// matched.
+type ReplyTapeEntry struct {
+	Generation    int        `bson:"generation"`
+	Order         int64      `bson:"order"`
+	ConnectionNum int64      `bson:"connectionNum"`
+	Op            string     `bson:"op"`
+	Command       string     `bson:"command,omitempty"`
+	Ns            string     `bson:"ns,omitempty"`
+	Error         string     `bson:"error,omitempty"`
+	Docs          []bson.Raw `bson:"docs"`
+}
+
+// replyTapeKey identifies the entries of a reply tape.
+type replyTapeKey struct {
+	generation int
+	order      int64
+}
+
+func (key replyTapeKey) String() string {
+	return fmt.Sprintf("%v:%v", key.generation, key.order)
+}
+
+func (entry *ReplyTapeEntry) key() replyTapeKey {
+	return replyTapeKey{entry.Generation, entry.Order}
+}
+
+// name returns the command of the entry's op, or its op type for ops which
+// are not commands.
+func (entry *ReplyTapeEntry) name() string {
+	if entry.Command != "" {
+		return entry.Command
+	}
+	return entry.Op
+}
+
+// replyDocuments returns the documents of a reply: the command reply and
+// output documents of an OP_COMMANDREPLY, the body of an OP_MSG reply, or
+// the documents returned by an OP_REPLY.
+func replyDocuments(reply Replyable) ([]bson.Raw, error) {
+	switch t := reply.(type) {
+	case *ReplyOp:
+		return t.Docs, nil
+	case *CommandReplyOp:
+		docs := []interface{}{t.CommandReply}
+		docs = append(docs, t.OutputDocs...)
+		raws := make([]bson.Raw, 0, len(docs))
+		for _, doc := range docs {
+			if doc == nil {
+				continue
+			}
+			raw, err := toRawDocument(doc)
+			if err != nil {
+				return nil, err
+			}
+			raws = append(raws, raw)
+		}
+		return raws, nil
+	case *MsgOpReply:
+		if len(t.Sections) == 0 {
+			return nil, nil
+		}
+		raw, _, err := fetchPayload0Data(t.Sections)
+		if err != nil {
+			return nil, err
+		}
+		return []bson.Raw{*raw}, nil
+	}
+	return nil, fmt.Errorf("unexpected reply type %T", reply)
+}
+
+func toRawDocument(doc interface{}) (bson.Raw, error) {
+	if raw, ok := doc.(bson.Raw); ok {
+		return raw, nil
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return bson.Raw{}, err
+	}
+	return bson.Raw{Kind: 0x03, Data: data}, nil
+}
+
+// ReplyTapeWriter implements the PostOpHook interface, writing the replies
+// received during playback to a reply tape, which diff-replies can compare
+// with the tape of another playback.
+type ReplyTapeWriter struct {
+	sync.Mutex
+	file    io.WriteCloser
+	out     *bufio.Writer
+	err     error
+	entries int64
+}
+
+// NewReplyTapeWriter creates a ReplyTapeWriter writing to the file at path.
+func NewReplyTapeWriter(path string, metadata ReplyTapeMetadata) (*ReplyTapeWriter, error) {
+	created, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening reply tape: %v", err)
+	}
+	file, err := newEncryptingWriteCloser(created)
+	if err != nil {
+		created.Close()
+		return nil, fmt.Errorf("error encrypting reply tape: %v", err)
+	}
+	writer := &ReplyTapeWriter{file: file, out: bufio.NewWriter(file)}
+	metadata.ReplyTapeVersion = ReplyTapeVersion
+	if err := bsonToWriter(writer.out, metadata); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error writing reply tape metadata: %v", err)
+	}
+	return writer, nil
+}
+
+// newReplyTapeEntry creates the entry holding the reply to the op, or the
+// error encountered playing it.
+func newReplyTapeEntry(op *RecordedOp, parsedOp Op, reply Replyable, err error) *ReplyTapeEntry {
+	meta := parsedOp.Meta()
+	entry := &ReplyTapeEntry{
+		Generation:    op.Generation,
+		Order:         op.Order,
+		ConnectionNum: op.SeenConnectionNum,
+		Op:            meta.Op,
+		Command:       meta.Command,
+		Ns:            meta.Ns,
+		Docs:          []bson.Raw{},
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if reply != nil {
+		docs, docsErr := replyDocuments(reply)
+		if docsErr != nil {
+			toolDebugLogger.Logvf(Always, "error reading reply for reply tape: %v", docsErr)
+		}
+		if docs != nil {
+			entry.Docs = docs
+		}
+	}
+	return entry
+}
+
+// AfterOp writes the reply to the op, or the error encountered playing it.
+func (writer *ReplyTapeWriter) AfterOp(op *RecordedOp, parsedOp Op, reply Replyable, err error) {
+	entry := newReplyTapeEntry(op, parsedOp, reply, err)
+	writer.Lock()
+	defer writer.Unlock()
+	if writer.err != nil {
+		return
+	}
+	if writer.err = bsonToWriter(writer.out, entry); writer.err != nil {
+		userInfoLogger.Logvf(Always, "Error writing reply tape, no more replies will be written: %v", writer.err)
+		return
+	}
+	writer.entries++
+}
+
+// Close flushes and closes the reply tape, returning the first error
+// encountered writing it.
+func (writer *ReplyTapeWriter) Close() error {
+	writer.Lock()
+	defer writer.Unlock()
+	err := writer.err
+	if flushErr := writer.out.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := writer.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Entries returns the number of replies written.
+func (writer *ReplyTapeWriter) Entries() int64 {
+	writer.Lock()
+	defer writer.Unlock()
+	return writer.entries
+}
+
+// ReplyTape holds the replies of a reply tape.
+type ReplyTape struct {
+	Metadata ReplyTapeMetadata
+	Entries  map[replyTapeKey]*ReplyTapeEntry
+}
+
+// ReadReplyTape reads the reply tape at path.
+func ReadReplyTape(path string) (*ReplyTape, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	in, err := openTape(file)
+	if err != nil {
+		return nil, err
+	}
+	return readReplyTape(bufio.NewReader(in))
+}
+
+func readReplyTape(in io.Reader) (*ReplyTape, error) {
+	tape := &ReplyTape{Entries: map[replyTapeKey]*ReplyTapeEntry{}}
+	if err := bsonFromReader(in, &tape.Metadata); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("empty reply tape")
+		}
+		return nil, fmt.Errorf("error reading reply tape metadata: %v", err)
+	}
+	if tape.Metadata.ReplyTapeVersion != ReplyTapeVersion {
+		return nil, fmt.Errorf("unsupported reply tape version %v", tape.Metadata.ReplyTapeVersion)
+	}
+	for {
+		entry := &ReplyTapeEntry{}
+		err := bsonFromReader(in, entry)
+		if err == io.EOF {
+			return tape, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading reply tape: %v", err)
+		}
+		tape.Entries[entry.key()] = entry
+	}
+}
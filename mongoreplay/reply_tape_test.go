@@ -0,0 +1,85 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// msgOpReplyWith creates an OP_MSG reply whose body is doc.
+func msgOpReplyWith(t *testing.T, doc bson.D) *MsgOpReply {
+	raw, err := dToRaw(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := &MsgOpReply{}
+	reply.Sections = []mgo.MsgSection{{PayloadType: mgo.MsgPayload0, Data: raw}}
+	return reply
+}
+
+func TestReplyTapeRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-replytape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "replies.tape")
+
+	writer, err := NewReplyTapeWriter(path, ReplyTapeMetadata{PlaybackFile: "workload.playback", ServerVersion: "4.4.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	find := &MsgOp{CommandName: "find", Database: "test"}
+	replyDoc := bson.D{{"cursor", bson.D{{"id", int64(0)}, {"firstBatch", []interface{}{bson.D{{"_id", 1}}}}}}, {"ok", 1.0}}
+	writer.AfterOp(&RecordedOp{Order: 1, SeenConnectionNum: 3}, find, msgOpReplyWith(t, replyDoc), nil)
+	writer.AfterOp(&RecordedOp{Order: 2, Generation: 1}, find, nil, fmt.Errorf("error executing op: EOF"))
+	if err := writer.Close(); err != nil {
+		t.Fatalf("error closing reply tape: %v", err)
+	}
+	if writer.Entries() != 2 {
+		t.Errorf("expected 2 entries to be written, saw %v", writer.Entries())
+	}
+
+	tape, err := ReadReplyTape(path)
+	if err != nil {
+		t.Fatalf("error reading reply tape: %v", err)
+	}
+	if tape.Metadata.PlaybackFile != "workload.playback" || tape.Metadata.ServerVersion != "4.4.0" {
+		t.Errorf("unexpected metadata %+v", tape.Metadata)
+	}
+	if len(tape.Entries) != 2 {
+		t.Fatalf("expected 2 entries, saw %v", len(tape.Entries))
+	}
+
+	entry := tape.Entries[replyTapeKey{0, 1}]
+	if entry == nil {
+		t.Fatalf("entry 0:1 missing from %v", tape.Entries)
+	}
+	if entry.Command != "find" || entry.Ns != "test" || entry.ConnectionNum != 3 || len(entry.Docs) != 1 {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+	doc := bson.D{}
+	if err := entry.Docs[0].Unmarshal(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(doc, replyDoc) {
+		t.Errorf("expected reply %v, saw %v", replyDoc, doc)
+	}
+
+	entry = tape.Entries[replyTapeKey{1, 2}]
+	if entry == nil || entry.Error != "error executing op: EOF" || len(entry.Docs) != 0 {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+)
+
+// retryableCodes are the codes of the server errors which the retryable
+// writes specification retries: a primary stepping down or shutting down,
+// or the server being unreachable from a mongos.
+var retryableCodes = map[int]bool{
+	6: true, 7: true, 89: true, 91: true, 189: true, 262: true, 9001: true,
+	10107: true, 11600: true, 11602: true, 13435: true, 13436: true,
+}
+
+// retryPolicy determines whether the ops which fail with transient errors
+// are sent again, how many times and how long after.
+type retryPolicy struct {
+	// retries is the number of times an op is sent again, none if 0.
+	retries int
+	// backoff is how long the first retry waits, doubling for every retry.
+	backoff time.Duration
+}
+
+// isRetryableOp returns whether an op can be sent again after a transient
+// error without being applied twice: the reads, except for the getMores,
+// which would skip the batch lost, and the writes carrying a txnNumber,
+// which the server applies once.
+func isRetryableOp(op Op) bool {
+	switch op.(type) {
+	case *GetMoreOp, *CommandGetMore, *MsgOpGetMore, *KillCursorsOp:
+		return false
+	}
+	if cursorCommands[commandNameOf(op)] {
+		return false
+	}
+	switch opKindOf(op) {
+	case opKindRead:
+		return true
+	case opKindWrite:
+		return carriesTxnNumber(op)
+	}
+	return false
+}
+
+// carriesTxnNumber returns whether a command carries a txnNumber, making it
+// a retryable write.
+func carriesTxnNumber(op Op) bool {
+	var body interface{}
+	switch castOp := op.(type) {
+	case *QueryOp:
+		body = castOp.Query
+	case *MsgOp:
+		payload, _, err := fetchPayload0Data(castOp.Sections)
+		if err != nil {
+			return false
+		}
+		body = payload
+	default:
+		return false
+	}
+	command, err := bsonToD(body)
+	if err != nil {
+		return false
+	}
+	if value, ok := FindValueByKey("$query", &command); ok {
+		if command, err = bsonToD(value); err != nil {
+			return false
+		}
+	}
+	_, ok := FindValueByKey("txnNumber", &command)
+	return ok
+}
+
+// transientError returns whether an op which failed with err, or whose reply
+// reported a transient error, can be sent again, and whether its socket
+// must be replaced first.
+func transientError(err error, reply Replyable) (retry bool, redial bool) {
+	if err != nil {
+		network := classifyExecutionError(err) == ErrorClassNetwork
+		return network, network
+	}
+	if reply == nil || len(reply.getErrors()) == 0 {
+		return false, false
+	}
+	docs, err := replyDocuments(reply)
+	if err != nil || len(docs) == 0 {
+		return false, false
+	}
+	doc := struct {
+		Code        int      `bson:"code"`
+		ErrorLabels []string `bson:"errorLabels"`
+	}{}
+	if err := docs[0].Unmarshal(&doc); err != nil {
+		return false, false
+	}
+	for _, label := range doc.ErrorLabels {
+		if label == "RetryableWriteError" {
+			return true, false
+		}
+	}
+	return retryableCodes[doc.Code], false
+}
+
+// send sends an op on the socket and waits for its reply, sending it again
+// as set by the retry policy while it fails with transient errors, if it is
+// retryable.
+func (context *ExecutionContext) send(ctx context.Context, op Op, socket **mgo.MongoSocket) (Replyable, error) {
+	return context.sendRetrying(ctx, op, isRetryableOp(op), socket)
+}
+
+// sendRetrying works like send, sending the op again only if retryable is
+// set. A socket which fails is replaced by a new one before the op is sent
+// again, and the op is abandoned, returning the last error, once it has
+// been retried as many times as the policy allows or ctx is done.
+func (context *ExecutionContext) sendRetrying(ctx context.Context, op Op, retryable bool, socket **mgo.MongoSocket) (Replyable, error) {
+	backoff := context.retry.backoff
+	for attempt := 0; ; attempt++ {
+		reply, err := op.Execute(*socket)
+		retry, redial := transientError(err, reply)
+		if !retry || !retryable {
+			return reply, err
+		}
+		if attempt == context.retry.retries {
+			if attempt > 0 {
+				atomic.AddInt64(&context.abandonedOps, 1)
+			}
+			return reply, err
+		}
+		atomic.AddInt64(&context.retriedOps, 1)
+		userInfoLogger.Logvf(DebugLow, "Retrying op after transient error (attempt %v of %v)", attempt+1, context.retry.retries)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			atomic.AddInt64(&context.abandonedOps, 1)
+			return reply, err
+		}
+		backoff *= 2
+		if redial {
+			replacement, dialErr := context.dialSocket()
+			if dialErr != nil {
+				userInfoLogger.Logvf(DebugLow, "Error replacing failed socket: %v", dialErr)
+				atomic.AddInt64(&context.abandonedOps, 1)
+				return reply, err
+			}
+			context.trackSocket(*socket, false)
+			(*socket).Close()
+			context.trackSocket(replacement, true)
+			*socket = replacement
+		}
+	}
+}
+
+// RetriedOps returns the number of times ops were sent again after failing
+// with transient errors.
+func (context *ExecutionContext) RetriedOps() int64 {
+	return atomic.LoadInt64(&context.retriedOps)
+}
+
+// AbandonedOps returns the number of ops which still failed with transient
+// errors once they had been retried as many times as allowed.
+func (context *ExecutionContext) AbandonedOps() int64 {
+	return atomic.LoadInt64(&context.abandonedOps)
+}
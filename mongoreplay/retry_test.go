@@ -0,0 +1,140 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	gocontext "context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestTransientError(t *testing.T) {
+	type testCase struct {
+		name   string
+		err    error
+		reply  bson.D
+		retry  bool
+		redial bool
+	}
+	cases := []testCase{
+		{name: "network error", err: io.EOF, retry: true, redial: true},
+		{name: "other error", err: fmt.Errorf("malformed reply"), retry: false},
+		{name: "success", reply: bson.D{{"ok", 1}}, retry: false},
+		{name: "primary stepped down", reply: bson.D{{"ok", 0}, {"errmsg", "not primary"}, {"code", 10107}}, retry: true},
+		{name: "duplicate key", reply: bson.D{{"ok", 0}, {"errmsg", "E11000 duplicate key"}, {"code", 11000}}, retry: false},
+		{
+			name:  "retryable write error label",
+			reply: bson.D{{"ok", 0}, {"errmsg", "transient"}, {"code", 112}, {"errorLabels", []string{"RetryableWriteError"}}},
+			retry: true,
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		var reply Replyable
+		if c.reply != nil {
+			reply = msgOpReplyWith(t, c.reply)
+		}
+		retry, redial := transientError(c.err, reply)
+		if retry != c.retry || redial != c.redial {
+			t.Errorf("expected retry %v and redial %v, got %v and %v", c.retry, c.redial, retry, redial)
+		}
+	}
+}
+
+// flakyOp is an op whose first failures executions reply that the primary
+// stepped down.
+type flakyOp struct {
+	MsgOp
+	failures   int
+	executions int
+	t          *testing.T
+}
+
+func (op *flakyOp) Execute(socket *mgo.MongoSocket) (Replyable, error) {
+	op.executions++
+	if op.executions <= op.failures {
+		return msgOpReplyWith(op.t, bson.D{{"ok", 0}, {"errmsg", "not primary"}, {"code", 10107}}), nil
+	}
+	return msgOpReplyWith(op.t, bson.D{{"ok", 1}}), nil
+}
+
+func TestSendRetries(t *testing.T) {
+	type testCase struct {
+		name       string
+		retries    int
+		failures   int
+		executions int
+		retried    int64
+		abandoned  int64
+		// notRetryable sends the op as one which isn't retried, and
+		// interrupted cancels the playback before the retries' backoff
+		notRetryable bool
+		interrupted  bool
+		backoff      time.Duration
+	}
+	cases := []testCase{
+		{name: "no retries", retries: 0, failures: 1, executions: 1},
+		{name: "retried until it succeeds", retries: 3, failures: 2, executions: 3, retried: 2},
+		{name: "abandoned", retries: 2, failures: 5, executions: 3, retried: 2, abandoned: 1},
+		{name: "not retryable", retries: 3, failures: 2, executions: 1, notRetryable: true},
+		{name: "interrupted while backing off", retries: 3, failures: 2, executions: 1, retried: 1, abandoned: 1, backoff: time.Hour, interrupted: true},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		context := NewExecutionContext(&StatCollector{noop: true}, nil, &ExecutionOptions{retry: retryPolicy{retries: c.retries, backoff: c.backoff}})
+		op := &flakyOp{failures: c.failures, t: t}
+		ctx, cancel := gocontext.WithCancel(gocontext.Background())
+		if c.interrupted {
+			cancel()
+		}
+		var socket *mgo.MongoSocket
+		_, err := context.sendRetrying(ctx, op, !c.notRetryable, &socket)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op.executions != c.executions || context.RetriedOps() != c.retried || context.AbandonedOps() != c.abandoned {
+			t.Errorf("expected %v executions, %v retried and %v abandoned, got %v, %v and %v",
+				c.executions, c.retried, c.abandoned, op.executions, context.RetriedOps(), context.AbandonedOps())
+		}
+	}
+}
+
+func TestIsRetryableOp(t *testing.T) {
+	type testCase struct {
+		name      string
+		command   bson.D
+		retryable bool
+	}
+	cases := []testCase{
+		{name: "find", command: bson.D{{"find", "c"}, {"$db", "test"}}, retryable: true},
+		{name: "insert", command: bson.D{{"insert", "c"}, {"$db", "test"}}},
+		{name: "insert with a txnNumber", command: bson.D{{"insert", "c"}, {"txnNumber", int64(1)}, {"$db", "test"}}, retryable: true},
+		{name: "aggregate with $out", command: bson.D{{"aggregate", "c"}, {"pipeline", []interface{}{bson.D{{"$out", "d"}}}}, {"$db", "test"}}},
+		{name: "getMore", command: bson.D{{"getMore", int64(1)}, {"collection", "c"}, {"$db", "test"}}},
+		{name: "isMaster", command: bson.D{{"isMaster", 1}, {"$db", "admin"}}},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		raw, err := newMsgRawOp(1, 0, c.command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		op, err := raw.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retryable := isRetryableOp(op); retryable != c.retryable {
+			t.Errorf("expected retryable %v, got %v", c.retryable, retryable)
+		}
+	}
+}
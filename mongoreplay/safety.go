@@ -0,0 +1,38 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+// destructiveCommands is the set of commands which are not played back unless
+// destructive commands have explicitly been allowed, since replaying them
+// against the wrong host can lose data or take the host down.
+var destructiveCommands = map[string]bool{
+	"dropDatabase":     true,
+	"drop":             true,
+	"shutdown":         true,
+	"renameCollection": true,
+
+	"createUser":               true,
+	"updateUser":               true,
+	"dropUser":                 true,
+	"dropAllUsersFromDatabase": true,
+	"grantRolesToUser":         true,
+	"revokeRolesFromUser":      true,
+	"createRole":               true,
+	"updateRole":               true,
+	"dropRole":                 true,
+	"dropAllRolesFromDatabase": true,
+	"grantRolesToRole":         true,
+	"revokeRolesFromRole":      true,
+	"grantPrivilegesToRole":    true,
+	"revokePrivilegesFromRole": true,
+}
+
+// IsDestructiveOp checks if an operation is a command that drops data, shuts
+// down the server, or modifies users and roles.
+func IsDestructiveOp(op Op) bool {
+	return destructiveCommands[commandNameOf(op)]
+}
@@ -0,0 +1,44 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestIsDestructiveOp(t *testing.T) {
+	legacyCommand := func(doc bson.D) Op {
+		op := &QueryOp{}
+		op.Collection = "admin.$cmd"
+		op.Query = &doc
+		return op
+	}
+	testCases := []struct {
+		name        string
+		op          Op
+		destructive bool
+	}{
+		{"legacy dropDatabase", legacyCommand(bson.D{{"dropDatabase", 1}}), true},
+		{"legacy shutdown", legacyCommand(bson.D{{"shutdown", 1}}), true},
+		{"legacy dropDatabase wrapped with $query", legacyCommand(bson.D{{"$query", bson.D{{"dropDatabase", 1}}}, {"$readPreference", bson.D{{"mode", "primary"}}}}), true},
+		{"legacy drop wrapped with query", legacyCommand(bson.D{{"query", bson.D{{"drop", "c"}}}}), true},
+		{"legacy find wrapped with $query", legacyCommand(bson.D{{"$query", bson.D{{"find", "c"}}}}), false},
+		{"legacy insert", legacyCommand(bson.D{{"insert", "test"}}), false},
+		{"op_msg drop", &MsgOp{CommandName: "drop"}, true},
+		{"op_msg createUser", &MsgOp{CommandName: "createUser"}, true},
+		{"op_msg find", &MsgOp{CommandName: "find"}, false},
+		{"legacy query", &QueryOp{}, false},
+	}
+	for _, c := range testCases {
+		t.Logf("running case: %s", c.name)
+		if IsDestructiveOp(c.op) != c.destructive {
+			t.Errorf("%v: expected destructive to be %v", c.name, c.destructive)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"math"
+	"sync"
+)
+
+// connectionSampler selects a deterministic subset of the connections of a
+// playback file by hashing their connection numbers, so that every playback
+// of the file with the same rate and seed plays the same connections.
+type connectionSampler struct {
+	rate float64
+	seed int64
+
+	sync.Mutex
+	seen map[int64]bool
+}
+
+func newConnectionSampler(rate float64, seed int64) *connectionSampler {
+	return &connectionSampler{rate: rate, seed: seed, seen: map[int64]bool{}}
+}
+
+// keeps returns whether the ops of the connection are played.
+func (sampler *connectionSampler) keeps(connectionNum int64) bool {
+	return float64(mixConnectionNum(connectionNum, sampler.seed)) < sampler.rate*math.MaxUint64
+}
+
+// mixConnectionNum hashes the connection number and seed with the
+// finalizer of splitmix64, so that consecutive connection numbers are
+// spread evenly over the range of the hash.
+func mixConnectionNum(connectionNum, seed int64) uint64 {
+	x := uint64(connectionNum) + uint64(seed)*0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// keep returns whether the op is played, counting the connections seen.
+func (sampler *connectionSampler) keep(op *RecordedOp) bool {
+	sampler.Lock()
+	defer sampler.Unlock()
+	kept, ok := sampler.seen[op.SeenConnectionNum]
+	if !ok {
+		kept = sampler.keeps(op.SeenConnectionNum)
+		sampler.seen[op.SeenConnectionNum] = kept
+	}
+	return kept
+}
+
+// counts returns the number of connections kept and seen.
+func (sampler *connectionSampler) counts() (kept, seen int) {
+	sampler.Lock()
+	defer sampler.Unlock()
+	for _, k := range sampler.seen {
+		if k {
+			kept++
+		}
+	}
+	return kept, len(sampler.seen)
+}
+
+// sampleOps passes on the ops of the connections kept by the sampler, in
+// the order they are received, closing the returned channel once in is
+// closed or ctx is done.
+func sampleOps(ctx context.Context, in <-chan *RecordedOp, sampler *connectionSampler) <-chan *RecordedOp {
+	out := make(chan *RecordedOp)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case op, ok := <-in:
+				if !ok {
+					return
+				}
+				if !sampler.keep(op) {
+					continue
+				}
+				select {
+				case out <- op:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
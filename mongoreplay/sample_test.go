@@ -0,0 +1,115 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	gocontext "context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestConnectionSampler(t *testing.T) {
+	const numConnections = 10000
+	testCases := []struct {
+		name string
+		rate float64
+		seed int64
+	}{
+		{"all", 1, 0},
+		{"half", 0.5, 0},
+		{"tenth", 0.1, 0},
+		{"tenth with another seed", 0.1, 42},
+		{"hundredth", 0.01, 0},
+	}
+	for _, c := range testCases {
+		t.Logf("running case: %s", c.name)
+		sampler := newConnectionSampler(c.rate, c.seed)
+		other := newConnectionSampler(c.rate, c.seed)
+		var kept int
+		for connectionNum := int64(1); connectionNum <= numConnections; connectionNum++ {
+			keeps := sampler.keeps(connectionNum)
+			if keeps != other.keeps(connectionNum) {
+				t.Fatalf("connection %v was not sampled deterministically", connectionNum)
+			}
+			if keeps {
+				kept++
+			}
+		}
+		share := float64(kept) / numConnections
+		if math.Abs(share-c.rate) > 0.02 {
+			t.Errorf("expected about %v of the connections to be kept, saw %v", c.rate, share)
+		}
+	}
+
+	var sameChoices int
+	seed0, seed1 := newConnectionSampler(0.5, 0), newConnectionSampler(0.5, 1)
+	for connectionNum := int64(1); connectionNum <= numConnections; connectionNum++ {
+		if seed0.keeps(connectionNum) == seed1.keeps(connectionNum) {
+			sameChoices++
+		}
+	}
+	if sameChoices == numConnections {
+		t.Errorf("expected different seeds to choose different connections")
+	}
+}
+
+func TestSampleOps(t *testing.T) {
+	sampler := newConnectionSampler(0.5, 0)
+	in := make(chan *RecordedOp)
+	go func() {
+		for order := int64(0); order < 100; order++ {
+			in <- &RecordedOp{SeenConnectionNum: order % 10, Order: order}
+		}
+		close(in)
+	}()
+
+	lastOrder := map[int64]int64{}
+	counts := map[int64]int{}
+	for op := range sampleOps(gocontext.Background(), in, sampler) {
+		if !sampler.keeps(op.SeenConnectionNum) {
+			t.Errorf("op of connection %v was not sampled out", op.SeenConnectionNum)
+		}
+		if last, ok := lastOrder[op.SeenConnectionNum]; ok && op.Order <= last {
+			t.Errorf("ops of connection %v were reordered", op.SeenConnectionNum)
+		}
+		lastOrder[op.SeenConnectionNum] = op.Order
+		counts[op.SeenConnectionNum]++
+	}
+	for connectionNum, count := range counts {
+		if count != 10 {
+			t.Errorf("expected the 10 ops of connection %v, saw %v", connectionNum, count)
+		}
+	}
+	kept, seen := sampler.counts()
+	if seen != 10 || kept != len(counts) {
+		t.Errorf("expected %v of 10 connections to be counted as kept, saw %v of %v", len(counts), kept, seen)
+	}
+}
+
+func TestSampleOpsCanceled(t *testing.T) {
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	in := make(chan *RecordedOp, 1)
+	out := sampleOps(ctx, in, newConnectionSampler(1, 0))
+	// the op is never read, and in never closed, so sampling stops only
+	// when canceled
+	in <- &RecordedOp{}
+	cancel()
+	select {
+	case <-out:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("sampling did not stop when canceled")
+	}
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Errorf("expected the channel to be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("sampling did not stop when canceled")
+	}
+}
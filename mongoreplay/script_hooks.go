@@ -0,0 +1,46 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// runScripts runs the commands of --before or --after in order through the
+// shell, with their output written to out and env added to their
+// environment, stopping at the first which fails.
+func runScripts(option string, commands []string, env []string, out io.Writer) error {
+	for _, command := range commands {
+		userInfoLogger.Logvf(Always, "Running %v command: %v", option, command)
+		start := time.Now()
+		cmd := exec.Command(shell[0], append(shell[1:], command)...)
+		cmd.Stdout, cmd.Stderr = out, out
+		cmd.Env = append(os.Environ(), env...)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%v command '%v' failed: %v", option, command, err)
+		}
+		userInfoLogger.Logvf(Always, "%v command completed in %v", option, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// scriptEnv returns the variables describing the playback which are added
+// to the environment of the --before and --after commands.
+func (play *PlayCommand) scriptEnv() []string {
+	env := []string{"MONGOREPLAY_PLAYBACK_FILE=" + play.PlaybackFile}
+	if play.target != nil {
+		env = append(env, "MONGOREPLAY_HOST="+describeServers(play.target))
+	}
+	if play.Report != "" {
+		env = append(env, "MONGOREPLAY_REPORT="+play.Report)
+	}
+	return env
+}
@@ -0,0 +1,49 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+// +build !windows
+
+package mongoreplay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunScripts(t *testing.T) {
+	out := &bytes.Buffer{}
+	env := []string{"MONGOREPLAY_PLAYBACK_FILE=tape.bson"}
+	err := runScripts("--before", []string{"echo restoring $MONGOREPLAY_PLAYBACK_FILE", "echo validating >&2"}, env, out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != "restoring tape.bson\nvalidating\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	// the commands after the first which fails aren't run
+	out.Reset()
+	err = runScripts("--after", []string{"exit 3", "echo not run"}, nil, out)
+	if err == nil || !strings.Contains(err.Error(), "--after command 'exit 3' failed: exit status 3") {
+		t.Errorf("expected the command to fail, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected the command following the failure not to run, got %q", out.String())
+	}
+}
+
+func TestRemotePlayRefusesScripts(t *testing.T) {
+	for _, play := range []*PlayCommand{
+		{PlaybackFile: "tape.bson", Speed: 1, remote: true, Before: []string{"touch /tmp/x"}},
+		{PlaybackFile: "tape.bson", Speed: 1, remote: true, After: []string{"touch /tmp/x"}},
+	} {
+		err := play.ValidateParams(nil)
+		if err == nil || !strings.Contains(err.Error(), "run by a worker") {
+			t.Errorf("expected the commands to be refused, got %v", err)
+		}
+	}
+}
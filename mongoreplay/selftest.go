@@ -0,0 +1,329 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// selfTestCaptureDelay is how long the capture is left running after the
+// traffic is generated, so that the last packets reach it.
+const selfTestCaptureDelay = time.Second
+
+// SelfTestCommand stores settings for the mongoreplay 'selftest' subcommand
+type SelfTestCommand struct {
+	GlobalOpts       *Options `no-flag:"true"`
+	URL              string   `short:"m" long:"host" description:"Location of the host to test against" default:"mongodb://localhost:27017"`
+	NetworkInterface string   `short:"i" long:"interface" description:"loopback network interface to capture on" default:"lo"`
+	Ops              int      `long:"ops" description:"number of inserts, and of finds, to generate" default:"100"`
+	Database         string   `long:"db" description:"database in which a collection is created for the test and dropped afterwards" default:"mongoreplay_selftest"`
+	KeepPlaybackFile bool     `long:"keepPlaybackFile" description:"keep the playback file recorded by the test instead of deleting it"`
+}
+
+// ValidateParams validates the settings described in the SelfTestCommand struct.
+func (selfTest *SelfTestCommand) ValidateParams(args []string) error {
+	switch {
+	case len(args) > 0:
+		return fmt.Errorf("unknown argument: %s", args[0])
+	case selfTest.Ops < 1:
+		return fmt.Errorf("Invalid setting for --ops: must be at least 1")
+	}
+	return nil
+}
+
+// Execute runs the program for the 'selftest' subcommand. It records the
+// traffic of a generated workload sent through a proxy listening on the
+// loopback interface, replays the recording against the same server and
+// checks that every generated op was recorded and played successfully.
+func (selfTest *SelfTestCommand) Execute(args []string) error {
+	err := selfTest.ValidateParams(args)
+	if err != nil {
+		return err
+	}
+	selfTest.GlobalOpts.SetLogging()
+
+	info, err := mgo.ParseURL(selfTest.URL)
+	if err != nil {
+		return err
+	}
+	info.Timeout = dialTimeout
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return fmt.Errorf("error connecting to %v: %v", selfTest.URL, err)
+	}
+	defer session.Close()
+	if buildInfo, err := session.BuildInfo(); err == nil {
+		userInfoLogger.Logvf(Always, "Testing against server version %v", buildInfo.Version)
+	}
+	collection := session.DB(selfTest.Database).C(fmt.Sprintf("selftest_%d", time.Now().UnixNano()))
+	defer collection.DropCollection()
+
+	proxy, err := newLoopbackProxy(selfTestTarget(session, info))
+	if err != nil {
+		return err
+	}
+	defer proxy.Close()
+
+	dir, err := ioutil.TempDir("", "mongoreplay-selftest")
+	if err != nil {
+		return err
+	}
+	playbackFile := filepath.Join(dir, "selftest.playback")
+	if selfTest.KeepPlaybackFile {
+		userInfoLogger.Logvf(Always, "Recording to %v", playbackFile)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+
+	userInfoLogger.Logvf(Always, "Recording traffic on %v through a proxy on port %v", selfTest.NetworkInterface, proxy.port())
+	if err := selfTest.record(playbackFile, proxy, info, collection); err != nil {
+		return fmt.Errorf("recording failed: %v", err)
+	}
+
+	// the ops are played again from an empty collection
+	if err := collection.DropCollection(); err != nil {
+		return err
+	}
+	userInfoLogger.Logvf(Always, "Replaying recorded traffic against %v", selfTest.URL)
+	failures, err := selfTest.play(playbackFile, session)
+	if err != nil {
+		return fmt.Errorf("playback failed: %v", err)
+	}
+	for _, failure := range failures {
+		userInfoLogger.Logvf(Always, "FAIL: %v", failure)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("self-test failed with %v errors", len(failures))
+	}
+	userInfoLogger.Logvf(Always, "PASS: %v inserts and %v finds were recorded and replayed", selfTest.Ops, selfTest.Ops)
+	return nil
+}
+
+// selfTestTarget returns the address of the primary of the session's
+// replica set, or of the server the session is connected to, through which
+// the test's traffic is sent.
+func selfTestTarget(session *mgo.Session, info *mgo.DialInfo) string {
+	var result struct {
+		Primary string `bson:"primary"`
+	}
+	if err := session.Run("isMaster", &result); err == nil && result.Primary != "" {
+		return result.Primary
+	}
+	if servers := session.LiveServers(); len(servers) > 0 {
+		return servers[0]
+	}
+	return info.Addrs[0]
+}
+
+// record captures the traffic sent through the proxy while the workload is
+// generated, writing it to playbackFile.
+func (selfTest *SelfTestCommand) record(playbackFile string, proxy *loopbackProxy, info *mgo.DialInfo, collection *mgo.Collection) error {
+	opStream, err := getOpstream(OpStreamSettings{
+		NetworkInterface: selfTest.NetworkInterface,
+		Expression:       fmt.Sprintf("tcp port %d", proxy.port()),
+		PacketBufSize:    1000,
+		CaptureBufSize:   2 * 1024,
+	})
+	if err != nil {
+		return err
+	}
+	playbackFileWriter, err := NewPlaybackFileWriter(playbackFile, false, false)
+	if err != nil {
+		return err
+	}
+	defer playbackFileWriter.Close()
+
+	recordErr := make(chan error, 1)
+	go func() {
+		recordErr <- Record(opStream, playbackFileWriter, false)
+	}()
+
+	proxiedInfo := *info
+	proxiedInfo.Addrs = []string{proxy.listener.Addr().String()}
+	proxiedInfo.Direct = true
+	generateErr := generateSelfTestTraffic(&proxiedInfo, collection.Database.Name, collection.Name, selfTest.Ops)
+
+	time.Sleep(selfTestCaptureDelay)
+	opStream.packetHandler.Close()
+	if err := <-recordErr; err != nil {
+		return err
+	}
+	return generateErr
+}
+
+// generateSelfTestTraffic inserts numOps documents into the collection, then
+// finds each of them.
+func generateSelfTestTraffic(info *mgo.DialInfo, db, collection string, numOps int) error {
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return fmt.Errorf("error connecting through the proxy: %v", err)
+	}
+	defer session.Close()
+	// every op is sent on the same connection so that they are played in order
+	session.SetPoolLimit(1)
+	coll := session.DB(db).C(collection)
+	for i := 0; i < numOps; i++ {
+		if err := coll.Insert(bson.D{{"_id", i}, {"selftest", true}}); err != nil {
+			return fmt.Errorf("error inserting: %v", err)
+		}
+	}
+	for i := 0; i < numOps; i++ {
+		var doc bson.D
+		if err := coll.FindId(i).One(&doc); err != nil {
+			return fmt.Errorf("error finding: %v", err)
+		}
+	}
+	return nil
+}
+
+// selfTestRecorder checks the stats of the ops played once they have all
+// been recorded, before the stats spooled are removed as the
+// BufferedStatRecorder is closed.
+type selfTestRecorder struct {
+	*BufferedStatRecorder
+	numOps   int
+	failures []error
+}
+
+func (recorder *selfTestRecorder) Close() error {
+	recorder.failures = checkSelfTestStats(recorder.BufferedStatRecorder, recorder.numOps)
+	return recorder.BufferedStatRecorder.Close()
+}
+
+// play replays the playback file with the session, returning the failures
+// found checking the stats of the ops played.
+func (selfTest *SelfTestCommand) play(playbackFile string, session *mgo.Session) ([]error, error) {
+	recorder := &selfTestRecorder{
+		BufferedStatRecorder: &BufferedStatRecorder{MaxBuffered: defaultBufferedStatsMax},
+		numOps:               selfTest.Ops,
+	}
+	statColl, err := NewStatCollector(StatOptions{Recorder: recorder}, "none", true, true)
+	if err != nil {
+		return nil, err
+	}
+	playbackFileReader, err := NewPlaybackFileReader(playbackFile, false)
+	if err != nil {
+		return nil, err
+	}
+	playSession := session.Copy()
+	defer playSession.Close()
+	playSession.SetSocketTimeout(0)
+	context := NewExecutionContext(statColl, playSession, &ExecutionOptions{})
+
+	opChan, errChan := playbackFileReader.OpChan(1)
+	if err := Play(context, opChan, 1, 1, 10); err != nil {
+		return nil, err
+	}
+	if err := <-errChan; err != nil && err != io.EOF {
+		return nil, err
+	}
+	return recorder.failures, nil
+}
+
+// checkSelfTestStats checks that the stats recorded hold numOps successful
+// inserts and numOps finds each returning a document.
+func checkSelfTestStats(recorder *BufferedStatRecorder, numOps int) []error {
+	var failures []error
+	var inserts, finds int
+	err := recorder.ForEach(func(stat *OpStat) error {
+		kind := opKindOfStat(stat)
+		if kind != latencyOpInsert && kind != latencyOpQuery {
+			return nil
+		}
+		if len(stat.Errors) > 0 {
+			failures = append(failures, fmt.Errorf("op %v (%v) received errors: %v", stat.Order, stat.Command, stat.Errors))
+			return nil
+		}
+		if stat.Message != "" {
+			failures = append(failures, fmt.Errorf("op %v (%v) was not played: %v", stat.Order, stat.Command, stat.Message))
+			return nil
+		}
+		if kind == latencyOpInsert {
+			inserts++
+		} else if stat.NumReturned != 1 {
+			failures = append(failures, fmt.Errorf("find %v returned %v documents instead of 1", stat.Order, stat.NumReturned))
+		} else {
+			finds++
+		}
+		return nil
+	})
+	if err != nil {
+		failures = append(failures, err)
+	}
+	if inserts != numOps {
+		failures = append(failures, fmt.Errorf("expected %v inserts to be replayed, saw %v", numOps, inserts))
+	}
+	if finds != numOps {
+		failures = append(failures, fmt.Errorf("expected %v finds to be replayed, saw %v", numOps, finds))
+	}
+	return failures
+}
+
+// loopbackProxy forwards the connections it accepts on the loopback
+// interface to a server.
+type loopbackProxy struct {
+	listener net.Listener
+	target   string
+	wg       sync.WaitGroup
+}
+
+func newLoopbackProxy(target string) (*loopbackProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	proxy := &loopbackProxy{listener: listener, target: target}
+	go proxy.serve()
+	return proxy, nil
+}
+
+func (proxy *loopbackProxy) port() int {
+	return proxy.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (proxy *loopbackProxy) serve() {
+	for {
+		client, err := proxy.listener.Accept()
+		if err != nil {
+			return
+		}
+		server, err := net.DialTimeout("tcp", proxy.target, dialTimeout)
+		if err != nil {
+			userInfoLogger.Logvf(Always, "error connecting proxy to %v: %v", proxy.target, err)
+			client.Close()
+			continue
+		}
+		proxy.wg.Add(2)
+		go proxy.pipe(client, server)
+		go proxy.pipe(server, client)
+	}
+}
+
+// pipe copies from src to dst until either fails, then closes both.
+func (proxy *loopbackProxy) pipe(dst, src net.Conn) {
+	defer proxy.wg.Done()
+	io.Copy(dst, src)
+	dst.Close()
+	src.Close()
+}
+
+// Close stops accepting connections and waits for those open to end.
+func (proxy *loopbackProxy) Close() error {
+	err := proxy.listener.Close()
+	proxy.wg.Wait()
+	return err
+}
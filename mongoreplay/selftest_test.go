@@ -0,0 +1,74 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestCheckSelfTestStats(t *testing.T) {
+	insert := OpStat{OpType: "op_msg", Command: "insert"}
+	find := OpStat{OpType: "op_msg", Command: "find", NumReturned: 1}
+	isMaster := OpStat{OpType: "op_query", Command: "isMaster"}
+
+	testCases := []struct {
+		name     string
+		stats    []OpStat
+		failures int
+	}{
+		{"all played", []OpStat{isMaster, insert, insert, find, find}, 0},
+		{"insert missing", []OpStat{insert, find, find}, 1},
+		{"find returned nothing", []OpStat{insert, insert, find, {OpType: "op_msg", Command: "find"}}, 2},
+		{"server error", []OpStat{insert, {OpType: "op_msg", Command: "insert", Errors: []error{fmt.Errorf("E11000")}}, find, find}, 2},
+	}
+	for _, c := range testCases {
+		t.Logf("running case: %s", c.name)
+		recorder := &BufferedStatRecorder{Buffer: c.stats}
+		if failures := checkSelfTestStats(recorder, 2); len(failures) != c.failures {
+			t.Errorf("expected %v failures, saw %v: %v", c.failures, len(failures), failures)
+		}
+	}
+}
+
+func TestLoopbackProxy(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	proxy, err := newLoopbackProxy(server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", proxy.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Errorf("expected the proxy to echo 'ping', saw %q (error %v)", reply, err)
+	}
+	conn.Close()
+	if err := proxy.Close(); err != nil {
+		t.Error(err)
+	}
+}
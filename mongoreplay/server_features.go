@@ -0,0 +1,126 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"sort"
+
+	mgo "github.com/10gen/llmgo"
+)
+
+// the wire versions of the servers which started or stopped accepting
+// opcodes
+const (
+	// wireVersionOpCommand is that of 3.2, the first to accept OP_COMMAND.
+	wireVersionOpCommand = 4
+	// wireVersionOpMsg is that of 3.6, the first to accept OP_MSG.
+	wireVersionOpMsg = 6
+	// wireVersionNoOpCommand is that of 4.2, the first to reject OP_COMMAND.
+	wireVersionNoOpCommand = 8
+	// wireVersionComment is that of 4.4, the first to accept a comment on
+	// every command.
+	wireVersionComment = 9
+	// wireVersionNoLegacyOps is that of 5.1, the first to reject the legacy
+	// opcodes other than the OP_QUERY of hello.
+	wireVersionNoLegacyOps = 14
+)
+
+// serverFeatures describes the server a playback targets, as detected
+// before playback starts. It chooses the opcodes ops are played as and
+// whether they declare the Stable API; the compressor of each connection is
+// negotiated when it is dialed, from those of --networkCompression.
+type serverFeatures struct {
+	host           string
+	version        string
+	maxWireVersion int
+}
+
+// detectServerFeatures runs hello, or isMaster on servers which predate it,
+// and buildInfo against the server of session.
+func detectServerFeatures(session *mgo.Session, host string) (*serverFeatures, error) {
+	var hello struct {
+		MaxWireVersion int `bson:"maxWireVersion"`
+	}
+	if err := session.Run("hello", &hello); err != nil {
+		if err = session.Run("isMaster", &hello); err != nil {
+			return nil, err
+		}
+	}
+	features := &serverFeatures{host: host, maxWireVersion: hello.MaxWireVersion}
+	if buildInfo, err := session.BuildInfo(); err == nil {
+		features.version = buildInfo.Version
+	}
+	return features, nil
+}
+
+// accepts returns whether the server accepts the ops of opCode.
+func (features *serverFeatures) accepts(opCode OpCode) bool {
+	switch opCode {
+	case OpCodeMessage:
+		return features.maxWireVersion >= wireVersionOpMsg
+	case OpCodeCommand:
+		return features.maxWireVersion >= wireVersionOpCommand && features.maxWireVersion < wireVersionNoOpCommand
+	case OpCodeQuery, OpCodeInsert, OpCodeUpdate, OpCodeDelete, OpCodeGetMore, OpCodeKillCursors:
+		return features.maxWireVersion < wireVersionNoLegacyOps
+	}
+	return true
+}
+
+// opcodeConversion returns whether legacy ops are translated to OP_MSG and
+// OP_MSG commands downconverted to legacy ops when playing against the
+// server. Unless either is requested, whichever the server needs is chosen.
+func (features *serverFeatures) opcodeConversion(translate, downconvert bool) (bool, bool) {
+	if translate || downconvert {
+		return translate, downconvert
+	}
+	if !features.accepts(OpCodeInsert) {
+		userInfoLogger.Logvf(Always, "%v rejects legacy opcodes; playing them as the equivalent commands, as with --translate", features.host)
+		return true, false
+	}
+	if !features.accepts(OpCodeMessage) {
+		userInfoLogger.Logvf(Always, "%v predates OP_MSG; playing simple commands as the equivalent legacy ops, as with --downconvert", features.host)
+		return false, true
+	}
+	return false, false
+}
+
+// apiParameters returns the Stable API parameters replayed commands declare
+// against the server: those of api, unless the server predates the Stable
+// API and would reject every command declaring them.
+func (features *serverFeatures) apiParameters(api *serverAPI) *serverAPI {
+	if api == nil || features.maxWireVersion >= wireVersionStableAPI {
+		return api
+	}
+	userInfoLogger.Logvf(Always, "%v predates the Stable API; replayed commands don't declare --apiVersion", features.host)
+	return nil
+}
+
+// warnUnplayable warns about the ops of the playback file which the server
+// can't accept, even once converted, given the number of request ops of
+// each opcode in the file.
+func (features *serverFeatures) warnUnplayable(opCodes map[OpCode]int64, translate, downconvert bool) {
+	var unplayable []OpCode
+	for opCode := range opCodes {
+		if features.accepts(opCode) {
+			continue
+		}
+		switch {
+		case translate && opCode != OpCodeKillCursors && opCode != OpCodeMessage && opCode != OpCodeCommand:
+			// played as the equivalent commands
+		case downconvert && opCode == OpCodeMessage:
+			userInfoLogger.Logvf(Always, "Warning: %v predates OP_MSG; of the %v OP_MSG ops in the playback file, only simple find, getMore and insert commands can be played against it",
+				features.host, opCodes[opCode])
+		default:
+			unplayable = append(unplayable, opCode)
+		}
+	}
+	sort.Slice(unplayable, func(i, j int) bool { return unplayable[i] < unplayable[j] })
+	for _, opCode := range unplayable {
+		userInfoLogger.Logvf(Always, "Warning: %v %v ops in the playback file can't be played against %v (version %v, maxWireVersion %v)",
+			opCodes[opCode], opCode, features.host, features.version, features.maxWireVersion)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"testing"
+)
+
+func TestServerFeatures(t *testing.T) {
+	type testCase struct {
+		name           string
+		maxWireVersion int
+		// translate and downconvert are requested, expectTranslate and
+		// expectDownconvert chosen
+		translate, downconvert             bool
+		expectTranslate, expectDownconvert bool
+		accepted, rejected                 []OpCode
+		// expectAPI is whether the Stable API is declared
+		expectAPI bool
+	}
+	cases := []testCase{
+		{
+			name:              "3.4",
+			maxWireVersion:    5,
+			expectDownconvert: true,
+			accepted:          []OpCode{OpCodeQuery, OpCodeInsert, OpCodeCommand},
+			rejected:          []OpCode{OpCodeMessage},
+		},
+		{
+			name:           "4.0",
+			maxWireVersion: 7,
+			accepted:       []OpCode{OpCodeQuery, OpCodeCommand, OpCodeMessage},
+		},
+		{
+			name:           "4.4",
+			maxWireVersion: 9,
+			accepted:       []OpCode{OpCodeQuery, OpCodeKillCursors, OpCodeMessage},
+			rejected:       []OpCode{OpCodeCommand},
+		},
+		{
+			name:            "6.0",
+			maxWireVersion:  17,
+			expectTranslate: true,
+			accepted:        []OpCode{OpCodeMessage},
+			rejected:        []OpCode{OpCodeQuery, OpCodeInsert, OpCodeKillCursors, OpCodeCommand},
+			expectAPI:       true,
+		},
+		{
+			name:              "conversion requested",
+			maxWireVersion:    17,
+			downconvert:       true,
+			expectDownconvert: true,
+			expectAPI:         true,
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		features := &serverFeatures{host: "localhost", maxWireVersion: c.maxWireVersion}
+		for _, opCode := range c.accepted {
+			if !features.accepts(opCode) {
+				t.Errorf("expected %v to be accepted", opCode)
+			}
+		}
+		for _, opCode := range c.rejected {
+			if features.accepts(opCode) {
+				t.Errorf("expected %v to be rejected", opCode)
+			}
+		}
+		translate, downconvert := features.opcodeConversion(c.translate, c.downconvert)
+		if translate != c.expectTranslate || downconvert != c.expectDownconvert {
+			t.Errorf("expected translate %v and downconvert %v, got %v and %v",
+				c.expectTranslate, c.expectDownconvert, translate, downconvert)
+		}
+		if api := features.apiParameters(&serverAPI{version: "1"}); (api != nil) != c.expectAPI {
+			t.Errorf("expected the Stable API declared %v, got %v", c.expectAPI, api != nil)
+		}
+	}
+}
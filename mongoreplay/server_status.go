@@ -0,0 +1,301 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// serverStatusTimeout bounds the time a sample of --serverStatus waits for
+// the server to reply, so that a server too loaded to answer doesn't hold
+// back the samples which follow.
+const serverStatusTimeout = 10 * time.Second
+
+// ServerStatusSample holds the metrics of the server played against at one
+// point of the playback, taken from serverStatus and, on a replica set,
+// replSetGetStatus. The opcounters and cache byte counts are cumulative since
+// the server started.
+type ServerStatusSample struct {
+	Time              time.Time        `json:"time"`
+	Connections       int64            `json:"connections"`
+	ActiveReaders     int64            `json:"activeReaders"`
+	ActiveWriters     int64            `json:"activeWriters"`
+	QueuedReaders     int64            `json:"queuedReaders"`
+	QueuedWriters     int64            `json:"queuedWriters"`
+	CacheBytes        int64            `json:"cacheBytes"`
+	CacheDirtyBytes   int64            `json:"cacheDirtyBytes"`
+	CacheReadBytes    int64            `json:"cacheReadBytes"`
+	CacheWrittenBytes int64            `json:"cacheWrittenBytes"`
+	Opcounters        map[string]int64 `json:"opcounters"`
+	// ReplicationLagSeconds is how far the furthest behind secondary is
+	// behind the primary, if the server is a member of a replica set.
+	ReplicationLagSeconds *float64 `json:"replicationLagSeconds,omitempty"`
+	// Error is the error which prevented the sample from being taken.
+	Error string `json:"error,omitempty"`
+}
+
+// Ops returns the total of the opcounters of the sample.
+func (sample *ServerStatusSample) Ops() int64 {
+	var ops int64
+	for _, count := range sample.Opcounters {
+		ops += count
+	}
+	return ops
+}
+
+// ServerStatusRecorder is implemented by the StatRecorders which report the
+// samples of --serverStatus along with the stats of the ops. It may be
+// called concurrently with RecordStat.
+type ServerStatusRecorder interface {
+	RecordServerStatus(sample *ServerStatusSample)
+}
+
+// RecordServerStatus passes the sample to the recorders which report it.
+func (msr multiStatRecorder) RecordServerStatus(sample *ServerStatusSample) {
+	for _, recorder := range msr {
+		if statusRecorder, ok := recorder.(ServerStatusRecorder); ok {
+			statusRecorder.RecordServerStatus(sample)
+		}
+	}
+}
+
+// serverStatusResult is the part of the reply to serverStatus which is
+// sampled.
+type serverStatusResult struct {
+	Connections struct {
+		Current int64 `bson:"current"`
+	} `bson:"connections"`
+	GlobalLock struct {
+		CurrentQueue struct {
+			Readers int64 `bson:"readers"`
+			Writers int64 `bson:"writers"`
+		} `bson:"currentQueue"`
+		ActiveClients struct {
+			Readers int64 `bson:"readers"`
+			Writers int64 `bson:"writers"`
+		} `bson:"activeClients"`
+	} `bson:"globalLock"`
+	WiredTiger struct {
+		Cache struct {
+			Bytes        int64 `bson:"bytes currently in the cache"`
+			DirtyBytes   int64 `bson:"tracked dirty bytes in the cache"`
+			ReadBytes    int64 `bson:"bytes read into cache"`
+			WrittenBytes int64 `bson:"bytes written from cache"`
+		} `bson:"cache"`
+	} `bson:"wiredTiger"`
+	Opcounters map[string]int64 `bson:"opcounters"`
+}
+
+// replSetStatusResult is the part of the reply to replSetGetStatus which is
+// sampled.
+type replSetStatusResult struct {
+	Members []struct {
+		StateStr   string    `bson:"stateStr"`
+		OptimeDate time.Time `bson:"optimeDate"`
+	} `bson:"members"`
+}
+
+// replicationLag returns how far the furthest behind secondary is behind the
+// primary, or false if there is no primary.
+func (status *replSetStatusResult) replicationLag() (time.Duration, bool) {
+	var primary time.Time
+	for _, member := range status.Members {
+		if member.StateStr == "PRIMARY" {
+			primary = member.OptimeDate
+		}
+	}
+	if primary.IsZero() {
+		return 0, false
+	}
+	var lag time.Duration
+	for _, member := range status.Members {
+		if member.StateStr == "SECONDARY" && primary.Sub(member.OptimeDate) > lag {
+			lag = primary.Sub(member.OptimeDate)
+		}
+	}
+	return lag, true
+}
+
+func newServerStatusSample(at time.Time, status *serverStatusResult, replSetStatus *replSetStatusResult) *ServerStatusSample {
+	sample := &ServerStatusSample{
+		Time:              at,
+		Connections:       status.Connections.Current,
+		ActiveReaders:     status.GlobalLock.ActiveClients.Readers,
+		ActiveWriters:     status.GlobalLock.ActiveClients.Writers,
+		QueuedReaders:     status.GlobalLock.CurrentQueue.Readers,
+		QueuedWriters:     status.GlobalLock.CurrentQueue.Writers,
+		CacheBytes:        status.WiredTiger.Cache.Bytes,
+		CacheDirtyBytes:   status.WiredTiger.Cache.DirtyBytes,
+		CacheReadBytes:    status.WiredTiger.Cache.ReadBytes,
+		CacheWrittenBytes: status.WiredTiger.Cache.WrittenBytes,
+		Opcounters:        status.Opcounters,
+	}
+	if replSetStatus != nil {
+		if lag, ok := replSetStatus.replicationLag(); ok {
+			seconds := lag.Seconds()
+			sample.ReplicationLagSeconds = &seconds
+		}
+	}
+	return sample
+}
+
+// serverStatusSampler samples the metrics of the server played against
+// every --serverStatus seconds while playing, passing each sample to the
+// recorder, if it reports them, and keeping them for --serverStatusReport.
+type serverStatusSampler struct {
+	session  *mgo.Session
+	interval time.Duration
+	recorder ServerStatusRecorder
+
+	// replSet is cleared once replSetGetStatus fails, as the server isn't a
+	// member of a replica set.
+	replSet bool
+
+	sync.Mutex
+	samples []*ServerStatusSample
+	done    chan struct{}
+}
+
+// newServerStatusSampler creates a serverStatusSampler passing its samples
+// to recorder if it is a ServerStatusRecorder.
+func newServerStatusSampler(session *mgo.Session, interval time.Duration, recorder StatRecorder) *serverStatusSampler {
+	sampler := &serverStatusSampler{
+		session:  session,
+		interval: interval,
+		replSet:  true,
+		done:     make(chan struct{}),
+	}
+	if statusRecorder, ok := recorder.(ServerStatusRecorder); ok {
+		sampler.recorder = statusRecorder
+	}
+	return sampler
+}
+
+// run samples the server at once and then every interval until ctx is done.
+func (sampler *serverStatusSampler) run(ctx context.Context) {
+	defer close(sampler.done)
+	session := sampler.session.Copy()
+	defer session.Close()
+	session.SetSocketTimeout(serverStatusTimeout)
+	ticker := time.NewTicker(sampler.interval)
+	defer ticker.Stop()
+	for {
+		sampler.record(sampler.sample(session))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// wait waits for run to return.
+func (sampler *serverStatusSampler) wait() {
+	<-sampler.done
+}
+
+func (sampler *serverStatusSampler) sample(session *mgo.Session) *ServerStatusSample {
+	at := time.Now()
+	var status serverStatusResult
+	if err := session.DB("admin").Run(bson.D{{Name: "serverStatus", Value: 1}}, &status); err != nil {
+		toolDebugLogger.Logvf(DebugLow, "Error running serverStatus: %v", err)
+		return &ServerStatusSample{Time: at, Error: err.Error()}
+	}
+	var replSetStatus *replSetStatusResult
+	if sampler.replSet {
+		replSetStatus = &replSetStatusResult{}
+		if err := session.DB("admin").Run(bson.D{{Name: "replSetGetStatus", Value: 1}}, replSetStatus); err != nil {
+			toolDebugLogger.Logvf(DebugLow, "Not sampling replication lag: %v", err)
+			sampler.replSet = false
+			replSetStatus = nil
+		}
+	}
+	return newServerStatusSample(at, &status, replSetStatus)
+}
+
+func (sampler *serverStatusSampler) record(sample *ServerStatusSample) {
+	sampler.Lock()
+	sampler.samples = append(sampler.samples, sample)
+	sampler.Unlock()
+	if sampler.recorder != nil {
+		sampler.recorder.RecordServerStatus(sample)
+	}
+}
+
+// Samples returns the samples taken so far.
+func (sampler *serverStatusSampler) Samples() []*ServerStatusSample {
+	sampler.Lock()
+	defer sampler.Unlock()
+	samples := make([]*ServerStatusSample, len(sampler.samples))
+	copy(samples, sampler.samples)
+	return samples
+}
+
+// logSummary logs the number of samples taken and the peaks of the
+// connections, queued ops and replication lag they saw.
+func (sampler *serverStatusSampler) logSummary() {
+	samples := sampler.Samples()
+	var taken, failed int
+	var peakConnections, peakQueued int64
+	var peakLag *float64
+	for _, sample := range samples {
+		if sample.Error != "" {
+			failed++
+			continue
+		}
+		taken++
+		if sample.Connections > peakConnections {
+			peakConnections = sample.Connections
+		}
+		if queued := sample.QueuedReaders + sample.QueuedWriters; queued > peakQueued {
+			peakQueued = queued
+		}
+		if sample.ReplicationLagSeconds != nil && (peakLag == nil || *sample.ReplicationLagSeconds > *peakLag) {
+			peakLag = sample.ReplicationLagSeconds
+		}
+	}
+	if failed > 0 {
+		userInfoLogger.Logvf(Always, "%v of %v samples of serverStatus failed", failed, len(samples))
+	}
+	if taken == 0 {
+		return
+	}
+	if peakLag != nil {
+		userInfoLogger.Logvf(Always, "Sampled serverStatus %v times: peak of %v connections, %v queued ops and %.1fs of replication lag",
+			taken, peakConnections, peakQueued, *peakLag)
+	} else {
+		userInfoLogger.Logvf(Always, "Sampled serverStatus %v times: peak of %v connections and %v queued ops",
+			taken, peakConnections, peakQueued)
+	}
+}
+
+// writeReport writes the samples as json to the file at path.
+func (sampler *serverStatusSampler) writeReport(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = writeServerStatusReport(file, sampler.Samples())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func writeServerStatusReport(out io.Writer, samples []*ServerStatusSample) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(samples)
+}
@@ -0,0 +1,119 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestServerStatusSample(t *testing.T) {
+	raw, err := bson.Marshal(bson.D{
+		{"connections", bson.D{{"current", int32(42)}}},
+		{"globalLock", bson.D{
+			{"currentQueue", bson.D{{"readers", int32(3)}, {"writers", int32(4)}}},
+			{"activeClients", bson.D{{"readers", int32(1)}, {"writers", int32(2)}}},
+		}},
+		{"wiredTiger", bson.D{{"cache", bson.D{
+			{"bytes currently in the cache", int64(1 << 30)},
+			{"tracked dirty bytes in the cache", int64(1 << 20)},
+			{"bytes read into cache", float64(5000)},
+			{"bytes written from cache", int64(6000)},
+		}}}},
+		{"opcounters", bson.D{{"query", int64(10)}, {"insert", int32(5)}}},
+		{"ok", 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status serverStatusResult
+	if err := bson.Unmarshal(raw, &status); err != nil {
+		t.Fatal(err)
+	}
+
+	optime := time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC)
+	raw, err = bson.Marshal(bson.D{{"members", []bson.D{
+		{{"stateStr", "SECONDARY"}, {"optimeDate", optime.Add(-time.Second)}},
+		{{"stateStr", "PRIMARY"}, {"optimeDate", optime}},
+		{{"stateStr", "SECONDARY"}, {"optimeDate", optime.Add(-3 * time.Second)}},
+		// an arbiter has no optime
+		{{"stateStr", "ARBITER"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replSetStatus replSetStatusResult
+	if err := bson.Unmarshal(raw, &replSetStatus); err != nil {
+		t.Fatal(err)
+	}
+
+	sample := newServerStatusSample(optime, &status, &replSetStatus)
+	if sample.Connections != 42 || sample.QueuedReaders != 3 || sample.QueuedWriters != 4 ||
+		sample.ActiveReaders != 1 || sample.ActiveWriters != 2 {
+		t.Errorf("unexpected connections and queues: %+v", sample)
+	}
+	if sample.CacheBytes != 1<<30 || sample.CacheDirtyBytes != 1<<20 ||
+		sample.CacheReadBytes != 5000 || sample.CacheWrittenBytes != 6000 {
+		t.Errorf("unexpected cache activity: %+v", sample)
+	}
+	if sample.Ops() != 15 {
+		t.Errorf("expected 15 ops, got %v", sample.Ops())
+	}
+	if sample.ReplicationLagSeconds == nil || *sample.ReplicationLagSeconds != 3 {
+		t.Errorf("expected 3s of replication lag, got %v", sample.ReplicationLagSeconds)
+	}
+
+	// without a primary the lag is unknown
+	replSetStatus.Members = replSetStatus.Members[:1]
+	if sample := newServerStatusSample(optime, &status, &replSetStatus); sample.ReplicationLagSeconds != nil {
+		t.Errorf("expected no replication lag without a primary, got %v", *sample.ReplicationLagSeconds)
+	}
+}
+
+func TestHTMLReportServerStatus(t *testing.T) {
+	out := &bytes.Buffer{}
+	rec := newHTMLReportRecorder(NopWriteCloser(out))
+	start := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		rec.RecordServerStatus(&ServerStatusSample{
+			Time:        start.Add(time.Duration(i) * time.Second),
+			Connections: int64(10 + i),
+			Opcounters:  map[string]int64{"query": int64(100 * i)},
+		})
+	}
+	rec.RecordServerStatus(&ServerStatusSample{Time: start.Add(5 * time.Second), Error: "timed out"})
+
+	rows, taken := serverStatusRows(rec.serverStatus)
+	if taken != 5 {
+		t.Errorf("expected the 5 samples taken to be summarized, got %v", taken)
+	}
+	byName := map[string]htmlServerStatusRow{}
+	for _, row := range rows {
+		byName[row.Name] = row
+	}
+	if row := byName["connections"]; row.Min != "10.0" || row.Mean != "12.0" || row.Max != "14.0" {
+		t.Errorf("unexpected connections: %+v", row)
+	}
+	if row := byName["ops/s"]; row.Min != "100.0" || row.Max != "100.0" || len(strings.Fields(row.SparklinePoints)) != 4 {
+		t.Errorf("unexpected ops/s: %+v", row)
+	}
+	if _, ok := byName["replication lag (s)"]; ok {
+		t.Errorf("expected no replication lag outside of a replica set")
+	}
+
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if report := out.String(); !strings.Contains(report, "5 samples of serverStatus") ||
+		!strings.Contains(report, "<td>connections</td><td>10.0</td><td>12.0</td><td>14.0</td>") {
+		t.Errorf("expected the samples in the report")
+	}
+}
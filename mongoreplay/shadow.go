@@ -0,0 +1,280 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+	"github.com/mongodb/mongo-tools/common/signals"
+)
+
+// shadowPollInterval is how often a followed playback file is checked for
+// new ops once all of those written to it have been read.
+const shadowPollInterval = 200 * time.Millisecond
+
+// ShadowCommand stores settings for the mongoreplay 'shadow' subcommand
+type ShadowCommand struct {
+	GlobalOpts *Options `no-flag:"true"`
+	StatOptions
+	OpStreamSettings
+	DialOptions
+	ConnectionOptions
+	PlaybackFile     string `short:"p" long:"playback-file" description:"path to a playback file being recorded, e.g. by 'record', to follow instead of capturing on a network interface"`
+	Lag              int    `long:"lag" description:"number of seconds after it was seen that each op is played against the shadow host" default:"5"`
+	Collect          string `long:"collect" description:"Stat collection format: json, csv, prometheus, mongodb, sqlite or none, or format to use the --format string" default:"none"`
+	AllowDestructive bool   `long:"allowDestructive" description:"play commands that drop data, shut down the server or modify users and roles, which are otherwise skipped"`
+
+	target *mgo.DialInfo
+}
+
+// ValidateParams validates the settings described in the ShadowCommand struct.
+func (shadow *ShadowCommand) ValidateParams(args []string) error {
+	target, err := shadow.dialInfo(&shadow.DialOptions)
+	if err != nil {
+		return err
+	}
+	if err := shadow.setDialOptions(&shadow.DialOptions); err != nil {
+		return err
+	}
+	switch {
+	case len(args) > 0:
+		return fmt.Errorf("unknown argument: %s", args[0])
+	case shadow.PcapFile != "":
+		return fmt.Errorf("shadow plays live traffic; use play to replay a pcap file once it is recorded")
+	case shadow.PlaybackFile != "" && shadow.NetworkInterface != "":
+		return fmt.Errorf("must only specify an interface or a playback file")
+	case shadow.PlaybackFile == "" && shadow.NetworkInterface == "":
+		return fmt.Errorf("must specify an interface or a playback file to follow")
+	case shadow.PlaybackFile != "" && shadow.Expression != "":
+		return fmt.Errorf("incompatible options: playback file with a filter expression")
+	case shadow.Lag < 0:
+		return fmt.Errorf("lag cannot be less than 0")
+	}
+	if shadow.NetworkInterface != "" {
+		// the capture is set up as by record
+		record := RecordCommand{OpStreamSettings: shadow.OpStreamSettings}
+		if err := record.ValidateParams(nil); err != nil {
+			return err
+		}
+		shadow.OpStreamSettings = record.OpStreamSettings
+	}
+	promptForPassword(target)
+	shadow.target = target
+	return nil
+}
+
+// Execute runs the program for the 'shadow' subcommand. It plays the ops
+// captured on a network interface, or written to a playback file being
+// recorded, against the shadow host as they are seen, each --lag seconds
+// after it was seen, until it is interrupted.
+func (shadow *ShadowCommand) Execute(args []string) error {
+	err := shadow.ValidateParams(args)
+	if err != nil {
+		return err
+	}
+	shadow.GlobalOpts.SetLogging()
+	if err := shadow.DialOptions.resolveServers(shadow.target); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	finishedChan := signals.HandleWithInterrupt(cancel)
+	defer close(finishedChan)
+
+	statColl, err := NewStatCollector(shadow.StatOptions, shadow.Collect, true, true)
+	if err != nil {
+		return err
+	}
+	session, err := dialSession(shadow.target, shadow.DialOptions.newDialer(nil))
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.SetSocketTimeout(0)
+	session.SetPoolLimit(-1)
+
+	var opChan <-chan *RecordedOp
+	var errChan <-chan error
+	driverOpsFiltered := false
+	if shadow.PlaybackFile != "" {
+		follower, err := followPlaybackFile(shadow.PlaybackFile)
+		if err != nil {
+			return err
+		}
+		defer follower.Close()
+		driverOpsFiltered = follower.metadata.DriverOpsFiltered
+		opChan, errChan = follower.OpChan(ctx, shadowPollInterval)
+		userInfoLogger.Logvf(Always, "Following %v", shadow.PlaybackFile)
+	} else {
+		handlerCtx, err := getOpstream(shadow.OpStreamSettings)
+		if err != nil {
+			return err
+		}
+		opChan = handlerCtx.mongoOpStream.Ops
+		e := make(chan error, 1)
+		errChan = e
+		go func() {
+			defer close(e)
+			if err := handlerCtx.packetHandler.Handle(handlerCtx.mongoOpStream, -1); err != nil {
+				e <- fmt.Errorf("shadow: error handling packet stream: %s", err)
+				return
+			}
+			handlerCtx.mongoOpStream.reportLostOps()
+		}()
+		go func() {
+			<-ctx.Done()
+			handlerCtx.packetHandler.Close()
+		}()
+		// the ops captured once playback stops are discarded, so that the
+		// packet handler isn't blocked on them
+		defer func() {
+			for range opChan {
+			}
+		}()
+		userInfoLogger.Logvf(Always, "Capturing traffic on %v", shadow.NetworkInterface)
+	}
+
+	lag := time.Duration(shadow.Lag) * time.Second
+	userInfoLogger.Logvf(Always, "Shadowing traffic to %v with a lag of %v", describeServers(shadow.target), lag)
+	context := NewExecutionContext(statColl, session, &ExecutionOptions{
+		driverOpsFiltered: driverOpsFiltered,
+		allowDestructive:  shadow.AllowDestructive,
+	})
+	context.Pacing = &lagPacing{lag: lag}
+	// ops are never queued much further ahead than the lag
+	queueTime := shadow.Lag + 1
+	if err := PlayWithContext(ctx, context, opChan, 1, 1, queueTime); err != nil && err != ctx.Err() {
+		userInfoLogger.Logvf(Always, "Play: %v", err)
+		cancel()
+	}
+	err = <-errChan
+	if err != nil && err != io.EOF && err != ctx.Err() {
+		return err
+	}
+	return nil
+}
+
+// lagPacing plays every op a fixed lag after it was seen, which is its
+// recording time rather than relative to the start of the playback, as the
+// ops are played while they are still being recorded. Ops seen longer ago
+// than the lag are played as soon as possible.
+type lagPacing struct {
+	lag time.Duration
+}
+
+// Start implements the PacingStrategy interface.
+func (p *lagPacing) Start(playbackStart time.Time, firstOp *RecordedOp) {}
+
+// PlayAt implements the PacingStrategy interface.
+func (p *lagPacing) PlayAt(op *RecordedOp) time.Time {
+	return op.Seen.Add(p.lag)
+}
+
+// playbackFileFollower reads the ops of a playback file as they are written
+// to it, waiting for more once it has read those written so far, until the
+// capture stats which end the file are reached. Gzipped playback files
+// can't be followed. A playback file read from stdin is read as it is
+// piped, without polling.
+type playbackFileFollower struct {
+	file     *os.File
+	stream   bool
+	metadata PlaybackFileMetadata
+}
+
+// followPlaybackFile opens a playback file to follow.
+func followPlaybackFile(filename string) (*playbackFileFollower, error) {
+	file := os.Stdin
+	if filename != stdStream {
+		var err error
+		if file, err = os.Open(filename); err != nil {
+			return nil, err
+		}
+	}
+	f := &playbackFileFollower{file: file, stream: filename == stdStream}
+	if err := bsonFromReader(file, &f.metadata); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error reading metadata: %v", err)
+	}
+	return f, nil
+}
+
+// OpChan runs a goroutine that reads the ops of the playback file and
+// pushes them to the returned recorded op chan, checking for new ones every
+// poll interval once it has read all of those written. Once the recorded op
+// chan is closed, the error chan yields io.EOF if the end of the file was
+// reached, ctx's error if it is done, or the error which stopped the read.
+func (f *playbackFileFollower) OpChan(ctx context.Context, poll time.Duration) (<-chan *RecordedOp, <-chan error) {
+	ch := make(chan *RecordedOp)
+	e := make(chan error, 1)
+	go func() {
+		defer close(e)
+		e <- func() error {
+			defer close(ch)
+			var order int64
+			for {
+				doc, err := f.next(ctx, poll)
+				if err != nil {
+					return err
+				}
+				if isPlaybackFileTrailer(doc) || isPlaybackFileFooter(doc) {
+					return io.EOF
+				}
+				op := new(RecordedOp)
+				if err := bson.Unmarshal(doc, op); err != nil {
+					return fmt.Errorf("error unmarshaling op: %v", err)
+				}
+				op.Order = order
+				order++
+				select {
+				case ch <- op:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}()
+	}()
+	return ch, e
+}
+
+// next returns the next document of the playback file, waiting for it to be
+// written in full.
+func (f *playbackFileFollower) next(ctx context.Context, poll time.Duration) ([]byte, error) {
+	if f.stream {
+		return ReadDocument(f.file)
+	}
+	for {
+		offset, err := f.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := ReadDocument(f.file)
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return doc, err
+		}
+		// the document is yet to be written, or only partly written
+		if _, err := f.file.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		select {
+		case <-time.After(poll):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Close closes the playback file.
+func (f *playbackFileFollower) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,100 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestLagPacing(t *testing.T) {
+	pacing := &lagPacing{lag: 5 * time.Second}
+	first := &RecordedOp{Seen: &PreciseTime{testTime}}
+	pacing.Start(time.Now(), first)
+	for _, offset := range []time.Duration{0, time.Second, time.Hour} {
+		op := &RecordedOp{Seen: &PreciseTime{testTime.Add(offset)}}
+		expected := testTime.Add(offset + 5*time.Second)
+		if playAt := pacing.PlayAt(op); !playAt.Equal(expected) {
+			t.Errorf("expected op seen %v after the first to be played at %v, got %v", offset, expected, playAt)
+		}
+	}
+}
+
+func TestPlaybackFileFollower(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	if err := generator.generateInsertHelper("insert", 0, 4); err != nil {
+		t.Fatal(err)
+	}
+	close(generator.opChan)
+	var ops []*RecordedOp
+	for op := range generator.opChan {
+		op.Seen = &PreciseTime{testTime}
+		ops = append(ops, op)
+	}
+
+	dir, err := ioutil.TempDir("", "mongoreplay-shadow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "live.playback")
+	w, err := NewPlaybackFileWriter(name, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	follower, err := followPlaybackFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opChan, errChan := follower.OpChan(ctx, 10*time.Millisecond)
+
+	for i, op := range ops {
+		opBytes, err := bson.Marshal(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the op is written in two parts, as if the recording was caught in
+		// the middle of writing it
+		if _, err := w.Write(opBytes[:len(opBytes)/2]); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if _, err := w.Write(opBytes[len(opBytes)/2:]); err != nil {
+			t.Fatal(err)
+		}
+		read, ok := <-opChan
+		if !ok {
+			t.Fatalf("expected op %v, the ops ended with %v", i, <-errChan)
+		}
+		if read.Order != int64(i) || read.Header.RequestID != op.Header.RequestID {
+			t.Errorf("expected op %v with request id %v, got op %v with request id %v",
+				i, op.Header.RequestID, read.Order, read.Header.RequestID)
+		}
+	}
+
+	if err := w.WriteCaptureStats(CaptureStats{}); err != nil {
+		t.Fatal(err)
+	}
+	if op, ok := <-opChan; ok {
+		t.Errorf("expected the ops to end with the capture stats, got %v", op)
+	}
+	if err := <-errChan; err != io.EOF {
+		t.Errorf("expected the follower to reach the end of the playback file, got %v", err)
+	}
+}
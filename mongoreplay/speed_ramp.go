@@ -0,0 +1,66 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// speedRampStep is a step of a --speedRamp: a speed played at for a
+// duration, or until the end of the playback for the last step.
+type speedRampStep struct {
+	speed    float64
+	duration time.Duration
+}
+
+// parseSpeedRamp parses a schedule of speeds such as '1x for 5m, then 2x for
+// 10m, then 5x'. Every step but the last must have a duration.
+func parseSpeedRamp(s string) ([]speedRampStep, error) {
+	var steps []speedRampStep
+	for i, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(part), "then "))
+		fields := strings.SplitN(part, " for ", 2)
+		speed, err := parseSpeed(strings.TrimSuffix(strings.TrimSpace(fields[0]), "x"))
+		if err != nil {
+			return nil, fmt.Errorf("step %v: %v", i+1, err)
+		}
+		step := speedRampStep{speed: speed}
+		if len(fields) == 2 {
+			step.duration, err = time.ParseDuration(strings.TrimSpace(fields[1]))
+			if err != nil || step.duration <= 0 {
+				return nil, fmt.Errorf("step %v: invalid duration '%v'", i+1, strings.TrimSpace(fields[1]))
+			}
+		}
+		steps = append(steps, step)
+	}
+	for i, step := range steps[:len(steps)-1] {
+		if step.duration == 0 {
+			return nil, fmt.Errorf("step %v: only the last step can be played until the end of the playback", i+1)
+		}
+	}
+	return steps, nil
+}
+
+// ramp changes the speed of the playback to that of each step of a
+// --speedRamp once the previous step has lasted its duration, until ctx is
+// done. The playback must have been started at the speed of the first step.
+func (control *playControl) ramp(ctx context.Context, steps []speedRampStep) {
+	for i, step := range steps[:len(steps)-1] {
+		timer := time.NewTimer(step.duration)
+		select {
+		case <-timer.C:
+			userInfoLogger.Logvf(Always, "Speed ramp step %v of %v", i+2, len(steps))
+			control.setSpeed(steps[i+1].speed)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSpeedRamp(t *testing.T) {
+	type testCase struct {
+		name  string
+		ramp  string
+		steps []speedRampStep
+		err   bool
+	}
+	cases := []testCase{
+		{
+			name: "ramp",
+			ramp: "1x for 5m, then 2x for 10m, then 5x",
+			steps: []speedRampStep{
+				{speed: 1, duration: 5 * time.Minute},
+				{speed: 2, duration: 10 * time.Minute},
+				{speed: 5},
+			},
+		},
+		{
+			name:  "single step with a duration",
+			ramp:  "0.5 for 90s",
+			steps: []speedRampStep{{speed: 0.5, duration: 90 * time.Second}},
+		},
+		{name: "step without a duration before the last", ramp: "1x, 2x for 5m", err: true},
+		{name: "invalid speed", ramp: "fastx for 5m, 2x", err: true},
+		{name: "invalid duration", ramp: "1x for ever, 2x", err: true},
+		{name: "empty", ramp: "", err: true},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		steps, err := parseSpeedRamp(c.ramp)
+		if (err != nil) != c.err {
+			t.Errorf("expected error %v, got %v", c.err, err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(steps, c.steps) {
+			t.Errorf("expected steps %v, got %v", c.steps, steps)
+		}
+	}
+}
+
+func TestSpeedRamp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	steps := []speedRampStep{
+		{speed: 1, duration: 50 * time.Millisecond},
+		{speed: 2, duration: 50 * time.Millisecond},
+		{speed: 4},
+	}
+	control := newPlayControl(1, cancel)
+	done := make(chan struct{})
+	go func() {
+		control.ramp(ctx, steps)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the ramp to reach its last step")
+	}
+	if speed := control.status().Speed; speed != 4 {
+		t.Errorf("expected the speed of the last step, got %v", speed)
+	}
+}
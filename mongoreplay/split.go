@@ -0,0 +1,391 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The keys which 'split --by' splits the ops of a playback file by.
+const (
+	splitByConnection = "connection"
+	splitByNamespace  = "namespace"
+	splitByTime       = "time"
+)
+
+// splitNoNamespace is the key of the ops of connections which haven't run
+// anything against a namespace when splitting by namespace.
+const splitNoNamespace = "none"
+
+// SplitCommand stores settings for the mongoreplay 'split' subcommand
+type SplitCommand struct {
+	GlobalOpts      *Options `no-flag:"true"`
+	PlaybackFile    string   `description:"path to the playback file to read from" short:"p" long:"playback-file" required:"yes"`
+	SplitFilePrefix string   `description:"prefix of the names of the playback files written, which is followed by the connection number, the namespace or the number of the time slice of their ops" long:"outfilePrefix" required:"yes"`
+	By              string   `long:"by" description:"what the ops are split by: the connection they were sent on, the namespace they run against, or the time slice of --interval seconds they were seen in" choice:"connection" choice:"namespace" choice:"time" default:"connection"`
+	Interval        int      `long:"interval" description:"number of seconds of traffic in each playback file written with --by time" default:"3600"`
+	Gzip            bool     `long:"gzip" description:"decompress gzipped input and compress the output"`
+
+	EncryptionOptions `group:"encryption options"`
+}
+
+// ValidateParams validates the settings described in the SplitCommand struct.
+func (split *SplitCommand) ValidateParams(args []string) error {
+	switch {
+	case len(args) > 0:
+		return fmt.Errorf("unknown argument: %s", args[0])
+	case split.Interval < 1:
+		return fmt.Errorf("Invalid setting for --interval: '%v', value must be >=1", split.Interval)
+	}
+	return nil
+}
+
+// Execute runs the program for the 'split' subcommand
+func (split *SplitCommand) Execute(args []string) error {
+	err := split.ValidateParams(args)
+	if err != nil {
+		return err
+	}
+	split.GlobalOpts.SetLogging()
+	if err := split.setTapeEncryption(); err != nil {
+		return err
+	}
+
+	playbackFileReader, err := NewPlaybackFileReader(split.PlaybackFile, split.Gzip)
+	if err != nil {
+		return err
+	}
+	opChan, errChan := playbackFileReader.OpChan(1)
+
+	splitter := newTapeSplitter(split.By, time.Duration(split.Interval)*time.Second,
+		func(key string) (*PlaybackFileWriter, error) {
+			return NewPlaybackFileWriter(split.SplitFilePrefix+splitFileName(key)+".playback",
+				playbackFileReader.metadata.DriverOpsFiltered, split.Gzip)
+		})
+	splitErr := splitter.split(opChan)
+	// the playback file is read to its end even after an error, so that its
+	// goroutines return
+	for range opChan {
+	}
+	if err := <-errChan; err != nil && err != io.EOF {
+		userInfoLogger.Logvf(Always, "OpChan: %v", err)
+	}
+	if err := splitter.close(); splitErr == nil {
+		splitErr = err
+	}
+	if splitErr != nil {
+		return splitErr
+	}
+	userInfoLogger.Logvf(Always, "Split %v into %v playback files by %v", split.PlaybackFile, len(splitter.written), split.By)
+	return nil
+}
+
+// splitFileName makes a key of a tapeSplitter safe to be part of a file
+// name.
+func splitFileName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// splitMaxHandshakeOps bounds the handshake ops kept for each connection,
+// so that monitoring connections, which only send hellos, don't keep every
+// one of them.
+const splitMaxHandshakeOps = 16
+
+// tapeSplitter writes each op of a playback file to the playback files of
+// the keys it is split by, so that each playback file can be played on its
+// own. Replies are written with the requests they reply to, and the ops
+// without a namespace, when splitting by namespace, with the other ops of
+// their connection. The handshakes of each connection, and their replies,
+// are written again to every other playback file its ops are written to.
+type tapeSplitter struct {
+	by       string
+	interval time.Duration
+	create   func(key string) (*PlaybackFileWriter, error)
+
+	writers map[string]*PlaybackFileWriter
+	// written lists the keys of every playback file written.
+	written map[string]bool
+	// start is the time the first op was seen, from which the time slices
+	// are counted, and slice the last time slice written to. The slices
+	// left are ended, and closed once the replies to their requests are
+	// written.
+	start time.Time
+	slice int
+	ended map[string]bool
+	// namespaces holds the keys a connection's ops were written under when
+	// splitting by namespace, requests the keys each request awaiting its
+	// reply was written under, and pending the number of requests awaiting
+	// their replies under each key.
+	namespaces map[int64][]string
+	requests   map[int64]map[int32]splitRequest
+	pending    map[string]int
+	// handshakes holds the handshake ops of each connection, and joined the
+	// keys its ops were written under, which hold its handshakes.
+	handshakes map[int64][]*RecordedOp
+	joined     map[int64]map[string]bool
+}
+
+// splitRequest is a request awaiting its reply.
+type splitRequest struct {
+	keys      []string
+	handshake bool
+}
+
+func newTapeSplitter(by string, interval time.Duration,
+	create func(key string) (*PlaybackFileWriter, error)) *tapeSplitter {
+	return &tapeSplitter{
+		by:         by,
+		interval:   interval,
+		create:     create,
+		writers:    map[string]*PlaybackFileWriter{},
+		written:    map[string]bool{},
+		ended:      map[string]bool{},
+		namespaces: map[int64][]string{},
+		requests:   map[int64]map[int32]splitRequest{},
+		pending:    map[string]int{},
+		handshakes: map[int64][]*RecordedOp{},
+		joined:     map[int64]map[string]bool{},
+	}
+}
+
+// split writes every op of opChan.
+func (s *tapeSplitter) split(opChan <-chan *RecordedOp) error {
+	for op := range opChan {
+		keys, handshake, err := s.keys(op)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := s.join(op.SeenConnectionNum, key); err != nil {
+				return err
+			}
+			if err := s.write(key, op); err != nil {
+				return err
+			}
+		}
+		if handshake && len(s.handshakes[op.SeenConnectionNum]) < splitMaxHandshakeOps {
+			s.handshakes[op.SeenConnectionNum] = append(s.handshakes[op.SeenConnectionNum], op)
+		}
+		if op.EOF {
+			if err := s.closeConnection(op.SeenConnectionNum); err != nil {
+				return err
+			}
+		}
+		if err := s.closeEnded(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// join writes the handshakes of a connection to the playback file of key
+// before its first other op written there.
+func (s *tapeSplitter) join(connection int64, key string) error {
+	if s.by == splitByConnection || s.joined[connection][key] {
+		return nil
+	}
+	if s.joined[connection] == nil {
+		s.joined[connection] = map[string]bool{}
+	}
+	s.joined[connection][key] = true
+	for _, op := range s.handshakes[connection] {
+		if err := s.write(key, op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keys returns the keys of the playback files op is written to, and
+// whether it is a handshake or the reply to one.
+func (s *tapeSplitter) keys(op *RecordedOp) ([]string, bool, error) {
+	connection := op.SeenConnectionNum
+	switch s.by {
+	case splitByConnection:
+		return []string{fmt.Sprintf("%d", connection)}, false, nil
+	case splitByTime:
+		if s.start.IsZero() {
+			s.start = op.Seen.Time
+		}
+		// the slices which were left are ended, so the ops seen out of
+		// order are written to the current one
+		if slice := int(op.Seen.Sub(s.start) / s.interval); slice > s.slice {
+			s.ended[s.sliceKey()] = true
+			s.slice = slice
+		}
+	}
+	if op.EOF {
+		return s.connectionKeys(connection), false, nil
+	}
+	// the op is parsed from a copy of its message, as a compressed message
+	// is replaced by the one it decompresses to
+	raw := op.RawOp
+	parsedOp, err := raw.Parse()
+	if err != nil {
+		return nil, false, fmt.Errorf("error parsing op: %v", err)
+	}
+	if _, ok := parsedOp.(Replyable); ok {
+		if request, ok := s.requests[connection][op.Header.ResponseTo]; ok {
+			delete(s.requests[connection], op.Header.ResponseTo)
+			s.release(request.keys)
+			return request.keys, request.handshake, nil
+		}
+		return s.connectionKeys(connection), false, nil
+	}
+
+	handshake := IsDriverOp(parsedOp)
+	var keys []string
+	if ns := namespaceOf(parsedOp); s.by == splitByNamespace && ns != "" && !handshake {
+		keys = []string{ns}
+		if !containsString(s.namespaces[connection], ns) {
+			s.namespaces[connection] = append(s.namespaces[connection], ns)
+		}
+	} else if !handshake || s.by == splitByTime || len(s.namespaces[connection]) > 0 {
+		// the handshakes of connections which have no namespace yet are
+		// only written with their first op which has one
+		keys = s.connectionKeys(connection)
+	}
+	if !raw.expectsReply() {
+		return keys, handshake, nil
+	}
+	if s.requests[connection] == nil {
+		s.requests[connection] = map[int32]splitRequest{}
+	}
+	s.requests[connection][op.Header.RequestID] = splitRequest{keys: keys, handshake: handshake}
+	for _, key := range keys {
+		s.pending[key]++
+	}
+	return keys, handshake, nil
+}
+
+// release counts the replies to the requests written under keys.
+func (s *tapeSplitter) release(keys []string) {
+	for _, key := range keys {
+		if s.pending[key]--; s.pending[key] <= 0 {
+			delete(s.pending, key)
+		}
+	}
+}
+
+// sliceKey returns the key of the current time slice.
+func (s *tapeSplitter) sliceKey() string {
+	return fmt.Sprintf("%04d", s.slice)
+}
+
+// connectionKeys returns the keys the ops of a connection without a key of
+// their own are written under: the current time slice, or the namespaces
+// the other ops of the connection were written under, or splitNoNamespace
+// if there aren't any yet.
+func (s *tapeSplitter) connectionKeys(connection int64) []string {
+	if s.by == splitByTime {
+		return []string{s.sliceKey()}
+	}
+	if keys := s.namespaces[connection]; len(keys) > 0 {
+		return keys
+	}
+	return []string{splitNoNamespace}
+}
+
+// write writes op to the playback file of key, creating it the first time.
+func (s *tapeSplitter) write(key string, op *RecordedOp) error {
+	writer, ok := s.writers[key]
+	if !ok {
+		if s.written[key] {
+			// the playback files of ended connections and time slices are
+			// closed, so their late ops are dropped
+			toolDebugLogger.Logvf(DebugLow, "Dropping op %v of closed playback file %v", op.Order, key)
+			return nil
+		}
+		var err error
+		if writer, err = s.create(key); err != nil {
+			return err
+		}
+		s.writers[key] = writer
+		s.written[key] = true
+	}
+	return writer.WriteRecordedOp(op)
+}
+
+// closeConnection forgets an ended connection, closing its playback file
+// when splitting by connection, of which it has no more ops. Its requests
+// will never be replied to.
+func (s *tapeSplitter) closeConnection(connection int64) error {
+	for _, request := range s.requests[connection] {
+		s.release(request.keys)
+	}
+	delete(s.namespaces, connection)
+	delete(s.requests, connection)
+	delete(s.handshakes, connection)
+	delete(s.joined, connection)
+	if s.by == splitByConnection {
+		return s.closeKey(fmt.Sprintf("%d", connection))
+	}
+	return nil
+}
+
+// closeEnded closes the playback files of the ended time slices which have
+// no more requests awaiting their replies.
+func (s *tapeSplitter) closeEnded() error {
+	for key := range s.ended {
+		if s.pending[key] > 0 {
+			continue
+		}
+		delete(s.ended, key)
+		if err := s.closeKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeKey closes the playback file of key, if it is open.
+func (s *tapeSplitter) closeKey(key string) error {
+	writer, ok := s.writers[key]
+	if !ok {
+		return nil
+	}
+	delete(s.writers, key)
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("error closing playback file of %v: %v", key, err)
+	}
+	return nil
+}
+
+// close closes every playback file still open.
+func (s *tapeSplitter) close() error {
+	keys := make([]string, 0, len(s.writers))
+	for key := range s.writers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var firstErr error
+	for _, key := range keys {
+		if err := s.closeKey(key); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
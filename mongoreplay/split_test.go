@@ -0,0 +1,256 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestNamespaceOf(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	steps := []struct {
+		name     string
+		generate func() error
+		ns       string
+	}{
+		{"legacy insert", func() error { return generator.generateInsertHelper("insert", 0, 1) }, "mongoreplay.test"},
+		{"legacy command", generator.generateGetLastError, "admin"},
+		{"OP_COMMAND insert", func() error { return generator.generateCommandOpInsertHelper("insert", 0, 1) }, "mongoreplay.test"},
+		{"OP_COMMAND getMore", func() error { return generator.generateCommandGetMore(2, 0) }, "mongoreplay.test"},
+		{"OP_MSG find", func() error { return generator.generateMsgOpFind(bson.D{}, 0, 3) }, "mongoreplay.test"},
+		{"OP_MSG getMore", func() error { return generator.generateMsgOpGetMore(2, 0) }, "mongoreplay.test"},
+		{"reply", func() error { return generator.generateReply(3, 0) }, ""},
+	}
+	for _, step := range steps {
+		t.Logf("running case: %s", step.name)
+		if err := step.generate(); err != nil {
+			t.Fatal(err)
+		}
+		op := <-generator.opChan
+		parsedOp, err := op.RawOp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ns := namespaceOf(parsedOp); ns != step.ns {
+			t.Errorf("expected namespace %q, got %q", step.ns, ns)
+		}
+	}
+}
+
+func TestTapeSplitter(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	if err := generator.generateInsertHelper("insert", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateCommandOp("find", bson.D{{"find", "other"}}, 11); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateCommandReply(11, 0); err != nil {
+		t.Fatal(err)
+	}
+	close(generator.opChan)
+	var ops []*RecordedOp
+	for op := range generator.opChan {
+		ops = append(ops, op)
+	}
+	ops = append(ops,
+		&RecordedOp{EOF: true, SeenConnectionNum: 1},
+		&RecordedOp{EOF: true, SeenConnectionNum: 2},
+		&RecordedOp{EOF: true, SeenConnectionNum: 3})
+	connections := []int64{1, 2, 2, 1, 2, 3}
+	offsets := []time.Duration{0, 500 * time.Millisecond, 1200 * time.Millisecond,
+		1500 * time.Millisecond, 2100 * time.Millisecond, 2200 * time.Millisecond}
+
+	type testCase struct {
+		name     string
+		by       string
+		expected map[string][]int
+	}
+	cases := []testCase{
+		{
+			name:     "by connection",
+			by:       splitByConnection,
+			expected: map[string][]int{"1": {0, 3}, "2": {1, 2, 4}, "3": {5}},
+		},
+		{
+			name: "by namespace",
+			by:   splitByNamespace,
+			expected: map[string][]int{"mongoreplay.test": {0, 3}, "mongoreplay.other": {1, 2, 4},
+				splitNoNamespace: {5}},
+		},
+		{
+			name: "by time",
+			by:   splitByTime,
+			// the reply to the find is written with it
+			expected: map[string][]int{"0000": {0, 1, 2}, "0001": {3}, "0002": {4, 5}},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		dir, err := ioutil.TempDir("", "mongoreplay-split")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		splitter := newTapeSplitter(c.by, time.Second, func(key string) (*PlaybackFileWriter, error) {
+			return NewPlaybackFileWriter(filepath.Join(dir, splitFileName(key)+".playback"), false, false)
+		})
+		opChan := make(chan *RecordedOp, len(ops))
+		for i, op := range ops {
+			op.SeenConnectionNum = connections[i]
+			op.Seen = &PreciseTime{testTime.Add(offsets[i])}
+			opChan <- op
+		}
+		close(opChan)
+		if err := splitter.split(opChan); err != nil {
+			t.Fatal(err)
+		}
+		if err := splitter.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != len(c.expected) {
+			t.Errorf("expected %v playback files, got %v", len(c.expected), len(files))
+		}
+		for key, expected := range c.expected {
+			reader, err := NewPlaybackFileReader(filepath.Join(dir, splitFileName(key)+".playback"), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opChan, errChan := reader.OpChan(1)
+			var read []int
+			for op := range opChan {
+				for i, offset := range offsets {
+					if op.Seen.Equal(testTime.Add(offset)) {
+						read = append(read, i)
+					}
+				}
+			}
+			if err := <-errChan; err != io.EOF {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(read, expected) {
+				t.Errorf("expected the playback file of %v to hold ops %v, got %v", key, expected, read)
+			}
+		}
+	}
+}
+
+func TestTapeSplitterHandshakes(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	if err := generator.generateCommandOp("isMaster", bson.D{{"isMaster", 1}}, 21); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateCommandReply(21, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateCommandOp("find", bson.D{{"find", "test"}}, 22); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateCommandOp("find", bson.D{{"find", "other"}}, 23); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateCommandReply(23, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.generateCommandReply(22, 0); err != nil {
+		t.Fatal(err)
+	}
+	close(generator.opChan)
+	var ops []*RecordedOp
+	for op := range generator.opChan {
+		ops = append(ops, op)
+	}
+	ops = append(ops, &RecordedOp{EOF: true})
+	// the handshake and the first find are seen in the first time slice,
+	// and the rest of the ops in the second
+	offsets := []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond,
+		1100 * time.Millisecond, 1200 * time.Millisecond, 1300 * time.Millisecond, 1400 * time.Millisecond}
+
+	type testCase struct {
+		name     string
+		by       string
+		expected map[string][]int
+	}
+	cases := []testCase{
+		{
+			name:     "by namespace",
+			by:       splitByNamespace,
+			expected: map[string][]int{"mongoreplay.test": {0, 1, 2, 5, 6}, "mongoreplay.other": {0, 1, 3, 4, 6}},
+		},
+		{
+			name:     "by time",
+			by:       splitByTime,
+			expected: map[string][]int{"0000": {0, 1, 2, 5}, "0001": {0, 1, 3, 4, 6}},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		dir, err := ioutil.TempDir("", "mongoreplay-split")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		splitter := newTapeSplitter(c.by, time.Second, func(key string) (*PlaybackFileWriter, error) {
+			return NewPlaybackFileWriter(filepath.Join(dir, splitFileName(key)+".playback"), false, false)
+		})
+		opChan := make(chan *RecordedOp, len(ops))
+		for i, op := range ops {
+			op.SeenConnectionNum = 1
+			op.Seen = &PreciseTime{testTime.Add(offsets[i])}
+			opChan <- op
+		}
+		close(opChan)
+		if err := splitter.split(opChan); err != nil {
+			t.Fatal(err)
+		}
+		if err := splitter.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != len(c.expected) {
+			t.Errorf("expected %v playback files, got %v", len(c.expected), len(files))
+		}
+		for key, expected := range c.expected {
+			reader, err := NewPlaybackFileReader(filepath.Join(dir, splitFileName(key)+".playback"), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opChan, errChan := reader.OpChan(1)
+			var read []int
+			for op := range opChan {
+				for i, offset := range offsets {
+					if op.Seen.Equal(testTime.Add(offset)) {
+						read = append(read, i)
+					}
+				}
+			}
+			if err := <-errChan; err != io.EOF {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(read, expected) {
+				t.Errorf("expected the playback file of %v to hold ops %v, got %v", key, expected, read)
+			}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// spooledPage is a page of a connection written to the spool of its
+// Assembler, where its bytes are at offset.
+type spooledPage struct {
+	seq    Sequence
+	offset int64
+	length int
+	seen   time.Time
+	end    bool
+}
+
+// spool is the temporary file to which an Assembler spills the pages
+// buffered for connections waiting for out-of-order packets once its
+// buffered pages limits are reached. The file is created when it is first
+// written to, and emptied whenever none of its pages remain to be read back.
+type spool struct {
+	dir  string
+	file *os.File
+	size int64
+	// pages is the number of pages written which have not been read back.
+	pages int
+}
+
+func (s *spool) write(b []byte) (int64, error) {
+	if s.file == nil {
+		file, err := ioutil.TempFile(s.dir, "mongoreplay-spool-")
+		if err != nil {
+			return 0, fmt.Errorf("error creating spool file: %v", err)
+		}
+		s.file = file
+	}
+	offset := s.size
+	if _, err := s.file.WriteAt(b, offset); err != nil {
+		return 0, fmt.Errorf("error writing to spool file: %v", err)
+	}
+	s.size += int64(len(b))
+	s.pages++
+	return offset, nil
+}
+
+func (s *spool) read(sp spooledPage, b []byte) error {
+	if _, err := s.file.ReadAt(b[:sp.length], sp.offset); err != nil {
+		return fmt.Errorf("error reading from spool file: %v", err)
+	}
+	return nil
+}
+
+// release forgets n pages which have been read back or given up on.
+func (s *spool) release(n int) {
+	s.pages -= n
+	if s.pages == 0 && s.size > 0 {
+		if err := s.file.Truncate(0); err == nil {
+			s.size = 0
+		}
+	}
+}
+
+// remove closes and removes the spool file, if it was created.
+func (s *spool) remove() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	err := os.Remove(s.file.Name())
+	s.file = nil
+	return err
+}
+
+// spill writes the pages buffered for conn to the spool, returning them to
+// the page cache. The connection keeps waiting for the packets it is missing,
+// and the spooled pages are read back by unspool once it is no longer.
+func (a *Assembler) spill(conn *connection) error {
+	if a.spool == nil {
+		a.spool = &spool{dir: a.SpoolDir}
+	}
+	for conn.first != nil {
+		p := conn.first
+		offset, err := a.spool.write(p.Bytes)
+		if err != nil {
+			return err
+		}
+		conn.spooled = append(conn.spooled, spooledPage{
+			seq:    p.seq,
+			offset: offset,
+			length: len(p.Bytes),
+			seen:   p.Seen,
+			end:    p.End,
+		})
+		conn.first = p.next
+		a.pc.replace(p)
+		conn.pages--
+		a.spooledPages++
+	}
+	conn.last = nil
+	// pages spilled earlier may come after those spilled now
+	sort.SliceStable(conn.spooled, func(i, j int) bool {
+		return conn.spooled[i].seq.Difference(conn.spooled[j].seq) > 0
+	})
+	return nil
+}
+
+// unspool reads the spooled pages of conn back into its buffered pages.
+func (a *Assembler) unspool(conn *connection) error {
+	defer func() {
+		a.spool.release(len(conn.spooled))
+		conn.spooled = conn.spooled[:0]
+	}()
+	for _, sp := range conn.spooled {
+		p := a.pc.next(sp.seen)
+		if err := a.spool.read(sp, p.buf[:]); err != nil {
+			a.pc.replace(p)
+			return err
+		}
+		p.Bytes = p.buf[:sp.length]
+		p.seq = sp.seq
+		p.End = sp.end
+		prev, current := conn.traverseConn(sp.seq)
+		conn.pushBetween(prev, current, p, p)
+		conn.pages++
+	}
+	return nil
+}
+
+// unspoolReached reads the spooled pages of conn back once the first of them
+// is the next to be passed on to its stream.
+func (a *Assembler) unspoolReached(conn *connection) bool {
+	if len(conn.spooled) == 0 || conn.nextSeq.Difference(conn.spooled[0].seq) > 0 {
+		return false
+	}
+	a.unspoolOrDrop(conn)
+	return true
+}
+
+// unspoolOrDrop reads the spooled pages of conn back, giving up on them if
+// the spool can't be read.
+func (a *Assembler) unspoolOrDrop(conn *connection) {
+	if err := a.unspool(conn); err != nil {
+		userInfoLogger.Logvf(Always, "%v; the packets spooled for a connection are lost", err)
+	}
+}
+
+// RemoveSpool removes the temporary file to which the Assembler spilled
+// buffered pages, once it is done assembling.
+func (a *Assembler) RemoveSpool() error {
+	if a.spool == nil {
+		return nil
+	}
+	return a.spool.remove()
+}
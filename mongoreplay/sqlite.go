@@ -0,0 +1,558 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+)
+
+// This file writes SQLite database files, as described by
+// https://www.sqlite.org/fileformat.html, without depending on the SQLite
+// library. The files are written in a single pass: the rows of each table
+// are appended in the order of their rowids, and the b-trees of the tables
+// and indexes are built from the bottom up once every row is written. The
+// b-trees of the tables can also be built, and the file committed, while
+// rows are still added, so that it is valid at that point: the interior
+// pages built then are freed by the next commit.
+
+// the layout of the pages of the SQLite files written
+const (
+	sqlitePageSize   = 4096
+	sqliteHeaderSize = 100
+
+	// the types of b-tree pages
+	sqliteInteriorIndex = 2
+	sqliteInteriorTable = 5
+	sqliteLeafIndex     = 10
+	sqliteLeafTable     = 13
+)
+
+// sqliteMaxLocal returns the largest payload a cell of a table leaf page,
+// or of an index page, holds without spilling to overflow pages.
+func sqliteMaxLocal(index bool) int {
+	if index {
+		return (sqlitePageSize-12)*64/255 - 23
+	}
+	return sqlitePageSize - 35
+}
+
+// sqliteMinLocal is the part of a payload a cell holds when the rest of it
+// spills to overflow pages.
+const sqliteMinLocal = (sqlitePageSize-12)*32/255 - 23
+
+// sqliteTrunkLeaves is the number of free pages listed by each trunk page of
+// the freelist, leaving unused the last entries older versions of SQLite
+// don't read.
+const sqliteTrunkLeaves = sqlitePageSize/4 - 8
+
+// sqliteFile is a SQLite database file being written.
+type sqliteFile struct {
+	file  *os.File
+	pages uint32
+	// free holds the pages which are no longer part of a b-tree
+	free []uint32
+	// commits counts the commits of the file, which change its header
+	commits uint32
+}
+
+// newSQLiteFile starts a SQLite database in file. The first page, which
+// holds the header and the schema, is written by commit.
+func newSQLiteFile(file *os.File) *sqliteFile {
+	return &sqliteFile{file: file, pages: 1}
+}
+
+// sqliteLockPage is the page holding the bytes SQLite locks, at 1GB into
+// the file, which holds no data.
+const sqliteLockPage = 1<<30/sqlitePageSize + 1
+
+// allocate returns the number of a new page.
+func (db *sqliteFile) allocate() uint32 {
+	db.pages++
+	if db.pages == sqliteLockPage {
+		db.pages++
+	}
+	return db.pages
+}
+
+// release adds pages to the freelist.
+func (db *sqliteFile) release(pages ...uint32) {
+	db.free = append(db.free, pages...)
+}
+
+// writePage writes the page numbered pgno.
+func (db *sqliteFile) writePage(pgno uint32, page []byte) error {
+	_, err := db.file.WriteAt(page, int64(pgno-1)*sqlitePageSize)
+	return err
+}
+
+// sqliteSchemaEntry is an entry of the sqlite_schema table, describing a
+// table or an index and the root page of its b-tree.
+type sqliteSchemaEntry struct {
+	kind     string
+	name     string
+	table    string
+	rootPage uint32
+	sql      string
+}
+
+// commit writes the freelist and the first page, with the header of the
+// file and the sqlite_schema table describing the tables and indexes of the
+// file, and syncs the file. It is valid from then on, until pages are
+// released.
+func (db *sqliteFile) commit(schema []sqliteSchemaEntry) error {
+	firstTrunk, err := db.writeFreelist()
+	if err != nil {
+		return err
+	}
+	cells := make([][]byte, len(schema))
+	used := sqliteHeaderSize + 8
+	for i, entry := range schema {
+		record, err := sqliteRecord(entry.kind, entry.name, entry.table, int64(entry.rootPage), entry.sql)
+		if err != nil {
+			return err
+		}
+		cell := appendSQLiteVarint(nil, int64(len(record)))
+		cell = appendSQLiteVarint(cell, int64(i+1))
+		cells[i] = append(cell, record...)
+		used += 2 + len(cells[i])
+	}
+	if used > sqlitePageSize {
+		return fmt.Errorf("SQLite schema too large for its page")
+	}
+	page := sqlitePage(sqliteLeafTable, cells, 0, sqliteHeaderSize)
+
+	header := page[:sqliteHeaderSize]
+	copy(header, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(header[16:], sqlitePageSize)
+	// the file format versions, the bytes reserved at the end of each page
+	// and the fractions of the payload of cells stored locally
+	copy(header[18:], []byte{1, 1, 0, 64, 32, 32})
+	// the file change counter, the size of the database in pages, and the
+	// first page and number of pages of the freelist
+	db.commits++
+	binary.BigEndian.PutUint32(header[24:], db.commits)
+	binary.BigEndian.PutUint32(header[28:], db.pages)
+	binary.BigEndian.PutUint32(header[32:], firstTrunk)
+	binary.BigEndian.PutUint32(header[36:], uint32(len(db.free)))
+	// the schema cookie and the schema format number
+	binary.BigEndian.PutUint32(header[40:], db.commits)
+	binary.BigEndian.PutUint32(header[44:], 4)
+	// the text encoding, UTF-8
+	binary.BigEndian.PutUint32(header[56:], 1)
+	// the change counter the version number is valid for, and the version
+	// number of SQLite which wrote the file
+	binary.BigEndian.PutUint32(header[92:], db.commits)
+	binary.BigEndian.PutUint32(header[96:], 3008000)
+	if err := db.writePage(1, page); err != nil {
+		return err
+	}
+	return db.file.Sync()
+}
+
+// writeFreelist writes the trunk pages of the freelist, which are free pages
+// themselves, each listing the free pages after it up to the next trunk,
+// and returns the first one.
+func (db *sqliteFile) writeFreelist() (uint32, error) {
+	var next uint32
+	if len(db.free) == 0 {
+		return next, nil
+	}
+	last := (len(db.free) - 1) / (sqliteTrunkLeaves + 1) * (sqliteTrunkLeaves + 1)
+	for start := last; start >= 0; start -= sqliteTrunkLeaves + 1 {
+		end := start + sqliteTrunkLeaves + 1
+		if end > len(db.free) {
+			end = len(db.free)
+		}
+		leaves := db.free[start+1 : end]
+		page := make([]byte, sqlitePageSize)
+		binary.BigEndian.PutUint32(page, next)
+		binary.BigEndian.PutUint32(page[4:], uint32(len(leaves)))
+		for i, leaf := range leaves {
+			binary.BigEndian.PutUint32(page[8+4*i:], leaf)
+		}
+		if err := db.writePage(db.free[start], page); err != nil {
+			return 0, err
+		}
+		next = db.free[start]
+	}
+	return next, nil
+}
+
+// sqlitePage lays out a b-tree page holding cells, starting its header at
+// offset, which is that of the database header on the first page.
+func sqlitePage(kind byte, cells [][]byte, rightmost uint32, offset int) []byte {
+	page := make([]byte, sqlitePageSize)
+	headerSize := 8
+	if kind == sqliteInteriorIndex || kind == sqliteInteriorTable {
+		headerSize = 12
+		binary.BigEndian.PutUint32(page[offset+8:], rightmost)
+	}
+	page[offset] = kind
+	binary.BigEndian.PutUint16(page[offset+3:], uint16(len(cells)))
+	content := sqlitePageSize
+	for i, cell := range cells {
+		content -= len(cell)
+		copy(page[content:], cell)
+		binary.BigEndian.PutUint16(page[offset+headerSize+2*i:], uint16(content))
+	}
+	// a content area starting at the end of a 64K page is written as 0
+	binary.BigEndian.PutUint16(page[offset+5:], uint16(content))
+	return page
+}
+
+// sqlitePageFits returns whether a page of the kind holding cells, whose
+// sizes add up to size, has room for another cell of cellSize bytes.
+func sqlitePageFits(kind byte, cells, size, cellSize int) bool {
+	headerSize := 8
+	if kind == sqliteInteriorIndex || kind == sqliteInteriorTable {
+		headerSize = 12
+	}
+	return headerSize+2*(cells+1)+size+cellSize <= sqlitePageSize
+}
+
+// appendPayload appends to cell as much of payload as is stored in a cell,
+// writing the rest of it to overflow pages.
+func (db *sqliteFile) appendPayload(cell []byte, payload []byte, index bool) ([]byte, error) {
+	maxLocal := sqliteMaxLocal(index)
+	if len(payload) <= maxLocal {
+		return append(cell, payload...), nil
+	}
+	local := sqliteMinLocal + (len(payload)-sqliteMinLocal)%(sqlitePageSize-4)
+	if local > maxLocal {
+		local = sqliteMinLocal
+	}
+	cell = append(cell, payload[:local]...)
+	rest := payload[local:]
+	first := db.allocate()
+	cell = append(cell, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(cell[len(cell)-4:], first)
+	for pgno := first; len(rest) > 0; {
+		page := make([]byte, sqlitePageSize)
+		n := copy(page[4:], rest)
+		rest = rest[n:]
+		next := uint32(0)
+		if len(rest) > 0 {
+			next = db.allocate()
+		}
+		binary.BigEndian.PutUint32(page, next)
+		if err := db.writePage(pgno, page); err != nil {
+			return nil, err
+		}
+		pgno = next
+	}
+	return cell, nil
+}
+
+// sqliteChild is a page of a table b-tree and the largest rowid under it.
+type sqliteChild struct {
+	page     uint32
+	maxRowid int64
+}
+
+// sqliteTable builds the b-tree of a table from its rows, added in the
+// order of their rowids.
+type sqliteTable struct {
+	db       *sqliteFile
+	cells    [][]byte
+	size     int
+	lastRow  int64
+	children []sqliteChild
+	// finished holds the pages written above the leaves by finish, which
+	// the next call to finish frees
+	finished []uint32
+}
+
+// add adds a row, whose rowid is larger than those of the rows before it.
+func (table *sqliteTable) add(rowid int64, record []byte) error {
+	cell := appendSQLiteVarint(nil, int64(len(record)))
+	cell = appendSQLiteVarint(cell, rowid)
+	cell, err := table.db.appendPayload(cell, record, false)
+	if err != nil {
+		return err
+	}
+	if !sqlitePageFits(sqliteLeafTable, len(table.cells), table.size, len(cell)) {
+		if err := table.flush(); err != nil {
+			return err
+		}
+	}
+	table.cells = append(table.cells, cell)
+	table.size += len(cell)
+	table.lastRow = rowid
+	return nil
+}
+
+// flush writes the leaf page being filled.
+func (table *sqliteTable) flush() error {
+	pgno := table.db.allocate()
+	if err := table.db.writePage(pgno, sqlitePage(sqliteLeafTable, table.cells, 0, 0)); err != nil {
+		return err
+	}
+	table.children = append(table.children, sqliteChild{page: pgno, maxRowid: table.lastRow})
+	table.cells, table.size = nil, 0
+	return nil
+}
+
+// sqliteTableFanout is the number of children of the interior pages of
+// table b-trees, whose cells take at most 15 bytes with their pointers.
+const sqliteTableFanout = (sqlitePageSize-12)/15 + 1
+
+// finish writes the last leaf page and the interior pages above the leaves,
+// and returns the root page of the table. Rows can still be added after it,
+// in new leaves, and finish called again.
+func (table *sqliteTable) finish() (uint32, error) {
+	table.db.release(table.finished...)
+	table.finished = nil
+	if len(table.cells) > 0 {
+		if err := table.flush(); err != nil {
+			return 0, err
+		}
+	}
+	if len(table.children) == 0 {
+		// the root of an empty table is a leaf which the rows added later
+		// don't go in
+		pgno := table.db.allocate()
+		table.finished = append(table.finished, pgno)
+		return pgno, table.db.writePage(pgno, sqlitePage(sqliteLeafTable, nil, 0, 0))
+	}
+	children := table.children
+	for len(children) > 1 {
+		// the children are spread evenly, so that every page has at least
+		// two of them
+		pages := (len(children) + sqliteTableFanout - 1) / sqliteTableFanout
+		var parents []sqliteChild
+		for i := 0; i < pages; i++ {
+			group := children[i*len(children)/pages : (i+1)*len(children)/pages]
+			cells := make([][]byte, len(group)-1)
+			for j, child := range group[:len(group)-1] {
+				cells[j] = make([]byte, 4, 13)
+				binary.BigEndian.PutUint32(cells[j], child.page)
+				cells[j] = appendSQLiteVarint(cells[j], child.maxRowid)
+			}
+			// the last child of a page is its rightmost pointer
+			last := group[len(group)-1]
+			pgno := table.db.allocate()
+			table.finished = append(table.finished, pgno)
+			if err := table.db.writePage(pgno, sqlitePage(sqliteInteriorTable, cells, last.page, 0)); err != nil {
+				return 0, err
+			}
+			parents = append(parents, sqliteChild{page: pgno, maxRowid: last.maxRowid})
+		}
+		children = parents
+	}
+	return children[0].page, nil
+}
+
+// sqliteIndex builds the b-tree of an index from its entries, added in
+// order. Unlike those of tables, the interior pages of indexes hold
+// entries: each entry which doesn't fit in the leaf being filled separates
+// it from the next leaf, and goes to the level above.
+type sqliteIndex struct {
+	db    *sqliteFile
+	cells [][]byte
+	size  int
+
+	// previous holds the cells of the last leaf filled, which is written
+	// once the next one is, as the last entry may have to be moved out of
+	// it.
+	previous   [][]byte
+	children   []uint32
+	separators [][]byte
+}
+
+// add adds an entry, the record of the indexed values followed by the
+// rowid of the row, which sorts after those before it.
+func (index *sqliteIndex) add(record []byte) error {
+	cell, err := index.db.appendPayload(appendSQLiteVarint(nil, int64(len(record))), record, true)
+	if err != nil {
+		return err
+	}
+	if sqlitePageFits(sqliteLeafIndex, len(index.cells), index.size, len(cell)) {
+		index.cells = append(index.cells, cell)
+		index.size += len(cell)
+		return nil
+	}
+	if err := index.writeLeaf(index.previous); err != nil {
+		return err
+	}
+	index.previous = index.cells
+	index.separators = append(index.separators, cell)
+	index.cells, index.size = nil, 0
+	return nil
+}
+
+// writeLeaf writes a leaf page holding cells, if there are any.
+func (index *sqliteIndex) writeLeaf(cells [][]byte) error {
+	if cells == nil {
+		return nil
+	}
+	pgno := index.db.allocate()
+	index.children = append(index.children, pgno)
+	return index.db.writePage(pgno, sqlitePage(sqliteLeafIndex, cells, 0, 0))
+}
+
+// finish writes the leaves left and the interior pages above the leaves,
+// and returns the root page of the index.
+func (index *sqliteIndex) finish() (uint32, error) {
+	if len(index.cells) == 0 && index.previous != nil {
+		// the last entry separates the previous leaf from no leaf, so the
+		// last entry of the previous leaf takes its place
+		last := len(index.separators) - 1
+		index.cells = [][]byte{index.separators[last]}
+		index.separators[last] = index.previous[len(index.previous)-1]
+		index.previous = index.previous[:len(index.previous)-1]
+	}
+	if err := index.writeLeaf(index.previous); err != nil {
+		return 0, err
+	}
+	if err := index.writeLeaf(append([][]byte{}, index.cells...)); err != nil {
+		return 0, err
+	}
+	children, separators := index.children, index.separators
+	for len(children) > 1 {
+		var err error
+		if children, separators, err = index.writeLevel(children, separators); err != nil {
+			return 0, err
+		}
+	}
+	return children[0], nil
+}
+
+// writeLevel writes the interior pages above children, which are separated
+// by the entries of separators, and returns those pages and the entries
+// separating them.
+func (index *sqliteIndex) writeLevel(children []uint32, separators [][]byte) ([]uint32, [][]byte, error) {
+	// each page holds the separators from the first of its bounds to the
+	// last, excluded, which separates it from the next page
+	type bounds struct{ first, last int }
+	var pages []bounds
+	first, cells, size := 0, 0, 0
+	for i, separator := range separators {
+		if sqlitePageFits(sqliteInteriorIndex, cells, size, 4+len(separator)) {
+			cells++
+			size += 4 + len(separator)
+			continue
+		}
+		pages = append(pages, bounds{first, i})
+		first, cells, size = i+1, 0, 0
+	}
+	if first == len(separators) && len(pages) > 0 {
+		// the last page would hold no entry, so it takes the last one of
+		// the page before it
+		pages[len(pages)-1].last--
+		first--
+	}
+	pages = append(pages, bounds{first, len(separators)})
+
+	var parents []uint32
+	var up [][]byte
+	for _, page := range pages {
+		cells := make([][]byte, 0, page.last-page.first)
+		for j := page.first; j < page.last; j++ {
+			cell := make([]byte, 4, 4+len(separators[j]))
+			binary.BigEndian.PutUint32(cell, children[j])
+			cells = append(cells, append(cell, separators[j]...))
+		}
+		pgno := index.db.allocate()
+		if err := index.db.writePage(pgno, sqlitePage(sqliteInteriorIndex, cells, children[page.last], 0)); err != nil {
+			return nil, nil, err
+		}
+		parents = append(parents, pgno)
+		if page.last < len(separators) {
+			up = append(up, separators[page.last])
+		}
+	}
+	return parents, up, nil
+}
+
+// sqliteRecord returns the record holding values, which are nil, int64,
+// float64 or string.
+func sqliteRecord(values ...interface{}) ([]byte, error) {
+	var types, body []byte
+	for _, value := range values {
+		switch v := value.(type) {
+		case nil:
+			types = appendSQLiteVarint(types, 0)
+		case int64:
+			switch {
+			case v == 0:
+				types = appendSQLiteVarint(types, 8)
+			case v == 1:
+				types = appendSQLiteVarint(types, 9)
+			case v >= math.MinInt8 && v <= math.MaxInt8:
+				types = appendSQLiteVarint(types, 1)
+				body = append(body, byte(v))
+			case v >= math.MinInt16 && v <= math.MaxInt16:
+				types = appendSQLiteVarint(types, 2)
+				body = append(body, byte(v>>8), byte(v))
+			case v >= -1<<23 && v < 1<<23:
+				types = appendSQLiteVarint(types, 3)
+				body = append(body, byte(v>>16), byte(v>>8), byte(v))
+			case v >= math.MinInt32 && v <= math.MaxInt32:
+				types = appendSQLiteVarint(types, 4)
+				body = append(body, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+			case v >= -1<<47 && v < 1<<47:
+				types = appendSQLiteVarint(types, 5)
+				body = append(body, byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+			default:
+				types = appendSQLiteVarint(types, 6)
+				body = append(body, make([]byte, 8)...)
+				binary.BigEndian.PutUint64(body[len(body)-8:], uint64(v))
+			}
+		case float64:
+			types = appendSQLiteVarint(types, 7)
+			body = append(body, make([]byte, 8)...)
+			binary.BigEndian.PutUint64(body[len(body)-8:], math.Float64bits(v))
+		case string:
+			types = appendSQLiteVarint(types, int64(2*len(v)+13))
+			body = append(body, v...)
+		default:
+			return nil, fmt.Errorf("unsupported SQLite value %T", value)
+		}
+	}
+	// the size of the header counts the varint holding it
+	headerSize := len(types) + 1
+	if len(appendSQLiteVarint(nil, int64(headerSize))) > 1 {
+		headerSize = len(types) + len(appendSQLiteVarint(nil, int64(len(types)+2)))
+	}
+	record := appendSQLiteVarint(nil, int64(headerSize))
+	record = append(record, types...)
+	return append(record, body...), nil
+}
+
+// appendSQLiteVarint appends v as a SQLite varint: big-endian groups of 7
+// bits with the high bit set on all but the last, the ninth byte holding 8
+// bits.
+func appendSQLiteVarint(buf []byte, v int64) []byte {
+	u := uint64(v)
+	if u > 1<<56-1 {
+		var out [9]byte
+		out[8] = byte(u)
+		u >>= 8
+		for i := 7; i >= 0; i-- {
+			out[i] = byte(u&0x7f) | 0x80
+			u >>= 7
+		}
+		return append(buf, out[:]...)
+	}
+	var out [8]byte
+	n := 0
+	for {
+		out[7-n] = byte(u & 0x7f)
+		n++
+		u >>= 7
+		if u == 0 {
+			break
+		}
+	}
+	for i := 8 - n; i < 7; i++ {
+		out[i] |= 0x80
+	}
+	return append(buf, out[8-n:]...)
+}
@@ -0,0 +1,269 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// the tables and indexes of the files written by the SQLiteStatRecorder
+const (
+	sqliteOpsTable = `CREATE TABLE ops(id INTEGER PRIMARY KEY, position INTEGER, played_at TEXT, ` +
+		`connection_num INTEGER, op TEXT, command TEXT, ns TEXT, latency_us INTEGER, ` +
+		`playbacklag_us INTEGER, nreturned INTEGER, error_count INTEGER, msg TEXT)`
+	sqliteErrorsTable = `CREATE TABLE errors(id INTEGER PRIMARY KEY, op_id INTEGER, error TEXT)`
+)
+
+// sqliteTimeFormat is the format of the times of the SQLite files, which the
+// date and time functions of SQLite accept.
+const sqliteTimeFormat = "2006-01-02 15:04:05.000000"
+
+// SQLiteStatRecorder writes the stats into a SQLite database at the path of
+// --report, with a row per op in the ops table and a row per error in the
+// errors table, which references the op by its id. The ops are indexed by
+// command, namespace and latency, and the errors by op.
+//
+// The rows are written as the stats are recorded, while the indexes are
+// written once playback finishes, from the indexed values of each op kept
+// until then. The file is committed when it is created and every time it is
+// flushed, so that it can be queried during playback, or after playback was
+// killed, as a database of the rows recorded until then without the
+// indexes.
+type SQLiteStatRecorder struct {
+	file   *os.File
+	db     *sqliteFile
+	ops    *sqliteTable
+	errors *sqliteTable
+
+	opCount    int64
+	errorCount int64
+
+	// the indexed values of each op, the strings numbered in order of
+	// appearance, and the op of each error
+	strings    map[string]uint32
+	names      []string
+	commands   []uint32
+	namespaces []uint32
+	latencies  []int64
+	errorOps   []int64
+}
+
+func newSQLiteStatRecorder(opts StatOptions, out io.WriteCloser) (StatRecorder, error) {
+	file, ok := out.(*os.File)
+	if opts.Report == "" || !ok {
+		return nil, fmt.Errorf("--report, the SQLite file to write, is required when using --collect sqlite")
+	}
+	db := newSQLiteFile(file)
+	ssr := &SQLiteStatRecorder{
+		file:    file,
+		db:      db,
+		ops:     &sqliteTable{db: db},
+		errors:  &sqliteTable{db: db},
+		strings: map[string]uint32{},
+		// the number 0 stands for NULL
+		names: []string{""},
+	}
+	if err := ssr.Flush(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error writing SQLite file: %v", err)
+	}
+	return ssr, nil
+}
+
+// RecordStat writes the rows of the stat
+func (ssr *SQLiteStatRecorder) RecordStat(stat *OpStat) {
+	if stat == nil {
+		return
+	}
+	if err := ssr.recordStat(stat); err != nil {
+		toolDebugLogger.Logvf(Always, "error recording stat: %v", err)
+	}
+}
+
+func (ssr *SQLiteStatRecorder) recordStat(stat *OpStat) error {
+	ssr.opCount++
+	id := ssr.opCount
+	var playedAt interface{}
+	if stat.PlayedAt != nil {
+		playedAt = stat.PlayedAt.UTC().Format(sqliteTimeFormat)
+	}
+	record, err := sqliteRecord(
+		nil, // the id is the rowid
+		stat.Order,
+		playedAt,
+		stat.ConnectionNum,
+		sqliteText(stat.OpType),
+		sqliteText(stat.Command),
+		sqliteText(stat.Ns),
+		sqliteInteger(stat.LatencyMicros),
+		stat.PlaybackLagMicros,
+		int64(stat.NumReturned),
+		int64(len(stat.Errors)),
+		sqliteText(stat.Message),
+	)
+	if err != nil {
+		return err
+	}
+	if err := ssr.ops.add(id, record); err != nil {
+		return err
+	}
+	ssr.commands = append(ssr.commands, ssr.stringNumber(stat.Command))
+	ssr.namespaces = append(ssr.namespaces, ssr.stringNumber(stat.Ns))
+	ssr.latencies = append(ssr.latencies, stat.LatencyMicros)
+
+	for _, opErr := range stat.Errors {
+		ssr.errorCount++
+		record, err := sqliteRecord(nil, id, opErr.Error())
+		if err != nil {
+			return err
+		}
+		if err := ssr.errors.add(ssr.errorCount, record); err != nil {
+			return err
+		}
+		ssr.errorOps = append(ssr.errorOps, id)
+	}
+	return nil
+}
+
+// stringNumber returns the number of s among the indexed strings, 0 if it
+// is empty and so stored as NULL.
+func (ssr *SQLiteStatRecorder) stringNumber(s string) uint32 {
+	if s == "" {
+		return 0
+	}
+	number, ok := ssr.strings[s]
+	if !ok {
+		number = uint32(len(ssr.names))
+		ssr.strings[s] = number
+		ssr.names = append(ssr.names, s)
+	}
+	return number
+}
+
+// sqliteText returns s as stored in the SQLite files, where empty strings
+// are NULL.
+func sqliteText(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// sqliteInteger returns n as stored in the SQLite files, where zero
+// latencies, those of ops which received no reply, are NULL.
+func sqliteInteger(n int64) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+// Close writes the b-trees of the tables and indexes and the schema, and
+// closes the SQLite file
+func (ssr *SQLiteStatRecorder) Close() error {
+	err := ssr.finish()
+	if closeErr := ssr.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Flush commits the rows recorded so far, without the indexes.
+func (ssr *SQLiteStatRecorder) Flush() error {
+	schema, err := ssr.tableSchema()
+	if err != nil {
+		return err
+	}
+	return ssr.db.commit(schema)
+}
+
+// tableSchema writes the b-trees of the tables, returning their entries of
+// the schema.
+func (ssr *SQLiteStatRecorder) tableSchema() ([]sqliteSchemaEntry, error) {
+	schema := []sqliteSchemaEntry{
+		{kind: "table", name: "ops", table: "ops", sql: sqliteOpsTable},
+		{kind: "table", name: "errors", table: "errors", sql: sqliteErrorsTable},
+	}
+	var err error
+	if schema[0].rootPage, err = ssr.ops.finish(); err != nil {
+		return nil, err
+	}
+	if schema[1].rootPage, err = ssr.errors.finish(); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+func (ssr *SQLiteStatRecorder) finish() error {
+	schema, err := ssr.tableSchema()
+	if err != nil {
+		return err
+	}
+
+	// each index holds the indexed value and the id of each row, sorted by
+	// value then id, NULL sorting first
+	indexes := []struct {
+		name, table, column string
+		rows                int64
+		less                func(a, b int64) bool
+		value               func(id int64) interface{}
+	}{
+		{
+			name: "ops_command", table: "ops", column: "command", rows: ssr.opCount,
+			less:  func(a, b int64) bool { return ssr.names[ssr.commands[a-1]] < ssr.names[ssr.commands[b-1]] },
+			value: func(id int64) interface{} { return sqliteText(ssr.names[ssr.commands[id-1]]) },
+		},
+		{
+			name: "ops_ns", table: "ops", column: "ns", rows: ssr.opCount,
+			less:  func(a, b int64) bool { return ssr.names[ssr.namespaces[a-1]] < ssr.names[ssr.namespaces[b-1]] },
+			value: func(id int64) interface{} { return sqliteText(ssr.names[ssr.namespaces[id-1]]) },
+		},
+		{
+			name: "ops_latency_us", table: "ops", column: "latency_us", rows: ssr.opCount,
+			less:  func(a, b int64) bool { return ssr.latencies[a-1] < ssr.latencies[b-1] },
+			value: func(id int64) interface{} { return sqliteInteger(ssr.latencies[id-1]) },
+		},
+		{
+			name: "errors_op_id", table: "errors", column: "op_id", rows: ssr.errorCount,
+			less:  func(a, b int64) bool { return ssr.errorOps[a-1] < ssr.errorOps[b-1] },
+			value: func(id int64) interface{} { return ssr.errorOps[id-1] },
+		},
+	}
+	for _, index := range indexes {
+		ids := make([]int64, index.rows)
+		for i := range ids {
+			ids[i] = int64(i + 1)
+		}
+		// the ids are in order, so a stable sort orders equal values by id
+		sort.SliceStable(ids, func(i, j int) bool { return index.less(ids[i], ids[j]) })
+		tree := &sqliteIndex{db: ssr.db}
+		for _, id := range ids {
+			record, err := sqliteRecord(index.value(id), id)
+			if err != nil {
+				return err
+			}
+			if err := tree.add(record); err != nil {
+				return err
+			}
+		}
+		root, err := tree.finish()
+		if err != nil {
+			return err
+		}
+		schema = append(schema, sqliteSchemaEntry{
+			kind:     "index",
+			name:     index.name,
+			table:    index.table,
+			rootPage: root,
+			sql:      fmt.Sprintf("CREATE INDEX %v ON %v(%v)", index.name, index.table, index.column),
+		})
+	}
+	return ssr.db.commit(schema)
+}
@@ -0,0 +1,510 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSQLiteVarint(t *testing.T) {
+	type testCase struct {
+		value    int64
+		expected []byte
+	}
+	cases := []testCase{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x81, 0x00}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x81, 0x80, 0x00}},
+		{-1, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %v", c.value)
+		if out := appendSQLiteVarint(nil, c.value); !bytes.Equal(out, c.expected) {
+			t.Errorf("expected %x, got %x", c.expected, out)
+		}
+	}
+}
+
+func TestSQLiteRecord(t *testing.T) {
+	record, err := sqliteRecord(nil, int64(1), int64(300), "ab", 1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the size of the header, the serial types of NULL, the integer 1, a
+	// 2-byte integer, a 2-byte string and a float, then the values
+	expected := []byte{6, 0, 9, 2, 17, 7, 0x01, 0x2c, 'a', 'b', 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(record, expected) {
+		t.Errorf("expected %x, got %x", expected, record)
+	}
+	if _, err := sqliteRecord(int32(1)); err == nil {
+		t.Errorf("expected an error for an unsupported value")
+	}
+}
+
+// sqliteTestFile reads back the SQLite files written, following the file
+// format rather than the code writing them. It fails the test on anything
+// SQLite would report as corrupt, and counts the pages it reads, each of
+// which must be read once.
+type sqliteTestFile struct {
+	t        *testing.T
+	contents []byte
+	pageSize int
+	seen     map[uint32]bool
+}
+
+// readSQLiteTestFile reads the file at path and checks its header.
+func readSQLiteTestFile(t *testing.T, path string) *sqliteTestFile {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contents) < sqliteHeaderSize || !bytes.HasPrefix(contents, []byte("SQLite format 3\x00")) {
+		t.Fatalf("expected a SQLite header")
+	}
+	db := &sqliteTestFile{t: t, contents: contents, pageSize: int(binary.BigEndian.Uint16(contents[16:])), seen: map[uint32]bool{}}
+	if db.pageSize == 1 {
+		db.pageSize = 65536
+	}
+	if db.pageSize < 512 || db.pageSize&(db.pageSize-1) != 0 || contents[20] != 0 {
+		t.Fatalf("expected a page size which is a power of two without reserved bytes, got %v and %v", db.pageSize, contents[20])
+	}
+	if pages := binary.BigEndian.Uint32(contents[28:]); int(pages)*db.pageSize != len(contents) {
+		t.Fatalf("expected the header to count the %v pages, got %v", len(contents)/db.pageSize, pages)
+	}
+	// the version valid for matches the change counter, or SQLite ignores
+	// the size of the database in the header
+	if binary.BigEndian.Uint32(contents[24:]) != binary.BigEndian.Uint32(contents[92:]) {
+		t.Errorf("expected the header to be valid for the current change counter")
+	}
+	// the text encoding is UTF-8
+	if encoding := binary.BigEndian.Uint32(contents[56:]); encoding != 1 {
+		t.Errorf("expected text encoded as UTF-8, got %v", encoding)
+	}
+	return db
+}
+
+// page returns the page numbered pgno, marking it as read.
+func (db *sqliteTestFile) page(pgno uint32) []byte {
+	if pgno == 0 || int(pgno)*db.pageSize > len(db.contents) {
+		db.t.Fatalf("page %v out of the file", pgno)
+	}
+	if db.seen[pgno] {
+		db.t.Fatalf("page %v used twice", pgno)
+	}
+	db.seen[pgno] = true
+	return db.contents[int(pgno-1)*db.pageSize : int(pgno)*db.pageSize]
+}
+
+// checkPages checks that every page of the file was read, apart from the
+// page of the lock bytes, once the b-trees and the freelist have been.
+func (db *sqliteTestFile) checkPages() {
+	pages := uint32(len(db.contents) / db.pageSize)
+	for pgno := uint32(1); pgno <= pages; pgno++ {
+		if !db.seen[pgno] && pgno != 1<<30/uint32(db.pageSize)+1 {
+			db.t.Errorf("page %v of %v is neither used nor free", pgno, pages)
+			return
+		}
+	}
+}
+
+// readFreelist reads the trunk and leaf pages of the freelist, returning how
+// many there are.
+func (db *sqliteTestFile) readFreelist() int {
+	count := 0
+	for trunk := binary.BigEndian.Uint32(db.contents[32:]); trunk != 0; {
+		page := db.page(trunk)
+		count++
+		leaves := int(binary.BigEndian.Uint32(page[4:]))
+		if leaves > db.pageSize/4-2 {
+			db.t.Fatalf("freelist trunk %v lists %v leaves", trunk, leaves)
+		}
+		for i := 0; i < leaves; i++ {
+			db.page(binary.BigEndian.Uint32(page[8+4*i:]))
+			count++
+		}
+		trunk = binary.BigEndian.Uint32(page)
+	}
+	if expected := int(binary.BigEndian.Uint32(db.contents[36:])); count != expected {
+		db.t.Errorf("expected the freelist to hold %v pages, got %v", expected, count)
+	}
+	return count
+}
+
+// readSQLiteTestVarint returns the varint at the start of buf and its length.
+func readSQLiteTestVarint(buf []byte) (int64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		v = v<<7 | uint64(buf[i]&0x7f)
+		if buf[i]&0x80 == 0 {
+			return int64(v), i + 1
+		}
+	}
+	return int64(v<<8 | uint64(buf[8])), 9
+}
+
+// payload returns the payload of size bytes of the cell starting at cell,
+// following its overflow pages.
+func (db *sqliteTestFile) payload(cell []byte, size int64, index bool) []byte {
+	usable := db.pageSize
+	maxLocal := usable - 35
+	if index {
+		maxLocal = (usable-12)*64/255 - 23
+	}
+	if size <= int64(maxLocal) {
+		return cell[:size]
+	}
+	minLocal := (usable-12)*32/255 - 23
+	local := minLocal + int((size-int64(minLocal))%int64(usable-4))
+	if local > maxLocal {
+		local = minLocal
+	}
+	payload := append([]byte{}, cell[:local]...)
+	for next := binary.BigEndian.Uint32(cell[local:]); int64(len(payload)) < size; {
+		if next == 0 {
+			db.t.Fatalf("payload of %v bytes cut at %v bytes", size, len(payload))
+		}
+		page := db.page(next)
+		n := size - int64(len(payload))
+		if n > int64(usable-4) {
+			n = int64(usable - 4)
+		}
+		payload = append(payload, page[4:4+n]...)
+		next = binary.BigEndian.Uint32(page)
+	}
+	return payload
+}
+
+// record decodes the values of a record, as nil, int64, float64 or string.
+func (db *sqliteTestFile) record(payload []byte) []interface{} {
+	headerSize, n := readSQLiteTestVarint(payload)
+	body := payload[headerSize:]
+	var values []interface{}
+	for pos := n; pos < int(headerSize); {
+		serialType, n := readSQLiteTestVarint(payload[pos:])
+		pos += n
+		var size int
+		switch {
+		case serialType == 0 || serialType == 8 || serialType == 9:
+			values = append(values, map[int64]interface{}{0: nil, 8: int64(0), 9: int64(1)}[serialType])
+		case serialType >= 1 && serialType <= 6:
+			size = []int{1, 2, 3, 4, 6, 8}[serialType-1]
+			v := int64(int8(body[0]))
+			for _, b := range body[1:size] {
+				v = v<<8 | int64(b)
+			}
+			values = append(values, v)
+		case serialType == 7:
+			size = 8
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(body)))
+		case serialType >= 13 && serialType%2 == 1:
+			size = int(serialType-13) / 2
+			values = append(values, string(body[:size]))
+		default:
+			db.t.Fatalf("unexpected serial type %v", serialType)
+		}
+		if size > len(body) {
+			db.t.Fatalf("record cut in its values")
+		}
+		body = body[size:]
+	}
+	if len(body) != 0 {
+		db.t.Errorf("expected the record to end with its values, got %v more bytes", len(body))
+	}
+	return values
+}
+
+// pageCells returns the type of the b-tree page pgno, its cells and its
+// rightmost pointer.
+func (db *sqliteTestFile) pageCells(pgno uint32) (byte, [][]byte, uint32) {
+	page := db.page(pgno)
+	header := page
+	if pgno == 1 {
+		header = page[sqliteHeaderSize:]
+	}
+	kind := header[0]
+	headerSize := 8
+	var rightmost uint32
+	switch kind {
+	case sqliteLeafTable, sqliteLeafIndex:
+	case sqliteInteriorTable, sqliteInteriorIndex:
+		headerSize = 12
+		rightmost = binary.BigEndian.Uint32(header[8:])
+	default:
+		db.t.Fatalf("page %v is not a b-tree page: %v", pgno, kind)
+	}
+	cells := make([][]byte, binary.BigEndian.Uint16(header[3:]))
+	for i := range cells {
+		offset := int(binary.BigEndian.Uint16(header[headerSize+2*i:]))
+		if offset < len(page)-len(header)+headerSize+2*len(cells) || offset >= len(page) {
+			db.t.Fatalf("cell %v of page %v at offset %v", i, pgno, offset)
+		}
+		cells[i] = page[offset:]
+	}
+	return kind, cells, rightmost
+}
+
+// sqliteTestRow is a row of a table, with its rowid.
+type sqliteTestRow struct {
+	rowid  int64
+	values []interface{}
+}
+
+// tableRows returns the rows of the table b-tree rooted at root, checking
+// that their rowids increase and are bounded by the keys of the interior
+// pages.
+func (db *sqliteTestFile) tableRows(root uint32) []sqliteTestRow {
+	var rows []sqliteTestRow
+	var walk func(pgno uint32, max int64)
+	walk = func(pgno uint32, max int64) {
+		kind, cells, rightmost := db.pageCells(pgno)
+		for _, cell := range cells {
+			if kind == sqliteInteriorTable {
+				key, _ := readSQLiteTestVarint(cell[4:])
+				walk(binary.BigEndian.Uint32(cell), key)
+				continue
+			}
+			if kind != sqliteLeafTable {
+				db.t.Fatalf("page %v of a table is of type %v", pgno, kind)
+			}
+			size, n := readSQLiteTestVarint(cell)
+			rowid, m := readSQLiteTestVarint(cell[n:])
+			if len(rows) > 0 && rowid <= rows[len(rows)-1].rowid || rowid > max {
+				db.t.Fatalf("rowid %v out of order on page %v", rowid, pgno)
+			}
+			rows = append(rows, sqliteTestRow{rowid, db.record(db.payload(cell[n+m:], size, false))})
+		}
+		if kind == sqliteInteriorTable {
+			walk(rightmost, max)
+		}
+	}
+	walk(root, math.MaxInt64)
+	return rows
+}
+
+// indexEntries returns the entries of the index b-tree rooted at root, in
+// the order of the b-tree.
+func (db *sqliteTestFile) indexEntries(root uint32) [][]interface{} {
+	var entries [][]interface{}
+	var walk func(pgno uint32)
+	walk = func(pgno uint32) {
+		kind, cells, rightmost := db.pageCells(pgno)
+		if kind != sqliteLeafIndex && kind != sqliteInteriorIndex {
+			db.t.Fatalf("page %v of an index is of type %v", pgno, kind)
+		}
+		for _, cell := range cells {
+			if kind == sqliteInteriorIndex {
+				walk(binary.BigEndian.Uint32(cell))
+				cell = cell[4:]
+			}
+			size, n := readSQLiteTestVarint(cell)
+			entries = append(entries, db.record(db.payload(cell[n:], size, true)))
+		}
+		if kind == sqliteInteriorIndex {
+			walk(rightmost)
+		}
+	}
+	walk(root)
+	return entries
+}
+
+// sqliteTestDatabase is the contents of a SQLite file: the rows of its
+// tables and the entries of its indexes, by name.
+type sqliteTestDatabase struct {
+	tables  map[string][]sqliteTestRow
+	indexes map[string][][]interface{}
+	sql     map[string]string
+}
+
+// readSQLiteTestDatabase reads the schema of the file at path, and the
+// tables and indexes it describes, checking that every page of the file
+// is used once.
+func readSQLiteTestDatabase(t *testing.T, path string) *sqliteTestDatabase {
+	db := readSQLiteTestFile(t, path)
+	database := &sqliteTestDatabase{tables: map[string][]sqliteTestRow{}, indexes: map[string][][]interface{}{}, sql: map[string]string{}}
+	for _, row := range db.tableRows(1) {
+		if len(row.values) != 5 {
+			t.Fatalf("expected 5 columns in the schema, got %v", row.values)
+		}
+		kind, _ := row.values[0].(string)
+		name, _ := row.values[1].(string)
+		root, _ := row.values[3].(int64)
+		database.sql[name], _ = row.values[4].(string)
+		switch kind {
+		case "table":
+			database.tables[name] = db.tableRows(uint32(root))
+		case "index":
+			database.indexes[name] = db.indexEntries(uint32(root))
+		default:
+			t.Fatalf("unexpected schema entry %v", row.values)
+		}
+	}
+	db.readFreelist()
+	db.checkPages()
+	return database
+}
+
+// checkIndex checks that the entries of an index are the value of column of
+// each row of the table followed by its rowid, sorted by value then rowid.
+func (database *sqliteTestDatabase) checkIndex(t *testing.T, index, table string, column int) {
+	entries := database.indexes[index]
+	var expected [][]interface{}
+	for _, row := range database.tables[table] {
+		expected = append(expected, []interface{}{row.values[column], row.rowid})
+	}
+	less := func(a, b []interface{}) bool {
+		// NULL sorts first, then integers, then text
+		rank := func(v interface{}) int {
+			switch v.(type) {
+			case nil:
+				return 0
+			case int64:
+				return 1
+			}
+			return 2
+		}
+		if rank(a[0]) != rank(b[0]) {
+			return rank(a[0]) < rank(b[0])
+		}
+		switch v := a[0].(type) {
+		case int64:
+			if v != b[0].(int64) {
+				return v < b[0].(int64)
+			}
+		case string:
+			if v != b[0].(string) {
+				return v < b[0].(string)
+			}
+		}
+		return a[1].(int64) < b[1].(int64)
+	}
+	sort.SliceStable(expected, func(i, j int) bool { return less(expected[i], expected[j]) })
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected index %v to hold %v sorted entries, got %v", index, len(expected), len(entries))
+	}
+}
+
+// countRows returns the number of rows of table whose column matches.
+func (database *sqliteTestDatabase) countRows(table string, column int, matches func(interface{}) bool) int {
+	count := 0
+	for _, row := range database.tables[table] {
+		if matches(row.values[column]) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestSQLiteStatRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.db")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := newSQLiteStatRecorder(StatOptions{Report: path}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// checkRows checks the number of rows of the tables, and that the rowids
+	// are numbered from 1
+	checkRows := func(database *sqliteTestDatabase, ops, errors int) {
+		for table, expected := range map[string]int{"ops": ops, "errors": errors} {
+			rows := database.tables[table]
+			if len(rows) != expected {
+				t.Errorf("expected %v rows in %v, got %v", expected, table, len(rows))
+				continue
+			}
+			for i, row := range rows {
+				if row.rowid != int64(i+1) {
+					t.Errorf("expected row %v of %v to have rowid %v, got %v", i, table, i+1, row.rowid)
+					break
+				}
+			}
+		}
+	}
+
+	// the file is valid as soon as it is created
+	database := readSQLiteTestDatabase(t, path)
+	checkRows(database, 0, 0)
+	if database.sql["ops"] != sqliteOpsTable || database.sql["errors"] != sqliteErrorsTable {
+		t.Errorf("expected the schema to create the tables, got %v", database.sql)
+	}
+
+	// enough ops for the b-trees to have interior pages, with messages
+	// long enough to spill to overflow pages
+	playedAt := time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 20000; i++ {
+		stat := &OpStat{
+			Order:         int64(i),
+			OpType:        "op_msg",
+			Command:       []string{"find", "insert", "update"}[i%3],
+			Ns:            fmt.Sprintf("test.c%v", i%5),
+			LatencyMicros: int64(i%1000 + 1),
+			PlayedAt:      &playedAt,
+		}
+		if i%100 == 0 {
+			stat.Errors = []error{fmt.Errorf("error %v", i)}
+			stat.Message = strings.Repeat("m", 5000)
+		}
+		recorder.RecordStat(stat)
+		// and every time it is flushed
+		if i == 9999 {
+			if err := recorder.(StatFlusher).Flush(); err != nil {
+				t.Fatal(err)
+			}
+			checkRows(readSQLiteTestDatabase(t, path), 10000, 100)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	database = readSQLiteTestDatabase(t, path)
+	checkRows(database, 20000, 200)
+	expected := []interface{}{nil, int64(0), "2020-05-20 12:00:00.000000", int64(0), "op_msg", "find", "test.c0",
+		int64(1), int64(0), int64(0), int64(1), strings.Repeat("m", 5000)}
+	if row := database.tables["ops"][0].values; !reflect.DeepEqual(row, expected) {
+		t.Errorf("expected the first op to be %v, got %v", expected, row)
+	}
+	expected = []interface{}{nil, int64(10001), "error 10000"}
+	if row := database.tables["errors"][100].values; !reflect.DeepEqual(row, expected) {
+		t.Errorf("expected the 101st error to be %v, got %v", expected, row)
+	}
+	if errors := database.countRows("errors", 1, func(v interface{}) bool { return v == int64(101) }); errors != 1 {
+		t.Errorf("expected an error of op 101, got %v", errors)
+	}
+	if finds := database.countRows("ops", 5, func(v interface{}) bool { return v == "find" }); finds != 6667 {
+		t.Errorf("expected 6667 finds, got %v", finds)
+	}
+	if slow := database.countRows("ops", 7, func(v interface{}) bool { return v.(int64) > 900 }); slow != 2000 {
+		t.Errorf("expected 2000 ops slower than 900us, got %v", slow)
+	}
+	database.checkIndex(t, "ops_command", "ops", 5)
+	database.checkIndex(t, "ops_ns", "ops", 6)
+	database.checkIndex(t, "ops_latency_us", "ops", 7)
+	database.checkIndex(t, "errors_op_id", "errors", 1)
+	if sql := database.sql["ops_latency_us"]; sql != "CREATE INDEX ops_latency_us ON ops(latency_us)" {
+		t.Errorf("expected the schema to create the index, got %q", sql)
+	}
+}
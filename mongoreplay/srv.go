@@ -0,0 +1,198 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	srvScheme      = "mongodb+srv://"
+	standardScheme = "mongodb://"
+)
+
+// srvTXTOptions are the connection string options which may be set by the
+// TXT record of a mongodb+srv:// host.
+var srvTXTOptions = map[string]bool{
+	"authSource": true,
+	"replicaSet": true,
+}
+
+// lookupSRV and lookupTXT resolve the DNS records of the hosts of
+// mongodb+srv:// connection strings.
+var (
+	lookupSRV = net.LookupSRV
+	lookupTXT = net.LookupTXT
+)
+
+// srvURI is a mongodb+srv:// connection string split into its parts.
+type srvURI struct {
+	credentials string
+	host        string
+	path        string
+	options     [][2]string
+}
+
+// parseSRV splits a mongodb+srv:// connection string into its parts,
+// checking that it names a single host, without a port, of at least three
+// parts, without looking the host up.
+func parseSRV(uri string) (*srvURI, error) {
+	rest := strings.TrimPrefix(uri, srvScheme)
+	srv := &srvURI{}
+	if i := strings.Index(rest, "?"); i >= 0 {
+		rest, srv.options = rest[:i], splitConnectionOptions(rest[i+1:])
+	}
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest, srv.path = rest[:i], rest[i:]
+	}
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		srv.credentials, rest = rest[:i+1], rest[i+1:]
+	}
+	srv.host = rest
+	switch {
+	case strings.Contains(srv.host, ","):
+		return nil, fmt.Errorf("a mongodb+srv:// connection string must name a single host")
+	case strings.Contains(srv.host, ":"):
+		return nil, fmt.Errorf("the host of a mongodb+srv:// connection string can't have a port")
+	case strings.Count(srv.host, ".") < 2:
+		return nil, fmt.Errorf("the host of a mongodb+srv:// connection string must have at least three parts, e.g. cluster0.example.net")
+	}
+	return srv, nil
+}
+
+// resolveSRV returns the mongodb:// connection string equivalent to a
+// mongodb+srv:// one, as resolved by resolve.
+func resolveSRV(uri string) (string, error) {
+	srv, err := parseSRV(uri)
+	if err != nil {
+		return "", err
+	}
+	return srv.resolve()
+}
+
+// resolve returns the mongodb:// connection string equivalent to srv. Its
+// servers are the targets of the SRV records of _mongodb._tcp.<host>, which
+// must be in the domain of host, and it takes the authSource and replicaSet
+// options of the TXT record of host unless they are given in the connection
+// string. It connects using TLS unless the connection string sets
+// tls=false.
+func (srv *srvURI) resolve() (string, error) {
+	host := srv.host
+	domain := host[strings.Index(host, "."):]
+	_, records, err := lookupSRV("mongodb", "tcp", host)
+	if err != nil {
+		return "", fmt.Errorf("error looking up the SRV records of %v: %v", host, err)
+	}
+	if len(records) == 0 {
+		return "", fmt.Errorf("no SRV records found for %v", host)
+	}
+	addrs := make([]string, len(records))
+	for i, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		if !strings.HasSuffix(target, domain) {
+			return "", fmt.Errorf("SRV record %v of %v is not in the domain %v", target, host, domain[1:])
+		}
+		addrs[i] = net.JoinHostPort(target, strconv.Itoa(int(record.Port)))
+	}
+
+	options := append([][2]string{}, srv.options...)
+	given := map[string]bool{}
+	for _, option := range options {
+		given[option[0]] = true
+	}
+	txt, err := lookupTXT(host)
+	if err != nil {
+		// a missing TXT record only means no options are set by DNS
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			return "", fmt.Errorf("error looking up the TXT record of %v: %v", host, err)
+		}
+	}
+	if len(txt) > 1 {
+		return "", fmt.Errorf("%v has more than one TXT record", host)
+	}
+	if len(txt) == 1 {
+		for _, option := range splitConnectionOptions(txt[0]) {
+			if !srvTXTOptions[option[0]] {
+				return "", fmt.Errorf("option %v of the TXT record of %v is not allowed", option[0], host)
+			}
+			if !given[option[0]] {
+				options = append(options, option)
+			}
+		}
+	}
+	return srv.connectionString(addrs, options), nil
+}
+
+// connectionString returns the mongodb:// connection string of srv
+// connecting to addrs with options, which use TLS unless they set the tls
+// or ssl option themselves.
+func (srv *srvURI) connectionString(addrs []string, options [][2]string) string {
+	pairs := make([]string, 0, len(options)+1)
+	defaultTLS := true
+	for _, option := range options {
+		pairs = append(pairs, option[0]+"="+option[1])
+		if option[0] == "tls" || option[0] == "ssl" {
+			defaultTLS = false
+		}
+	}
+	if defaultTLS {
+		pairs = append(pairs, "tls=true")
+	}
+	path := srv.path
+	if path == "" {
+		path = "/"
+	}
+	return standardScheme + srv.credentials + strings.Join(addrs, ",") + path + "?" + strings.Join(pairs, "&")
+}
+
+// extractTLSOption removes the tls and ssl options from a connection string,
+// which mgo doesn't support, returning whether they ask for TLS, or nil if
+// neither is set.
+func extractTLSOption(uri string) (string, *bool, error) {
+	i := strings.Index(uri, "?")
+	if i < 0 {
+		return uri, nil, nil
+	}
+	var useTLS *bool
+	var kept []string
+	for _, option := range splitConnectionOptions(uri[i+1:]) {
+		if option[0] != "tls" && option[0] != "ssl" {
+			kept = append(kept, option[0]+"="+option[1])
+			continue
+		}
+		value, err := strconv.ParseBool(option[1])
+		if err != nil {
+			return "", nil, fmt.Errorf("bad value for %v: %v", option[0], option[1])
+		}
+		if useTLS != nil && *useTLS != value {
+			return "", nil, fmt.Errorf("the tls and ssl options of the connection string conflict")
+		}
+		useTLS = &value
+	}
+	uri = uri[:i]
+	if len(kept) > 0 {
+		uri += "?" + strings.Join(kept, "&")
+	}
+	return uri, useTLS, nil
+}
+
+// splitConnectionOptions splits the options of a connection string into
+// their names and values.
+func splitConnectionOptions(query string) [][2]string {
+	var options [][2]string
+	for _, pair := range strings.FieldsFunc(query, func(r rune) bool { return r == '&' || r == ';' }) {
+		option := [2]string{pair, ""}
+		if i := strings.Index(pair, "="); i >= 0 {
+			option = [2]string{pair[:i], pair[i+1:]}
+		}
+		options = append(options, option)
+	}
+	return options
+}
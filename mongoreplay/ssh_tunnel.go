@@ -0,0 +1,441 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// defaultSSHPort is the port of the jump host of --sshTunnel when it names
+// none.
+const defaultSSHPort = "22"
+
+// defaultIdentityFiles are the private keys, relative to ~/.ssh, tried when
+// --sshIdentityFile is not set, like ssh does.
+var defaultIdentityFiles = []string{"id_rsa", "id_ecdsa", "id_dsa"}
+
+// sshTunnel opens the connections to the servers through the jump host of
+// --sshTunnel, which forwards each of them to its server. The connections
+// are forwarded over a single SSH connection, opened with the first of them
+// and reopened if it is lost. Forwarded connections don't support deadlines,
+// so they are enforced by deadlineConn.
+type sshTunnel struct {
+	addr   string
+	config *ssh.ClientConfig
+
+	// hostMap maps the servers to the addresses the jump host forwards
+	// their connections to, when it knows them by other names.
+	hostMap map[string]string
+	// timeout bounds the connection to the jump host, dialTimeout if not
+	// set
+	timeout time.Duration
+
+	mutex  sync.Mutex
+	client *ssh.Client
+}
+
+// parseSSHTunnel parses the user@jumphost[:port] of --sshTunnel, and the
+// host:port=forward:port mappings of --sshHostMap. The user authenticates
+// with the keys of ssh-agent, if it runs, and with those of identityFile,
+// or of the default identity files if it is empty. The key of the jump
+// host must be in the known hosts file, ~/.ssh/known_hosts if knownHostsFile
+// is empty.
+func parseSSHTunnel(value, identityFile, knownHostsFile string, hostMap []string) (*sshTunnel, error) {
+	user, host := "", value
+	if i := strings.LastIndex(value, "@"); i >= 0 {
+		user, host = value[:i], value[i+1:]
+	}
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	if user == "" || host == "" {
+		return nil, fmt.Errorf("'%v' is not user@jumphost[:port]", value)
+	}
+	tunnel := &sshTunnel{addr: host, hostMap: map[string]string{}}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		tunnel.addr = net.JoinHostPort(strings.Trim(host, "[]"), defaultSSHPort)
+	}
+	for _, mapping := range hostMap {
+		i := strings.Index(mapping, "=")
+		if i <= 0 || i == len(mapping)-1 {
+			return nil, fmt.Errorf("'%v' is not <host:port>=<host:port>", mapping)
+		}
+		server := normalizeAddr(mapping[:i], "")
+		_, port, _ := net.SplitHostPort(server)
+		tunnel.hostMap[server] = normalizeAddr(mapping[i+1:], port)
+	}
+
+	auth, err := sshAuthMethod(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	}
+	hosts, err := loadKnownHosts(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	tunnel.config = &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hosts.check,
+	}
+	return tunnel, nil
+}
+
+// sshAuthMethod returns the public key authentication offering the keys of
+// ssh-agent and those of identityFile, or of the default identity files if
+// it is empty.
+func sshAuthMethod(identityFile string) (ssh.AuthMethod, error) {
+	var signers []ssh.Signer
+	var keyring agent.Agent
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			keyring = agent.NewClient(conn)
+		}
+	}
+	if identityFile != "" {
+		signer, err := loadIdentityFile(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	} else {
+		// the default identity files which don't exist, or which can't be
+		// used, are skipped like ssh does
+		for _, name := range defaultIdentityFiles {
+			signer, err := loadIdentityFile(filepath.Join(os.Getenv("HOME"), ".ssh", name))
+			if err == nil {
+				signers = append(signers, signer)
+			}
+		}
+	}
+	if keyring == nil && len(signers) == 0 {
+		return nil, fmt.Errorf("no SSH keys to authenticate with; start ssh-agent or set --sshIdentityFile")
+	}
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		if keyring == nil {
+			return signers, nil
+		}
+		agentSigners, err := keyring.Signers()
+		if err != nil {
+			return signers, nil
+		}
+		return append(agentSigners, signers...), nil
+	}), nil
+}
+
+// loadIdentityFile loads the PEM private key of an identity file. Encrypted
+// keys must be added to ssh-agent instead, as there is no way to prompt for
+// their passphrase.
+func loadIdentityFile(path string) (ssh.Signer, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(contents); block != nil && x509.IsEncryptedPEMBlock(block) {
+		return nil, fmt.Errorf("%v is encrypted; add it to ssh-agent instead", path)
+	}
+	signer, err := ssh.ParsePrivateKey(contents)
+	if err != nil {
+		return nil, fmt.Errorf("error loading %v: %v", path, err)
+	}
+	return signer, nil
+}
+
+// knownHost is an entry of a known hosts file.
+type knownHost struct {
+	marker   string
+	patterns []string
+	key      ssh.PublicKey
+}
+
+// knownHosts holds the entries of a known hosts file, which the keys of the
+// jump hosts are checked against.
+type knownHosts struct {
+	path    string
+	entries []knownHost
+}
+
+// loadKnownHosts loads the entries of the known hosts file at path.
+func loadKnownHosts(path string) (*knownHosts, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading known hosts: %v", err)
+	}
+	hosts := &knownHosts{path: path}
+	for {
+		marker, patterns, key, _, rest, err := ssh.ParseKnownHosts(contents)
+		if err == io.EOF {
+			return hosts, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading known hosts %v: %v", path, err)
+		}
+		hosts.entries = append(hosts.entries, knownHost{marker: marker, patterns: patterns, key: key})
+		contents = rest
+	}
+}
+
+// check is the ssh.ClientConfig HostKeyCallback accepting the keys of the
+// known hosts. Unknown hosts are refused rather than added, as ssh does with
+// StrictHostKeyChecking, since playback is not interactive.
+func (hosts *knownHosts) check(addr string, remote net.Addr, key ssh.PublicKey) error {
+	name := knownHostName(addr)
+	accepted, mismatched := false, false
+	for _, entry := range hosts.entries {
+		if entry.marker == "cert-authority" || !entry.matches(name) {
+			continue
+		}
+		same := bytes.Equal(entry.key.Marshal(), key.Marshal())
+		switch {
+		case entry.marker == "revoked" && same:
+			return fmt.Errorf("the host key of %v is revoked in %v", addr, hosts.path)
+		case entry.marker == "revoked":
+		case same:
+			accepted = true
+		case entry.key.Type() == key.Type():
+			mismatched = true
+		}
+	}
+	switch {
+	case accepted:
+		return nil
+	case mismatched:
+		return fmt.Errorf("the host key of %v does not match the one in %v; it may have been changed, or the connection intercepted", addr, hosts.path)
+	default:
+		return fmt.Errorf("the host key of %v is not in %v; connect to it with ssh once to add it", addr, hosts.path)
+	}
+}
+
+// knownHostName returns the name of the host at addr in known hosts files,
+// which holds its port unless it is the default one.
+func knownHostName(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port == defaultSSHPort {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// matches returns whether the patterns of the entry match the host name,
+// which they do if any of them matches it and no negated one does. Hashed
+// patterns are the HMAC-SHA1 of the names they match, salted.
+func (entry *knownHost) matches(name string) bool {
+	matched := false
+	for _, pattern := range entry.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		var ok bool
+		if strings.HasPrefix(pattern, "|1|") {
+			ok = matchesHashedHost(pattern, name)
+		} else {
+			ok = matchesHostPattern(pattern, name)
+		}
+		switch {
+		case ok && negated:
+			return false
+		case ok:
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchesHostPattern returns whether a pattern, in which * matches any
+// number of characters and ? any single one, matches the host name.
+func matchesHostPattern(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if matchesHostPattern(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+		default:
+			if len(name) == 0 || pattern[0] != name[0] {
+				return false
+			}
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchesHashedHost returns whether a hashed pattern, |1|salt|hash with the
+// salt and hash in base64, matches the host name.
+func matchesHashedHost(pattern, name string) bool {
+	parts := strings.Split(pattern[len("|1|"):], "|")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// dial opens a connection to addr forwarded by the jump host, or to the
+// address it is mapped to by --sshHostMap. The jump host resolves the host
+// of the address, so that servers named as only its network knows them can
+// be reached.
+func (tunnel *sshTunnel) dial(addr string) (net.Conn, error) {
+	if forward, ok := tunnel.hostMap[normalizeAddr(addr, "")]; ok {
+		addr = forward
+	}
+	client, err := tunnel.connect()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.Dial("tcp", addr)
+	if _, refused := err.(*ssh.OpenChannelError); err != nil && !refused {
+		// the SSH connection was lost, so it is reopened
+		tunnel.disconnect(client)
+		if client, err = tunnel.connect(); err != nil {
+			return nil, err
+		}
+		conn, err = client.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %v through SSH tunnel %v: %v", addr, tunnel.addr, err)
+	}
+	return &deadlineConn{Conn: conn}, nil
+}
+
+// deadlineConn enforces the deadlines of a forwarded connection, which
+// doesn't support them, by closing it when a deadline passes during a read
+// or write. Its reads and writes then fail with a timeout, after which the
+// driver discards the connection, so it isn't used again.
+type deadlineConn struct {
+	net.Conn
+
+	mutex                       sync.Mutex
+	readDeadline, writeDeadline time.Time
+}
+
+// errDeadlineExceeded is the timeout error of the reads and writes of a
+// deadlineConn whose deadline passed.
+var errDeadlineExceeded error = &net.OpError{Op: "read/write", Net: "ssh", Err: os.ErrDeadlineExceeded}
+
+func (conn *deadlineConn) SetDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.readDeadline, conn.writeDeadline = t, t
+	return nil
+}
+
+func (conn *deadlineConn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.readDeadline = t
+	return nil
+}
+
+func (conn *deadlineConn) SetWriteDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.writeDeadline = t
+	return nil
+}
+
+func (conn *deadlineConn) Read(b []byte) (int, error) {
+	conn.mutex.Lock()
+	deadline := conn.readDeadline
+	conn.mutex.Unlock()
+	return conn.bounded(deadline, func() (int, error) { return conn.Conn.Read(b) })
+}
+
+func (conn *deadlineConn) Write(b []byte) (int, error) {
+	conn.mutex.Lock()
+	deadline := conn.writeDeadline
+	conn.mutex.Unlock()
+	return conn.bounded(deadline, func() (int, error) { return conn.Conn.Write(b) })
+}
+
+// bounded runs a read or write, closing the connection if it hasn't
+// returned by the deadline, unless the deadline is zero.
+func (conn *deadlineConn) bounded(deadline time.Time, op func() (int, error)) (int, error) {
+	if deadline.IsZero() {
+		return op()
+	}
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return 0, errDeadlineExceeded
+	}
+	timer := time.AfterFunc(wait, func() { conn.Conn.Close() })
+	n, err := op()
+	if !timer.Stop() {
+		return n, errDeadlineExceeded
+	}
+	return n, err
+}
+
+// connect returns the SSH connection to the jump host, opening it if it is
+// not open.
+func (tunnel *sshTunnel) connect() (*ssh.Client, error) {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	if tunnel.client != nil {
+		return tunnel.client, nil
+	}
+	timeout := orDialTimeout(tunnel.timeout)
+	conn, err := net.DialTimeout("tcp", tunnel.addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to SSH tunnel %v: %v", tunnel.addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, tunnel.addr, tunnel.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting to SSH tunnel %v: %v", tunnel.addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	tunnel.client = ssh.NewClient(sshConn, chans, reqs)
+	return tunnel.client, nil
+}
+
+// disconnect closes the SSH connection client, if it is still the one to
+// the jump host.
+func (tunnel *sshTunnel) disconnect(client *ssh.Client) {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	if tunnel.client == client {
+		tunnel.client.Close()
+		tunnel.client = nil
+	}
+}
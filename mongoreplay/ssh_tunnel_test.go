@@ -0,0 +1,315 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newSSHKey generates an RSA key, returning its signer and its PEM encoding.
+func newSSHKey(t *testing.T) (ssh.Signer, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+// writeSSHFiles writes an identity file holding the client key and a known
+// hosts file holding the given entries to dir.
+func writeSSHFiles(t *testing.T, dir string, clientKey []byte, knownHosts string) (string, string) {
+	identityFile := filepath.Join(dir, "id_rsa")
+	if err := ioutil.WriteFile(identityFile, clientKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(knownHostsFile, []byte(knownHosts), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return identityFile, knownHostsFile
+}
+
+func TestParseSSHTunnel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh_tunnel_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, clientKey := newSSHKey(t)
+	identityFile, knownHostsFile := writeSSHFiles(t, dir, clientKey, "")
+
+	type testCase struct {
+		name    string
+		value   string
+		hostMap []string
+		addr    string
+		user    string
+		forward map[string]string
+		invalid bool
+	}
+	cases := []testCase{
+		{name: "default port", value: "deploy@bastion", addr: "bastion:22", user: "deploy"},
+		{name: "port", value: "deploy@bastion:2222", addr: "bastion:2222", user: "deploy"},
+		{name: "ipv6", value: "deploy@[::1]", addr: "[::1]:22", user: "deploy"},
+		{
+			name:    "host map",
+			value:   "deploy@bastion",
+			hostMap: []string{"db0.example.com:27018=10.0.0.5:27017", "db1.example.com=10.0.0.6"},
+			addr:    "bastion:22",
+			user:    "deploy",
+			forward: map[string]string{"db0.example.com:27018": "10.0.0.5:27017", "db1.example.com:27017": "10.0.0.6:27017"},
+		},
+		{name: "no host", value: "deploy@", invalid: true},
+		{name: "invalid host map", value: "deploy@bastion", hostMap: []string{"db0.example.com:27017"}, invalid: true},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		tunnel, err := parseSSHTunnel(c.value, identityFile, knownHostsFile, c.hostMap)
+		if c.invalid {
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if tunnel.addr != c.addr || tunnel.config.User != c.user {
+			t.Errorf("expected %v@%v, got %v@%v", c.user, c.addr, tunnel.config.User, tunnel.addr)
+		}
+		if len(tunnel.hostMap) != len(c.forward) {
+			t.Errorf("expected host map %v, got %v", c.forward, tunnel.hostMap)
+		}
+		for server, forward := range c.forward {
+			if tunnel.hostMap[server] != forward {
+				t.Errorf("expected %v to be forwarded to %v, got %v", server, forward, tunnel.hostMap[server])
+			}
+		}
+	}
+
+	t.Log("Loading a missing identity file")
+	if _, err := parseSSHTunnel("deploy@bastion", filepath.Join(dir, "missing"), knownHostsFile, nil); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+// hashKnownHost returns the hashed pattern of a known hosts file matching
+// the host name.
+func hashKnownHost(name string) string {
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestKnownHostsCheck(t *testing.T) {
+	hostKey, _ := newSSHKey(t)
+	otherKey, _ := newSSHKey(t)
+	entry := func(marker string, patterns ...string) knownHost {
+		return knownHost{marker: marker, patterns: patterns, key: hostKey.PublicKey()}
+	}
+
+	type testCase struct {
+		name     string
+		entries  []knownHost
+		addr     string
+		key      ssh.PublicKey
+		accepted bool
+	}
+	cases := []testCase{
+		{name: "plain", entries: []knownHost{entry("", "bastion", "10.0.0.1")}, addr: "bastion:22", key: hostKey.PublicKey(), accepted: true},
+		{name: "port", entries: []knownHost{entry("", "[bastion]:2222")}, addr: "bastion:2222", key: hostKey.PublicKey(), accepted: true},
+		{name: "port mismatch", entries: []knownHost{entry("", "bastion")}, addr: "bastion:2222", key: hostKey.PublicKey()},
+		{name: "hashed", entries: []knownHost{entry("", hashKnownHost("bastion"))}, addr: "bastion:22", key: hostKey.PublicKey(), accepted: true},
+		{name: "wildcard", entries: []knownHost{entry("", "*.example.com")}, addr: "bastion.example.com:22", key: hostKey.PublicKey(), accepted: true},
+		{name: "negated", entries: []knownHost{entry("", "*.example.com", "!bastion.example.com")}, addr: "bastion.example.com:22", key: hostKey.PublicKey()},
+		{name: "changed key", entries: []knownHost{entry("", "bastion")}, addr: "bastion:22", key: otherKey.PublicKey()},
+		{name: "revoked", entries: []knownHost{entry("", "bastion"), entry("revoked", "*")}, addr: "bastion:22", key: hostKey.PublicKey()},
+		{name: "unknown", entries: []knownHost{entry("", "other")}, addr: "bastion:22", key: hostKey.PublicKey()},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		hosts := &knownHosts{path: "known_hosts", entries: c.entries}
+		err := hosts.check(c.addr, nil, c.key)
+		if c.accepted && err != nil {
+			t.Errorf("expected the key to be accepted, got %v", err)
+		}
+		if !c.accepted && err == nil {
+			t.Errorf("expected the key to be refused")
+		}
+	}
+}
+
+// serveSSH accepts SSH connections on listener authenticated with the client
+// key, forwarding the connections they open to the addresses requested,
+// which are sent to requested.
+func serveSSH(t *testing.T, listener net.Listener, hostKey ssh.Signer, clientKey ssh.PublicKey, requested chan<- string) {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for newChannel := range chans {
+				// the addresses of a direct-tcpip channel, as defined by RFC
+				// 4254
+				var forward struct {
+					Host       string
+					Port       uint32
+					OriginHost string
+					OriginPort uint32
+				}
+				if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &forward) != nil {
+					newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+					continue
+				}
+				addr := net.JoinHostPort(forward.Host, strconv.Itoa(int(forward.Port)))
+				requested <- addr
+				server, err := net.Dial("tcp", addr)
+				if err != nil {
+					newChannel.Reject(ssh.ConnectionFailed, err.Error())
+					continue
+				}
+				channel, channelReqs, err := newChannel.Accept()
+				if err != nil {
+					server.Close()
+					continue
+				}
+				go ssh.DiscardRequests(channelReqs)
+				go func() {
+					io.Copy(server, channel)
+					server.Close()
+				}()
+				go func() {
+					io.Copy(channel, server)
+					channel.Close()
+				}()
+			}
+		}()
+	}
+}
+
+func TestSSHTunnel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh_tunnel_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	hostKey, _ := newSSHKey(t)
+	clientSigner, clientKey := newSSHKey(t)
+	requested := make(chan string, 2)
+	go serveSSH(t, listener, hostKey, clientSigner.PublicKey(), requested)
+
+	// the environment's ssh-agent is not used
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Unsetenv("SSH_AUTH_SOCK")
+
+	knownHost := knownHostName(listener.Addr().String()) + " " + string(ssh.MarshalAuthorizedKey(hostKey.PublicKey()))
+	identityFile, knownHostsFile := writeSSHFiles(t, dir, clientKey, knownHost)
+	tunnel, err := parseSSHTunnel("deploy@"+listener.Addr().String(), identityFile, knownHostsFile,
+		[]string{"db0.internal:27017=" + echo.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log("Dialing a server through the tunnel")
+	conn, err := tunnel.dial("db0.internal:27017")
+	if err != nil {
+		t.Fatalf("error dialing through the tunnel: %v", err)
+	}
+	if addr := <-requested; addr != echo.Addr().String() {
+		t.Errorf("expected the jump host to forward to %v, got %v", echo.Addr(), addr)
+	}
+	conn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Errorf("expected the connection to reach the server, got %q (%v)", reply, err)
+	}
+
+	t.Log("Reading past the deadline of a forwarded connection")
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(reply)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("expected the read to time out, got %v", err)
+	}
+	conn.Close()
+
+	t.Log("Dialing after the SSH connection is lost")
+	tunnel.client.Close()
+	conn, err = tunnel.dial(echo.Addr().String())
+	if err != nil {
+		t.Fatalf("expected the SSH connection to be reopened, got %v", err)
+	}
+	<-requested
+	conn.Close()
+
+	t.Log("Connecting to a jump host with an unknown key")
+	_, knownHostsFile = writeSSHFiles(t, dir, clientKey, "")
+	tunnel, err = parseSSHTunnel("deploy@"+listener.Addr().String(), identityFile, knownHostsFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tunnel.dial(echo.Addr().String()); err == nil {
+		t.Errorf("expected the host key to be refused")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"strings"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// wireVersionStableAPI is that of 5.0, the first to accept the Stable API
+// parameters.
+const wireVersionStableAPI = 13
+
+// serverAPI describes the Stable API version declared by every replayed
+// command, as set by --apiVersion, --apiStrict and --apiDeprecationErrors.
+type serverAPI struct {
+	version           string
+	strict            bool
+	deprecationErrors bool
+}
+
+// apply declares the API version in a command. getMores, and commands which
+// continue a transaction, inherit the API version of the command which
+// started their cursor or transaction, so they are left untouched, as are
+// the legacy ops other than commands, which can't declare it.
+func (api *serverAPI) apply(op Op) error {
+	switch castOp := op.(type) {
+	case *QueryOp:
+		if !strings.HasSuffix(castOp.Collection, ".$cmd") {
+			return nil
+		}
+		query, wrapper, err := unwrapQuery(castOp.Query)
+		if err != nil || len(query) == 0 || !api.declaredBy(query) {
+			return err
+		}
+		query = api.declare(query)
+		if wrapper != nil {
+			wrapper[0].Value = query
+			castOp.Query = wrapper
+		} else {
+			castOp.Query = query
+		}
+	case *MsgOp:
+		payload, sectionIx, err := fetchPayload0Data(castOp.Sections)
+		if err != nil {
+			return err
+		}
+		body, err := bsonToD(payload)
+		if err != nil || len(body) == 0 || !api.declaredBy(body) {
+			return err
+		}
+		raw, err := dToRaw(api.declare(body))
+		if err != nil {
+			return err
+		}
+		castOp.Sections[sectionIx].Data = raw
+	}
+	return nil
+}
+
+// declaredBy returns whether the command declares the API version.
+func (api *serverAPI) declaredBy(command bson.D) bool {
+	switch command[0].Name {
+	case "getMore", "getmore":
+		return false
+	}
+	if _, ok := FindValueByKey("autocommit", &command); ok {
+		_, ok = FindValueByKey("startTransaction", &command)
+		return ok
+	}
+	return true
+}
+
+func (api *serverAPI) declare(command bson.D) bson.D {
+	command = setDocField(command, "apiVersion", api.version)
+	if api.strict {
+		command = setDocField(command, "apiStrict", true)
+	}
+	if api.deprecationErrors {
+		command = setDocField(command, "apiDeprecationErrors", true)
+	}
+	return command
+}
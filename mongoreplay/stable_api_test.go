@@ -0,0 +1,88 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"reflect"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestServerAPIApply(t *testing.T) {
+	api := &serverAPI{version: "1", strict: true}
+	type testCase struct {
+		name string
+		op   Op
+		// expected is the command sent, or nil if the op is left untouched
+		expected bson.D
+	}
+	msgCommand := func(command bson.D) Op {
+		op, err := newMsgCommand("test", command)
+		if err != nil {
+			t.Fatalf("error building the command: %v", err)
+		}
+		return op
+	}
+	cases := []testCase{
+		{
+			name:     "find",
+			op:       msgCommand(bson.D{{"find", "c"}}),
+			expected: bson.D{{"find", "c"}, {"$db", "test"}, {"apiVersion", "1"}, {"apiStrict", true}},
+		},
+		{
+			name:     "transaction started",
+			op:       msgCommand(bson.D{{"insert", "c"}, {"autocommit", false}, {"startTransaction", true}}),
+			expected: bson.D{{"insert", "c"}, {"autocommit", false}, {"startTransaction", true}, {"$db", "test"}, {"apiVersion", "1"}, {"apiStrict", true}},
+		},
+		{
+			name: "transaction continued",
+			op:   msgCommand(bson.D{{"insert", "c"}, {"autocommit", false}}),
+		},
+		{
+			name: "getMore",
+			op:   msgCommand(bson.D{{"getMore", int64(10)}, {"collection", "c"}}),
+		},
+		{
+			name:     "legacy command",
+			op:       &QueryOp{QueryOp: mgo.QueryOp{Collection: "test.$cmd", Query: bson.D{{"$query", bson.D{{"count", "c"}}}}}},
+			expected: bson.D{{"$query", bson.D{{"count", "c"}, {"apiVersion", "1"}, {"apiStrict", true}}}},
+		},
+		{
+			name: "legacy query",
+			op:   &QueryOp{QueryOp: mgo.QueryOp{Collection: "test.c", Query: bson.D{{"a", 1}}}},
+		},
+	}
+	// sent returns the document holding the command of op
+	sent := func(op Op) bson.D {
+		var doc bson.D
+		switch castOp := op.(type) {
+		case *MsgOp:
+			doc, _ = bsonToD(castOp.Sections[0].Data)
+		case *QueryOp:
+			doc, _ = bsonToD(castOp.Query)
+		}
+		return doc
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		before := sent(c.op)
+		if err := api.apply(c.op); err != nil {
+			t.Errorf("error declaring the API version: %v", err)
+			continue
+		}
+		after := sent(c.op)
+		if c.expected == nil {
+			if !reflect.DeepEqual(after, before) {
+				t.Errorf("expected the op to be left untouched, got %v", after)
+			}
+		} else if !reflect.DeepEqual(after, c.expected) {
+			t.Errorf("expected command %v, got %v", c.expected, after)
+		}
+	}
+}
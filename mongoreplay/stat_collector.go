@@ -24,12 +24,38 @@ const TruncateLength = 350
 // StatOptions stores settings for the mongoreplay subcommands which have stat
 // output
 type StatOptions struct {
-	Buffered   bool   `hidden:"yes"`
-	BufferSize int    `long:"stats-buffer-size" description:"the size (in events) of the stat collector buffer" default:"1024"`
-	Report     string `long:"report" description:"Write report on execution to given output path"`
-	NoTruncate bool   `long:"no-truncate" description:"Disable truncation of large payload data in log output"`
-	Format     string `long:"format" description:"Format for terminal output, %-escaped. Arguments are provided immediately after the escape, surrounded in curly braces. Supported escapes are:\n	%n namespace\n%l latency\n%t time (optional arg -- specify date layout, e.g. '%t{3:04PM}')\n%T op type\n%c command\n%o number of connections\n%i request ID\n%q request (optional arg -- dot-delimited field within the JSON structure, e.g. '%q{command_args.documents}')\n%r response (optional arg -- same as %q)\n%Q{<arg>} conditionally show <arg> on presence of request data\n%R{<arg>} conditionally show <arg> on presence of response data\nANSI escape sequences, start/end:\n%B/%b bold\n%U/%u underline\n%S/%s standout\n%F/%f text color (required arg -- word or number, 8-color)\n%K/%k background color (required arg -- same as %F/%f)\n" default:"%F{blue}%t%f %F{cyan}(Connection: %o:%i)%f %F{yellow}%l%f %F{red}%T %c%f %F{white}%n%f %F{green}%Q{Request:}%f%q %F{green}%R{Response:}%f%r"`
-	NoColors   bool   `long:"no-colors" description:"Remove colors from the default format"`
+	Buffered       bool   `hidden:"yes"`
+	BufferSize     int    `long:"stats-buffer-size" description:"the size (in events) of the stat collector buffer" default:"1024"`
+	Report         string `long:"report" description:"Write report on execution to given output path"`
+	ReportHTML     string `long:"reportHtml" description:"Write a self-contained HTML report on throughput, latencies, errors and namespaces to given output path"`
+	NoTruncate     bool   `long:"no-truncate" description:"Disable truncation of large payload data in log output"`
+	Format         string `long:"format" description:"Format for terminal output, %-escaped. Arguments are provided immediately after the escape, surrounded in curly braces. Supported escapes are:\n	%n namespace\n%l latency\n%t time (optional arg -- specify date layout, e.g. '%t{3:04PM}')\n%T op type\n%c command\n%o number of connections\n%i request ID\n%q request (optional arg -- dot-delimited field within the JSON structure, e.g. '%q{command_args.documents}')\n%r response (optional arg -- same as %q)\n%Q{<arg>} conditionally show <arg> on presence of request data\n%R{<arg>} conditionally show <arg> on presence of response data\nANSI escape sequences, start/end:\n%B/%b bold\n%U/%u underline\n%S/%s standout\n%F/%f text color (required arg -- word or number, 8-color)\n%K/%k background color (required arg -- same as %F/%f)\n" default:"%F{blue}%t%f %F{cyan}(Connection: %o:%i)%f %F{yellow}%l%f %F{red}%T %c%f %F{white}%n%f %F{green}%Q{Request:}%f%q %F{green}%R{Response:}%f%r"`
+	NoColors       bool   `long:"no-colors" description:"Remove colors from the default format"`
+	StatsURI       string `long:"statsUri" value-name:"<uri>" description:"connection string of the server which --collect mongodb inserts the stats into"`
+	StatsNamespace string `long:"statsNamespace" value-name:"<database.collection>" description:"collection which --collect mongodb inserts the stats into" default:"mongoreplay.stats"`
+	JSONMode       string `long:"jsonMode" description:"Extended JSON mode of the request and reply documents of the json and format stats: relaxed, writing numbers and dates as plain JSON where possible, or canonical, keeping the BSON type of every value" choice:"relaxed" choice:"canonical" default:"relaxed"`
+	LatencyUDP     string `long:"latencyUdp" description:"Send the latency of every op, packed in binary datagrams, to the given host:port over UDP"`
+	Percentiles    bool   `long:"percentiles" description:"Log the p50, p90, p95 and p99 latencies of each op type and namespace when finished"`
+	Heatmap        string `long:"heatmap" value-name:"<path>" description:"Write the number of ops of each op type and namespace in each --heatmapBucket of the run to given output path, as json if it ends in .json and as csv otherwise"`
+	HeatmapBucket  string `long:"heatmapBucket" description:"length of the time buckets of --heatmap, such as 1m or 10s" default:"1m"`
+
+	StatsFlushInterval int `long:"statsFlushInterval" description:"number of seconds between the writes to disk of the stats recorded by --collect, so that a playback which is killed loses at most this many seconds of stats; 0 never syncs them" default:"1"`
+
+	StatsD       string   `long:"statsd" value-name:"<host:port>" description:"Send op counts, error counts and latencies to the StatsD server at the given host:port while playing"`
+	StatsDPrefix string   `long:"statsdPrefix" description:"Prefix of the names of the metrics sent to --statsd" default:"mongoreplay"`
+	DogStatsD    bool     `long:"dogstatsd" description:"Send the metrics to --statsd in the DogStatsD format, with the op as a tag rather than in the metric name"`
+	StatsDTags   []string `long:"statsdTag" value-name:"<key:value>" description:"Tag added to every metric sent to --statsd with --dogstatsd; may be repeated"`
+
+	// Recorder, if set, records the stats along with the recorders of the
+	// other options.
+	Recorder StatRecorder `no-flag:"true"`
+
+	// BufferedMax is the number of stats the buffered recorder holds in
+	// memory before spooling the rest to a temporary file in
+	// BufferedSpoolDir; 0 holds defaultBufferedStatsMax, and a negative
+	// number every stat.
+	BufferedMax      int    `no-flag:"true"`
+	BufferedSpoolDir string `no-flag:"true"`
 }
 
 // StatCollector is a struct that handles generation and recording of statistics
@@ -41,6 +67,9 @@ type StatCollector struct {
 	done           chan struct{}
 	statStream     chan *OpStat
 	statStreamSize int
+	// flushInterval is the time between the flushes of the StatRecorder, if
+	// it is a StatFlusher; 0 flushes it only when it is closed.
+	flushInterval time.Duration
 	StatGenerator
 	StatRecorder
 	noop bool
@@ -57,11 +86,19 @@ func (statColl *StatCollector) Close() error {
 	return statColl.StatRecorder.Close()
 }
 
-func newStatCollector(opts StatOptions, collectFormat string, isPairedMode bool, isComparative bool) (*StatCollector, error) {
+// NewStatCollector creates a StatCollector recording stats with the
+// StatRecorder registered under collectFormat, or recording nothing if
+// collectFormat is "none". In paired mode, stats are generated from ops and
+// their replies; comparative StatCollectors are used for playback, where the
+// live replies are compared with the recorded ones.
+func NewStatCollector(opts StatOptions, collectFormat string, isPairedMode bool, isComparative bool) (*StatCollector, error) {
 	if opts.Buffered {
 		collectFormat = "buffered"
 	}
-	if collectFormat == "none" {
+	if err := validateStatsDOptions(opts); err != nil {
+		return nil, err
+	}
+	if collectFormat == "none" && opts.LatencyUDP == "" && opts.StatsD == "" && !opts.Percentiles && opts.ReportHTML == "" && opts.Heatmap == "" && opts.Recorder == nil {
 		return &StatCollector{noop: true}, nil
 	}
 
@@ -79,9 +116,16 @@ func newStatCollector(opts StatOptions, collectFormat string, isPairedMode bool,
 		opts.Format = "%t (Connection: %o:%i) %l %T %c %n %Q{Request:}%q %R{Response:}%r"
 	}
 
-	var o io.WriteCloser
+	var factory StatRecorderFactory
 	var err error
-	if opts.Report != "" {
+	if collectFormat != "none" {
+		if factory, err = lookupStatRecorder(collectFormat); err != nil {
+			return nil, err
+		}
+	}
+
+	var o io.WriteCloser
+	if opts.Report != "" && collectFormat != "none" {
 		o, err = os.Create(opts.Report)
 		if err != nil {
 			return nil, err
@@ -91,21 +135,50 @@ func newStatCollector(opts StatOptions, collectFormat string, isPairedMode bool,
 	}
 
 	var statRec StatRecorder
-	switch collectFormat {
-	case "json":
-		statRec = &JSONStatRecorder{
-			out: o,
+	if collectFormat == "none" {
+		statRec = &NopRecorder{}
+	} else if statRec, err = factory(opts, o); err != nil {
+		return nil, err
+	}
+
+	if opts.LatencyUDP != "" {
+		udpRec, err := NewUDPLatencyRecorder(opts.LatencyUDP)
+		if err != nil {
+			return nil, err
 		}
-	case "buffered":
-		statRec = &BufferedStatRecorder{
-			Buffer: []OpStat{},
+		statRec = multiStatRecorder{udpRec, statRec}
+	}
+	if opts.StatsD != "" {
+		statsDRec, err := NewStatsDRecorder(opts.StatsD, opts.StatsDPrefix, opts.DogStatsD, opts.StatsDTags)
+		if err != nil {
+			return nil, err
 		}
-	case "format":
-		statRec = &TerminalStatRecorder{
-			out:      o,
-			truncate: !opts.NoTruncate,
-			format:   opts.Format,
+		statRec = multiStatRecorder{statsDRec, statRec}
+	}
+	if opts.Percentiles {
+		statRec = multiStatRecorder{statRec, NewPercentileStatRecorder()}
+	}
+	if opts.ReportHTML != "" {
+		htmlRec, err := NewHTMLReportRecorder(opts.ReportHTML)
+		if err != nil {
+			return nil, err
+		}
+		statRec = multiStatRecorder{statRec, htmlRec}
+	}
+	if opts.Heatmap != "" {
+		bucket, err := parseHeatmapBucket("heatmapBucket", opts.HeatmapBucket)
+		if err != nil {
+			return nil, err
+		}
+		heatmapRec, err := NewHeatmapRecorder(opts.Heatmap, bucket)
+		if err != nil {
+			return nil, err
 		}
+		statRec = multiStatRecorder{statRec, heatmapRec}
+	}
+
+	if opts.Recorder != nil {
+		statRec = multiStatRecorder{statRec, opts.Recorder}
 	}
 
 	if opts.BufferSize < 1 {
@@ -116,6 +189,7 @@ func newStatCollector(opts StatOptions, collectFormat string, isPairedMode bool,
 		StatGenerator:  statGen,
 		StatRecorder:   statRec,
 		statStreamSize: opts.BufferSize,
+		flushInterval:  time.Duration(opts.StatsFlushInterval) * time.Second,
 	}, nil
 }
 
@@ -126,7 +200,10 @@ type StatGenerator interface {
 	Finalize(chan *OpStat)
 }
 
-// StatRecorder is an interface that specifies how to take OpStats to be recorded
+// StatRecorder is an interface that specifies how to take OpStats to be recorded.
+// RecordStat is called for every stat in turn from a single goroutine, and
+// Close once all of the stats have been recorded. New StatRecorders can be
+// made available by name with RegisterStatRecorder.
 type StatRecorder interface {
 	RecordStat(stat *OpStat)
 	Close() error
@@ -164,9 +241,7 @@ func (statColl *StatCollector) Collect(op *RecordedOp, replayedOp Op, reply Repl
 		statColl.statStream = make(chan *OpStat, statColl.statStreamSize)
 		statColl.done = make(chan struct{})
 		go func() {
-			for stat := range statColl.statStream {
-				statColl.StatRecorder.RecordStat(stat)
-			}
+			statColl.record()
 			close(statColl.done)
 		}()
 	})
@@ -175,16 +250,51 @@ func (statColl *StatCollector) Collect(op *RecordedOp, replayedOp Op, reply Repl
 	}
 }
 
+// record records the stats sent to the stat stream until it is closed,
+// flushing the StatRecorder every flushInterval while stats are recorded.
+func (statColl *StatCollector) record() {
+	flusher, ok := statColl.StatRecorder.(StatFlusher)
+	if !ok || statColl.flushInterval <= 0 {
+		for stat := range statColl.statStream {
+			statColl.StatRecorder.RecordStat(stat)
+		}
+		return
+	}
+	ticker := time.NewTicker(statColl.flushInterval)
+	defer ticker.Stop()
+	var recorded bool
+	for {
+		select {
+		case stat, ok := <-statColl.statStream:
+			if !ok {
+				return
+			}
+			statColl.StatRecorder.RecordStat(stat)
+			recorded = true
+		case <-ticker.C:
+			if !recorded {
+				continue
+			}
+			if err := flusher.Flush(); err != nil {
+				toolDebugLogger.Logvf(Always, "error flushing stats: %v", err)
+			}
+			recorded = false
+		}
+	}
+}
+
 // JSONStatRecorder records stats in JSON output
 type JSONStatRecorder struct {
-	out io.WriteCloser
+	out       io.WriteCloser
+	canonical bool
 }
 
 // TerminalStatRecorder records stats for terminal output
 type TerminalStatRecorder struct {
-	out      io.WriteCloser
-	truncate bool
-	format   string
+	out       io.WriteCloser
+	truncate  bool
+	format    string
+	canonical bool
 }
 
 // BufferedStatRecorder implements the StatRecorder interface using an in-memory
@@ -193,12 +303,25 @@ type TerminalStatRecorder struct {
 //
 // BufferedStatCollector's main purpose is for asserting correct execution of
 // ops for testing
+//
+// Once MaxBuffered stats are held in Buffer, the rest are spooled to a
+// temporary file, so that long playbacks don't exhaust memory. ForEach
+// iterates over both until the BufferedStatRecorder is closed, which removes
+// the spool.
 type BufferedStatRecorder struct {
 	// Buffer is a slice of OpStats that is appended to every time the Collect
 	// function makes a record It stores an in-order series of OpStats that
 	// store information about the commands mongoreplay ran as a result of reading
 	// a playback file
 	Buffer []OpStat
+
+	// MaxBuffered is the number of stats held in Buffer before the rest are
+	// spooled to a temporary file in SpoolDir, or in the default directory
+	// for temporary files if SpoolDir is unset. 0 holds every stat in Buffer.
+	MaxBuffered int
+	SpoolDir    string
+
+	spool *statSpool
 }
 
 // NopRecorder implements the StatRecorder interface but doesn't do anything
@@ -211,20 +334,21 @@ func (jsr *JSONStatRecorder) RecordStat(stat *OpStat) {
 		return
 	}
 
-	// TODO use variant of this function that does not mutate its argument.
+	// the documents are written in Extended JSON, so that they can be
+	// parsed back with their types
 	if stat.RequestData != nil {
-		reqD, err := ConvertBSONValueToJSON(stat.RequestData)
+		reqD, err := marshalExtJSON(stat.RequestData, jsr.canonical)
 		if err != nil {
 			toolDebugLogger.Logvf(Always, "error recording stat: %v", err)
 		}
-		stat.RequestData = reqD
+		stat.RequestData = json.RawMessage(reqD)
 	}
 	if stat.ReplyData != nil {
-		repD, err := ConvertBSONValueToJSON(stat.ReplyData)
+		repD, err := marshalExtJSON(stat.ReplyData, jsr.canonical)
 		if err != nil {
 			toolDebugLogger.Logvf(Always, "error recording stat: %v", err)
 		}
-		stat.ReplyData = repD
+		stat.ReplyData = json.RawMessage(repD)
 	}
 
 	jsonBytes, err := json.Marshal(stat)
@@ -244,9 +368,50 @@ func (jsr *JSONStatRecorder) RecordStat(stat *OpStat) {
 	}
 }
 
-// RecordStat records the stat into a buffer
+// RecordStat records the stat into a buffer, or into the spool once the
+// buffer is full.
 func (bsr *BufferedStatRecorder) RecordStat(stat *OpStat) {
-	bsr.Buffer = append(bsr.Buffer, *stat)
+	if bsr.MaxBuffered <= 0 || len(bsr.Buffer) < bsr.MaxBuffered {
+		bsr.Buffer = append(bsr.Buffer, *stat)
+		return
+	}
+	if bsr.spool == nil {
+		bsr.spool = &statSpool{dir: bsr.SpoolDir}
+	}
+	if err := bsr.spool.write(stat); err != nil {
+		toolDebugLogger.Logvf(Always, "error recording stat: %v", err)
+	}
+}
+
+// Len returns the number of stats recorded, in the buffer and the spool.
+func (bsr *BufferedStatRecorder) Len() int {
+	if bsr.spool == nil {
+		return len(bsr.Buffer)
+	}
+	return len(bsr.Buffer) + bsr.spool.count
+}
+
+// ForEach calls fn with each stat recorded in order, those of the buffer
+// followed by those of the spool, stopping at the first error fn returns.
+func (bsr *BufferedStatRecorder) ForEach(fn func(stat *OpStat) error) error {
+	for i := range bsr.Buffer {
+		if err := fn(&bsr.Buffer[i]); err != nil {
+			return err
+		}
+	}
+	if bsr.spool == nil {
+		return nil
+	}
+	return bsr.spool.forEach(fn)
+}
+
+// Remove removes the spool of the BufferedStatRecorder, if any stats were
+// spooled, after which they can no longer be iterated.
+func (bsr *BufferedStatRecorder) Remove() error {
+	if bsr.spool == nil {
+		return nil
+	}
+	return bsr.spool.remove()
 }
 
 // RecordStat records the stat into the terminal
@@ -262,11 +427,7 @@ func (dsr *TerminalStatRecorder) RecordStat(stat *OpStat) {
 			return
 		}
 		payload := new(bytes.Buffer)
-		jsonData, err := ConvertBSONValueToJSON(data)
-		if err != nil {
-			toolDebugLogger.Logvf(Always, "error recording stat: %v", err)
-		}
-		jsonBytes, err := json.Marshal(jsonData)
+		jsonBytes, err := marshalExtJSON(data, dsr.canonical)
 		if err != nil {
 			payload.WriteString(err.Error())
 		} else if dsr.truncate {
@@ -298,14 +459,24 @@ func (dsr *TerminalStatRecorder) RecordStat(stat *OpStat) {
 func (nr *NopRecorder) RecordStat(stat *OpStat) {
 }
 
+// Flush writes out the stats recorded.
+func (jsr *JSONStatRecorder) Flush() error {
+	if flusher, ok := jsr.out.(StatFlusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
 // Close closes the JSONStatRecorder
 func (jsr *JSONStatRecorder) Close() error {
 	return jsr.out.Close()
 }
 
-// Close closes the BufferedStatRecorder
+// Close closes the BufferedStatRecorder, removing its spool. The stats held
+// in Buffer can still be read once it is closed, but those which were
+// spooled can no longer be iterated.
 func (bsr *BufferedStatRecorder) Close() error {
-	return nil
+	return bsr.Remove()
 }
 
 // Close closes the NopRecorder (i.e. does nothing)
@@ -345,6 +516,8 @@ func (gen *ComparativeStatGenerator) GenerateOpStat(op *RecordedOp, replayedOp O
 		Seen:          &op.Seen.Time,
 		RequestID:     op.Header.RequestID,
 	}
+	stat.setReadMetadata(replayedOp)
+	stat.Unacknowledged = isUnacknowledgedWrite(replayedOp)
 	var playAtHasVal bool
 	if op.PlayAt != nil && !op.PlayAt.IsZero() {
 		stat.PlayAt = &op.PlayAt.Time
@@ -388,6 +561,8 @@ func (gen *RegularStatGenerator) GenerateOpStat(recordedOp *RecordedOp, parsedOp
 		ConnectionNum: recordedOp.SeenConnectionNum,
 		Seen:          &recordedOp.Seen.Time,
 	}
+	stat.setReadMetadata(parsedOp)
+	stat.Unacknowledged = isUnacknowledgedWrite(parsedOp)
 	if msg != "" {
 		stat.Message = msg
 	}
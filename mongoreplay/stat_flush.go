@@ -0,0 +1,59 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"io"
+	"os"
+)
+
+// StatFlusher is implemented by the StatRecorders which hold stats before
+// writing them out, or write them to a file which can be synced to disk. A
+// StatCollector calls Flush every --statsFlushInterval while stats are
+// recorded, from the goroutine which calls RecordStat, so that a playback
+// which is killed or crashes loses only the stats of its last moments.
+type StatFlusher interface {
+	Flush() error
+}
+
+// syncingWriter writes the stats to out as they are recorded, and syncs out
+// to disk when it is flushed, if it is a regular file.
+type syncingWriter struct {
+	io.WriteCloser
+	file *os.File
+}
+
+func newSyncingWriter(out io.WriteCloser) *syncingWriter {
+	w := &syncingWriter{WriteCloser: out}
+	if file, ok := out.(*os.File); ok {
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+			w.file = file
+		}
+	}
+	return w
+}
+
+// Flush syncs the stats written to disk.
+func (w *syncingWriter) Flush() error {
+	if w.file != nil {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// Flush writes out the stats held by the recorders which hold them.
+func (msr multiStatRecorder) Flush() error {
+	var err error
+	for _, recorder := range msr {
+		if flusher, ok := recorder.(StatFlusher); ok {
+			if flushErr := flusher.Flush(); err == nil {
+				err = flushErr
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncingWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := newSyncingWriter(NopWriteCloser(out))
+	io.WriteString(w, "unbuffered")
+	if out.String() != "unbuffered" {
+		t.Errorf("expected the write not to be buffered, got %q", out.String())
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestStatCollectorFlushes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stat_flush_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.json")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := newJSONStatRecorder(StatOptions{}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statColl := &StatCollector{
+		StatRecorder:  multiStatRecorder{recorder},
+		statStream:    make(chan *OpStat),
+		done:          make(chan struct{}),
+		flushInterval: 10 * time.Millisecond,
+	}
+	go func() {
+		statColl.record()
+		close(statColl.done)
+	}()
+	statColl.statStream <- &OpStat{Order: 1, OpType: "op_msg"}
+	statColl.statStream <- &OpStat{Order: 2, OpType: "op_msg"}
+
+	// the stats are written out while the collector is still open
+	deadline := time.Now().Add(5 * time.Second)
+	var contents []byte
+	for time.Now().Before(deadline) {
+		if contents, err = ioutil.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Count(string(contents), "\n") == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if lines := strings.Count(string(contents), "\n"); lines != 2 {
+		t.Errorf("expected 2 stats to be flushed before the collector was closed, got %v", lines)
+	}
+
+	close(statColl.statStream)
+	<-statColl.done
+	if err := statColl.StatRecorder.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
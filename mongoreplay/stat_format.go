@@ -71,6 +71,17 @@ type OpStat struct {
 
 	Message string `json:"msg,omitempty"`
 
+	// HedgeEnabled is set for reads whose read preference carries a hedge
+	// option, and is true if the read was hedged by mongos.
+	HedgeEnabled *bool `json:"hedge_enabled,omitempty"`
+
+	// Mirrored is true for reads mirrored by a primary to a secondary.
+	Mirrored bool `json:"mirrored,omitempty"`
+
+	// Unacknowledged is true for writes the server doesn't acknowledge,
+	// which have no reply and so no latency.
+	Unacknowledged bool `json:"unacknowledged,omitempty"`
+
 	// Seen is the time that this operation was originally seen.
 	Seen *time.Time `json:"seen,omitempty"`
 
@@ -0,0 +1,283 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatRecorderFactory creates a StatRecorder writing to out, which is the
+// file given by --report or stdout.
+type StatRecorderFactory func(opts StatOptions, out io.WriteCloser) (StatRecorder, error)
+
+var (
+	statRecordersLock sync.RWMutex
+	statRecorders     = map[string]StatRecorderFactory{
+		"json":       newJSONStatRecorder,
+		"format":     newTerminalStatRecorder,
+		"buffered":   newBufferedStatRecorder,
+		"csv":        newCSVStatRecorder,
+		"prometheus": newPrometheusStatRecorder,
+		"mongodb":    newMongoDBStatRecorder,
+		"sqlite":     newSQLiteStatRecorder,
+	}
+)
+
+// RegisterStatRecorder makes a StatRecorder available under name, which can
+// then be given to --collect or NewStatCollector. It is meant to be called
+// from the init function of the package providing the StatRecorder, and
+// panics if name is already registered.
+func RegisterStatRecorder(name string, factory StatRecorderFactory) {
+	statRecordersLock.Lock()
+	defer statRecordersLock.Unlock()
+	if factory == nil {
+		panic("mongoreplay: RegisterStatRecorder factory is nil")
+	}
+	if _, dup := statRecorders[name]; dup || name == "none" {
+		panic("mongoreplay: RegisterStatRecorder called twice for " + name)
+	}
+	statRecorders[name] = factory
+}
+
+// StatRecorderNames returns the sorted names of the registered StatRecorders.
+func StatRecorderNames() []string {
+	statRecordersLock.RLock()
+	defer statRecordersLock.RUnlock()
+	names := make([]string, 0, len(statRecorders))
+	for name := range statRecorders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupStatRecorder returns the factory of the StatRecorder registered
+// under name.
+func lookupStatRecorder(name string) (StatRecorderFactory, error) {
+	statRecordersLock.RLock()
+	factory, ok := statRecorders[name]
+	statRecordersLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown stat collection format '%v', expected one of none, %v",
+			name, strings.Join(StatRecorderNames(), ", "))
+	}
+	return factory, nil
+}
+
+func newJSONStatRecorder(opts StatOptions, out io.WriteCloser) (StatRecorder, error) {
+	return &JSONStatRecorder{
+		out:       newSyncingWriter(out),
+		canonical: opts.JSONMode == extJSONCanonical,
+	}, nil
+}
+
+func newTerminalStatRecorder(opts StatOptions, out io.WriteCloser) (StatRecorder, error) {
+	return &TerminalStatRecorder{
+		out:       out,
+		truncate:  !opts.NoTruncate,
+		format:    opts.Format,
+		canonical: opts.JSONMode == extJSONCanonical,
+	}, nil
+}
+
+func newBufferedStatRecorder(opts StatOptions, out io.WriteCloser) (StatRecorder, error) {
+	maxBuffered := opts.BufferedMax
+	if maxBuffered == 0 {
+		maxBuffered = defaultBufferedStatsMax
+	}
+	return &BufferedStatRecorder{
+		Buffer:      []OpStat{},
+		MaxBuffered: maxBuffered,
+		SpoolDir:    opts.BufferedSpoolDir,
+	}, nil
+}
+
+// csvStatColumns are the columns written by the CSVStatRecorder.
+var csvStatColumns = []string{"order", "played_at", "connection_num", "op", "command", "ns",
+	"latency_us", "playbacklag_us", "nreturned", "errors", "msg"}
+
+// CSVStatRecorder records stats as comma-separated values, one row per op,
+// omitting the request and reply payloads.
+type CSVStatRecorder struct {
+	out    io.WriteCloser
+	writer *csv.Writer
+}
+
+func newCSVStatRecorder(opts StatOptions, out io.WriteCloser) (StatRecorder, error) {
+	out = newSyncingWriter(out)
+	writer := csv.NewWriter(out)
+	if err := writer.Write(csvStatColumns); err != nil {
+		return nil, err
+	}
+	return &CSVStatRecorder{
+		out:    out,
+		writer: writer,
+	}, nil
+}
+
+// RecordStat records the stat as a row
+func (csr *CSVStatRecorder) RecordStat(stat *OpStat) {
+	if stat == nil {
+		return
+	}
+	var playedAt string
+	if stat.PlayedAt != nil {
+		playedAt = stat.PlayedAt.Format(time.RFC3339Nano)
+	}
+	errs := make([]string, len(stat.Errors))
+	for i, err := range stat.Errors {
+		errs[i] = err.Error()
+	}
+	err := csr.writer.Write([]string{
+		strconv.FormatInt(stat.Order, 10),
+		playedAt,
+		strconv.FormatInt(stat.ConnectionNum, 10),
+		stat.OpType,
+		stat.Command,
+		stat.Ns,
+		strconv.FormatInt(stat.LatencyMicros, 10),
+		strconv.FormatInt(stat.PlaybackLagMicros, 10),
+		strconv.Itoa(stat.NumReturned),
+		strings.Join(errs, "; "),
+		stat.Message,
+	})
+	if err != nil {
+		toolDebugLogger.Logvf(Always, "error recording stat: %v", err)
+	}
+}
+
+// Flush writes out the rows recorded.
+func (csr *CSVStatRecorder) Flush() error {
+	csr.writer.Flush()
+	if err := csr.writer.Error(); err != nil {
+		return err
+	}
+	if flusher, ok := csr.out.(StatFlusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// Close flushes and closes the CSVStatRecorder
+func (csr *CSVStatRecorder) Close() error {
+	csr.writer.Flush()
+	err := csr.writer.Error()
+	if closeErr := csr.out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// prometheusLatencyBuckets are the upper bounds, in seconds, of the buckets
+// of the latency histogram written by the PrometheusStatRecorder.
+var prometheusLatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// opMetrics accumulates the metrics of the ops with the same name.
+type opMetrics struct {
+	count        int64
+	errors       int64
+	buckets      []int64
+	latencyCount int64
+	latencySum   float64
+}
+
+// PrometheusStatRecorder aggregates stats by command, or by op type for ops
+// which are not commands, and writes them in the Prometheus text exposition
+// format when closed, e.g. for the textfile collector of node_exporter.
+type PrometheusStatRecorder struct {
+	out     io.WriteCloser
+	metrics map[string]*opMetrics
+}
+
+func newPrometheusStatRecorder(opts StatOptions, out io.WriteCloser) (StatRecorder, error) {
+	return &PrometheusStatRecorder{
+		out:     out,
+		metrics: map[string]*opMetrics{},
+	}, nil
+}
+
+// RecordStat adds the stat to the metrics of its op
+func (psr *PrometheusStatRecorder) RecordStat(stat *OpStat) {
+	if stat == nil {
+		return
+	}
+	name := stat.Command
+	if name == "" {
+		name = stat.OpType
+	}
+	metrics, ok := psr.metrics[name]
+	if !ok {
+		metrics = &opMetrics{buckets: make([]int64, len(prometheusLatencyBuckets))}
+		psr.metrics[name] = metrics
+	}
+	metrics.count++
+	if len(stat.Errors) > 0 {
+		metrics.errors++
+	}
+	if stat.LatencyMicros <= 0 {
+		return
+	}
+	latency := float64(stat.LatencyMicros) / 1e6
+	for i, bound := range prometheusLatencyBuckets {
+		if latency <= bound {
+			metrics.buckets[i]++
+		}
+	}
+	metrics.latencyCount++
+	metrics.latencySum += latency
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Close writes the metrics and closes the PrometheusStatRecorder
+func (psr *PrometheusStatRecorder) Close() error {
+	names := make([]string, 0, len(psr.metrics))
+	for name := range psr.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := bufio.NewWriter(psr.out)
+	fmt.Fprintln(w, "# HELP mongoreplay_ops_total Number of ops recorded.")
+	fmt.Fprintln(w, "# TYPE mongoreplay_ops_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "mongoreplay_ops_total{op=\"%v\"} %v\n", prometheusLabelEscaper.Replace(name), psr.metrics[name].count)
+	}
+	fmt.Fprintln(w, "# HELP mongoreplay_op_errors_total Number of ops which received errors.")
+	fmt.Fprintln(w, "# TYPE mongoreplay_op_errors_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "mongoreplay_op_errors_total{op=\"%v\"} %v\n", prometheusLabelEscaper.Replace(name), psr.metrics[name].errors)
+	}
+	fmt.Fprintln(w, "# HELP mongoreplay_op_latency_seconds Latency of the ops which received replies.")
+	fmt.Fprintln(w, "# TYPE mongoreplay_op_latency_seconds histogram")
+	for _, name := range names {
+		metrics := psr.metrics[name]
+		label := prometheusLabelEscaper.Replace(name)
+		for i, bound := range prometheusLatencyBuckets {
+			fmt.Fprintf(w, "mongoreplay_op_latency_seconds_bucket{op=\"%v\",le=\"%v\"} %v\n",
+				label, strconv.FormatFloat(bound, 'g', -1, 64), metrics.buckets[i])
+		}
+		fmt.Fprintf(w, "mongoreplay_op_latency_seconds_bucket{op=\"%v\",le=\"+Inf\"} %v\n", label, metrics.latencyCount)
+		fmt.Fprintf(w, "mongoreplay_op_latency_seconds_sum{op=\"%v\"} %v\n", label,
+			strconv.FormatFloat(metrics.latencySum, 'g', -1, 64))
+		fmt.Fprintf(w, "mongoreplay_op_latency_seconds_count{op=\"%v\"} %v\n", label, metrics.latencyCount)
+	}
+
+	err := w.Flush()
+	if closeErr := psr.out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSVStatRecorder(t *testing.T) {
+	out := &bytes.Buffer{}
+	rec, err := newCSVStatRecorder(StatOptions{}, NopWriteCloser(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	playedAt := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	rec.RecordStat(&OpStat{
+		Order:         7,
+		PlayedAt:      &playedAt,
+		ConnectionNum: 2,
+		OpType:        "op_msg",
+		Command:       "find",
+		Ns:            "test.c",
+		LatencyMicros: 1500,
+		Errors:        []error{fmt.Errorf("bad, very bad")},
+	})
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "order,played_at,connection_num,op,command,ns,latency_us,playbacklag_us,nreturned,errors,msg\n" +
+		"7,2017-01-02T03:04:05Z,2,op_msg,find,test.c,1500,0,0,\"bad, very bad\",\n"
+	if out.String() != expected {
+		t.Errorf("unexpected csv output:\n%v", out.String())
+	}
+}
+
+func TestPrometheusStatRecorder(t *testing.T) {
+	out := &bytes.Buffer{}
+	rec, _ := newPrometheusStatRecorder(StatOptions{}, NopWriteCloser(out))
+	rec.RecordStat(&OpStat{OpType: "op_msg", Command: "find", LatencyMicros: 2000})
+	rec.RecordStat(&OpStat{OpType: "op_msg", Command: "find", LatencyMicros: 20000, Errors: []error{fmt.Errorf("e")}})
+	rec.RecordStat(&OpStat{OpType: "insert"})
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{
+		`mongoreplay_ops_total{op="find"} 2`,
+		`mongoreplay_ops_total{op="insert"} 1`,
+		`mongoreplay_op_errors_total{op="find"} 1`,
+		`mongoreplay_op_latency_seconds_bucket{op="find",le="0.001"} 0`,
+		`mongoreplay_op_latency_seconds_bucket{op="find",le="0.0025"} 1`,
+		`mongoreplay_op_latency_seconds_bucket{op="find",le="0.025"} 2`,
+		`mongoreplay_op_latency_seconds_bucket{op="find",le="+Inf"} 2`,
+		`mongoreplay_op_latency_seconds_sum{op="find"} 0.022`,
+		`mongoreplay_op_latency_seconds_count{op="insert"} 0`,
+	}
+	for _, line := range lines {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("expected line %v in output:\n%v", line, out.String())
+		}
+	}
+}
+
+type countingStatRecorder struct {
+	count int
+}
+
+func (csr *countingStatRecorder) RecordStat(stat *OpStat) { csr.count++ }
+func (csr *countingStatRecorder) Close() error            { return nil }
+
+func TestRegisterStatRecorder(t *testing.T) {
+	counter := &countingStatRecorder{}
+	RegisterStatRecorder("counting", func(opts StatOptions, out io.WriteCloser) (StatRecorder, error) {
+		return counter, nil
+	})
+	defer func() {
+		statRecordersLock.Lock()
+		delete(statRecorders, "counting")
+		statRecordersLock.Unlock()
+	}()
+
+	names := strings.Join(StatRecorderNames(), ",")
+	if names != "buffered,counting,csv,format,json,mongodb,prometheus,sqlite" {
+		t.Errorf("unexpected stat recorder names %v", names)
+	}
+	statColl, err := NewStatCollector(StatOptions{}, "counting", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statColl.StatRecorder != counter {
+		t.Errorf("expected the registered StatRecorder to be used")
+	}
+	if _, err := NewStatCollector(StatOptions{}, "nonexistent", true, false); err == nil {
+		t.Errorf("expected an error for an unknown stat collection format")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected registering a name twice to panic")
+			}
+		}()
+		RegisterStatRecorder("json", newJSONStatRecorder)
+	}()
+}
@@ -0,0 +1,178 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// defaultBufferedStatsMax is the number of stats a BufferedStatRecorder
+// created by NewStatCollector keeps in memory before spooling the rest.
+const defaultBufferedStatsMax = 100000
+
+// spooledStat is an OpStat as written to a statSpool, with its request and
+// reply data as BSON and its errors as their messages.
+type spooledStat struct {
+	OpStat
+	RequestData *spooledData `json:"request_data,omitempty"`
+	ReplyData   *spooledData `json:"reply_data,omitempty"`
+	Errors      []string     `json:"errors,omitempty"`
+}
+
+// spooledData is the request or reply data of a spooled stat, as the BSON
+// of a document holding it in its "data" field, so that it is read back
+// with the types the bson package decodes it with. Map is set for the data
+// which were maps, which are read back as maps rather than as bson.Ds.
+type spooledData struct {
+	BSON []byte `json:"bson"`
+	Map  bool   `json:"map,omitempty"`
+}
+
+func newSpooledData(data interface{}) (*spooledData, error) {
+	raw, err := bson.Marshal(bson.D{{"data", data}})
+	if err != nil {
+		return nil, fmt.Errorf("error spooling stat data: %v", err)
+	}
+	spooled := &spooledData{BSON: raw}
+	switch data.(type) {
+	case map[string]interface{}, bson.M:
+		spooled.Map = true
+	}
+	return spooled, nil
+}
+
+// data returns the data as they were before they were spooled.
+func (spooled *spooledData) data() (interface{}, error) {
+	var doc bson.D
+	if err := bson.Unmarshal(spooled.BSON, &doc); err != nil || len(doc) == 0 {
+		return nil, err
+	}
+	if fields, ok := doc[0].Value.(bson.D); ok && spooled.Map {
+		m := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			m[field.Name] = field.Value
+		}
+		return m, nil
+	}
+	return doc[0].Value, nil
+}
+
+// statSpool is the temporary file to which a BufferedStatRecorder writes the
+// stats recorded once its buffer is full, one json document per line. The
+// file is created when it is first written to.
+type statSpool struct {
+	dir    string
+	file   *os.File
+	writer *bufio.Writer
+	count  int
+}
+
+// write appends the stat to the spool.
+func (s *statSpool) write(stat *OpStat) error {
+	if s.file == nil {
+		file, err := ioutil.TempFile(s.dir, "mongoreplay-stats-")
+		if err != nil {
+			return fmt.Errorf("error creating stat spool file: %v", err)
+		}
+		s.file = file
+		s.writer = bufio.NewWriter(file)
+	}
+	spooled := spooledStat{OpStat: *stat}
+	var err error
+	if stat.RequestData != nil {
+		if spooled.RequestData, err = newSpooledData(stat.RequestData); err != nil {
+			return err
+		}
+	}
+	if stat.ReplyData != nil {
+		if spooled.ReplyData, err = newSpooledData(stat.ReplyData); err != nil {
+			return err
+		}
+	}
+	for _, err := range stat.Errors {
+		spooled.Errors = append(spooled.Errors, err.Error())
+	}
+	line, err := json.Marshal(spooled)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := s.writer.Write(line); err != nil {
+		return fmt.Errorf("error writing to stat spool file: %v", err)
+	}
+	s.count++
+	return nil
+}
+
+// flush writes the stats buffered by the writer of the spool to its file.
+func (s *statSpool) flush() error {
+	if s.writer == nil {
+		return nil
+	}
+	return s.writer.Flush()
+}
+
+// forEach calls fn with each stat of the spool in the order they were
+// written, stopping at the first error fn returns.
+func (s *statSpool) forEach(fn func(stat *OpStat) error) error {
+	if s.file == nil {
+		return nil
+	}
+	if err := s.flush(); err != nil {
+		return fmt.Errorf("error writing to stat spool file: %v", err)
+	}
+	file, err := os.Open(s.file.Name())
+	if err != nil {
+		return fmt.Errorf("error reading stat spool file: %v", err)
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for {
+		var spooled spooledStat
+		if err := decoder.Decode(&spooled); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading stat spool file: %v", err)
+		}
+		stat := spooled.OpStat
+		if spooled.RequestData != nil {
+			if stat.RequestData, err = spooled.RequestData.data(); err != nil {
+				return fmt.Errorf("error reading stat spool file: %v", err)
+			}
+		}
+		if spooled.ReplyData != nil {
+			if stat.ReplyData, err = spooled.ReplyData.data(); err != nil {
+				return fmt.Errorf("error reading stat spool file: %v", err)
+			}
+		}
+		for _, message := range spooled.Errors {
+			stat.Errors = append(stat.Errors, errors.New(message))
+		}
+		if err := fn(&stat); err != nil {
+			return err
+		}
+	}
+}
+
+// remove closes and removes the spool file, if it was created.
+func (s *statSpool) remove() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	err := os.Remove(s.file.Name())
+	s.file, s.writer, s.count = nil, nil, 0
+	return err
+}
@@ -0,0 +1,118 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestBufferedStatRecorderSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stat_spool_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	recorder := &BufferedStatRecorder{MaxBuffered: 4, SpoolDir: dir}
+	playedAt := time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		stat := &OpStat{
+			Order:         int64(i),
+			OpType:        "op_msg",
+			Command:       "find",
+			Ns:            "test.c",
+			LatencyMicros: int64(i * 10),
+			PlayedAt:      &playedAt,
+			RequestData:   bson.D{{Name: "find", Value: "c"}, {Name: "limit", Value: int64(i)}},
+			ReplyData:     map[string]interface{}{"cursor": bson.D{{Name: "id", Value: int64(i)}}, "ok": 1},
+		}
+		if i%3 == 0 {
+			stat.Errors = []error{fmt.Errorf("error %v", i)}
+		}
+		recorder.RecordStat(stat)
+	}
+
+	if len(recorder.Buffer) != 4 {
+		t.Errorf("expected 4 stats to be buffered, got %v", len(recorder.Buffer))
+	}
+	if recorder.Len() != 10 {
+		t.Errorf("expected 10 stats to be recorded, got %v", recorder.Len())
+	}
+	var order int64
+	err = recorder.ForEach(func(stat *OpStat) error {
+		if stat.Order != order || stat.LatencyMicros != order*10 || !stat.PlayedAt.Equal(playedAt) {
+			t.Errorf("unexpected stat %v: %+v", order, stat)
+		}
+		if (order%3 == 0) != (len(stat.Errors) == 1) {
+			t.Errorf("unexpected errors of stat %v: %v", order, stat.Errors)
+		} else if len(stat.Errors) == 1 && stat.Errors[0].Error() != fmt.Sprintf("error %v", order) {
+			t.Errorf("unexpected error of stat %v: %v", order, stat.Errors[0])
+		}
+		// the spooled data are read back with their types
+		request, ok := stat.RequestData.(bson.D)
+		if !ok || len(request) != 2 || request[1].Value != order {
+			t.Errorf("expected the request of stat %v, got %#v", order, stat.RequestData)
+		}
+		reply, ok := stat.ReplyData.(map[string]interface{})
+		if !ok || reply["ok"] != 1 {
+			t.Errorf("expected the reply of stat %v, got %#v", order, stat.ReplyData)
+		} else if cursor, ok := reply["cursor"].(bson.D); !ok || cursor[0].Value != order {
+			t.Errorf("expected the cursor of stat %v, got %#v", order, reply["cursor"])
+		}
+		order++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if order != 10 {
+		t.Errorf("expected to iterate over 10 stats, got %v", order)
+	}
+
+	stop := fmt.Errorf("stop")
+	var seen int
+	err = recorder.ForEach(func(stat *OpStat) error {
+		seen++
+		if seen == 6 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || seen != 6 {
+		t.Errorf("expected iteration to stop at the 6th stat, got %v after %v", err, seen)
+	}
+
+	// closing the recorder removes the spool
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected a spool file, found %v files", len(files))
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected the spool to be removed, found %v files", len(files))
+	}
+}
+
+func TestBufferedStatRecorderUnbounded(t *testing.T) {
+	recorder := &BufferedStatRecorder{}
+	for i := 0; i < 1000; i++ {
+		recorder.RecordStat(&OpStat{Order: int64(i)})
+	}
+	if len(recorder.Buffer) != 1000 || recorder.Len() != 1000 {
+		t.Errorf("expected every stat to be buffered, got %v of %v", len(recorder.Buffer), recorder.Len())
+	}
+	if err := recorder.Remove(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
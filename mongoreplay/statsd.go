@@ -0,0 +1,195 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// statsDDatagramMaxSize is the size of the datagrams recommended by
+	// StatsD, keeping them within the MTU of most networks.
+	statsDDatagramMaxSize = 1432
+
+	// statsDFlushInterval bounds how long counts and latencies wait to be
+	// sent, as long as stats keep being recorded.
+	statsDFlushInterval = time.Second
+)
+
+// StatsDRecorder implements the StatRecorder interface, sending metrics to a
+// StatsD server while playback runs:
+//
+//	<prefix>.ops      counter, the number of ops played
+//	<prefix>.errors   counter, the number of ops which received errors
+//	<prefix>.latency  timer, the latency in milliseconds of the ops which
+//	                  received replies
+//
+// The metrics are kept apart by the command of the op, or its op type for
+// ops which are not commands. It is appended to the metric name, e.g.
+// mongoreplay.ops.find, or sent as the op tag in the DogStatsD format. The
+// counts are summed between flushes, while every latency is sent.
+type StatsDRecorder struct {
+	conn      net.Conn
+	prefix    string
+	dogStatsD bool
+	tags      string
+
+	counts    map[statsDMetric]int64
+	buf       []byte
+	flushedAt time.Time
+}
+
+// statsDMetric is a metric of the ops of one command or op type.
+type statsDMetric struct {
+	name, op string
+}
+
+// validateStatsDOptions checks that the options refining --statsd are used
+// along with it.
+func validateStatsDOptions(opts StatOptions) error {
+	switch {
+	case opts.StatsD == "" && opts.DogStatsD:
+		return fmt.Errorf("--statsd is required when using --dogstatsd")
+	case !opts.DogStatsD && len(opts.StatsDTags) > 0:
+		return fmt.Errorf("--dogstatsd is required when using --statsdTag")
+	}
+	for _, tag := range opts.StatsDTags {
+		if tag == "" || strings.ContainsAny(tag, ",|#\n") {
+			return fmt.Errorf("Invalid setting for --statsdTag: '%v' is not <key>:<value>", tag)
+		}
+	}
+	return nil
+}
+
+// NewStatsDRecorder creates a StatsDRecorder sending to address the metrics
+// named after prefix. In the DogStatsD format, the tags are added to every
+// metric.
+func NewStatsDRecorder(address, prefix string, dogStatsD bool, tags []string) (*StatsDRecorder, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &StatsDRecorder{
+		conn:      conn,
+		prefix:    prefix,
+		dogStatsD: dogStatsD,
+		tags:      strings.Join(tags, ","),
+		counts:    map[statsDMetric]int64{},
+		buf:       make([]byte, 0, statsDDatagramMaxSize),
+		flushedAt: time.Now(),
+	}, nil
+}
+
+// RecordStat counts the stat's op and sends its latency, sending the counts
+// once they have waited long enough.
+func (sdr *StatsDRecorder) RecordStat(stat *OpStat) {
+	if stat == nil {
+		return
+	}
+	op := stat.Command
+	if op == "" {
+		op = stat.OpType
+	}
+	op = statsDName(op)
+	sdr.counts[statsDMetric{"ops", op}]++
+	if len(stat.Errors) > 0 {
+		sdr.counts[statsDMetric{"errors", op}]++
+	}
+	if stat.LatencyMicros > 0 {
+		latency := strconv.FormatFloat(float64(stat.LatencyMicros)/1000, 'f', -1, 64)
+		sdr.write(statsDMetric{"latency", op}, latency, "ms")
+	}
+	if time.Since(sdr.flushedAt) >= statsDFlushInterval {
+		sdr.flush()
+	}
+}
+
+// write adds a value of the metric to the datagram being filled, sending
+// the datagram first if the value doesn't fit.
+func (sdr *StatsDRecorder) write(metric statsDMetric, value, kind string) {
+	var line string
+	if sdr.dogStatsD {
+		line = fmt.Sprintf("%v%v:%v|%v|#op:%v", sdr.prefix, metric.name, value, kind, metric.op)
+		if sdr.tags != "" {
+			line += "," + sdr.tags
+		}
+	} else {
+		line = fmt.Sprintf("%v%v.%v:%v|%v", sdr.prefix, metric.name, metric.op, value, kind)
+	}
+	if len(sdr.buf) > 0 && len(sdr.buf)+1+len(line) > statsDDatagramMaxSize {
+		sdr.send()
+	}
+	if len(sdr.buf) > 0 {
+		sdr.buf = append(sdr.buf, '\n')
+	}
+	sdr.buf = append(sdr.buf, line...)
+}
+
+// flush writes the counts summed since the last flush and sends the
+// datagram being filled.
+func (sdr *StatsDRecorder) flush() {
+	metrics := make([]statsDMetric, 0, len(sdr.counts))
+	for metric := range sdr.counts {
+		metrics = append(metrics, metric)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].name != metrics[j].name {
+			return metrics[i].name < metrics[j].name
+		}
+		return metrics[i].op < metrics[j].op
+	})
+	for _, metric := range metrics {
+		sdr.write(metric, strconv.FormatInt(sdr.counts[metric], 10), "c")
+		delete(sdr.counts, metric)
+	}
+	sdr.send()
+	sdr.flushedAt = time.Now()
+}
+
+// send sends the datagram being filled.
+func (sdr *StatsDRecorder) send() {
+	if len(sdr.buf) == 0 {
+		return
+	}
+	if _, err := sdr.conn.Write(sdr.buf); err != nil {
+		toolDebugLogger.Logvf(DebugLow, "error sending metrics to StatsD: %v", err)
+	}
+	sdr.buf = sdr.buf[:0]
+}
+
+// Flush sends the counts summed since the last flush.
+func (sdr *StatsDRecorder) Flush() error {
+	sdr.flush()
+	return nil
+}
+
+// Close sends the remaining metrics and closes the StatsDRecorder.
+func (sdr *StatsDRecorder) Close() error {
+	sdr.flush()
+	return sdr.conn.Close()
+}
+
+// statsDName replaces the characters of s which have a meaning in the
+// StatsD protocol, or separate the parts of Graphite metric names, with
+// underscores.
+func statsDName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
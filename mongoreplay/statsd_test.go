@@ -0,0 +1,138 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsDRecorder(t *testing.T) {
+	type testCase struct {
+		name      string
+		dogStatsD bool
+		tags      []string
+		expected  []string
+	}
+	cases := []testCase{
+		{
+			name: "StatsD",
+			expected: []string{
+				"mongoreplay.latency.find:1.5|ms",
+				"mongoreplay.latency.find:0.25|ms",
+				"mongoreplay.errors.find:1|c",
+				"mongoreplay.ops.find:2|c",
+				"mongoreplay.ops.op_query:1|c",
+				"mongoreplay.ops.weird_name_:1|c",
+			},
+		},
+		{
+			name:      "DogStatsD",
+			dogStatsD: true,
+			tags:      []string{"env:test", "run"},
+			expected: []string{
+				"mongoreplay.latency:1.5|ms|#op:find,env:test,run",
+				"mongoreplay.latency:0.25|ms|#op:find,env:test,run",
+				"mongoreplay.errors:1|c|#op:find,env:test,run",
+				"mongoreplay.ops:2|c|#op:find,env:test,run",
+				"mongoreplay.ops:1|c|#op:op_query,env:test,run",
+				"mongoreplay.ops:1|c|#op:weird_name_,env:test,run",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder, err := NewStatsDRecorder(listener.LocalAddr().String(), "mongoreplay", c.dogStatsD, c.tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := []*OpStat{
+			{OpType: "op_msg", Command: "find", LatencyMicros: 1500},
+			{OpType: "op_msg", Command: "find", LatencyMicros: 250, Errors: []error{fmt.Errorf("failed")}},
+			// ops without a reply are counted without a latency
+			{OpType: "op_query"},
+			{OpType: "op_msg", Command: "weird.name|"},
+		}
+		for _, stat := range stats {
+			recorder.RecordStat(stat)
+		}
+		if err := recorder.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, statsDDatagramMaxSize)
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := listener.ReadFrom(buf)
+		listener.Close()
+		if err != nil {
+			t.Fatalf("error reading datagram: %v", err)
+		}
+		if lines := strings.Split(string(buf[:n]), "\n"); strings.Join(lines, "\n") != strings.Join(c.expected, "\n") {
+			t.Errorf("expected %q, got %q", c.expected, lines)
+		}
+	}
+}
+
+func TestStatsDRecorderDatagramSize(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	recorder, err := NewStatsDRecorder(listener.LocalAddr().String(), "mongoreplay", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		recorder.RecordStat(&OpStat{OpType: "op_msg", Command: "find", LatencyMicros: 1000})
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	latencies := 0
+	buf := make([]byte, 2*statsDDatagramMaxSize)
+	for latencies < 200 {
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("error reading datagram after %v latencies: %v", latencies, err)
+		}
+		if n > statsDDatagramMaxSize {
+			t.Errorf("expected datagrams of at most %v bytes, got %v", statsDDatagramMaxSize, n)
+		}
+		latencies += strings.Count(string(buf[:n]), "|ms")
+	}
+}
+
+func TestStatsDOptions(t *testing.T) {
+	type testCase struct {
+		name  string
+		opts  StatOptions
+		valid bool
+	}
+	cases := []testCase{
+		{"StatsD", StatOptions{StatsD: "localhost:8125"}, true},
+		{"DogStatsD with tags", StatOptions{StatsD: "localhost:8125", DogStatsD: true, StatsDTags: []string{"env:test"}}, true},
+		{"DogStatsD without --statsd", StatOptions{DogStatsD: true}, false},
+		{"tags without --dogstatsd", StatOptions{StatsD: "localhost:8125", StatsDTags: []string{"env:test"}}, false},
+		{"tag with a comma", StatOptions{StatsD: "localhost:8125", DogStatsD: true, StatsDTags: []string{"a:b,c"}}, false},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		if err := validateStatsDOptions(c.opts); (err == nil) != c.valid {
+			t.Errorf("expected valid %v, got error %v", c.valid, err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"sync/atomic"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// getLastErrorFor returns the getLastError command which waits until the
+// legacy write op has been applied, or nil if op is acknowledged by a reply
+// of its own.
+func getLastErrorFor(op Op) *QueryOp {
+	var collection string
+	switch castOp := op.(type) {
+	case *InsertOp:
+		collection = castOp.Collection
+	case *UpdateOp:
+		collection = castOp.Collection
+	case *DeleteOp:
+		collection = castOp.Collection
+	default:
+		return nil
+	}
+	database, _ := splitNamespace(collection)
+	return &QueryOp{QueryOp: mgo.QueryOp{
+		Collection: database + ".$cmd",
+		Query:      bson.D{{"getLastError", 1}},
+		Limit:      -1,
+	}}
+}
+
+// acknowledge waits until op has been applied if it is a legacy write,
+// which the server doesn't reply to, so that the next op of its connection
+// isn't played before it is.
+func acknowledge(op Op, socket *mgo.MongoSocket) error {
+	getLastError := getLastErrorFor(op)
+	if getLastError == nil {
+		return nil
+	}
+	_, err := getLastError.Execute(socket)
+	return err
+}
+
+// BrokenConnectionOps returns the number of ops that were not played because
+// an earlier op of their connection failed with a network error while ops
+// were played in strict order.
+func (context *ExecutionContext) BrokenConnectionOps() int64 {
+	return atomic.LoadInt64(&context.brokenConnectionOps)
+}
@@ -0,0 +1,47 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestGetLastErrorFor(t *testing.T) {
+	type testCase struct {
+		name       string
+		op         Op
+		collection string
+	}
+	cases := []testCase{
+		{name: "insert", op: &InsertOp{InsertOp: mgo.InsertOp{Collection: "app.users"}}, collection: "app.$cmd"},
+		{name: "update", op: &UpdateOp{UpdateOp: mgo.UpdateOp{Collection: "app.users.archive"}}, collection: "app.$cmd"},
+		{name: "delete", op: &DeleteOp{DeleteOp: mgo.DeleteOp{Collection: "app.users"}}, collection: "app.$cmd"},
+		{name: "acknowledged op", op: &MsgOp{}},
+		{name: "query", op: &QueryOp{QueryOp: mgo.QueryOp{Collection: "app.users"}}},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		getLastError := getLastErrorFor(c.op)
+		if c.collection == "" {
+			if getLastError != nil {
+				t.Errorf("expected no getLastError, got one on %v", getLastError.Collection)
+			}
+			continue
+		}
+		if getLastError == nil {
+			t.Errorf("expected a getLastError on %v", c.collection)
+			continue
+		}
+		query, ok := getLastError.Query.(bson.D)
+		if getLastError.Collection != c.collection || !ok || len(query) != 1 || query[0].Name != "getLastError" {
+			t.Errorf("expected a getLastError on %v, got %v on %v", c.collection, getLastError.Query, getLastError.Collection)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+	"github.com/patrickmn/go-cache"
+)
+
+// ErrWaitBudgetSpent is returned when a getMore of a tailable cursor is not
+// played because the getMores of its cursor have waited for the whole
+// --tailableBudget.
+var ErrWaitBudgetSpent = fmt.Errorf("getMore of a tailable cursor past its wait budget skipped")
+
+// defaultAwaitTime is how long the server waits for new results on the
+// getMores of awaitData cursors which don't set maxTimeMS.
+const defaultAwaitTime = time.Second
+
+// tailableCursor is a live tailable cursor, whose getMores wait for new
+// results rather than return when they reach the end of its collection.
+type tailableCursor struct {
+	awaitData bool
+
+	sync.Mutex
+	// waited is how long the getMores of the cursor have taken in total.
+	waited time.Duration
+}
+
+// tailableQuery returns whether op creates a tailable cursor, and whether
+// the cursor's getMores await new results. The cursors of change streams
+// are tailable awaitData cursors.
+func tailableQuery(op Op) (tailable, awaitData bool) {
+	if isChangeStream(op) {
+		return true, true
+	}
+	switch castOp := op.(type) {
+	case *QueryOp:
+		return castOp.Flags&queryFlagTailable != 0, castOp.Flags&queryFlagAwaitData != 0
+	case *MsgOp:
+		if castOp.CommandName != "find" {
+			return false, false
+		}
+		payload, _, err := fetchPayload0Data(castOp.Sections)
+		if err != nil {
+			return false, false
+		}
+		body, err := bsonToD(payload)
+		if err != nil {
+			return false, false
+		}
+		tailableValue, _ := FindValueByKey("tailable", &body)
+		awaitDataValue, _ := FindValueByKey("awaitData", &body)
+		return tailableValue == true, tailableValue == true && awaitDataValue == true
+	}
+	return false, false
+}
+
+// tracksTailable returns whether the waits of tailable cursors are bounded.
+func (context *ExecutionContext) tracksTailable() bool {
+	return context.tailableCursors != nil
+}
+
+// trackTailable keeps the live cursor created by op if it is tailable.
+func (context *ExecutionContext) trackTailable(op Op, reply Replyable) {
+	if reply == nil {
+		return
+	}
+	tailable, awaitData := tailableQuery(op)
+	if !tailable {
+		return
+	}
+	if cursorID, err := reply.getCursorID(); err == nil && cursorID != 0 {
+		context.tailableCursors.Set(strconv.FormatInt(cursorID, 10), &tailableCursor{awaitData: awaitData}, cache.DefaultExpiration)
+	}
+}
+
+// boundTailableWait returns the tailable cursor a getMore continues, if any,
+// once its cursors have been rewritten to the live ones, and the getMore to
+// play. It returns ErrWaitBudgetSpent if the cursor's getMores have waited
+// for the whole --tailableBudget, and otherwise lowers the time a getMore of
+// an awaitData cursor waits for new results to --maxAwait, or to what is
+// left of the budget. The wait of a legacy OP_GET_MORE can't be set, so it
+// is played as the equivalent OP_MSG getMore, unless the server only speaks
+// the legacy opcodes.
+func (context *ExecutionContext) boundTailableWait(op Op) (Op, *tailableCursor, error) {
+	_, cursorID, ok := getMoreCursor(op)
+	if !ok {
+		return op, nil, nil
+	}
+	value, ok := context.tailableCursors.Get(strconv.FormatInt(cursorID, 10))
+	if !ok {
+		return op, nil, nil
+	}
+	cursor := value.(*tailableCursor)
+	cursor.Lock()
+	waited := cursor.waited
+	cursor.Unlock()
+
+	bound := context.maxAwait
+	if context.tailableBudget > 0 {
+		if waited >= context.tailableBudget {
+			atomic.AddInt64(&context.budgetSpentGetMores, 1)
+			return op, nil, ErrWaitBudgetSpent
+		}
+		if left := context.tailableBudget - waited; bound == 0 || left < bound {
+			bound = left
+		}
+	}
+	if !cursor.awaitData || bound == 0 {
+		return op, cursor, nil
+	}
+
+	wait, err := getMoreAwaitTime(op)
+	if err != nil {
+		return op, nil, err
+	}
+	if wait <= bound {
+		return op, cursor, nil
+	}
+	// maxTimeMS is rounded up, as 0 would wait without bound
+	maxTimeMS := int64((bound + time.Millisecond - 1) / time.Millisecond)
+	switch getMore := op.(type) {
+	case *GetMoreOp:
+		if context.downconvert {
+			return op, cursor, nil
+		}
+		translated, err := translateLegacyOp(getMore)
+		if err != nil {
+			return op, nil, err
+		}
+		op = translated
+		err = setMsgOpField(&translated.(*MsgOpGetMore).MsgOp, "maxTimeMS", maxTimeMS)
+	case *MsgOpGetMore:
+		err = setMsgOpField(&getMore.MsgOp, "maxTimeMS", maxTimeMS)
+	case *CommandGetMore:
+		var args bson.D
+		if args, err = bsonToD(getMore.CommandArgs); err == nil {
+			args = setDocField(args, "maxTimeMS", maxTimeMS)
+			getMore.CommandArgs = &args
+		}
+	default:
+		return op, cursor, nil
+	}
+	if err != nil {
+		return op, nil, err
+	}
+	atomic.AddInt64(&context.truncatedWaits, 1)
+	return op, cursor, nil
+}
+
+// getMoreAwaitTime returns how long a getMore of an awaitData cursor waits
+// for new results: its maxTimeMS, if it is a command setting it, and
+// otherwise the server's default.
+func getMoreAwaitTime(op Op) (time.Duration, error) {
+	var args interface{}
+	switch getMore := op.(type) {
+	case *MsgOpGetMore:
+		payload, _, err := fetchPayload0Data(getMore.Sections)
+		if err != nil {
+			return 0, err
+		}
+		args = payload
+	case *CommandGetMore:
+		args = getMore.CommandArgs
+	default:
+		return defaultAwaitTime, nil
+	}
+	body, err := bsonToD(args)
+	if err != nil {
+		return 0, err
+	}
+	if maxTimeMS, ok := FindValueByKey("maxTimeMS", &body); ok {
+		if ms, ok := toFloat(maxTimeMS); ok {
+			return time.Duration(ms) * time.Millisecond, nil
+		}
+	}
+	return defaultAwaitTime, nil
+}
+
+// addWait adds the time a getMore of the cursor took to its waits.
+func (cursor *tailableCursor) addWait(wait time.Duration) {
+	cursor.Lock()
+	cursor.waited += wait
+	cursor.Unlock()
+}
+
+// TruncatedWaits returns the number of getMores of awaitData cursors whose
+// wait for new results was shortened by --maxAwait or --tailableBudget.
+func (context *ExecutionContext) TruncatedWaits() int64 {
+	return atomic.LoadInt64(&context.truncatedWaits)
+}
+
+// BudgetSpentGetMores returns the number of getMores of tailable cursors
+// which were not played because their cursor's wait budget was spent.
+func (context *ExecutionContext) BudgetSpentGetMores() int64 {
+	return atomic.LoadInt64(&context.budgetSpentGetMores)
+}
@@ -0,0 +1,123 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"testing"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestTailableQuery(t *testing.T) {
+	find := func(command bson.D) Op {
+		op, err := newMsgCommand("test", command)
+		if err != nil {
+			t.Fatalf("error building the command: %v", err)
+		}
+		return op
+	}
+	type testCase struct {
+		name                string
+		op                  Op
+		tailable, awaitData bool
+	}
+	cases := []testCase{
+		{name: "legacy tailable query", op: &QueryOp{QueryOp: mgo.QueryOp{Collection: "local.oplog.rs", Flags: queryFlagTailable}}, tailable: true},
+		{name: "legacy awaitData query", op: &QueryOp{QueryOp: mgo.QueryOp{Collection: "local.oplog.rs", Flags: queryFlagTailable | queryFlagAwaitData}}, tailable: true, awaitData: true},
+		{name: "tailable find", op: find(bson.D{{"find", "capped"}, {"tailable", true}, {"awaitData", true}}), tailable: true, awaitData: true},
+		{name: "find", op: find(bson.D{{"find", "c"}})},
+		{name: "change stream", op: find(bson.D{{"aggregate", "c"}, {"pipeline", []interface{}{bson.D{{"$changeStream", bson.D{}}}}}}), tailable: true, awaitData: true},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		if tailable, awaitData := tailableQuery(c.op); tailable != c.tailable || awaitData != c.awaitData {
+			t.Errorf("expected tailable %v and awaitData %v, got %v and %v", c.tailable, c.awaitData, tailable, awaitData)
+		}
+	}
+}
+
+func TestBoundTailableWait(t *testing.T) {
+	type testCase struct {
+		name                     string
+		maxAwait, tailableBudget time.Duration
+		// waited is how long the getMores of the cursor have waited, and
+		// maxTimeMS the wait of the getMore, if set
+		waited    time.Duration
+		maxTimeMS int64
+		// legacy and command play an OP_GET_MORE or OP_COMMAND getMore
+		// rather than an OP_MSG one
+		legacy, command bool
+		err             error
+		expected        int64
+		truncated       int64
+	}
+	cases := []testCase{
+		{name: "wait truncated", maxAwait: 200 * time.Millisecond, maxTimeMS: 5000, expected: 200, truncated: 1},
+		{name: "default wait truncated", maxAwait: 200 * time.Millisecond, expected: 200, truncated: 1},
+		{name: "short wait kept", maxAwait: 200 * time.Millisecond, maxTimeMS: 100, expected: 100},
+		{name: "wait bounded by budget", tailableBudget: 10 * time.Second, waited: 9500 * time.Millisecond, maxTimeMS: 5000, expected: 500, truncated: 1},
+		{name: "budget spent", tailableBudget: 10 * time.Second, waited: 10 * time.Second, maxTimeMS: 5000, err: ErrWaitBudgetSpent, expected: 5000},
+		{name: "less than a millisecond left", tailableBudget: 10 * time.Second, waited: 10*time.Second - time.Microsecond, maxTimeMS: 5000, expected: 1, truncated: 1},
+		{name: "command wait truncated", maxAwait: 200 * time.Millisecond, maxTimeMS: 5000, command: true, expected: 200, truncated: 1},
+		{name: "legacy wait truncated", maxAwait: 200 * time.Millisecond, legacy: true, expected: 200, truncated: 1},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		context := NewExecutionContext(&StatCollector{noop: true}, nil, &ExecutionOptions{maxAwait: c.maxAwait, tailableBudget: c.tailableBudget})
+		query, err := newMsgCommand("test", bson.D{{"find", "capped"}, {"tailable", true}, {"awaitData", true}})
+		if err != nil {
+			t.Fatalf("error building the query: %v", err)
+		}
+		context.trackTailable(query, msgOpReplyWith(t, bson.D{{"cursor", bson.D{{"id", int64(20)}}}, {"ok", 1}}))
+
+		command := bson.D{{"getMore", int64(20)}, {"collection", "capped"}}
+		if c.maxTimeMS > 0 {
+			command = append(command, bson.DocElem{Name: "maxTimeMS", Value: c.maxTimeMS})
+		}
+		var getMore Op
+		switch {
+		case c.legacy:
+			getMore = &GetMoreOp{GetMoreOp: mgo.GetMoreOp{Collection: "test.capped", CursorId: 20}}
+		case c.command:
+			getMore = &CommandGetMore{CommandOp: CommandOp{CommandOp: mgo.CommandOp{Database: "test", CommandName: "getMore", CommandArgs: &command}}}
+		default:
+			msgOp, err := newMsgCommand("test", command)
+			if err != nil {
+				t.Fatalf("error building the getMore: %v", err)
+			}
+			getMore = &MsgOpGetMore{MsgOp: *msgOp}
+		}
+		if c.waited > 0 {
+			value, _ := context.tailableCursors.Get("20")
+			value.(*tailableCursor).addWait(c.waited)
+		}
+		played, cursor, err := context.boundTailableWait(getMore)
+		if err != c.err {
+			t.Errorf("expected error %v, got %v", c.err, err)
+		}
+		if err == nil && cursor == nil {
+			t.Errorf("expected the cursor to be tailable")
+		}
+		var body bson.D
+		switch played := played.(type) {
+		case *MsgOpGetMore:
+			body, _ = bsonToD(played.Sections[0].Data)
+		case *CommandGetMore:
+			body, _ = bsonToD(played.CommandArgs)
+		default:
+			t.Errorf("expected the getMore to be played as a command, got %T", played)
+		}
+		if maxTimeMS, _ := FindValueByKey("maxTimeMS", &body); c.expected != 0 && maxTimeMS != c.expected {
+			t.Errorf("expected maxTimeMS %v, got %v", c.expected, maxTimeMS)
+		}
+		if truncated := context.TruncatedWaits(); truncated != c.truncated {
+			t.Errorf("expected %v truncated waits, got %v", c.truncated, truncated)
+		}
+	}
+}
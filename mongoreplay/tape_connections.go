@@ -0,0 +1,285 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// ConnectionsCommand stores settings for the mongoreplay 'connections'
+// subcommand
+type ConnectionsCommand struct {
+	GlobalOpts   *Options `no-flag:"true"`
+	PlaybackFile string   `description:"path to the playback file to analyze" short:"p" long:"playback-file" required:"yes"`
+	Top          int      `long:"top" description:"number of connections listed, busiest first; 0 lists every connection" default:"20"`
+	JSON         bool     `long:"json" description:"print the report as json"`
+	Gzip         bool     `long:"gzip" description:"decompress gzipped input"`
+}
+
+// connectionLifetime describes a recorded connection: when it was opened
+// and closed, and the ops sent on it.
+type connectionLifetime struct {
+	ConnectionNum int64  `json:"connection"`
+	Client        string `json:"client"`
+	// Opened is when the first op of the connection was seen, and Closed
+	// when the recording saw it close, which is zero for the connections
+	// still open at the end of the recording.
+	Opened   time.Time     `json:"opened"`
+	Closed   time.Time     `json:"closed"`
+	Duration time.Duration `json:"durationNanos"`
+	// Ops counts the ops sent on the connection, without their replies, and
+	// PeakRate is the most of them sent in any second.
+	Ops      int64   `json:"ops"`
+	Rate     float64 `json:"opsPerSecond"`
+	PeakRate int64   `json:"peakOpsPerSecond"`
+
+	second    time.Time
+	secondOps int64
+}
+
+// connectionReport describes the connections of a playback file, for
+// sizing the connection limits of the cluster it is played against.
+type connectionReport struct {
+	Connections int64 `json:"connections"`
+	OpenAtEnd   int64 `json:"openAtEnd"`
+	// PeakConcurrent is the most connections open at once, first reached at
+	// PeakAt, and MeanConcurrent the number open on average over the
+	// recording.
+	PeakConcurrent int64     `json:"peakConcurrent"`
+	PeakAt         time.Time `json:"peakAt"`
+	MeanConcurrent float64   `json:"meanConcurrent"`
+	// PeakOpenRate is the most connections opened in any second.
+	PeakOpenRate int64         `json:"peakOpenedPerSecond"`
+	First        time.Time     `json:"first"`
+	Last         time.Time     `json:"last"`
+	Duration     time.Duration `json:"durationNanos"`
+	// ByConnection lists the connections, those which sent the most ops
+	// first.
+	ByConnection []*connectionLifetime `json:"byConnection"`
+
+	lifetimes map[int64]*connectionLifetime
+}
+
+// ValidateParams validates the settings described in the ConnectionsCommand
+// struct.
+func (connections *ConnectionsCommand) ValidateParams(args []string) error {
+	switch {
+	case len(args) > 0:
+		return fmt.Errorf("unknown argument: %s", args[0])
+	case connections.Top < 0:
+		return fmt.Errorf("Invalid setting for --top: '%v', value must be >=0", connections.Top)
+	}
+	return nil
+}
+
+// Execute runs the program for the 'connections' subcommand
+func (connections *ConnectionsCommand) Execute(args []string) error {
+	if err := connections.ValidateParams(args); err != nil {
+		return err
+	}
+	connections.GlobalOpts.SetLogging()
+
+	reader, err := NewPlaybackFileReader(connections.PlaybackFile, connections.Gzip)
+	if err != nil {
+		return err
+	}
+	report, err := reportConnections(reader)
+	if err != nil {
+		return err
+	}
+	if connections.Top > 0 && len(report.ByConnection) > connections.Top {
+		report.ByConnection = report.ByConnection[:connections.Top]
+	}
+	if connections.JSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	writeConnectionLifetimes(os.Stdout, report)
+	return nil
+}
+
+// reportConnections reads every op of a playback file into the report of
+// its connections.
+func reportConnections(reader *PlaybackFileReader) (*connectionReport, error) {
+	report := &connectionReport{lifetimes: map[int64]*connectionLifetime{}}
+	opChan, errChan := reader.OpChan(1)
+	var parseErr error
+	for op := range opChan {
+		if parseErr != nil {
+			continue
+		}
+		var parsedOp Op
+		if !op.EOF {
+			var err error
+			if parsedOp, err = op.RawOp.Parse(); err != nil {
+				parseErr = fmt.Errorf("error parsing op %v: %v", op.Order, err)
+				continue
+			}
+		}
+		report.add(op, parsedOp)
+	}
+	if err := <-errChan; err != nil && err != io.EOF {
+		return nil, err
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	report.finish()
+	return report, nil
+}
+
+// add counts an op in the report. The EOF ops recorded as connections close
+// mark the end of their lifetime.
+func (report *connectionReport) add(op *RecordedOp, parsedOp Op) {
+	if op.Seen == nil {
+		return
+	}
+	seen := op.Seen.Time
+	if report.First.IsZero() || seen.Before(report.First) {
+		report.First = seen
+	}
+	if seen.After(report.Last) {
+		report.Last = seen
+	}
+	lifetime, ok := report.lifetimes[op.SeenConnectionNum]
+	if !ok {
+		if op.EOF {
+			return
+		}
+		lifetime = &connectionLifetime{ConnectionNum: op.SeenConnectionNum, Opened: seen}
+		report.lifetimes[op.SeenConnectionNum] = lifetime
+	}
+	if op.EOF {
+		lifetime.Closed = seen
+		return
+	}
+	// an op seen after the connection closed reopens it
+	lifetime.Closed = time.Time{}
+	if parsedOp == nil {
+		return
+	}
+	if _, ok := parsedOp.(Replyable); ok {
+		return
+	}
+	if lifetime.Client == "" {
+		lifetime.Client = op.SrcEndpoint
+	}
+	lifetime.Ops++
+	if second := seen.Truncate(time.Second); !second.Equal(lifetime.second) {
+		lifetime.second, lifetime.secondOps = second, 0
+	}
+	lifetime.secondOps++
+	if lifetime.secondOps > lifetime.PeakRate {
+		lifetime.PeakRate = lifetime.secondOps
+	}
+}
+
+// finish computes the lifetimes of the connections and their concurrency
+// once every op was added. The connections still open at the end of the
+// recording are counted as open until its last op.
+func (report *connectionReport) finish() {
+	type event struct {
+		at    time.Time
+		delta int64
+	}
+	var events []event
+	var openSeconds float64
+	opened := map[time.Time]int64{}
+	for _, lifetime := range report.lifetimes {
+		report.ByConnection = append(report.ByConnection, lifetime)
+		end := lifetime.Closed
+		if end.IsZero() {
+			report.OpenAtEnd++
+			end = report.Last
+		} else {
+			events = append(events, event{end, -1})
+		}
+		events = append(events, event{lifetime.Opened, 1})
+		lifetime.Duration = end.Sub(lifetime.Opened)
+		openSeconds += lifetime.Duration.Seconds()
+		if lifetime.Duration >= time.Second {
+			lifetime.Rate = float64(lifetime.Ops) / lifetime.Duration.Seconds()
+		} else {
+			lifetime.Rate = float64(lifetime.Ops)
+		}
+		second := lifetime.Opened.Truncate(time.Second)
+		opened[second]++
+		if opened[second] > report.PeakOpenRate {
+			report.PeakOpenRate = opened[second]
+		}
+	}
+	report.Connections = int64(len(report.lifetimes))
+	report.Duration = report.Last.Sub(report.First)
+	if report.Duration > 0 {
+		report.MeanConcurrent = openSeconds / report.Duration.Seconds()
+	} else {
+		report.MeanConcurrent = float64(report.Connections)
+	}
+
+	// connections closing when others open aren't counted as concurrent
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].at.Equal(events[j].at) {
+			return events[i].delta < events[j].delta
+		}
+		return events[i].at.Before(events[j].at)
+	})
+	var concurrent int64
+	for _, e := range events {
+		concurrent += e.delta
+		if concurrent > report.PeakConcurrent {
+			report.PeakConcurrent, report.PeakAt = concurrent, e.at
+		}
+	}
+
+	sort.Slice(report.ByConnection, func(i, j int) bool {
+		a, b := report.ByConnection[i], report.ByConnection[j]
+		if a.Ops != b.Ops {
+			return a.Ops > b.Ops
+		}
+		return a.ConnectionNum < b.ConnectionNum
+	})
+}
+
+func writeConnectionLifetimes(out io.Writer, report *connectionReport) {
+	const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "connections\t%v\n", report.Connections)
+	fmt.Fprintf(w, "open at end\t%v\n", report.OpenAtEnd)
+	if report.PeakConcurrent > 0 {
+		fmt.Fprintf(w, "peak concurrent\t%v at %v\n", report.PeakConcurrent, report.PeakAt.Format(timeFormat))
+	} else {
+		fmt.Fprintf(w, "peak concurrent\t0\n")
+	}
+	fmt.Fprintf(w, "mean concurrent\t%.1f\n", report.MeanConcurrent)
+	fmt.Fprintf(w, "peak opened/s\t%v\n", report.PeakOpenRate)
+	fmt.Fprintf(w, "duration\t%v\n", report.Duration)
+	w.Flush()
+	if len(report.ByConnection) == 0 {
+		return
+	}
+
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "connection\tclient\topened\tclosed\tduration\tops\tops/s\tpeak ops/s\n")
+	for _, lifetime := range report.ByConnection {
+		closed := "open"
+		if !lifetime.Closed.IsZero() {
+			closed = lifetime.Closed.Format(timeFormat)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%.1f\t%v\n", lifetime.ConnectionNum, lifetime.Client,
+			lifetime.Opened.Format(timeFormat), closed, lifetime.Duration.Round(time.Millisecond),
+			lifetime.Ops, lifetime.Rate, lifetime.PeakRate)
+	}
+	w.Flush()
+}
@@ -0,0 +1,99 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestConnectionReport(t *testing.T) {
+	start := testTime.Truncate(time.Second)
+	report := &connectionReport{lifetimes: map[int64]*connectionLifetime{}}
+	find := msgOpWithDoc(t, "test", bson.D{{"find", "c"}})
+	var reply Op = msgOpReplyWith(t, bson.D{{"ok", 1}})
+	add := func(connection int64, at time.Duration, parsedOp Op) {
+		op := &RecordedOp{Seen: &PreciseTime{start.Add(at)}, SeenConnectionNum: connection,
+			SrcEndpoint: "10.0.0.1:5000", EOF: parsedOp == nil}
+		report.add(op, parsedOp)
+	}
+	// connection 1 is open for 4s, with 3 ops in its first second
+	add(1, 0, &find)
+	add(1, 100*time.Millisecond, reply)
+	add(1, 200*time.Millisecond, &find)
+	add(1, 300*time.Millisecond, &find)
+	add(1, 3*time.Second, &find)
+	add(1, 4*time.Second, nil)
+	// connection 2 overlaps it, and connection 3 opens as it closes
+	add(2, 500*time.Millisecond, &find)
+	add(2, 2*time.Second, nil)
+	add(3, 4*time.Second, &find)
+	add(3, 6*time.Second, &find)
+	// an EOF of a connection without ops is ignored
+	add(4, 5*time.Second, nil)
+	report.finish()
+
+	if report.Connections != 3 || report.OpenAtEnd != 1 {
+		t.Errorf("expected 3 connections with 1 open at end, got %v and %v", report.Connections, report.OpenAtEnd)
+	}
+	if report.PeakConcurrent != 2 || !report.PeakAt.Equal(start.Add(500*time.Millisecond)) {
+		t.Errorf("expected a peak of 2 connections at 500ms, got %v at %v", report.PeakConcurrent, report.PeakAt.Sub(start))
+	}
+	// 4s + 1.5s + 2s open over 6s
+	if mean := report.MeanConcurrent; mean < 1.24 || mean > 1.26 {
+		t.Errorf("expected 1.25 connections open on average, got %v", mean)
+	}
+	if report.PeakOpenRate != 2 || report.Duration != 6*time.Second {
+		t.Errorf("expected 2 connections opened in a second over 6s, got %v over %v", report.PeakOpenRate, report.Duration)
+	}
+
+	first := report.ByConnection[0]
+	if first.ConnectionNum != 1 || first.Ops != 4 || first.PeakRate != 3 || first.Rate != 1 ||
+		first.Duration != 4*time.Second || !first.Closed.Equal(start.Add(4*time.Second)) {
+		t.Errorf("unexpected lifetime of connection 1: %+v", first)
+	}
+	last := report.ByConnection[2]
+	if last.ConnectionNum != 2 || last.Ops != 1 || last.Duration != 1500*time.Millisecond {
+		t.Errorf("unexpected lifetime of connection 2: %+v", last)
+	}
+	if open := report.ByConnection[1]; !open.Closed.IsZero() || open.Duration != 2*time.Second {
+		t.Errorf("expected connection 3 to be open for 2s, got %+v", open)
+	}
+
+	out := &bytes.Buffer{}
+	writeConnectionLifetimes(out, report)
+	for _, expected := range []string{"peak concurrent  2 at", "connection  client", "\n3           10.0.0.1:5000"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in:\n%v", expected, out)
+		}
+	}
+}
+
+func TestReportConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-connections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	reader, err := NewPlaybackFileReader(writeDumpTape(t, dir), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := reportConnections(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Connections != 1 || report.ByConnection[0].Ops != 6 {
+		t.Errorf("expected the 6 ops of the playback file on 1 connection, got %+v", report)
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// DiffTapesCommand stores settings for the mongoreplay 'diff-tapes'
+// subcommand
+type DiffTapesCommand struct {
+	GlobalOpts *Options `no-flag:"true"`
+	Tolerance  string   `long:"tolerance" description:"largest difference between the shares of the ops of the two playback files that an op type, namespace or query shape may have without being reported, as a percentage (e.g. '1%') or a fraction" default:"0"`
+	JSON       bool     `long:"json" description:"print the profiles of the two playback files and their differences as json"`
+	Gzip       bool     `long:"gzip" description:"decompress gzipped input"`
+
+	tolerance float64
+}
+
+// tapeProfile summarizes the workload of a playback file.
+type tapeProfile struct {
+	Ops         int64 `json:"ops"`
+	Connections int64 `json:"connections"`
+	// ByOp counts the ops by their type and namespace, and ByShape the
+	// queries by their shape.
+	ByOp    map[string]int64 `json:"byOp"`
+	ByShape map[string]int64 `json:"byShape"`
+	// First and Last are the times the first and the last ops were seen, and
+	// PeakRate the most ops seen in any second.
+	First    time.Time     `json:"first"`
+	Last     time.Time     `json:"last"`
+	Duration time.Duration `json:"durationNanos"`
+	MeanRate float64       `json:"meanOpsPerSecond"`
+	PeakRate int64         `json:"peakOpsPerSecond"`
+
+	connections map[int64]bool
+	second      time.Time
+	secondOps   int64
+}
+
+// tapeDiffRow compares the count of an op type, namespace or query shape in
+// the two playback files.
+type tapeDiffRow struct {
+	Name   string  `json:"name"`
+	CountA int64   `json:"countA"`
+	CountB int64   `json:"countB"`
+	ShareA float64 `json:"shareA"`
+	ShareB float64 `json:"shareB"`
+}
+
+// tapeDiff is the comparison of two playback files printed by diff-tapes.
+type tapeDiff struct {
+	A       *tapeProfile  `json:"a"`
+	B       *tapeProfile  `json:"b"`
+	ByOp    []tapeDiffRow `json:"byOp"`
+	ByShape []tapeDiffRow `json:"byShape"`
+}
+
+// ValidateParams validates the settings described in the DiffTapesCommand
+// struct.
+func (diff *DiffTapesCommand) ValidateParams(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("must specify the two playback files to compare")
+	}
+	if countStdStreams(args) > 1 {
+		return fmt.Errorf("only one of the playback files compared can be read from stdin")
+	}
+	tolerance, err := parseRate(diff.Tolerance)
+	if err != nil {
+		return fmt.Errorf("Invalid setting for --tolerance: %v", err)
+	}
+	diff.tolerance = tolerance
+	return nil
+}
+
+// Execute runs the program for the 'diff-tapes' subcommand
+func (diff *DiffTapesCommand) Execute(args []string) error {
+	err := diff.ValidateParams(args)
+	if err != nil {
+		return err
+	}
+	diff.GlobalOpts.SetLogging()
+
+	var profiles [2]*tapeProfile
+	for i, file := range args {
+		reader, err := NewPlaybackFileReader(file, diff.Gzip)
+		if err != nil {
+			return fmt.Errorf("error opening %v: %v", file, err)
+		}
+		if profiles[i], err = profileTape(reader); err != nil {
+			return fmt.Errorf("error reading %v: %v", file, err)
+		}
+	}
+
+	result := diffTapeProfiles(profiles[0], profiles[1], diff.tolerance)
+	if diff.JSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	} else {
+		writeTapeDiff(os.Stdout, args[0], args[1], result)
+	}
+	if len(result.ByOp) > 0 || len(result.ByShape) > 0 {
+		return fmt.Errorf("workloads differ")
+	}
+	return nil
+}
+
+// profileTape reads every op of a playback file into its profile. Replies
+// are not counted.
+func profileTape(reader *PlaybackFileReader) (*tapeProfile, error) {
+	profile := &tapeProfile{
+		ByOp:        map[string]int64{},
+		ByShape:     map[string]int64{},
+		connections: map[int64]bool{},
+	}
+	opChan, errChan := reader.OpChan(1)
+	var parseErr error
+	for op := range opChan {
+		if parseErr != nil || op.EOF {
+			continue
+		}
+		parsedOp, err := op.RawOp.Parse()
+		if err != nil {
+			parseErr = fmt.Errorf("error parsing op %v: %v", op.Order, err)
+			continue
+		}
+		profile.add(op, parsedOp)
+	}
+	if err := <-errChan; err != nil && err != io.EOF {
+		return nil, err
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	profile.finish()
+	return profile, nil
+}
+
+// add counts an op in the profile.
+func (profile *tapeProfile) add(op *RecordedOp, parsedOp Op) {
+	if parsedOp == nil {
+		return
+	}
+	if _, ok := parsedOp.(Replyable); ok {
+		return
+	}
+	profile.Ops++
+	profile.connections[op.SeenConnectionNum] = true
+
+	meta := parsedOp.Meta()
+	name := meta.Command
+	if name == "" {
+		name = meta.Op
+	}
+	if ns := namespaceOf(parsedOp); ns != "" {
+		name += " " + ns
+	}
+	profile.ByOp[name]++
+	if shape, err := queryShapeOfOp(parsedOp); err == nil && shape != nil {
+		profile.ByShape[shape.String()]++
+	}
+
+	seen := op.Seen.Time
+	if profile.First.IsZero() || seen.Before(profile.First) {
+		profile.First = seen
+	}
+	if seen.After(profile.Last) {
+		profile.Last = seen
+	}
+	if second := seen.Truncate(time.Second); !second.Equal(profile.second) {
+		profile.second, profile.secondOps = second, 0
+	}
+	profile.secondOps++
+	if profile.secondOps > profile.PeakRate {
+		profile.PeakRate = profile.secondOps
+	}
+}
+
+// finish computes the totals of the profile once every op was added.
+func (profile *tapeProfile) finish() {
+	profile.Connections = int64(len(profile.connections))
+	profile.Duration = profile.Last.Sub(profile.First)
+	if profile.Duration > 0 {
+		profile.MeanRate = float64(profile.Ops) / profile.Duration.Seconds()
+	} else {
+		profile.MeanRate = float64(profile.Ops)
+	}
+}
+
+// diffTapeProfiles compares the op types and namespaces, and the query
+// shapes, of two profiles by their share of the ops of each, keeping those
+// whose shares differ by more than tolerance.
+func diffTapeProfiles(a, b *tapeProfile, tolerance float64) *tapeDiff {
+	return &tapeDiff{
+		A:       a,
+		B:       b,
+		ByOp:    diffCounts(a.ByOp, b.ByOp, a.Ops, b.Ops, tolerance),
+		ByShape: diffCounts(a.ByShape, b.ByShape, a.Ops, b.Ops, tolerance),
+	}
+}
+
+func diffCounts(a, b map[string]int64, totalA, totalB int64, tolerance float64) []tapeDiffRow {
+	share := func(count, total int64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(count) / float64(total)
+	}
+	var rows []tapeDiffRow
+	for _, name := range unionCountNames(a, b) {
+		row := tapeDiffRow{Name: name, CountA: a[name], CountB: b[name],
+			ShareA: share(a[name], totalA), ShareB: share(b[name], totalB)}
+		// what only one of the files has is reported whatever its share
+		if (row.CountA == 0) != (row.CountB == 0) || math.Abs(row.ShareA-row.ShareB) > tolerance {
+			rows = append(rows, row)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return math.Abs(rows[i].ShareA-rows[i].ShareB) > math.Abs(rows[j].ShareA-rows[j].ShareB)
+	})
+	return rows
+}
+
+func unionCountNames(a, b map[string]int64) []string {
+	var names []string
+	for name := range a {
+		names = append(names, name)
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeTapeDiff(out io.Writer, nameA, nameB string, diff *tapeDiff) {
+	fmt.Fprintf(out, "--- %v\n+++ %v\n", nameA, nameB)
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ops\t%v\t%v\n", diff.A.Ops, diff.B.Ops)
+	fmt.Fprintf(w, "connections\t%v\t%v\n", diff.A.Connections, diff.B.Connections)
+	fmt.Fprintf(w, "duration\t%v\t%v\n", diff.A.Duration, diff.B.Duration)
+	fmt.Fprintf(w, "mean ops/s\t%.1f\t%.1f\n", diff.A.MeanRate, diff.B.MeanRate)
+	fmt.Fprintf(w, "peak ops/s\t%v\t%v\n", diff.A.PeakRate, diff.B.PeakRate)
+	w.Flush()
+
+	for _, section := range []struct {
+		title string
+		rows  []tapeDiffRow
+		total int
+	}{
+		{"op types and namespaces", diff.ByOp, len(unionCountNames(diff.A.ByOp, diff.B.ByOp))},
+		{"query shapes", diff.ByShape, len(unionCountNames(diff.A.ByShape, diff.B.ByShape))},
+	} {
+		fmt.Fprintf(out, "\n%v: %v of %v differ\n", section.title, len(section.rows), section.total)
+		if len(section.rows) == 0 {
+			continue
+		}
+		w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		for _, row := range section.rows {
+			fmt.Fprintf(w, "  %v\t%v (%.1f%%)\t%v (%.1f%%)\n", row.Name,
+				row.CountA, row.ShareA*100, row.CountB, row.ShareB*100)
+		}
+		w.Flush()
+	}
+}
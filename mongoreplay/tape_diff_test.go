@@ -0,0 +1,109 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// writeProfiledTape writes a playback file of inserts and finds, each op
+// seen 100ms after the previous one, and returns its profile.
+func writeProfiledTape(t *testing.T, dir, name string, inserts, finds int) *tapeProfile {
+	generator := newRecordedOpGenerator()
+	if err := generator.generateInsertHelper("insert", 0, inserts); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < finds; i++ {
+		if err := generator.generateCommandFind(bson.D{{"name", "x"}}, 0, int32(100+i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := generator.generateCommandReply(int32(100+i), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(generator.opChan)
+
+	path := filepath.Join(dir, name)
+	w, err := NewPlaybackFileWriter(path, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var i int
+	for op := range generator.opChan {
+		op.Seen = &PreciseTime{testTime.Truncate(time.Second).Add(time.Duration(i) * 100 * time.Millisecond)}
+		op.SeenConnectionNum = int64(i % 2)
+		if err := w.WriteRecordedOp(op); err != nil {
+			t.Fatal(err)
+		}
+		i++
+	}
+	w.Close()
+
+	reader, err := NewPlaybackFileReader(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := profileTape(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return profile
+}
+
+func TestDiffTapeProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-diff-tapes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	original := writeProfiledTape(t, dir, "original.playback", 8, 4)
+	if original.Ops != 12 || original.Connections != 2 {
+		t.Errorf("expected 12 ops on 2 connections, got %v ops on %v connections", original.Ops, original.Connections)
+	}
+	if original.ByOp["insert mongoreplay.test"] != 8 || original.ByOp["find mongoreplay.test"] != 4 {
+		t.Errorf("expected 8 inserts and 4 finds, got %v", original.ByOp)
+	}
+	if len(original.ByShape) != 1 {
+		t.Errorf("expected a single query shape, got %v", original.ByShape)
+	}
+	// the last find is seen 1.4s after the first insert, followed by its
+	// reply, and the 8 inserts and the first find in the first second
+	if original.Duration != 1400*time.Millisecond || original.PeakRate != 9 {
+		t.Errorf("expected a duration of 1.4s and a peak of 9 ops per second, got %v and %v",
+			original.Duration, original.PeakRate)
+	}
+
+	sampled := writeProfiledTape(t, dir, "sampled.playback", 4, 2)
+	skewed := writeProfiledTape(t, dir, "skewed.playback", 4, 4)
+	type testCase struct {
+		name      string
+		b         *tapeProfile
+		tolerance float64
+		byOp      int
+		byShape   int
+	}
+	cases := []testCase{
+		{name: "same shares", b: sampled},
+		{name: "different shares", b: skewed, byOp: 2, byShape: 1},
+		{name: "different shares within tolerance", b: skewed, tolerance: 0.2},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		diff := diffTapeProfiles(original, c.b, c.tolerance)
+		if len(diff.ByOp) != c.byOp || len(diff.ByShape) != c.byShape {
+			t.Errorf("expected %v op types and %v shapes to differ, got %v and %v",
+				c.byOp, c.byShape, diff.ByOp, diff.ByShape)
+		}
+	}
+}
@@ -0,0 +1,541 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// Playback files and reply tapes are written encrypted with AES-256-GCM when
+// --encryptKeyFile names a key file, or --kmsKeyId an AWS KMS key, which
+// MONGOREPLAY_KEY_FILE and MONGOREPLAY_KMS_KEY_ID set when neither option is
+// given, and are decrypted transparently when read. Each file is encrypted
+// with a data key of its own, stored in its header wrapped by the key of the
+// key file, which holds 32 bytes, raw or hex or base64 encoded, or by KMS,
+// whose requests are signed with the AWS credentials of the environment, as
+// those of S3 are, and so only from the environment variables of
+// parseObjectURL. AWS_ENDPOINT_URL_KMS can name another KMS endpoint.
+//
+// An encrypted file starts with encryptedTapeMagic and its header, followed
+// by the chunks of its bytes, gzipped first if they are, each sealed with a
+// nonce holding its number and whether it is the last chunk, so that chunks
+// can't be reordered and truncated files are detected.
+const (
+	keyFileEnv  = "MONGOREPLAY_KEY_FILE"
+	kmsKeyIDEnv = "MONGOREPLAY_KMS_KEY_ID"
+	kmsEndpoint = "AWS_ENDPOINT_URL_KMS"
+
+	// encryptedTapeMagic can't start a file which isn't encrypted: read as
+	// the length of its metadata, it far exceeds the maximum size of a bson
+	// document.
+	encryptedTapeMagic = "MRENCv1\x00"
+	encryptedChunkSize = 64 * 1024
+	dataKeySize        = 32
+)
+
+// encryptedTapeHeader follows the magic of an encrypted file, naming the key
+// which wrapped its data key: the fingerprint of the key of a key file, or
+// the id of a KMS key.
+type encryptedTapeHeader struct {
+	KeyFingerprint string `bson:"keyFingerprint,omitempty"`
+	KMSKeyID       string `bson:"kmsKeyId,omitempty"`
+	WrappedKey     []byte `bson:"wrappedKey"`
+	ChunkSize      int    `bson:"chunkSize"`
+}
+
+// tapeKeyWrapper wraps the data keys of the files written encrypted.
+type tapeKeyWrapper interface {
+	// newDataKey returns a new data key and the header of the file it
+	// encrypts.
+	newDataKey() ([]byte, *encryptedTapeHeader, error)
+}
+
+// EncryptionOptions select the key the playback files and reply tapes
+// written by a command are encrypted with.
+type EncryptionOptions struct {
+	EncryptKeyFile string `long:"encryptKeyFile" value-name:"<path>" description:"encrypt the files written with the key of this key file, which also decrypts the files read; defaults to MONGOREPLAY_KEY_FILE"`
+	KMSKeyID       string `long:"kmsKeyId" value-name:"<key-id>" description:"encrypt the files written with data keys of this AWS KMS key; defaults to MONGOREPLAY_KMS_KEY_ID"`
+}
+
+// tapeEncryption holds the encryption options of the command being run.
+var tapeEncryption EncryptionOptions
+
+// setTapeEncryption makes the files written by the command encrypted with
+// the key of its options, or of the environment if it has none.
+func (opts *EncryptionOptions) setTapeEncryption() error {
+	if opts.EncryptKeyFile != "" && opts.KMSKeyID != "" {
+		return fmt.Errorf("only one of --encryptKeyFile and --kmsKeyId can be set")
+	}
+	tapeEncryption = *opts
+	return nil
+}
+
+// encryptionKeys returns the key file and the KMS key of the encryption
+// options, or else of the environment.
+func encryptionKeys() (string, string) {
+	if tapeEncryption.EncryptKeyFile != "" || tapeEncryption.KMSKeyID != "" {
+		return tapeEncryption.EncryptKeyFile, tapeEncryption.KMSKeyID
+	}
+	return os.Getenv(keyFileEnv), os.Getenv(kmsKeyIDEnv)
+}
+
+// newTapeKeyWrapper returns the wrapper of the key of the encryption
+// options, or nil if files aren't encrypted.
+func newTapeKeyWrapper() (tapeKeyWrapper, error) {
+	keyFile, kmsKeyID := encryptionKeys()
+	switch {
+	case keyFile != "" && kmsKeyID != "":
+		return nil, fmt.Errorf("only one of %v and %v can be set", keyFileEnv, kmsKeyIDEnv)
+	case keyFile != "":
+		return loadKeyFile(keyFile)
+	case kmsKeyID != "":
+		return newKMSClient(kmsKeyID)
+	}
+	return nil, nil
+}
+
+// keyFileWrapper wraps data keys with the key of a key file.
+type keyFileWrapper struct {
+	aead        cipher.AEAD
+	fingerprint string
+}
+
+// readKeyFile reads the key of a key file, returning it with its
+// fingerprint.
+func readKeyFile(path string) ([]byte, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading key file: %v", err)
+	}
+	key := data
+	if len(key) != dataKeySize {
+		text := strings.TrimSpace(string(data))
+		if key, err = hex.DecodeString(text); err != nil || len(key) != dataKeySize {
+			key, err = base64.StdEncoding.DecodeString(text)
+		}
+		if err != nil || len(key) != dataKeySize {
+			return nil, "", fmt.Errorf("key file %v doesn't hold a %v byte key, raw or hex or base64 encoded", path, dataKeySize)
+		}
+	}
+	sum := sha256.Sum256(key)
+	return key, hex.EncodeToString(sum[:8]), nil
+}
+
+// loadKeyFile reads the key of a key file to wrap data keys with.
+func loadKeyFile(path string) (*keyFileWrapper, error) {
+	key, fingerprint, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newTapeAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &keyFileWrapper{aead: aead, fingerprint: fingerprint}, nil
+}
+
+func (wrapper *keyFileWrapper) newDataKey() ([]byte, *encryptedTapeHeader, error) {
+	dataKey := make([]byte, dataKeySize)
+	nonce := make([]byte, wrapper.aead.NonceSize())
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return dataKey, &encryptedTapeHeader{
+		KeyFingerprint: wrapper.fingerprint,
+		WrappedKey:     wrapper.aead.Seal(nonce, nonce, dataKey, nil),
+	}, nil
+}
+
+func (wrapper *keyFileWrapper) unwrap(header *encryptedTapeHeader) ([]byte, error) {
+	if header.KeyFingerprint != wrapper.fingerprint {
+		return nil, fmt.Errorf("the file was encrypted with another key, of fingerprint %v", header.KeyFingerprint)
+	}
+	nonceSize := wrapper.aead.NonceSize()
+	if len(header.WrappedKey) < nonceSize {
+		return nil, fmt.Errorf("invalid wrapped data key")
+	}
+	dataKey, err := wrapper.aead.Open(nil, header.WrappedKey[:nonceSize], header.WrappedKey[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key: %v", err)
+	}
+	return dataKey, nil
+}
+
+// kmsClient generates and decrypts data keys with AWS KMS.
+type kmsClient struct {
+	store *objectStore
+	keyID string
+}
+
+// newKMSClient returns a client of the KMS key of the given id, in the
+// region of its ARN, or of the environment if it is named otherwise.
+func newKMSClient(keyID string) (*kmsClient, error) {
+	region := firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+	if parts := strings.Split(keyID, ":"); len(parts) > 3 && parts[0] == "arn" {
+		region = parts[3]
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv(kmsEndpoint)
+	if endpoint == "" {
+		endpoint = "https://kms." + region + ".amazonaws.com"
+	}
+	store := &objectStore{
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		service:      "kms",
+		client:       &http.Client{},
+		now:          time.Now,
+	}
+	var err error
+	if store.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid %v: %v", kmsEndpoint, err)
+	}
+	if store.accessKey == "" || store.secretKey == "" {
+		return nil, fmt.Errorf("no credentials in the environment to use KMS key %v", keyID)
+	}
+	return &kmsClient{store: store, keyID: keyID}, nil
+}
+
+// call sends a request of the KMS json API, decoding its response.
+func (kms *kmsClient) call(action string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	u := *kms.store.endpoint
+	u.Path = "/"
+	httpRequest, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	httpRequest.Header.Set("X-Amz-Target", "TrentService."+action)
+	kms.store.sign(httpRequest, body)
+	httpResponse, err := kms.store.client.Do(httpRequest)
+	if err != nil {
+		return fmt.Errorf("error calling KMS %v: %v", action, err)
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		var kmsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		data, _ := ioutil.ReadAll(io.LimitReader(httpResponse.Body, 64*1024))
+		json.Unmarshal(data, &kmsErr)
+		return fmt.Errorf("error calling KMS %v: %v %v: %v", action, httpResponse.StatusCode, kmsErr.Type, kmsErr.Message)
+	}
+	if err := json.NewDecoder(httpResponse.Body).Decode(response); err != nil {
+		return fmt.Errorf("error decoding KMS %v response: %v", action, err)
+	}
+	return nil
+}
+
+func (kms *kmsClient) newDataKey() ([]byte, *encryptedTapeHeader, error) {
+	var response struct {
+		CiphertextBlob []byte
+		Plaintext      []byte
+		KeyId          string
+	}
+	err := kms.call("GenerateDataKey", map[string]interface{}{"KeyId": kms.keyID, "KeySpec": "AES_256"}, &response)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(response.Plaintext) != dataKeySize {
+		return nil, nil, fmt.Errorf("KMS returned a data key of %v bytes", len(response.Plaintext))
+	}
+	keyID := response.KeyId
+	if keyID == "" {
+		keyID = kms.keyID
+	}
+	return response.Plaintext, &encryptedTapeHeader{KMSKeyID: keyID, WrappedKey: response.CiphertextBlob}, nil
+}
+
+func (kms *kmsClient) unwrap(header *encryptedTapeHeader) ([]byte, error) {
+	var response struct {
+		Plaintext []byte
+	}
+	err := kms.call("Decrypt", map[string]interface{}{"CiphertextBlob": header.WrappedKey, "KeyId": header.KMSKeyID}, &response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Plaintext, nil
+}
+
+// unwrapDataKey returns the data key of an encrypted file, unwrapped with the
+// key file of the encryption options, or by the KMS key named by its header.
+func unwrapDataKey(header *encryptedTapeHeader) ([]byte, error) {
+	if header.KMSKeyID != "" {
+		kms, err := newKMSClient(header.KMSKeyID)
+		if err != nil {
+			return nil, err
+		}
+		return kms.unwrap(header)
+	}
+	keyFile, _ := encryptionKeys()
+	if keyFile == "" {
+		return nil, fmt.Errorf("the file is encrypted, and neither --encryptKeyFile nor %v names the key file to decrypt it with", keyFileEnv)
+	}
+	wrapper, err := loadKeyFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return wrapper.unwrap(header)
+}
+
+func newTapeAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of a chunk: its number, followed by whether
+// it is the last chunk.
+func chunkNonce(aead cipher.AEAD, chunk uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, chunk)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptingWriteCloser encrypts the bytes written to a file in chunks,
+// sealing the last one when closed.
+type encryptingWriteCloser struct {
+	w      io.WriteCloser
+	aead   cipher.AEAD
+	buffer []byte
+	chunk  uint64
+}
+
+// newEncryptingWriteCloser writes the header of an encrypted file to w,
+// returning the writer encrypting its bytes, or w itself if no key is
+// named.
+func newEncryptingWriteCloser(w io.WriteCloser) (io.WriteCloser, error) {
+	wrapper, err := newTapeKeyWrapper()
+	if err != nil || wrapper == nil {
+		return w, err
+	}
+	dataKey, header, err := wrapper.newDataKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newTapeAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	header.ChunkSize = encryptedChunkSize
+	headerBytes, err := bson.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(encryptedTapeMagic), headerBytes...)); err != nil {
+		return nil, err
+	}
+	return &encryptingWriteCloser{w: w, aead: aead, buffer: make([]byte, 0, encryptedChunkSize)}, nil
+}
+
+func (e *encryptingWriteCloser) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := encryptedChunkSize - len(e.buffer)
+		if n > len(p) {
+			n = len(p)
+		}
+		e.buffer = append(e.buffer, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(e.buffer) == encryptedChunkSize {
+			if err := e.writeChunk(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (e *encryptingWriteCloser) writeChunk(last bool) error {
+	sealed := e.aead.Seal(make([]byte, 4, 4+len(e.buffer)+e.aead.Overhead()), chunkNonce(e.aead, e.chunk, last), e.buffer, nil)
+	binary.LittleEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	e.chunk++
+	e.buffer = e.buffer[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// Close seals the last chunk, which may be empty, and closes the file.
+func (e *encryptingWriteCloser) Close() error {
+	err := e.writeChunk(true)
+	if closeErr := e.w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// decryptingReadSeeker decrypts the chunks of an encrypted file. It can only
+// seek to the beginning of the file.
+type decryptingReadSeeker struct {
+	rs         io.ReadSeeker
+	aead       cipher.AEAD
+	headerSize int
+	chunkSize  int
+	chunk      uint64
+	plain      []byte
+	last       bool
+}
+
+// prefixedReadSeeker reads the bytes already read from the start of a file
+// before the rest of it.
+type prefixedReadSeeker struct {
+	io.ReadSeeker
+	prefix []byte
+}
+
+func (p *prefixedReadSeeker) Read(b []byte) (int, error) {
+	if len(p.prefix) > 0 {
+		n := copy(b, p.prefix)
+		p.prefix = p.prefix[n:]
+		return n, nil
+	}
+	return p.ReadSeeker.Read(b)
+}
+
+func (p *prefixedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, fmt.Errorf("can only seek to the beginning of the file")
+	}
+	p.prefix = nil
+	return p.ReadSeeker.Seek(offset, whence)
+}
+
+// openTape returns a reader of the decrypted bytes of a file if it is
+// encrypted, and of its bytes otherwise. The start of the file is read
+// once, so that files read from stdin can still be rewound.
+func openTape(rs io.ReadSeeker) (io.ReadSeeker, error) {
+	magic := make([]byte, len(encryptedTapeMagic))
+	n, err := io.ReadFull(rs, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if string(magic[:n]) != encryptedTapeMagic {
+		return &prefixedReadSeeker{ReadSeeker: rs, prefix: magic[:n]}, nil
+	}
+	headerBytes, err := ReadDocument(rs)
+	if err != nil {
+		return nil, fmt.Errorf("error reading encryption header: %v", err)
+	}
+	header := &encryptedTapeHeader{}
+	if err := bson.Unmarshal(headerBytes, header); err != nil {
+		return nil, fmt.Errorf("error reading encryption header: %v", err)
+	}
+	if header.ChunkSize <= 0 || header.ChunkSize > MaxMessageSize {
+		return nil, fmt.Errorf("invalid encrypted chunk size %v", header.ChunkSize)
+	}
+	dataKey, err := unwrapDataKey(header)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting file: %v", err)
+	}
+	aead, err := newTapeAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReadSeeker{
+		rs:         rs,
+		aead:       aead,
+		headerSize: len(encryptedTapeMagic) + len(headerBytes),
+		chunkSize:  header.ChunkSize,
+	}, nil
+}
+
+func (d *decryptingReadSeeker) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.last {
+			return 0, io.EOF
+		}
+		if err := d.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptingReadSeeker) readChunk() error {
+	var size [4]byte
+	if _, err := io.ReadFull(d.rs, size[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("encrypted file is truncated after %v chunks", d.chunk)
+		}
+		return err
+	}
+	length := int(binary.LittleEndian.Uint32(size[:]))
+	if length < d.aead.Overhead() || length > d.chunkSize+d.aead.Overhead() {
+		return fmt.Errorf("invalid encrypted chunk of %v bytes", length)
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.rs, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("encrypted file is truncated after %v chunks", d.chunk)
+		}
+		return err
+	}
+	// the last chunk is told apart by its nonce, the only one it opens with
+	plain, err := d.aead.Open(nil, chunkNonce(d.aead, d.chunk, false), sealed, nil)
+	if err != nil {
+		if plain, err = d.aead.Open(nil, chunkNonce(d.aead, d.chunk, true), sealed, nil); err != nil {
+			return fmt.Errorf("error decrypting chunk %v: the file is corrupt or was tampered with", d.chunk)
+		}
+		d.last = true
+	}
+	d.chunk++
+	d.plain = plain
+	return nil
+}
+
+// Seek rewinds the file to its beginning, past its header.
+func (d *decryptingReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, fmt.Errorf("can only seek to the beginning of an encrypted file")
+	}
+	if _, err := d.rs.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, d.rs, int64(d.headerSize)); err != nil {
+		return 0, err
+	}
+	d.chunk, d.plain, d.last = 0, nil, false
+	return 0, nil
+}
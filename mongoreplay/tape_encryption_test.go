@@ -0,0 +1,327 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKeyFile writes a hex encoded key of the given byte to dir.
+func writeKeyFile(t *testing.T, dir string, b byte) string {
+	path := filepath.Join(dir, fmt.Sprintf("tape%v.key", b))
+	key := hex.EncodeToString(bytes.Repeat([]byte{b}, dataKeySize))
+	if err := ioutil.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// encrypt returns data encrypted with the key of the encryption options.
+func encrypt(t *testing.T, data []byte) []byte {
+	b := &bytes.Buffer{}
+	wc, err := newEncryptingWriteCloser(NopWriteCloser(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// decrypt returns the bytes read from an encrypted file.
+func decrypt(encrypted []byte) ([]byte, error) {
+	rs, err := openTape(bytes.NewReader(encrypted))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(rs)
+}
+
+func TestEncryptedChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(keyFileEnv, writeKeyFile(t, dir, 1))
+	defer os.Unsetenv(keyFileEnv)
+
+	type testCase struct {
+		name string
+		size int
+	}
+	cases := []testCase{
+		{name: "empty", size: 0},
+		{name: "less than a chunk", size: 100},
+		{name: "whole chunks", size: 2 * encryptedChunkSize},
+		{name: "several chunks", size: 3*encryptedChunkSize + 5},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		data := bytes.Repeat([]byte("m"), c.size)
+		encrypted := encrypt(t, data)
+		if !bytes.HasPrefix(encrypted, []byte(encryptedTapeMagic)) || (c.size > 0 && bytes.Contains(encrypted, data[:c.size/2])) {
+			t.Errorf("expected the data to be encrypted")
+		}
+		decrypted, err := decrypt(encrypted)
+		if err != nil || !bytes.Equal(decrypted, data) {
+			t.Errorf("expected %v bytes decrypted, got %v, %v", len(data), len(decrypted), err)
+		}
+	}
+
+	encrypted := encrypt(t, bytes.Repeat([]byte("m"), 2*encryptedChunkSize+5))
+	rs, err := openTape(bytes.NewReader(encrypted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := ioutil.ReadAll(rs)
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if second, err := ioutil.ReadAll(rs); err != nil || !bytes.Equal(first, second) {
+		t.Errorf("expected the file to be read again after seeking to its beginning, got %v", err)
+	}
+
+	// the last chunk is 5 bytes, sealed with 4 bytes of length and the
+	// overhead of GCM
+	lastChunk := 4 + 5 + 16
+	if _, err := decrypt(encrypted[:len(encrypted)-lastChunk]); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("expected a file truncated after a chunk to be rejected, got %v", err)
+	}
+	if _, err := decrypt(encrypted[:len(encrypted)-3]); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("expected a file truncated within a chunk to be rejected, got %v", err)
+	}
+	tampered := append([]byte{}, encrypted...)
+	tampered[len(tampered)-lastChunk-100] ^= 1
+	if _, err := decrypt(tampered); err == nil || !strings.Contains(err.Error(), "tampered") {
+		t.Errorf("expected a tampered file to be rejected, got %v", err)
+	}
+
+	os.Setenv(keyFileEnv, writeKeyFile(t, dir, 2))
+	if _, err := decrypt(encrypted); err == nil || !strings.Contains(err.Error(), "another key") {
+		t.Errorf("expected an error decrypting with another key, got %v", err)
+	}
+	os.Unsetenv(keyFileEnv)
+	if _, err := decrypt(encrypted); err == nil || !strings.Contains(err.Error(), keyFileEnv) {
+		t.Errorf("expected an error decrypting without a key, got %v", err)
+	}
+
+	// files which aren't encrypted are read as they are, even if shorter
+	// than the magic
+	for _, data := range []string{"", "mongo", "mongoreplay"} {
+		rs, err := openTape(bytes.NewReader([]byte(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if read, err := ioutil.ReadAll(rs); err != nil || string(read) != data {
+				t.Errorf("expected %q, got %q, %v", data, read, err)
+			}
+			rs.Seek(0, io.SeekStart)
+		}
+	}
+}
+
+func TestEncryptedPlaybackFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(keyFileEnv, writeKeyFile(t, dir, 1))
+	defer os.Unsetenv(keyFileEnv)
+
+	for _, gzip := range []bool{false, true} {
+		t.Logf("running case: gzip %v", gzip)
+		path := filepath.Join(dir, "encrypted.playback")
+		writer, err := NewPlaybackFileWriter(path, false, gzip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		generator := newRecordedOpGenerator()
+		if err := generator.generateInsertHelper("insert", 0, 10); err != nil {
+			t.Fatal(err)
+		}
+		close(generator.opChan)
+		for op := range generator.opChan {
+			if err := writer.WriteRecordedOp(op); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		written, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(written, []byte(encryptedTapeMagic)) || bytes.Contains(written, []byte("PlaybackFileVersion")) {
+			t.Errorf("expected the playback file to be encrypted")
+		}
+
+		reader, err := NewPlaybackFileReader(path, gzip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the ops are read twice, seeking back to the beginning
+		for i := 0; i < 2; i++ {
+			opChan, errChan := reader.OpChan(1)
+			numOps := 0
+			for range opChan {
+				numOps++
+			}
+			if err := <-errChan; err != io.EOF {
+				t.Fatal(err)
+			}
+			if numOps != 10 {
+				t.Errorf("expected 10 ops, got %v", numOps)
+			}
+		}
+	}
+}
+
+func TestEncryptedReplyTape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(keyFileEnv, writeKeyFile(t, dir, 1))
+	defer os.Unsetenv(keyFileEnv)
+
+	path := filepath.Join(dir, "replies.tape")
+	writer, err := NewReplyTapeWriter(path, ReplyTapeMetadata{PlaybackFile: "workload.playback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tape, err := ReadReplyTape(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tape.Metadata.PlaybackFile != "workload.playback" {
+		t.Errorf("expected the metadata to be decrypted, got %+v", tape.Metadata)
+	}
+}
+
+// fakeKMS serves the GenerateDataKey and Decrypt requests of KMS, wrapping
+// data keys by prefixing them with the id of the key.
+type fakeKMS struct {
+	authorizations []string
+}
+
+func (kms *fakeKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kms.authorizations = append(kms.authorizations, r.Header.Get("Authorization"))
+	var request struct {
+		KeyId          string
+		CiphertextBlob []byte
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+	dataKey := bytes.Repeat([]byte{7}, dataKeySize)
+	switch r.Header.Get("X-Amz-Target") {
+	case "TrentService.GenerateDataKey":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"KeyId":          "arn:aws:kms:eu-west-1:111122223333:key/" + request.KeyId,
+			"Plaintext":      dataKey,
+			"CiphertextBlob": append([]byte(request.KeyId), dataKey...),
+		})
+	case "TrentService.Decrypt":
+		if !bytes.HasPrefix(request.CiphertextBlob, []byte("tapes")) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "InvalidCiphertextException", "message": "invalid blob"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Plaintext": request.CiphertextBlob[len("tapes"):]})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestKMSEncryption(t *testing.T) {
+	kms := &fakeKMS{}
+	server := httptest.NewServer(kms)
+	defer server.Close()
+	os.Setenv(kmsEndpoint, server.URL)
+	os.Setenv("AWS_ACCESS_KEY_ID", "key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	os.Setenv(kmsKeyIDEnv, "tapes")
+	defer os.Unsetenv(kmsEndpoint)
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	defer os.Unsetenv(kmsKeyIDEnv)
+
+	encrypted := encrypt(t, []byte("mongoreplay"))
+	// decrypting only needs the credentials, the key being named by the
+	// header
+	os.Unsetenv(kmsKeyIDEnv)
+	if decrypted, err := decrypt(encrypted); err != nil || string(decrypted) != "mongoreplay" {
+		t.Errorf("expected the file to be decrypted, got %q, %v", decrypted, err)
+	}
+	if len(kms.authorizations) != 2 || !strings.Contains(kms.authorizations[0], "/us-east-1/kms/aws4_request") ||
+		!strings.Contains(kms.authorizations[1], "/eu-west-1/kms/aws4_request") {
+		t.Errorf("expected requests signed for KMS in the region of the key, got %v", kms.authorizations)
+	}
+
+	os.Setenv(kmsKeyIDEnv, "other")
+	encrypted = encrypt(t, []byte("mongoreplay"))
+	if _, err := decrypt(encrypted); err == nil || !strings.Contains(err.Error(), "InvalidCiphertextException") {
+		t.Errorf("expected the error of KMS, got %v", err)
+	}
+
+	os.Setenv(keyFileEnv, "tape.key")
+	defer os.Unsetenv(keyFileEnv)
+	if _, err := newEncryptingWriteCloser(NopWriteCloser(&bytes.Buffer{})); err == nil {
+		t.Errorf("expected an error with both a key file and a KMS key")
+	}
+}
+
+func TestEncryptionOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(keyFileEnv, writeKeyFile(t, dir, 1))
+	defer os.Unsetenv(keyFileEnv)
+	defer func() { tapeEncryption = EncryptionOptions{} }()
+
+	// the options override the environment, for writing and reading
+	opts := &EncryptionOptions{EncryptKeyFile: writeKeyFile(t, dir, 2)}
+	if err := opts.setTapeEncryption(); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := encrypt(t, []byte("mongoreplay"))
+	if decrypted, err := decrypt(encrypted); err != nil || string(decrypted) != "mongoreplay" {
+		t.Errorf("expected the file to be decrypted, got %q, %v", decrypted, err)
+	}
+	tapeEncryption = EncryptionOptions{}
+	if _, err := decrypt(encrypted); err == nil || !strings.Contains(err.Error(), "another key") {
+		t.Errorf("expected the key of the environment to be used without options, got %v", err)
+	}
+
+	opts.KMSKeyID = "tapes"
+	if err := opts.setTapeEncryption(); err == nil {
+		t.Errorf("expected an error with both a key file and a KMS key")
+	}
+}
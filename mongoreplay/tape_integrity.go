@@ -0,0 +1,378 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// Playback files end with an integrity footer, after the capture stats of
+// their recording if they have them. It holds the CRC-32C checksums of the
+// chunks of the bytes before it, once decrypted and decompressed, and their
+// HMAC-SHA256 signature if MONGOREPLAY_SIGNING_KEY_FILE named a key file when
+// they were written, holding 32 bytes as encryption key files do. Readers
+// skip the footer, and verify checks the bytes against it.
+const (
+	signingKeyFileEnv  = "MONGOREPLAY_SIGNING_KEY_FILE"
+	integrityChunkSize = 1024 * 1024
+)
+
+// playbackFileFooter is the document holding the integrity footer which ends
+// a playback file. Files written before footers were don't have one.
+type playbackFileFooter struct {
+	Integrity integrityFooter `bson:"integrity"`
+}
+
+// integrityFooter holds the length of the bytes of a playback file before
+// its footer, and the checksums of each of their chunks, 4 bytes big-endian
+// each. Signature is their HMAC, with the key of the key file of the
+// fingerprint.
+type integrityFooter struct {
+	Length         int64  `bson:"length"`
+	ChunkSize      int64  `bson:"chunkSize"`
+	Checksums      []byte `bson:"checksums"`
+	KeyFingerprint string `bson:"keyFingerprint,omitempty"`
+	Signature      []byte `bson:"signature,omitempty"`
+}
+
+// isPlaybackFileFooter returns whether a raw document of a playback file is
+// its integrity footer, from the name of its first field.
+func isPlaybackFileFooter(doc []byte) bool {
+	return len(doc) > 5 && bytes.HasPrefix(doc[5:], []byte("integrity\x00"))
+}
+
+// integrityHash computes the checksums and signature of the bytes of a
+// playback file.
+type integrityHash struct {
+	chunk      hash.Hash32
+	chunkBytes int64
+	checksums  []byte
+	length     int64
+	mac        hash.Hash
+}
+
+func newIntegrityHash(key []byte) *integrityHash {
+	h := &integrityHash{chunk: crc32.New(castagnoliTable)}
+	if key != nil {
+		h.mac = hmac.New(sha256.New, key)
+	}
+	return h
+}
+
+func (h *integrityHash) Write(p []byte) (int, error) {
+	if h.mac != nil {
+		h.mac.Write(p)
+	}
+	written := len(p)
+	for len(p) > 0 {
+		n := integrityChunkSize - h.chunkBytes
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		h.chunk.Write(p[:n])
+		h.chunkBytes += n
+		h.length += n
+		p = p[n:]
+		if h.chunkBytes == integrityChunkSize {
+			h.endChunk()
+		}
+	}
+	return written, nil
+}
+
+func (h *integrityHash) endChunk() {
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], h.chunk.Sum32())
+	h.checksums = append(h.checksums, checksum[:]...)
+	h.chunk.Reset()
+	h.chunkBytes = 0
+}
+
+// footer returns the footer of the bytes written.
+func (h *integrityHash) footer() integrityFooter {
+	if h.chunkBytes > 0 {
+		h.endChunk()
+	}
+	footer := integrityFooter{Length: h.length, ChunkSize: integrityChunkSize, Checksums: h.checksums}
+	if footer.Checksums == nil {
+		footer.Checksums = []byte{}
+	}
+	if h.mac != nil {
+		footer.Signature = h.mac.Sum(nil)
+	}
+	return footer
+}
+
+// signingKeyFromEnv returns the key of the signing key file of the
+// environment with its fingerprint, or nil if playback files aren't signed.
+func signingKeyFromEnv() ([]byte, string, error) {
+	path := os.Getenv(signingKeyFileEnv)
+	if path == "" {
+		return nil, "", nil
+	}
+	return readKeyFile(path)
+}
+
+// integrityWriteCloser checksums the bytes of a playback file as they are
+// written, ending it with its integrity footer when closed.
+type integrityWriteCloser struct {
+	w           io.WriteCloser
+	hash        *integrityHash
+	fingerprint string
+}
+
+func newIntegrityWriteCloser(w io.WriteCloser) (*integrityWriteCloser, error) {
+	key, fingerprint, err := signingKeyFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key: %v", err)
+	}
+	return &integrityWriteCloser{w: w, hash: newIntegrityHash(key), fingerprint: fingerprint}, nil
+}
+
+func (i *integrityWriteCloser) Write(p []byte) (int, error) {
+	n, err := i.w.Write(p)
+	i.hash.Write(p[:n])
+	return n, err
+}
+
+// Close writes the footer and closes the file.
+func (i *integrityWriteCloser) Close() error {
+	footer := i.hash.footer()
+	footer.KeyFingerprint = i.fingerprint
+	err := bsonToWriter(i.w, playbackFileFooter{footer})
+	if closeErr := i.w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// VerifyCommand stores settings for the mongoreplay 'verify' subcommand
+type VerifyCommand struct {
+	GlobalOpts       *Options `no-flag:"true"`
+	PlaybackFile     string   `description:"path to the playback file to verify" short:"p" long:"playback-file" required:"yes"`
+	RequireSignature bool     `long:"requireSignature" description:"fail unless the playback file is signed, with the key of the key file named by MONGOREPLAY_SIGNING_KEY_FILE"`
+	Gzip             bool     `long:"gzip" description:"decompress gzipped input"`
+}
+
+// integrityReport holds the outcome of the verification of a playback file.
+// Problems are those which fail it, and Warnings those which don't.
+type integrityReport struct {
+	Ops          int64
+	Length       int64
+	Chunks       int
+	BadChunks    []int
+	Footer       bool
+	CaptureStats bool
+	Signed       bool
+	Fingerprint  string
+	// SignatureVerified is set once the signature is checked, with the key
+	// it was signed with, and matches.
+	SignatureVerified bool
+	Problems          []string
+	Warnings          []string
+}
+
+func (report *integrityReport) problem(format string, args ...interface{}) {
+	report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+}
+
+// ValidateParams validates the settings described in the VerifyCommand
+// struct.
+func (verify *VerifyCommand) ValidateParams(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unknown argument: %s", args[0])
+	}
+	return nil
+}
+
+// Execute runs the program for the 'verify' subcommand
+func (verify *VerifyCommand) Execute(args []string) error {
+	if err := verify.ValidateParams(args); err != nil {
+		return err
+	}
+	verify.GlobalOpts.SetLogging()
+
+	reader, err := NewPlaybackFileReader(verify.PlaybackFile, verify.Gzip)
+	if err != nil {
+		return err
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	report, err := verifyPlaybackFile(bufio.NewReader(reader), verify.RequireSignature)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(os.Stdout)
+	writeIntegrityReport(out, report)
+	out.Flush()
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%v failed verification: %v", verify.PlaybackFile, strings.Join(report.Problems, "; "))
+	}
+	return nil
+}
+
+// verifyPlaybackFile reads the documents of a playback file from its
+// beginning, checking that each can be read, and that they match the
+// checksums and signature of its footer. The signature is checked with the
+// key of the signing key file of the environment.
+func verifyPlaybackFile(r io.Reader, requireSignature bool) (*integrityReport, error) {
+	key, fingerprint, err := signingKeyFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key: %v", err)
+	}
+	report := &integrityReport{}
+	h := newIntegrityHash(key)
+	var footer *integrityFooter
+	version := PlaybackFileVersion
+	for documents := 0; ; documents++ {
+		doc, err := ReadDocument(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				report.problem("the playback file is truncated within the document at offset %v", h.length)
+			} else {
+				report.problem("error reading the document at offset %v: %v", h.length, err)
+			}
+			break
+		}
+		if isPlaybackFileFooter(doc) {
+			f := new(playbackFileFooter)
+			if err := bson.Unmarshal(doc, f); err != nil {
+				report.problem("error reading the integrity footer: %v", err)
+				break
+			}
+			footer = &f.Integrity
+			if _, err := ReadDocument(r); err != io.EOF {
+				report.problem("the integrity footer is followed by more data")
+			}
+			break
+		}
+		h.Write(doc)
+		switch {
+		case documents == 0:
+			metadata := new(PlaybackFileMetadata)
+			if err := bson.Unmarshal(doc, metadata); err != nil {
+				report.problem("error reading metadata: %v", err)
+			}
+			version = metadata.PlaybackFileVersion
+		case isPlaybackFileTrailer(doc):
+			report.CaptureStats = true
+		default:
+			if err := bson.Unmarshal(doc, new(RecordedOp)); err != nil {
+				report.problem("error reading op %v at offset %v: %v", report.Ops, h.length-int64(len(doc)), err)
+			}
+			report.Ops++
+		}
+	}
+
+	computed := h.footer()
+	report.Length = computed.Length
+	report.Chunks = len(computed.Checksums) / 4
+	switch {
+	case footer == nil && version < playbackFileFooterVersion:
+		report.problem("the playback file has no integrity footer, as it is of version %v, written before footers were", version)
+	case footer == nil:
+		report.problem("the playback file has no integrity footer: it is truncated")
+	default:
+		report.Footer = true
+		report.Signed = footer.Signature != nil
+		report.Fingerprint = footer.KeyFingerprint
+		report.verifyChecksums(footer, &computed)
+		report.verifySignature(footer, &computed, key, fingerprint)
+	}
+	if requireSignature && !report.SignatureVerified {
+		if report.Signed {
+			report.problem("the signature of the playback file can't be checked")
+		} else {
+			report.problem("the playback file isn't signed")
+		}
+	}
+	return report, nil
+}
+
+// verifyChecksums compares the checksums of the footer with those computed.
+func (report *integrityReport) verifyChecksums(footer, computed *integrityFooter) {
+	if footer.ChunkSize != integrityChunkSize || len(footer.Checksums)%4 != 0 {
+		report.problem("unsupported integrity footer, of chunks of %v bytes", footer.ChunkSize)
+		return
+	}
+	for i := 0; i*4 < len(footer.Checksums) && i*4 < len(computed.Checksums); i++ {
+		if !bytes.Equal(footer.Checksums[i*4:i*4+4], computed.Checksums[i*4:i*4+4]) {
+			report.BadChunks = append(report.BadChunks, i)
+		}
+	}
+	if len(report.BadChunks) > 0 {
+		report.problem("%v chunks don't match their checksums, from bytes %v to %v", len(report.BadChunks),
+			int64(report.BadChunks[0])*integrityChunkSize, (int64(report.BadChunks[len(report.BadChunks)-1])+1)*integrityChunkSize)
+	}
+	if footer.Length != computed.Length {
+		report.problem("the playback file holds %v bytes before its footer, which was written after %v", computed.Length, footer.Length)
+	}
+}
+
+// verifySignature checks the signature of the footer with the key of the
+// environment, if it is signed.
+func (report *integrityReport) verifySignature(footer, computed *integrityFooter, key []byte, fingerprint string) {
+	switch {
+	case footer.Signature == nil:
+		return
+	case key == nil:
+		report.Warnings = append(report.Warnings, fmt.Sprintf("the signature isn't checked, as %v doesn't name the signing key file", signingKeyFileEnv))
+	case footer.KeyFingerprint != fingerprint:
+		report.problem("the playback file was signed with another key, of fingerprint %v", footer.KeyFingerprint)
+	case !hmac.Equal(footer.Signature, computed.Signature):
+		report.problem("the signature doesn't match: the playback file was altered")
+	default:
+		report.SignatureVerified = true
+	}
+}
+
+func writeIntegrityReport(out io.Writer, report *integrityReport) {
+	fmt.Fprintf(out, "ops               %v\n", report.Ops)
+	fmt.Fprintf(out, "bytes             %v, in %v chunks\n", report.Length, report.Chunks)
+	fmt.Fprintf(out, "capture stats     %v\n", report.CaptureStats)
+	switch {
+	case !report.Footer:
+		fmt.Fprintf(out, "integrity footer  missing\n")
+	case len(report.BadChunks) > 0:
+		fmt.Fprintf(out, "integrity footer  chunks %v don't match\n", report.BadChunks)
+	default:
+		fmt.Fprintf(out, "integrity footer  present\n")
+	}
+	switch {
+	case report.SignatureVerified:
+		fmt.Fprintf(out, "signed            with key %v, verified\n", report.Fingerprint)
+	case report.Signed:
+		fmt.Fprintf(out, "signed            with key %v\n", report.Fingerprint)
+	default:
+		fmt.Fprintf(out, "signed            no\n")
+	}
+	for _, warning := range report.Warnings {
+		fmt.Fprintf(out, "warning           %v\n", warning)
+	}
+	for _, problem := range report.Problems {
+		fmt.Fprintf(out, "problem           %v\n", problem)
+	}
+	if len(report.Problems) == 0 {
+		fmt.Fprintf(out, "verified          ok\n")
+	}
+}
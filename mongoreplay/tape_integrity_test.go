@@ -0,0 +1,223 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/10gen/llmgo/bson"
+)
+
+// writeIntegrityTape writes a playback file of 10 inserts and capture stats,
+// returning its bytes.
+func writeIntegrityTape(t *testing.T, dir string) []byte {
+	path := filepath.Join(dir, "integrity.playback")
+	writer, err := NewPlaybackFileWriter(path, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generator := newRecordedOpGenerator()
+	if err := generator.generateInsertHelper("insert", 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	close(generator.opChan)
+	for op := range generator.opChan {
+		if err := writer.WriteRecordedOp(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.WriteCaptureStats(CaptureStats{PacketsCaptured: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	written, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return written
+}
+
+// footerOffset returns the offset of the footer of a playback file.
+func footerOffset(t *testing.T, tape []byte) int {
+	r := bytes.NewReader(tape)
+	offset := 0
+	for {
+		doc, err := ReadDocument(r)
+		if err != nil {
+			t.Fatalf("no footer found: %v", err)
+		}
+		if isPlaybackFileFooter(doc) {
+			return offset
+		}
+		offset += len(doc)
+	}
+}
+
+func TestVerifyPlaybackFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-integrity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tape := writeIntegrityTape(t, dir)
+	footer := footerOffset(t, tape)
+
+	// readers skip the footer
+	reader, err := NewPlaybackFileReader(filepath.Join(dir, "integrity.playback"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opChan, errChan := reader.OpChan(1)
+	numOps := 0
+	for range opChan {
+		numOps++
+	}
+	if err := <-errChan; err != io.EOF {
+		t.Fatal(err)
+	}
+	if numOps != 10 || reader.CaptureStats() == nil {
+		t.Errorf("expected 10 ops and the capture stats, got %v and %v", numOps, reader.CaptureStats())
+	}
+
+	flipped := append([]byte{}, tape...)
+	flipped[footer/2] ^= 1
+	metadataLength := int(getInt32(tape, 0))
+	oldMetadata, err := bson.Marshal(PlaybackFileMetadata{PlaybackFileVersion: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldTape := append(oldMetadata, tape[metadataLength:footer]...)
+	type testCase struct {
+		name    string
+		tape    []byte
+		problem string
+	}
+	cases := []testCase{
+		{name: "intact", tape: tape},
+		{name: "truncated within the footer", tape: tape[:len(tape)-10], problem: "truncated within"},
+		{name: "truncated before the footer", tape: tape[:footer], problem: "no integrity footer: it is truncated"},
+		{name: "written before footers", tape: oldTape, problem: "of version 1, written before footers"},
+		{name: "altered", tape: flipped, problem: "don't match their checksums"},
+		{name: "followed by more data", tape: append(append([]byte{}, tape...), tape[:footer]...), problem: "followed by more data"},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		report, err := verifyPlaybackFile(bytes.NewReader(c.tape), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		problems := strings.Join(report.Problems, "; ")
+		if c.problem == "" && (problems != "" || report.Ops != 10 || !report.CaptureStats || !report.Footer) {
+			t.Errorf("expected 10 ops and capture stats verified, got %+v", report)
+		}
+		if c.problem != "" && !strings.Contains(problems, c.problem) {
+			t.Errorf("expected a problem containing %q, got %q", c.problem, problems)
+		}
+	}
+
+	report, err := verifyPlaybackFile(bytes.NewReader(tape), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || !strings.Contains(report.Problems[0], "isn't signed") {
+		t.Errorf("expected the missing signature to fail verification, got %v", report.Problems)
+	}
+}
+
+func TestVerifySignedPlaybackFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongoreplay-integrity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(signingKeyFileEnv, writeKeyFile(t, dir, 1))
+	defer os.Unsetenv(signingKeyFileEnv)
+	tape := writeIntegrityTape(t, dir)
+
+	report, err := verifyPlaybackFile(bytes.NewReader(tape), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 || !report.SignatureVerified {
+		t.Errorf("expected the signature to be verified, got %+v", report)
+	}
+
+	// an op altered with a footer of checksums computed anew fails the
+	// signature
+	footer := footerOffset(t, tape)
+	f := new(playbackFileFooter)
+	if err := bson.Unmarshal(tape[footer:], f); err != nil {
+		t.Fatal(err)
+	}
+	altered := append([]byte{}, tape[:footer]...)
+	altered[footer/2] ^= 1
+	h := newIntegrityHash(nil)
+	h.Write(altered)
+	forged := h.footer()
+	forged.KeyFingerprint, forged.Signature = f.Integrity.KeyFingerprint, f.Integrity.Signature
+	forgedFooter, err := bson.Marshal(playbackFileFooter{forged})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = verifyPlaybackFile(bytes.NewReader(append(altered, forgedFooter...)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || !strings.Contains(report.Problems[0], "signature doesn't match") {
+		t.Errorf("expected the signature not to match, got %v", report.Problems)
+	}
+
+	os.Setenv(signingKeyFileEnv, writeKeyFile(t, dir, 2))
+	report, err = verifyPlaybackFile(bytes.NewReader(tape), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || !strings.Contains(report.Problems[0], "another key") {
+		t.Errorf("expected an error verifying with another key, got %v", report.Problems)
+	}
+
+	// the signature is only checked with the key
+	os.Unsetenv(signingKeyFileEnv)
+	for _, requireSignature := range []bool{false, true} {
+		report, err = verifyPlaybackFile(bytes.NewReader(tape), requireSignature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Warnings) != 1 || len(report.Problems) > 0 != requireSignature {
+			t.Errorf("expected a warning, and a problem if the signature is required, got %v and %v", report.Warnings, report.Problems)
+		}
+	}
+}
+
+func TestIntegrityHashChunks(t *testing.T) {
+	data := bytes.Repeat([]byte("m"), 2*integrityChunkSize+1)
+	whole := newIntegrityHash([]byte("key"))
+	whole.Write(data)
+	pieces := newIntegrityHash([]byte("key"))
+	for i := 0; i < len(data); i += 1000 {
+		end := i + 1000
+		if end > len(data) {
+			end = len(data)
+		}
+		pieces.Write(data[i:end])
+	}
+	a, b := whole.footer(), pieces.footer()
+	if len(a.Checksums) != 12 || !bytes.Equal(a.Checksums, b.Checksums) || !bytes.Equal(a.Signature, b.Signature) || a.Length != b.Length {
+		t.Errorf("expected 3 checksums whatever the writes, got %+v and %+v", a, b)
+	}
+	if !bytes.Equal(a.Checksums[:4], a.Checksums[4:8]) || bytes.Equal(a.Checksums[4:8], a.Checksums[8:]) {
+		t.Errorf("expected the checksums of the chunks of the same bytes to match")
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// clusterTimeFields hold the cluster times that commands are sent with,
+// which refer to the clock of the server rather than to the data and so are
+// never shifted.
+var clusterTimeFields = map[string]bool{
+	"$clusterTime":     true,
+	"afterClusterTime": true,
+	"atClusterTime":    true,
+	"operationTime":    true,
+}
+
+// timeShifter implements the PreOpHook interface, moving every date and
+// timestamp in the documents and queries of the ops played by a fixed
+// delta, so that workloads which depend on the current time, such as those
+// on time-series and TTL collections, behave on replay as they did when
+// they were recorded.
+type timeShifter struct {
+	delta time.Duration
+}
+
+func (shifter *timeShifter) BeforeOp(op *RecordedOp, parsedOp Op) error {
+	return rewriteOpDocuments(parsedOp, shifter.shiftDocument)
+}
+
+func (shifter *timeShifter) shiftDocument(doc bson.D) bson.D {
+	for i := range doc {
+		if clusterTimeFields[doc[i].Name] {
+			continue
+		}
+		doc[i].Value = shifter.shiftValue(doc[i].Value)
+	}
+	return doc
+}
+
+func (shifter *timeShifter) shiftValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Add(shifter.delta)
+	case bson.MongoTimestamp:
+		// a zero timestamp is filled in by the server
+		if v == 0 {
+			return v
+		}
+		return v + bson.MongoTimestamp(int64(shifter.delta/time.Second)<<32)
+	case bson.D:
+		return shifter.shiftDocument(v)
+	case *bson.D:
+		shifted := shifter.shiftDocument(*v)
+		return &shifted
+	case bson.M:
+		for name, elem := range v {
+			if !clusterTimeFields[name] {
+				v[name] = shifter.shiftValue(elem)
+			}
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = shifter.shiftValue(v[i])
+		}
+		return v
+	}
+	return value
+}
+
+// rewriteOpDocuments replaces each document sent by an op, such as the
+// query of an OP_QUERY, the selector and update of an OP_UPDATE or the body
+// and document sequences of an OP_MSG, with the result of rewrite.
+func rewriteOpDocuments(op Op, rewrite func(bson.D) bson.D) error {
+	rewriteValue := func(value interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, nil
+		}
+		doc, err := bsonToD(value)
+		if err != nil {
+			return nil, err
+		}
+		return rewrite(doc), nil
+	}
+	rewriteValues := func(values []interface{}) error {
+		for i := range values {
+			rewritten, err := rewriteValue(values[i])
+			if err != nil {
+				return err
+			}
+			values[i] = rewritten
+		}
+		return nil
+	}
+
+	var err error
+	switch castOp := op.(type) {
+	case *QueryOp:
+		castOp.Query, err = rewriteValue(castOp.Query)
+	case *InsertOp:
+		err = rewriteValues(castOp.Documents)
+	case *UpdateOp:
+		if castOp.Selector, err = rewriteValue(castOp.Selector); err == nil {
+			castOp.Update, err = rewriteValue(castOp.Update)
+		}
+	case *DeleteOp:
+		castOp.Selector, err = rewriteValue(castOp.Selector)
+	case *CommandOp:
+		if castOp.CommandArgs, err = rewriteValue(castOp.CommandArgs); err == nil {
+			err = rewriteValues(castOp.InputDocs)
+		}
+	case *MsgOp:
+		for i, section := range castOp.Sections {
+			switch section.PayloadType {
+			case mgo.MsgPayload0:
+				body, err := bsonToD(section.Data)
+				if err != nil {
+					return err
+				}
+				if castOp.Sections[i].Data, err = dToRaw(rewrite(body)); err != nil {
+					return err
+				}
+			case mgo.MsgPayload1:
+				payload, ok := section.Data.(mgo.PayloadType1)
+				if !ok {
+					continue
+				}
+				if castOp.Sections[i].Data, err = rewriteDocumentSequence(payload, rewrite); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return err
+}
+
+// parseShiftTime parses the --shiftTime option, which is either a duration
+// or "now". ok is false if the delta is to be computed at the start of
+// playback, aligning the start of the recording with the current time.
+func parseShiftTime(setting string) (delta time.Duration, ok bool, err error) {
+	if setting == "now" {
+		return 0, false, nil
+	}
+	delta, err = time.ParseDuration(setting)
+	if err != nil {
+		return 0, false, fmt.Errorf("'%v' is neither a duration, e.g. 720h or -24h, nor 'now'", setting)
+	}
+	return delta, true, nil
+}
+
+// recordingStart returns the time the first op of the playback file was
+// seen, leaving the file at its beginning.
+func recordingStart(playbackFileReader *PlaybackFileReader) (time.Time, error) {
+	if _, err := playbackFileReader.Seek(0, 0); err != nil {
+		return time.Time{}, err
+	}
+	metadata := new(PlaybackFileMetadata)
+	if err := bsonFromReader(playbackFileReader, metadata); err != nil {
+		return time.Time{}, fmt.Errorf("bson read error: %v", err)
+	}
+	doc, err := ReadDocument(playbackFileReader)
+	if err == io.EOF || (err == nil && (isPlaybackFileTrailer(doc) || isPlaybackFileFooter(doc))) {
+		err = fmt.Errorf("playback file is empty")
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	op := new(RecordedOp)
+	if err := bson.Unmarshal(doc, op); err != nil {
+		return time.Time{}, err
+	}
+	if _, err := playbackFileReader.Seek(0, 0); err != nil {
+		return time.Time{}, err
+	}
+	return op.Seen.Time, nil
+}
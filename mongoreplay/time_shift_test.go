@@ -0,0 +1,155 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestTimeShifter(t *testing.T) {
+	recorded := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	timestamp := bson.MongoTimestamp(int64(recorded.Unix()) << 32)
+	body, err := dToRaw(bson.D{
+		{"find", "events"},
+		{"filter", bson.D{{"at", bson.D{{"$gte", recorded}}}, {"ts", timestamp}}},
+		{"readConcern", bson.D{{"afterClusterTime", timestamp}}},
+		{"$clusterTime", bson.D{{"clusterTime", timestamp}}},
+		{"$db", "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := dToRaw(bson.D{{"at", recorded}, {"tags", []interface{}{recorded}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := &MsgOp{MsgOp: mgo.MsgOp{Sections: []mgo.MsgSection{
+		{PayloadType: mgo.MsgPayload0, Data: body},
+		{PayloadType: mgo.MsgPayload1, Data: mgo.PayloadType1{Identifier: "documents", Docs: []interface{}{*event}}},
+	}}}
+
+	shifter := &timeShifter{delta: 48 * time.Hour}
+	if err := shifter.BeforeOp(&RecordedOp{}, op); err != nil {
+		t.Fatal(err)
+	}
+	shifted := recorded.Add(48 * time.Hour)
+	shiftedTimestamp := bson.MongoTimestamp(int64(shifted.Unix()) << 32)
+
+	doc, err := bsonToD(op.Sections[0].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filterValue, _ := FindValueByKey("filter", &doc)
+	filter := filterValue.(bson.D)
+	if at := filter[0].Value.(bson.D)[0].Value.(time.Time); !at.Equal(shifted) {
+		t.Errorf("expected the date in the filter to be shifted to %v, saw %v", shifted, at)
+	}
+	if ts := filter[1].Value.(bson.MongoTimestamp); ts != shiftedTimestamp {
+		t.Errorf("expected the timestamp in the filter to be shifted to %v, saw %v", shiftedTimestamp, ts)
+	}
+	readConcernValue, _ := FindValueByKey("readConcern", &doc)
+	if ts := readConcernValue.(bson.D)[0].Value.(bson.MongoTimestamp); ts != timestamp {
+		t.Errorf("expected afterClusterTime not to be shifted, saw %v", ts)
+	}
+	clusterTimeValue, _ := FindValueByKey("$clusterTime", &doc)
+	if ts := clusterTimeValue.(bson.D)[0].Value.(bson.MongoTimestamp); ts != timestamp {
+		t.Errorf("expected $clusterTime not to be shifted, saw %v", ts)
+	}
+
+	sequence := op.Sections[1].Data.(mgo.PayloadType1)
+	eventDoc, err := bsonToD(sequence.Docs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at := eventDoc[0].Value.(time.Time); !at.Equal(shifted) {
+		t.Errorf("expected the date of the inserted document to be shifted to %v, saw %v", shifted, at)
+	}
+	if tag := eventDoc[1].Value.([]interface{})[0].(time.Time); !tag.Equal(shifted) {
+		t.Errorf("expected the date in the array to be shifted to %v, saw %v", shifted, tag)
+	}
+
+	update := &UpdateOp{UpdateOp: mgo.UpdateOp{
+		Selector: &bson.D{{"at", recorded}},
+		Update:   &bson.D{{"$set", bson.D{{"seen", recorded}}}},
+	}}
+	if err := shifter.BeforeOp(&RecordedOp{}, update); err != nil {
+		t.Fatal(err)
+	}
+	if at := update.Selector.(bson.D)[0].Value.(time.Time); !at.Equal(shifted) {
+		t.Errorf("expected the date in the update selector to be shifted, saw %v", at)
+	}
+	if seen := update.Update.(bson.D)[0].Value.(bson.D)[0].Value.(time.Time); !seen.Equal(shifted) {
+		t.Errorf("expected the date in the update to be shifted, saw %v", seen)
+	}
+}
+
+func TestParseShiftTime(t *testing.T) {
+	type testCase struct {
+		setting  string
+		delta    time.Duration
+		fixed    bool
+		errorful bool
+	}
+	cases := []testCase{
+		{setting: "720h", delta: 720 * time.Hour, fixed: true},
+		{setting: "-24h", delta: -24 * time.Hour, fixed: true},
+		{setting: "now"},
+		{setting: "tomorrow", errorful: true},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.setting)
+		delta, fixed, err := parseShiftTime(c.setting)
+		if (err != nil) != c.errorful {
+			t.Errorf("expected error %v, saw %v", c.errorful, err)
+			continue
+		}
+		if delta != c.delta || fixed != c.fixed {
+			t.Errorf("expected delta %v (fixed %v), saw %v (fixed %v)", c.delta, c.fixed, delta, fixed)
+		}
+	}
+}
+
+func TestRecordingStart(t *testing.T) {
+	start := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	file, err := playbackFileWriterFromWriteCloser(NopWriteCloser(&buf), "", PlaybackFileMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := bsonToWriter(file, &RecordedOp{Seen: &PreciseTime{start.Add(time.Duration(i) * time.Second)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	playbackReader, err := playbackFileReaderFromReadSeeker(bytes.NewReader(buf.Bytes()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen, err := recordingStart(playbackReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !seen.Equal(start) {
+		t.Errorf("expected the recording to start at %v, saw %v", start, seen)
+	}
+
+	// the file is left at its beginning
+	opChan, errChan := playbackReader.OpChan(1)
+	count := 0
+	for range opChan {
+		count++
+	}
+	<-errChan
+	if count != 3 {
+		t.Errorf("expected to read the 3 ops after finding the start, saw %v", count)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mongodb/mongo-tools/common/text"
+)
+
+const (
+	// topUnknownNamespace is the namespace of the replies whose request was
+	// not seen.
+	topUnknownNamespace = "(unknown)"
+	// topPendingTimeout is how long a request is waited on for its reply
+	// before being forgotten, as unacknowledged writes get none.
+	topPendingTimeout = time.Minute
+	// topClearScreen moves the cursor home and clears the terminal.
+	topClearScreen = "\x1b[H\x1b[2J"
+)
+
+// topKey identifies the ops of a namespace and op type counted by
+// --top.
+type topKey struct {
+	ns, op string
+}
+
+// topCounts holds the number of ops of a topKey and the bytes of their
+// requests and replies.
+type topCounts struct {
+	ops, bytesIn, bytesOut int64
+}
+
+// topPending is a request waiting for its reply, whose bytes are counted
+// along with it.
+type topPending struct {
+	key  topKey
+	seen time.Time
+}
+
+// namespaceTop counts the ops seen by monitor --top by namespace and op
+// type, in the manner of mongotop, and writes a table of their rates and of
+// the bytes of their requests and replies every interval. The intervals
+// follow the times the ops were seen at, so that recorded traffic can be
+// counted as it would have been live.
+type namespaceTop struct {
+	out      io.Writer
+	interval time.Duration
+	rows     int
+	// live is set when counting traffic as it is captured, in which case
+	// the terminal is cleared before each table, and empty intervals are
+	// written too.
+	live bool
+
+	start   time.Time
+	counts  map[topKey]*topCounts
+	pending map[opKey]topPending
+}
+
+func newNamespaceTop(out io.Writer, interval time.Duration, rows int, live bool) *namespaceTop {
+	return &namespaceTop{
+		out:      out,
+		interval: interval,
+		rows:     rows,
+		live:     live,
+		counts:   map[topKey]*topCounts{},
+		pending:  map[opKey]topPending{},
+	}
+}
+
+// observe counts an op, whose message took wireLength bytes on the wire. A
+// reply is counted in the bytes of the namespace and op type of its
+// request.
+func (top *namespaceTop) observe(op *RecordedOp, parsedOp Op, wireLength int32) {
+	top.advance(op.Seen.Time)
+	if op.Header.OpCode == OpCodeReply || op.Header.OpCode == OpCodeCommandReply || op.Header.ResponseTo != 0 {
+		key := opKey{
+			driverEndpoint: op.DstEndpoint,
+			serverEndpoint: op.SrcEndpoint,
+			opID:           op.Header.ResponseTo,
+		}
+		request, ok := top.pending[key]
+		if !ok {
+			request.key = topKey{ns: topUnknownNamespace, op: "reply"}
+		}
+		delete(top.pending, key)
+		top.countsOf(request.key).bytesOut += int64(wireLength)
+		return
+	}
+	meta := parsedOp.Meta()
+	key := topKey{ns: namespaceOf(parsedOp), op: meta.Command}
+	if key.ns == "" {
+		key.ns = meta.Ns
+	}
+	if key.op == "" {
+		key.op = meta.Op
+	}
+	counts := top.countsOf(key)
+	counts.ops++
+	counts.bytesIn += int64(wireLength)
+	top.pending[opKey{
+		driverEndpoint: op.SrcEndpoint,
+		serverEndpoint: op.DstEndpoint,
+		opID:           op.Header.RequestID,
+	}] = topPending{key: key, seen: op.Seen.Time}
+}
+
+func (top *namespaceTop) countsOf(key topKey) *topCounts {
+	counts, ok := top.counts[key]
+	if !ok {
+		counts = &topCounts{}
+		top.counts[key] = counts
+	}
+	return counts
+}
+
+// advance writes the table of each interval which ended by now, skipping
+// ahead to the interval holding now.
+func (top *namespaceTop) advance(now time.Time) {
+	if top.start.IsZero() {
+		top.start = now.Truncate(top.interval)
+		return
+	}
+	end := top.start.Add(top.interval)
+	if now.Before(end) {
+		return
+	}
+	if len(top.counts) > 0 || top.live {
+		top.write(top.start, end)
+	}
+	top.counts = map[topKey]*topCounts{}
+	top.start = now.Truncate(top.interval)
+	for key, request := range top.pending {
+		if now.Sub(request.seen) > topPendingTimeout {
+			delete(top.pending, key)
+		}
+	}
+}
+
+// finish writes the table of the interval being counted, if it holds any
+// ops, which ended at end.
+func (top *namespaceTop) finish(end time.Time) {
+	if len(top.counts) > 0 && end.After(top.start) {
+		top.write(top.start, end)
+	}
+}
+
+// write writes the table of the interval from start to end, with the
+// namespaces and op types of the most ops first.
+func (top *namespaceTop) write(start, end time.Time) {
+	keys := make([]topKey, 0, len(top.counts))
+	for key := range top.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := top.counts[keys[i]], top.counts[keys[j]]
+		switch {
+		case a.ops != b.ops:
+			return a.ops > b.ops
+		case a.bytesIn+a.bytesOut != b.bytesIn+b.bytesOut:
+			return a.bytesIn+a.bytesOut > b.bytesIn+b.bytesOut
+		case keys[i].ns != keys[j].ns:
+			return keys[i].ns < keys[j].ns
+		}
+		return keys[i].op < keys[j].op
+	})
+
+	seconds := end.Sub(start).Seconds()
+	perSecond := func(n int64) int64 {
+		return int64(float64(n) / seconds)
+	}
+	out := &bytes.Buffer{}
+	if top.live {
+		out.WriteString(topClearScreen)
+	}
+	fmt.Fprintf(out, "%v (%v)\n", end.Format(time.RFC3339), end.Sub(start))
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ns\top\tops/s\tin/s\tout/s\t")
+	for i, key := range keys {
+		if i == top.rows {
+			fmt.Fprintf(w, "... %v more\t\t\t\t\t\n", len(keys)-i)
+			break
+		}
+		counts := top.counts[key]
+		fmt.Fprintf(w, "%v\t%v\t%.1f\t%v\t%v\t\n", key.ns, key.op, float64(counts.ops)/seconds,
+			text.FormatByteAmount(perSecond(counts.bytesIn)), text.FormatByteAmount(perSecond(counts.bytesOut)))
+	}
+	w.Flush()
+	out.WriteString("\n")
+	if _, err := top.out.Write(out.Bytes()); err != nil {
+		toolDebugLogger.Logvf(Always, "error writing namespace table: %v", err)
+	}
+}
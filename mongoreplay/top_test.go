@@ -0,0 +1,92 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/10gen/llmgo/bson"
+	"github.com/mongodb/mongo-tools/common/text"
+)
+
+func TestNamespaceTop(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	for i := int32(0); i < 4; i++ {
+		if err := generator.generateMsgOpFind(bson.D{}, 0, 10+i); err != nil {
+			t.Fatal(err)
+		}
+		if err := generator.generateMsgOpReply(10+i, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := generator.generateMsgOpInsertHelper("insert", 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	// a reply to a request which was not seen
+	if err := generator.generateMsgOpReply(99, 0); err != nil {
+		t.Fatal(err)
+	}
+	close(generator.opChan)
+
+	out := &bytes.Buffer{}
+	top := newNamespaceTop(out, 2*time.Second, 1, false)
+	start := time.Date(2020, 5, 20, 12, 0, 0, 0, time.UTC)
+	var requestBytes, replyBytes int64
+	i := 0
+	for op := range generator.opChan {
+		// the first six ops fall in the first interval, the others in the
+		// third, leaving the second one empty
+		op.Seen = &PreciseTime{start.Add(time.Duration(i) * 100 * time.Millisecond)}
+		if i >= 6 {
+			op.Seen = &PreciseTime{start.Add(5 * time.Second)}
+		}
+		parsedOp, err := op.RawOp.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 6 && i%2 == 0 {
+			requestBytes += int64(op.Header.MessageLength)
+		} else if i < 6 {
+			replyBytes += int64(op.Header.MessageLength)
+		}
+		top.observe(op, parsedOp, op.Header.MessageLength)
+		i++
+	}
+	top.finish(start.Add(6 * time.Second))
+
+	tables := strings.Split(strings.TrimSpace(out.String()), "\n\n")
+	if len(tables) != 2 {
+		t.Fatalf("expected 2 tables, got %v:\n%v", len(tables), out)
+	}
+	expected := []string{
+		"2020-05-20T12:00:02Z (2s)",
+		"ns                op    ops/s  in/s",
+		"mongoreplay.test  find  1.5    " + text.FormatByteAmount(requestBytes/2),
+	}
+	first := strings.Split(tables[0], "\n")
+	for i, line := range expected {
+		if !strings.HasPrefix(first[i], line) {
+			t.Errorf("expected line %v of the first table to start with %q, got %q", i, line, first[i])
+		}
+	}
+	if !strings.HasSuffix(strings.TrimSpace(first[2]), text.FormatByteAmount(replyBytes/2)) {
+		t.Errorf("expected %v of replies per second, got %q", text.FormatByteAmount(replyBytes/2), first[2])
+	}
+
+	// the second interval is empty, and the third lists the busiest of the
+	// find, the insert and the reply to the unseen request
+	second := strings.Split(tables[1], "\n")
+	if second[0] != "2020-05-20T12:00:06Z (2s)" {
+		t.Errorf("expected the second table to end at 12:00:06, got %q", second[0])
+	}
+	if len(second) != 4 || !strings.HasPrefix(second[3], "... 2 more") {
+		t.Errorf("expected 1 row and 2 left out, got %q", second)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+// ErrGetLastErrorDropped is returned for the getLastError commands, which
+// aren't played with --translate: the writes they follow are played as
+// commands, which are acknowledged by their own replies, and the servers
+// which no longer support the legacy opcodes no longer have the command.
+var ErrGetLastErrorDropped = fmt.Errorf("getLastError not played with --translate")
+
+// the flags of legacy ops which change the commands they translate to
+const (
+	insertFlagContinueOnError = 1 << 0
+	updateFlagUpsert          = 1 << 0
+	updateFlagMulti           = 1 << 1
+	deleteFlagSingleRemove    = 1 << 0
+	queryFlagTailable         = mgo.QueryOpFlags(1 << 1)
+	queryFlagNoCursorTimeout  = mgo.QueryOpFlags(1 << 4)
+	queryFlagAwaitData        = mgo.QueryOpFlags(1 << 5)
+	queryFlagPartial          = mgo.QueryOpFlags(1 << 7)
+)
+
+// splitNamespace splits a namespace into its database and collection.
+func splitNamespace(namespace string) (string, string) {
+	if i := strings.Index(namespace, "."); i >= 0 {
+		return namespace[:i], namespace[i+1:]
+	}
+	return namespace, ""
+}
+
+// newMsgCommand returns the OP_MSG running command against the database.
+func newMsgCommand(database string, command bson.D) (*MsgOp, error) {
+	body := append(command, bson.DocElem{Name: "$db", Value: database})
+	raw, err := dToRaw(body)
+	if err != nil {
+		return nil, err
+	}
+	op := &MsgOp{CommandName: command[0].Name, Database: database}
+	op.Sections = []mgo.MsgSection{{PayloadType: mgo.MsgPayload0, Data: raw}}
+	return op, nil
+}
+
+// translateLegacyOp returns the OP_MSG command equivalent to a legacy
+// OP_INSERT, OP_UPDATE, OP_DELETE, OP_QUERY or OP_GET_MORE, or nil if op
+// isn't one of them. The getMores are translated to MsgOpGetMores, whose
+// cursors are rewritten like those of the legacy ones.
+func translateLegacyOp(op Op) (Op, error) {
+	switch castOp := op.(type) {
+	case *InsertOp:
+		database, collection := splitNamespace(castOp.Collection)
+		return newMsgCommand(database, bson.D{
+			{Name: "insert", Value: collection},
+			{Name: "documents", Value: castOp.Documents},
+			{Name: "ordered", Value: castOp.Flags&insertFlagContinueOnError == 0},
+		})
+	case *UpdateOp:
+		database, collection := splitNamespace(castOp.Collection)
+		update := bson.D{{Name: "q", Value: castOp.Selector}, {Name: "u", Value: castOp.Update}}
+		if castOp.Flags&updateFlagUpsert != 0 {
+			update = append(update, bson.DocElem{Name: "upsert", Value: true})
+		}
+		if castOp.Flags&updateFlagMulti != 0 {
+			update = append(update, bson.DocElem{Name: "multi", Value: true})
+		}
+		return newMsgCommand(database, bson.D{{Name: "update", Value: collection}, {Name: "updates", Value: []bson.D{update}}})
+	case *DeleteOp:
+		database, collection := splitNamespace(castOp.Collection)
+		limit := 0
+		if castOp.Flags&deleteFlagSingleRemove != 0 {
+			limit = 1
+		}
+		return newMsgCommand(database, bson.D{
+			{Name: "delete", Value: collection},
+			{Name: "deletes", Value: []bson.D{{{Name: "q", Value: castOp.Selector}, {Name: "limit", Value: limit}}}},
+		})
+	case *QueryOp:
+		return translateQuery(castOp)
+	case *GetMoreOp:
+		database, collection := splitNamespace(castOp.Collection)
+		command := bson.D{{Name: "getMore", Value: castOp.CursorId}, {Name: "collection", Value: collection}}
+		if castOp.Limit > 0 {
+			command = append(command, bson.DocElem{Name: "batchSize", Value: castOp.Limit})
+		}
+		msgOp, err := newMsgCommand(database, command)
+		if err != nil {
+			return nil, err
+		}
+		return &MsgOpGetMore{MsgOp: *msgOp}, nil
+	}
+	return nil, nil
+}
+
+// translateQuery translates a legacy OP_QUERY into the command it runs, if
+// it runs one against a $cmd collection, or into a find command.
+func translateQuery(op *QueryOp) (Op, error) {
+	query, wrapper, err := unwrapQuery(op.Query)
+	if err != nil {
+		return nil, err
+	}
+	var database string
+	var command bson.D
+	if strings.HasSuffix(op.Collection, ".$cmd") {
+		if len(query) == 0 {
+			return nil, nil
+		}
+		database, command = strings.TrimSuffix(op.Collection, ".$cmd"), query
+	} else {
+		database, command = legacyFindCommand(op, query, wrapper)
+		if op.Limit < 0 {
+			command = append(command, bson.DocElem{Name: "singleBatch", Value: true})
+		}
+		for _, flag := range []struct {
+			flag  mgo.QueryOpFlags
+			field string
+		}{
+			{queryFlagTailable, "tailable"}, {queryFlagNoCursorTimeout, "noCursorTimeout"},
+			{queryFlagAwaitData, "awaitData"}, {queryFlagPartial, "allowPartialResults"},
+		} {
+			if op.Flags&flag.flag != 0 {
+				command = append(command, bson.DocElem{Name: flag.field, Value: true})
+			}
+		}
+	}
+	if readPreference, ok := FindValueByKey("$readPreference", &wrapper); ok {
+		command = append(command, bson.DocElem{Name: "$readPreference", Value: readPreference})
+	} else if op.Flags&queryFlagSlaveOk != 0 {
+		command = append(command, bson.DocElem{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "secondaryPreferred"}}})
+	}
+	return newMsgCommand(database, command)
+}
+
+// isGetLastError returns whether op runs getLastError, which older drivers
+// spell getlasterror.
+func isGetLastError(op Op) bool {
+	return strings.EqualFold(commandNameOf(op), "getLastError")
+}
+
+// TranslatedOps returns the number of legacy ops that were played as the
+// equivalent OP_MSG commands.
+func (context *ExecutionContext) TranslatedOps() int64 {
+	return atomic.LoadInt64(&context.translatedOps)
+}
+
+// DroppedGetLastErrors returns the number of getLastError commands which
+// weren't played since the ops were translated.
+func (context *ExecutionContext) DroppedGetLastErrors() int64 {
+	return atomic.LoadInt64(&context.droppedGetLastErrors)
+}
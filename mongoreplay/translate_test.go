@@ -0,0 +1,119 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"bytes"
+	"testing"
+
+	mgo "github.com/10gen/llmgo"
+	"github.com/10gen/llmgo/bson"
+)
+
+func TestTranslateLegacyOp(t *testing.T) {
+	filter := bson.D{{"a", 1}}
+	type testCase struct {
+		name    string
+		op      Op
+		command bson.D
+	}
+	cases := []testCase{
+		{
+			name:    "insert",
+			op:      &InsertOp{InsertOp: mgo.InsertOp{Collection: "test.c", Documents: []interface{}{bson.D{{"_id", 1}}}}},
+			command: bson.D{{"insert", "c"}, {"documents", []interface{}{bson.D{{"_id", 1}}}}, {"ordered", true}, {"$db", "test"}},
+		},
+		{
+			name:    "multi upsert",
+			op:      &UpdateOp{UpdateOp: mgo.UpdateOp{Collection: "test.c", Selector: filter, Update: bson.D{{"$set", bson.D{{"b", 2}}}}, Flags: 3}},
+			command: bson.D{{"update", "c"}, {"updates", []bson.D{{{"q", filter}, {"u", bson.D{{"$set", bson.D{{"b", 2}}}}}, {"upsert", true}, {"multi", true}}}}, {"$db", "test"}},
+		},
+		{
+			name:    "single delete",
+			op:      &DeleteOp{DeleteOp: mgo.DeleteOp{Collection: "test.c", Selector: filter, Flags: 1}},
+			command: bson.D{{"delete", "c"}, {"deletes", []bson.D{{{"q", filter}, {"limit", 1}}}}, {"$db", "test"}},
+		},
+		{
+			name: "find",
+			op: &QueryOp{QueryOp: mgo.QueryOp{Collection: "test.c", Query: bson.D{{"$query", filter}, {"$orderby", bson.D{{"a", -1}}}},
+				Limit: -5, Flags: queryFlagSlaveOk | queryFlagNoCursorTimeout}},
+			command: bson.D{{"find", "c"}, {"filter", filter}, {"sort", bson.D{{"a", -1}}}, {"limit", int32(5)}, {"singleBatch", true},
+				{"noCursorTimeout", true}, {"$readPreference", bson.D{{"mode", "secondaryPreferred"}}}, {"$db", "test"}},
+		},
+		{
+			name:    "command",
+			op:      &QueryOp{QueryOp: mgo.QueryOp{Collection: "admin.$cmd", Query: bson.D{{"ping", 1}}, Limit: -1}},
+			command: bson.D{{"ping", 1}, {"$db", "admin"}},
+		},
+		{
+			name:    "getMore",
+			op:      &GetMoreOp{GetMoreOp: mgo.GetMoreOp{Collection: "test.c", CursorId: 12345, Limit: 10}},
+			command: bson.D{{"getMore", int64(12345)}, {"collection", "c"}, {"batchSize", int32(10)}, {"$db", "test"}},
+		},
+		{
+			name: "killCursors",
+			op:   &KillCursorsOp{KillCursorsOp: mgo.KillCursorsOp{CursorIds: []int64{12345}}},
+		},
+	}
+	for _, c := range cases {
+		t.Logf("running case: %s", c.name)
+		translated, err := translateLegacyOp(c.op)
+		if err != nil {
+			t.Errorf("error translating op: %v", err)
+			continue
+		}
+		if c.command == nil {
+			if translated != nil {
+				t.Errorf("expected the op not to be translated, got %#v", translated)
+			}
+			continue
+		}
+		var msgOp *MsgOp
+		switch castOp := translated.(type) {
+		case *MsgOp:
+			msgOp = castOp
+		case *MsgOpGetMore:
+			msgOp = &castOp.MsgOp
+		default:
+			t.Errorf("expected an OP_MSG, got %#v", translated)
+			continue
+		}
+		if msgOp.CommandName != c.command[0].Name {
+			t.Errorf("expected command %v, got %v", c.command[0].Name, msgOp.CommandName)
+		}
+		body, _, err := fetchPayload0Data(msgOp.Sections)
+		if err != nil {
+			t.Errorf("error reading the command: %v", err)
+			continue
+		}
+		expected, err := bson.Marshal(c.command)
+		if err != nil {
+			t.Fatalf("error marshaling the expected command: %v", err)
+		}
+		if !bytes.Equal(body.Data, expected) {
+			got, _ := bsonToD(body)
+			t.Errorf("expected command %v, got %v", c.command, got)
+		}
+	}
+}
+
+func TestTranslateDropsGetLastError(t *testing.T) {
+	generator := newRecordedOpGenerator()
+	context := NewExecutionContext(&StatCollector{noop: true}, nil, &ExecutionOptions{translate: true})
+	for _, name := range []string{"getLastError", "getlasterror"} {
+		op, err := generator.fetchRecordedOpsFromConn(&mgo.QueryOp{Collection: "admin.$cmd", Query: bson.D{{name, 1}}, Limit: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := context.Execute(op, nil); err != ErrGetLastErrorDropped {
+			t.Errorf("expected %v not to be played, got %v", name, err)
+		}
+	}
+	if dropped := context.DroppedGetLastErrors(); dropped != 2 {
+		t.Errorf("expected 2 getLastErrors dropped, got %v", dropped)
+	}
+}
@@ -8,6 +8,7 @@ package mongoreplay
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -187,6 +188,56 @@ func setCursorID(in interface{}, newCursorIDs []int64) (bson.D, int64, error) {
 	return doc, newCursorID, nil
 }
 
+// bsonToD converts a document held as a bson.Raw or bson.D (or pointers to
+// either) into a bson.D so that its fields can be edited in place.
+func bsonToD(in interface{}) (bson.D, error) {
+	switch t := in.(type) {
+	case nil:
+		return bson.D{}, nil
+	case bson.D:
+		return t, nil
+	case *bson.D:
+		return *t, nil
+	case bson.Raw:
+		doc := bson.D{}
+		err := t.Unmarshal(&doc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal bson.Raw into bson.D: %v", err)
+		}
+		return doc, nil
+	case *bson.Raw:
+		return bsonToD(*t)
+	default:
+		return nil, fmt.Errorf("not a bson document: %T", in)
+	}
+}
+
+// dToRaw converts a bson.D into a bson.Raw.
+func dToRaw(doc bson.D) (*bson.Raw, error) {
+	asSlice, err := bson.Marshal(&doc)
+	if err != nil {
+		return nil, err
+	}
+	raw := &bson.Raw{}
+	err = bson.Unmarshal(asSlice, raw)
+	if err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// setDocField sets the value of the named field in doc, appending the field
+// if it is not already present.
+func setDocField(doc bson.D, name string, value interface{}) bson.D {
+	for i := range doc {
+		if doc[i].Name == name {
+			doc[i].Value = value
+			return doc
+		}
+	}
+	return append(doc, bson.DocElem{Name: name, Value: value})
+}
+
 func getCommandName(rawOp *RawOp) (string, error) {
 	if rawOp.Header.OpCode != OpCodeCommand {
 		return "", fmt.Errorf("getCommandName received wrong opType: %v", rawOp.Header.OpCode)
@@ -605,3 +656,36 @@ func min(a, b int) int {
 	}
 	return b
 }
+
+// sleepUntil sleeps until t, returning early with the context's error if ctx
+// is done first.
+func sleepUntil(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// forwardOps sends the ops received from in to out until in is closed or ctx
+// is done.
+func forwardOps(ctx context.Context, in <-chan *RecordedOp, out chan<- *RecordedOp) {
+	for {
+		select {
+		case op, ok := <-in:
+			if !ok {
+				return
+			}
+			select {
+			case out <- op:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	mgo "github.com/10gen/llmgo"
+)
+
+// bufferWarmupOps reads the ops seen within window of the first op in opChan.
+// It returns those ops along with a channel that yields every op of opChan,
+// starting with the buffered ones, until ctx is done.
+func bufferWarmupOps(ctx context.Context, opChan <-chan *RecordedOp, window time.Duration) ([]*RecordedOp, <-chan *RecordedOp) {
+	var buffered []*RecordedOp
+	withinWindow := 0
+	for op := range opChan {
+		buffered = append(buffered, op)
+		if op.Seen.Sub(buffered[0].Seen.Time) > window {
+			break
+		}
+		withinWindow++
+	}
+
+	ch := make(chan *RecordedOp, len(buffered))
+	for _, op := range buffered {
+		ch <- op
+	}
+	go func() {
+		defer close(ch)
+		forwardOps(ctx, opChan, ch)
+	}()
+	return buffered[:withinWindow], ch
+}
+
+// countPlaybackConnections returns the number of connections Play opens to
+// play ops, accounting for recorded connections that end and are then reused.
+func countPlaybackConnections(ops []*RecordedOp) int {
+	open := map[int64]bool{}
+	count := 0
+	for _, op := range ops {
+		if !open[op.SeenConnectionNum] {
+			open[op.SeenConnectionNum] = true
+			count++
+		}
+		if op.EOF {
+			delete(open, op.SeenConnectionNum)
+		}
+	}
+	return count
+}
+
+// warmConnections opens and authenticates count sockets ahead of playback.
+// They are handed out by acquireSocket as the connections of the playback are
+// created. Once ctx is done, no more sockets are opened.
+func (context *ExecutionContext) warmConnections(ctx context.Context, count int) {
+	context.warmSockets = make(chan *mgo.MongoSocket, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ctx.Err() != nil {
+				return
+			}
+			socket, err := context.dialSocket()
+			if err != nil {
+				userInfoLogger.Logvf(Info, "Opening connection ahead of playback FAILED: %v", err)
+				return
+			}
+			context.warmSockets <- socket
+		}()
+	}
+	wg.Wait()
+	userInfoLogger.Logvf(Always, "Opened %v of %v connections ahead of playback", len(context.warmSockets), count)
+}
+
+// closeWarmConnections closes the sockets opened by warmConnections that
+// were never used.
+func (context *ExecutionContext) closeWarmConnections() {
+	if context.warmSockets == nil {
+		return
+	}
+	close(context.warmSockets)
+	for socket := range context.warmSockets {
+		socket.Close()
+	}
+}
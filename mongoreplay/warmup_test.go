@@ -0,0 +1,86 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	gocontext "context"
+	"testing"
+	"time"
+)
+
+func TestBufferWarmupOps(t *testing.T) {
+	start := time.Now()
+	opAt := func(offset time.Duration, connectionNum int64, eof bool) *RecordedOp {
+		return &RecordedOp{
+			Seen:              &PreciseTime{start.Add(offset)},
+			SeenConnectionNum: connectionNum,
+			EOF:               eof,
+		}
+	}
+	ops := []*RecordedOp{
+		opAt(0, 1, false),
+		opAt(time.Second, 2, false),
+		opAt(2*time.Second, 1, true),
+		// connection 1 is reused after it ended
+		opAt(3*time.Second, 1, false),
+		opAt(10*time.Second, 3, false),
+		opAt(11*time.Second, 4, false),
+	}
+	opChan := make(chan *RecordedOp, len(ops))
+	for _, op := range ops {
+		opChan <- op
+	}
+	close(opChan)
+
+	warmupOps, allOps := bufferWarmupOps(gocontext.Background(), opChan, 5*time.Second)
+	if len(warmupOps) != 4 {
+		t.Errorf("expected 4 ops within the warmup window, saw %v", len(warmupOps))
+	}
+	if count := countPlaybackConnections(warmupOps); count != 3 {
+		t.Errorf("expected 3 connections within the warmup window, saw %v", count)
+	}
+
+	i := 0
+	for op := range allOps {
+		if op != ops[i] {
+			t.Errorf("op %v not passed through in order", i)
+		}
+		i++
+	}
+	if i != len(ops) {
+		t.Errorf("expected %v ops to be passed through, saw %v", len(ops), i)
+	}
+}
+
+func TestBufferWarmupOpsCanceled(t *testing.T) {
+	opChan := make(chan *RecordedOp, 3)
+	for i := 0; i < 3; i++ {
+		opChan <- &RecordedOp{Seen: &PreciseTime{time.Now().Add(time.Duration(i) * time.Hour)}}
+	}
+	// opChan is left open, as when the playback file is still being read
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	_, allOps := bufferWarmupOps(ctx, opChan, time.Minute)
+	<-allOps
+	<-allOps
+	cancel()
+
+	// the third op may have been forwarded before the cancellation
+	timeout := time.After(5 * time.Second)
+	for i := 0; ; i++ {
+		select {
+		case _, ok := <-allOps:
+			if !ok {
+				return
+			}
+			if i > 0 {
+				t.Errorf("expected no more ops once canceled")
+			}
+		case <-timeout:
+			t.Fatalf("ops channel not closed after cancellation")
+		}
+	}
+}
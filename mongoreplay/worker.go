@@ -0,0 +1,445 @@
+// Copyright (C) MongoDB, Inc. 2014-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package mongoreplay
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// WorkerCommand stores settings for the mongoreplay 'worker' subcommand
+type WorkerCommand struct {
+	GlobalOpts *Options `no-flag:"true"`
+	DialOptions
+	ConnectionOptions
+	ListenAddr string `long:"listenAddr" description:"address of the HTTP endpoint which the coordinator sends the segments to play to" default:"localhost:9190"`
+	SegmentDir string `long:"segmentDir" description:"directory the segments are stored in until they are played; defaults to the temporary directory"`
+	SecretFile string `long:"secretFile" value-name:"<filename>" description:"file holding the secret the coordinator must send with every request, shared with the --secretFile of 'coordinate'" required:"yes"`
+
+	secret string
+}
+
+// workerPlayRequest is the body of the requests to POST /play of a worker,
+// which plays a segment it was sent with the given play options at startAt.
+type workerPlayRequest struct {
+	Segment string            `json:"segment"`
+	Options workerPlayOptions `json:"options"`
+	StartAt time.Time         `json:"startAt"`
+}
+
+// workerPlayOptions are the play options a coordinator may have its workers
+// play with. They are limited to those shaping the traffic played, leaving
+// out the options which write files, run commands, listen on an address,
+// read stdin or play commands which drop data, as the worker runs them on
+// behalf of whoever can reach its endpoint.
+type workerPlayOptions struct {
+	Speed              float64  `json:"speed" long:"speed" default:"1.0"`
+	Repeat             int      `json:"repeat" long:"repeat" default:"1"`
+	Amplify            int      `json:"amplify" long:"amplify" default:"1"`
+	QueueTime          int      `json:"queueTime" long:"queueTime" default:"15"`
+	DrainTimeout       int      `json:"drainTimeout" long:"drainTimeout" default:"10"`
+	OpTimeout          int      `json:"opTimeout" long:"opTimeout"`
+	Timeout            int      `json:"timeout" long:"timeout"`
+	Retries            int      `json:"retries" long:"retries"`
+	RetryBackoff       int      `json:"retryBackoff" long:"retryBackoff" default:"100"`
+	CursorNotFound     string   `json:"cursorNotFound" long:"cursorNotFound" choice:"error" choice:"skip" choice:"reissue" choice:"abort" default:"error"`
+	ConnectionModel    string   `json:"connectionModel" long:"connectionModel" choice:"perConnection" choice:"pool" choice:"affinity" default:"perConnection"`
+	PoolSize           int      `json:"poolSize" long:"poolSize" default:"100"`
+	MaxConnsPerTarget  int      `json:"maxConnsPerTarget" long:"maxConnsPerTarget"`
+	WorkersPerHost     int      `json:"workersPerHost" long:"workersPerHost"`
+	MaxAwait           int      `json:"maxAwait" long:"maxAwait"`
+	TailableBudget     int      `json:"tailableBudget" long:"tailableBudget"`
+	ChangeStreamResume string   `json:"changeStreamResume" long:"changeStreamResume" choice:"remap" choice:"now" choice:"recorded" default:"remap"`
+	StrictOrder        bool     `json:"strictOrder" long:"strictOrder"`
+	Translate          bool     `json:"translate" long:"translate"`
+	Downconvert        bool     `json:"downconvert" long:"downconvert"`
+	Warmup             int      `json:"warmup" long:"warmup"`
+	NoDetect           bool     `json:"noDetect" long:"no-detect"`
+	NoPreprocess       bool     `json:"noPreprocess" long:"no-preprocess"`
+	FullSpeed          bool     `json:"fullSpeed" long:"fullSpeed"`
+	DryRun             bool     `json:"dryRun" long:"dryRun"`
+	Pacing             string   `json:"pacing" long:"pacing" choice:"recorded" choice:"adaptive" choice:"fixed" choice:"poisson" default:"recorded"`
+	Rate               float64  `json:"rate" long:"rate"`
+	RegenerateIDs      string   `json:"regenerateIds" long:"regenerateIds" choice:"none" choice:"objectId" choice:"prefix" default:"none"`
+	IDPrefix           string   `json:"idPrefix" long:"idPrefix"`
+	ShiftTime          string   `json:"shiftTime" long:"shiftTime"`
+	ReadsOnly          bool     `json:"readsOnly" long:"readsOnly"`
+	WritesOnly         bool     `json:"writesOnly" long:"writesOnly"`
+	APIVersion         string   `json:"apiVersion" long:"apiVersion" choice:"1"`
+	APIStrict          bool     `json:"apiStrict" long:"apiStrict"`
+	APIDeprecation     bool     `json:"apiDeprecationErrors" long:"apiDeprecationErrors"`
+	HedgedReads        string   `json:"hedgedReads" long:"hedgedReads" choice:"recorded" choice:"enabled" choice:"disabled" default:"recorded"`
+	ReadPref           string   `json:"readPreference" long:"readPreference"`
+	MaxErrorRate       string   `json:"maxErrorRate" long:"maxErrorRate"`
+	Assert             []string `json:"assert" long:"assert"`
+	KillCursors        bool     `json:"killCursors" long:"killCursors"`
+	BehindThreshold    int      `json:"behindThreshold" long:"behindThreshold" default:"1000"`
+	MaxLag             int      `json:"maxLag" long:"maxLag"`
+	SampleConnections  string   `json:"sampleConnections" long:"sampleConnections"`
+	SampleSeed         int64    `json:"sampleSeed" long:"sampleSeed"`
+	SpeedRamp          string   `json:"speedRamp" long:"speedRamp"`
+}
+
+// parseWorkerPlayOptions parses the play options of args, failing on any
+// option the workers don't accept.
+func parseWorkerPlayOptions(args []string) (workerPlayOptions, error) {
+	var options workerPlayOptions
+	rest, err := flags.NewParser(&options, flags.None).ParseArgs(args)
+	switch {
+	case err != nil:
+		return options, fmt.Errorf("invalid play options for the workers: %v", err)
+	case len(rest) > 0:
+		return options, fmt.Errorf("unknown argument: %s", rest[0])
+	}
+	return options, nil
+}
+
+// apply sets the options of play.
+func (options *workerPlayOptions) apply(play *PlayCommand) {
+	play.Speed = options.Speed
+	play.Repeat = options.Repeat
+	play.Amplify = options.Amplify
+	play.QueueTime = options.QueueTime
+	play.DrainTimeout = options.DrainTimeout
+	play.OpTimeout = options.OpTimeout
+	play.Timeout = options.Timeout
+	play.Retries = options.Retries
+	play.RetryBackoff = options.RetryBackoff
+	play.CursorNotFound = options.CursorNotFound
+	play.ConnectionModel = options.ConnectionModel
+	play.PoolSize = options.PoolSize
+	play.MaxConnsPerTarget = options.MaxConnsPerTarget
+	play.WorkersPerHost = options.WorkersPerHost
+	play.MaxAwait = options.MaxAwait
+	play.TailableBudget = options.TailableBudget
+	play.ChangeStreamResume = options.ChangeStreamResume
+	play.StrictOrder = options.StrictOrder
+	play.Translate = options.Translate
+	play.Downconvert = options.Downconvert
+	play.Warmup = options.Warmup
+	play.NoDetect = options.NoDetect
+	play.NoPreprocess = options.NoPreprocess
+	play.FullSpeed = options.FullSpeed
+	play.DryRun = options.DryRun
+	play.Pacing = options.Pacing
+	play.Rate = options.Rate
+	play.RegenerateIDs = options.RegenerateIDs
+	play.IDPrefix = options.IDPrefix
+	play.ShiftTime = options.ShiftTime
+	play.ReadsOnly = options.ReadsOnly
+	play.WritesOnly = options.WritesOnly
+	play.APIVersion = options.APIVersion
+	play.APIStrict = options.APIStrict
+	play.APIDeprecation = options.APIDeprecation
+	play.HedgedReads = options.HedgedReads
+	play.ReadPref = options.ReadPref
+	play.MaxErrorRate = options.MaxErrorRate
+	play.Assert = options.Assert
+	play.KillCursors = options.KillCursors
+	play.BehindThreshold = options.BehindThreshold
+	play.MaxLag = options.MaxLag
+	play.SampleConnections = options.SampleConnections
+	play.SampleSeed = options.SampleSeed
+	play.SpeedRamp = options.SpeedRamp
+}
+
+// readSecretFile returns the shared secret held by a file.
+func readSecretFile(path string) (string, error) {
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret file: %v", err)
+	}
+	if s := strings.TrimSpace(string(secret)); s != "" {
+		return s, nil
+	}
+	return "", fmt.Errorf("secret file %v is empty", path)
+}
+
+// workerSegment is the response of POST /segments, naming the segment
+// stored.
+type workerSegment struct {
+	Segment string `json:"segment"`
+}
+
+// workerMessage is a line of the response of POST /play, which streams a
+// message for the stat of every op played, then one with the outcome of
+// the playback.
+type workerMessage struct {
+	Stat *OpStat `json:"stat,omitempty"`
+	// StatErrors are the errors of Stat, which aren't serialized with it.
+	StatErrors []string `json:"statErrors,omitempty"`
+
+	Done              bool   `json:"done,omitempty"`
+	Error             string `json:"error,omitempty"`
+	ThresholdExceeded bool   `json:"thresholdExceeded,omitempty"`
+}
+
+// replayWorker serves the endpoint of 'worker', playing one segment at a
+// time.
+type replayWorker struct {
+	worker *WorkerCommand
+
+	mu       sync.Mutex
+	segments map[string]string
+	playing  bool
+}
+
+// ValidateParams validates the settings described in the WorkerCommand
+// struct.
+func (worker *WorkerCommand) ValidateParams(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unknown argument: %s", args[0])
+	}
+	target, err := worker.dialInfo(&worker.DialOptions)
+	if err != nil {
+		return err
+	}
+	// the password is asked for once, rather than by every playback
+	promptForPassword(target)
+	worker.Password = target.Password
+	if worker.secret, err = readSecretFile(worker.SecretFile); err != nil {
+		return err
+	}
+	if worker.SegmentDir == "" {
+		worker.SegmentDir = os.TempDir()
+	}
+	return nil
+}
+
+// Execute runs the program for the 'worker' subcommand
+func (worker *WorkerCommand) Execute(args []string) error {
+	err := worker.ValidateParams(args)
+	if err != nil {
+		return err
+	}
+	worker.GlobalOpts.SetLogging()
+
+	listener, err := net.Listen("tcp", worker.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("error listening for the coordinator: %v", err)
+	}
+	server := &http.Server{Handler: newReplayWorker(worker).handler()}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	userInfoLogger.Logvf(Always, "Waiting for segments to play on http://%v", listener.Addr())
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigChan)
+	select {
+	case s := <-sigChan:
+		toolDebugLogger.Logvf(Info, "Got signal %v, stopping", s)
+		server.Close()
+		return nil
+	case err := <-serveErr:
+		return fmt.Errorf("error serving the coordinator: %v", err)
+	}
+}
+
+func newReplayWorker(worker *WorkerCommand) *replayWorker {
+	return &replayWorker{worker: worker, segments: map[string]string{}}
+}
+
+// handler returns the handler of the worker's endpoint.
+func (w *replayWorker) handler() http.Handler {
+	mux := http.NewServeMux()
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		authorization := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(authorization, []byte("Bearer "+w.worker.secret)) != 1 {
+			http.Error(rw, "the request doesn't carry the secret of the worker", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(rw, r)
+	})
+	mux.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		json.NewEncoder(rw).Encode(map[string]interface{}{"playing": w.playing, "segments": len(w.segments)})
+	})
+	mux.HandleFunc("/segments", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(rw, "segments must be sent with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		segment, err := w.storeSegment(r.Body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(rw).Encode(workerSegment{Segment: segment})
+	})
+	mux.HandleFunc("/play", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(rw, "play must be requested with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		request := workerPlayRequest{Options: defaultWorkerPlayOptions()}
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil {
+			http.Error(rw, fmt.Sprintf("invalid play request: %v", err), http.StatusBadRequest)
+			return
+		}
+		w.mu.Lock()
+		path, ok := w.segments[request.Segment]
+		switch {
+		case !ok:
+			w.mu.Unlock()
+			http.Error(rw, fmt.Sprintf("unknown segment %q", request.Segment), http.StatusNotFound)
+			return
+		case w.playing:
+			w.mu.Unlock()
+			http.Error(rw, "already playing a segment", http.StatusConflict)
+			return
+		}
+		w.playing = true
+		delete(w.segments, request.Segment)
+		w.mu.Unlock()
+		defer func() {
+			w.mu.Lock()
+			w.playing = false
+			w.mu.Unlock()
+			os.Remove(path)
+		}()
+
+		stream := newWorkerStatStream(rw)
+		err := w.play(path, request, stream)
+		result := workerMessage{Done: true}
+		if err != nil {
+			result.Error = err.Error()
+			_, result.ThresholdExceeded = err.(ErrThresholdExceeded)
+		}
+		stream.send(result)
+	})
+	return handler
+}
+
+// defaultWorkerPlayOptions returns the play options with their defaults,
+// which those of a play request override.
+func defaultWorkerPlayOptions() workerPlayOptions {
+	options, _ := parseWorkerPlayOptions(nil)
+	return options
+}
+
+// storeSegment saves the segment sent to the worker, returning its name.
+func (w *replayWorker) storeSegment(body io.Reader) (string, error) {
+	file, err := ioutil.TempFile(w.worker.SegmentDir, "mongoreplay-segment-")
+	if err != nil {
+		return "", fmt.Errorf("error storing segment: %v", err)
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, body); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("error storing segment: %v", err)
+	}
+	segment := filepath.Base(file.Name())
+	w.mu.Lock()
+	w.segments[segment] = file.Name()
+	w.mu.Unlock()
+	toolDebugLogger.Logvf(DebugLow, "Stored segment %v", segment)
+	return segment, nil
+}
+
+// play plays a segment with the play options of the request, against the
+// server of the worker's options, once it is time to start.
+func (w *replayWorker) play(path string, request workerPlayRequest, stream *workerStatStream) error {
+	play := &PlayCommand{GlobalOpts: w.worker.GlobalOpts, remote: true}
+	if _, err := flags.NewParser(play, flags.None).ParseArgs(nil); err != nil {
+		return err
+	}
+	request.Options.apply(play)
+	play.DialOptions = w.worker.DialOptions
+	play.ConnectionOptions = w.worker.ConnectionOptions
+	play.PlaybackFile = path
+	play.Gzip = false
+	play.StatOptions.Recorder = stream
+
+	if wait := time.Until(request.StartAt); wait > 0 {
+		userInfoLogger.Logvf(Always, "Playing segment %v in %v", request.Segment, wait.Round(time.Millisecond))
+		time.Sleep(wait)
+	}
+	return play.Execute(nil)
+}
+
+// workerStatStream is the StatRecorder streaming the stats of the playback
+// of a segment to the coordinator.
+type workerStatStream struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	flusher http.Flusher
+	err     error
+}
+
+func newWorkerStatStream(rw http.ResponseWriter) *workerStatStream {
+	flusher, _ := rw.(http.Flusher)
+	return &workerStatStream{encoder: json.NewEncoder(rw), flusher: flusher}
+}
+
+// RecordStat streams a stat, without the data of its request and reply.
+func (s *workerStatStream) RecordStat(stat *OpStat) {
+	if stat == nil {
+		return
+	}
+	streamed := *stat
+	streamed.RequestData, streamed.ReplyData, streamed.Errors = nil, nil, nil
+	message := workerMessage{Stat: &streamed}
+	for _, err := range stat.Errors {
+		message.StatErrors = append(message.StatErrors, err.Error())
+	}
+	s.send(message)
+}
+
+// Close flushes the stats streamed.
+func (s *workerStatStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return s.err
+}
+
+func (s *workerStatStream) send(message workerMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	if s.err = s.encoder.Encode(message); s.err != nil {
+		toolDebugLogger.Logvf(Always, "error streaming stats to the coordinator: %v", s.err)
+		return
+	}
+	if message.Done && s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// stat returns the stat of a message, with its errors.
+func (message *workerMessage) stat() *OpStat {
+	stat := message.Stat
+	for _, err := range message.StatErrors {
+		stat.Errors = append(stat.Errors, errors.New(err))
+	}
+	return stat
+}
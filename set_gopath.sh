@@ -32,6 +32,7 @@ setgopath() {
 		cp -r `pwd`/mongorestore .gopath/src/$TOOLS_PKG
 		cp -r `pwd`/mongostat .gopath/src/$TOOLS_PKG
 		cp -r `pwd`/mongotop .gopath/src/$TOOLS_PKG
+		cp -r `pwd`/mongoreplay .gopath/src/$TOOLS_PKG
 		cp -r `pwd`/vendor/src/github.com/* .gopath/src/github.com
 		cp -r `pwd`/vendor/src/gopkg.in .gopath/src/
 		export GOPATH="$SOURCE_GOPATH;$VENDOR_GOPATH"